@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// readParams returns the params argument, read from stdin if it's "-".
+func readParams(arg string) (json.RawMessage, error) {
+	if arg == "" {
+		return nil, nil
+	}
+	params := []byte(arg)
+	if arg == "-" {
+		var err error
+		if params, err = io.ReadAll(os.Stdin); err != nil {
+			return nil, fmt.Errorf("failed to read params from stdin: %v", err)
+		}
+	}
+	if !json.Valid(params) {
+		return nil, fmt.Errorf("params are not valid JSON")
+	}
+	return params, nil
+}
+
+func main() {
+	app := &cli.App{
+		Name:      "arrakis-call",
+		Usage:     "Invoke a callback on the host from inside a VM",
+		ArgsUsage: "<method> [params_json | -]",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Aliases: []string{"t"},
+				Usage:   "How long each attempt may take",
+				Value:   guestcall.DefaultTimeout,
+			},
+			&cli.IntFlag{
+				Name:    "retries",
+				Aliases: []string{"r"},
+				Usage:   "How often to retry callbacks that didn't reach the host",
+				Value:   guestcall.DefaultMaxRetries,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			method := c.Args().Get(0)
+			if method == "" || c.Args().Len() > 2 {
+				return cli.ShowAppHelp(c)
+			}
+			params, err := readParams(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			retries := c.Int("retries")
+			if retries == 0 {
+				// Zero selects the default in guestcall.Options.
+				retries = -1
+			}
+			client := guestcall.New(guestcall.Options{
+				Timeout:    c.Duration("timeout"),
+				MaxRetries: retries,
+			})
+			result, err := client.CallRaw(context.Background(), method, params)
+			if err != nil {
+				return err
+			}
+			if len(result) == 0 {
+				result = json.RawMessage("null")
+			}
+			fmt.Println(string(result))
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
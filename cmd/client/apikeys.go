@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func printAPIKey(key serverapi.ApiKeyInfo) {
+	fmt.Printf("ID: %s\n", key.GetId())
+	fmt.Printf("Name: %s\n", key.GetName())
+	fmt.Printf("Permissions: %s\n", strings.Join(key.GetPermissions(), ", "))
+	if len(key.GetNamespaces()) > 0 {
+		fmt.Printf("Namespaces: %s\n", strings.Join(key.GetNamespaces(), ", "))
+	} else {
+		fmt.Println("Namespaces: all")
+	}
+	fmt.Printf("Created: %s\n", key.GetCreatedAt().Format(time.RFC3339))
+	if key.HasRevokedAt() {
+		fmt.Printf("Revoked: %s\n", key.GetRevokedAt().Format(time.RFC3339))
+	}
+}
+
+func createAPIKey(name string, permissions []string, namespaces []string) error {
+	req := serverapi.NewCreateApiKeyRequest(name, permissions)
+	if len(namespaces) > 0 {
+		req.SetNamespaces(namespaces)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminApikeysPost(context.Background()).CreateApiKeyRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("create API key", httpResp, err)
+	}
+
+	key := resp.GetApiKey()
+	return printOutput(resp, []string{key.GetId()}, func() {
+		printAPIKey(key)
+		fmt.Printf("Key: %s\n", resp.GetKey())
+		fmt.Println("The key is only shown once, store it now.")
+	})
+}
+
+func listAPIKeys() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminApikeysGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("list API keys", httpResp, err)
+	}
+
+	ids := make([]string, len(resp.GetApiKeys()))
+	for i, key := range resp.GetApiKeys() {
+		ids[i] = key.GetId()
+	}
+	return printOutput(resp, ids, func() {
+		fmt.Println("API keys:")
+		fmt.Println("-------------")
+		for _, key := range resp.GetApiKeys() {
+			printAPIKey(key)
+			fmt.Println("-------------")
+		}
+	})
+}
+
+func updateAPIKey(id string, permissions []string, namespaces []string, allNamespaces bool) error {
+	req := serverapi.NewUpdateApiKeyRequest()
+	if len(permissions) > 0 {
+		req.SetPermissions(permissions)
+	}
+	if allNamespaces {
+		req.SetNamespaces([]string{})
+	} else if len(namespaces) > 0 {
+		req.SetNamespaces(namespaces)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminApikeysIdPatch(context.Background(), id).UpdateApiKeyRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("update API key", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetId()}, func() { printAPIKey(*resp) })
+}
+
+func revokeAPIKey(id string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminApikeysIdDelete(context.Background(), id).Execute()
+	if err != nil {
+		return parseErrorResponse("revoke API key", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetId()}, func() { printAPIKey(*resp) })
+}
+
+var apiKeysCommand = &cli.Command{
+	Name:  "apikeys",
+	Usage: "Manage API keys, requires an admin key once any exist",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "create",
+			Usage: "Create an API key",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the key, VMs it starts are owned by this name",
+					Required: true,
+				},
+				&cli.StringSliceFlag{
+					Name:    "permission",
+					Aliases: []string{"p"},
+					Usage:   "Permission to grant: read, write or admin. Can be repeated",
+					Value:   cli.NewStringSlice("read", "write"),
+				},
+				&cli.StringSliceFlag{
+					Name:  "namespace",
+					Usage: "Namespace the key may use, all if not given. Can be repeated",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return createAPIKey(ctx.String("name"), ctx.StringSlice("permission"), ctx.StringSlice("namespace"))
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List API keys",
+			Action: func(ctx *cli.Context) error {
+				return listAPIKeys()
+			},
+		},
+		{
+			Name:  "update",
+			Usage: "Change the permissions or namespaces of an API key",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "ID of the key",
+					Required: true,
+				},
+				&cli.StringSliceFlag{
+					Name:    "permission",
+					Aliases: []string{"p"},
+					Usage:   "Replaces the key's permissions. Can be repeated",
+				},
+				&cli.StringSliceFlag{
+					Name:  "namespace",
+					Usage: "Replaces the key's namespaces. Can be repeated",
+				},
+				&cli.BoolFlag{
+					Name:  "all-namespaces",
+					Usage: "Let the key use every namespace",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return updateAPIKey(
+					ctx.String("id"),
+					ctx.StringSlice("permission"),
+					ctx.StringSlice("namespace"),
+					ctx.Bool("all-namespaces"),
+				)
+			},
+		},
+		{
+			Name:  "revoke",
+			Usage: "Revoke an API key",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "ID of the key",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return revokeAPIKey(ctx.String("id"))
+			},
+		},
+	},
+}
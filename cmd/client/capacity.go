@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// formatCapacityAmount formats `value` of `unit` for people, e.g. bytes as GiB.
+func formatCapacityAmount(value float64, unit string) string {
+	if unit == "bytes" {
+		return fmt.Sprintf("%.1f GiB", value/(1<<30))
+	}
+	return fmt.Sprintf("%.2f %s", value, unit)
+}
+
+func printCapacityResource(resource serverapi.CapacityResource) {
+	unit := resource.GetUnit()
+	fmt.Printf("  %s: %s of %s used", resource.GetResource(),
+		formatCapacityAmount(resource.GetUsed(), unit),
+		formatCapacityAmount(resource.GetCapacity(), unit))
+	if resource.HasGrowthPerDay() {
+		fmt.Printf(", growing %s a day", formatCapacityAmount(resource.GetGrowthPerDay(), unit))
+	}
+	if resource.HasExhaustsAt() {
+		fmt.Printf(", exhausted in %.1f days (%s)", resource.GetDaysLeft(), resource.GetExhaustsAt().Local().Format(time.RFC3339))
+	} else if resource.GetMessage() != "" {
+		fmt.Printf(", %s", resource.GetMessage())
+	}
+	fmt.Println()
+}
+
+func forecastCapacity(window string) error {
+	req := apiClient.DefaultAPI.V1AdminCapacityGet(context.Background())
+	if window != "" {
+		req = req.Window(window)
+	}
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("forecast capacity", httpResp, err)
+	}
+
+	// Resources forecast to run out, so that scripts can alert on them.
+	var exhausting []string
+	for _, resource := range resp.GetResources() {
+		if resource.HasExhaustsAt() {
+			exhausting = append(exhausting, resource.GetResource())
+		}
+	}
+	return printOutput(resp, exhausting, func() {
+		fmt.Printf("Forecast over %s from %d samples", resp.GetWindow(), resp.GetSamples())
+		if resp.HasFirstSampleAt() {
+			fmt.Printf(" since %s", resp.GetFirstSampleAt().Local().Format(time.RFC3339))
+		}
+		fmt.Println(":")
+		for _, resource := range resp.GetResources() {
+			printCapacityResource(resource)
+		}
+	})
+}
+
+var capacityCommand = &cli.Command{
+	Name:  "capacity",
+	Usage: "Forecast when the host runs out of CPU, memory or disk at its current growth",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "window",
+			Aliases: []string{"w"},
+			Usage:   "How far back to fit the growth over, e.g. 72h. Defaults to 168h",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return forecastCapacity(ctx.String("window"))
+	},
+}
+
+func printHostResource(name string, resource serverapi.HostResourceCapacity, unit string) {
+	format := func(value int64) string {
+		if unit == "bytes" {
+			return formatCapacityAmount(float64(value), unit)
+		}
+		return fmt.Sprintf("%d %s", value, unit)
+	}
+	fmt.Printf("  %s: %s of %s allocated, %s free\n", name,
+		format(resource.GetAllocated()), format(resource.GetTotal()), format(resource.GetFree()))
+}
+
+func showAllocation() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1HostCapacityGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get host capacity", httpResp, err)
+	}
+
+	var vmNames []string
+	for _, reservation := range resp.GetReservations() {
+		vmNames = append(vmNames, reservation.GetVmName())
+	}
+	return printOutput(resp, vmNames, func() {
+		fmt.Println("Host:")
+		printHostResource("vcpus", resp.GetVcpus(), "vcpus")
+		printHostResource("memory", resp.GetMemory(), "bytes")
+		printHostResource("disk", resp.GetDisk(), "bytes")
+		pool := resp.GetWarmPool()
+		fmt.Printf("Warm pool: %d stateful disks", pool.GetStatefulDisks())
+		for template, vms := range pool.GetVms() {
+			fmt.Printf(", %d VMs of %s", vms, template)
+		}
+		fmt.Println()
+		next := resp.GetNextVm()
+		fmt.Printf("Next VM: %d vcpus, %s memory, %s disk, ", next.GetVcpus(),
+			formatCapacityAmount(float64(next.GetMemoryBytes()), "bytes"),
+			formatCapacityAmount(float64(next.GetDiskBytes()), "bytes"))
+		if resp.GetFits() {
+			fmt.Println("fits")
+		} else {
+			fmt.Printf("doesn't fit: %s\n", strings.Join(resp.GetReasons(), "; "))
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tNAME\tSTATUS\tVCPUS\tMEMORY\tDISK\tPOOL")
+		for _, r := range resp.GetReservations() {
+			vcpus, memory := "-", "-"
+			if r.HasVcpus() {
+				vcpus = fmt.Sprint(r.GetVcpus())
+				memory = formatCapacityAmount(float64(r.GetMemoryBytes()), "bytes")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.GetNamespace(), r.GetVmName(), r.GetStatus(),
+				vcpus, memory, formatCapacityAmount(float64(r.GetDiskBytes()), "bytes"), r.GetPoolTemplate())
+		}
+		tw.Flush()
+	})
+}
+
+var allocationCommand = &cli.Command{
+	Name:  "allocation",
+	Usage: "Show the host's capacity, what its VMs reserve and whether another VM fits",
+	Action: func(ctx *cli.Context) error {
+		return showAllocation()
+	},
+}
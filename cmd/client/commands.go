@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func printCommandStatus(status *serverapi.VmCommandStatus) error {
+	return printOutput(status, []string{status.GetId()}, func() {
+		fmt.Printf("Command ID: %s\n", status.GetId())
+		fmt.Printf("Command: %s\n", status.GetCmd())
+		switch {
+		case status.GetRunning():
+			fmt.Println("State: running")
+		case status.HasExitCode():
+			fmt.Printf("State: exited %d\n", status.GetExitCode())
+		default:
+			fmt.Println("State: killed")
+		}
+		if status.GetError() != "" {
+			fmt.Printf("Error: %s\n", status.GetError())
+		}
+		fmt.Printf("Started: %s\n", status.GetStartedAt().Local().Format(time.RFC3339))
+		if status.HasExitedAt() {
+			fmt.Printf("Exited: %s\n", status.GetExitedAt().Local().Format(time.RFC3339))
+		}
+		if status.GetTruncated() {
+			fmt.Println("Output (older output dropped):")
+		} else {
+			fmt.Println("Output:")
+		}
+		fmt.Print(status.GetOutput())
+	})
+}
+
+func getCommandStatus(vmName string, id string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCmdIdGet(context.Background(), vmName, id).Execute()
+	if err != nil {
+		return parseErrorResponse("get command status", httpResp, err)
+	}
+	return printCommandStatus(resp)
+}
+
+func killCommand(vmName string, id string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCmdIdDelete(context.Background(), vmName, id).Execute()
+	if err != nil {
+		return parseErrorResponse("kill command", httpResp, err)
+	}
+	return printCommandStatus(resp)
+}
+
+func backgroundCommandFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "id",
+			Usage:    "ID of the command, as printed by run --background",
+			Required: true,
+		},
+	}
+}
+
+var runStatusCommand = &cli.Command{
+	Name:  "run-status",
+	Usage: "Show whether a background command is running, its exit code and output",
+	Flags: backgroundCommandFlags(),
+	Action: func(ctx *cli.Context) error {
+		return getCommandStatus(ctx.String("name"), ctx.String("id"))
+	},
+}
+
+var runKillCommand = &cli.Command{
+	Name:  "run-kill",
+	Usage: "Kill a background command and forget it",
+	Flags: backgroundCommandFlags(),
+	Action: func(ctx *cli.Context) error {
+		return killCommand(ctx.String("name"), ctx.String("id"))
+	},
+}
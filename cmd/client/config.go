@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// validateServerConfig sends the config file at `configPath` to the server to be checked against
+// its host and running config. The generated client has no body for it, so it's sent by hand.
+func validateServerConfig(configPath string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	cfg := apiClient.GetConfig()
+	serverURL, err := cfg.ServerURL(0, nil)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/v1/admin/config/validate", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	for key, value := range cfg.DefaultHeader {
+		req.Header.Set(key, value)
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to validate config: %v", err)
+	}
+	if httpResp.StatusCode >= 300 {
+		return parseErrorResponse("validate config", httpResp, fmt.Errorf("HTTP %d", httpResp.StatusCode))
+	}
+	defer httpResp.Body.Close()
+	var resp serverapi.ValidateConfigResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+
+	err = printOutput(&resp, nil, func() {
+		for _, check := range resp.GetChecks() {
+			fmt.Printf("[%-4s] %s: %s\n", strings.ToUpper(check.GetLevel()), check.GetCheck(), check.GetMessage())
+			if check.GetHint() != "" {
+				fmt.Printf("       -> %s\n", check.GetHint())
+			}
+		}
+		if len(resp.GetChanges()) == 0 {
+			fmt.Println("No changes from the running config")
+		} else {
+			fmt.Println("Changes from the running config:")
+		}
+		for _, change := range resp.GetChanges() {
+			applied := "on reload"
+			if !change.GetReloadable() {
+				applied = "on restart"
+			}
+			if change.GetRedacted() {
+				fmt.Printf("  %s: changed (%s)\n", change.GetKey(), applied)
+				continue
+			}
+			fmt.Printf("  %s: %q -> %q (%s)\n", change.GetKey(), change.GetRunning(), change.GetCandidate(), applied)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.GetValid() {
+		return cli.Exit("config is invalid", 1)
+	}
+	return nil
+}
+
+var validateConfigCommand = &cli.Command{
+	Name:  "validate-config",
+	Usage: "Check a config file against the server's host and running config without applying it, requires an admin key",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "file",
+			Aliases:  []string{"f"},
+			Usage:    "Path of the config file",
+			Required: true,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return validateServerConfig(ctx.String("file"))
+	},
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func containersHealth(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameContainersHealthGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("check container engine", httpResp, err)
+	}
+
+	if !resp.HasEngine() {
+		return fmt.Errorf("VM %s has no container engine", vmName)
+	}
+	if !resp.GetHealthy() {
+		return fmt.Errorf("%s in VM %s is unhealthy: %s", resp.GetEngine(), vmName, resp.GetError())
+	}
+	return printOutput(resp, []string{resp.GetEngine()}, func() {
+		fmt.Printf("%s %s in VM %s is healthy\n", resp.GetEngine(), resp.GetVersion(), vmName)
+	})
+}
+
+func runContainer(vmName string, image string, command []string, envFlags []string, workdir string, detach bool, timeoutSeconds int) error {
+	req := serverapi.NewContainerRunRequest(image)
+	req.Command = command
+	if len(envFlags) > 0 {
+		env, err := parseEnvFlags(envFlags)
+		if err != nil {
+			return err
+		}
+		req.SetEnv(env)
+	}
+	if workdir != "" {
+		req.SetWorkdir(workdir)
+	}
+	req.SetDetach(detach)
+	if timeoutSeconds > 0 {
+		req.SetTimeoutSeconds(int32(timeoutSeconds))
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameContainersPost(context.Background(), vmName).ContainerRunRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("run container", httpResp, err)
+	}
+
+	var ids []string
+	if resp.HasContainerId() {
+		ids = append(ids, resp.GetContainerId())
+	}
+	err = printOutput(resp, ids, func() {
+		fmt.Print(resp.GetStdout())
+		fmt.Fprint(os.Stderr, resp.GetStderr())
+	})
+	if err != nil {
+		return err
+	}
+	if resp.GetError() != "" {
+		return fmt.Errorf("failed to run container: %s", resp.GetError())
+	}
+	if resp.GetExitCode() != 0 {
+		return cli.Exit("", int(resp.GetExitCode()))
+	}
+	if resp.HasContainerId() {
+		log.Infof("started container %s in VM %s", resp.GetContainerId(), vmName)
+	}
+	return nil
+}
+
+var containersCommand = &cli.Command{
+	Name:  "containers",
+	Usage: "Run containers inside a VM whose image has Docker or Podman",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "health",
+			Usage: "Check that the VM's container engine can run containers",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return containersHealth(ctx.String("name"))
+			},
+		},
+		{
+			Name:      "run",
+			Usage:     "Run a container and print its output",
+			ArgsUsage: "[command [args...]]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "image",
+					Aliases:  []string{"i"},
+					Usage:    "Image to run, e.g. python:3.12-slim",
+					Required: true,
+				},
+				&cli.StringSliceFlag{
+					Name:    "env",
+					Aliases: []string{"e"},
+					Usage:   "Environment variable in KEY=VALUE form (can be specified multiple times)",
+				},
+				&cli.StringFlag{
+					Name:    "workdir",
+					Aliases: []string{"w"},
+					Usage:   "Working directory inside the container",
+				},
+				&cli.BoolFlag{
+					Name:    "detach",
+					Aliases: []string{"d"},
+					Usage:   "Leave the container running and print its ID",
+				},
+				&cli.IntFlag{
+					Name:  "timeout",
+					Usage: "Seconds the container may run before it is killed (default: 600)",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return runContainer(
+					ctx.String("name"),
+					ctx.String("image"),
+					ctx.Args().Slice(),
+					ctx.StringSlice("env"),
+					ctx.String("workdir"),
+					ctx.Bool("detach"),
+					ctx.Int("timeout"),
+				)
+			},
+		},
+	},
+}
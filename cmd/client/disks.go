@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func attachDisk(vmName string, disk serverapi.DataDisk) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameDisksPost(context.Background(), vmName).
+		DataDisk(disk).Execute()
+	if err != nil {
+		return parseErrorResponse("attach disk", httpResp, err)
+	}
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		log.Infof("attached disk %s of %d MiB to VM %s", resp.GetId(), resp.GetSizeBytes()>>20, vmName)
+		if resp.GetGuestPath() != "" {
+			log.Infof("mounted on %s", resp.GetGuestPath())
+		}
+	})
+}
+
+func detachDisk(vmName string, diskId string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameDisksIdDelete(context.Background(), vmName, diskId).Execute()
+	if err != nil {
+		return parseErrorResponse("detach disk", httpResp, err)
+	}
+	return printOutput(map[string]any{"vmName": vmName, "id": diskId, "detached": true}, []string{diskId}, func() {
+		log.Infof("detached disk %s of VM %s", diskId, vmName)
+	})
+}
+
+func resizeDisk(vmName string, diskId string, sizeMb int64) error {
+	req := serverapi.NewResizeDiskRequest()
+	req.SetSizeBytes(sizeMb << 20)
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameDisksIdResizePost(context.Background(), vmName, diskId).
+		ResizeDiskRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("resize disk", httpResp, err)
+	}
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		log.Infof("resized disk %s of VM %s to %d MiB", diskId, vmName, resp.GetSizeBytes()>>20)
+	})
+}
+
+var disksCommand = &cli.Command{
+	Name:  "disks",
+	Usage: "Manage the disks of a VM",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "attach",
+			Usage: "Hot-plug a new disk or a volume into a running VM",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "ID of the disk, its serial in the guest",
+					Required: true,
+				},
+				&cli.Int64Flag{
+					Name:  "size-mb",
+					Usage: "Size in MiB of a new, empty ext4 disk",
+				},
+				&cli.StringFlag{
+					Name:  "volume",
+					Usage: "Volume of the server's config to attach instead of a new disk",
+				},
+				&cli.StringFlag{
+					Name:  "guest-path",
+					Usage: "Where to mount the disk in the guest, unmounted if not set",
+				},
+				&cli.BoolFlag{
+					Name:  "read-only",
+					Usage: "Attach the volume read-only",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				disk := serverapi.DataDisk{Id: serverapi.PtrString(ctx.String("id"))}
+				if ctx.IsSet("size-mb") {
+					disk.SizeBytes = serverapi.PtrInt64(ctx.Int64("size-mb") << 20)
+				}
+				if ctx.IsSet("volume") {
+					disk.Volume = serverapi.PtrString(ctx.String("volume"))
+				}
+				if ctx.IsSet("guest-path") {
+					disk.GuestPath = serverapi.PtrString(ctx.String("guest-path"))
+				}
+				if ctx.Bool("read-only") {
+					disk.ReadOnly = serverapi.PtrBool(true)
+				}
+				return attachDisk(ctx.String("name"), disk)
+			},
+		},
+		{
+			Name:  "detach",
+			Usage: "Unmount a data disk in a running VM and unplug it",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "disk",
+					Usage:    "ID of the disk",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return detachDisk(ctx.String("name"), ctx.String("disk"))
+			},
+		},
+		{
+			Name:  "resize",
+			Usage: "Grow a disk of a running VM and the file system on it",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "disk",
+					Usage: "ID of the disk",
+					Value: "stateful",
+				},
+				&cli.Int64Flag{
+					Name:     "size-mb",
+					Usage:    "New size of the disk in MiB",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return resizeDisk(ctx.String("name"), ctx.String("disk"), ctx.Int64("size-mb"))
+			},
+		},
+	},
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const defaultFleetParallelism = 8
+
+var (
+	// The servers of client.fleet and the API key to send them, set from the config.
+	fleetServers []string
+	fleetAPIKey  string
+)
+
+// fleetServerResult is the outcome of a fleet command on one server.
+type fleetServerResult struct {
+	Server string `json:"server"`
+	Error  string `json:"error,omitempty"`
+	Result any    `json:"result,omitempty"`
+}
+
+// fleetResponse holds the outcome of a fleet command on every server, in the order they were given.
+type fleetResponse struct {
+	Servers   []fleetServerResult `json:"servers"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+}
+
+// onFleet runs `action` against every server of the fleet, at most --parallelism at a time, logging
+// each server's outcome as it finishes. A server fails if `action` returns an error.
+func onFleet(ctx *cli.Context, action func(client *serverapi.APIClient) (any, error)) (*fleetResponse, error) {
+	servers := fleetServers
+	if ctx.IsSet("server") {
+		servers = ctx.StringSlice("server")
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers to act on, list them in client.fleet of the config or pass --server")
+	}
+	parallelism := ctx.Int("parallelism")
+	if parallelism <= 0 {
+		return nil, fmt.Errorf("parallelism must be at least 1")
+	}
+
+	resp := &fleetResponse{Servers: make([]fleetServerResult, len(servers))}
+	sem := make(chan struct{}, parallelism)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		resp.Servers[i].Server = server
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var result any
+			client, err := createApiClient(server, fleetAPIKey)
+			if err == nil {
+				result, err = action(client)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			resp.Servers[i].Result = result
+			if err != nil {
+				resp.Servers[i].Error = err.Error()
+				resp.Failed++
+				log.Warnf("[%d/%d] %s: %v", resp.Succeeded+resp.Failed, len(servers), server, err)
+			} else {
+				resp.Succeeded++
+				log.Infof("[%d/%d] %s: done", resp.Succeeded+resp.Failed, len(servers), server)
+			}
+		}()
+	}
+	wg.Wait()
+	return resp, nil
+}
+
+// printFleetOutput prints `resp`, with `printResult` printing each successful server's result, and
+// fails if any server did.
+func printFleetOutput(resp *fleetResponse, ids []string, printResult func(result any)) error {
+	err := printOutput(resp, ids, func() {
+		for _, server := range resp.Servers {
+			fmt.Printf("Server: %s\n", server.Server)
+			if server.Error != "" {
+				fmt.Printf("Error: %s\n", server.Error)
+			}
+			if server.Result != nil {
+				printResult(server.Result)
+			}
+			fmt.Println("=============")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Failed > 0 {
+		return cli.Exit(fmt.Sprintf("failed on %d of %d servers", resp.Failed, len(resp.Servers)), 1)
+	}
+	return nil
+}
+
+func listFleetVMs(ctx *cli.Context) error {
+	resp, err := onFleet(ctx, func(client *serverapi.APIClient) (any, error) {
+		req := client.DefaultAPI.V1VmsGet(context.Background())
+		if selector := ctx.String("selector"); selector != "" {
+			req = req.LabelSelector(selector)
+		}
+		vms, httpResp, err := req.Execute()
+		if err != nil {
+			return nil, parseErrorResponse("list VMs", httpResp, err)
+		}
+		return vms, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, server := range resp.Servers {
+		if vms, ok := server.Result.(*serverapi.ListAllVMsResponse); ok {
+			for _, vm := range vms.GetVms() {
+				ids = append(ids, server.Server+"/"+vm.GetVmName())
+			}
+		}
+	}
+	return printFleetOutput(resp, ids, func(result any) {
+		for _, vm := range result.(*serverapi.ListAllVMsResponse).GetVms() {
+			fmt.Printf("  %s: %s %s\n", vm.GetVmName(), vm.GetStatus(), vm.GetIp())
+		}
+	})
+}
+
+func drainFleet(ctx *cli.Context) error {
+	resp, err := onFleet(ctx, func(client *serverapi.APIClient) (any, error) {
+		req := serverapi.NewCordonRequest()
+		if reason := ctx.String("reason"); reason != "" {
+			req.SetReason(reason)
+		}
+		status, httpResp, err := client.DefaultAPI.V1AdminCordonPost(context.Background()).CordonRequest(*req).Execute()
+		if err != nil {
+			return nil, parseErrorResponse("cordon server", httpResp, err)
+		}
+		return status, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, server := range resp.Servers {
+		if server.Error == "" {
+			ids = append(ids, server.Server)
+		}
+	}
+	return printFleetOutput(resp, ids, func(result any) {
+		status := result.(*serverapi.MaintenanceStatus)
+		fmt.Printf("Cordoned: %t, %d VMs\n", status.GetCordoned(), len(status.GetVms()))
+	})
+}
+
+func execOnFleet(ctx *cli.Context) error {
+	opts, err := commandOptionsFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := onFleet(ctx, func(client *serverapi.APIClient) (any, error) {
+		req := serverapi.NewFanOutCommandRequest(ctx.String("cmd"), ctx.String("selector"))
+		if opts.cwd != "" {
+			req.SetCwd(opts.cwd)
+		}
+		if len(opts.env) > 0 {
+			req.SetEnv(opts.env)
+		}
+		if opts.user != "" {
+			req.SetUser(opts.user)
+		}
+		results, httpResp, err := client.DefaultAPI.V1VmsCmdPost(context.Background()).FanOutCommandRequest(*req).Execute()
+		if err != nil {
+			return nil, parseErrorResponse("run command", httpResp, err)
+		}
+		if results.GetFailed() > 0 {
+			return results, fmt.Errorf("command failed in %d of %d VMs", results.GetFailed(), len(results.GetResults()))
+		}
+		return results, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, server := range resp.Servers {
+		if results, ok := server.Result.(*serverapi.FanOutCommandResponse); ok {
+			for _, result := range results.GetResults() {
+				ids = append(ids, server.Server+"/"+result.GetVmName())
+			}
+		}
+	}
+	return printFleetOutput(resp, ids, func(result any) {
+		for _, vm := range result.(*serverapi.FanOutCommandResponse).GetResults() {
+			fmt.Printf("VM Name: %s\n", vm.GetVmName())
+			if vm.HasExitCode() {
+				fmt.Printf("Exit Code: %d\n", vm.GetExitCode())
+			}
+			if vm.HasError() {
+				fmt.Printf("Error: %s\n", vm.GetError())
+			}
+			fmt.Printf("Output: %s\n", vm.GetOutput())
+			fmt.Println("-------------")
+		}
+	})
+}
+
+func destroyOnFleet(ctx *cli.Context) error {
+	// An empty selector matches every VM.
+	if strings.TrimSpace(ctx.String("selector")) == "" {
+		return fmt.Errorf("label selector cannot be empty")
+	}
+	resp, err := onFleet(ctx, func(client *serverapi.APIClient) (any, error) {
+		vms, httpResp, err := client.DefaultAPI.V1VmsGet(context.Background()).LabelSelector(ctx.String("selector")).Execute()
+		if err != nil {
+			return nil, parseErrorResponse("list VMs", httpResp, err)
+		}
+		destroyed := []string{}
+		var failed []string
+		for _, vm := range vms.GetVms() {
+			_, httpResp, err := client.DefaultAPI.V1VmsNameDelete(context.Background(), vm.GetVmName()).Force(ctx.Bool("force")).Execute()
+			if err != nil {
+				failed = append(failed, parseErrorResponse("destroy VM "+vm.GetVmName(), httpResp, err).Error())
+				continue
+			}
+			destroyed = append(destroyed, vm.GetVmName())
+		}
+		if len(failed) > 0 {
+			return destroyed, fmt.Errorf("%s", strings.Join(failed, "; "))
+		}
+		return destroyed, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, server := range resp.Servers {
+		if destroyed, ok := server.Result.([]string); ok {
+			for _, name := range destroyed {
+				ids = append(ids, server.Server+"/"+name)
+			}
+		}
+	}
+	return printFleetOutput(resp, ids, func(result any) {
+		fmt.Printf("Destroyed: %s\n", strings.Join(result.([]string), ", "))
+	})
+}
+
+var fleetCommand = &cli.Command{
+	Name:  "fleet",
+	Usage: "Act on every server listed in client.fleet of the config",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "server",
+			Usage: "Server to act on, as host:port, instead of those of the config. Can be repeated",
+		},
+		&cli.IntFlag{
+			Name:  "parallelism",
+			Usage: "How many servers are acted on at the same time",
+			Value: defaultFleetParallelism,
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List the VMs of every server",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "selector",
+					Aliases: []string{"l"},
+					Usage:   "Label selector of the VMs, e.g. team=infra,tier!=db",
+				},
+			},
+			Action: listFleetVMs,
+		},
+		{
+			Name:  "drain",
+			Usage: "Cordon every server so that it refuses new VMs, requires an admin key",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "reason",
+					Usage: "Why the servers are cordoned",
+				},
+			},
+			Action: drainFleet,
+		},
+		{
+			Name:  "exec",
+			Usage: "Run a command in every VM of every server whose labels match a selector",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "selector",
+					Aliases:  []string{"l"},
+					Usage:    "Label selector of the VMs, e.g. team=infra,tier!=db",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "cmd",
+					Aliases:  []string{"c"},
+					Usage:    "Command to run",
+					Required: true,
+				},
+			}, commandOptionFlags()...),
+			Action: execOnFleet,
+		},
+		{
+			Name:  "destroy",
+			Usage: "Destroy every VM of every server whose labels match a selector",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "selector",
+					Aliases:  []string{"l"},
+					Usage:    "Label selector of the VMs, e.g. team=infra,tier!=db",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Also destroy protected VMs. Requires an admin key",
+				},
+			},
+			Action: destroyOnFleet,
+		},
+	},
+}
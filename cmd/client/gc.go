@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func collectGarbage(reclaim bool) error {
+	var resp *serverapi.GarbageCollectionReport
+	var httpResp *http.Response
+	var err error
+	action := "list orphaned resources"
+	if reclaim {
+		action = "reclaim orphaned resources"
+		resp, httpResp, err = apiClient.DefaultAPI.V1AdminGcPost(context.Background()).Execute()
+	} else {
+		resp, httpResp, err = apiClient.DefaultAPI.V1AdminGcGet(context.Background()).Execute()
+	}
+	if err != nil {
+		return parseErrorResponse(action, httpResp, err)
+	}
+
+	names := make([]string, len(resp.GetResources()))
+	failed := 0
+	for i, resource := range resp.GetResources() {
+		names[i] = resource.GetName()
+		if resource.GetError() != "" {
+			failed++
+		}
+	}
+	if err := printOutput(resp, names, func() {
+		if len(resp.GetResources()) == 0 {
+			fmt.Println("No orphaned resources")
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tNAME\tDETAIL\tRECLAIMED")
+		for _, resource := range resp.GetResources() {
+			reclaimed := fmt.Sprintf("%t", resource.GetReclaimed())
+			if resource.GetError() != "" {
+				reclaimed = "failed: " + resource.GetError()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", resource.GetKind(), resource.GetName(), resource.GetDetail(), reclaimed)
+		}
+		tw.Flush()
+	}); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to reclaim %d orphaned resources", failed)
+	}
+	return nil
+}
+
+var gcCommand = &cli.Command{
+	Name:  "gc",
+	Usage: "List tap devices, hypervisors, directories and sockets no VM accounts for, requires an admin key",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "reclaim",
+			Usage: "Kill the hypervisors and remove the other resources found",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return collectGarbage(ctx.Bool("reclaim"))
+	},
+}
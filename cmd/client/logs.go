@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+// printConsoleLog copies the serial console output of the VM to stdout, as it prints if `follow`
+// is set.
+func printConsoleLog(vmName string, tail int, follow bool) error {
+	query := url.Values{}
+	if tail > 0 {
+		query.Set("tail", fmt.Sprint(tail))
+	}
+	if follow {
+		query.Set("follow", "true")
+	}
+	httpResp, err := transferRequest(http.MethodGet, "/v1/vms/"+url.PathEscape(vmName)+"/logs", query, nil, 0, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get console log: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("get console log", httpResp, fmt.Errorf("HTTP %d", httpResp.StatusCode))
+	}
+	defer httpResp.Body.Close()
+	_, err = io.Copy(os.Stdout, httpResp.Body)
+	return err
+}
+
+var logsCommand = &cli.Command{
+	Name:  "logs",
+	Usage: "Print the serial console output of a VM, e.g. to find out why it didn't boot",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "tail",
+			Usage: "Only print the last this many lines",
+		},
+		&cli.BoolFlag{
+			Name:    "follow",
+			Aliases: []string{"f"},
+			Usage:   "Keep printing output as the console prints it",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return printConsoleLog(ctx.String("name"), ctx.Int("tail"), ctx.Bool("follow"))
+	},
+}
@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -45,11 +49,12 @@ func parseErrorResponse(operation string, httpResp *http.Response, err error) er
 	return fmt.Errorf("failed to %s: %s (HTTP %d)", operation, string(body), httpResp.StatusCode)
 }
 
-func stopVM(vmName string) error {
+func stopVM(vmName string, force bool) error {
 	req := apiClient.DefaultAPI.V1VmsNamePatch(context.Background(), vmName)
 
 	req = req.V1VmsNamePatchRequest(serverapi.V1VmsNamePatchRequest{
 		Status: serverapi.PtrString("stopped"),
+		Force:  serverapi.PtrBool(force),
 	})
 
 	_, httpResp, err := req.Execute()
@@ -57,93 +62,194 @@ func stopVM(vmName string) error {
 		return parseErrorResponse("stop VM", httpResp, err)
 	}
 
-	log.Infof("successfully stopped VM: %s", vmName)
-	return nil
+	return printOutput(map[string]any{"vmName": vmName, "status": "stopped"}, []string{vmName}, func() { log.Infof("successfully stopped VM: %s", vmName) })
 }
 
-func destroyVM(vmName string) error {
-	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameDelete(context.Background(), vmName).Execute()
+func destroyVM(vmName string, force bool) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameDelete(context.Background(), vmName).Force(force).Execute()
 	if err != nil {
 		return parseErrorResponse("destroy VM", httpResp, err)
 	}
 
-	log.Infof("successfully destroyed VM: %s", vmName)
-	return nil
+	return printOutput(map[string]any{"vmName": vmName, "status": "destroyed"}, []string{vmName}, func() { log.Infof("successfully destroyed VM: %s", vmName) })
 }
 
-func destroyAllVMs() error {
-	_, httpResp, err := apiClient.DefaultAPI.V1VmsDelete(context.Background()).Execute()
+func destroyAllVMs(force bool) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsDelete(context.Background()).Force(force).Execute()
 	if err != nil {
 		return parseErrorResponse("destroy all VMs", httpResp, err)
 	}
 
-	log.Infof("destroyed all VMs")
-	return nil
+	return printOutput(resp, resp.GetProtectedVms(), func() {
+		if protected := resp.GetProtectedVms(); len(protected) > 0 {
+			log.Infof("destroyed all VMs except protected VMs: %s", strings.Join(protected, ", "))
+			return
+		}
+		log.Infof("destroyed all VMs")
+	})
 }
 
-func startVM(vmName string, kernel string, rootfs string, entryPoint string, snapshotId string) error {
+// parseLabels parses "key=value" flags into labels.
+func parseLabels(flags []string) (map[string]string, error) {
+	labels := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, must be key=value", flag)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+func startVM(vmName string, generateName string, kernel string, rootfs string, entryPoint string, snapshotId string, template string, baseImage string, protected bool, labels map[string]string, memory memoryOptions, readiness readinessOptions, restart restartOptions) error {
+	if (vmName == "") == (generateName == "") {
+		return fmt.Errorf("exactly one of --name and --generate-name is required")
+	}
+
 	var startVMRequest *serverapi.StartVMRequest
 	if snapshotId != "" {
 		// If snapshot ID is provided, restore the VM from the snapshot
 		startVMRequest = &serverapi.StartVMRequest{
-			VmName:     serverapi.PtrString(vmName),
 			SnapshotId: serverapi.PtrString(snapshotId),
 		}
 	} else {
 		startVMRequest = &serverapi.StartVMRequest{
-			VmName:     serverapi.PtrString(vmName),
 			Kernel:     serverapi.PtrString(kernel),
 			Rootfs:     serverapi.PtrString(rootfs),
 			EntryPoint: serverapi.PtrString(entryPoint),
+			Template:   serverapi.PtrString(template),
+		}
+		if baseImage != "" {
+			startVMRequest.SetBaseImage(baseImage)
 		}
+		memory.apply(startVMRequest)
 	}
+	if vmName != "" {
+		startVMRequest.SetVmName(vmName)
+	} else {
+		startVMRequest.SetGenerateName(generateName)
+	}
+	if protected {
+		startVMRequest.SetProtected(true)
+	}
+	if len(labels) > 0 {
+		startVMRequest.SetLabels(labels)
+	}
+	readiness.apply(startVMRequest)
+	restart.apply(startVMRequest)
 
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsPost(context.Background()).StartVMRequest(*startVMRequest).Execute()
 	if err != nil {
 		return parseErrorResponse("start VM", httpResp, err)
 	}
 
-	resp_bytes, err := resp.MarshalJSON()
+	return printOutput(resp, []string{resp.GetVmName()}, func() {
+		resp_bytes, _ := resp.MarshalJSON()
+		log.Infof("started VM: %v", string(resp_bytes))
+		if timing, ok := resp.GetTimingOk(); ok {
+			printBootTiming(timing)
+		}
+	})
+}
+
+// printBootTiming prints where the time of a VM start went, leaving out the phases it skipped.
+func printBootTiming(timing *serverapi.BootTiming) {
+	fmt.Printf("Started in %dms", timing.GetTotalMs())
+	if timing.GetPooled() {
+		fmt.Print(", from the warm pool")
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	phases := []struct {
+		name string
+		ms   *int64
+	}{
+		{"tap setup", timing.TapSetupMs},
+		{"hypervisor spawn", timing.HypervisorSpawnMs},
+		{"stateful disk", timing.StatefulDiskMs},
+		{"create VM", timing.CreateVmMs},
+		{"boot", timing.BootMs},
+		{"restore", timing.RestoreMs},
+		{"kernel boot", timing.KernelBootMs},
+		{"guest agent ready", timing.GuestAgentReadyMs},
+	}
+	for _, phase := range phases {
+		if phase.ms != nil {
+			fmt.Fprintf(w, "  %s\t%dms\n", phase.name, *phase.ms)
+		}
+	}
+	w.Flush()
+}
+
+func prewarm(template string, statefulDisks int, poolVMs int) error {
+	req := serverapi.NewPrewarmRequest(template)
+	req.SetStatefulDisks(int32(statefulDisks))
+	req.SetPoolVms(int32(poolVMs))
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminPrewarmPost(context.Background()).PrewarmRequest(*req).Execute()
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		return parseErrorResponse("prewarm host", httpResp, err)
 	}
-	log.Infof("started VM: %v", string(resp_bytes))
-	return nil
+
+	return printOutput(resp, resp.GetPooledVms(), func() {
+		log.Infof("prewarmed template: %s", resp.GetTemplate())
+		fmt.Printf("Images: %s\n", strings.Join(resp.GetImages(), ", "))
+		fmt.Printf("Stateful disks ready: %d\n", resp.GetStatefulDisksReady())
+		fmt.Printf("Pool VMs: %s\n", strings.Join(resp.GetPooledVms(), ", "))
+	})
 }
 
-func listAllVMs() error {
-	resp, httpResp, err := apiClient.DefaultAPI.V1VmsGet(context.Background()).Execute()
+func listAllVMs(labelSelector string) error {
+	req := apiClient.DefaultAPI.V1VmsGet(context.Background())
+	if labelSelector != "" {
+		req = req.LabelSelector(labelSelector)
+	}
+	resp, httpResp, err := req.Execute()
 	if err != nil {
 		return parseErrorResponse("list all VMs", httpResp, err)
 	}
 
-	// Format output to better show port forwards with descriptions
-	fmt.Println("Available VMs:")
-	fmt.Println("-------------")
+	vmNames := make([]string, len(resp.GetVms()))
+	for i, vm := range resp.GetVms() {
+		vmNames[i] = vm.GetVmName()
+	}
+	return printOutput(resp, vmNames, func() {
+		// Format output to better show port forwards with descriptions
+		fmt.Println("Available VMs:")
+		fmt.Println("-------------")
 
-	for _, vm := range resp.GetVms() {
-		fmt.Printf("VM Name: %s\n", vm.GetVmName())
-		fmt.Printf("Status: %s\n", vm.GetStatus())
-		fmt.Printf("IP Address: %s\n", vm.GetIp())
-		fmt.Printf("Tap Device: %s\n", vm.GetTapDeviceName())
+		for _, vm := range resp.GetVms() {
+			fmt.Printf("VM Name: %s\n", vm.GetVmName())
+			fmt.Printf("Status: %s\n", vm.GetStatus())
+			fmt.Printf("IP Address: %s\n", vm.GetIp())
+			fmt.Printf("Tap Device: %s\n", vm.GetTapDeviceName())
+			if labels := vm.GetLabels(); len(labels) > 0 {
+				keys := slices.Sorted(maps.Keys(labels))
+				pairs := make([]string, len(keys))
+				for i, key := range keys {
+					pairs[i] = key + "=" + labels[key]
+				}
+				fmt.Printf("Labels: %s\n", strings.Join(pairs, ","))
+			}
 
-		// Print port forwards with descriptions
-		if len(vm.GetPortForwards()) > 0 {
-			fmt.Println("Port Forwards:")
-			for _, pf := range vm.GetPortForwards() {
-				fmt.Printf("  %s -> %s: %s\n",
-					pf.GetHostPort(),
-					pf.GetGuestPort(),
-					pf.GetDescription())
+			// Print port forwards with descriptions
+			if len(vm.GetPortForwards()) > 0 {
+				fmt.Println("Port Forwards:")
+				for _, pf := range vm.GetPortForwards() {
+					fmt.Printf("  %s -> %s: %s\n",
+						pf.GetHostPort(),
+						pf.GetGuestPort(),
+						pf.GetDescription())
+				}
 			}
+			fmt.Println("-------------")
 		}
-		fmt.Println("-------------")
-	}
 
-	return nil
+	})
 }
 
-func createApiClient(serverAddr string) (*serverapi.APIClient, error) {
+func createApiClient(serverAddr string, apiKey string) (*serverapi.APIClient, error) {
 	host, port, err := net.SplitHostPort(serverAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse server address: %v", err)
@@ -168,9 +274,10 @@ func createApiClient(serverAddr string) (*serverapi.APIClient, error) {
 	configuration.Servers = serverapi.ServerConfigurations{
 		*serverConfiguration,
 	}
-	apiClient = serverapi.NewAPIClient(configuration)
-
-	return apiClient, nil
+	if apiKey != "" {
+		configuration.AddDefaultHeader("Authorization", "Bearer "+apiKey)
+	}
+	return serverapi.NewAPIClient(configuration), nil
 }
 
 func snapshotVM(vmName string, snapshotId string) error {
@@ -183,12 +290,43 @@ func snapshotVM(vmName string, snapshotId string) error {
 	if err != nil {
 		return parseErrorResponse("create snapshot", httpResp, err)
 	}
-	log.Infof("successfully created snapshot for VM %s with ID %s", vmName, resp.GetSnapshotId())
-	return nil
+	return printOutput(resp, []string{resp.GetSnapshotId()}, func() {
+		log.Infof("successfully created snapshot for VM %s with ID %s", vmName, resp.GetSnapshotId())
+	})
 }
 
 func restoreVM(vmName string, snapshotId string) error {
-	return startVM(vmName, "", "", "", snapshotId)
+	return startVM(vmName, "", "", "", "", snapshotId, "", "", false, nil, memoryOptions{}, readinessOptions{}, restartOptions{})
+}
+
+// forkSnapshot starts a new VM from a snapshot, leaving the snapshotted VM alone.
+func forkSnapshot(vmName string, generateName string, snapshotId string, protected bool, labels map[string]string, readiness readinessOptions, restart restartOptions) error {
+	if (vmName == "") == (generateName == "") {
+		return fmt.Errorf("exactly one of --name and --generate-name is required")
+	}
+	req := serverapi.StartVMRequest{}
+	if vmName != "" {
+		req.SetVmName(vmName)
+	} else {
+		req.SetGenerateName(generateName)
+	}
+	if protected {
+		req.SetProtected(true)
+	}
+	if len(labels) > 0 {
+		req.SetLabels(labels)
+	}
+	readiness.apply(&req)
+	restart.apply(&req)
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1SnapshotsIdStartPost(context.Background(), snapshotId).StartVMRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("start VM from snapshot", httpResp, err)
+	}
+	return printOutput(resp, []string{resp.GetVmName()}, func() {
+		respBytes, _ := resp.MarshalJSON()
+		log.Infof("started VM from snapshot: %v", string(respBytes))
+	})
 }
 
 func pauseVM(vmName string) error {
@@ -200,8 +338,9 @@ func pauseVM(vmName string) error {
 	if err != nil {
 		return parseErrorResponse("pause VM", httpResp, err)
 	}
-	log.Infof("successfully paused VM: %s", vmName)
-	return nil
+	return printOutput(map[string]any{"vmName": vmName, "status": "paused"}, []string{vmName}, func() {
+		log.Infof("successfully paused VM: %s", vmName)
+	})
 }
 
 func resumeVM(vmName string) error {
@@ -213,16 +352,26 @@ func resumeVM(vmName string) error {
 	if err != nil {
 		return parseErrorResponse("resume VM", httpResp, err)
 	}
-	log.Infof("successfully resumed VM: %s", vmName)
-	return nil
+	return printOutput(map[string]any{"vmName": vmName, "status": "running"}, []string{vmName}, func() {
+		log.Infof("successfully resumed VM: %s", vmName)
+	})
+}
+
+// uploadOptions apply to every file of an upload.
+type uploadOptions struct {
+	mode   string
+	uid    int
+	gid    int
+	mkdirs bool
 }
 
-func uploadFiles(vmName string, fileSpecs []string) error {
+func uploadFiles(vmName string, fileSpecs []string, opts uploadOptions) error {
 	if len(fileSpecs) == 0 || len(fileSpecs)%2 != 0 {
 		return fmt.Errorf("invalid number of file specifications: must be even")
 	}
 
 	apiFiles := make([]serverapi.VmFileUploadRequestFilesInner, len(fileSpecs)/2)
+	destPaths := make([]string, len(fileSpecs)/2)
 	for i := 0; i < len(fileSpecs); i += 2 {
 		sourcePath := fileSpecs[i]
 		destPath := fileSpecs[i+1]
@@ -238,6 +387,19 @@ func uploadFiles(vmName string, fileSpecs []string) error {
 			Path:    destPath,
 			Content: string(content),
 		}
+		if opts.mode != "" {
+			apiFiles[i/2].SetMode(opts.mode)
+		}
+		if opts.uid >= 0 {
+			apiFiles[i/2].SetUid(int32(opts.uid))
+		}
+		if opts.gid >= 0 {
+			apiFiles[i/2].SetGid(int32(opts.gid))
+		}
+		if opts.mkdirs {
+			apiFiles[i/2].SetMkdirs(true)
+		}
+		destPaths[i/2] = destPath
 	}
 
 	req := apiClient.DefaultAPI.V1VmsNameFilesPost(context.Background(), vmName)
@@ -250,14 +412,74 @@ func uploadFiles(vmName string, fileSpecs []string) error {
 		return parseErrorResponse("upload files", httpResp, err)
 	}
 
-	log.Infof("successfully uploaded %d files to VM: %s", len(fileSpecs)/2, vmName)
-	return nil
+	return printOutput(map[string]any{"vmName": vmName, "paths": destPaths}, destPaths, func() {
+		log.Infof("successfully uploaded %d files to VM: %s", len(fileSpecs)/2, vmName)
+	})
+}
+
+// parseEnvFlags parses environment variables given as KEY=VALUE flags.
+func parseEnvFlags(envFlags []string) (map[string]string, error) {
+	env := make(map[string]string, len(envFlags))
+	for _, flag := range envFlags {
+		key, value, found := strings.Cut(flag, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", flag)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// commandOptions are the working directory, environment and user of a command run in VMs.
+type commandOptions struct {
+	cwd  string
+	env  map[string]string
+	user string
+}
+
+func commandOptionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "cwd",
+			Usage: "Working directory of the command, relative to /tmp/server_files unless absolute",
+		},
+		&cli.StringSliceFlag{
+			Name:    "env",
+			Aliases: []string{"e"},
+			Usage:   "Environment variable in KEY=VALUE form (can be specified multiple times)",
+		},
+		&cli.StringFlag{
+			Name:    "user",
+			Aliases: []string{"u"},
+			Usage:   "User name or UID to run the command as, root if not set",
+		},
+	}
+}
+
+func commandOptionsFromFlags(ctx *cli.Context) (commandOptions, error) {
+	env, err := parseEnvFlags(ctx.StringSlice("env"))
+	if err != nil {
+		return commandOptions{}, err
+	}
+	return commandOptions{cwd: ctx.String("cwd"), env: env, user: ctx.String("user")}, nil
 }
 
-func runCommand(vmName string, cmd string) error {
+func runCommand(vmName string, cmd string, timeoutSeconds int, background bool, opts commandOptions) error {
 	req := serverapi.VmCommandRequest{
 		Cmd:      cmd,
-		Blocking: serverapi.PtrBool(true),
+		Blocking: serverapi.PtrBool(!background),
+	}
+	if timeoutSeconds > 0 {
+		req.SetTimeoutSeconds(int32(timeoutSeconds))
+	}
+	if opts.cwd != "" {
+		req.SetCwd(opts.cwd)
+	}
+	if len(opts.env) > 0 {
+		req.SetEnv(opts.env)
+	}
+	if opts.user != "" {
+		req.SetUser(opts.user)
 	}
 
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCmdPost(context.Background(), vmName).VmCommandRequest(req).Execute()
@@ -266,9 +488,69 @@ func runCommand(vmName string, cmd string) error {
 	}
 
 	if resp.GetError() != "" {
+		if outputFormat != outputTable && !quietOutput {
+			// Scripts parsing the output get the failed command's output too.
+			if err := printOutput(resp, nil, nil); err != nil {
+				return err
+			}
+		}
 		return fmt.Errorf("command failed: %s\nOutput: %s", resp.GetError(), resp.GetOutput())
 	}
-	fmt.Println(resp.GetOutput())
+	if background {
+		return printOutput(resp, []string{resp.GetId()}, func() {
+			fmt.Println(resp.GetOutput())
+			if resp.GetId() != "" {
+				fmt.Printf("Command ID: %s\n", resp.GetId())
+			}
+		})
+	}
+	return printOutput(resp, nil, func() { fmt.Println(resp.GetOutput()) })
+}
+
+func runCommandOnGroup(labelSelector string, cmd string, parallelism int, opts commandOptions) error {
+	req := serverapi.NewFanOutCommandRequest(cmd, labelSelector)
+	if parallelism > 0 {
+		req.SetParallelism(int32(parallelism))
+	}
+	if opts.cwd != "" {
+		req.SetCwd(opts.cwd)
+	}
+	if len(opts.env) > 0 {
+		req.SetEnv(opts.env)
+	}
+	if opts.user != "" {
+		req.SetUser(opts.user)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsCmdPost(context.Background()).FanOutCommandRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("run command", httpResp, err)
+	}
+
+	vmNames := make([]string, len(resp.GetResults()))
+	for i, result := range resp.GetResults() {
+		vmNames[i] = result.GetVmName()
+	}
+	err = printOutput(resp, vmNames, func() {
+		for _, result := range resp.GetResults() {
+			fmt.Printf("VM Name: %s\n", result.GetVmName())
+			if result.HasExitCode() {
+				fmt.Printf("Exit Code: %d\n", result.GetExitCode())
+			}
+			if result.HasError() {
+				fmt.Printf("Error: %s\n", result.GetError())
+			}
+			fmt.Printf("Output: %s\n", result.GetOutput())
+			fmt.Println("-------------")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if resp.GetFailed() > 0 {
+		return fmt.Errorf("command failed in %d of %d VMs", resp.GetFailed(), len(resp.GetResults()))
+	}
+	log.Infof("command succeeded in %d VMs", resp.GetSucceeded())
 	return nil
 }
 
@@ -279,36 +561,230 @@ func downloadFiles(vmName string, paths []string) error {
 		return parseErrorResponse("download files", httpResp, err)
 	}
 
-	for _, file := range resp.GetFiles() {
-		log.Infof("Downloaded file: %s", file.GetPath())
-		fmt.Printf("Content: %s\n", file.GetContent())
+	downloaded := make([]string, len(resp.GetFiles()))
+	for i, file := range resp.GetFiles() {
+		downloaded[i] = file.GetPath()
+	}
+	return printOutput(resp, downloaded, func() {
+		for _, file := range resp.GetFiles() {
+			if file.GetError() != "" {
+				log.Errorf("Failed to download %s: %s", file.GetPath(), file.GetError())
+				continue
+			}
+			log.Infof("Downloaded file: %s", file.GetPath())
+			fmt.Printf("Content: %s\n", file.GetContent())
+		}
+		if resp.GetTruncated() {
+			log.Warn("Patterns matched too many files, the rest were left out")
+		}
+	})
+}
+
+func searchFiles(vmName string, pattern string, searchPath string, globs []string, ignoreCase bool, includeHidden bool, maxResults int) error {
+	req := serverapi.NewVmFileSearchRequest(pattern)
+	if searchPath != "" {
+		req.SetPath(searchPath)
+	}
+	req.SetGlobs(globs)
+	req.SetIgnoreCase(ignoreCase)
+	req.SetIncludeHidden(includeHidden)
+	if maxResults > 0 {
+		req.SetMaxResults(int32(maxResults))
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameFilesSearchPost(context.Background(), vmName).VmFileSearchRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("search files", httpResp, err)
+	}
+
+	var paths []string
+	for _, match := range resp.GetMatches() {
+		if !slices.Contains(paths, match.GetPath()) {
+			paths = append(paths, match.GetPath())
+		}
+	}
+	err = printOutput(resp, paths, func() {
+		// Same format as grep -n so that the output works with editors and other tools.
+		for _, match := range resp.GetMatches() {
+			fmt.Printf("%s:%d:%s\n", match.GetPath(), match.GetLineNumber(), match.GetLine())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("%d matches in %d files searched", len(resp.GetMatches()), resp.GetFilesSearched())
+	if resp.GetTruncated() {
+		log.Warnf("stopped after %d matches, use --max-results to see more", len(resp.GetMatches()))
+	}
+	return nil
+}
+
+func loadModules(vmName string, modules []string) error {
+	req := serverapi.NewVmLoadModulesRequest(modules)
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameModulesPost(context.Background(), vmName).VmLoadModulesRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("load modules", httpResp, err)
+	}
+
+	var loaded, failed []string
+	for _, module := range resp.GetModules() {
+		if module.GetLoaded() {
+			loaded = append(loaded, module.GetName())
+		} else {
+			failed = append(failed, module.GetName())
+		}
+	}
+	err = printOutput(resp, loaded, func() {
+		for _, module := range resp.GetModules() {
+			if module.GetLoaded() {
+				log.Infof("loaded module: %s", module.GetName())
+			} else {
+				log.Errorf("failed to load module: %s: %s", module.GetName(), module.GetError())
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to load modules: %s", strings.Join(failed, ", "))
 	}
 	return nil
 }
 
+func mountVM(vmName string, guestPath string) error {
+	req := serverapi.NewVmMountRequest()
+	if guestPath != "" {
+		req.SetGuestPath(guestPath)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameMountPost(context.Background(), vmName).VmMountRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("mount VM filesystem", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetMountPath()}, func() {
+		log.Infof("mounted %s from VM %s read-only at %s", resp.GetGuestPath(), vmName, resp.GetMountPath())
+	})
+}
+
+func unmountVM(vmName string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameMountDelete(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("unmount VM filesystem", httpResp, err)
+	}
+
+	return printOutput(map[string]any{"vmName": vmName, "mounted": false}, []string{vmName}, func() {
+		log.Infof("unmounted filesystem of VM %s", vmName)
+	})
+}
+
+func transferVM(vmName string, owner string) error {
+	req := serverapi.NewVmOwnerRequest(owner)
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameOwnerPost(context.Background(), vmName).VmOwnerRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("transfer VM", httpResp, err)
+	}
+
+	return printOutput(map[string]any{"vmName": vmName, "owner": owner}, []string{vmName}, func() {
+		log.Infof("VM %s is now owned by %s", vmName, owner)
+	})
+}
+
+func protectVM(vmName string, protected bool) error {
+	req := apiClient.DefaultAPI.V1VmsNamePatch(context.Background(), vmName)
+	req = req.V1VmsNamePatchRequest(serverapi.V1VmsNamePatchRequest{
+		Protected: serverapi.PtrBool(protected),
+	})
+	_, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("change VM protection", httpResp, err)
+	}
+
+	return printOutput(map[string]any{"vmName": vmName, "protected": protected}, []string{vmName}, func() {
+		if protected {
+			log.Infof("VM %s is now protected", vmName)
+		} else {
+			log.Infof("VM %s is no longer protected", vmName)
+		}
+	})
+}
+
+func signURL(rawURL string, expiresIn string) error {
+	req := serverapi.NewSignUrlRequest(rawURL)
+	if expiresIn != "" {
+		req.SetExpiresIn(expiresIn)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1SignedurlsPost(context.Background()).SignUrlRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("sign URL", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetUrl()}, func() {
+		fmt.Printf("URL: %s\n", resp.GetUrl())
+		fmt.Printf("Expires: %s\n", resp.GetExpiresAt().Format(time.RFC3339))
+	})
+}
+
 func listVM(vmName string) error {
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameGet(context.Background(), vmName).Execute()
 	if err != nil {
 		return parseErrorResponse("get VM info", httpResp, err)
 	}
 
-	fmt.Printf("VM Name: %s\n", resp.GetVmName())
-	fmt.Printf("Status: %s\n", resp.GetStatus())
-	fmt.Printf("IP Address: %s\n", resp.GetIp())
-	fmt.Printf("Tap Device: %s\n", resp.GetTapDeviceName())
+	return printOutput(resp, []string{resp.GetVmName()}, func() {
+		fmt.Printf("VM Name: %s\n", resp.GetVmName())
+		fmt.Printf("Status: %s\n", resp.GetStatus())
+		fmt.Printf("IP Address: %s\n", resp.GetIp())
+		fmt.Printf("Tap Device: %s\n", resp.GetTapDeviceName())
+		if usage, ok := resp.GetDiskUsageBytesOk(); ok {
+			fmt.Printf("Disk Usage: %d MiB\n", *usage>>20)
+		}
+		if resp.GetOwner() != "" {
+			fmt.Printf("Owner: %s\n", resp.GetOwner())
+		}
+		if resp.GetProtected() {
+			fmt.Println("Protected: true")
+		}
+		if resp.GetAgentRestarts() > 0 {
+			fmt.Printf("Agent Restarts: %d\n", resp.GetAgentRestarts())
+			crash := resp.GetLastAgentCrash()
+			fmt.Printf("Last Agent Crash: %s at %s: %s\n",
+				crash.GetAgent(),
+				crash.GetTime().Format(time.RFC3339),
+				crash.GetReason())
+		}
+		if crash, ok := resp.GetLastCrashOk(); ok {
+			fmt.Printf("Restarts: %d\n", resp.GetRestarts())
+			fmt.Printf("Last Crash: %s: %s\n", crash.GetTime().Format(time.RFC3339), crash.GetReason())
+		}
+		if kill, ok := resp.GetLastOomKillOk(); ok {
+			fmt.Printf("OOM Kills: %d\n", resp.GetOomKills())
+			fmt.Printf("Last OOM Kill: %s in the %s: %s (pid %d)\n",
+				kill.GetTime().Format(time.RFC3339),
+				kill.GetSource(),
+				kill.GetProcess(),
+				kill.GetPid())
+		}
 
-	// Print port forwards with descriptions
-	if len(resp.GetPortForwards()) > 0 {
-		fmt.Println("Port Forwards:")
-		for _, pf := range resp.GetPortForwards() {
-			fmt.Printf("  %s -> %s: %s\n",
-				pf.GetHostPort(),
-				pf.GetGuestPort(),
-				pf.GetDescription())
+		if len(resp.GetServices()) > 0 {
+			fmt.Println("Services:")
+			for _, svc := range resp.GetServices() {
+				fmt.Printf("  %s: vsock port %d\n", svc.GetName(), svc.GetPort())
+			}
 		}
-	}
 
-	return nil
+		// Print port forwards with descriptions
+		if len(resp.GetPortForwards()) > 0 {
+			fmt.Println("Port Forwards:")
+			for _, pf := range resp.GetPortForwards() {
+				fmt.Printf("  %s -> %s: %s\n",
+					pf.GetHostPort(),
+					pf.GetGuestPort(),
+					pf.GetDescription())
+			}
+		}
+
+	})
 }
 
 func main() {
@@ -322,33 +798,50 @@ func main() {
 				Usage:   "Path to config file",
 				Value:   "./config.yaml",
 			},
+			&cli.StringFlag{
+				Name:    "api-key",
+				Usage:   "API key to authenticate with, overrides the config file",
+				EnvVars: []string{"ARRAKIS_API_KEY"},
+			},
 		},
 		Before: func(ctx *cli.Context) error {
+			if err := setOutput(ctx); err != nil {
+				return err
+			}
 			configPath := ctx.String("config")
 			clientConfig, err := config.GetClientConfig(configPath)
 			if err != nil {
 				return fmt.Errorf("failed to get client config: %v", err)
 			}
-			log.Infof("client config: %v", clientConfig)
+			log.Debugf("client config: %v", clientConfig)
 
+			apiKey := clientConfig.APIKey
+			if ctx.IsSet("api-key") {
+				apiKey = ctx.String("api-key")
+			}
 			apiClient, err = createApiClient(
 				fmt.Sprintf("%s:%s", clientConfig.ServerHost, clientConfig.ServerPort),
+				apiKey,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to initialize api client: %v", err)
 			}
+			fleetServers, fleetAPIKey = clientConfig.Fleet, apiKey
 			return nil
 		},
 		Commands: []*cli.Command{
 			{
 				Name:  "start",
 				Usage: "Start a VM",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
-						Name:     "name",
-						Aliases:  []string{"n"},
-						Usage:    "Name of the VM to create",
-						Required: true,
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Name of the VM to create",
+					},
+					&cli.StringFlag{
+						Name:  "generate-name",
+						Usage: "Prefix of a name the server completes with a random suffix, instead of --name",
 					},
 					&cli.StringFlag{
 						Name:    "kernel",
@@ -371,17 +864,74 @@ func main() {
 						Aliases: []string{"s"},
 						Usage:   "Path to snapshot directory to restore from",
 					},
-				},
+					&cli.StringFlag{
+						Name:    "template",
+						Aliases: []string{"t"},
+						Usage:   "Name of a template configured on the server",
+					},
+					&cli.StringFlag{
+						Name:  "base-image",
+						Usage: "Name of a base image configured on the server that the VM's stateful disk starts from",
+					},
+					&cli.BoolFlag{
+						Name:  "protected",
+						Usage: "Only let the VM be stopped or destroyed when forced with an admin key",
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "Label of the VM as key=value, can be repeated",
+					},
+				}, append(append(memoryFlags(), readinessFlags()...), restartFlags()...)...),
 				Action: func(ctx *cli.Context) error {
+					labels, err := parseLabels(ctx.StringSlice("label"))
+					if err != nil {
+						return err
+					}
+					memory, err := memoryFromFlags(ctx)
+					if err != nil {
+						return err
+					}
 					return startVM(
 						ctx.String("name"),
+						ctx.String("generate-name"),
 						ctx.String("kernel"),
 						ctx.String("rootfs"),
 						ctx.String("entry-point"),
 						ctx.String("snapshot"),
+						ctx.String("template"),
+						ctx.String("base-image"),
+						ctx.Bool("protected"),
+						labels,
+						memory,
+						readinessFromFlags(ctx),
+						restartFromFlags(ctx),
 					)
 				},
 			},
+			{
+				Name:  "prewarm",
+				Usage: "Warm up the server for a template",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "template",
+						Aliases:  []string{"t"},
+						Usage:    "Name of the template to warm up",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "stateful-disks",
+						Usage: "Number of stateful disks to pre-create",
+					},
+					&cli.IntFlag{
+						Name:  "pool-vms",
+						Usage: "Number of VMs to pre-boot",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return prewarm(ctx.String("template"), ctx.Int("stateful-disks"), ctx.Int("pool-vms"))
+				},
+			},
 			{
 				Name:  "stop",
 				Usage: "Stop a VM",
@@ -392,9 +942,13 @@ func main() {
 						Usage:    "Name of the VM to stop",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Stop the VM even if it's protected. Requires an admin key",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return stopVM(ctx.String("name"))
+					return stopVM(ctx.String("name"), ctx.Bool("force"))
 				},
 			},
 			{
@@ -407,23 +961,59 @@ func main() {
 						Usage:    "Name of the VM to destroy",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Destroy the VM even if it's protected. Requires an admin key",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return destroyVM(ctx.String("name"))
+					return destroyVM(ctx.String("name"), ctx.Bool("force"))
 				},
 			},
 			{
 				Name:  "destroy-all",
 				Usage: "Destroy all VMs",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Also destroy protected VMs. Requires an admin key",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					return destroyAllVMs()
+					return destroyAllVMs(ctx.Bool("force"))
+				},
+			},
+			{
+				Name:  "protect",
+				Usage: "Protect a VM from being stopped or destroyed unless an admin forces it",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "off",
+						Usage: "Lift the protection instead. Requires an admin key",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return protectVM(ctx.String("name"), !ctx.Bool("off"))
 				},
 			},
 			{
 				Name:  "list-all",
 				Usage: "List all VMs",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "selector",
+						Aliases: []string{"l"},
+						Usage:   "Only list VMs whose labels match, e.g. team=infra,tier!=db",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					return listAllVMs()
+					return listAllVMs(ctx.String("selector"))
 				},
 			},
 			{
@@ -483,6 +1073,51 @@ func main() {
 					return restoreVM(ctx.String("name"), ctx.String("id"))
 				},
 			},
+			{
+				Name:  "fork",
+				Usage: "Start a new VM from a snapshot, with its own name and IP",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Name of the new VM",
+					},
+					&cli.StringFlag{
+						Name:  "generate-name",
+						Usage: "Prefix of a name the server completes with a random suffix, instead of --name",
+					},
+					&cli.StringFlag{
+						Name:     "id",
+						Aliases:  []string{"i"},
+						Usage:    "ID of the snapshot to start from",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "protected",
+						Usage: "Only let the VM be stopped or destroyed when forced with an admin key",
+					},
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "Label of the VM as key=value, can be repeated",
+					},
+				}, append(readinessFlags(), restartFlags()...)...),
+				Action: func(ctx *cli.Context) error {
+					labels, err := parseLabels(ctx.StringSlice("label"))
+					if err != nil {
+						return err
+					}
+					return forkSnapshot(
+						ctx.String("name"),
+						ctx.String("generate-name"),
+						ctx.String("id"),
+						ctx.Bool("protected"),
+						labels,
+						readinessFromFlags(ctx),
+						restartFromFlags(ctx),
+					)
+				},
+			},
 			{
 				Name:  "pause",
 				Usage: "Pause a running VM",
@@ -529,15 +1164,38 @@ func main() {
 						Usage:    "File(s) to upload in format 'source,destination' (can be specified multiple times)",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "mode",
+						Usage: "Permissions of the files in octal, e.g. 0755",
+					},
+					&cli.IntFlag{
+						Name:  "uid",
+						Usage: "UID to own the files",
+						Value: -1,
+					},
+					&cli.IntFlag{
+						Name:  "gid",
+						Usage: "GID to own the files",
+						Value: -1,
+					},
+					&cli.BoolFlag{
+						Name:  "mkdirs",
+						Usage: "Create missing parent directories",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return uploadFiles(ctx.String("name"), ctx.StringSlice("file"))
+					return uploadFiles(ctx.String("name"), ctx.StringSlice("file"), uploadOptions{
+						mode:   ctx.String("mode"),
+						uid:    ctx.Int("uid"),
+						gid:    ctx.Int("gid"),
+						mkdirs: ctx.Bool("mkdirs"),
+					})
 				},
 			},
 			{
 				Name:  "run",
 				Usage: "Run a command in a VM",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "name",
 						Aliases:  []string{"n"},
@@ -550,9 +1208,50 @@ func main() {
 						Usage:    "Command to run",
 						Required: true,
 					},
+					&cli.IntFlag{
+						Name:  "timeout",
+						Usage: "Seconds to wait for the command, the server's default if 0. Background commands are killed after it if set",
+					},
+					&cli.BoolFlag{
+						Name:  "background",
+						Usage: "Return once the command started and print its ID, to follow it with run-status",
+					},
+				}, commandOptionFlags()...),
+				Action: func(ctx *cli.Context) error {
+					opts, err := commandOptionsFromFlags(ctx)
+					if err != nil {
+						return err
+					}
+					return runCommand(ctx.String("name"), ctx.String("cmd"), ctx.Int("timeout"), ctx.Bool("background"), opts)
 				},
+			},
+			{
+				Name:  "run-all",
+				Usage: "Run a command in every VM whose labels match a selector",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "selector",
+						Aliases:  []string{"l"},
+						Usage:    "Label selector of the VMs, e.g. team=infra,tier!=db",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "cmd",
+						Aliases:  []string{"c"},
+						Usage:    "Command to run",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "parallelism",
+						Usage: "How many VMs run the command at the same time, the server's default if 0",
+					},
+				}, commandOptionFlags()...),
 				Action: func(ctx *cli.Context) error {
-					return runCommand(ctx.String("name"), ctx.String("cmd"))
+					opts, err := commandOptionsFromFlags(ctx)
+					if err != nil {
+						return err
+					}
+					return runCommandOnGroup(ctx.String("selector"), ctx.String("cmd"), ctx.Int("parallelism"), opts)
 				},
 			},
 			{
@@ -568,7 +1267,7 @@ func main() {
 					&cli.StringSliceFlag{
 						Name:     "path",
 						Aliases:  []string{"p"},
-						Usage:    "Path(s) to download (can be specified multiple times)",
+						Usage:    "Path(s) to download, glob patterns or directories too (can be specified multiple times)",
 						Required: true,
 					},
 				},
@@ -576,9 +1275,185 @@ func main() {
 					return downloadFiles(ctx.String("name"), ctx.StringSlice("path"))
 				},
 			},
+			{
+				Name:  "search",
+				Usage: "Search file contents in a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "pattern",
+						Aliases:  []string{"e"},
+						Usage:    "Regular expression to search for",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "path",
+						Aliases: []string{"p"},
+						Usage:   "Directory or file to search",
+					},
+					&cli.StringSliceFlag{
+						Name:    "glob",
+						Aliases: []string{"g"},
+						Usage:   "Only search matching files, or exclude them when prefixed with '!' (can be specified multiple times)",
+					},
+					&cli.BoolFlag{
+						Name:    "ignore-case",
+						Aliases: []string{"i"},
+						Usage:   "Match case insensitively",
+					},
+					&cli.BoolFlag{
+						Name:  "hidden",
+						Usage: "Also search hidden files and directories",
+					},
+					&cli.IntFlag{
+						Name:  "max-results",
+						Usage: "Maximum number of matching lines to return",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return searchFiles(
+						ctx.String("name"),
+						ctx.String("pattern"),
+						ctx.String("path"),
+						ctx.StringSlice("glob"),
+						ctx.Bool("ignore-case"),
+						ctx.Bool("hidden"),
+						ctx.Int("max-results"),
+					)
+				},
+			},
+			{
+				Name:  "load-modules",
+				Usage: "Load kernel modules in a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:     "module",
+						Aliases:  []string{"m"},
+						Usage:    "Kernel module(s) to load (can be specified multiple times)",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return loadModules(ctx.String("name"), ctx.StringSlice("module"))
+				},
+			},
+			{
+				Name:  "mount",
+				Usage: "Mount a VM's filesystem read-only on the server host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "path",
+						Aliases: []string{"p"},
+						Usage:   "Guest directory to mount (default: /)",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return mountVM(ctx.String("name"), ctx.String("path"))
+				},
+			},
+			{
+				Name:  "unmount",
+				Usage: "Unmount a VM's filesystem from the server host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return unmountVM(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "transfer",
+				Usage: "Hand a VM over to another API key",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "owner",
+						Usage:    "Name of the API key to transfer the VM to",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return transferVM(ctx.String("name"), ctx.String("owner"))
+				},
+			},
+			{
+				Name:  "sign-url",
+				Usage: "Create a URL that gives read access to an API path without an API key",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "url",
+						Aliases:  []string{"u"},
+						Usage:    "API path to sign, e.g. /v1/vms/foo/files?paths=/tmp/report.html",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "expires-in",
+						Usage: "How long the URL works for, e.g. 1h. Defaults to 15m",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return signURL(ctx.String("url"), ctx.String("expires-in"))
+				},
+			},
+			snapshotPoliciesCommand,
+			socketsCommand,
+			shellCommand,
+			vmsCommand,
+			containersCommand,
+			exportSnapshotCommand,
+			compactSnapshotCommand,
+			importSnapshotCommand,
+			operationsCommand,
+			migrateCommand,
+			compactCommand,
+			disksCommand,
+			apiKeysCommand,
+			maintenanceCommand,
+			validateConfigCommand,
+			fleetCommand,
+			capacityCommand,
+			allocationCommand,
+			usageCommand,
+			gcCommand,
+			processesCommand,
+			runStatusCommand,
+			runKillCommand,
+			pushCommand,
+			pullCommand,
+			logsCommand,
 		},
 	}
 
+	app.Flags = append(app.Flags, outputFlags()...)
+	addOutputFlags(app.Commands)
+
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func printMaintenanceWindow(window serverapi.MaintenanceWindow) {
+	fmt.Printf("  %s: %s - %s", window.GetId(), window.GetStart().Format(time.RFC3339), window.GetEnd().Format(time.RFC3339))
+	if window.GetReason() != "" {
+		fmt.Printf(" (%s)", window.GetReason())
+	}
+	if window.GetActive() {
+		fmt.Print(" [active]")
+	}
+	fmt.Println()
+}
+
+func printMaintenanceStatus(status *serverapi.MaintenanceStatus) {
+	fmt.Printf("Cordoned: %t\n", status.GetCordoned())
+	if status.GetReason() != "" {
+		fmt.Printf("Reason: %s\n", status.GetReason())
+	}
+	if status.GetManuallyCordoned() {
+		fmt.Printf("Cordoned at: %s\n", status.GetCordonedAt().Format(time.RFC3339))
+	}
+	if len(status.GetWindows()) > 0 {
+		fmt.Println("Maintenance windows:")
+		for _, window := range status.GetWindows() {
+			printMaintenanceWindow(window)
+		}
+	}
+	if len(status.GetVms()) > 0 {
+		fmt.Println("VMs on the host:")
+		for _, vm := range status.GetVms() {
+			fmt.Printf("  %s/%s: %s", vm.GetNamespace(), vm.GetVmName(), vm.GetStatus())
+			if vm.GetProtected() {
+				fmt.Print(" [protected]")
+			}
+			fmt.Println()
+		}
+	}
+}
+
+// printMaintenanceOutput prints `status`, or the IDs of its maintenance windows if quiet.
+func printMaintenanceOutput(status *serverapi.MaintenanceStatus) error {
+	ids := make([]string, len(status.GetWindows()))
+	for i, window := range status.GetWindows() {
+		ids[i] = window.GetId()
+	}
+	return printOutput(status, ids, func() { printMaintenanceStatus(status) })
+}
+
+func cordonHost(reason string) error {
+	req := serverapi.NewCordonRequest()
+	if reason != "" {
+		req.SetReason(reason)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminCordonPost(context.Background()).CordonRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("cordon host", httpResp, err)
+	}
+
+	return printMaintenanceOutput(resp)
+}
+
+func uncordonHost() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminCordonDelete(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("uncordon host", httpResp, err)
+	}
+
+	return printMaintenanceOutput(resp)
+}
+
+func showMaintenance() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminMaintenanceGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get maintenance status", httpResp, err)
+	}
+
+	return printMaintenanceOutput(resp)
+}
+
+func scheduleMaintenance(start string, duration time.Duration, reason string) error {
+	startTime, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return fmt.Errorf("invalid start time, expected RFC 3339 e.g. 2024-06-01T22:00:00Z: %w", err)
+	}
+	req := serverapi.NewMaintenanceWindowRequest(startTime, startTime.Add(duration))
+	if reason != "" {
+		req.SetReason(reason)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminMaintenanceWindowsPost(context.Background()).MaintenanceWindowRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("schedule maintenance window", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		fmt.Println("Scheduled maintenance window:")
+		printMaintenanceWindow(*resp)
+	})
+}
+
+func cancelMaintenance(id string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminMaintenanceWindowsIdDelete(context.Background(), id).Execute()
+	if err != nil {
+		return parseErrorResponse("cancel maintenance window", httpResp, err)
+	}
+
+	return printMaintenanceOutput(resp)
+}
+
+var maintenanceCommand = &cli.Command{
+	Name:  "maintenance",
+	Usage: "Cordon the host and schedule maintenance windows, requires an admin key",
+	Action: func(ctx *cli.Context) error {
+		return showMaintenance()
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "cordon",
+			Usage: "Refuse new VMs until the host is uncordoned",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "reason",
+					Usage: "Why the host is cordoned",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return cordonHost(ctx.String("reason"))
+			},
+		},
+		{
+			Name:  "uncordon",
+			Usage: "Accept new VMs again",
+			Action: func(ctx *cli.Context) error {
+				return uncordonHost()
+			},
+		},
+		{
+			Name:  "schedule",
+			Usage: "Schedule a maintenance window, during which the host is cordoned",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "start",
+					Usage:    "Start of the window in RFC 3339, e.g. 2024-06-01T22:00:00Z",
+					Required: true,
+				},
+				&cli.DurationFlag{
+					Name:     "duration",
+					Usage:    "Length of the window, e.g. 2h",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "reason",
+					Usage: "What the maintenance is for",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return scheduleMaintenance(ctx.String("start"), ctx.Duration("duration"), ctx.String("reason"))
+			},
+		},
+		{
+			Name:  "cancel",
+			Usage: "Cancel a maintenance window",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "ID of the window",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return cancelMaintenance(ctx.String("id"))
+			},
+		},
+	},
+}
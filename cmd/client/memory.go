@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+// memoryOptions are the tmpfs, swap and OOM policy of a VM that starts with them.
+type memoryOptions struct {
+	tmpfs  []guesttuning.Tmpfs
+	swapMB int64
+	// Whether --swap-mb was given, since 0 turns off the template's swap.
+	swapSet bool
+
+	oomAction      string
+	oomGrowMB      int
+	oomMaxMemoryMB int
+}
+
+// memoryFlags are the flags of the commands that start VMs that `memoryFromFlags` reads.
+func memoryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "tmpfs",
+			Usage: "tmpfs mounted in the guest as path:size_mb, e.g. /tmp:512, can be repeated",
+		},
+		&cli.Int64Flag{
+			Name:  "swap-mb",
+			Usage: "Size of a swap file on the VM's stateful disk, 0 for none",
+		},
+		&cli.StringFlag{
+			Name:  "oom-action",
+			Usage: "What's done when the guest kills a process for running out of memory: none, grow-memory or restart",
+		},
+		&cli.IntFlag{
+			Name:  "oom-grow-mb",
+			Usage: "Memory added to the guest on every OOM kill with --oom-action grow-memory, 512 if not given",
+		},
+		&cli.IntFlag{
+			Name:  "oom-max-memory-mb",
+			Usage: "The most memory --oom-action grow-memory grows the guest to",
+		},
+	}
+}
+
+func memoryFromFlags(ctx *cli.Context) (memoryOptions, error) {
+	opts := memoryOptions{
+		swapMB:         ctx.Int64("swap-mb"),
+		swapSet:        ctx.IsSet("swap-mb"),
+		oomAction:      ctx.String("oom-action"),
+		oomGrowMB:      ctx.Int("oom-grow-mb"),
+		oomMaxMemoryMB: ctx.Int("oom-max-memory-mb"),
+	}
+	for _, flag := range ctx.StringSlice("tmpfs") {
+		t, err := guesttuning.ParseTmpfs(flag)
+		if err != nil {
+			return memoryOptions{}, err
+		}
+		opts.tmpfs = append(opts.tmpfs, t)
+	}
+	return opts, nil
+}
+
+// apply sets the tmpfs, swap and OOM policy of `req`.
+func (o memoryOptions) apply(req *serverapi.StartVMRequest) {
+	for _, t := range o.tmpfs {
+		req.Tmpfs = append(req.Tmpfs, serverapi.TmpfsMount{
+			Path:      serverapi.PtrString(t.Path),
+			SizeBytes: serverapi.PtrInt64(t.SizeBytes),
+		})
+	}
+	if o.swapSet {
+		req.SetSwapSizeBytes(o.swapMB << 20)
+	}
+	if o.oomAction != "" {
+		policy := serverapi.NewOomPolicy()
+		policy.SetAction(o.oomAction)
+		if o.oomGrowMB != 0 {
+			policy.SetGrowMb(int32(o.oomGrowMB))
+		}
+		if o.oomMaxMemoryMB != 0 {
+			policy.SetMaxMemoryMb(int32(o.oomMaxMemoryMB))
+		}
+		req.SetOomPolicy(*policy)
+	}
+}
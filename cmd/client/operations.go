@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const operationPollInterval = time.Second
+
+func printOperation(op *serverapi.Operation) {
+	fmt.Printf("%s: %s of %s, %s", op.GetId(), op.GetType(), op.GetTarget(), op.GetStatus())
+	if op.GetBytesTotal() > 0 {
+		fmt.Printf(" (%d%% of %d bytes)", op.GetBytesDone()*100/op.GetBytesTotal(), op.GetBytesTotal())
+	}
+	fmt.Println()
+	if op.GetError() != "" {
+		fmt.Printf("  Error: %s\n", op.GetError())
+	}
+	for key, value := range op.GetResult() {
+		fmt.Printf("  %s: %s\n", key, value)
+	}
+}
+
+// printOperationOutput prints `op`, or its ID if quiet.
+func printOperationOutput(op *serverapi.Operation) error {
+	return printOutput(op, []string{op.GetId()}, func() { printOperation(op) })
+}
+
+func listOperations() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1OperationsGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("list operations", httpResp, err)
+	}
+	ids := make([]string, len(resp.GetOperations()))
+	for i, op := range resp.GetOperations() {
+		ids[i] = op.GetId()
+	}
+	return printOutput(resp, ids, func() {
+		for _, op := range resp.GetOperations() {
+			printOperation(&op)
+		}
+	})
+}
+
+// waitForOperation polls the operation `id` until it's finished, printing its progress.
+func waitForOperation(id string) error {
+	lastPercent := int64(-1)
+	for {
+		op, httpResp, err := apiClient.DefaultAPI.V1OperationsIdGet(context.Background(), id).Execute()
+		if err != nil {
+			return parseErrorResponse("get operation", httpResp, err)
+		}
+		if op.GetStatus() != "running" {
+			if err := printOperationOutput(op); err != nil {
+				return err
+			}
+			if op.GetStatus() == "failed" {
+				return fmt.Errorf("operation %s failed", id)
+			}
+			return nil
+		}
+		if total := op.GetBytesTotal(); total > 0 && outputFormat == outputTable && !quietOutput {
+			if percent := op.GetBytesDone() * 100 / total; percent != lastPercent {
+				fmt.Printf("%d%%\n", percent)
+				lastPercent = percent
+			}
+		}
+		time.Sleep(operationPollInterval)
+	}
+}
+
+func exportSnapshot(snapshotId string, wait bool) error {
+	op, httpResp, err := apiClient.DefaultAPI.V1SnapshotsIdExportPost(context.Background(), snapshotId).Execute()
+	if err != nil {
+		return parseErrorResponse("export snapshot", httpResp, err)
+	}
+	if !wait {
+		return printOperationOutput(op)
+	}
+	return waitForOperation(op.GetId())
+}
+
+func compactSnapshot(snapshotId string, format string, wait bool) error {
+	req := serverapi.NewCompactSnapshotRequest()
+	if format != "" {
+		req.SetFormat(format)
+	}
+	op, httpResp, err := apiClient.DefaultAPI.V1SnapshotsIdCompactPost(context.Background(), snapshotId).
+		CompactSnapshotRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("compact snapshot", httpResp, err)
+	}
+	if !wait {
+		return printOperationOutput(op)
+	}
+	return waitForOperation(op.GetId())
+}
+
+func compactVM(vmName string, zeroFill bool, wait bool) error {
+	req := serverapi.NewCompactVMRequest()
+	if zeroFill {
+		req.SetZeroFill(true)
+	}
+	op, httpResp, err := apiClient.DefaultAPI.V1VmsNameCompactPost(context.Background(), vmName).
+		CompactVMRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("compact VM disk", httpResp, err)
+	}
+	if !wait {
+		return printOperationOutput(op)
+	}
+	return waitForOperation(op.GetId())
+}
+
+func importSnapshot(uri string, snapshotId string, wait bool) error {
+	req := serverapi.NewSnapshotImportRequest(uri)
+	if snapshotId != "" {
+		req.SetSnapshotId(snapshotId)
+	}
+	op, httpResp, err := apiClient.DefaultAPI.V1SnapshotsImportPost(context.Background()).SnapshotImportRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("import snapshot", httpResp, err)
+	}
+	if !wait {
+		return printOperationOutput(op)
+	}
+	return waitForOperation(op.GetId())
+}
+
+func migrateVM(vmName string, destination string, apiKey string, wait bool) error {
+	req := serverapi.NewMigrateVMRequest(destination)
+	if apiKey != "" {
+		req.SetApiKey(apiKey)
+	}
+	op, httpResp, err := apiClient.DefaultAPI.V1VmsNameMigratePost(context.Background(), vmName).MigrateVMRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("migrate VM", httpResp, err)
+	}
+	if !wait {
+		return printOperationOutput(op)
+	}
+	return waitForOperation(op.GetId())
+}
+
+// uploadSnapshot imports the snapshot archive at `archivePath`. The generated client only sends
+// JSON, so the archive is sent by hand.
+func uploadSnapshot(archivePath string, snapshotId string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cfg := apiClient.GetConfig()
+	serverURL, err := cfg.ServerURL(0, nil)
+	if err != nil {
+		return err
+	}
+	importURL := serverURL + "/v1/snapshots/import"
+	if snapshotId != "" {
+		importURL += "?snapshotId=" + url.QueryEscape(snapshotId)
+	}
+	req, err := http.NewRequest(http.MethodPost, importURL, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+	for key, value := range cfg.DefaultHeader {
+		req.Header.Set(key, value)
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload snapshot: %v", err)
+	}
+	if httpResp.StatusCode >= 300 {
+		return parseErrorResponse("upload snapshot", httpResp, fmt.Errorf("HTTP %d", httpResp.StatusCode))
+	}
+	defer httpResp.Body.Close()
+	var op serverapi.Operation
+	if err := json.NewDecoder(httpResp.Body).Decode(&op); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return printOperationOutput(&op)
+}
+
+var operationsCommand = &cli.Command{
+	Name:  "operations",
+	Usage: "List long-running operations, such as snapshot exports",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "wait",
+			Usage: "ID of an operation to wait for",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if id := ctx.String("wait"); id != "" {
+			return waitForOperation(id)
+		}
+		return listOperations()
+	},
+}
+
+var exportSnapshotCommand = &cli.Command{
+	Name:  "export-snapshot",
+	Usage: "Upload a snapshot to the server's snapshot store",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Aliases:  []string{"i"},
+			Usage:    "ID of the snapshot",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait for the upload and print its progress",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return exportSnapshot(ctx.String("id"), ctx.Bool("wait"))
+	},
+}
+
+var compactSnapshotCommand = &cli.Command{
+	Name:  "compact-snapshot",
+	Usage: "Rewrite the stateful disk of a snapshot without its zero blocks",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Aliases:  []string{"i"},
+			Usage:    "ID of the snapshot",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "raw or qcow2, the server's default if not set",
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait for the compaction and print its progress",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return compactSnapshot(ctx.String("id"), ctx.String("format"), ctx.Bool("wait"))
+	},
+}
+
+var compactCommand = &cli.Command{
+	Name:  "compact",
+	Usage: "Trim the stateful disk of a running VM and drop its zero blocks",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "zero-fill",
+			Usage: "Fill the free space with zeros first, for disks that can't be trimmed",
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait for the compaction and print its progress",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return compactVM(ctx.String("name"), ctx.Bool("zero-fill"), ctx.Bool("wait"))
+	},
+}
+
+var importSnapshotCommand = &cli.Command{
+	Name:  "import-snapshot",
+	Usage: "Import a snapshot exported by this or another server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "uri",
+			Usage: "s3:// URI of the snapshot archive",
+		},
+		&cli.StringFlag{
+			Name:    "file",
+			Aliases: []string{"f"},
+			Usage:   "Path of a snapshot archive to upload",
+		},
+		&cli.StringFlag{
+			Name:    "id",
+			Aliases: []string{"i"},
+			Usage:   "ID to register the snapshot as, instead of the one it was exported with",
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait for the download and print its progress",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		uri, file := ctx.String("uri"), ctx.String("file")
+		if (uri == "") == (file == "") {
+			return fmt.Errorf("exactly one of --uri and --file is required")
+		}
+		if file != "" {
+			return uploadSnapshot(file, ctx.String("id"))
+		}
+		return importSnapshot(uri, ctx.String("id"), ctx.Bool("wait"))
+	},
+}
+
+var migrateCommand = &cli.Command{
+	Name:  "migrate",
+	Usage: "Move a running VM to another arrakis server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "destination",
+			Aliases:  []string{"d"},
+			Usage:    "host:port of the server to move the VM to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "destination-api-key",
+			Usage: "Admin API key of the destination, if it requires authentication",
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait for the migration and print its progress",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return migrateVM(ctx.String("name"), ctx.String("destination"), ctx.String("destination-api-key"), ctx.Bool("wait"))
+	},
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of --output.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+var (
+	// How commands print their result, set from the flags by setOutput.
+	outputFormat = outputTable
+	// Whether commands print only the IDs of what they list or changed, one per line.
+	quietOutput bool
+)
+
+func outputFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format: table, json or yaml",
+			Value:   outputTable,
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Usage:   "Only print IDs, one per line",
+		},
+	}
+}
+
+// addOutputFlags adds the output flags to `commands` and their subcommands, so that they can be
+// given after the command as well as before it.
+func addOutputFlags(commands []*cli.Command) {
+	for _, command := range commands {
+		command.Flags = append(command.Flags, outputFlags()...)
+		command.Before = setOutput
+		addOutputFlags(command.Subcommands)
+	}
+}
+
+// setOutput sets the output format from the flags of the innermost command that was given them.
+func setOutput(ctx *cli.Context) error {
+	format, quiet := outputTable, false
+	lineage := ctx.Lineage()
+	for i := len(lineage) - 1; i >= 0; i-- {
+		c := lineage[i]
+		names := c.LocalFlagNames()
+		if slices.Contains(names, "output") || slices.Contains(names, "o") {
+			format = c.String("output")
+		}
+		if slices.Contains(names, "quiet") || slices.Contains(names, "q") {
+			quiet = c.Bool("quiet")
+		}
+	}
+	switch format {
+	case outputTable, outputJSON, outputYAML:
+	default:
+		return fmt.Errorf("invalid output format %q, must be table, json or yaml", format)
+	}
+	outputFormat, quietOutput = format, quiet
+	if quietOutput {
+		log.SetLevel(log.WarnLevel)
+	}
+	return nil
+}
+
+// printOutput prints the result of a command: `ids` if quiet, `resp` as JSON or YAML if asked
+// for, and otherwise whatever `printTable` prints for people.
+func printOutput(resp any, ids []string, printTable func()) error {
+	if quietOutput {
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	}
+	switch outputFormat {
+	case outputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(resp)
+	case outputYAML:
+		// Through JSON, so that fields are named as in the API rather than after the Go fields.
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		var value any
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		out, err := yaml.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	default:
+		printTable()
+		return nil
+	}
+}
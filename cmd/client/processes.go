@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// How often `processes logs --follow` polls for more output.
+const processLogsPollInterval = time.Second
+
+// processState describes whether `process` runs, or how it exited.
+func processState(process serverapi.Process) string {
+	if process.GetRunning() {
+		return "running"
+	}
+	return fmt.Sprintf("exited %d", process.GetExitCode())
+}
+
+func printProcess(process serverapi.Process) {
+	fmt.Printf("  %s: pid %d, %s, %d bytes of output: %s\n",
+		process.GetId(),
+		process.GetPid(),
+		processState(process),
+		process.GetOutputSize(),
+		process.GetCmd())
+}
+
+func listProcesses(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameProcessesGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("list processes", httpResp, err)
+	}
+
+	ids := make([]string, len(resp.GetProcesses()))
+	for i, process := range resp.GetProcesses() {
+		ids[i] = process.GetId()
+	}
+	return printOutput(resp, ids, func() {
+		if len(resp.GetProcesses()) == 0 {
+			fmt.Printf("VM %s has no processes started through the API\n", vmName)
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPID\tSTATE\tSTARTED\tOUTPUT\tCOMMAND")
+		for _, process := range resp.GetProcesses() {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\n",
+				process.GetId(),
+				process.GetPid(),
+				processState(process),
+				process.GetStartedAt().Local().Format(time.RFC3339),
+				process.GetOutputSize(),
+				process.GetCmd())
+		}
+		tw.Flush()
+	})
+}
+
+func startProcess(vmName string, command []string, envFlags []string, workdir string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("a command is required")
+	}
+	req := serverapi.NewProcessStartRequest(strings.Join(command, " "))
+	if len(envFlags) > 0 {
+		env, err := parseEnvFlags(envFlags)
+		if err != nil {
+			return err
+		}
+		req.SetEnv(env)
+	}
+	if workdir != "" {
+		req.SetWorkdir(workdir)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameProcessesPost(context.Background(), vmName).ProcessStartRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("start process", httpResp, err)
+	}
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		fmt.Println("Started process:")
+		printProcess(*resp)
+	})
+}
+
+// processLogs prints the output of the process `id` from `offset`, and with `follow` keeps
+// printing new output until the process exits.
+func processLogs(vmName string, id string, offset int64, follow bool) error {
+	for {
+		resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameProcessesIdOutputGet(context.Background(), vmName, id).
+			Offset(offset).Execute()
+		if err != nil {
+			return parseErrorResponse("get process output", httpResp, err)
+		}
+		if outputFormat != outputTable || quietOutput {
+			// Structured output is a single response, following makes no sense for it.
+			return printOutput(resp, []string{id}, nil)
+		}
+		if resp.GetTruncated() {
+			log.Warnf("output from %d to %d was dropped", offset, resp.GetOffset())
+		}
+		fmt.Print(resp.GetData())
+		offset = resp.GetNextOffset()
+		process := resp.GetProcess()
+		if !follow || (!process.GetRunning() && offset >= process.GetOutputSize()) {
+			return nil
+		}
+		if resp.GetData() == "" {
+			time.Sleep(processLogsPollInterval)
+		}
+	}
+}
+
+func signalProcess(vmName string, id string, signal string) error {
+	req := serverapi.NewProcessSignalRequest(signal)
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameProcessesIdSignalPost(context.Background(), vmName, id).
+		ProcessSignalRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("signal process", httpResp, err)
+	}
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		log.Infof("sent %s to process %s of VM %s", signal, id, vmName)
+	})
+}
+
+func killProcess(vmName string, id string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameProcessesIdDelete(context.Background(), vmName, id).Execute()
+	if err != nil {
+		return parseErrorResponse("kill process", httpResp, err)
+	}
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		log.Infof("killed process %s of VM %s", id, vmName)
+	})
+}
+
+func processNameFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "name",
+		Aliases:  []string{"n"},
+		Usage:    "Name of the VM",
+		Required: true,
+	}
+}
+
+func processIDFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "id",
+		Usage:    "ID of the process",
+		Required: true,
+	}
+}
+
+var processesCommand = &cli.Command{
+	Name:  "processes",
+	Usage: "Manage long-running processes in a VM's guest",
+	Flags: []cli.Flag{processNameFlag()},
+	Action: func(ctx *cli.Context) error {
+		return listProcesses(ctx.String("name"))
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "start",
+			Usage:     "Start a command detached in the guest and print its ID",
+			ArgsUsage: "COMMAND...",
+			Flags: []cli.Flag{
+				processNameFlag(),
+				&cli.StringSliceFlag{
+					Name:    "env",
+					Aliases: []string{"e"},
+					Usage:   "Environment variable in KEY=VALUE form (can be specified multiple times)",
+				},
+				&cli.StringFlag{
+					Name:    "workdir",
+					Aliases: []string{"w"},
+					Usage:   "Working directory in the guest",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return startProcess(ctx.String("name"), ctx.Args().Slice(), ctx.StringSlice("env"), ctx.String("workdir"))
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List the processes started through the API",
+			Flags: []cli.Flag{processNameFlag()},
+			Action: func(ctx *cli.Context) error {
+				return listProcesses(ctx.String("name"))
+			},
+		},
+		{
+			Name:  "logs",
+			Usage: "Print the output of a process",
+			Flags: []cli.Flag{
+				processNameFlag(),
+				processIDFlag(),
+				&cli.Int64Flag{
+					Name:  "offset",
+					Usage: "Offset in the output to print from",
+				},
+				&cli.BoolFlag{
+					Name:    "follow",
+					Aliases: []string{"f"},
+					Usage:   "Keep printing new output until the process exits",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return processLogs(ctx.String("name"), ctx.String("id"), ctx.Int64("offset"), ctx.Bool("follow"))
+			},
+		},
+		{
+			Name:  "signal",
+			Usage: "Send a signal to the process group of a process",
+			Flags: []cli.Flag{
+				processNameFlag(),
+				processIDFlag(),
+				&cli.StringFlag{
+					Name:    "signal",
+					Aliases: []string{"s"},
+					Usage:   "Name of the signal, e.g. TERM or SIGHUP",
+					Value:   "SIGTERM",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return signalProcess(ctx.String("name"), ctx.String("id"), ctx.String("signal"))
+			},
+		},
+		{
+			Name:  "kill",
+			Usage: "Kill a process and forget it",
+			Flags: []cli.Flag{processNameFlag(), processIDFlag()},
+			Action: func(ctx *cli.Context) error {
+				return killProcess(ctx.String("name"), ctx.String("id"))
+			},
+		},
+	},
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// readinessOptions say when a VM that a command starts counts as ready.
+type readinessOptions struct {
+	command            string
+	port               int
+	bootTimeoutSeconds int
+}
+
+// readinessFlags are the flags of the commands that start VMs that `readinessFromFlags` reads.
+func readinessFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "ready-cmd",
+			Usage: "Command in the guest that has to exit with 0 before the VM counts as ready",
+		},
+		&cli.IntFlag{
+			Name:  "ready-port",
+			Usage: "TCP port in the guest that has to accept connections before the VM counts as ready",
+		},
+		&cli.IntFlag{
+			Name:  "boot-timeout",
+			Usage: "Seconds the VM has to get ready before it's destroyed, the server's default if 0",
+		},
+	}
+}
+
+func readinessFromFlags(ctx *cli.Context) readinessOptions {
+	return readinessOptions{
+		command:            ctx.String("ready-cmd"),
+		port:               ctx.Int("ready-port"),
+		bootTimeoutSeconds: ctx.Int("boot-timeout"),
+	}
+}
+
+// apply sets the readiness probe and boot timeout of `req`.
+func (o readinessOptions) apply(req *serverapi.StartVMRequest) {
+	if o.command != "" || o.port != 0 {
+		probe := serverapi.NewReadinessProbe()
+		if o.command != "" {
+			probe.SetCommand(o.command)
+		}
+		if o.port != 0 {
+			probe.SetPort(int32(o.port))
+		}
+		req.SetReadiness(*probe)
+	}
+	if o.bootTimeoutSeconds != 0 {
+		req.SetBootTimeoutSeconds(int32(o.bootTimeoutSeconds))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// restartOptions say what happens once a VM that a command starts crashes.
+type restartOptions struct {
+	policy         string
+	maxRestarts    int
+	backoffSeconds int
+}
+
+// restartFlags are the flags of the commands that start VMs that `restartFromFlags` reads.
+func restartFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "restart",
+			Usage: "Restart policy once the VM crashes: never, on-failure or always",
+		},
+		&cli.IntFlag{
+			Name:  "max-restarts",
+			Usage: "Restarts after which a VM that keeps crashing is left crashed, no limit if 0",
+		},
+		&cli.IntFlag{
+			Name:  "restart-backoff",
+			Usage: "Seconds to wait before the first restart, doubled for every crash in a row",
+		},
+	}
+}
+
+func restartFromFlags(ctx *cli.Context) restartOptions {
+	return restartOptions{
+		policy:         ctx.String("restart"),
+		maxRestarts:    ctx.Int("max-restarts"),
+		backoffSeconds: ctx.Int("restart-backoff"),
+	}
+}
+
+// apply sets the restart policy of `req`.
+func (o restartOptions) apply(req *serverapi.StartVMRequest) {
+	if o.policy == "" && o.maxRestarts == 0 && o.backoffSeconds == 0 {
+		return
+	}
+	policy := serverapi.NewRestartPolicy()
+	if o.policy != "" {
+		policy.SetPolicy(o.policy)
+	}
+	if o.maxRestarts != 0 {
+		policy.SetMaxRestarts(int32(o.maxRestarts))
+	}
+	if o.backoffSeconds != 0 {
+		policy.SetBackoffSeconds(int32(o.backoffSeconds))
+	}
+	req.SetRestartPolicy(*policy)
+}
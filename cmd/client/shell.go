@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+// shellMessage is a text message of the shell WebSocket, see the server's vmShellWebSocket.
+type shellMessage struct {
+	Type     string `json:"type"`
+	Cols     uint16 `json:"cols,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// makeRaw puts the terminal `fd` into raw mode, so that keys such as Ctrl-C reach the guest rather
+// than this process, and returns a func that restores its previous mode.
+func makeRaw(fd int) (func(), error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	previous := *termios
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, &previous) }, nil
+}
+
+// terminalSize returns the size of the terminal `fd`, or zeros if it isn't one.
+func terminalSize(fd int) (uint16, uint16) {
+	winsize, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0
+	}
+	return winsize.Col, winsize.Row
+}
+
+// openShell runs an interactive shell in `vmName` on this terminal until it exits, and returns its
+// exit code.
+func openShell(vmName string) (int, error) {
+	cfg := apiClient.GetConfig()
+	serverURL, err := cfg.ServerURL(0, nil)
+	if err != nil {
+		return 0, err
+	}
+	wsURL, err := url.Parse(serverURL + "/v1/vms/" + url.PathEscape(vmName) + "/shell")
+	if err != nil {
+		return 0, err
+	}
+	wsURL.Scheme = strings.Replace(wsURL.Scheme, "http", "ws", 1)
+	query := url.Values{}
+	if term := os.Getenv("TERM"); term != "" {
+		query.Set("term", term)
+	}
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if cols, rows := terminalSize(stdout); cols > 0 && rows > 0 {
+		query.Set("cols", strconv.Itoa(int(cols)))
+		query.Set("rows", strconv.Itoa(int(rows)))
+	}
+	wsURL.RawQuery = query.Encode()
+	header := http.Header{}
+	for key, value := range cfg.DefaultHeader {
+		header.Set(key, value)
+	}
+
+	ws, httpResp, err := websocket.DefaultDialer.Dial(wsURL.String(), header)
+	if err != nil {
+		return 0, parseErrorResponse("open shell", httpResp, err)
+	}
+	defer ws.Close()
+
+	// Without a terminal, e.g. with input piped in, input is passed on as is.
+	if restore, err := makeRaw(stdin); err == nil {
+		defer restore()
+	}
+
+	// Only this goroutine writes to the WebSocket once the input is being read, so resizes are
+	// handed to it.
+	resizes := make(chan os.Signal, 1)
+	signal.Notify(resizes, syscall.SIGWINCH)
+	defer signal.Stop(resizes)
+	input := make(chan []byte)
+	go func() {
+		defer close(input)
+		for {
+			buf := make([]byte, 32<<10)
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				input <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case data, ok := <-input:
+				if !ok {
+					// End of input, e.g. of a pipe, ends the shell's input too.
+					ws.WriteMessage(websocket.BinaryMessage, []byte{4})
+					return
+				}
+				if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+					return
+				}
+			case <-resizes:
+				cols, rows := terminalSize(stdout)
+				if cols == 0 || rows == 0 {
+					continue
+				}
+				if err := ws.WriteJSON(shellMessage{Type: "resize", Cols: cols, Rows: rows}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		typ, data, err := ws.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == websocket.CloseNormalClosure {
+				return 0, errors.New("shell closed without an exit code")
+			}
+			return 0, fmt.Errorf("shell connection lost: %w", err)
+		}
+		if typ == websocket.BinaryMessage {
+			os.Stdout.Write(data)
+			continue
+		}
+		var msg shellMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "exit" {
+			continue
+		}
+		if msg.Error != "" {
+			return 0, fmt.Errorf("shell failed: %s", msg.Error)
+		}
+		return msg.ExitCode, nil
+	}
+}
+
+var shellCommand = &cli.Command{
+	Name:      "shell",
+	Usage:     "Open an interactive shell in a VM",
+	ArgsUsage: "<vm>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "name",
+			Aliases: []string{"n"},
+			Usage:   "Name of the VM, instead of the argument",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		vmName := ctx.String("name")
+		if vmName == "" {
+			vmName = ctx.Args().First()
+		}
+		if vmName == "" {
+			return errors.New("name of the VM is required")
+		}
+		exitCode, err := openShell(vmName)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return cli.Exit("", exitCode)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func printSnapshotPolicy(policy serverapi.SnapshotPolicy) {
+	fmt.Printf("  %s: %q, keeping %d\n", policy.GetId(), policy.GetSchedule(), policy.GetRetention())
+	fmt.Printf("    Next run: %s\n", policy.GetNextRun().Format(time.RFC3339))
+	if policy.HasLastRun() {
+		fmt.Printf("    Last run: %s", policy.GetLastRun().Format(time.RFC3339))
+		if policy.GetLastError() != "" {
+			fmt.Printf(" (failed: %s)", policy.GetLastError())
+		}
+		fmt.Println()
+	}
+	if len(policy.GetSnapshots()) > 0 {
+		fmt.Printf("    Snapshots: %s\n", strings.Join(policy.GetSnapshots(), ", "))
+	}
+}
+
+func listSnapshotPolicies(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSnapshotPoliciesGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("list snapshot policies", httpResp, err)
+	}
+
+	ids := make([]string, len(resp.GetPolicies()))
+	for i, policy := range resp.GetPolicies() {
+		ids[i] = policy.GetId()
+	}
+	return printOutput(resp, ids, func() {
+		if len(resp.GetPolicies()) == 0 {
+			fmt.Printf("VM %s has no snapshot policies\n", vmName)
+			return
+		}
+		fmt.Printf("Snapshot policies of VM %s:\n", vmName)
+		for _, policy := range resp.GetPolicies() {
+			printSnapshotPolicy(policy)
+		}
+	})
+}
+
+func createSnapshotPolicy(vmName string, schedule string, retention int) error {
+	req := serverapi.NewSnapshotPolicyRequest(schedule, int32(retention))
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSnapshotPoliciesPost(context.Background(), vmName).SnapshotPolicyRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("create snapshot policy", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		fmt.Println("Created snapshot policy:")
+		printSnapshotPolicy(*resp)
+	})
+}
+
+func deleteSnapshotPolicy(vmName string, id string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameSnapshotPoliciesIdDelete(context.Background(), vmName, id).Execute()
+	if err != nil {
+		return parseErrorResponse("delete snapshot policy", httpResp, err)
+	}
+	return printOutput(map[string]any{"vmName": vmName, "id": id, "deleted": true}, []string{id}, func() {
+		log.Infof("deleted snapshot policy %s of VM %s", id, vmName)
+	})
+}
+
+var snapshotPoliciesCommand = &cli.Command{
+	Name:  "snapshot-policies",
+	Usage: "Snapshot a VM on a schedule",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return listSnapshotPolicies(ctx.String("name"))
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "create",
+			Usage: "Snapshot the VM on a schedule, keeping only the newest snapshots",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "schedule",
+					Aliases:  []string{"s"},
+					Usage:    "Cron expression in UTC, e.g. \"0 */6 * * *\", or @hourly, @daily or \"@every 30m\"",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:     "retention",
+					Aliases:  []string{"r"},
+					Usage:    "How many snapshots to keep",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return createSnapshotPolicy(ctx.String("name"), ctx.String("schedule"), ctx.Int("retention"))
+			},
+		},
+		{
+			Name:  "delete",
+			Usage: "Delete a snapshot policy, keeping the snapshots it took",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "ID of the policy",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return deleteSnapshotPolicy(ctx.String("name"), ctx.String("id"))
+			},
+		},
+	},
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func printSocketForward(socket serverapi.SocketForward) {
+	fmt.Printf("  %s: %s -> %s (%d connections)\n",
+		socket.GetId(),
+		socket.GetHostPath(),
+		socket.GetGuestPath(),
+		socket.GetConnections())
+}
+
+func listSocketForwards(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSocketsGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("list exposed sockets", httpResp, err)
+	}
+
+	ids := make([]string, len(resp.GetSockets()))
+	for i, socket := range resp.GetSockets() {
+		ids[i] = socket.GetId()
+	}
+	return printOutput(resp, ids, func() {
+		if len(resp.GetSockets()) == 0 {
+			fmt.Printf("VM %s exposes no sockets\n", vmName)
+			return
+		}
+		fmt.Printf("Sockets exposed by VM %s:\n", vmName)
+		for _, socket := range resp.GetSockets() {
+			printSocketForward(socket)
+		}
+	})
+}
+
+func createSocketForward(vmName string, guestPath string) error {
+	req := serverapi.NewSocketForwardRequest(guestPath)
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSocketsPost(context.Background(), vmName).SocketForwardRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("expose socket", httpResp, err)
+	}
+
+	return printOutput(resp, []string{resp.GetId()}, func() {
+		fmt.Println("Exposed socket:")
+		printSocketForward(*resp)
+	})
+}
+
+func deleteSocketForward(vmName string, id string) error {
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameSocketsIdDelete(context.Background(), vmName, id).Execute()
+	if err != nil {
+		return parseErrorResponse("remove exposed socket", httpResp, err)
+	}
+	return printOutput(map[string]any{"vmName": vmName, "id": id, "deleted": true}, []string{id}, func() {
+		log.Infof("removed socket %s of VM %s", id, vmName)
+	})
+}
+
+// bridgeSocket listens on the local Unix socket `listenPath` and bridges every connection to the
+// socket at `guestPath` in `vmName` over the server's WebSocket endpoint, until interrupted.
+func bridgeSocket(vmName string, guestPath string, listenPath string) error {
+	cfg := apiClient.GetConfig()
+	serverURL, err := cfg.ServerURL(0, nil)
+	if err != nil {
+		return err
+	}
+	wsURL, err := url.Parse(serverURL + "/v1/vms/" + url.PathEscape(vmName) + "/sockets/ws")
+	if err != nil {
+		return err
+	}
+	wsURL.Scheme = strings.Replace(wsURL.Scheme, "http", "ws", 1)
+	wsURL.RawQuery = url.Values{"path": {guestPath}}.Encode()
+	header := http.Header{}
+	for key, value := range cfg.DefaultHeader {
+		header.Set(key, value)
+	}
+
+	listener, err := net.Listen("unix", listenPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(listenPath, 0600); err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Also removes the socket file.
+		listener.Close()
+	}()
+
+	log.Infof("bridging %s to %s in VM %s, press Ctrl-C to stop", listenPath, guestPath, vmName)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go bridgeWebSocket(conn, wsURL.String(), header)
+	}
+}
+
+// bridgeWebSocket copies bytes between `conn` and a new WebSocket to `wsURL` until either closes.
+func bridgeWebSocket(conn net.Conn, wsURL string, header http.Header) {
+	defer conn.Close()
+	ws, httpResp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		log.Error(parseErrorResponse("connect to guest socket", httpResp, err))
+		return
+	}
+	defer ws.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			if _, err := conn.Write(data); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	ws.Close()
+	<-done
+}
+
+var socketsCommand = &cli.Command{
+	Name:  "sockets",
+	Usage: "Expose Unix sockets of a VM's guest on the host",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return listSocketForwards(ctx.String("name"))
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "expose",
+			Usage: "Expose a Unix socket of the guest as a Unix socket on the server's host",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "path",
+					Aliases:  []string{"p"},
+					Usage:    "Absolute path of the socket in the guest, e.g. /var/run/docker.sock",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return createSocketForward(ctx.String("name"), ctx.String("path"))
+			},
+		},
+		{
+			Name:  "remove",
+			Usage: "Remove an exposed socket, leaving open connections alone",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "ID of the exposed socket",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return deleteSocketForward(ctx.String("name"), ctx.String("id"))
+			},
+		},
+		{
+			Name:  "bridge",
+			Usage: "Bridge a local Unix socket to a Unix socket of the guest over the API",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "name",
+					Aliases:  []string{"n"},
+					Usage:    "Name of the VM",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "path",
+					Aliases:  []string{"p"},
+					Usage:    "Absolute path of the socket in the guest, e.g. /var/run/docker.sock",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "listen",
+					Aliases:  []string{"l"},
+					Usage:    "Path of the local socket to create",
+					Required: true,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return bridgeSocket(ctx.String("name"), ctx.String("path"), ctx.String("listen"))
+			},
+		},
+	},
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const (
+	defaultPushChunkMB = 64
+	// How long push and pull wait before retrying a failed chunk, doubled after each failure.
+	transferRetryBackoff = time.Second
+)
+
+// transferRequest sends a request to the server's `path` with `query`, which the generated client
+// can't do for bodies and responses that aren't JSON.
+func transferRequest(method string, path string, query url.Values, body io.Reader, contentLength int64, header http.Header) (*http.Response, error) {
+	cfg := apiClient.GetConfig()
+	serverURL, err := cfg.ServerURL(0, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, serverURL+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	for key, value := range cfg.DefaultHeader {
+		req.Header.Set(key, value)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// pushChunk writes the `length` bytes of `f` from `offset` to the upload of `dest`, and returns
+// where the upload is at afterwards.
+func pushChunk(vmName string, f *os.File, dest string, offset int64, length int64, mkdirs bool) (int64, error) {
+	query := url.Values{
+		"path":   {dest},
+		"offset": {fmt.Sprint(offset)},
+		"mkdirs": {fmt.Sprint(mkdirs)},
+	}
+	httpResp, err := transferRequest(http.MethodPut, "/v1/vms/"+url.PathEscape(vmName)+"/uploads", query,
+		io.NewSectionReader(f, offset, length), length, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write upload: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return 0, parseErrorResponse("write upload", httpResp, fmt.Errorf("HTTP %d", httpResp.StatusCode))
+	}
+	defer httpResp.Body.Close()
+	var upload serverapi.FileUpload
+	if err := json.NewDecoder(httpResp.Body).Decode(&upload); err != nil {
+		return 0, fmt.Errorf("invalid response: %v", err)
+	}
+	return upload.GetOffset(), nil
+}
+
+// uploadOffset returns how much of the upload of `dest` the VM has.
+func uploadOffset(vmName string, dest string) (int64, error) {
+	upload, httpResp, err := apiClient.DefaultAPI.V1VmsNameUploadsGet(context.Background(), vmName).Path(dest).Execute()
+	if err != nil {
+		return 0, parseErrorResponse("get upload status", httpResp, err)
+	}
+	return upload.GetOffset(), nil
+}
+
+func fileSHA256(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// pushFile uploads `source` to `dest` in the VM in chunks of `chunkSize` bytes, resuming an upload
+// the VM already has unless `restart` is set. Failed chunks are sent again up to `retries` times.
+func pushFile(vmName string, source string, dest string, chunkSize int64, retries int, restart bool, opts uploadOptions) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	var offset int64
+	if !restart {
+		if offset, err = uploadOffset(vmName, dest); err != nil {
+			return err
+		}
+		if offset > size {
+			// Another file's upload, start over.
+			offset = 0
+		}
+		if offset > 0 {
+			fmt.Printf("Resuming upload of %s at %d of %d bytes\n", dest, offset, size)
+		}
+	}
+
+	// At least one chunk is sent, for empty files to be uploaded too.
+	for failures := 0; ; {
+		length := min(chunkSize, size-offset)
+		next, err := pushChunk(vmName, f, dest, offset, length, opts.mkdirs)
+		if err != nil {
+			failures++
+			if failures > retries {
+				return err
+			}
+			backoff := transferRetryBackoff << (failures - 1)
+			fmt.Fprintf(os.Stderr, "%v, retrying in %s\n", err, backoff)
+			time.Sleep(backoff)
+			// The chunk may have been written in part.
+			if next, err = uploadOffset(vmName, dest); err != nil {
+				return err
+			}
+			if next > size {
+				next = 0
+			}
+			offset = next
+			continue
+		}
+		failures = 0
+		offset = next
+		fmt.Printf("Uploaded %d of %d bytes\n", offset, size)
+		if offset >= size {
+			break
+		}
+	}
+
+	sum, err := fileSHA256(f)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %v", source, err)
+	}
+	commitReq := serverapi.FileUploadCommitRequest{
+		Path:   dest,
+		Size:   size,
+		Sha256: serverapi.PtrString(sum),
+	}
+	if opts.mode != "" {
+		commitReq.Mode = serverapi.PtrString(opts.mode)
+	}
+	if opts.uid >= 0 {
+		commitReq.Uid = serverapi.PtrInt32(int32(opts.uid))
+	}
+	if opts.gid >= 0 {
+		commitReq.Gid = serverapi.PtrInt32(int32(opts.gid))
+	}
+	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameUploadsCommitPost(context.Background(), vmName).FileUploadCommitRequest(commitReq).Execute()
+	if err != nil {
+		return parseErrorResponse("commit upload", httpResp, err)
+	}
+	fmt.Printf("Uploaded %s to %s (%d bytes, sha256 %s)\n", source, dest, size, sum)
+	return nil
+}
+
+// pullChunk appends the file `source` of the VM, from the end of `f`, to `f`. Returns true once
+// the whole file is there, or whether it's worth trying again if it failed.
+func pullChunk(vmName string, source string, f *os.File) (bool, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	offset := info.Size()
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	httpResp, err := transferRequest(http.MethodGet, "/v1/vms/"+url.PathEscape(vmName)+"/files/raw",
+		url.Values{"path": {source}}, nil, 0, header)
+	if err != nil {
+		return false, true, fmt.Errorf("failed to download file: %v", err)
+	}
+	if httpResp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+		httpResp.Body.Close()
+		// The file isn't any longer than what we have.
+		return true, false, nil
+	}
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusPartialContent {
+		return false, httpResp.StatusCode >= 500, parseErrorResponse("download file", httpResp, fmt.Errorf("HTTP %d", httpResp.StatusCode))
+	}
+	defer httpResp.Body.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, false, err
+	}
+	written, err := io.Copy(f, httpResp.Body)
+	if err != nil {
+		return false, true, fmt.Errorf("download stopped after %d bytes: %v", offset+written, err)
+	}
+	if httpResp.ContentLength >= 0 && written != httpResp.ContentLength {
+		return false, true, fmt.Errorf("download stopped after %d bytes", offset+written)
+	}
+	return true, false, nil
+}
+
+// pullFile downloads the file `source` of the VM to `dest`, resuming from the end of `dest` if it
+// exists unless `restart` is set. Interrupted downloads are resumed up to `retries` times.
+func pullFile(vmName string, source string, dest string, retries int, restart bool) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	if restart {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(dest, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for failures := 0; ; {
+		done, retry, err := pullChunk(vmName, source, f)
+		if done {
+			break
+		}
+		failures++
+		if !retry || failures > retries {
+			return err
+		}
+		backoff := transferRetryBackoff << (failures - 1)
+		fmt.Fprintf(os.Stderr, "%v, retrying in %s\n", err, backoff)
+		time.Sleep(backoff)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Downloaded %s to %s (%d bytes)\n", source, dest, info.Size())
+	return nil
+}
+
+var pushCommand = &cli.Command{
+	Name:  "push",
+	Usage: "Upload a file of any size to a VM in chunks, resuming an interrupted upload",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "source",
+			Aliases:  []string{"s"},
+			Usage:    "Local file to upload",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "dest",
+			Aliases:  []string{"d"},
+			Usage:    "Absolute path of the file in the VM",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "chunk-mb",
+			Usage: "Size of the chunks sent in one request, in MiB",
+			Value: defaultPushChunkMB,
+		},
+		&cli.IntFlag{
+			Name:  "retries",
+			Usage: "How many times a failed chunk is sent again",
+			Value: 5,
+		},
+		&cli.BoolFlag{
+			Name:  "restart",
+			Usage: "Start over instead of resuming an earlier upload",
+		},
+		&cli.StringFlag{
+			Name:  "mode",
+			Usage: "Permissions of the file in octal, e.g. 0755",
+		},
+		&cli.IntFlag{
+			Name:  "uid",
+			Usage: "UID to own the file",
+			Value: -1,
+		},
+		&cli.IntFlag{
+			Name:  "gid",
+			Usage: "GID to own the file",
+			Value: -1,
+		},
+		&cli.BoolFlag{
+			Name:  "mkdirs",
+			Usage: "Create missing parent directories",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.Int("chunk-mb") <= 0 {
+			return errors.New("--chunk-mb must be positive")
+		}
+		return pushFile(ctx.String("name"), ctx.String("source"), ctx.String("dest"),
+			int64(ctx.Int("chunk-mb"))<<20, ctx.Int("retries"), ctx.Bool("restart"), uploadOptions{
+				mode:   ctx.String("mode"),
+				uid:    ctx.Int("uid"),
+				gid:    ctx.Int("gid"),
+				mkdirs: ctx.Bool("mkdirs"),
+			})
+	},
+}
+
+var pullCommand = &cli.Command{
+	Name:  "pull",
+	Usage: "Download a file of any size from a VM, resuming an interrupted download",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Aliases:  []string{"n"},
+			Usage:    "Name of the VM",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "source",
+			Aliases:  []string{"s"},
+			Usage:    "Absolute path of the file in the VM",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "dest",
+			Aliases:  []string{"d"},
+			Usage:    "Local file to write; an existing one is taken as the start of the download",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "retries",
+			Usage: "How many times an interrupted download is resumed",
+			Value: 5,
+		},
+		&cli.BoolFlag{
+			Name:  "restart",
+			Usage: "Start over instead of resuming from the end of the local file",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return pullFile(ctx.String("name"), ctx.String("source"), ctx.String("dest"), ctx.Int("retries"), ctx.Bool("restart"))
+	},
+}
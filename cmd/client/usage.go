@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func usageReport() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1AdminUsageGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get usage report", httpResp, err)
+	}
+
+	vmNames := make([]string, len(resp.GetVms()))
+	for i, vm := range resp.GetVms() {
+		vmNames[i] = vm.GetVmName()
+	}
+	return printOutput(resp, vmNames, func() {
+		fmt.Printf("Usage since %s", resp.GetSince().Local().Format(time.RFC3339))
+		if resp.GetEnergySource() != "" {
+			fmt.Printf(", host CPU energy %.0f J (%s)", resp.GetHostEnergyJoules(), resp.GetEnergySource())
+		} else {
+			fmt.Print(", energy not measured on this host")
+		}
+		fmt.Println(":")
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tNAME\tRUNNING\tCPU SECONDS\tENERGY (J)")
+		for _, vm := range resp.GetVms() {
+			energy := "-"
+			if vm.HasEnergyJoules() {
+				energy = fmt.Sprintf("%.1f", vm.GetEnergyJoules())
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%.1f\t%s\n",
+				vm.GetNamespace(), vm.GetVmName(), vm.GetRunning(), vm.GetCpuSeconds(), energy)
+		}
+		tw.Flush()
+	})
+}
+
+var usageCommand = &cli.Command{
+	Name:  "usage",
+	Usage: "Report the CPU time and energy used by each VM, requires an admin key",
+	Action: func(ctx *cli.Context) error {
+		return usageReport()
+	},
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const (
+	// Bursts of events, e.g. from destroying all VMs, are coalesced into one refresh.
+	watchRefreshDelay = 250 * time.Millisecond
+	// How long to wait before reconnecting to the events stream after it ended.
+	watchReconnectDelay = 2 * time.Second
+)
+
+// sseEvent is an event read from the server's events stream. `Type` is "connected" once the
+// stream is (re)opened, which isn't sent by the server.
+type sseEvent struct {
+	ID   uint64
+	Type string
+	Data string
+}
+
+// openEventStream opens the server's events stream, resuming after the event `after` unless it's
+// zero.
+func openEventStream(after uint64) (io.ReadCloser, error) {
+	cfg := apiClient.GetConfig()
+	serverURL, err := cfg.ServerURL(0, nil)
+	if err != nil {
+		return nil, err
+	}
+	streamURL, err := url.Parse(serverURL + "/v1/events")
+	if err != nil {
+		return nil, err
+	}
+	if after != 0 {
+		streamURL.RawQuery = url.Values{"after": {strconv.FormatUint(after, 10)}}.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, streamURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range cfg.DefaultHeader {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseErrorResponse("watch events", resp, fmt.Errorf("%s", resp.Status))
+	}
+	return resp.Body, nil
+}
+
+// readEventStream sends the events of the Server-Sent Events stream `r` to `events` until it ends.
+func readEventStream(r io.Reader, events chan<- sseEvent) error {
+	scanner := bufio.NewScanner(r)
+	var event sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			// A blank line ends an event, a line starting with ':' is a comment.
+			if line == "" && event.Type != "" {
+				events <- event
+			}
+			if line == "" {
+				event = sseEvent{}
+			}
+		case "id":
+			event.ID, _ = strconv.ParseUint(value, 10, 64)
+		case "event":
+			event.Type = value
+		case "data":
+			event.Data = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// followEvents sends the server's events to `events`, reconnecting whenever the stream ends, and
+// why it ended to `errs`.
+func followEvents(events chan<- sseEvent, errs chan<- error) {
+	var lastID uint64
+	for {
+		stream, err := openEventStream(lastID)
+		if err == nil {
+			events <- sseEvent{Type: "connected"}
+			forward := make(chan sseEvent)
+			done := make(chan error, 1)
+			go func() {
+				done <- readEventStream(stream, forward)
+			}()
+		read:
+			for {
+				select {
+				case event := <-forward:
+					if event.ID != 0 {
+						lastID = event.ID
+					}
+					events <- event
+				case err = <-done:
+					break read
+				}
+			}
+			stream.Close()
+		}
+		errs <- err
+		time.Sleep(watchReconnectDelay)
+	}
+}
+
+// formatUptime formats `d` in its two largest units, e.g. "3d4h" or "5m12s".
+func formatUptime(d time.Duration) string {
+	d = d.Truncate(time.Second)
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm%ds", minutes, seconds)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+// renderVMTable clears the terminal and draws `vms`, with `notice` below the header if set.
+func renderVMTable(vms []serverapi.ListAllVMsResponseVmsInner, updated time.Time, notice string) {
+	var buf bytes.Buffer
+	// Moves the cursor home and clears the screen.
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "%d VMs, updated %s. Press Ctrl-C to stop.\n", len(vms), updated.Format(time.TimeOnly))
+	if notice != "" {
+		fmt.Fprintf(&buf, "%s\n", notice)
+	}
+	buf.WriteString("\n")
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tIP\tUPTIME")
+	now := time.Now()
+	for _, vm := range vms {
+		ip, uptime := vm.GetIp(), "-"
+		if ip == "" {
+			ip = "-"
+		}
+		if vm.HasStartedAt() && vm.GetStatus() != "stopped" {
+			uptime = formatUptime(now.Sub(vm.GetStartedAt()))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", vm.GetVmName(), vm.GetStatus(), ip, uptime)
+	}
+	tw.Flush()
+	os.Stdout.Write(buf.Bytes())
+}
+
+// watchVMs keeps a table of the VMs matching `labelSelector` on screen, refreshed whenever the
+// events stream reports a change, until interrupted.
+func watchVMs(labelSelector string) error {
+	fetch := func() ([]serverapi.ListAllVMsResponseVmsInner, error) {
+		req := apiClient.DefaultAPI.V1VmsGet(context.Background())
+		if labelSelector != "" {
+			req = req.LabelSelector(labelSelector)
+		}
+		resp, httpResp, err := req.Execute()
+		if err != nil {
+			return nil, parseErrorResponse("list all VMs", httpResp, err)
+		}
+		return resp.GetVms(), nil
+	}
+	vms, err := fetch()
+	if err != nil {
+		return err
+	}
+	updated := time.Now()
+	var notice string
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	events := make(chan sseEvent)
+	streamErrs := make(chan error)
+	go followEvents(events, streamErrs)
+
+	refresh := time.NewTimer(watchRefreshDelay)
+	refresh.Stop()
+	refreshPending := false
+	// Uptimes go up while nothing happens.
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	renderVMTable(vms, updated, notice)
+	for {
+		select {
+		case <-signals:
+			return nil
+		case event := <-events:
+			// "gap" and "overflow" mean changes may have been missed.
+			if strings.HasPrefix(event.Type, "vm.") || event.Type == "connected" || event.Type == "gap" {
+				if event.Type == "connected" {
+					notice = ""
+				}
+				if !refreshPending {
+					refresh.Reset(watchRefreshDelay)
+					refreshPending = true
+				}
+			}
+			continue
+		case err := <-streamErrs:
+			notice = fmt.Sprintf("Events stream lost, reconnecting: %v", err)
+		case <-refresh.C:
+			refreshPending = false
+			fetched, err := fetch()
+			if err != nil {
+				notice = err.Error()
+				break
+			}
+			vms, updated = fetched, time.Now()
+		case <-tick.C:
+		}
+		renderVMTable(vms, updated, notice)
+	}
+}
+
+var vmsCommand = &cli.Command{
+	Name:  "vms",
+	Usage: "Commands on all VMs",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "watch",
+			Usage: "Show a live table of the VMs, their states, IPs and uptimes, updated from the events stream",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "selector",
+					Aliases: []string{"l"},
+					Usage:   "Only show VMs whose labels match, e.g. team=infra,tier!=db",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return watchVMs(ctx.String("selector"))
+			},
+		},
+	},
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	// Background commands that are kept, running or not. Starting another forgets the oldest
+	// finished one, or fails if all are running.
+	maxBackgroundCommands = 64
+	// How long killing a background command waits for it to be reaped.
+	backgroundKillWait = 5 * time.Second
+)
+
+var (
+	backgroundLock sync.Mutex
+	// Oldest first.
+	backgroundCommands []*backgroundCommand
+)
+
+// backgroundCommand is a non-blocking command, and the end of its output.
+type backgroundCommand struct {
+	id        string
+	cmd       string
+	pid       int
+	startedAt time.Time
+	// Closed once the command was reaped.
+	done chan struct{}
+
+	lock     sync.Mutex
+	exitCode *int
+	exitedAt *time.Time
+	// Why the command was killed, or couldn't be waited for.
+	err       string
+	output    []byte
+	truncated bool
+}
+
+// Write appends to the output, dropping the oldest beyond `cmdserver.MaxCommandOutput`.
+func (c *backgroundCommand) Write(data []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.output = append(c.output, data...)
+	if excess := len(c.output) - cmdserver.MaxCommandOutput; excess > 0 {
+		c.output = slices.Clone(c.output[excess:])
+		c.truncated = true
+	}
+	return len(data), nil
+}
+
+func (c *backgroundCommand) status() cmdserver.CommandStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return cmdserver.CommandStatus{
+		ID:        c.id,
+		Cmd:       c.cmd,
+		Running:   c.exitedAt == nil,
+		ExitCode:  c.exitCode,
+		Error:     c.err,
+		Output:    string(c.output),
+		Truncated: c.truncated,
+		StartedAt: c.startedAt,
+		ExitedAt:  c.exitedAt,
+	}
+}
+
+// kill kills the command's process group, giving `reason` as its error, unless it exited already.
+func (c *backgroundCommand) kill(reason string) {
+	// Holding the lock, so that the command's exit isn't recorded meanwhile.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.exitedAt != nil {
+		return
+	}
+	if c.err == "" {
+		c.err = reason
+	}
+	if err := syscall.Kill(-c.pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		log.WithField("command", c.id).Errorf("failed to kill process group %d: %v", c.pid, err)
+	}
+}
+
+// startBackgroundCommand starts `cmd`, created by commandFor for `req`, and keeps it with its output.
+// It's killed once it has run for `timeout`, unless zero.
+func startBackgroundCommand(cmd *exec.Cmd, req cmdserver.RunCmdRequest, timeout time.Duration) (*backgroundCommand, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate command ID: %v", err)
+	}
+
+	backgroundLock.Lock()
+	defer backgroundLock.Unlock()
+	if len(backgroundCommands) >= maxBackgroundCommands {
+		i := slices.IndexFunc(backgroundCommands, func(c *backgroundCommand) bool { return !c.status().Running })
+		if i < 0 {
+			return nil, fmt.Errorf("%d background commands are running, kill one first", maxBackgroundCommands)
+		}
+		backgroundCommands = slices.Delete(backgroundCommands, i, i+1)
+	}
+
+	c := &backgroundCommand{id: hex.EncodeToString(b), cmd: req.Cmd, done: make(chan struct{})}
+	cmd.Stdout = c
+	cmd.Stderr = c
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+	c.pid = cmd.Process.Pid
+	c.startedAt = time.Now().UTC()
+	backgroundCommands = append(backgroundCommands, c)
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { c.kill(fmt.Sprintf("command timed out after %s", timeout)) })
+	}
+	logger := log.WithFields(log.Fields{"api": "run_cmd", "command": c.id, "pid": c.pid})
+	go func() {
+		defer close(c.done)
+		err := cmd.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		exitedAt := time.Now().UTC()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.exitedAt = &exitedAt
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+			exitCode := 0
+			c.exitCode = &exitCode
+		case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+			exitCode := exitErr.ExitCode()
+			c.exitCode = &exitCode
+		case c.err == "":
+			c.err = err.Error()
+		}
+		logger.WithFields(log.Fields{"exitCode": c.exitCode, "error": c.err}).Info("background command exited")
+	}()
+	return c, nil
+}
+
+// findBackgroundCommand returns the background command `id`, or nil.
+func findBackgroundCommand(id string) *backgroundCommand {
+	backgroundLock.Lock()
+	defer backgroundLock.Unlock()
+	for _, c := range backgroundCommands {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func writeCommandStatus(w http.ResponseWriter, status cmdserver.CommandStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// commandStatusHandler handles "/cmd/{id}" GET requests.
+func commandStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	c := findBackgroundCommand(id)
+	if c == nil {
+		http.Error(w, fmt.Sprintf("command not found: %s", id), http.StatusNotFound)
+		return
+	}
+	writeCommandStatus(w, c.status())
+}
+
+// killCommandHandler handles "/cmd/{id}" DELETE requests. The command is killed if it's still
+// running and forgotten, its final status is returned.
+func killCommandHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	c := findBackgroundCommand(id)
+	if c == nil {
+		http.Error(w, fmt.Sprintf("command not found: %s", id), http.StatusNotFound)
+		return
+	}
+	c.kill("killed")
+	ctx, cancel := context.WithTimeout(r.Context(), backgroundKillWait)
+	defer cancel()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		// Killed, so it will be reaped, but its output may still be held open.
+	}
+
+	backgroundLock.Lock()
+	backgroundCommands = slices.DeleteFunc(backgroundCommands, func(other *backgroundCommand) bool { return other == c })
+	backgroundLock.Unlock()
+	log.WithFields(log.Fields{"api": "kill_cmd", "command": id}).Info("killed background command")
+	writeCommandStatus(w, c.status())
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+// How long the engine may take to answer a health probe.
+const containerHealthTimeout = 10 * time.Second
+
+// containerEngine returns the container engine configured by the VM's template or, failing that,
+// the first one installed. Returns "" if there is none.
+func containerEngine() string {
+	if cmdline, err := os.ReadFile("/proc/cmdline"); err == nil {
+		if _, value, found := strings.Cut(string(cmdline), guesttuning.ContainerRuntimeCmdlineKey+"=\""); found {
+			encoded, _, _ := strings.Cut(value, "\"")
+			if rt, err := guesttuning.DecodeContainerRuntime(encoded); err == nil && rt != nil {
+				return rt.Engine
+			}
+		}
+	}
+	for _, engine := range []string{guesttuning.EngineDocker, guesttuning.EnginePodman} {
+		if _, err := exec.LookPath(engine); err == nil {
+			return engine
+		}
+	}
+	return ""
+}
+
+// containersHealthHandler handles "/containers/health" GET requests. Docker is only healthy once its
+// daemon answers; Podman has no daemon, so we check that it can read its storage.
+func containersHealthHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "containers_health")
+
+	resp := cmdserver.ContainersHealthResponse{Engine: containerEngine()}
+	if resp.Engine == "" {
+		resp.Error = "no container engine installed"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), containerHealthTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if resp.Engine == guesttuning.EngineDocker {
+		cmd = exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}")
+	} else {
+		cmd = exec.CommandContext(ctx, "podman", "info", "--format", "{{.Version.Version}}")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		logger.Warnf("%s is unhealthy: %v: %s", resp.Engine, err, strings.TrimSpace(stderr.String()))
+		resp.Error = fmt.Sprintf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	} else {
+		resp.Healthy = true
+		resp.Version = strings.TrimSpace(string(output))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// containerRunArgs returns the arguments to the engine's CLI that run `req` in a container named
+// `name`.
+func containerRunArgs(req *cmdserver.ContainerRunRequest, name string) []string {
+	args := []string{"run", "--name", name}
+	if req.Detach {
+		args = append(args, "--detach")
+	} else {
+		args = append(args, "--rm")
+	}
+	for _, key := range slices.Sorted(maps.Keys(req.Env)) {
+		args = append(args, "--env", key+"="+req.Env[key])
+	}
+	if req.Workdir != "" {
+		args = append(args, "--workdir", req.Workdir)
+	}
+	args = append(args, req.Image)
+	return append(args, req.Command...)
+}
+
+// runContainerHandler handles "/containers" POST requests.
+func runContainerHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "run_container")
+
+	var req cmdserver.ContainerRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	// An image starting with "-" would be taken as a flag.
+	if req.Image == "" || strings.HasPrefix(req.Image, "-") {
+		http.Error(w, fmt.Sprintf("invalid image: %q", req.Image), http.StatusBadRequest)
+		return
+	}
+	for key := range req.Env {
+		if key == "" || strings.Contains(key, "=") {
+			http.Error(w, fmt.Sprintf("invalid environment variable name: %q", key), http.StatusBadRequest)
+			return
+		}
+	}
+	timeout := cmdserver.DefaultContainerRunTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = min(time.Duration(req.TimeoutSeconds)*time.Second, cmdserver.MaxContainerRunTimeout)
+	}
+
+	engine := containerEngine()
+	if engine == "" {
+		http.Error(w, "no container engine installed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Named by us so that a container that outlives its timeout can be removed.
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, fmt.Sprintf("failed to name container: %v", err), http.StatusInternalServerError)
+		return
+	}
+	name := "arrakis-" + hex.EncodeToString(b)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	args := containerRunArgs(&req, name)
+	cmd := exec.CommandContext(ctx, engine, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	logger.WithFields(log.Fields{
+		"engine": engine,
+		"args":   args,
+	}).Info("Running container")
+
+	err := cmd.Run()
+	resp := cmdserver.ContainerRunResponse{
+		Stdout: stdout.String(),
+		Stderr: stderr.String(),
+	}
+	if ctx.Err() != nil {
+		// Killing the CLI leaves the container running.
+		if output, err := exec.Command(engine, "rm", "--force", name).CombinedOutput(); err != nil {
+			logger.Errorf("failed to remove container: %s output: %s err: %v", name, string(output), err)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			resp.Error = fmt.Sprintf("container timed out after %s", timeout)
+		} else {
+			resp.Error = "request canceled"
+		}
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode := exitErr.ExitCode()
+		resp.ExitCode = &exitCode
+	} else if err != nil {
+		resp.Error = fmt.Sprintf("failed to run %s: %v", engine, err)
+	} else {
+		exitCode := 0
+		resp.ExitCode = &exitCode
+		if req.Detach {
+			resp.ContainerID = strings.TrimSpace(resp.Stdout)
+		}
+	}
+	if resp.Error != "" {
+		logger.Errorf("failed to run container: %s err: %s", req.Image, resp.Error)
+	} else if resp.ContainerID != "" {
+		logger.Infof("started container %s", name)
+	} else {
+		logger.Infof("container %s exited with code %d", name, *resp.ExitCode)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
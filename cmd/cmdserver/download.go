@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// fileCollector adds the files that the globs and directories of a download expand to to its
+// response, up to `cmdserver.MaxDownloadFiles` files and `cmdserver.MaxDownloadBytes` bytes.
+type fileCollector struct {
+	ctx   context.Context
+	resp  *cmdserver.FilesGetResponse
+	files int
+	size  int64
+}
+
+// requestPath returns the path the client knows `absolutePath`, which `pattern` expanded to, by.
+func requestPath(pattern string, absolutePath string) string {
+	rel, err := filepath.Rel(baseDir, absolutePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return absolutePath
+	}
+	if filepath.IsAbs(pattern) {
+		return "/" + rel
+	}
+	return rel
+}
+
+// addGlob adds the files that `pattern`, resolved to `absolutePattern`, matches, and those under
+// the directories it matches.
+func (c *fileCollector) addGlob(pattern string, absolutePattern string) {
+	matches, err := filepath.Glob(absolutePattern)
+	if err != nil {
+		c.addError(pattern, pattern, fmt.Sprintf("Invalid pattern: %v", err))
+		return
+	}
+	if len(matches) == 0 {
+		c.addError(pattern, pattern, "No files match the pattern")
+		return
+	}
+	for _, match := range matches {
+		if !c.addTree(pattern, match) {
+			return
+		}
+	}
+}
+
+// addTree adds the file at `root`, or the regular files under it if it's a directory. Symlinks
+// aren't followed. Returns false once the response is full.
+func (c *fileCollector) addTree(pattern string, root string) bool {
+	logger := log.WithField("api", "download")
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			c.addError(requestPath(pattern, p), pattern, fmt.Sprintf("Failed to read file: %v", err))
+			if d != nil && d.IsDir() && p != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			c.addError(requestPath(pattern, p), pattern, fmt.Sprintf("Failed to read file: %v", err))
+			return nil
+		}
+		if c.files >= cmdserver.MaxDownloadFiles || c.size+info.Size() > cmdserver.MaxDownloadBytes {
+			c.resp.Truncated = true
+			return fs.SkipAll
+		}
+
+		fileResp := cmdserver.FileData{Path: requestPath(pattern, p), Pattern: pattern}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			fileResp.Error = fmt.Sprintf("Failed to read file: %v", err)
+		} else {
+			fileResp.Content = string(content)
+			c.size += int64(len(content))
+		}
+		c.files++
+		logger.Infof("downloading file: %s", p)
+		c.resp.Files = append(c.resp.Files, fileResp)
+		return nil
+	})
+	if err != nil {
+		c.addError(pattern, pattern, fmt.Sprintf("Failed to read files: %v", err))
+		return false
+	}
+	return !c.resp.Truncated
+}
+
+func (c *fileCollector) addError(path string, pattern string, message string) {
+	c.resp.Files = append(c.resp.Files, cmdserver.FileData{Path: path, Pattern: pattern, Error: message})
+}
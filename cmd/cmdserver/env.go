@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// Where the environment of the VM's start request is written for login shells and PAM, besides the
+// cmdserver's own copy.
+const etcEnvironmentPath = "/etc/environment"
+
+// envStore is a set of environment variables added to every command, kept in a file readable only
+// by root so that they survive restarts of the cmdserver.
+type envStore struct {
+	path string
+
+	lock sync.Mutex
+	// Guarded by lock.
+	vars map[string]string
+}
+
+var (
+	// The environment of the VM's start request. /run is a tmpfs, so neither store reaches the disk.
+	startEnv = &envStore{path: "/run/arrakis/env"}
+	// Secrets delivered as environment variables.
+	secretEnv = &envStore{path: "/run/arrakis/secret-env"}
+)
+
+// load reads the variables added before the cmdserver restarted.
+func (e *envStore) load() {
+	file, err := os.Open(e.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("path", e.path).Warn("Failed to read environment")
+		return
+	}
+	defer file.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry [2]string
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.WithField("path", e.path).Warn("Skipping invalid line of environment")
+			continue
+		}
+		vars[entry[0]] = entry[1]
+	}
+	e.lock.Lock()
+	e.vars = vars
+	e.lock.Unlock()
+}
+
+// list returns the variables as "KEY=value".
+func (e *envStore) list() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	env := make([]string, 0, len(e.vars))
+	for key, value := range e.vars {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// add adds `vars`, replacing variables of the same name, and saves them, one JSON array of name
+// and value per line.
+func (e *envStore) add(vars map[string]string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	merged := make(map[string]string, len(e.vars)+len(vars))
+	for key, value := range e.vars {
+		merged[key] = value
+	}
+	for key, value := range vars {
+		merged[key] = value
+	}
+
+	var lines strings.Builder
+	for key, value := range merged {
+		line, err := json.Marshal([2]string{key, value})
+		if err != nil {
+			return err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), 0700); err != nil {
+		return err
+	}
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(lines.String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.path); err != nil {
+		return err
+	}
+	e.vars = merged
+	return nil
+}
+
+// validateEnv checks that names aren't empty and have no "=", and that nothing has a NUL.
+func validateEnv(vars map[string]string) error {
+	for key, value := range vars {
+		if key == "" || strings.ContainsAny(key, "=\x00") || strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid environment variable %q", key)
+		}
+	}
+	return nil
+}
+
+// writeEtcEnvironment sets `vars` in /etc/environment, replacing the lines of variables of the
+// same name and keeping the rest.
+func writeEtcEnvironment(vars map[string]string) error {
+	data, err := os.ReadFile(etcEnvironmentPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		key, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+		if _, ok := vars[key]; line == "" || ok {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+"="+strconv.Quote(vars[key]))
+	}
+	return os.WriteFile(etcEnvironmentPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// envHandler handles "/env" POST requests, adding the environment of the VM's start request to
+// every command run afterwards and to /etc/environment.
+func envHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "env")
+	var req cmdserver.EnvPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := validateEnv(req.Env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := startEnv.add(req.Env); err != nil {
+		logger.WithError(err).Error("failed to save environment")
+		http.Error(w, fmt.Sprintf("failed to save environment: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := writeEtcEnvironment(req.Env); err != nil {
+		logger.WithError(err).Error("failed to write /etc/environment")
+		http.Error(w, fmt.Sprintf("failed to write /etc/environment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	names := make([]string, 0, len(req.Env))
+	for key := range req.Env {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	logger.WithField("env", names).Info("set environment")
+	w.WriteHeader(http.StatusOK)
+}
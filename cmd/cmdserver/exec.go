@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// commandFor returns the command that runs `req.Cmd` with bash, in its working directory, with its
+// environment and as its user. The command leads its own process group, see killGroupOnDone.
+func commandFor(req cmdserver.RunCmdRequest) (*exec.Cmd, error) {
+	// Set up environment variables
+	env := os.Environ()
+	customPath := "/usr/local/bin:/usr/bin:/bin" // Modify as needed
+	env = append(env, "PATH="+customPath)
+	// Secrets win over the VM's environment, and the request's own environment over both.
+	env = append(env, startEnv.list()...)
+	env = append(env, secretEnv.list()...)
+
+	cmd := exec.Command("bash", "-c", req.Cmd)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Dir = baseDir
+	if req.Cwd != "" {
+		cmd.Dir = req.Cwd
+		if !filepath.IsAbs(req.Cwd) {
+			cmd.Dir = filepath.Join(baseDir, req.Cwd)
+		}
+	}
+
+	if req.User != "" {
+		u, err := lookupUser(req.User)
+		if err != nil {
+			return nil, err
+		}
+		credential, err := credentialOf(u)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr.Credential = credential
+		// Like su does, but the command's own environment still wins.
+		env = append(env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	}
+
+	for key, value := range req.Env {
+		env = append(env, key+"="+value)
+	}
+	// Later values of a variable win.
+	cmd.Env = env
+	return cmd, nil
+}
+
+// killGroupOnDone kills the process group of the started `cmd` once `ctx` is done, so that nothing
+// the command forked keeps running or holds its output open. The returned func stops it.
+func killGroupOnDone(ctx context.Context, cmd *exec.Cmd) func() bool {
+	pgid := cmd.Process.Pid
+	return context.AfterFunc(ctx, func() {
+		if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.WithField("api", "run_cmd").Errorf("failed to kill process group %d: %v", pgid, err)
+		}
+	})
+}
+
+// lookupUser finds the user named `name`, or with the UID `name` if it's numeric. UIDs without an
+// entry in /etc/passwd are users of their own group, with / as their home.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u, err := user.LookupId(name)
+		if errors.As(err, new(user.UnknownUserIdError)) {
+			return &user.User{Uid: name, Gid: name, Username: name, HomeDir: "/"}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up user %s: %w", name, err)
+		}
+		return u, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+// credentialOf returns the UID, GID and supplementary groups of `u`.
+func credentialOf(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID of user %s: %s", u.Username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GID of user %s: %s", u.Username, u.Gid)
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIDs, err := u.GroupIds()
+	if err != nil && u.Name == "" && u.Username == u.Uid {
+		// Not in /etc/passwd, so in no groups either.
+		groupIDs, err = nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the groups of user %s: %w", u.Username, err)
+	}
+	for _, id := range groupIDs {
+		if group, err := strconv.ParseUint(id, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(group))
+		}
+	}
+	return credential, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// The "/fs" endpoints give the host read-only access to the whole guest filesystem, which it
+// exposes as a FUSE mount. Unlike "/files" they aren't confined to `baseDir`.
+
+const (
+	// Upper bound on a single read, the host splits larger reads up.
+	maxFsReadSize = 1 << 20
+)
+
+// fsPathFromRequest returns the cleaned absolute path from the "path" query parameter.
+func fsPathFromRequest(r *http.Request) (string, error) {
+	p := r.URL.Query().Get("path")
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("path must be absolute: %q", p)
+	}
+	return filepath.Clean(p), nil
+}
+
+// writeFsError replies with the errno behind `err` so that the host can hand it to the FUSE
+// caller as is.
+func writeFsError(w http.ResponseWriter, err error) {
+	resp := cmdserver.FsErrorResponse{Error: err.Error()}
+	code := http.StatusInternalServerError
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		resp.Errno = int(errno)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		code = http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		code = http.StatusForbidden
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func fsEntryFromFileInfo(p string, info fs.FileInfo) cmdserver.FsEntry {
+	entry := cmdserver.FsEntry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		MtimeNs: info.ModTime().UnixNano(),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Mode = st.Mode
+		entry.Nlink = uint32(st.Nlink)
+		entry.Uid = st.Uid
+		entry.Gid = st.Gid
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		// Best effort, a dangling or unreadable link is still listed.
+		entry.LinkTarget, _ = os.Readlink(p)
+	}
+	return entry
+}
+
+// fsStatHandler handles "/fs/stat" GET requests.
+func fsStatHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := fsPathFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		writeFsError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fsEntryFromFileInfo(p, info))
+}
+
+// fsReadDirHandler handles "/fs/readdir" GET requests.
+func fsReadDirHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := fsPathFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dirEntries, err := os.ReadDir(p)
+	if err != nil {
+		writeFsError(w, err)
+		return
+	}
+
+	resp := cmdserver.FsReadDirResponse{
+		Entries: make([]cmdserver.FsEntry, 0, len(dirEntries)),
+	}
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			// Removed since we listed the directory.
+			continue
+		}
+		resp.Entries = append(resp.Entries, fsEntryFromFileInfo(filepath.Join(p, dirEntry.Name()), info))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fsReadHandler handles "/fs/read" GET requests. Replies with the raw file contents starting at
+// "offset", which may be shorter than "length" at the end of the file.
+func fsReadHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := fsPathFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.Atoi(r.URL.Query().Get("length"))
+	if err != nil || length < 0 || length > maxFsReadSize {
+		http.Error(w, fmt.Sprintf("length must be between 0 and %d", maxFsReadSize), http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		writeFsError(w, err)
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		log.WithField("api", "fs_read").Errorf("failed to read file: %s err: %v", p, err)
+		writeFsError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf[:n])
+}
+
+// writeUploadedFile writes `f` to `path`, creating its parent directories if asked, then sets its
+// owner and mode. The owner goes first, since changing it clears setuid and setgid.
+func writeUploadedFile(path string, f cmdserver.FilePostData) error {
+	uid, gid := -1, -1
+	if f.UID != nil {
+		uid = *f.UID
+	}
+	if f.GID != nil {
+		gid = *f.GID
+	}
+	if f.Mkdirs {
+		if err := mkdirsOwned(filepath.Dir(path), uid, gid); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(f.Content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if mode, ok, _ := f.FileMode(); ok {
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// mkdirsOwned creates `dir` and its missing parents with mode 0755, owned by `uid` and `gid`
+// unless -1. Existing directories are left alone.
+func mkdirsOwned(dir string, uid int, gid int) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		missing = append(missing, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	for _, d := range missing {
+		if err := os.Chown(d, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
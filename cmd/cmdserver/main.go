@@ -1,18 +1,23 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
 	"github.com/gorilla/mux"
 	"github.com/mattn/go-shellwords"
 )
@@ -22,6 +27,10 @@ const (
 	baseDir = "/tmp/server_files"
 )
 
+// How long after the guest kernel the cmdserver started, which the server reports as the kernel's
+// boot time. Zero if unknown.
+var bootMs int64
+
 // uploadFileHandler handles "/files" POST requests.
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "upload")
@@ -39,6 +48,14 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, file_data := range req.Files {
+		if err := file_data.Validate(); err != nil {
+			logger.WithError(err).Error("invalid file options")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	for _, file_data := range req.Files {
 		if file_data.Path == "" {
 			logger.Warn("skipping empty file path")
@@ -53,17 +70,7 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 			absoluteFilePath = filepath.Join(baseDir, file_data.Path)
 		}
 
-		file, err := os.Create(absoluteFilePath)
-		if err != nil {
-			logger.Errorf("failed to create file: %s err: %v", absoluteFilePath, err)
-			http.Error(w, fmt.Sprintf("failed to create file: %s err: %v", absoluteFilePath, err), http.StatusInternalServerError)
-			return
-		}
-		defer file.Close()
-		logger.Infof("uploading file: %s", absoluteFilePath)
-
-		_, err = file.WriteString(file_data.Content)
-		if err != nil {
+		if err := writeUploadedFile(absoluteFilePath, file_data); err != nil {
 			logger.Errorf("failed to write file: %s err: %v", absoluteFilePath, err)
 			http.Error(w, fmt.Sprintf("failed to write file: %s err: %v", absoluteFilePath, err), http.StatusInternalServerError)
 			return
@@ -71,7 +78,8 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// downloadFileHandler handles "/files" GET requests.
+// downloadFileHandler handles "/files" GET requests. Globs and directories expand to the regular
+// files they match or contain, recursively.
 func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -89,11 +97,20 @@ func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	response := cmdserver.FilesGetResponse{
 		Files: make([]cmdserver.FileData, 0, len(filePaths)),
 	}
+	collector := &fileCollector{ctx: r.Context(), resp: &response}
 
 	for _, filePath := range filePaths {
 		fileResp := cmdserver.FileData{Path: filePath}
 		// Resolve path to prevent path traversal.
 		absolutePath := filepath.Join(baseDir, filepath.Clean(filePath))
+		if cmdserver.IsGlob(filePath) {
+			collector.addGlob(filePath, absolutePath)
+			continue
+		}
+		if info, err := os.Stat(absolutePath); err == nil && info.IsDir() {
+			collector.addTree(filePath, absolutePath)
+			continue
+		}
 		content, err := os.ReadFile(absolutePath)
 		if err != nil {
 			fileResp.Error = fmt.Sprintf("Failed to read file: %v", err)
@@ -108,6 +125,41 @@ func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// loadModulesHandler handles "/modules" POST requests. The host is responsible for checking modules
+// against its allow-list; here we only make sure the names can't be abused as modprobe flags.
+func loadModulesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "load_modules")
+
+	var req cmdserver.ModulesPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	resp := cmdserver.ModulesPostResponse{
+		Modules: make([]cmdserver.ModuleLoadResult, len(req.Modules)),
+	}
+	for i, module := range req.Modules {
+		resp.Modules[i].Name = module
+		if err := guesttuning.ValidateModuleName(module); err != nil {
+			resp.Modules[i].Error = err.Error()
+			continue
+		}
+
+		output, err := exec.Command("modprobe", "--", module).CombinedOutput()
+		if err != nil {
+			logger.Errorf("failed to load module: %s output: %s err: %v", module, string(output), err)
+			resp.Modules[i].Error = fmt.Sprintf("modprobe failed: %v: %s", err, strings.TrimSpace(string(output)))
+			continue
+		}
+		logger.Infof("loaded module: %s", module)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // runCommandHandler handles "/cmd" POST requests.
 func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -116,10 +168,7 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Cmd      string `json:"cmd"`
-		Blocking bool   `json:"blocking,omitempty"`
-	}
+	var req cmdserver.RunCmdRequest
 	// Block by default if not specified in the payload.
 	req.Blocking = true
 
@@ -135,6 +184,11 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Empty Command", http.StatusBadRequest)
 		return
 	}
+	if err := req.Validate(); err != nil {
+		log.WithField("api", "run_cmd").WithError(err).Error("invalid options")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Parse the command string using shellwords to handle quotes and escaped spaces
 	parser := shellwords.NewParser()
@@ -158,15 +212,17 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	cmdName := parts[0]
 	cmdArgs := parts[1:]
 
-	// Set up environment variables
-	env := os.Environ()
-	customPath := "/usr/local/bin:/usr/bin:/bin" // Modify as needed
-	env = append(env, "PATH="+customPath)
-
 	// Create the command
-	cmd := exec.Command("bash", "-c", req.Cmd)
-	cmd.Env = env
-	cmd.Dir = baseDir
+	cmd, err := commandFor(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"api":  "run_cmd",
+			"cmd":  cmdName,
+			"user": req.User,
+		}).Errorf("failed to set up command: %v", err)
+		writeJSON(w, cmdserver.RunCmdResponse{Error: err.Error()})
+		return
+	}
 
 	// Log the command execution details
 	log.WithFields(log.Fields{
@@ -174,12 +230,46 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		"cmd":        cmdName,
 		"args":       cmdArgs,
 		"workingDir": cmd.Dir,
+		"user":       req.User,
 	}).Info("Executing command")
 
 	// Handle command execution based on blocking mode
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
 	if req.Blocking {
+		// The command is killed if the caller goes away or it runs out of time.
+		ctx, cancel := r.Context(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+
 		// Execute the command and capture the combined output in blocking mode
-		output, err := cmd.CombinedOutput()
+		var buf bytes.Buffer
+		cmd.Stdout = &buf
+		cmd.Stderr = &buf
+		killed := false
+		err := cmd.Start()
+		if err == nil {
+			stop := killGroupOnDone(ctx, cmd)
+			err = cmd.Wait()
+			killed = !stop()
+		}
+		output := buf.Bytes()
+		if killed {
+			resp := cmdserver.RunCmdResponse{Output: string(output)}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				resp.Error = fmt.Sprintf("command timed out after %s", timeout)
+			} else {
+				resp.Error = "request canceled"
+			}
+			log.WithFields(log.Fields{
+				"api":  "run_cmd",
+				"cmd":  cmdName,
+				"args": cmdArgs,
+			}).Errorf("command killed: %s", resp.Error)
+			writeJSON(w, resp)
+			return
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
 				"api":  "run_cmd",
@@ -190,6 +280,10 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 				Error:  err.Error(),
 				Output: string(output),
 			}
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode := exitErr.ExitCode()
+				resp.ExitCode = &exitCode
+			}
 			writeJSON(w, resp)
 			return
 		}
@@ -204,99 +298,30 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		}).Info("command executed successfully")
 
 		// Respond with the command output
+		exitCode := 0
 		resp := cmdserver.RunCmdResponse{
-			Output: string(output),
+			Output:   string(output),
+			ExitCode: &exitCode,
 		}
 		writeJSON(w, resp)
 	} else {
-		// Non-blocking mode: start the command but don't wait for it to complete
-		// Set up pipes for stdout and stderr
-		stdoutPipe, err := cmd.StdoutPipe()
-		if err != nil {
-			log.WithFields(log.Fields{
-				"api":  "run_cmd",
-				"cmd":  cmdName,
-				"args": cmdArgs,
-			}).Errorf("failed to create stdout pipe: %v", err)
-			resp := cmdserver.RunCmdResponse{
-				Error: fmt.Sprintf("failed to create stdout pipe: %v", err),
-			}
-			writeJSON(w, resp)
-			return
-		}
-
-		stderrPipe, err := cmd.StderrPipe()
+		// Non-blocking mode: start the command but don't wait for it to complete. Its output and
+		// exit are kept for "/cmd/{id}", and only its own timeout kills it.
+		c, err := startBackgroundCommand(cmd, req, timeout)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"api":  "run_cmd",
-				"cmd":  cmdName,
-				"args": cmdArgs,
-			}).Errorf("failed to create stderr pipe: %v", err)
-			resp := cmdserver.RunCmdResponse{
-				Error: fmt.Sprintf("failed to create stderr pipe: %v", err),
-			}
-			writeJSON(w, resp)
-			return
-		}
-
-		// Start the command
-		if err := cmd.Start(); err != nil {
 			log.WithFields(log.Fields{
 				"api":  "run_cmd",
 				"cmd":  cmdName,
 				"args": cmdArgs,
 			}).Errorf("failed to start command: %v", err)
-			resp := cmdserver.RunCmdResponse{
-				Error: fmt.Sprintf("failed to start command: %v", err),
-			}
-			writeJSON(w, resp)
+			writeJSON(w, cmdserver.RunCmdResponse{Error: err.Error()})
 			return
 		}
 
-		// Start goroutines to handle stdout and stderr in the background
-		go func() {
-			scanner := bufio.NewScanner(stdoutPipe)
-			for scanner.Scan() {
-				log.WithFields(log.Fields{
-					"api":    "run_cmd",
-					"cmd":    cmdName,
-					"stdout": scanner.Text(),
-				}).Debug("command stdout")
-			}
-		}()
-
-		go func() {
-			scanner := bufio.NewScanner(stderrPipe)
-			for scanner.Scan() {
-				log.WithFields(log.Fields{
-					"api":    "run_cmd",
-					"cmd":    cmdName,
-					"stderr": scanner.Text(),
-				}).Debug("command stderr")
-			}
-		}()
-
-		// Start a goroutine to wait for the command to complete
-		go func() {
-			err := cmd.Wait()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"api":  "run_cmd",
-					"cmd":  cmdName,
-					"args": cmdArgs,
-				}).Errorf("command execution failed: %v", err)
-			} else {
-				log.WithFields(log.Fields{
-					"api":  "run_cmd",
-					"cmd":  cmdName,
-					"args": cmdArgs,
-				}).Info("command completed successfully")
-			}
-		}()
-
 		// Respond immediately with a success message
 		resp := cmdserver.RunCmdResponse{
 			Output: fmt.Sprintf("Command '%s' started in background", cmd.String()),
+			ID:     c.id,
 		}
 		writeJSON(w, resp)
 	}
@@ -309,14 +334,32 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]string{
-		"msg": "Hello from cmdserver",
+	response := cmdserver.IndexResponse{
+		Msg:    "Hello from cmdserver",
+		BootMs: bootMs,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// readUptime returns how long ago the guest kernel started.
+func readUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/uptime")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
 // Utility function to write JSON response
 func writeJSON(w http.ResponseWriter, resp cmdserver.RunCmdResponse) {
 	w.Header().Set("Content-Type", "application/json")
@@ -324,11 +367,19 @@ func writeJSON(w http.ResponseWriter, resp cmdserver.RunCmdResponse) {
 }
 
 func main() {
+	if uptime, err := readUptime(); err == nil {
+		bootMs = uptime.Milliseconds()
+	} else {
+		log.WithError(err).Warn("Failed to read uptime")
+	}
+
 	// Ensure base directory exists.
 	err := os.MkdirAll(baseDir, os.ModePerm)
 	if err != nil {
 		log.Fatalf("Failed to create base directory: %v", err)
 	}
+	startEnv.load()
+	secretEnv.load()
 
 	// Initialize Gorilla Mux router.
 	router := mux.NewRouter()
@@ -336,8 +387,25 @@ func main() {
 	// Register routes with their respective handlers.
 	router.HandleFunc("/", indexHandler).Methods(http.MethodGet)
 	router.HandleFunc("/files", uploadFileHandler).Methods(http.MethodPost)
+	// The same, under a path that cmdservers ignoring the file options don't have.
+	router.HandleFunc("/files/write", uploadFileHandler).Methods(http.MethodPost)
 	router.HandleFunc("/files", downloadFileHandler).Methods(http.MethodGet)
+	// The same, under a path that cmdservers reading globs as file names don't have.
+	router.HandleFunc("/files/read", downloadFileHandler).Methods(http.MethodGet)
+	router.HandleFunc("/files/search", searchFilesHandler).Methods(http.MethodPost)
 	router.HandleFunc("/cmd", runCommandHandler).Methods(http.MethodPost)
+	router.HandleFunc("/cmd/{id}", commandStatusHandler).Methods(http.MethodGet)
+	router.HandleFunc("/cmd/{id}", killCommandHandler).Methods(http.MethodDelete)
+	// The same, under a path that cmdservers ignoring the options don't have.
+	router.HandleFunc("/exec", runCommandHandler).Methods(http.MethodPost)
+	router.HandleFunc("/modules", loadModulesHandler).Methods(http.MethodPost)
+	router.HandleFunc("/env", envHandler).Methods(http.MethodPost)
+	router.HandleFunc("/secrets", secretsHandler).Methods(http.MethodPost)
+	router.HandleFunc("/fs/stat", fsStatHandler).Methods(http.MethodGet)
+	router.HandleFunc("/fs/readdir", fsReadDirHandler).Methods(http.MethodGet)
+	router.HandleFunc("/fs/read", fsReadHandler).Methods(http.MethodGet)
+	router.HandleFunc("/containers", runContainerHandler).Methods(http.MethodPost)
+	router.HandleFunc("/containers/health", containersHealthHandler).Methods(http.MethodGet)
 
 	// Optionally, add logging middleware.
 	router.Use(loggingMiddleware)
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	defaultSearchMaxResults = 100
+	maxSearchMaxResults     = 10000
+
+	// Files bigger than this are skipped, they are rarely source code.
+	maxSearchFileSize = 50 << 20
+	maxSearchLineSize = 1 << 20
+	// Matching lines are cut short to this many bytes in the response.
+	maxSearchMatchLen = 1000
+	// Like ripgrep, a NUL byte in the first few KB marks a file as binary.
+	binaryCheckSize = 8 << 10
+)
+
+// searchFilter decides which files and directories a search visits.
+type searchFilter struct {
+	includes      []string
+	excludes      []string
+	includeHidden bool
+}
+
+func newSearchFilter(globs []string, includeHidden bool) (*searchFilter, error) {
+	f := &searchFilter{includeHidden: includeHidden}
+	for _, glob := range globs {
+		exclude := strings.HasPrefix(glob, "!")
+		glob = strings.TrimPrefix(glob, "!")
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+		if exclude {
+			f.excludes = append(f.excludes, glob)
+		} else {
+			f.includes = append(f.includes, glob)
+		}
+	}
+	return f, nil
+}
+
+// matchesAny returns true if one of `globs` matches either the path relative to the search root or
+// just the name.
+func matchesAny(globs []string, relPath string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.Base(relPath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *searchFilter) skipDir(relPath string) bool {
+	if relPath == "." {
+		return false
+	}
+	if !f.includeHidden && strings.HasPrefix(filepath.Base(relPath), ".") {
+		return true
+	}
+	return matchesAny(f.excludes, relPath)
+}
+
+func (f *searchFilter) skipFile(relPath string) bool {
+	if !f.includeHidden && strings.HasPrefix(filepath.Base(relPath), ".") {
+		return true
+	}
+	if matchesAny(f.excludes, relPath) {
+		return true
+	}
+	return len(f.includes) > 0 && !matchesAny(f.includes, relPath)
+}
+
+// searchFile appends the lines of `filePath` matching `re` to `resp`, up to `maxResults` matches in
+// total. Returns false if the file was skipped as binary or unreadable.
+func searchFile(filePath string, re *regexp.Regexp, maxResults int, resp *cmdserver.FilesSearchResponse) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	head, err := reader.Peek(binaryCheckSize)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return false
+	}
+	if bytes.IndexByte(head, 0) != -1 {
+		return false
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxSearchLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Bytes()
+		if !re.Match(line) {
+			continue
+		}
+		if len(resp.Matches) >= maxResults {
+			resp.Truncated = true
+			break
+		}
+		if len(line) > maxSearchMatchLen {
+			line = line[:maxSearchMatchLen]
+		}
+		resp.Matches = append(resp.Matches, cmdserver.SearchMatch{
+			Path:       filePath,
+			LineNumber: lineNumber,
+			Line:       strings.ToValidUTF8(string(line), "�"),
+		})
+	}
+	// A line longer than `maxSearchLineSize` ends the search of this file, like a read error. What
+	// was matched before still counts.
+	return true
+}
+
+// searchFilesHandler handles "/files/search" POST requests.
+func searchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "search_files")
+
+	var req cmdserver.FilesSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	pattern := req.Pattern
+	if req.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pattern: %v", err), http.StatusBadRequest)
+		return
+	}
+	filter, err := newSearchFilter(req.Globs, req.IncludeHidden)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = defaultSearchMaxResults
+	}
+	maxResults = min(maxResults, maxSearchMaxResults)
+
+	// Same as uploads, relative paths are under `baseDir`.
+	root := baseDir
+	if req.Path != "" {
+		if filepath.IsAbs(req.Path) {
+			root = filepath.Clean(req.Path)
+		} else {
+			root = filepath.Join(baseDir, req.Path)
+		}
+	}
+	if _, err := os.Stat(root); err != nil {
+		writeFsError(w, err)
+		return
+	}
+
+	resp := cmdserver.FilesSearchResponse{
+		Matches: []cmdserver.SearchMatch{},
+	}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped rather than failing the whole search.
+			if d != nil && d.IsDir() && p != root {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+
+		relPath, _ := filepath.Rel(root, p)
+		if d.IsDir() {
+			if filter.skipDir(relPath) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Symlinks aren't followed, this also keeps us out of cycles.
+		if !d.Type().IsRegular() || (relPath != "." && filter.skipFile(relPath)) {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxSearchFileSize {
+			return nil
+		}
+
+		if searchFile(p, re, maxResults, &resp) {
+			resp.FilesSearched++
+		}
+		if resp.Truncated {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("search failed: %s err: %v", root, err)
+		writeFsError(w, err)
+		return
+	}
+
+	logger.Infof("searched %d files under %s, %d matches", resp.FilesSearched, root, len(resp.Matches))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
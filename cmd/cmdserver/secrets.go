@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// writeSecretFile writes a secret to `path`, never readable by others while it's written.
+func writeSecretFile(path string, f cmdserver.FilePostData) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0400)
+	if m, ok, _ := f.FileMode(); ok {
+		mode = m
+	}
+	// A secret delivered before may be read-only.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(f.Content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if f.UID != nil || f.GID != nil {
+		uid, gid := -1, -1
+		if f.UID != nil {
+			uid = *f.UID
+		}
+		if f.GID != nil {
+			gid = *f.GID
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
+
+// secretsHandler handles "/secrets" POST requests. Only names and paths are logged.
+func secretsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "secrets")
+	var req cmdserver.SecretsPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := validateEnv(req.Env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, f := range req.Files {
+		if !filepath.IsAbs(f.Path) {
+			http.Error(w, fmt.Sprintf("secret file path %q must be absolute", f.Path), http.StatusBadRequest)
+			return
+		}
+		if err := f.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, f := range req.Files {
+		if err := writeSecretFile(f.Path, f); err != nil {
+			logger.WithField("path", f.Path).WithError(err).Error("failed to write secret file")
+			http.Error(w, fmt.Sprintf("failed to write secret file %s: %v", f.Path, err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(req.Env) > 0 {
+		if err := secretEnv.add(req.Env); err != nil {
+			logger.WithError(err).Error("failed to save secret environment")
+			http.Error(w, fmt.Sprintf("failed to save secret environment: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	names := make([]string, 0, len(req.Env))
+	for key := range req.Env {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	logger.WithFields(log.Fields{"env": names, "files": len(req.Files)}).Info("received secrets")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+)
+
+const (
+	// First argument of fakevmm started as a guest.
+	guestCommand = "guest"
+	// The guest's end of the tap device, passed as the first extra file.
+	guestTapFd = 3
+
+	ifname = "eth0"
+	// Largest frame on either tap device, as neither has offloads.
+	maxFrameSize = 65536
+	// Where the guest keeps what it writes to /etc.
+	guestScratchDir = "/run/fakevmm"
+)
+
+// Directories of the host that guests get empty ones of their own of.
+var guestTmpfsDirs = []string{"/tmp", "/run", "/root", "/var/tmp", "/dev/shm"}
+
+// guest is a running guest, PID 1 of its PID namespace.
+type guest struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// startGuest starts fakevmm as the guest of `config`, with `cmdserver` as its agent.
+func startGuest(config *chvapi.VmConfig, cmdserver string) (*guest, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	tap, err := openTap(config.Net[0].GetTap())
+	if err != nil {
+		return nil, err
+	}
+	defer tap.Close()
+
+	cmd := exec.Command(self, guestCommand, cmdserver, config.Payload.GetCmdline())
+	cmd.ExtraFiles = []*os.File{tap}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if serial := config.Serial; serial != nil && serial.GetFile() != "" {
+		console, err := os.OpenFile(serial.GetFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open serial console: %w", err)
+		}
+		defer console.Close()
+		cmd.Stdout = console
+		cmd.Stderr = console
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+		// Guests don't outlive their hypervisor.
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start guest: %w", err)
+	}
+	g := &guest{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(g.done)
+	}()
+	return g, nil
+}
+
+func (g *guest) exited() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill kills the guest, and so every process in it, and waits for it to exit.
+func (g *guest) kill() {
+	g.cmd.Process.Kill()
+	select {
+	case <-g.done:
+	case <-time.After(guestExitTimeout):
+		log.Warn("guest didn't exit after being killed")
+	}
+}
+
+// signal sends `sig` to every process in the guest.
+func (g *guest) signal(sig syscall.Signal) error {
+	pidns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", g.cmd.Process.Pid))
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var pid int
+		if _, err := fmt.Sscan(entry.Name(), &pid); err != nil {
+			continue
+		}
+		// Processes that exited in the meantime have no namespaces.
+		if ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid)); err == nil && ns == pidns {
+			if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openTap attaches to the tap device `name`, creating it if it doesn't exist.
+func openTap(name string) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/net/tun: %w", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to attach to tap device %s: %w", name, err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// parseKeyFromCmdLine returns the value of `key` in the kernel command line `cmdline`, where
+// it's present like key="val".
+func parseKeyFromCmdLine(cmdline string, key string) (string, error) {
+	for _, field := range strings.Fields(cmdline) {
+		if value, ok := strings.CutPrefix(field, key+"="); ok {
+			return strings.Trim(value, `"`), nil
+		}
+	}
+	return "", fmt.Errorf("key %q not found in kernel command line", key)
+}
+
+// guestNetwork is what the guest's network is set up from.
+type guestNetwork struct {
+	vmName    string
+	guestCIDR string
+	gatewayIP string
+}
+
+func parseGuestNetwork(cmdline string) (*guestNetwork, error) {
+	var n guestNetwork
+	var err error
+	if n.vmName, err = parseKeyFromCmdLine(cmdline, "vm_name"); err != nil {
+		return nil, err
+	}
+	if n.guestCIDR, err = parseKeyFromCmdLine(cmdline, "guest_ip"); err != nil {
+		return nil, err
+	}
+	if _, _, err := net.ParseCIDR(n.guestCIDR); err != nil {
+		return nil, fmt.Errorf("invalid guest_ip: %w", err)
+	}
+	gateway, err := parseKeyFromCmdLine(cmdline, "gateway_ip")
+	if err != nil {
+		return nil, err
+	}
+	// The gateway may come with its prefix.
+	gatewayIP, _, cidrErr := net.ParseCIDR(gateway)
+	if cidrErr != nil {
+		if gatewayIP = net.ParseIP(gateway); gatewayIP == nil {
+			return nil, fmt.Errorf("invalid gateway_ip %q", gateway)
+		}
+	}
+	n.gatewayIP = gatewayIP.String()
+	return &n, nil
+}
+
+// runGuest runs in the guest's namespaces as their first process: it sets up the guest's file
+// system and network and runs the agent, until the agent exits.
+func runGuest() error {
+	if len(os.Args) != 4 {
+		return fmt.Errorf("usage: fakevmm %s CMDSERVER CMDLINE", guestCommand)
+	}
+	cmdserver, cmdline := os.Args[2], os.Args[3]
+	network, err := parseGuestNetwork(cmdline)
+	if err != nil {
+		return err
+	}
+	if err := resetUptime(); err != nil {
+		log.WithError(err).Warn("failed to reset the guest's uptime")
+	}
+	hostTap := os.NewFile(guestTapFd, "tap")
+	// The agent may be in a directory the guest gets an empty one of, so it's bound into the
+	// guest's own.
+	agentFile, err := os.Open(cmdserver)
+	if err != nil {
+		return err
+	}
+	if err := setupFilesystem(); err != nil {
+		return err
+	}
+	agentPath := path.Join(guestScratchDir, path.Base(cmdserver))
+	if err := os.WriteFile(agentPath, nil, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount(fmt.Sprintf("/proc/self/fd/%d", agentFile.Fd()), agentPath, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind %s: %w", cmdserver, err)
+	}
+	agentFile.Close()
+	if err := unix.Sethostname([]byte(network.vmName)); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+	tap, err := openTap(ifname)
+	if err != nil {
+		return err
+	}
+	if err := setupNetworking(network); err != nil {
+		return err
+	}
+	go relayFrames(tap, hostTap)
+	go relayFrames(hostTap, tap)
+
+	agent := exec.Command(agentPath)
+	agent.Dir = "/"
+	agent.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"}
+	agent.Stdout = os.Stdout
+	agent.Stderr = os.Stderr
+	if err := agent.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", cmdserver, err)
+	}
+	log.WithField("vmName", network.vmName).Info("guest booted")
+
+	// As PID 1, reap every orphan until the agent exits.
+	for {
+		var status unix.WaitStatus
+		pid, err := unix.Wait4(-1, &status, 0, nil)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return fmt.Errorf("failed to wait for the agent: %w", err)
+		}
+		if pid == agent.Process.Pid {
+			return fmt.Errorf("%s exited: %s", cmdserver, exitDescription(status))
+		}
+	}
+}
+
+// resetUptime starts the uptime of the processes we start from 0, as the agent reports it as how
+// long the guest took to boot.
+func resetUptime() error {
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return err
+	}
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &now); err != nil {
+		return err
+	}
+	// Offsets have non-negative nanoseconds.
+	sec, nsec := -now.Sec, int64(0)
+	if now.Nsec > 0 {
+		sec, nsec = -now.Sec-1, 1e9-now.Nsec
+	}
+	return os.WriteFile("/proc/self/timens_offsets", []byte(fmt.Sprintf("boottime %d %d\n", sec, nsec)), 0)
+}
+
+func exitDescription(status unix.WaitStatus) string {
+	if status.Signaled() {
+		return fmt.Sprintf("killed by %s", status.Signal())
+	}
+	return fmt.Sprintf("exit code %d", status.ExitStatus())
+}
+
+// setupFilesystem makes the host's file system read-only for the guest, but for directories of
+// its own in `guestTmpfsDirs` and a writable /etc, and mounts the guest's /proc.
+func setupFilesystem() error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	if err := unix.MountSetattr(-1, "/", unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("failed to make mounts read-only: %w", err)
+	}
+	if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+	for _, dir := range guestTmpfsDirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", dir, err)
+		}
+	}
+	upper, work := path.Join(guestScratchDir, "etc"), path.Join(guestScratchDir, "etc-work")
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	options := fmt.Sprintf("lowerdir=/etc,upperdir=%s,workdir=%s", upper, work)
+	if err := unix.Mount("overlay", "/etc", "overlay", 0, options); err != nil {
+		return fmt.Errorf("failed to mount /etc: %w", err)
+	}
+	return nil
+}
+
+// setupNetworking sets up the guest's network on its tap device.
+func setupNetworking(n *guestNetwork) error {
+	commands := [][]string{
+		{"l", "set", "lo", "up"},
+		{"a", "add", n.guestCIDR, "dev", ifname},
+		{"l", "set", ifname, "up"},
+		{"r", "add", "default", "via", n.gatewayIP},
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to execute command 'ip %s': %s %w", strings.Join(args, " "), output, err)
+		}
+	}
+	return nil
+}
+
+// relayFrames copies each frame read from `src` to `dst`, until either is closed.
+func relayFrames(dst io.Writer, src io.Reader) {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			log.WithError(err).Warn("failed to read frame")
+			return
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			log.WithError(err).Warn("failed to write frame")
+		}
+	}
+}
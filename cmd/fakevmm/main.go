@@ -0,0 +1,363 @@
+// fakevmm stands in for cloud-hypervisor in tests of arrakis-restserver on hosts without KVM or
+// guest images. It serves the part of cloud-hypervisor's API that starting, pausing and
+// destroying VMs uses on --api-socket. Its guests aren't VMs but processes in namespaces of their
+// own: a read-only view of the host's file system with a fresh /tmp, /run, /root and /etc, and
+// a network of their own, connected to the VM's tap device, in which arrakis-cmdserver runs as
+// the guest agent. It's no sandbox, guests run as root on the host.
+//
+// Snapshots, migrations, vsock and hotplugging disks or memory aren't supported.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+)
+
+const (
+	// VM states as cloud-hypervisor reports them.
+	stateCreated  = "Created"
+	stateRunning  = "Running"
+	statePaused   = "Paused"
+	stateShutdown = "Shutdown"
+
+	// How long guests have to exit once killed.
+	guestExitTimeout = 10 * time.Second
+)
+
+// vmm is the hypervisor of a single VM, as cloud-hypervisor's is.
+type vmm struct {
+	lock   sync.Mutex
+	config *chvapi.VmConfig
+	state  string
+	guest  guestProcess
+	// Starts the guest of `config`, replaced in tests.
+	startGuest func(config *chvapi.VmConfig) (guestProcess, error)
+	// Called once vmm.shutdown is answered.
+	exit func()
+}
+
+// guestProcess is the running guest of a VM.
+type guestProcess interface {
+	exited() bool
+	// kill stops the guest for good and waits for it to exit.
+	kill()
+	// signal sends `sig` to every process of the guest.
+	signal(sig syscall.Signal) error
+}
+
+// apiError is an error of the API, with its status.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func errorf(status int, format string, args ...any) error {
+	return &apiError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// handler serves the API, under /api/v1 like cloud-hypervisor's.
+func (v *vmm) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/vmm.ping", func(w http.ResponseWriter, r *http.Request) {
+		pid := int64(os.Getpid())
+		writeJSON(w, chvapi.VmmPingResponse{Version: "fakevmm", BuildVersion: chvapi.PtrString("fakevmm"), Pid: &pid})
+	})
+	mux.HandleFunc("GET /api/v1/vm.info", func(w http.ResponseWriter, r *http.Request) {
+		info, err := v.info()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, info)
+	})
+	mux.HandleFunc("PUT /api/v1/vm.create", func(w http.ResponseWriter, r *http.Request) {
+		var config chvapi.VmConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeError(w, errorf(http.StatusBadRequest, "invalid VM config: %v", err))
+			return
+		}
+		reply(w, v.create(&config))
+	})
+	mux.HandleFunc("PUT /api/v1/vm.boot", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, v.boot())
+	})
+	mux.HandleFunc("PUT /api/v1/vm.shutdown", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, v.shutdown())
+	})
+	mux.HandleFunc("PUT /api/v1/vm.reboot", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, v.reboot())
+	})
+	mux.HandleFunc("PUT /api/v1/vm.pause", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, v.pause())
+	})
+	mux.HandleFunc("PUT /api/v1/vm.resume", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, v.resume())
+	})
+	mux.HandleFunc("PUT /api/v1/vm.delete", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, v.delete())
+	})
+	mux.HandleFunc("PUT /api/v1/vmm.shutdown", func(w http.ResponseWriter, r *http.Request) {
+		v.delete()
+		w.WriteHeader(http.StatusNoContent)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go v.exit()
+	})
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, errorf(http.StatusNotImplemented, "%s isn't supported by fakevmm", r.URL.Path))
+	})
+	return mux
+}
+
+func (v *vmm) info() (*chvapi.VmInfo, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config == nil {
+		return nil, errorf(http.StatusNotFound, "VM isn't created")
+	}
+	v.reapLocked()
+	return chvapi.NewVmInfo(*v.config, v.state), nil
+}
+
+func (v *vmm) create(config *chvapi.VmConfig) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config != nil {
+		return errorf(http.StatusBadRequest, "VM is already created")
+	}
+	if len(config.Net) != 1 || config.Net[0].GetTap() == "" {
+		return errorf(http.StatusBadRequest, "VM needs a single tap device")
+	}
+	v.config = config
+	v.state = stateCreated
+	return nil
+}
+
+func (v *vmm) boot() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config == nil {
+		return errorf(http.StatusNotFound, "VM isn't created")
+	}
+	v.reapLocked()
+	if v.state != stateCreated && v.state != stateShutdown {
+		return errorf(http.StatusBadRequest, "VM is %s", v.state)
+	}
+	return v.bootLocked()
+}
+
+func (v *vmm) bootLocked() error {
+	g, err := v.startGuest(v.config)
+	if err != nil {
+		return errorf(http.StatusInternalServerError, "failed to boot VM: %v", err)
+	}
+	v.guest = g
+	v.state = stateRunning
+	return nil
+}
+
+func (v *vmm) shutdown() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config == nil {
+		return errorf(http.StatusNotFound, "VM isn't created")
+	}
+	v.stopLocked()
+	return nil
+}
+
+func (v *vmm) reboot() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config == nil {
+		return errorf(http.StatusNotFound, "VM isn't created")
+	}
+	v.reapLocked()
+	if v.state != stateRunning {
+		return errorf(http.StatusBadRequest, "VM is %s", v.state)
+	}
+	v.stopLocked()
+	return v.bootLocked()
+}
+
+func (v *vmm) pause() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config == nil {
+		return errorf(http.StatusNotFound, "VM isn't created")
+	}
+	v.reapLocked()
+	if v.state != stateRunning {
+		return errorf(http.StatusBadRequest, "VM is %s", v.state)
+	}
+	if err := v.guest.signal(syscall.SIGSTOP); err != nil {
+		return errorf(http.StatusInternalServerError, "failed to pause VM: %v", err)
+	}
+	v.state = statePaused
+	return nil
+}
+
+func (v *vmm) resume() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.config == nil {
+		return errorf(http.StatusNotFound, "VM isn't created")
+	}
+	v.reapLocked()
+	if v.state != statePaused {
+		return errorf(http.StatusBadRequest, "VM is %s", v.state)
+	}
+	if err := v.guest.signal(syscall.SIGCONT); err != nil {
+		return errorf(http.StatusInternalServerError, "failed to resume VM: %v", err)
+	}
+	v.state = stateRunning
+	return nil
+}
+
+func (v *vmm) delete() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.stopLocked()
+	v.config = nil
+	v.state = ""
+	return nil
+}
+
+// stopLocked kills the guest, if it runs.
+func (v *vmm) stopLocked() {
+	if v.guest != nil {
+		v.guest.kill()
+		v.guest = nil
+	}
+	if v.config != nil {
+		v.state = stateShutdown
+	}
+}
+
+// reapLocked notices a guest that exited by itself, as a VM that shut down.
+func (v *vmm) reapLocked() {
+	if v.guest != nil && v.guest.exited() {
+		log.Info("guest exited")
+		v.guest = nil
+		v.state = stateShutdown
+	}
+}
+
+func reply(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		status = apiErr.status
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// serve serves the API on the unix socket `socketPath` until vmm.shutdown.
+func serve(socketPath string, cmdserver string) error {
+	v := &vmm{
+		startGuest: func(config *chvapi.VmConfig) (guestProcess, error) {
+			return startGuest(config, cmdserver)
+		},
+	}
+	// A socket left behind by a hypervisor that crashed.
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: v.handler()}
+	v.exit = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+	log.WithField("socket", socketPath).Info("serving API")
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	// Guests are this binary, started again.
+	if len(os.Args) > 1 && os.Args[1] == guestCommand {
+		if err := runGuest(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	app := &cli.App{
+		Name:  "fakevmm",
+		Usage: "Stand-in for cloud-hypervisor whose guests are processes in namespaces",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "api-socket",
+				Usage:    "Unix socket to serve the API on",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "seccomp",
+				Usage: "Ignored, for compatibility with cloud-hypervisor",
+			},
+			&cli.StringFlag{
+				Name:  "cmdserver",
+				Usage: "Guest agent to run in guests, defaults to arrakis-cmdserver next to fakevmm",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cmdserver := c.String("cmdserver")
+			if cmdserver == "" {
+				self, err := os.Executable()
+				if err != nil {
+					return err
+				}
+				cmdserver = filepath.Join(filepath.Dir(self), "arrakis-cmdserver")
+			}
+			if _, err := exec.LookPath(cmdserver); err != nil {
+				return fmt.Errorf("no guest agent: %w", err)
+			}
+			return serve(strings.TrimPrefix(c.String("api-socket"), "path="), cmdserver)
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
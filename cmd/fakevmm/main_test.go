@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+)
+
+// stubGuest records what the guest was sent instead of running.
+type stubGuest struct {
+	killed  bool
+	signals []syscall.Signal
+}
+
+func (g *stubGuest) exited() bool { return g.killed }
+func (g *stubGuest) kill()        { g.killed = true }
+func (g *stubGuest) signal(sig syscall.Signal) error {
+	g.signals = append(g.signals, sig)
+	return nil
+}
+
+func TestVMMLifecycle(t *testing.T) {
+	var guests []*stubGuest
+	exited := false
+	v := &vmm{
+		startGuest: func(config *chvapi.VmConfig) (guestProcess, error) {
+			g := &stubGuest{}
+			guests = append(guests, g)
+			return g, nil
+		},
+		exit: func() { exited = true },
+	}
+	server := httptest.NewServer(v.handler())
+	defer server.Close()
+
+	call := func(method string, endpoint string, body any) int {
+		t.Helper()
+		var data []byte
+		if body != nil {
+			var err error
+			if data, err = json.Marshal(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req, err := http.NewRequest(method, server.URL+"/api/v1/"+endpoint, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	state := func() string {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/api/v1/vm.info")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return ""
+		}
+		var info chvapi.VmInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		return info.State
+	}
+	tap := "tap0"
+	config := chvapi.VmConfig{Net: []chvapi.NetConfig{{Tap: &tap}}}
+
+	steps := []struct {
+		method     string
+		endpoint   string
+		body       any
+		wantStatus int
+		wantState  string
+	}{
+		{method: http.MethodGet, endpoint: "vmm.ping", wantStatus: http.StatusOK},
+		{method: http.MethodPut, endpoint: "vm.boot", wantStatus: http.StatusNotFound},
+		{method: http.MethodPut, endpoint: "vm.create", body: chvapi.VmConfig{}, wantStatus: http.StatusBadRequest},
+		{method: http.MethodPut, endpoint: "vm.create", body: config, wantStatus: http.StatusNoContent, wantState: stateCreated},
+		{method: http.MethodPut, endpoint: "vm.create", body: config, wantStatus: http.StatusBadRequest, wantState: stateCreated},
+		{method: http.MethodPut, endpoint: "vm.resume", wantStatus: http.StatusBadRequest, wantState: stateCreated},
+		{method: http.MethodPut, endpoint: "vm.boot", wantStatus: http.StatusNoContent, wantState: stateRunning},
+		{method: http.MethodPut, endpoint: "vm.boot", wantStatus: http.StatusBadRequest, wantState: stateRunning},
+		{method: http.MethodPut, endpoint: "vm.pause", wantStatus: http.StatusNoContent, wantState: statePaused},
+		{method: http.MethodPut, endpoint: "vm.reboot", wantStatus: http.StatusBadRequest, wantState: statePaused},
+		{method: http.MethodPut, endpoint: "vm.resume", wantStatus: http.StatusNoContent, wantState: stateRunning},
+		{method: http.MethodPut, endpoint: "vm.snapshot", body: map[string]string{"destination_url": "file:///tmp"}, wantStatus: http.StatusNotImplemented, wantState: stateRunning},
+		{method: http.MethodPut, endpoint: "vm.reboot", wantStatus: http.StatusNoContent, wantState: stateRunning},
+		{method: http.MethodPut, endpoint: "vm.shutdown", wantStatus: http.StatusNoContent, wantState: stateShutdown},
+		{method: http.MethodPut, endpoint: "vm.boot", wantStatus: http.StatusNoContent, wantState: stateRunning},
+		{method: http.MethodPut, endpoint: "vm.delete", wantStatus: http.StatusNoContent},
+		{method: http.MethodPut, endpoint: "vmm.shutdown", wantStatus: http.StatusNoContent},
+	}
+	for _, step := range steps {
+		if got := call(step.method, step.endpoint, step.body); got != step.wantStatus {
+			t.Fatalf("%s %s = %d, want %d", step.method, step.endpoint, got, step.wantStatus)
+		}
+		if got := state(); got != step.wantState {
+			t.Fatalf("state after %s = %q, want %q", step.endpoint, got, step.wantState)
+		}
+	}
+
+	// Booted, rebooted and booted again after the shutdown.
+	if len(guests) != 3 {
+		t.Fatalf("started %d guests, want 3", len(guests))
+	}
+	for i, g := range guests {
+		if !g.killed {
+			t.Errorf("guest %d wasn't killed", i)
+		}
+	}
+	if got := guests[0].signals; len(got) != 2 || got[0] != syscall.SIGSTOP || got[1] != syscall.SIGCONT {
+		t.Errorf("guest was sent %v, want SIGSTOP and SIGCONT", got)
+	}
+	if !exited {
+		t.Error("vmm.shutdown didn't exit")
+	}
+}
+
+func TestVMMGuestExited(t *testing.T) {
+	g := &stubGuest{}
+	v := &vmm{startGuest: func(config *chvapi.VmConfig) (guestProcess, error) { return g, nil }}
+	tap := "tap0"
+	if err := v.create(&chvapi.VmConfig{Net: []chvapi.NetConfig{{Tap: &tap}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.boot(); err != nil {
+		t.Fatal(err)
+	}
+	// As if the guest's agent exited.
+	g.killed = true
+	info, err := v.info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != stateShutdown {
+		t.Errorf("state = %q, want %q", info.State, stateShutdown)
+	}
+	if err := v.pause(); err == nil {
+		t.Error("paused a VM that shut down")
+	}
+}
+
+func TestParseGuestNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdline string
+		want    guestNetwork
+		wantErr bool
+	}{
+		{
+			name:    "gateway without prefix",
+			cmdline: `console=ttyS0 gateway_ip="10.20.1.1" guest_ip="10.20.1.2/24" vm_name="foo" arrakis_vsock_secret="abc"`,
+			want:    guestNetwork{vmName: "foo", guestCIDR: "10.20.1.2/24", gatewayIP: "10.20.1.1"},
+		},
+		{
+			name:    "gateway with prefix",
+			cmdline: `console=ttyS0 gateway_ip="10.20.1.1/24" guest_ip="10.20.1.2/24" vm_name="foo" sysctl.vm.swappiness="10"`,
+			want:    guestNetwork{vmName: "foo", guestCIDR: "10.20.1.2/24", gatewayIP: "10.20.1.1"},
+		},
+		{name: "no guest IP", cmdline: `console=ttyS0 gateway_ip="10.20.1.1" vm_name="foo"`, wantErr: true},
+		{name: "guest IP without prefix", cmdline: `gateway_ip="10.20.1.1" guest_ip="10.20.1.2" vm_name="foo"`, wantErr: true},
+		{name: "invalid gateway", cmdline: `gateway_ip="gw" guest_ip="10.20.1.2/24" vm_name="foo"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGuestNetwork(tt.cmdline)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseGuestNetwork() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseGuestNetwork() error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseGuestNetwork() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+// How long a data disk's device may take to show up.
+const dataDiskWaitTimeout = 5 * time.Second
+
+// mountDataDisks mounts the data disks the VM was started with where the start asked.
+func mountDataDisks() error {
+	// Optional, like the tuning keys.
+	encoded, _ := parseKeyFromCmdLine(guesttuning.DataDisksCmdlineKey)
+	disks, err := guesttuning.DecodeDataDisks(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to parse data disks: %w", err)
+	}
+
+	var finalErr error
+	for _, d := range disks {
+		device, err := findDataDisk(d.Serial)
+		if err != nil {
+			finalErr = errors.Join(finalErr, err)
+			continue
+		}
+		if err := os.MkdirAll(d.GuestPath, 0755); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to create %s: %w", d.GuestPath, err))
+			continue
+		}
+		args := []string{device, d.GuestPath}
+		if d.ReadOnly {
+			args = append(args, "-o", "ro")
+		}
+		if output, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to mount data disk %s on %s: %w output: %s", d.Serial, d.GuestPath, err, output))
+			continue
+		}
+		log.Infof("mounted data disk %s (%s) on %s", d.Serial, device, d.GuestPath)
+	}
+	return finalErr
+}
+
+// findDataDisk returns the device to mount of the disk with the serial `serial`: the disk itself,
+// or its last partition if it has any.
+func findDataDisk(serial string) (string, error) {
+	deadline := time.Now().Add(dataDiskWaitTimeout)
+	for {
+		serials, _ := filepath.Glob("/sys/block/vd*/serial")
+		for _, serialPath := range serials {
+			data, err := os.ReadFile(serialPath)
+			if err != nil || strings.TrimSpace(string(data)) != serial {
+				continue
+			}
+			name := path.Base(path.Dir(serialPath))
+			partitions, _ := filepath.Glob(path.Join("/sys/block", name, name+"*"))
+			if len(partitions) == 0 {
+				return "/dev/" + name, nil
+			}
+			// vdc1, vdc2, ..., vdc10 sort by length first.
+			sort.Slice(partitions, func(i, j int) bool {
+				if len(partitions[i]) != len(partitions[j]) {
+					return len(partitions[i]) < len(partitions[j])
+				}
+				return partitions[i] < partitions[j]
+			})
+			return "/dev/" + path.Base(partitions[len(partitions)-1]), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no device with serial %s", serial)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+const (
+	hostname = "arrakis-vm"
+
+	// Read by the vsockserver's watchdog, which reports the crashes to the host. Records are
+	// written like arrakis-agent-stopped does under systemd.
+	agentCrashDir = "/run/arrakis/agent-crashes"
+	// Where the PIDs of the agents are written, e.g. for the host to restart the vsockserver
+	// after a fork.
+	agentPIDDir = "/run/arrakis"
+
+	// How long processes get to exit after SIGTERM when the guest shuts down.
+	shutdownGrace = 5 * time.Second
+)
+
+// initAgent is an agent that guestinit keeps running when it's the guest's init, like systemd does
+// with the agents' units.
+type initAgent struct {
+	name         string
+	path         string
+	restartDelay time.Duration
+}
+
+// As in the agents' units.
+var initAgents = []initAgent{
+	{name: "arrakis-vsockserver", path: "/usr/local/bin/arrakis-vsockserver", restartDelay: time.Second},
+	{name: "arrakis-cmdserver", path: "/usr/local/bin/arrakis-cmdserver", restartDelay: 5 * time.Second},
+}
+
+// Filesystems that systemd would mount, less the ones the agents don't need.
+var initMounts = []struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+}{
+	{"proc", "/proc", "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"devtmpfs", "/dev", "devtmpfs", unix.MS_NOSUID, "mode=0755"},
+	{"devpts", "/dev/pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, "mode=0620,gid=5,ptmxmode=0666"},
+	{"tmpfs", "/dev/shm", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=1777"},
+	{"tmpfs", "/run", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=0755"},
+	{"cgroup2", "/sys/fs/cgroup", "cgroup2", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+}
+
+// Resources of the ulimits, by limits.conf name.
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// isMountPoint reports whether something is mounted at `target`, i.e. it's on another device than
+// its parent.
+func isMountPoint(target string) bool {
+	var st, parent unix.Stat_t
+	if unix.Stat(target, &st) != nil || unix.Stat(path.Dir(target), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// mountFilesystems mounts the filesystems the agents need that aren't mounted yet.
+func mountFilesystems() error {
+	var finalErr error
+	for _, m := range initMounts {
+		if isMountPoint(m.target) {
+			continue
+		}
+		if err := os.MkdirAll(m.target, 0755); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to create %s: %w", m.target, err))
+			continue
+		}
+		if err := unix.Mount(m.source, m.target, m.fstype, m.flags, m.data); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to mount %s on %s: %w", m.fstype, m.target, err))
+			continue
+		}
+		log.Infof("mounted %s on %s", m.fstype, m.target)
+	}
+	return finalErr
+}
+
+// setHostname does what the guestinit unit does after it under systemd.
+func setHostname() error {
+	if err := unix.Sethostname([]byte(hostname)); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+	f, err := os.OpenFile("/etc/hosts", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open /etc/hosts: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "127.0.0.1 %s\n127.0.0.1 localhost\n", hostname); err != nil {
+		return fmt.Errorf("failed to write /etc/hosts: %w", err)
+	}
+	return nil
+}
+
+// setRlimits sets the given limits on ourselves, which every process started after inherits.
+func setRlimits(ulimits []guesttuning.Ulimit) error {
+	parse := func(limit string) (uint64, error) {
+		if limit == "unlimited" {
+			return unix.RLIM_INFINITY, nil
+		}
+		return strconv.ParseUint(limit, 10, 64)
+	}
+	var finalErr error
+	for _, u := range ulimits {
+		resource, ok := rlimitResources[u.Name]
+		if !ok {
+			finalErr = errors.Join(finalErr, fmt.Errorf("unknown ulimit %s", u.Name))
+			continue
+		}
+		var rlimit unix.Rlimit
+		var err error
+		if rlimit.Cur, err = parse(u.Soft); err == nil {
+			rlimit.Max, err = parse(u.Hard)
+		}
+		if err == nil {
+			err = unix.Setrlimit(resource, &rlimit)
+		}
+		if err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to set ulimit %s: %w", u.Name, err))
+			continue
+		}
+		log.Infof("set ulimit %s=%s:%s", u.Name, u.Soft, u.Hard)
+	}
+	return finalErr
+}
+
+// startAgent starts `agent` with its output on the console, and returns its PID.
+func startAgent(agent initAgent) (int, error) {
+	process, err := os.StartProcess(agent.path, []string{agent.path}, &os.ProcAttr{
+		Dir:   "/",
+		Env:   []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"},
+		Files: []*os.File{nil, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		return 0, err
+	}
+	pid := process.Pid
+	// Reaped by reapChildren, along with every other process.
+	process.Release()
+	if err := os.WriteFile(path.Join(agentPIDDir, agent.name+".pid"), []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		log.WithError(err).Warnf("failed to write the PID of %s", agent.name)
+	}
+	return pid, nil
+}
+
+// recordAgentCrash records that `agent` exited with `status`, unless it stopped cleanly, the way
+// arrakis-agent-stopped does for systemd.
+func recordAgentCrash(agent initAgent, status unix.WaitStatus) error {
+	var result, exitCode, exitStatus string
+	switch {
+	case status.Exited() && status.ExitStatus() == 0:
+		return nil
+	case status.Exited():
+		result, exitCode, exitStatus = "exit-code", "exited", strconv.Itoa(status.ExitStatus())
+	case status.Signaled():
+		switch sig := status.Signal(); {
+		// Clean stops to systemd too.
+		case sig == unix.SIGTERM || sig == unix.SIGINT || sig == unix.SIGHUP || sig == unix.SIGPIPE:
+			return nil
+		case status.CoreDump():
+			result, exitCode = "core-dump", "dumped"
+		default:
+			result, exitCode = "signal", "killed"
+		}
+		exitStatus = strings.TrimPrefix(unix.SignalName(status.Signal()), "SIG")
+	default:
+		return nil
+	}
+
+	if err := os.MkdirAll(agentCrashDir, 0755); err != nil {
+		return err
+	}
+	record := fmt.Sprintf("agent=%s\nresult=%s\nexitCode=%s\nexitStatus=%s\ncrashedAt=%s\n",
+		agent.name, result, exitCode, exitStatus, time.Now().UTC().Format(time.RFC3339))
+	file := path.Join(agentCrashDir, fmt.Sprintf("%s.service.%d", agent.name, time.Now().UnixNano()))
+	// Renamed into place so that the watchdog never reads half a record.
+	if err := os.WriteFile(file+".tmp", []byte(record), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// reapChildren waits for every child that exited, which includes orphans of any process as we're
+// PID 1, and returns the PIDs and statuses of those that were agents.
+func reapChildren(agents map[int]initAgent) map[int]unix.WaitStatus {
+	exited := make(map[int]unix.WaitStatus)
+	for {
+		var status unix.WaitStatus
+		pid, err := unix.Wait4(-1, &status, unix.WNOHANG, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return exited
+		}
+		if _, ok := agents[pid]; ok {
+			exited[pid] = status
+		}
+	}
+}
+
+// shutdown stops every process and powers the guest off, or reboots it for `sig` SIGTERM or
+// SIGINT, like busybox' init.
+func shutdown(sig os.Signal) {
+	log.Infof("shutting down on %v", sig)
+	unix.Kill(-1, unix.SIGTERM)
+	deadline := time.Now().Add(shutdownGrace)
+	for time.Now().Before(deadline) {
+		if _, err := unix.Wait4(-1, nil, unix.WNOHANG, nil); errors.Is(err, unix.ECHILD) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	unix.Kill(-1, unix.SIGKILL)
+	unix.Sync()
+
+	cmd := unix.LINUX_REBOOT_CMD_POWER_OFF
+	if sig == unix.SIGTERM || sig == unix.SIGINT {
+		cmd = unix.LINUX_REBOOT_CMD_RESTART
+	}
+	if err := unix.Reboot(cmd); err != nil {
+		log.WithError(err).Error("failed to shut down")
+	}
+}
+
+// runInit sets the guest up as PID 1 in images without systemd: mounts the filesystems, sets up
+// networking, hostname and tuning, and then keeps the agents running, reaps orphans and shuts down
+// when asked. It never returns, as the kernel panics if PID 1 exits.
+func runInit() {
+	log.Info("starting guestinit as init")
+	// Before anything else, the initramfs' mounts stayed behind in its root.
+	if err := mountFilesystems(); err != nil {
+		log.WithError(err).Error("failed to mount filesystems")
+	}
+	if err := setHostname(); err != nil {
+		log.WithError(err).Error("failed to set hostname")
+	}
+	setupGuest(true)
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, unix.SIGCHLD, unix.SIGTERM, unix.SIGINT, unix.SIGUSR1, unix.SIGUSR2)
+	if err := os.MkdirAll(agentPIDDir, 0755); err != nil {
+		log.WithError(err).Error("failed to create agent PID directory")
+	}
+
+	agents := make(map[int]initAgent)
+	restarts := make(chan initAgent, len(initAgents))
+	start := func(agent initAgent) {
+		pid, err := startAgent(agent)
+		if err != nil {
+			log.WithError(err).Errorf("failed to start %s", agent.name)
+			time.AfterFunc(agent.restartDelay, func() { restarts <- agent })
+			return
+		}
+		log.Infof("started %s as %d", agent.name, pid)
+		agents[pid] = agent
+	}
+	for _, agent := range initAgents {
+		start(agent)
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig != unix.SIGCHLD {
+				shutdown(sig)
+				continue
+			}
+			for pid, status := range reapChildren(agents) {
+				agent := agents[pid]
+				delete(agents, pid)
+				how := fmt.Sprintf("exit code %d", status.ExitStatus())
+				if status.Signaled() {
+					how = "signal " + unix.SignalName(status.Signal())
+				}
+				log.Warnf("%s exited with %s, restarting in %v", agent.name, how, agent.restartDelay)
+				if err := recordAgentCrash(agent, status); err != nil {
+					log.WithError(err).Errorf("failed to record crash of %s", agent.name)
+				}
+				time.AfterFunc(agent.restartDelay, func() { restarts <- agent })
+			}
+		case agent := <-restarts:
+			start(agent)
+		}
+	}
+}
@@ -1,18 +1,43 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
 )
 
 const (
 	ifname = "eth0"
 	ipBin  = "/usr/bin/ip"
+
+	// Commands are run by the cmdserver, which is only started once we exit. Hence a drop-in for
+	// its unit is enough to have the limits apply to all of them.
+	cmdServerUlimitsDropInPath = "/run/systemd/system/arrakis-cmdserver.service.d/ulimits.conf"
+	// Covers login sessions e.g. over ssh.
+	limitsConfPath = "/etc/security/limits.d/90-arrakis.conf"
+
+	// The image orders docker.service after us, so the daemon reads our configuration on its
+	// first start. Podman has no daemon and reads its configuration on every run.
+	dockerDaemonConfigPath = "/etc/docker/daemon.json"
+	podmanStorageConfPath  = "/etc/containers/storage.conf"
+	podmanConfPath         = "/etc/containers/containers.conf"
+	fuseOverlayfsBin       = "/usr/bin/fuse-overlayfs"
+
+	// The transport each shared directory was mounted with, as `tag=transport` lines, which the
+	// vsockserver reports to the host.
+	sharedDirsRecordPath = "/run/arrakis/shared-dirs"
+	// Largest 9P message, the host's server allows up to 1 MiB.
+	ninePMsize = 512 << 10
 )
 
 // parseKeyFromCmdLine parses a key from the kernel command line. Assumes each
@@ -127,8 +152,306 @@ func setupNetworking(guestCIDR string, gatewayIP string) error {
 	return nil
 }
 
-func main() {
-	log.Infof("starting guestinit")
+// applySysctls writes the given sysctls to /proc/sys.
+func applySysctls(sysctls []guesttuning.Sysctl) error {
+	var finalErr error
+	for _, s := range sysctls {
+		if err := os.WriteFile(s.ProcPath(), []byte(s.Value), 0644); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to set sysctl %s: %w", s.Key, err))
+			continue
+		}
+		log.Infof("set sysctl %s=%s", s.Key, s.Value)
+	}
+	return finalErr
+}
+
+// applyUlimits makes the given limits the defaults for commands run via the cmdserver and for login
+// sessions.
+func applyUlimits(ulimits []guesttuning.Ulimit) error {
+	var dropIn strings.Builder
+	var limitsConf strings.Builder
+	dropIn.WriteString("[Service]\n")
+	for _, u := range ulimits {
+		fmt.Fprintf(&dropIn, "%s=%s:%s\n", u.SystemdDirective(), infinityIfUnlimited(u.Soft), infinityIfUnlimited(u.Hard))
+		// "*" doesn't match root in limits.conf.
+		for _, domain := range []string{"*", "root"} {
+			fmt.Fprintf(&limitsConf, "%s soft %s %s\n", domain, u.Name, u.Soft)
+			fmt.Fprintf(&limitsConf, "%s hard %s %s\n", domain, u.Name, u.Hard)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(cmdServerUlimitsDropInPath), 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	}
+	if err := os.WriteFile(cmdServerUlimitsDropInPath, []byte(dropIn.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write cmdserver drop-in: %w", err)
+	}
+	if err := os.WriteFile(limitsConfPath, []byte(limitsConf.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write limits.conf: %w", err)
+	}
+
+	output, err := exec.Command("systemctl", "daemon-reload").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to reload systemd. output: %s, error: %w",
+			string(output),
+			err,
+		)
+	}
+	return nil
+}
+
+// infinityIfUnlimited translates the limits.conf spelling of "no limit" to the systemd one.
+func infinityIfUnlimited(limit string) string {
+	if limit == "unlimited" {
+		return "infinity"
+	}
+	return limit
+}
+
+// loadModules loads the given kernel modules.
+func loadModules(modules []string) error {
+	var finalErr error
+	for _, module := range modules {
+		output, err := exec.Command("modprobe", "--", module).CombinedOutput()
+		if err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf(
+				"failed to load module %s. output: %s, error: %w",
+				module,
+				string(output),
+				err,
+			))
+			continue
+		}
+		log.Infof("loaded kernel module %s", module)
+	}
+	return finalErr
+}
+
+// configureDocker writes the Docker daemon's configuration for `rt`.
+func configureDocker(rt *guesttuning.ContainerRuntime) error {
+	config, err := json.MarshalIndent(map[string]any{
+		"storage-driver": rt.StorageDriver,
+		"exec-opts":      []string{"native.cgroupdriver=" + rt.CgroupDriver},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dockerDaemonConfigPath), 0755); err != nil {
+		return fmt.Errorf("failed to create docker config directory: %w", err)
+	}
+	if err := os.WriteFile(dockerDaemonConfigPath, config, 0644); err != nil {
+		return fmt.Errorf("failed to write docker daemon config: %w", err)
+	}
+	return nil
+}
+
+// configurePodman writes Podman's storage and engine configuration for `rt`.
+func configurePodman(rt *guesttuning.ContainerRuntime) error {
+	var storageConf strings.Builder
+	storageConf.WriteString("[storage]\n")
+	fmt.Fprintf(&storageConf, "driver = %q\n", rt.StorageDriver)
+	storageConf.WriteString("runroot = \"/run/containers/storage\"\n")
+	storageConf.WriteString("graphroot = \"/var/lib/containers/storage\"\n")
+	if rt.StorageDriver == "overlay" {
+		// The kernel's overlayfs can't use our overlayfs root as its upper layer.
+		storageConf.WriteString("\n[storage.options.overlay]\n")
+		fmt.Fprintf(&storageConf, "mount_program = %q\n", fuseOverlayfsBin)
+	}
+	conf := fmt.Sprintf("[engine]\ncgroup_manager = %q\n", rt.CgroupDriver)
+
+	if err := os.MkdirAll(path.Dir(podmanStorageConfPath), 0755); err != nil {
+		return fmt.Errorf("failed to create containers config directory: %w", err)
+	}
+	if err := os.WriteFile(podmanStorageConfPath, []byte(storageConf.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write podman storage.conf: %w", err)
+	}
+	if err := os.WriteFile(podmanConfPath, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("failed to write podman containers.conf: %w", err)
+	}
+	return nil
+}
+
+// configureContainerRuntime configures the container engine of the image as the VM's template
+// asks, if it asks at all.
+func configureContainerRuntime() error {
+	// Optional, like the tuning keys.
+	encoded, _ := parseKeyFromCmdLine(guesttuning.ContainerRuntimeCmdlineKey)
+	rt, err := guesttuning.DecodeContainerRuntime(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to parse container runtime: %w", err)
+	}
+	if rt == nil {
+		return nil
+	}
+
+	switch rt.Engine {
+	case guesttuning.EngineDocker:
+		err = configureDocker(rt)
+	case guesttuning.EnginePodman:
+		err = configurePodman(rt)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("configured %s with storage driver %s and cgroup driver %s", rt.Engine, rt.StorageDriver, rt.CgroupDriver)
+	return nil
+}
+
+// mountSharedDirs mounts the host directories shared into the guest where the VM's start asked,
+// over virtiofs if the kernel has it and over 9P otherwise, and records the transports used for the
+// vsockserver to report.
+func mountSharedDirs() error {
+	// Optional, like the tuning keys.
+	encoded, _ := parseKeyFromCmdLine(guesttuning.SharedDirsCmdlineKey)
+	dirs, err := guesttuning.DecodeSharedDirs(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to parse shared directories: %w", err)
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	virtiofs := kernelHasFilesystem("virtiofs")
+	var finalErr error
+	var record strings.Builder
+	for _, d := range dirs {
+		if err := os.MkdirAll(d.GuestPath, 0755); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to create %s: %w", d.GuestPath, err))
+			continue
+		}
+		transport, err := mountSharedDir(d, virtiofs)
+		if err != nil {
+			finalErr = errors.Join(finalErr, err)
+			continue
+		}
+		log.Infof("mounted shared directory %s on %s over %s", d.Tag, d.GuestPath, transport)
+		fmt.Fprintf(&record, "%s=%s\n", d.Tag, transport)
+	}
+	if record.Len() > 0 {
+		if err := writeSharedDirsRecord(record.String()); err != nil {
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	return finalErr
+}
+
+// mountSharedDir mounts `d` over virtiofs if `virtiofs`, falling back to 9P e.g. when the host has no
+// virtiofsd, and returns the transport it was mounted with.
+func mountSharedDir(d guesttuning.SharedDir, virtiofs bool) (string, error) {
+	if virtiofs {
+		args := []string{"-t", "virtiofs", d.Tag, d.GuestPath}
+		if d.ReadOnly {
+			args = append(args, "-o", "ro")
+		}
+		output, err := exec.Command("mount", args...).CombinedOutput()
+		if err == nil {
+			return guesttuning.SharedDirTransportVirtiofs, nil
+		}
+		log.Warnf("failed to mount %s over virtiofs, falling back to 9p. output: %s, error: %v", d.Tag, output, err)
+	}
+	if err := mount9P(d); err != nil {
+		return "", fmt.Errorf("failed to mount %s on %s over 9p: %w", d.Tag, d.GuestPath, err)
+	}
+	return guesttuning.SharedDirTransport9P, nil
+}
+
+// mount9P mounts `d` from the host's 9P server, over a vsock connection handed to the kernel.
+func mount9P(d guesttuning.SharedDir) error {
+	// The fd transport is a module of its own on recent kernels. Either may be built in.
+	for _, module := range []string{"9pnet_fd", "9p"} {
+		exec.Command("modprobe", "--", module).Run()
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create vsock socket: %w", err)
+	}
+	// The mount keeps its own reference to the connection.
+	defer unix.Close(fd)
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_HOST, Port: guesttuning.SharedDirsVsockPort}); err != nil {
+		return fmt.Errorf("failed to connect to the host: %w", err)
+	}
+	var flags uintptr
+	if d.ReadOnly {
+		flags = unix.MS_RDONLY
+	}
+	options := fmt.Sprintf("trans=fd,rfdno=%d,wfdno=%d,version=9p2000.L,aname=%s,msize=%d,access=client", fd, fd, d.Tag, ninePMsize)
+	return unix.Mount(d.Tag, d.GuestPath, "9p", flags, options)
+}
+
+// kernelHasFilesystem returns whether the kernel can mount `fsType`, loading its module if needed.
+func kernelHasFilesystem(fsType string) bool {
+	// Fails harmlessly when it's built in or missing.
+	exec.Command("modprobe", "--", fsType).Run()
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fsType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSharedDirsRecord writes `record` where the vsockserver looks for it, atomically so that it
+// never reads half of it.
+func writeSharedDirsRecord(record string) error {
+	if err := os.MkdirAll(path.Dir(sharedDirsRecordPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path.Dir(sharedDirsRecordPath), err)
+	}
+	tmpPath := sharedDirsRecordPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(record), 0644); err != nil {
+		return fmt.Errorf("failed to record shared directories: %w", err)
+	}
+	if err := os.Rename(tmpPath, sharedDirsRecordPath); err != nil {
+		return fmt.Errorf("failed to record shared directories: %w", err)
+	}
+	return nil
+}
+
+// applyGuestTuning applies the sysctls, ulimits and kernel modules of the VM's template, if any.
+// Without systemd, i.e. `asInit`, the ulimits are set on ourselves for every process to inherit.
+func applyGuestTuning(asInit bool) error {
+	// All keys are optional.
+	encodedSysctls, _ := parseKeyFromCmdLine(guesttuning.SysctlsCmdlineKey)
+	encodedUlimits, _ := parseKeyFromCmdLine(guesttuning.UlimitsCmdlineKey)
+	encodedModules, _ := parseKeyFromCmdLine(guesttuning.ModulesCmdlineKey)
+
+	sysctls, err := guesttuning.DecodeSysctls(encodedSysctls)
+	if err != nil {
+		return fmt.Errorf("failed to parse sysctls: %w", err)
+	}
+	ulimits, err := guesttuning.DecodeUlimits(encodedUlimits)
+	if err != nil {
+		return fmt.Errorf("failed to parse ulimits: %w", err)
+	}
+	modules, err := guesttuning.DecodeModules(encodedModules)
+	if err != nil {
+		return fmt.Errorf("failed to parse kernel modules: %w", err)
+	}
+
+	var finalErr error
+	// Modules first, as some sysctls only exist once their module is loaded.
+	if len(modules) > 0 {
+		finalErr = errors.Join(finalErr, loadModules(modules))
+	}
+	if len(sysctls) > 0 {
+		finalErr = errors.Join(finalErr, applySysctls(sysctls))
+	}
+	if len(ulimits) > 0 && asInit {
+		finalErr = errors.Join(finalErr, setRlimits(ulimits))
+	} else if len(ulimits) > 0 {
+		finalErr = errors.Join(finalErr, applyUlimits(ulimits))
+	}
+	return finalErr
+}
+
+// setupGuest sets up networking, tuning, tmpfs, swap, the container runtime, shared directories
+// and data disks, logging what fails.
+func setupGuest(asInit bool) {
 	guestCIDR, gatewayIP, err := parseNetworkingMetadata()
 	if err != nil {
 		log.WithError(err).Error("failed to parse guest networking metadata")
@@ -137,5 +460,39 @@ func main() {
 	if err := setupNetworking(guestCIDR, gatewayIP); err != nil {
 		log.WithError(err).Error("failed to setup networking")
 	}
+
+	if err := applyGuestTuning(asInit); err != nil {
+		log.WithError(err).Error("failed to apply guest tuning")
+	}
+
+	// Before anything is mounted below them.
+	if err := mountTmpfs(); err != nil {
+		log.WithError(err).Error("failed to mount tmpfs")
+	}
+
+	if err := enableSwap(); err != nil {
+		log.WithError(err).Error("failed to enable swap")
+	}
+
+	if err := configureContainerRuntime(); err != nil {
+		log.WithError(err).Error("failed to configure container runtime")
+	}
+
+	if err := mountSharedDirs(); err != nil {
+		log.WithError(err).Error("failed to mount shared directories")
+	}
+
+	if err := mountDataDisks(); err != nil {
+		log.WithError(err).Error("failed to mount data disks")
+	}
+}
+
+func main() {
+	// Images without systemd boot with us as their init.
+	if os.Getpid() == 1 {
+		runInit()
+	}
+	log.Infof("starting guestinit")
+	setupGuest(false)
 	log.Info("guestinit exiting...")
 }
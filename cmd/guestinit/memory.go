@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+const (
+	// The stateful disk, whose ext4 file system the initramfs keeps the overlay's upper dir on.
+	statefulDiskDevice = "/dev/vdb"
+	// The stateful disk is mounted again here for the swap file, which can't be on the overlay.
+	statefulDiskMountPath = "/run/arrakis/stateful"
+	// Outside the upper dir, so that the guest's root never shows it.
+	swapFileName = "arrakis.swap"
+)
+
+// mountTmpfs mounts the tmpfs the VM was started with, or resizes the ones already mounted there,
+// like /dev/shm.
+func mountTmpfs() error {
+	// Optional, like the tuning keys.
+	encoded, _ := parseKeyFromCmdLine(guesttuning.TmpfsCmdlineKey)
+	mounts, err := guesttuning.DecodeTmpfs(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to parse tmpfs: %w", err)
+	}
+
+	var finalErr error
+	for _, t := range mounts {
+		options := "size=" + strconv.FormatInt(t.SizeBytes, 10)
+		if isTmpfsMount(t.Path) {
+			if err := unix.Mount("tmpfs", t.Path, "tmpfs", unix.MS_REMOUNT|unix.MS_NOSUID|unix.MS_NODEV, options); err != nil {
+				finalErr = errors.Join(finalErr, fmt.Errorf("failed to resize tmpfs on %s: %w", t.Path, err))
+				continue
+			}
+			log.Infof("resized tmpfs on %s to %d bytes", t.Path, t.SizeBytes)
+			continue
+		}
+		if err := os.MkdirAll(t.Path, 0755); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to create %s: %w", t.Path, err))
+			continue
+		}
+		if err := unix.Mount("tmpfs", t.Path, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777,"+options); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to mount tmpfs on %s: %w", t.Path, err))
+			continue
+		}
+		log.Infof("mounted tmpfs of %d bytes on %s", t.SizeBytes, t.Path)
+	}
+	return finalErr
+}
+
+// isTmpfsMount returns whether a tmpfs is mounted on `p`.
+func isTmpfsMount(p string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(p, &fs); err != nil || fs.Type != unix.TMPFS_MAGIC {
+		return false
+	}
+	// A directory of a tmpfs mounted further up, like /run, is on the same device as its parent.
+	var st, parent unix.Stat_t
+	if unix.Stat(p, &st) != nil || unix.Stat(path.Dir(p), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// enableSwap enables a swap file of the size the VM was started with on the stateful disk. The
+// file is kept across boots of the VM as long as its size doesn't change.
+func enableSwap() error {
+	encoded, _ := parseKeyFromCmdLine(guesttuning.SwapCmdlineKey)
+	if encoded == "" {
+		return nil
+	}
+	size, err := strconv.ParseInt(encoded, 10, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid swap size %q", encoded)
+	}
+	swapPath := path.Join(statefulDiskMountPath, swapFileName)
+	if swaps, err := os.ReadFile("/proc/swaps"); err == nil && strings.Contains(string(swaps), swapPath) {
+		return nil
+	}
+
+	if err := os.MkdirAll(statefulDiskMountPath, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", statefulDiskMountPath, err)
+	}
+	// The same file system as the initramfs mounted, a second mount of it is fine.
+	if err := unix.Mount(statefulDiskDevice, statefulDiskMountPath, "ext4", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount stateful disk: %w", err)
+	}
+	if info, err := os.Stat(swapPath); err != nil || info.Size() != size {
+		if err := createSwapFile(swapPath, size); err != nil {
+			return err
+		}
+	}
+	if output, err := exec.Command("swapon", swapPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to enable swap: %w output: %s", err, output)
+	}
+	log.Infof("enabled %d bytes of swap", size)
+	return nil
+}
+
+// createSwapFile creates a swap file of `size` bytes at `swapPath`. Swap files can't have holes,
+// so the space is taken from the stateful disk up front.
+func createSwapFile(swapPath string, size int64) error {
+	os.Remove(swapPath)
+	f, err := os.OpenFile(swapPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create swap file: %w", err)
+	}
+	err = unix.Fallocate(int(f.Fd()), 0, 0, size)
+	f.Close()
+	if err != nil {
+		os.Remove(swapPath)
+		return fmt.Errorf("failed to allocate %d bytes of swap on the stateful disk: %w", size, err)
+	}
+	if output, err := exec.Command("mkswap", swapPath).CombinedOutput(); err != nil {
+		os.Remove(swapPath)
+		return fmt.Errorf("failed to format swap file: %w output: %s", err, output)
+	}
+	return nil
+}
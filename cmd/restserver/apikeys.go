@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "createAPIKey")
+
+	var req serverapi.CreateApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CreateAPIKey(r.Context(), &req)
+	if err != nil {
+		logger.WithField("name", req.GetName()).WithError(err).Error("Failed to create API key")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to create API key: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.ListAPIKeys(r.Context()))
+}
+
+func (s *restServer) updateAPIKey(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "updateAPIKey")
+	id := mux.Vars(r)["id"]
+
+	var req serverapi.UpdateApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("id", id).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.UpdateAPIKey(r.Context(), id, &req)
+	if err != nil {
+		logger.WithField("id", id).WithError(err).Error("Failed to update API key")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to update API key: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "revokeAPIKey")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.RevokeAPIKey(r.Context(), id)
+	if err != nil {
+		logger.WithField("id", id).WithError(err).Error("Failed to revoke API key")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to revoke API key: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
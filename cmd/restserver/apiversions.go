@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The current version of the API. Its requests are served by the routes of API_VERSION, the
+// deprecated v1, and only differ from v1 ones in how errors are answered.
+const apiV2 = "v2"
+
+// apiV2Writer is the response writer of v2 requests, which lets `sendErrorResponse` tell them
+// apart from v1 ones.
+type apiV2Writer struct {
+	http.ResponseWriter
+}
+
+// Unwrap lets `http.ResponseController` reach the underlying writer, e.g. to flush streams.
+func (w *apiV2Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection.
+func (w *apiV2Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// isAPIV2 reports whether `w`, or a writer it wraps, answers a v2 request.
+func isAPIV2(w http.ResponseWriter) bool {
+	for {
+		switch u := w.(type) {
+		case *apiV2Writer:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = u.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// apiVersions serves v2 requests with the v1 routes of `next`, and marks v1 responses as
+// deprecated, with v2 as their successor. Guests' internal endpoints aren't versioned.
+func (s *restServer) apiVersions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/"+apiV2+"/"); ok {
+			// Like http.StripPrefix, so that the original request stays untouched.
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + API_VERSION + "/" + rest
+			if rawRest, ok := strings.CutPrefix(r.URL.RawPath, "/"+apiV2+"/"); ok {
+				r2.URL.RawPath = "/" + API_VERSION + "/" + rawRest
+			}
+			next.ServeHTTP(&apiV2Writer{w}, r2)
+			return
+		}
+
+		if rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/"+API_VERSION+"/"); ok && !strings.HasPrefix(rest, "internal/") {
+			w.Header().Set("Deprecation", "true")
+			if sunset := s.vmServer.Config().API.V1Sunset; sunset != "" {
+				// Validated when the config was loaded.
+				t, _ := time.Parse(time.DateOnly, sunset)
+				w.Header().Set("Sunset", t.Format(http.TimeFormat))
+			}
+			w.Header().Set("Link", "</"+apiV2+"/"+rest+`>; rel="successor-version"`)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorCode returns the machine-readable code of v2 errors with the HTTP status `statusCode`,
+// e.g. "not_found".
+func errorCode(statusCode int) string {
+	text := http.StatusText(statusCode)
+	if text == "" {
+		text = http.StatusText(http.StatusInternalServerError)
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+// httpStatusFromErrorSinceV2 returns the HTTP status of `err` for v2 requests, and `v1Status`,
+// which v1 answers every failure of the request with, for v1 ones.
+func httpStatusFromErrorSinceV2(w http.ResponseWriter, v1Status int, err error) int {
+	if isAPIV2(w) {
+		return httpStatusFromError(err)
+	}
+	return v1Status
+}
+
+// apiV2ErrorHandler answers v2 requests with the error `statusCode` and `message`, and v1 ones
+// with `v1`.
+func apiV2ErrorHandler(statusCode int, message string, v1 http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIV2(w) {
+			sendErrorResponse(w, statusCode, message)
+			return
+		}
+		v1.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/server"
+)
+
+func TestAPIVersions(t *testing.T) {
+	tests := []struct {
+		name           string
+		target         string
+		wantPath       string
+		wantRawPath    string
+		wantQuery      string
+		wantV2         bool
+		wantDeprecated bool
+		wantLink       string
+	}{
+		{
+			name:     "v2",
+			target:   "/v2/vms/foo",
+			wantPath: "/v1/vms/foo",
+			wantV2:   true,
+		},
+		{
+			name:      "v2 with a query",
+			target:    "/v2/vms?namespace=team-a",
+			wantPath:  "/v1/vms",
+			wantQuery: "namespace=team-a",
+			wantV2:    true,
+		},
+		{
+			name:        "v2 with an escaped path",
+			target:      "/v2/vms/foo/files/a%2Fb",
+			wantPath:    "/v1/vms/foo/files/a/b",
+			wantRawPath: "/v1/vms/foo/files/a%2Fb",
+			wantV2:      true,
+		},
+		{
+			name:           "v1",
+			target:         "/v1/vms/foo",
+			wantPath:       "/v1/vms/foo",
+			wantDeprecated: true,
+			wantLink:       `</v2/vms/foo>; rel="successor-version"`,
+		},
+		{
+			name:     "v1 internal",
+			target:   "/v1/internal/report",
+			wantPath: "/v1/internal/report",
+		},
+		{
+			name:     "unversioned",
+			target:   "/v2",
+			wantPath: "/v2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &restServer{vmServer: new(server.Server)}
+			var got *http.Request
+			var gotV2 bool
+			h := s.apiVersions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				gotV2 = isAPIV2(w)
+			}))
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			orig := r.URL.String()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if got.URL.Path != tt.wantPath || got.URL.RawPath != tt.wantRawPath || got.URL.RawQuery != tt.wantQuery {
+				t.Errorf("served %q (raw %q, query %q), want %q (raw %q, query %q)",
+					got.URL.Path, got.URL.RawPath, got.URL.RawQuery, tt.wantPath, tt.wantRawPath, tt.wantQuery)
+			}
+			if r.URL.String() != orig {
+				t.Errorf("original request changed to %s", r.URL)
+			}
+			if gotV2 != tt.wantV2 {
+				t.Errorf("isAPIV2() = %v, want %v", gotV2, tt.wantV2)
+			}
+			if deprecated := w.Header().Get("Deprecation") == "true"; deprecated != tt.wantDeprecated {
+				t.Errorf("Deprecation header set = %v, want %v", deprecated, tt.wantDeprecated)
+			}
+			if link := w.Header().Get("Link"); link != tt.wantLink {
+				t.Errorf("Link = %q, want %q", link, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestSendErrorResponseV2(t *testing.T) {
+	tests := []struct {
+		name     string
+		v2       bool
+		wantCode string
+	}{
+		{name: "v1", v2: false},
+		{name: "v2", v2: true, wantCode: "not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			var w http.ResponseWriter = rec
+			if tt.v2 {
+				// Wrapped again, as by the middlewares after apiVersions.
+				w = &statusRecorder{ResponseWriter: &apiV2Writer{rec}}
+			}
+			sendErrorResponse(w, http.StatusNotFound, "vm foo not found")
+
+			var resp serverapi.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusNotFound || resp.Error.GetMessage() != "vm foo not found" {
+				t.Errorf("got %d %q, want 404 %q", rec.Code, resp.Error.GetMessage(), "vm foo not found")
+			}
+			if resp.Error.GetCode() != tt.wantCode {
+				t.Errorf("code = %q, want %q", resp.Error.GetCode(), tt.wantCode)
+			}
+		})
+	}
+}
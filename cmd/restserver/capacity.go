@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+func (s *restServer) capacityForecast(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "capacityForecast")
+
+	var window time.Duration
+	if value := r.URL.Query().Get("window"); value != "" {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil || window <= 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid window: %s", value))
+			return
+		}
+	}
+	resp, err := s.vmServer.CapacityForecast(window)
+	if err != nil {
+		logger.WithError(err).Error("Failed to forecast capacity")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to forecast capacity: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) hostCapacity(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "hostCapacity")
+	resp, err := s.vmServer.HostCapacity(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Failed to get host capacity")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to get host capacity: %v", err))
+		return
+	}
+
+	// `resp` may be shared through the server's read cache.
+	filtered := *resp
+	filtered.Reservations = nil
+	caller := auth.FromContext(r.Context())
+	for _, reservation := range resp.Reservations {
+		if caller.CanUseNamespace(reservation.GetNamespace()) {
+			filtered.Reservations = append(filtered.Reservations, reservation)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *restServer) getVMCommand(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getVMCommand")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.VMCommandStatus(r.Context(), vmName, id)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"commandId": id,
+		}).WithError(err).Error("Failed to get command status")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to get command status: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) killVMCommand(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "killVMCommand")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.KillVMCommand(r.Context(), vmName, id)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"commandId": id,
+		}).WithError(err).Error("Failed to kill command")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to kill command: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) compactSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "compactSnapshot")
+	snapshotId := mux.Vars(r)["id"]
+
+	// The body is optional, an empty one keeps the configured format.
+	var req serverapi.CompactSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CompactSnapshot(r.Context(), snapshotId, &req)
+	if err != nil {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to compact snapshot")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to compact snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) compactVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "compactVM")
+	vmName := vmNameFromRequest(r)
+
+	// The body is optional.
+	var req serverapi.CompactVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CompactVM(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to compact VM disk")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to compact VM disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `W/"abc"`
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{name: "none", ifNoneMatch: "", want: false},
+		{name: "same", ifNoneMatch: `W/"abc"`, want: true},
+		{name: "strong", ifNoneMatch: `"abc"`, want: true},
+		{name: "other", ifNoneMatch: `W/"abd"`, want: false},
+		{name: "in a list", ifNoneMatch: `"xyz", W/"abc"`, want: true},
+		{name: "in a list without spaces", ifNoneMatch: `"xyz",W/"abc"`, want: true},
+		{name: "not in a list", ifNoneMatch: `"xyz", W/"abd"`, want: false},
+		{name: "any", ifNoneMatch: "*", want: true},
+		{name: "unquoted", ifNoneMatch: "abc", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+				t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, etag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{acceptEncoding: "", want: false},
+		{acceptEncoding: "gzip", want: true},
+		{acceptEncoding: "deflate, gzip;q=0.5", want: true},
+		{acceptEncoding: "GZIP", want: true},
+		{acceptEncoding: "gzip;q=0", want: false},
+		{acceptEncoding: "gzip; q=0.0", want: false},
+		{acceptEncoding: "*", want: true},
+		{acceptEncoding: "br", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip(%q) = %v, want %v", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendCacheableJSON(t *testing.T) {
+	small := map[string]string{"status": "RUNNING"}
+	large := map[string]string{"output": strings.Repeat("x", 2*minGzipSize)}
+
+	// The ETag of each body, from a first request.
+	etag := func(v any) string {
+		w := httptest.NewRecorder()
+		sendCacheableJSON(w, httptest.NewRequest(http.MethodGet, "/v1/vms", nil), v)
+		return w.Header().Get("ETag")
+	}
+	if etag(small) == "" || etag(small) != etag(small) || etag(small) == etag(large) {
+		t.Fatalf("ETags aren't stable and distinct: %q and %q", etag(small), etag(large))
+	}
+
+	tests := []struct {
+		name         string
+		v            any
+		ifNoneMatch  string
+		gzip         bool
+		wantStatus   int
+		wantEncoding string
+	}{
+		{name: "first request", v: small, wantStatus: http.StatusOK},
+		{name: "unchanged", v: small, ifNoneMatch: etag(small), wantStatus: http.StatusNotModified},
+		{name: "changed", v: large, ifNoneMatch: etag(small), wantStatus: http.StatusOK},
+		{name: "large with gzip", v: large, gzip: true, wantStatus: http.StatusOK, wantEncoding: "gzip"},
+		{name: "small with gzip", v: small, gzip: true, wantStatus: http.StatusOK},
+		{name: "unchanged with gzip", v: large, ifNoneMatch: etag(large), gzip: true, wantStatus: http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.gzip {
+				r.Header.Set("Accept-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			sendCacheableJSON(w, r, tt.v)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Header().Get("ETag") != etag(tt.v) {
+				t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), etag(tt.v))
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if tt.wantStatus == http.StatusNotModified {
+				if w.Body.Len() != 0 {
+					t.Errorf("304 with a body: %q", w.Body.String())
+				}
+				return
+			}
+			var body io.Reader = w.Body
+			if tt.wantEncoding == "gzip" {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), "{") || !strings.HasSuffix(string(data), "}\n") {
+				t.Errorf("body isn't JSON: %.40q", data)
+			}
+		})
+	}
+}
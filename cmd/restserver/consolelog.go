@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// vmConsoleLog returns the serial console output of a VM as text, or only its last `tail` lines.
+// With `follow`, the response goes on as the console prints until the VM is destroyed. WebSocket
+// upgrades get the output as binary messages instead, since reads may split UTF-8 characters.
+func (s *restServer) vmConsoleLog(w http.ResponseWriter, r *http.Request) {
+	vmName := vmNameFromRequest(r)
+	logger := log.WithFields(log.Fields{
+		"api":    "vmConsoleLog",
+		"vmName": vmName,
+	})
+	query := r.URL.Query()
+
+	var tail int
+	if t := query.Get("tail"); t != "" {
+		var err error
+		if tail, err = strconv.Atoi(t); err != nil || tail < 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid tail: %s", t))
+			return
+		}
+	}
+	var follow bool
+	if f := query.Get("follow"); f != "" {
+		var err error
+		if follow, err = strconv.ParseBool(f); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid follow: %s", f))
+			return
+		}
+	}
+	upgrade := websocket.IsWebSocketUpgrade(r)
+	if upgrade && s.originForbidden(w, r) {
+		return
+	}
+
+	// Hijacked connections don't end the request's context, the WebSocket cancels this instead.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	consoleLog, err := s.vmServer.OpenConsoleLog(ctx, vmName, tail, follow)
+	if err != nil {
+		logger.WithError(err).Error("Failed to open console log")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to open console log: %v", err))
+		return
+	}
+	defer consoleLog.Close()
+
+	if upgrade {
+		s.streamConsoleLogWebSocket(w, r, consoleLog, cancel, logger)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := consoleLog.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if follow {
+				rc.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// Too late for an error response when following, the client sees the body end.
+			if r.Context().Err() == nil {
+				logger.WithError(err).Error("Failed to read console log")
+			}
+			return
+		}
+	}
+}
+
+// streamConsoleLogWebSocket sends `consoleLog` over a WebSocket, one message per read, and closes
+// it normally once the log ends. `cancel` stops reads once the client goes away.
+func (s *restServer) streamConsoleLogWebSocket(w http.ResponseWriter, r *http.Request, consoleLog io.Reader, cancel func(), logger *log.Entry) {
+	conn, err := s.upgrade(w, r)
+	if err != nil {
+		// upgrade has already replied.
+		logger.WithError(err).Warn("Failed to upgrade to WebSocket")
+		return
+	}
+	defer conn.Close()
+	// The client's messages are ignored, reading them notices it leaving.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	closeCode, closeText := websocket.CloseNormalClosure, ""
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := consoleLog.Read(buf)
+		if n > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if r.Context().Err() == nil && !errors.Is(err, context.Canceled) {
+				closeCode, closeText = websocket.CloseInternalServerErr, "failed to read console log"
+				logger.WithError(err).Error("Failed to read console log")
+			}
+			break
+		}
+	}
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeCode, closeText),
+		time.Now().Add(time.Second))
+}
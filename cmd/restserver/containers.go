@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) vmRunContainer(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmRunContainer")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.ContainerRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.VMRunContainer(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"image":  req.GetImage(),
+		}).WithError(err).Error("Failed to run container")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to run container: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmContainersHealth(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmContainersHealth")
+	vmName := vmNameFromRequest(r)
+
+	resp, err := s.vmServer.VMContainersHealth(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to check container engine")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to check container engine: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
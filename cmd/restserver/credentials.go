@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleInternalCredentials returns short-lived cloud credentials of the credential profile in the
+// "profile" query parameter. This endpoint is called by the vsockserver running inside guest VMs,
+// which names its VM in the "vmName" query parameter.
+func (s *restServer) handleInternalCredentials(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "handleInternalCredentials")
+
+	vmName := r.URL.Query().Get("vmName")
+	profile := r.URL.Query().Get("profile")
+	if vmName == "" || profile == "" {
+		sendErrorResponse(w, http.StatusBadRequest, "vmName and profile are required")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Unknown source address")
+		return
+	}
+	creds, err := s.vmServer.GuestCredentials(r.Context(), vmName, net.ParseIP(host), profile)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":  vmName,
+			"profile": profile,
+		}).WithError(err).Warn("Failed to get credentials")
+		sendErrorResponse(w, httpStatusFromError(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(creds)
+}
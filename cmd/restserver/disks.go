@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) attachDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "attachDisk")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.DataDisk
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.AttachDisk(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"disk":   req.GetId(),
+		}).WithError(err).Error("Failed to attach disk")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to attach disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) detachDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "detachDisk")
+	vmName := vmNameFromRequest(r)
+	diskId := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.DetachDisk(r.Context(), vmName, diskId)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"disk":   diskId,
+		}).WithError(err).Error("Failed to detach disk")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to detach disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) resizeDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "resizeDisk")
+	vmName := vmNameFromRequest(r)
+	diskId := mux.Vars(r)["id"]
+
+	var req serverapi.ResizeDiskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.ResizeDisk(r.Context(), vmName, diskId, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"disk":   diskId,
+		}).WithError(err).Error("Failed to resize disk")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to resize disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
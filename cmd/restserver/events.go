@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+	"github.com/abilashraghuram/arrakis/pkg/server"
+)
+
+// Sent as an SSE comment so that proxies don't time out idle streams.
+const eventsKeepaliveInterval = 15 * time.Second
+
+// streamNotice is the data of the "gap" and "overflow" events, which tell the client that it
+// missed events. It can resume with `?after=<lastEventId>`.
+type streamNotice struct {
+	LastEventID uint64 `json:"lastEventId"`
+	Message     string `json:"message"`
+}
+
+// writeSSE writes a single Server-Sent Event. `id` is omitted if zero.
+func writeSSE(w http.ResponseWriter, id uint64, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, payload)
+	return err
+}
+
+// eventsCursor returns the ID of the last event the client has seen, from either the "after" query
+// parameter or the Last-Event-ID header sent by reconnecting EventSource clients. Clients that
+// don't send either only get new events.
+func eventsCursor(r *http.Request, bus *events.Bus) (uint64, error) {
+	cursor := r.URL.Query().Get("after")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+	if cursor == "" {
+		return bus.LastID(), nil
+	}
+	return strconv.ParseUint(cursor, 10, 64)
+}
+
+// events streams server events as Server-Sent Events. Clients that can't keep up get an
+// "overflow" event and the stream ends, rather than events being dropped silently.
+func (s *restServer) events(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "events")
+
+	bus := s.vmServer.Events()
+	afterID, err := eventsCursor(r, bus)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid event cursor")
+		return
+	}
+	vmName := r.URL.Query().Get("vm")
+	id := auth.FromContext(r.Context())
+
+	sub, err := bus.Subscribe(afterID)
+	if err != nil {
+		sendErrorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if sub.Gap {
+		notice := streamNotice{
+			LastEventID: afterID,
+			Message:     "events after the cursor are no longer retained",
+		}
+		if err := writeSSE(w, 0, "gap", notice); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		logger.WithError(err).Error("streaming not supported")
+		return
+	}
+
+	keepalive := time.NewTicker(eventsKeepaliveInterval)
+	defer keepalive.Stop()
+
+	lastID := afterID
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.Events():
+			if !ok {
+				if sub.Overflowed() {
+					logger.Warnf("subscriber fell behind, ending stream at event %d", lastID)
+					writeSSE(w, 0, "overflow", streamNotice{
+						LastEventID: lastID,
+						Message:     "client fell behind, resume from lastEventId",
+					})
+					rc.Flush()
+				}
+				return
+			}
+			lastID = event.ID
+			if vmName != "" && event.VMName != vmName {
+				continue
+			}
+			// Keys scoped to some namespaces don't see VMs in others.
+			if event.VMName != "" {
+				if ns, _ := server.SplitQualifiedName(event.VMName); !id.CanUseNamespace(ns) {
+					continue
+				}
+			}
+			if err := writeSSE(w, event.ID, event.Type, event); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// orphanedResources reports the resources no VM or snapshot accounts for, without touching them.
+func (s *restServer) orphanedResources(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.CollectGarbage(false))
+}
+
+// collectGarbage reclaims the resources no VM or snapshot accounts for.
+func (s *restServer) collectGarbage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.CollectGarbage(true))
+}
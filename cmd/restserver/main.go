@@ -1,23 +1,36 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
 	"github.com/abilashraghuram/arrakis/pkg/callback"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
 	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
 	"github.com/abilashraghuram/arrakis/pkg/server"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
 )
 
 const (
@@ -26,23 +39,283 @@ const (
 
 // sendErrorResponse sends a standardized error response to the client.
 func sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
+	sendErrorDetails(w, statusCode, message, nil)
+}
+
+// sendErrorDetails sends an error response like `sendErrorResponse`. v2 callers also get the
+// error's code, the request's ID and `details`.
+func sendErrorDetails(w http.ResponseWriter, statusCode int, message string, details map[string]interface{}) {
 	resp := serverapi.ErrorResponse{
 		Error: &serverapi.ErrorResponseError{
 			Message: &message,
 		},
 	}
+	if isAPIV2(w) {
+		resp.Error.Code = serverapi.PtrString(errorCode(statusCode))
+		resp.Error.Details = details
+		if id := w.Header().Get(requestIDHeader); id != "" {
+			resp.Error.RequestId = &id
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// httpStatusFromError maps the status code carried by errors from the VM server to an HTTP status.
+func httpStatusFromError(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.OutOfRange:
+		return http.StatusRequestedRangeNotSatisfiable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 type restServer struct {
 	vmServer       *server.Server
 	sessionManager *callback.SessionManager
+	// Re-read on reload.
+	configFile string
+}
+
+// tracingMiddleware starts a server span for every request, continuing any trace context sent by
+// the caller. Spans are named after the route template so that VM names don't explode cardinality.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				name = tmpl
+			}
+		}
+
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.StartWithKind(
+			ctx,
+			r.Method+" "+name,
+			tracing.SpanKindServer,
+			tracing.String("http.method", r.Method),
+			tracing.String("http.route", name),
+		)
+		defer span.End()
+		if id := requestIDFromContext(r.Context()); id != "" {
+			span.SetAttributes(tracing.String("http.request_id", id))
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(tracing.Int("http.status_code", int64(rec.status)))
+		if rec.status >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("request failed with status %d", rec.status))
+		}
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets `http.ResponseController` reach the underlying writer, e.g. to flush streams.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Routes that are reachable without an API key. Guests can't hold keys, so the internal endpoints
+// have to stay open.
+var unauthenticatedPaths = map[string]bool{
+	"/" + API_VERSION + "/health":                                           true,
+	"/" + API_VERSION + "/internal/callback":                                true,
+	"/" + API_VERSION + "/internal/report":                                  true,
+	"/" + API_VERSION + "/internal/credentials":                             true,
+	"/" + API_VERSION + "/internal/telemetry/" + guestcall.TelemetryLogs:    true,
+	"/" + API_VERSION + "/internal/telemetry/" + guestcall.TelemetryMetrics: true,
+}
+
+// requiredPermission returns the permission an API key needs for `r`.
+func requiredPermission(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/"+API_VERSION+"/admin/"):
+		return auth.PermissionAdmin
+	case r.URL.Path == "/"+API_VERSION+"/signedurls":
+		// Signed URLs only grant what the signer could read anyway.
+		return auth.PermissionRead
+	case strings.HasSuffix(r.URL.Path, "/ws"), strings.HasSuffix(r.URL.Path, "/shell"):
+		// Answering a VM's callbacks, bridging its sockets and running a shell in it steer it.
+		return auth.PermissionWrite
+	case websocket.IsWebSocketUpgrade(r) && !strings.HasSuffix(r.URL.Path, "/logs"):
+		// So can other WebSockets into the guest, e.g. to its services. Following the serial
+		// console only reads it.
+		return auth.PermissionWrite
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return auth.PermissionRead
+	default:
+		return auth.PermissionWrite
+	}
+}
+
+// authMiddleware authenticates requests by API key or OIDC token once either is configured, and
+// attaches the caller's identity to the request context.
+func (s *restServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] || !s.vmServer.AuthEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Query().Has(auth.SignatureParam) {
+			id, err := s.vmServer.AuthenticateSignedURL(r)
+			if err != nil {
+				sendErrorResponse(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+			return
+		}
+
+		id, ok := s.vmServer.Authenticate(r.Context(), auth.KeyFromRequest(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendErrorResponse(w, http.StatusUnauthorized, "Missing or invalid API key or token")
+			return
+		}
+		if permission := requiredPermission(r); !id.Has(permission) {
+			sendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Caller lacks the %s permission", permission))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+	})
+}
+
+// requireOwner only lets the owner of the VM in the request, or an admin, through to `next`.
+func (s *restServer) requireOwner(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.vmServer.AuthorizeVM(r.Context(), vmNameFromRequest(r)); err != nil {
+			sendErrorResponse(w, httpStatusFromError(err), err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// wakeVM resumes the VM in the request first if it was suspended for being idle, and keeps it from
+// being idle until `next` returns.
+func (s *restServer) wakeVM(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		done, err := s.vmServer.WakeVM(r.Context(), vmNameFromRequest(r))
+		if err != nil {
+			sendErrorResponse(w, httpStatusFromError(err), err.Error())
+			return
+		}
+		defer done()
+		next(w, r)
+	}
+}
+
+// namespaceMiddleware rejects requests for invalid namespaces, or namespaces the caller's API key
+// isn't scoped to, before they reach a handler.
+func namespaceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ns, namespaced := mux.Vars(r)["ns"]
+		if namespaced {
+			if err := server.ValidateNamespace(ns); err != nil {
+				sendErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if namespaced || strings.HasPrefix(r.URL.Path, "/"+API_VERSION+"/vms") {
+			if !auth.FromContext(r.Context()).CanUseNamespace(namespaceFromRequest(r)) {
+				sendErrorResponse(w, http.StatusForbidden, "API key can't use this namespace")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// namespaceFromRequest returns the namespace a request is for. Routes outside /namespaces/{ns} are
+// for the default namespace.
+func namespaceFromRequest(r *http.Request) string {
+	if ns := mux.Vars(r)["ns"]; ns != "" {
+		return ns
+	}
+	return server.DefaultNamespace
+}
+
+// vmNameFromRequest returns the server-wide name of the VM a request is for.
+func vmNameFromRequest(r *http.Request) string {
+	return server.QualifiedName(namespaceFromRequest(r), mux.Vars(r)["name"])
+}
+
+// forceFromRequest returns the value of the request's `force` query parameter, which lets callers
+// stop or destroy protected VMs.
+func forceFromRequest(r *http.Request) (bool, error) {
+	force := r.URL.Query().Get("force")
+	if force == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(force)
 }
 
 // Health check endpoint for load balancer monitoring
 func (s *restServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	// Take the server out of rotation while draining so that it stops receiving new VMs.
+	if s.vmServer.IsDraining() {
+		sendErrorResponse(w, http.StatusServiceUnavailable, "Server is draining")
+		return
+	}
+	// The same goes for a cordoned host, e.g. during a maintenance window.
+	if reason, cordoned := s.vmServer.CordonReason(); cordoned {
+		sendErrorResponse(w, http.StatusServiceUnavailable, strings.TrimSuffix("Host is cordoned: "+reason, ": "))
+		return
+	}
+
+	deep, err := strconv.ParseBool(r.URL.Query().Get("deep"))
+	if err != nil && r.URL.Query().Get("deep") != "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid deep: %v", err))
+		return
+	}
+	if deep {
+		// Fails with the results of every check, so that it's clear what's broken.
+		response := s.vmServer.DeepHealth()
+		response.SetTimestamp(time.Now().UTC())
+		statusCode := http.StatusOK
+		response.SetStatus("healthy")
+		if !response.GetHealthy() {
+			statusCode = http.StatusServiceUnavailable
+			response.SetStatus("unhealthy")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	response := map[string]interface{}{
 		"status":    "healthy",
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
@@ -68,62 +341,185 @@ func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.GetVmName() == "" {
-		logger.Error("Empty vm name")
-		sendErrorResponse(
-			w,
-			http.StatusBadRequest,
-			"Empty vm name")
+	ctx, name, release, ok := s.nameStartRequest(w, r, &req, logger)
+	if !ok {
 		return
 	}
-
+	defer release()
 	vmName := req.GetVmName()
 	callbackUrl := req.GetCallbackUrl()
 
-	resp, err := s.vmServer.StartVM(r.Context(), &req)
+	resp, err := s.vmServer.StartVM(ctx, &req)
 	if err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to start VM: %v", err))
 		return
 	}
-
-	// If callbackUrl is provided, register it with the session manager
-	// The session manager will route callbacks from this VM to the HTTP URL
-	if callbackUrl != "" {
-		_, err := s.sessionManager.RegisterHTTPCallback(vmName, callbackUrl)
-		if err != nil {
-			logger.WithFields(log.Fields{
-				"vmName":      vmName,
-				"callbackUrl": callbackUrl,
-			}).WithError(err).Warn("Failed to register HTTP callback, callbacks will not work")
-		} else {
-			logger.WithFields(log.Fields{
-				"vmName":      vmName,
-				"callbackUrl": callbackUrl,
-			}).Info("Registered HTTP callback for VM")
-		}
-	}
+	s.registerCallbackURL(namespaceFromRequest(r), name, callbackUrl, logger)
 
 	elapsedTime := time.Since(startTime)
 	logger.WithFields(log.Fields{
 		"vmName":      vmName,
 		"startupTime": elapsedTime.String(),
 	}).Info("VM started successfully")
+	resp.VmName = &name
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// forkSnapshot starts a new VM from a snapshot, see `server.ForkSnapshot`.
+func (s *restServer) forkSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "forkSnapshot")
+	startTime := time.Now()
+	snapshotId := mux.Vars(r)["id"]
+
+	var req serverapi.StartVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	namespace := namespaceFromRequest(r)
+	// Outside /namespaces/{ns} the namespace middleware leaves this to us.
+	if !auth.FromContext(r.Context()).CanUseNamespace(namespace) {
+		sendErrorResponse(w, http.StatusForbidden, "API key can't use this namespace")
+		return
+	}
+	ctx, name, release, ok := s.nameStartRequest(w, r, &req, logger)
+	if !ok {
+		return
+	}
+	defer release()
+	vmName := req.GetVmName()
+
+	resp, err := s.vmServer.ForkSnapshot(ctx, snapshotId, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":     vmName,
+			"snapshotId": snapshotId,
+		}).WithError(err).Error("Failed to fork snapshot")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to start VM from snapshot: %v", err))
+		return
+	}
+	s.registerCallbackURL(namespace, name, req.GetCallbackUrl(), logger)
+
+	logger.WithFields(log.Fields{
+		"vmName":      vmName,
+		"snapshotId":  snapshotId,
+		"startupTime": time.Since(startTime).String(),
+	}).Info("VM started from snapshot successfully")
+	resp.VmName = &name
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// nameStartRequest settles the name of the VM `req` starts, generating or normalizing it as asked,
+// and qualifies `req.VmName` with the request's namespace. Returns the context to start the VM
+// with, which holds a generated name, the unqualified name and the function that releases a
+// generated name once the VM exists, or false once it has replied with an error.
+func (s *restServer) nameStartRequest(w http.ResponseWriter, r *http.Request, req *serverapi.StartVMRequest, logger *log.Entry) (context.Context, string, func(), bool) {
+	ctx := r.Context()
+	namespace := namespaceFromRequest(r)
+	normalize := s.vmServer.Config().NormalizeVMNames
+	release := func() {}
+	if req.GetGenerateName() != "" {
+		if req.GetVmName() != "" {
+			sendErrorResponse(w, http.StatusBadRequest, "Only one of vmName and generateName may be given")
+			return nil, "", nil, false
+		}
+		prefix := req.GetGenerateName()
+		if normalize {
+			// Normalized as part of a full name, so that a trailing separator like in "test-" stays.
+			prefix = strings.TrimSuffix(server.NormalizeVMName(prefix+"x"), "x")
+		}
+		if err := server.ValidateVMNamePrefix(prefix, server.GeneratedNameLength); err != nil {
+			sendErrorDetails(w, http.StatusUnprocessableEntity, status.Convert(err).Message(), map[string]interface{}{"field": "generateName"})
+			return nil, "", nil, false
+		}
+		nameCtx, name, releaseName, err := s.vmServer.GenerateVMName(ctx, namespace, prefix)
+		if err != nil {
+			sendErrorResponse(w, httpStatusFromError(err), err.Error())
+			return nil, "", nil, false
+		}
+		ctx, release = nameCtx, releaseName
+		req.VmName = &name
+	}
+
+	if req.GetVmName() == "" {
+		release()
+		logger.Error("Empty vm name")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Empty vm name")
+		return nil, "", nil, false
+	}
+
+	if normalize {
+		if normalized := server.NormalizeVMName(req.GetVmName()); normalized != req.GetVmName() {
+			logger.WithFields(log.Fields{
+				"requested":  req.GetVmName(),
+				"normalized": normalized,
+			}).Info("Normalized vm name")
+			req.VmName = &normalized
+		}
+	}
+	if err := server.ValidateVMName(req.GetVmName()); err != nil {
+		release()
+		sendErrorDetails(w, http.StatusUnprocessableEntity, status.Convert(err).Message(), map[string]interface{}{"field": "vmName"})
+		return nil, "", nil, false
+	}
+
+	name := req.GetVmName()
+	vmName := server.QualifiedName(namespace, name)
+	req.VmName = &vmName
+	return ctx, name, release, true
+}
+
+// registerCallbackURL has the session manager route the callbacks of the VM `name` to
+// `callbackUrl` instead of a WebSocket, if one was given.
+func (s *restServer) registerCallbackURL(namespace string, name string, callbackUrl string, logger *log.Entry) {
+	if callbackUrl == "" {
+		return
+	}
+	vmName := server.QualifiedName(namespace, name)
+	_, err := s.sessionManager.RegisterHTTPCallback(namespace, name, callbackUrl)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":      vmName,
+			"callbackUrl": callbackUrl,
+		}).WithError(err).Warn("Failed to register HTTP callback, callbacks will not work")
+	} else {
+		logger.WithFields(log.Fields{
+			"vmName":      vmName,
+			"callbackUrl": callbackUrl,
+		}).Info("Registered HTTP callback for VM")
+	}
+}
+
 func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "destroyVM")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
+	force, err := forceFromRequest(r)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid force value: %v", err))
+		return
+	}
 
 	// Create request object with the VM name
 	req := serverapi.VMRequest{
 		VmName: &vmName,
+		Force:  serverapi.PtrBool(force),
 	}
 
 	resp, err := s.vmServer.DestroyVM(r.Context(), &req)
@@ -131,13 +527,13 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 		logger.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to destroy VM: %v", err))
 		return
 	}
 
 	// Also remove any active session for this VM
-	s.sessionManager.RemoveSession(vmName)
+	s.sessionManager.RemoveSession(namespaceFromRequest(r), mux.Vars(r)["name"])
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -145,12 +541,17 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 
 func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "destroyAllVMs")
-	resp, err := s.vmServer.DestroyAllVMs(r.Context())
+	force, err := forceFromRequest(r)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid force value: %v", err))
+		return
+	}
+	resp, err := s.vmServer.DestroyNamespaceVMs(r.Context(), namespaceFromRequest(r), force)
 	if err != nil {
 		logger.WithError(err).Error("Failed to destroy all VMs")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromErrorSinceV2(w, http.StatusInternalServerError, err),
 			fmt.Sprintf("Failed to destroy all VMs: %v", err))
 		return
 	}
@@ -161,42 +562,50 @@ func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 
 func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "listAllVMs")
-	resp, err := s.vmServer.ListAllVMs(r.Context())
+	var limit int
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit: %s", l))
+			return
+		}
+	}
+	query := r.URL.Query()
+	resp, err := s.vmServer.ListNamespaceVMs(r.Context(), namespaceFromRequest(r), query.Get("labelSelector"), limit, query.Get("pageToken"))
 	if err != nil {
 		logger.WithError(err).Error("Failed to list all VMs")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to list all VMs: %v", err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	sendCacheableJSON(w, r, resp)
 }
 
 func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "listVM")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
 	resp, err := s.vmServer.ListVM(r.Context(), vmName)
 	if err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list VM")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromErrorSinceV2(w, http.StatusInternalServerError, err),
 			fmt.Sprintf("Failed to list VM: %v", err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	// `resp` may be shared through the server's read cache.
+	namespaced := *resp
+	namespaced.VmName = serverapi.PtrString(mux.Vars(r)["name"])
+	sendCacheableJSON(w, r, namespaced)
 }
 
 func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "snapshotVM")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
 
 	var req struct {
 		SnapshotId string `json:"snapshotId,omitempty"`
@@ -218,7 +627,7 @@ func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
 		}).WithError(err).Error("Failed to create snapshot")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromErrorSinceV2(w, http.StatusInternalServerError, err),
 			fmt.Sprintf("Failed to create snapshot: %v", err))
 		return
 	}
@@ -229,8 +638,7 @@ func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
 
 func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "updateVMState")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
 
 	var req serverapi.V1VmsNamePatchRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -242,6 +650,44 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.DisconnectPolicy != nil {
+		if req.Status != nil || req.Protected != nil {
+			sendErrorResponse(w, http.StatusBadRequest, "disconnectPolicy can't be changed together with status or protected")
+			return
+		}
+		resp, err := s.vmServer.SetDisconnectPolicy(r.Context(), vmName, req.DisconnectPolicy)
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to change VM disconnect policy")
+			sendErrorResponse(
+				w,
+				httpStatusFromError(err),
+				fmt.Sprintf("Failed to change VM disconnect policy: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if req.Protected != nil {
+		if req.Status != nil {
+			sendErrorResponse(w, http.StatusBadRequest, "status and protected can't be changed together")
+			return
+		}
+		resp, err := s.vmServer.SetVMProtection(r.Context(), vmName, req.GetProtected())
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to change VM protection")
+			sendErrorResponse(
+				w,
+				httpStatusFromError(err),
+				fmt.Sprintf("Failed to change VM protection: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
 	status := req.GetStatus()
 	if status != "stopped" && status != "paused" && status != "resume" {
 		logger.WithFields(log.Fields{
@@ -257,6 +703,7 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 
 	vmReq := serverapi.VMRequest{
 		VmName: &vmName,
+		Force:  req.Force,
 	}
 
 	var resp *serverapi.VMResponse
@@ -276,7 +723,7 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 		}).WithError(err).Error("Failed to update VM state")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to change VM state to '%s': %v", status, err))
 		return
 	}
@@ -287,8 +734,7 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 
 func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "vmCommand")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
 
 	var req serverapi.VmCommandRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -316,7 +762,14 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 		blocking = *req.Blocking
 	}
 
-	resp, err := s.vmServer.VMCommand(r.Context(), vmName, cmd, blocking)
+	timeout := time.Duration(req.GetTimeoutSeconds()) * time.Second
+	resp, err := s.vmServer.VMCommand(r.Context(), vmName, cmdserver.RunCmdRequest{
+		Cmd:      cmd,
+		Blocking: blocking,
+		Cwd:      req.GetCwd(),
+		Env:      req.GetEnv(),
+		User:     req.GetUser(),
+	}, timeout)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"vmName":   vmName,
@@ -326,7 +779,7 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 		}).Error("Failed to execute command")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to execute command: %v", err))
 		return
 	}
@@ -341,10 +794,37 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// fanOutCommand runs a command in every VM matching a label selector.
+func (s *restServer) fanOutCommand(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "fanOutCommand")
+
+	var req serverapi.FanOutCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.FanOutCommand(r.Context(), namespaceFromRequest(r), &req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to fan out command")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to execute command: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (s *restServer) vmFileUpload(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "vmFileUpload")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
 
 	var req serverapi.VmFileUploadRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -374,7 +854,7 @@ func (s *restServer) vmFileUpload(w http.ResponseWriter, r *http.Request) {
 		}).WithError(err).Error("Failed to upload files")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to upload files: %v", err))
 		return
 	}
@@ -385,8 +865,7 @@ func (s *restServer) vmFileUpload(w http.ResponseWriter, r *http.Request) {
 
 func (s *restServer) vmFileDownload(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "vmFileDownload")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+	vmName := vmNameFromRequest(r)
 
 	paths := r.URL.Query().Get("paths")
 	if paths == "" {
@@ -406,7 +885,7 @@ func (s *restServer) vmFileDownload(w http.ResponseWriter, r *http.Request) {
 		}).WithError(err).Error("Failed to download files")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			httpStatusFromError(err),
 			fmt.Sprintf("Failed to download files: %v", err))
 		return
 	}
@@ -415,6 +894,295 @@ func (s *restServer) vmFileDownload(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (s *restServer) prewarm(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "prewarm")
+	startTime := time.Now()
+
+	var req serverapi.PrewarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetTemplate() == "" {
+		logger.Error("Empty template name")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Empty template name")
+		return
+	}
+
+	resp, err := s.vmServer.Prewarm(r.Context(), &req)
+	if err != nil {
+		logger.WithField("template", req.GetTemplate()).WithError(err).Error("Failed to prewarm host")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to prewarm host: %v", err))
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"template":    req.GetTemplate(),
+		"elapsedTime": time.Since(startTime).String(),
+	}).Info("Host prewarmed successfully")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// applyLogLevel sets the global log level. An empty level leaves it unchanged.
+func applyLogLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	log.SetLevel(parsed)
+	return nil
+}
+
+// reloadConfig re-reads the config file and applies it to the running server. Returns the changed
+// settings that need a restart.
+func (s *restServer) reloadConfig() ([]string, error) {
+	newConfig, err := config.GetServerConfig(s.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	// Validate everything before applying anything so that a bad file doesn't half apply.
+	if _, err := log.ParseLevel(newConfig.LogLevel); newConfig.LogLevel != "" && err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+
+	restartRequired, err := s.vmServer.ApplyConfig(*newConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyLogLevel(newConfig.LogLevel); err != nil {
+		return nil, err
+	}
+	return restartRequired, nil
+}
+
+func (s *restServer) reload(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "reload")
+
+	restartRequired, err := s.reloadConfig()
+	if err != nil {
+		logger.WithError(err).Error("Failed to reload config")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to reload config: %v", err))
+		return
+	}
+
+	logger.WithField("restartRequired", restartRequired).Info("Config reloaded")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverapi.ReloadConfigResponse{
+		Success:         serverapi.PtrBool(true),
+		RestartRequired: restartRequired,
+	})
+}
+
+func (s *restServer) vmFileSearch(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmFileSearch")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.VmFileSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetPattern() == "" {
+		logger.WithField("vmName", vmName).Error("No pattern provided")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"No pattern provided")
+		return
+	}
+
+	resp, err := s.vmServer.VMFileSearch(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":  vmName,
+			"pattern": req.GetPattern(),
+		}).WithError(err).Error("Failed to search files")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to search files: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmLoadModules(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmLoadModules")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.VmLoadModulesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if len(req.GetModules()) == 0 {
+		logger.WithField("vmName", vmName).Error("No modules provided")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"No modules provided")
+		return
+	}
+
+	resp, err := s.vmServer.VMLoadModules(r.Context(), vmName, req.GetModules())
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":  vmName,
+			"modules": req.GetModules(),
+		}).WithError(err).Error("Failed to load modules")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to load modules: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmMount(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmMount")
+	vmName := vmNameFromRequest(r)
+
+	// The body is optional, an empty one mounts the whole guest filesystem.
+	var req serverapi.VmMountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.MountVMFilesystem(r.Context(), vmName, req.GetGuestPath())
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to mount VM filesystem")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to mount VM filesystem: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmUnmount(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmUnmount")
+	vmName := vmNameFromRequest(r)
+
+	resp, err := s.vmServer.UnmountVMFilesystem(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to unmount VM filesystem")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to unmount VM filesystem: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) signURL(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "signURL")
+
+	var req serverapi.SignUrlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.SignURL(r.Context(), &req)
+	if err != nil {
+		logger.WithField("url", req.GetUrl()).WithError(err).Error("Failed to sign URL")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to sign URL: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmTransferOwnership(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmTransferOwnership")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.VmOwnerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetOwner() == "" {
+		sendErrorResponse(w, http.StatusBadRequest, "No owner provided")
+		return
+	}
+
+	resp, err := s.vmServer.TransferVMOwnership(r.Context(), vmName, req.GetOwner())
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"owner":  req.GetOwner(),
+		}).WithError(err).Error("Failed to transfer VM ownership")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to transfer VM ownership: %v", err))
+		return
+	}
+	// The session belongs to the old owner.
+	s.sessionManager.CloseWebSocketSession(namespaceFromRequest(r), mux.Vars(r)["name"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // InternalCallbackRequest represents a callback request from a VM to the host.
 type InternalCallbackRequest struct {
 	VMName string          `json:"vmName"`
@@ -454,13 +1222,18 @@ func (s *restServer) handleInternalCallback(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// VMs claimed from the warm pool were booted under their pool name.
+	req.VMName = s.vmServer.ResolveGuestName(req.VMName)
+	namespace, vmName := server.SplitQualifiedName(req.VMName)
+	s.vmServer.RecordVMActivity(req.VMName)
+
 	logger.WithFields(log.Fields{
 		"vmName": req.VMName,
 		"method": req.Method,
 	}).Info("Processing callback from VM")
 
 	// Route the callback to the registered HTTP callback URL
-	result, err := s.sessionManager.RouteCallback(r.Context(), req.VMName, req.Method, req.Params)
+	result, err := s.sessionManager.RouteCallback(r.Context(), namespace, vmName, req.Method, req.Params)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"vmName": req.VMName,
@@ -485,6 +1258,193 @@ func (s *restServer) handleInternalCallback(w http.ResponseWriter, r *http.Reque
 	})
 }
 
+// InternalReportRequest is a report from a VM about its own work, such as its progress.
+type InternalReportRequest struct {
+	VMName string            `json:"vmName"`
+	Type   string            `json:"type"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// handleInternalReport publishes reports from VMs as events, and pushes progress to the VM's
+// callback client. This endpoint is called by the
+// vsockserver running inside guest VMs.
+func (s *restServer) handleInternalReport(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "handleInternalReport")
+
+	var req InternalReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid report request body")
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+	if req.VMName == "" {
+		sendErrorResponse(w, http.StatusBadRequest, "vmName is required")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Unknown source address")
+		return
+	}
+	qualifiedName, err := s.vmServer.PublishGuestReport(req.VMName, net.ParseIP(host), req.Type, req.Data)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": req.VMName,
+			"type":   req.Type,
+		}).WithError(err).Error("Failed to publish report")
+		sendErrorResponse(w, httpStatusFromError(err), err.Error())
+		return
+	}
+	// Progress is also pushed to the client answering the VM's callbacks, so that it can show it.
+	namespace, vmName := server.SplitQualifiedName(qualifiedName)
+	switch req.Type {
+	case server.ReportProgress:
+		s.sessionManager.SendProgress(namespace, vmName, callback.ProgressUpdate, req.Data)
+	case server.ReportHeartbeat:
+		s.sessionManager.SendProgress(namespace, vmName, callback.ProgressHeartbeat, req.Data)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// drain waits for in-flight work on the VM server to finish and optionally snapshots the remaining
+// VMs. New VMs are refused from the moment it is called.
+func drain(vmServer *server.Server, cfg config.DrainConfig) {
+	log.Info("Draining server...")
+	ctx, cancel := context.WithTimeout(context.Background(), vmServer.Config().Timeouts.ShutdownDrain)
+	defer cancel()
+
+	if err := vmServer.Drain(ctx); err != nil {
+		log.WithError(err).Warn("Drain did not complete, shutting down anyway")
+	}
+
+	if cfg.SnapshotVMs {
+		// Snapshots get their own budget; cutting one short would only leave a partial snapshot.
+		snapshotIds, err := vmServer.SnapshotAllVMs(context.Background())
+		if err != nil {
+			log.WithError(err).Error("Failed to snapshot some VMs during drain")
+		}
+		for vmName, snapshotId := range snapshotIds {
+			log.WithFields(log.Fields{
+				"vmName":     vmName,
+				"snapshotId": snapshotId,
+			}).Info("Snapshotted VM")
+		}
+	}
+	log.Info("Drain complete")
+}
+
+// newRouter returns a router for the API whose requests pass through `middlewares` in order.
+func (s *restServer) newRouter(middlewares []mux.MiddlewareFunc) *mux.Router {
+	r := mux.NewRouter()
+
+	// Register routes
+	// VM routes are served for the default namespace under /v1/vms and for any namespace under
+	// /v1/namespaces/{ns}/vms.
+	for _, prefix := range []string{"/" + API_VERSION, "/" + API_VERSION + "/namespaces/{ns}"} {
+		r.HandleFunc(prefix+"/vms", s.startVM).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}", s.requireOwner(s.wakeVM(s.updateVMState))).Methods("PATCH")
+		r.HandleFunc(prefix+"/vms/{name}", s.requireOwner(s.destroyVM)).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms", s.destroyAllVMs).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms", s.listAllVMs).Methods("GET")
+		r.HandleFunc(prefix+"/vms/cmd", s.fanOutCommand).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}", s.listVM).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/snapshots", s.requireOwner(s.wakeVM(s.snapshotVM))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/snapshot-policies", s.listSnapshotPolicies).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/snapshot-policies", s.requireOwner(s.createSnapshotPolicy)).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/snapshot-policies/{id}", s.requireOwner(s.deleteSnapshotPolicy)).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/cmd", s.requireOwner(s.wakeVM(s.vmCommand))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/cmd/{id}", s.requireOwner(s.wakeVM(s.getVMCommand))).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/cmd/{id}", s.requireOwner(s.wakeVM(s.killVMCommand))).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/files", s.requireOwner(s.wakeVM(s.vmFileUpload))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/files", s.wakeVM(s.vmFileDownload)).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/files/search", s.wakeVM(s.vmFileSearch)).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/files/raw", s.wakeVM(s.streamFile)).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/logs", s.vmConsoleLog).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/uploads", s.getUploadStatus).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/uploads", s.requireOwner(s.wakeVM(s.writeUpload))).Methods("PUT")
+		r.HandleFunc(prefix+"/vms/{name}/uploads", s.requireOwner(s.abortUpload)).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/uploads/commit", s.requireOwner(s.wakeVM(s.commitUpload))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/modules", s.requireOwner(s.wakeVM(s.vmLoadModules))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/containers", s.requireOwner(s.wakeVM(s.vmRunContainer))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/containers/health", s.wakeVM(s.vmContainersHealth)).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/mount", s.requireOwner(s.vmMount)).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/mount", s.requireOwner(s.vmUnmount)).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/migrate", s.requireOwner(s.wakeVM(s.migrateVM))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/compact", s.requireOwner(s.wakeVM(s.compactVM))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/disks", s.requireOwner(s.wakeVM(s.attachDisk))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/disks/{id}", s.requireOwner(s.wakeVM(s.detachDisk))).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/disks/{id}/resize", s.requireOwner(s.wakeVM(s.resizeDisk))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/owner", s.vmTransferOwnership).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/ws", s.vmWebSocket).Methods("GET")
+		// Any method, passed on to the service.
+		r.HandleFunc(prefix+"/vms/{name}/services/{service}", s.requireOwner(s.wakeVM(s.vmServiceProxy)))
+		r.HandleFunc(prefix+"/vms/{name}/services/{service}/{path:.*}", s.requireOwner(s.wakeVM(s.vmServiceProxy)))
+		r.HandleFunc(prefix+"/vms/{name}/session", s.vmRotateSessionToken).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/sockets", s.listSocketForwards).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/sockets", s.requireOwner(s.wakeVM(s.createSocketForward))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/sockets/ws", s.requireOwner(s.wakeVM(s.vmSocketWebSocket))).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/shell", s.requireOwner(s.wakeVM(s.vmShellWebSocket))).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/sockets/{id}", s.requireOwner(s.deleteSocketForward)).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/processes", s.wakeVM(s.listProcesses)).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/processes", s.requireOwner(s.wakeVM(s.startProcess))).Methods("POST")
+		r.HandleFunc(prefix+"/vms/{name}/processes/{id}", s.requireOwner(s.wakeVM(s.killProcess))).Methods("DELETE")
+		r.HandleFunc(prefix+"/vms/{name}/processes/{id}/output", s.requireOwner(s.wakeVM(s.getProcessOutput))).Methods("GET")
+		r.HandleFunc(prefix+"/vms/{name}/processes/{id}/signal", s.requireOwner(s.wakeVM(s.signalProcess))).Methods("POST")
+		r.HandleFunc(prefix+"/snapshots/{id}/start", s.forkSnapshot).Methods("POST")
+	}
+	r.HandleFunc("/"+API_VERSION+"/health", s.healthCheck).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/events", s.events).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/signedurls", s.signURL).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/import", s.importSnapshot).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/{id}/export", s.exportSnapshot).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/{id}/compact", s.compactSnapshot).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/operations", s.listOperations).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/operations/{id}", s.getOperation).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/host/capacity", s.hostCapacity).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/prewarm", s.prewarm).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/reload", s.reload).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/config/validate", s.validateCandidateConfig).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/apikeys", s.createAPIKey).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/apikeys", s.listAPIKeys).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/apikeys/{id}", s.updateAPIKey).Methods("PATCH")
+	r.HandleFunc("/"+API_VERSION+"/admin/apikeys/{id}", s.revokeAPIKey).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/admin/cordon", s.cordonHost).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/cordon", s.uncordonHost).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/admin/capacity", s.capacityForecast).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/usage", s.usageReport).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/gc", s.orphanedResources).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/gc", s.collectGarbage).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/maintenance", s.maintenanceStatus).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/maintenance/windows", s.scheduleMaintenance).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/maintenance/windows/{id}", s.cancelMaintenance).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/admin/migrations", s.prepareIncomingMigration).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/admin/migrations/{id}", s.abortIncomingMigration).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/admin/migrations/{id}/disk", s.incomingMigrationDisk).Methods("PUT")
+	r.HandleFunc("/"+API_VERSION+"/admin/migrations/{id}/memory", s.incomingMigrationMemory).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/admin/migrations/{id}/complete", s.completeIncomingMigration).Methods("POST")
+
+	// Internal endpoints for VM callbacks and reports (called by vsockserver in guest)
+	r.HandleFunc("/"+API_VERSION+"/internal/callback", s.handleInternalCallback).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/internal/report", s.handleInternalReport).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/internal/telemetry/{signal}", s.handleInternalTelemetry).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/internal/credentials", s.handleInternalCredentials).Methods("GET")
+
+	// Routes only accept their own methods, so preflights need a route of their own to reach the
+	// cors middleware. They only get here if it didn't answer them.
+	r.PathPrefix("/").Methods(http.MethodOptions).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+	// Unmatched requests get v2's error envelope too, v1 keeps mux's own answers.
+	r.NotFoundHandler = apiV2ErrorHandler(http.StatusNotFound, "Not found", http.NotFoundHandler())
+	r.MethodNotAllowedHandler = apiV2ErrorHandler(http.StatusMethodNotAllowed, "Method not allowed", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+
+	r.Use(middlewares...)
+	return r
+}
+
 func main() {
 	var serverConfig *config.ServerConfig
 	var configFile string
@@ -510,6 +1470,15 @@ func main() {
 			log.Infof("server config: %v", serverConfig)
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "validate",
+				Usage: "Check the config and the host, then exit without starting the server",
+				Action: func(ctx *cli.Context) error {
+					return validateConfig(configFile)
+				},
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -517,61 +1486,135 @@ func main() {
 		log.WithError(err).Fatal("server exited with error")
 	}
 
-	// At this point `serverConfig` is populated.
-	// Create the session manager for handling HTTP callback sessions
-	sessionManager := callback.NewSessionManager()
+	// Only the default action populates `serverConfig`, e.g. not `validate` or `--help`.
+	if serverConfig == nil {
+		return
+	}
+	if err := applyLogLevel(serverConfig.LogLevel); err != nil {
+		log.Fatalf("failed to set log level: %v", err)
+	}
+
+	order, err := middlewareOrder(serverConfig.Middlewares)
+	if err != nil {
+		log.Fatalf("invalid middlewares: %v", err)
+	}
+	if err := validateListeners(serverConfig.Listeners); err != nil {
+		log.Fatalf("invalid listeners: %v", err)
+	}
+
+	shutdownTracing, err := tracing.Init(serverConfig.Tracing)
+	if err != nil {
+		log.Fatalf("failed to initialize tracing: %v", err)
+	}
+
+	listeners := append([]config.ListenerConfig{{
+		Address: net.JoinHostPort(serverConfig.Host, serverConfig.Port),
+	}}, serverConfig.Listeners...)
+
+	// HTTP servers, one per listener, each with its own middleware chain once the server is up.
+	// With high availability they answer as a standby until this server becomes the leader.
+	servers := make([]*http.Server, len(listeners))
+	gates := make([]*standbyGate, len(listeners))
+	for i := range listeners {
+		gates[i] = &standbyGate{lockPath: server.LeaderLockPath(*serverConfig)}
+		servers[i] = &http.Server{Handler: gates[i]}
+	}
+	serve := func() {
+		for i, l := range listeners {
+			listener, err := listen(l)
+			if err != nil {
+				log.Fatalf("Failed to listen on %s: %v", l.Address, err)
+			}
+			go func() {
+				log.WithField("disabledMiddlewares", l.DisableMiddlewares).Printf("REST server listening on: %s", l.Address)
+				if err := servers[i].Serve(listener); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("Failed to start server: %v", err)
+				}
+			}()
+		}
+	}
+	if serverConfig.HA.Enabled {
+		serve()
+		// Nothing may touch the state dir or the host's networking before this.
+		leaderLock, err := becomeLeader(*serverConfig)
+		if err != nil {
+			log.Fatalf("failed to become the leader: %v", err)
+		}
+		defer leaderLock.Release()
+	}
+
+	// Before anything reads the state dir.
+	if err := server.MigrateStateDir(serverConfig.StateDir); err != nil {
+		log.Fatalf("failed to migrate state dir: %v", err)
+	}
+
+	// Create the session manager for handling HTTP and WebSocket callback sessions
+	sessionManager, err := callback.NewSessionManager(serverConfig.Callbacks, serverConfig.StateDir)
+	if err != nil {
+		log.Fatalf("failed to create session manager: %v", err)
+	}
 
 	// Create the VM server
 	vmServer, err := server.NewServer(*serverConfig, sessionManager)
 	if err != nil {
 		log.Fatalf("failed to create VM server: %v", err)
 	}
+	sessionManager.OnSessionClose(vmServer.HandleSessionClose)
 
 	// Create REST server
 	s := &restServer{
 		vmServer:       vmServer,
 		sessionManager: sessionManager,
+		configFile:     configFile,
 	}
-	r := mux.NewRouter()
-
-	// Register routes
-	r.HandleFunc("/"+API_VERSION+"/vms", s.startVM).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.updateVMState).Methods("PATCH")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.destroyVM).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.destroyAllVMs).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.listAllVMs).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.listVM).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/snapshots", s.snapshotVM).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/cmd", s.vmCommand).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileUpload).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileDownload).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/health", s.healthCheck).Methods("GET")
-
-	// Internal endpoint for VM callbacks (called by vsockserver in guest)
-	r.HandleFunc("/"+API_VERSION+"/internal/callback", s.handleInternalCallback).Methods("POST")
-
-	// Start HTTP server
-	srv := &http.Server{
-		Addr:    serverConfig.Host + ":" + serverConfig.Port,
-		Handler: r,
+	middlewares, err := s.newMiddlewares(serverConfig.Middlewares)
+	if err != nil {
+		log.Fatalf("failed to set up middlewares: %v", err)
+	}
+	for i, l := range listeners {
+		gates[i].open(s.apiVersions(s.newRouter(middlewareChain(middlewares, order, l.DisableMiddlewares))))
+		// Event streams never finish by themselves, end them so that shutdown doesn't wait on them.
+		servers[i].RegisterOnShutdown(vmServer.Events().Close)
+	}
+	if !serverConfig.HA.Enabled {
+		serve()
 	}
-
-	go func() {
-		log.Printf("REST server listening on: %s:%s", serverConfig.Host, serverConfig.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
+	sig := <-sigChan
+	for sig == syscall.SIGHUP {
+		if restartRequired, err := s.reloadConfig(); err != nil {
+			log.WithError(err).Error("Failed to reload config")
+		} else {
+			log.WithField("restartRequired", restartRequired).Info("Config reloaded")
+		}
+		sig = <-sigChan
+	}
+
+	// Use the drain settings as of now, they may have been reloaded.
+	drainConfig := vmServer.Config().Drain
+	if sig == syscall.SIGUSR1 || drainConfig.OnShutdown {
+		drain(vmServer, drainConfig)
+	}
 
 	log.Println("Shutting down server...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+	for _, srv := range servers {
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Fatalf("Server shutdown failed: %v", err)
+		}
+	}
+	if ha := vmServer.Config().HA; ha.Enabled && ha.KeepVMsOnShutdown {
+		log.Println("Leaving VMs running for a standby to take over")
+	} else {
+		vmServer.DestroyAllVMs(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.WithError(err).Warn("failed to flush traces")
 	}
-	vmServer.DestroyAllVMs(context.Background())
 	log.Println("Server stopped")
 }
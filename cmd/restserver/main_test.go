@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+func TestRequiredPermission(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		websocket bool
+		want      string
+	}{
+		{name: "list vms", method: http.MethodGet, path: "/v1/vms", want: auth.PermissionRead},
+		{name: "head file", method: http.MethodHead, path: "/v1/vms/foo/files", want: auth.PermissionRead},
+		{name: "start vm", method: http.MethodPost, path: "/v1/vms", want: auth.PermissionWrite},
+		{name: "destroy vm", method: http.MethodDelete, path: "/v1/vms/foo", want: auth.PermissionWrite},
+		{name: "admin read", method: http.MethodGet, path: "/v1/admin/apikeys", want: auth.PermissionAdmin},
+		{name: "admin write", method: http.MethodPost, path: "/v1/admin/reload", want: auth.PermissionAdmin},
+		{name: "sign url", method: http.MethodPost, path: "/v1/signedurls", want: auth.PermissionRead},
+		{name: "callbacks", method: http.MethodGet, path: "/v1/vms/foo/ws", websocket: true, want: auth.PermissionWrite},
+		{name: "callbacks without upgrade", method: http.MethodGet, path: "/v1/vms/foo/ws", want: auth.PermissionWrite},
+		{name: "shell", method: http.MethodGet, path: "/v1/vms/foo/shell", websocket: true, want: auth.PermissionWrite},
+		{name: "guest websocket", method: http.MethodGet, path: "/v1/vms/foo/proxy/8080/", websocket: true, want: auth.PermissionWrite},
+		{name: "console logs", method: http.MethodGet, path: "/v1/vms/foo/logs", websocket: true, want: auth.PermissionRead},
+		{name: "admin websocket", method: http.MethodGet, path: "/v1/admin/ws", websocket: true, want: auth.PermissionAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.websocket {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+			if got := requiredPermission(r); got != tt.want {
+				t.Errorf("requiredPermission(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
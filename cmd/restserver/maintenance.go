@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) cordonHost(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cordonHost")
+
+	// The body is optional.
+	var req serverapi.CordonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CordonHost(r.Context(), req.GetReason())
+	if err != nil {
+		logger.WithError(err).Error("Failed to cordon host")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to cordon host: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) uncordonHost(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "uncordonHost")
+
+	resp, err := s.vmServer.UncordonHost(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Failed to uncordon host")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to uncordon host: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) maintenanceStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.MaintenanceStatus(r.Context()))
+}
+
+func (s *restServer) scheduleMaintenance(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "scheduleMaintenance")
+
+	var req serverapi.MaintenanceWindowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.ScheduleMaintenance(r.Context(), &req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to schedule maintenance window")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to schedule maintenance window: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) cancelMaintenance(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cancelMaintenance")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.CancelMaintenance(r.Context(), id)
+	if err != nil {
+		logger.WithField("id", id).WithError(err).Error("Failed to cancel maintenance window")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to cancel maintenance window: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
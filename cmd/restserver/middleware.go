@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/logrotate"
+)
+
+// Names of the middlewares in `middlewares.order` and `disable_middlewares`.
+const (
+	middlewareRequestID         = "request_id"
+	middlewareTracing           = "tracing"
+	middlewareCORS              = "cors"
+	middlewareRateLimit         = "rate_limit"
+	middlewareAuth              = "auth"
+	middlewareAudit             = "audit"
+	middlewareValidation        = "validation"
+	middlewareMigrationRedirect = "migration_redirect"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// Longer request IDs sent by callers are replaced with our own.
+	maxRequestIDLen = 128
+
+	defaultCORSMaxAge = 10 * time.Minute
+
+	// How often idle callers are dropped from the rate limiter.
+	rateLimitPruneInterval = time.Minute
+
+	unixListenerPrefix      = "unix:"
+	defaultUnixListenerMode = 0600
+)
+
+// Every middleware, in the default order.
+var defaultMiddlewareOrder = []string{
+	middlewareRequestID,
+	middlewareTracing,
+	middlewareCORS,
+	middlewareRateLimit,
+	middlewareAuth,
+	middlewareAudit,
+	middlewareValidation,
+	middlewareMigrationRedirect,
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "If-None-Match", "X-API-Key", requestIDHeader}
+)
+
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// middlewareOrder returns the order of the middlewares in `cfg`, after checking that it makes
+// sense.
+func middlewareOrder(cfg config.MiddlewaresConfig) ([]string, error) {
+	order := cfg.Order
+	if len(order) == 0 {
+		order = defaultMiddlewareOrder
+	}
+
+	positions := make(map[string]int, len(order))
+	for i, name := range order {
+		if !slices.Contains(defaultMiddlewareOrder, name) {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if _, ok := positions[name]; ok {
+			return nil, fmt.Errorf("middleware %s is listed twice", name)
+		}
+		positions[name] = i
+	}
+	if authPos, ok := positions[middlewareAuth]; ok {
+		if pos, ok := positions[middlewareCORS]; ok && pos > authPos {
+			return nil, fmt.Errorf("%s must come before %s to answer preflights", middlewareCORS, middlewareAuth)
+		}
+		if pos, ok := positions[middlewareValidation]; ok && pos < authPos {
+			return nil, fmt.Errorf("%s must come after %s to check the caller's namespaces", middlewareValidation, middlewareAuth)
+		}
+	}
+	if cfg.RateLimit.RequestsPerSecond < 0 || cfg.RateLimit.Burst < 0 {
+		return nil, fmt.Errorf("rate_limit must not be negative")
+	}
+	return order, nil
+}
+
+// validateListeners checks the extra listeners in `cfg`.
+func validateListeners(listeners []config.ListenerConfig) error {
+	for _, l := range listeners {
+		if socketPath, ok := strings.CutPrefix(l.Address, unixListenerPrefix); ok {
+			if !strings.HasPrefix(socketPath, "/") {
+				return fmt.Errorf("listener %s: socket path must be absolute", l.Address)
+			}
+			if _, err := unixListenerMode(l); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Address, err)
+			}
+		} else if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("listener %q: %w", l.Address, err)
+		}
+		for _, name := range l.DisableMiddlewares {
+			if !slices.Contains(defaultMiddlewareOrder, name) {
+				return fmt.Errorf("listener %s: unknown middleware %q", l.Address, name)
+			}
+		}
+	}
+	return nil
+}
+
+// unixListenerMode returns the permissions of the Unix socket of `l`.
+func unixListenerMode(l config.ListenerConfig) (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return defaultUnixListenerMode, nil
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket_mode %q", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listen opens the listener `l`, replacing a socket left behind by a previous run.
+func listen(l config.ListenerConfig) (net.Listener, error) {
+	socketPath, ok := strings.CutPrefix(l.Address, unixListenerPrefix)
+	if !ok {
+		return net.Listen("tcp", l.Address)
+	}
+
+	mode, err := unixListenerMode(l)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode().Type() == os.ModeSocket {
+		os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// newMiddlewares returns every middleware by name. Stateful ones, like the rate limiter, are
+// shared by all listeners.
+func (s *restServer) newMiddlewares(cfg config.MiddlewaresConfig) (map[string]mux.MiddlewareFunc, error) {
+	audit, err := newAuditLog(cfg.Audit)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]mux.MiddlewareFunc{
+		middlewareRequestID:         requestIDMiddleware,
+		middlewareTracing:           tracingMiddleware,
+		middlewareCORS:              newCORS(cfg.CORS).middleware,
+		middlewareRateLimit:         newRateLimiter(cfg.RateLimit).middleware,
+		middlewareAuth:              s.authMiddleware,
+		middlewareAudit:             audit.middleware,
+		middlewareValidation:        namespaceMiddleware,
+		middlewareMigrationRedirect: s.migratedVMRedirect,
+	}, nil
+}
+
+// middlewareChain returns the middlewares named in `order`, less those in `disabled`.
+func middlewareChain(middlewares map[string]mux.MiddlewareFunc, order []string, disabled []string) []mux.MiddlewareFunc {
+	var chain []mux.MiddlewareFunc
+	for _, name := range order {
+		if !slices.Contains(disabled, name) {
+			chain = append(chain, middlewares[name])
+		}
+	}
+	return chain
+}
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID of the request, or "" if the request_id middleware is off.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware tags every request with an ID, the caller's X-Request-ID if it sent a sane
+// one, and returns it in the response's X-Request-ID.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if len(id) > maxRequestIDLen || !requestIDRegex.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// cors adds CORS headers for allowed origins and answers their preflights.
+type cors struct {
+	allowedOrigins []string
+	allowMethods   string
+	allowHeaders   string
+	// Any header a preflight asks for is allowed.
+	anyHeader bool
+	maxAge    string
+}
+
+func newCORS(cfg config.CORSConfig) *cors {
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	maxAge := cfg.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultCORSMaxAge
+	}
+	return &cors{
+		allowedOrigins: cfg.AllowedOrigins,
+		allowMethods:   strings.ToUpper(strings.Join(methods, ", ")),
+		allowHeaders:   strings.Join(headers, ", "),
+		anyHeader:      slices.Contains(headers, "*"),
+		maxAge:         strconv.Itoa(int(maxAge.Seconds())),
+	}
+}
+
+// originAllowed reports whether `origin` is one of `allowed`, which may hold "*" for any.
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !originAllowed(c.allowedOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", Location, Retry-After, Deprecation, Sunset, Link, ETag")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			allowHeaders := c.allowHeaders
+			if c.anyHeader {
+				// Browsers don't let "*" cover Authorization, so the headers asked for are echoed.
+				allowHeaders = r.Header.Get("Access-Control-Request-Headers")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", c.allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			w.Header().Set("Access-Control-Max-Age", c.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter gives every caller a token bucket that refills at `rate` tokens a second, up to
+// `burst`. Each request takes a token.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(cfg.RequestsPerSecond))
+	}
+	return &rateLimiter{
+		rate:    cfg.RequestsPerSecond,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of `caller`. If it's empty, returns false and how long until
+// it has a token again.
+func (l *rateLimiter) allow(caller string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Buckets that refilled completely are the same as new ones.
+	refillTime := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		for key, b := range l.buckets {
+			if now.Sub(b.updated) > refillTime {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[caller]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[caller] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.rate == 0 || unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller := "ip:" + remoteIP(r)
+		if id := auth.FromContext(r.Context()); id != nil {
+			caller = "key:" + id.Name
+		}
+		if ok, wait := l.allow(caller, time.Now()); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			sendErrorDetails(w, http.StatusTooManyRequests, "Rate limit exceeded", map[string]interface{}{"retryAfterSeconds": retryAfter})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP returns the IP the request came from, or its remote address if it has no IP, e.g. on a
+// Unix socket.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditLog records requests, with their caller and outcome, to a file or the server log.
+type auditLog struct {
+	includeReads bool
+
+	// Nil to log instead.
+	file *logrotate.Writer
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Caller     string    `json:"caller,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+func newAuditLog(cfg config.AuditConfig) (*auditLog, error) {
+	a := &auditLog{includeReads: cfg.IncludeReads}
+	if cfg.Path != "" {
+		f, err := logrotate.Open(cfg.Path, 0600, logrotate.FromConfig(cfg.Rotation, logrotate.Policy{}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(rec auditRecord) {
+	if a.file == nil {
+		log.WithFields(log.Fields{
+			"requestId":  rec.RequestID,
+			"caller":     rec.Caller,
+			"remoteAddr": rec.RemoteAddr,
+			"method":     rec.Method,
+			"path":       rec.Path,
+			"status":     rec.Status,
+			"durationMs": rec.DurationMs,
+		}).Info("audit")
+		return
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode audit record")
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.WithError(err).Error("Failed to write audit record")
+	}
+}
+
+func (a *auditLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Guests calling back aren't API users.
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.includeReads && (r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		var caller string
+		if id := auth.FromContext(r.Context()); id != nil {
+			caller = id.Name
+		}
+		a.record(auditRecord{
+			Time:       start,
+			RequestID:  requestIDFromContext(r.Context()),
+			Caller:     caller,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rec.status,
+			DurationMs: time.Since(start).Milliseconds(),
+		})
+	})
+}
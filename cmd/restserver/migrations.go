@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) migrateVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "migrateVM")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.MigrateVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.MigrateVM(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":      vmName,
+			"destination": req.Destination,
+		}).WithError(err).Error("Failed to migrate VM")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to migrate VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) prepareIncomingMigration(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "prepareIncomingMigration")
+
+	var req serverapi.IncomingMigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.PrepareIncomingMigration(r.Context(), &req)
+	if err != nil {
+		logger.WithField("vmName", req.VmName).WithError(err).Error("Failed to prepare incoming migration")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to prepare incoming migration: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) abortIncomingMigration(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "abortIncomingMigration")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.AbortIncomingMigration(r.Context(), id)
+	if err != nil {
+		logger.WithField("migrationId", id).WithError(err).Error("Failed to abort incoming migration")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to abort incoming migration: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) incomingMigrationDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "incomingMigrationDisk")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.ReceiveMigrationDisk(r.Context(), id, r.Body)
+	if err != nil {
+		logger.WithField("migrationId", id).WithError(err).Error("Failed to receive stateful disk")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to receive stateful disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// incomingMigrationMemory bridges a WebSocket from the source of a migration to the cloud-hypervisor
+// receiving the VM. Binary messages carry cloud-hypervisor's migration stream both ways.
+func (s *restServer) incomingMigrationMemory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	logger := log.WithFields(log.Fields{
+		"api":         "incomingMigrationMemory",
+		"migrationId": id,
+	})
+
+	if s.originForbidden(w, r) {
+		return
+	}
+	chvConn, err := s.vmServer.DialIncomingMigration(r.Context(), id)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to connect to the migration receiver")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to connect to the migration receiver: %v", err))
+		return
+	}
+	defer chvConn.Close()
+
+	conn, err := s.upgrade(w, r)
+	if err != nil {
+		// upgrade has already replied.
+		logger.WithError(err).Warn("Failed to upgrade to WebSocket")
+		return
+	}
+	defer conn.Close()
+	logger.Info("Receiving migration stream")
+
+	bridgeWebSocket(conn, chvConn)
+	logger.Info("Migration stream closed")
+}
+
+func (s *restServer) completeIncomingMigration(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "completeIncomingMigration")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.CompleteIncomingMigration(r.Context(), id)
+	if err != nil {
+		logger.WithField("migrationId", id).WithError(err).Error("Failed to complete incoming migration")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to complete incoming migration: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// migratedVMRedirect sends requests for VMs that were migrated to another host there, WebSocket
+// session connects included.
+func (s *restServer) migratedVMRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := mux.Vars(r)["name"]; ok {
+			if destination, ok := s.vmServer.MigratedTo(vmNameFromRequest(r)); ok {
+				http.Redirect(w, r, "http://"+destination+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) exportSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "exportSnapshot")
+	snapshotId := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.ExportSnapshot(r.Context(), snapshotId)
+	if err != nil {
+		logger.WithField("snapshotId", snapshotId).WithError(err).Error("Failed to export snapshot")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to export snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// importSnapshot imports a snapshot from the URI in a JSON body, or from the archive that's the
+// body.
+func (s *restServer) importSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "importSnapshot")
+
+	var resp *serverapi.Operation
+	var err error
+	statusCode := http.StatusCreated
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var req serverapi.SnapshotImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.WithError(err).Error("Invalid request body")
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request format: %v", err))
+			return
+		}
+		resp, err = s.vmServer.ImportSnapshot(r.Context(), req.GetUri(), req.GetSnapshotId())
+		statusCode = http.StatusAccepted
+	} else {
+		resp, err = s.vmServer.ImportSnapshotArchive(r.Context(), r.Body, r.ContentLength, r.URL.Query().Get("snapshotId"))
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to import snapshot")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to import snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.ListOperations(r.Context()))
+}
+
+func (s *restServer) getOperation(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getOperation")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.GetOperation(r.Context(), id)
+	if err != nil {
+		logger.WithField("id", id).WithError(err).Error("Failed to get operation")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to get operation: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) startProcess(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "startProcess")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.ProcessStartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.StartProcess(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"cmd":    req.Cmd,
+		}).WithError(err).Error("Failed to start process")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to start process: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listProcesses(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listProcesses")
+	vmName := vmNameFromRequest(r)
+
+	resp, err := s.vmServer.ListProcesses(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list processes")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to list processes: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) getProcessOutput(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getProcessOutput")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	query := r.URL.Query()
+	var offset int64
+	if o := query.Get("offset"); o != "" {
+		var err error
+		if offset, err = strconv.ParseInt(o, 10, 64); err != nil || offset < 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid offset: %s", o))
+			return
+		}
+	}
+	var maxBytes int
+	if m := query.Get("maxBytes"); m != "" {
+		var err error
+		if maxBytes, err = strconv.Atoi(m); err != nil || maxBytes < 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid maxBytes: %s", m))
+			return
+		}
+	}
+
+	resp, err := s.vmServer.ProcessOutput(r.Context(), vmName, id, offset, maxBytes)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"processId": id,
+		}).WithError(err).Error("Failed to get process output")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to get process output: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) signalProcess(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "signalProcess")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	var req serverapi.ProcessSignalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.SignalProcess(r.Context(), vmName, id, req.Signal)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"processId": id,
+			"signal":    req.Signal,
+		}).WithError(err).Error("Failed to signal process")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to signal process: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) killProcess(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "killProcess")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.KillProcess(r.Context(), vmName, id)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"processId": id,
+		}).WithError(err).Error("Failed to kill process")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to kill process: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/server"
+)
+
+// vmServiceProxy forwards a request to an HTTP service in a VM over the service's vsock port,
+// WebSocket upgrades included. The caller's credentials are stripped first, so that the guest
+// never sees the API key.
+func (s *restServer) vmServiceProxy(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmServiceProxy")
+	vmName := vmNameFromRequest(r)
+	service := mux.Vars(r)["service"]
+	logger = logger.WithFields(log.Fields{
+		"vmName":  vmName,
+		"service": service,
+	})
+
+	socketPath, port, err := s.vmServer.VsockService(vmName, service)
+	dialTimeout := s.vmServer.Config().Timeouts.AgentDial
+	if err != nil {
+		sendErrorResponse(w, httpStatusFromError(err), fmt.Sprintf("Failed to reach service: %v", err))
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) && s.originForbidden(w, r) {
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = service
+			pr.Out.URL.Path = "/" + mux.Vars(r)["path"]
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = service
+			pr.SetXForwarded()
+
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Del("X-API-Key")
+			query := pr.Out.URL.Query()
+			query.Del("access_token")
+			query.Del(auth.SignatureParam)
+			pr.Out.URL.RawQuery = query.Encode()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return server.DialVsock(ctx, socketPath, port, dialTimeout)
+			},
+			// Every request dials the guest afresh, so idle connections would only pile up.
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.WithError(err).Warn("Failed to proxy request to service")
+			sendErrorResponse(w, http.StatusBadGateway, fmt.Sprintf("Failed to reach service: %v", err))
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// shellMessage is a text message of a shell WebSocket: a resize from the client, or the shell's
+// exit from the server.
+type shellMessage struct {
+	Type     string `json:"type"`
+	Cols     uint16 `json:"cols,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ptyRequestFromQuery reads the terminal size and type of a shell from the query of `r`.
+func ptyRequestFromQuery(r *http.Request) (guestcall.PTYRequest, error) {
+	query := r.URL.Query()
+	req := guestcall.PTYRequest{Term: query.Get("term")}
+	for name, dst := range map[string]*uint16{"cols": &req.Cols, "rows": &req.Rows} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || n == 0 {
+			return req, fmt.Errorf("invalid %s %q", name, value)
+		}
+		*dst = uint16(n)
+	}
+	return req, nil
+}
+
+// vmShellWebSocket bridges a WebSocket to an interactive shell in the guest. Binary messages carry
+// terminal input and output, a text message `{"type": "resize", "cols": ..., "rows": ...}` resizes
+// the terminal, and the server sends `{"type": "exit", "exitCode": ...}` before closing once the
+// shell exits.
+func (s *restServer) vmShellWebSocket(w http.ResponseWriter, r *http.Request) {
+	vmName := vmNameFromRequest(r)
+	logger := log.WithFields(log.Fields{
+		"api":    "vmShellWebSocket",
+		"vmName": vmName,
+	})
+
+	if s.originForbidden(w, r) {
+		return
+	}
+	req, err := ptyRequestFromQuery(r)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	guestConn, err := s.vmServer.OpenShell(r.Context(), vmName, req)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to open shell")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to open shell: %v", err))
+		return
+	}
+	defer guestConn.Close()
+
+	conn, err := s.upgrade(w, r)
+	if err != nil {
+		// upgrade has already replied.
+		logger.WithError(err).Warn("Failed to upgrade to WebSocket")
+		return
+	}
+	defer conn.Close()
+	logger.Info("Opened shell")
+
+	// Only this goroutine writes to the WebSocket.
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		closeCode, closeText := websocket.CloseNormalClosure, ""
+		defer func() {
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(closeCode, closeText),
+				time.Now().Add(time.Second))
+		}()
+		for {
+			typ, payload, err := guestcall.ReadFrame(guestConn)
+			if err != nil {
+				closeCode, closeText = websocket.CloseGoingAway, "shell connection lost"
+				return
+			}
+			switch typ {
+			case guestcall.FrameData:
+				if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					return
+				}
+			case guestcall.FrameExit:
+				var exit guestcall.PTYExit
+				if err := json.Unmarshal(payload, &exit); err != nil {
+					exit = guestcall.PTYExit{ExitCode: -1, Error: fmt.Sprintf("invalid exit from agent: %v", err)}
+				}
+				logger.WithField("exitCode", exit.ExitCode).Info("Shell exited")
+				conn.WriteJSON(shellMessage{Type: "exit", ExitCode: exit.ExitCode, Error: exit.Error})
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if typ == websocket.TextMessage {
+				var msg shellMessage
+				if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "resize" || msg.Cols == 0 || msg.Rows == 0 {
+					logger.Warnf("Ignoring invalid shell message: %s", data)
+					continue
+				}
+				size, _ := json.Marshal(guestcall.PTYSize{Cols: msg.Cols, Rows: msg.Rows})
+				err = guestcall.WriteFrame(guestConn, guestcall.FrameResize, size)
+			} else {
+				err = guestcall.WriteFrame(guestConn, guestcall.FrameData, data)
+			}
+			if err != nil {
+				break
+			}
+		}
+		// Hangs up the shell, which ends the output too.
+		guestConn.Close()
+	}()
+	<-outputDone
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) createSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "createSnapshotPolicy")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.SnapshotPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CreateSnapshotPolicy(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":   vmName,
+			"schedule": req.Schedule,
+		}).WithError(err).Error("Failed to create snapshot policy")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to create snapshot policy: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listSnapshotPolicies(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listSnapshotPolicies")
+	vmName := vmNameFromRequest(r)
+
+	resp, err := s.vmServer.ListSnapshotPolicies(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list snapshot policies")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to list snapshot policies: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) deleteSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "deleteSnapshotPolicy")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.DeleteSnapshotPolicy(r.Context(), vmName, id)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":   vmName,
+			"policyId": id,
+		}).WithError(err).Error("Failed to delete snapshot policy")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to delete snapshot policy: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// Size of the chunks read from guest sockets bridged to WebSockets.
+const socketBufferSize = 32 << 10
+
+func (s *restServer) createSocketForward(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "createSocketForward")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.SocketForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CreateSocketForward(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"guestPath": req.GuestPath,
+		}).WithError(err).Error("Failed to expose guest socket")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to expose guest socket: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listSocketForwards(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listSocketForwards")
+	vmName := vmNameFromRequest(r)
+
+	resp, err := s.vmServer.ListSocketForwards(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list exposed guest sockets")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to list exposed guest sockets: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) deleteSocketForward(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "deleteSocketForward")
+	vmName := vmNameFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.DeleteSocketForward(r.Context(), vmName, id)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":   vmName,
+			"socketId": id,
+		}).WithError(err).Error("Failed to remove exposed guest socket")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to remove exposed guest socket: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// vmSocketWebSocket bridges a WebSocket to a Unix socket in the guest. Binary messages carry the
+// socket's bytes both ways.
+func (s *restServer) vmSocketWebSocket(w http.ResponseWriter, r *http.Request) {
+	vmName := vmNameFromRequest(r)
+	socketPath := r.URL.Query().Get("path")
+	logger := log.WithFields(log.Fields{
+		"api":    "vmSocketWebSocket",
+		"vmName": vmName,
+		"socket": socketPath,
+	})
+
+	if s.originForbidden(w, r) {
+		return
+	}
+	guestConn, err := s.vmServer.DialGuestSocket(r.Context(), vmName, socketPath)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to connect to guest socket")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to connect to guest socket: %v", err))
+		return
+	}
+	defer guestConn.Close()
+
+	conn, err := s.upgrade(w, r)
+	if err != nil {
+		// upgrade has already replied.
+		logger.WithError(err).Warn("Failed to upgrade to WebSocket")
+		return
+	}
+	defer conn.Close()
+	logger.Info("Bridging guest socket to WebSocket")
+
+	bridgeWebSocket(conn, guestConn)
+	logger.Info("Guest socket WebSocket closed")
+}
+
+// bridgeWebSocket copies binary messages of `conn` to `target` and what `target` sends back to
+// `conn`, until either side closes. `target` is closed on return.
+func bridgeWebSocket(conn *websocket.Conn, target io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, socketBufferSize)
+		for {
+			n, err := target.Read(buf)
+			if n > 0 {
+				if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+					time.Now().Add(time.Second))
+				return
+			}
+		}
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if _, err := target.Write(data); err != nil {
+			break
+		}
+	}
+	// Ends the copy from the target too.
+	target.Close()
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/server"
+)
+
+// standbyGate serves the API of a listener once the server is up. Until then, e.g. while it's a
+// standby waiting for the leader lock, every request, the health check included, gets a 503 so
+// that load balancers send them to the leader.
+type standbyGate struct {
+	handler  atomic.Pointer[http.Handler]
+	lockPath string
+}
+
+func (g *standbyGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler := g.handler.Load(); handler != nil {
+		(*handler).ServeHTTP(w, r)
+		return
+	}
+	message := "Server is on standby"
+	if leader, _ := server.CurrentLeader(g.lockPath); leader != nil {
+		message += fmt.Sprintf(", the leader is %s on %s (pid %d)", leader.Address, leader.Host, leader.PID)
+	}
+	sendErrorResponse(w, http.StatusServiceUnavailable, message)
+}
+
+// open starts serving `handler` instead of the standby answer.
+func (g *standbyGate) open(handler http.Handler) {
+	g.handler.Store(&handler)
+}
+
+// becomeLeader blocks until this server holds the leader lock of its high-availability setup, so
+// that it can start managing VMs. The lock is held until the process exits.
+func becomeLeader(cfg config.ServerConfig) (*server.LeaderLock, error) {
+	hostname, _ := os.Hostname()
+	lockPath := server.LeaderLockPath(cfg)
+	info := server.LeaderInfo{
+		Host: hostname,
+		PID:  os.Getpid(),
+		// As standbys are reached, e.g. "10.0.0.5:7000".
+		Address: net.JoinHostPort(cfg.Host, cfg.Port),
+	}
+
+	logged := false
+	lock, err := server.AcquireLeaderLock(context.Background(), lockPath, cfg.HA.RetryInterval, info, func(leader *server.LeaderInfo) {
+		if logged {
+			return
+		}
+		logged = true
+		logger := log.WithField("lockFile", lockPath)
+		if leader != nil {
+			logger = logger.WithFields(log.Fields{"leader": leader.Address, "leaderPid": leader.PID})
+		}
+		logger.Info("Another server is the leader, waiting on standby")
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("lockFile", lockPath).Info("Became the leader")
+	return lock, nil
+}
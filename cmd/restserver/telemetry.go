@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// handleInternalTelemetry forwards OTLP/HTTP JSON logs or metrics that a guest collected to the
+// collector of the `guest_telemetry` config. This endpoint is called by the vsockserver running
+// inside guest VMs, which names its VM in the "vmName" query parameter.
+func (s *restServer) handleInternalTelemetry(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "handleInternalTelemetry")
+
+	vmName := r.URL.Query().Get("vmName")
+	if vmName == "" {
+		sendErrorResponse(w, http.StatusBadRequest, "vmName is required")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, guestcall.MaxTelemetryBody))
+	if err != nil {
+		sendErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Failed to read telemetry: %v", err))
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Unknown source address")
+		return
+	}
+	signal := mux.Vars(r)["signal"]
+	if err := s.vmServer.ForwardGuestTelemetry(r.Context(), vmName, net.ParseIP(host), signal, body); err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"signal": signal,
+		}).WithError(err).Warn("Failed to forward guest telemetry")
+		sendErrorResponse(w, httpStatusFromError(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
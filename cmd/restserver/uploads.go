@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+func (s *restServer) getUploadStatus(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getUploadStatus")
+	vmName := vmNameFromRequest(r)
+	path := r.URL.Query().Get("path")
+
+	resp, err := s.vmServer.UploadStatus(r.Context(), vmName, path)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   path,
+		}).WithError(err).Error("Failed to get upload status")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to get upload status: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) writeUpload(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "writeUpload")
+	vmName := vmNameFromRequest(r)
+	query := r.URL.Query()
+	path := query.Get("path")
+
+	var offset int64
+	if o := query.Get("offset"); o != "" {
+		var err error
+		if offset, err = strconv.ParseInt(o, 10, 64); err != nil || offset < 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid offset: %s", o))
+			return
+		}
+	}
+	var mkdirs bool
+	if m := query.Get("mkdirs"); m != "" {
+		var err error
+		if mkdirs, err = strconv.ParseBool(m); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid mkdirs: %s", m))
+			return
+		}
+	}
+
+	resp, err := s.vmServer.WriteUpload(r.Context(), vmName, path, offset, mkdirs, r.Body)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   path,
+			"offset": offset,
+		}).WithError(err).Error("Failed to write upload")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to write upload: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) commitUpload(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "commitUpload")
+	vmName := vmNameFromRequest(r)
+
+	var req serverapi.FileUploadCommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CommitUpload(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   req.Path,
+		}).WithError(err).Error("Failed to commit upload")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to commit upload: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) abortUpload(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "abortUpload")
+	vmName := vmNameFromRequest(r)
+	path := r.URL.Query().Get("path")
+
+	resp, err := s.vmServer.AbortUpload(r.Context(), vmName, path)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   path,
+		}).WithError(err).Error("Failed to abort upload")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to abort upload: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseByteRange parses a Range header of a single range, "bytes=N-" or "bytes=N-M", into its
+// offset and length, zero for the rest of the file.
+func parseByteRange(header string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	start, end, hasDash := strings.Cut(spec, "-")
+	if !ok || !hasDash || start == "" || strings.Contains(end, ",") {
+		return 0, 0, fmt.Errorf("only a single range of the form bytes=N- or bytes=N-M is supported, got %q", header)
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid range start %q", start)
+	}
+	if end == "" {
+		return offset, 0, nil
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || last < offset {
+		return 0, 0, fmt.Errorf("invalid range end %q", end)
+	}
+	return offset, last - offset + 1, nil
+}
+
+func (s *restServer) streamFile(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "streamFile")
+	vmName := vmNameFromRequest(r)
+	path := r.URL.Query().Get("path")
+
+	var offset, length int64
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		var err error
+		if offset, length, err = parseByteRange(rangeHeader); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid range: %v", err))
+			return
+		}
+	}
+
+	file, err := s.vmServer.OpenGuestFile(r.Context(), vmName, path, offset, length)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   path,
+		}).WithError(err).Error("Failed to open file")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to open file: %v", err))
+		return
+	}
+	defer file.Close()
+
+	if rangeHeader != "" && file.Length == 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+		sendErrorResponse(w, http.StatusRequestedRangeNotSatisfiable,
+			fmt.Sprintf("Range starts at the end of the %d bytes of %s", file.Size, path))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Length, 10))
+	if rangeHeader != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", file.Offset, file.Offset+file.Length-1, file.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if n, err := io.Copy(w, file); err != nil {
+		// Too late for an error response, the client sees the body end early.
+		logger.WithFields(log.Fields{
+			"vmName":  vmName,
+			"path":    path,
+			"written": n,
+		}).WithError(err).Error("Failed to stream file")
+	}
+}
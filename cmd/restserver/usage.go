@@ -0,0 +1,11 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *restServer) usageReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.UsageReport())
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/server"
+	"github.com/abilashraghuram/arrakis/pkg/server/statemigrate"
+)
+
+type diagnosticLevel int
+
+// access(2) mode, as syscall doesn't export it.
+const accessWriteOK = 0x2
+
+const (
+	diagnosticOK diagnosticLevel = iota
+	diagnosticWarn
+	diagnosticFail
+)
+
+func (l diagnosticLevel) String() string {
+	switch l {
+	case diagnosticOK:
+		return " OK "
+	case diagnosticWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// diagnostic is the outcome of a single check run by `validate`.
+type diagnostic struct {
+	level   diagnosticLevel
+	check   string
+	message string
+	// What to do about it, only set for warnings and failures.
+	hint string
+}
+
+// diagnostics collects the results of the checks in the order they ran.
+type diagnostics []diagnostic
+
+func (d *diagnostics) ok(check string, format string, args ...any) {
+	*d = append(*d, diagnostic{level: diagnosticOK, check: check, message: fmt.Sprintf(format, args...)})
+}
+
+func (d *diagnostics) warn(check string, hint string, format string, args ...any) {
+	*d = append(*d, diagnostic{level: diagnosticWarn, check: check, message: fmt.Sprintf(format, args...), hint: hint})
+}
+
+func (d *diagnostics) fail(check string, hint string, format string, args ...any) {
+	*d = append(*d, diagnostic{level: diagnosticFail, check: check, message: fmt.Sprintf(format, args...), hint: hint})
+}
+
+func (d diagnostics) print() {
+	for _, diag := range d {
+		fmt.Printf("[%s] %s: %s\n", diag.level, diag.check, diag.message)
+		if diag.hint != "" {
+			fmt.Printf("       -> %s\n", diag.hint)
+		}
+	}
+}
+
+func (d diagnostics) count(level diagnosticLevel) int {
+	n := 0
+	for _, diag := range d {
+		if diag.level == level {
+			n++
+		}
+	}
+	return n
+}
+
+// checkFile checks that `p` is an existing regular file. With `executable` it also has to have an
+// execute bit set.
+func (d *diagnostics) checkFile(check string, p string, executable bool, hint string) {
+	if p == "" {
+		d.fail(check, hint, "not set")
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		d.fail(check, hint, "%v", err)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		d.fail(check, hint, "%s is not a regular file", p)
+		return
+	}
+	if executable && info.Mode().Perm()&0111 == 0 {
+		d.fail(check, fmt.Sprintf("run `chmod +x %s`", p), "%s is not executable", p)
+		return
+	}
+	d.ok(check, "%s", p)
+}
+
+// checkImage is like `checkFile` but accepts http(s) URLs, which are downloaded when first used.
+func (d *diagnostics) checkImage(check string, src string, hint string) {
+	if u, err := url.Parse(src); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		d.ok(check, "%s (downloaded on first use)", src)
+		return
+	}
+	d.checkFile(check, src, false, hint)
+}
+
+// checkImageFormat checks that qemu-img can convert the disk image `src` if it's a qcow2 image.
+func (d *diagnostics) checkImageFormat(check string, src string) {
+	if !server.NeedsConversion(src) {
+		return
+	}
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		d.fail(check, "install qemu-img or convert the image to raw", "%s is a qcow2 image, which needs qemu-img to be converted", src)
+		return
+	}
+	d.ok(check+".format", "%s is a qcow2 image, converted to raw on first use", src)
+}
+
+func (d *diagnostics) checkStateDir(stateDir string) {
+	const check = "state_dir"
+	if stateDir == "" {
+		d.fail(check, "set state_dir to a directory on a disk with room for VM disks and snapshots", "not set")
+		return
+	}
+
+	info, err := os.Stat(stateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		// Created on start as long as we can write to the closest existing ancestor.
+		parent := path.Dir(path.Clean(stateDir))
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == "/" || parent == "." {
+				break
+			}
+			parent = path.Dir(parent)
+		}
+		if err := syscall.Access(parent, accessWriteOK); err != nil {
+			d.fail(check, "create it up front or run the server as a user that can write to "+parent, "%s doesn't exist and can't be created: %v", stateDir, err)
+			return
+		}
+		d.ok(check, "%s (created on start)", stateDir)
+		return
+	}
+	if err != nil {
+		d.fail(check, "", "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		d.fail(check, "point state_dir at a directory", "%s is not a directory", stateDir)
+		return
+	}
+	if err := syscall.Access(stateDir, accessWriteOK); err != nil {
+		d.fail(check, "run the server as root or fix the directory's permissions", "%s is not writable: %v", stateDir, err)
+		return
+	}
+	version, latest, err := server.StateDirVersion(stateDir)
+	if err != nil {
+		d.fail(check, "fix or remove "+path.Join(stateDir, statemigrate.VersionFileName), "%v", err)
+		return
+	}
+	if version > latest {
+		d.fail(check, "upgrade the server, or restore a backup from "+path.Join(stateDir, statemigrate.BackupsDirName),
+			"%s is at format version %d, newer than the %d this server supports", stateDir, version, latest)
+		return
+	}
+	if version < latest {
+		d.ok(check, "%s (migrated from format version %d to %d on start)", stateDir, version, latest)
+		return
+	}
+	d.ok(check, "%s", stateDir)
+}
+
+func (d *diagnostics) checkKVM() {
+	const check = "kvm"
+	info, err := os.Stat("/dev/kvm")
+	if err != nil {
+		d.fail(check, "enable virtualization in the BIOS or, on a cloud VM, use an instance type with nested virtualization, then `modprobe kvm_intel` or `modprobe kvm_amd`", "/dev/kvm not available: %v", err)
+		return
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		d.fail(check, "", "/dev/kvm is not a character device")
+		return
+	}
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		d.fail(check, "run the server as root or add the user to the kvm group", "can't open /dev/kvm: %v", err)
+		return
+	}
+	f.Close()
+	d.ok(check, "/dev/kvm is accessible")
+}
+
+func (d *diagnostics) checkBridge(cfg config.ServerConfig) {
+	const check = "bridge"
+	bridgeIP, bridgeIPNet, err := net.ParseCIDR(cfg.BridgeIP)
+	if err != nil {
+		d.fail("bridge_ip", "use CIDR notation, e.g. 10.20.1.1/24", "invalid: %v", err)
+	}
+	_, subnet, err := net.ParseCIDR(cfg.BridgeSubnet)
+	if err != nil {
+		d.fail("bridge_subnet", "use CIDR notation, e.g. 10.20.1.0/24", "invalid: %v", err)
+	}
+	if bridgeIPNet != nil && subnet != nil && !subnet.Contains(bridgeIP) {
+		d.fail("bridge_ip", "pick a bridge_ip inside bridge_subnet", "%s is not in %s", cfg.BridgeIP, cfg.BridgeSubnet)
+	}
+
+	iface, err := net.InterfaceByName(cfg.BridgeName)
+	if err != nil {
+		// setupBridgeAndFirewall creates it using these tools.
+		var missing []string
+		for _, tool := range []string{"ip", "iptables", "iptables-save", "sysctl"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				missing = append(missing, tool)
+			}
+		}
+		if len(missing) > 0 {
+			d.fail(check, "install iproute2, iptables and procps", "%s doesn't exist and can't be created, missing: %s", cfg.BridgeName, strings.Join(missing, ", "))
+			return
+		}
+		if subnet != nil {
+			if conflict := findConflictingInterface(subnet); conflict != "" {
+				d.fail(check, "pick a bridge_subnet that isn't used on this host", "bridge_subnet %s overlaps with an address on %s", cfg.BridgeSubnet, conflict)
+				return
+			}
+		}
+		// The bridge also gets an address on every subnet of the IP pools, but for the bridged one,
+		// whose subnet is already on the host.
+		for name, pool := range cfg.IPAM.Pools {
+			if name == cfg.NetworkModes.Bridged.Pool {
+				continue
+			}
+			for _, cidr := range pool.CIDRs {
+				_, poolSubnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					d.fail("ipam", "use CIDR notation, e.g. 10.20.2.0/24", "ipam.pools.%s has an invalid subnet: %v", name, err)
+					return
+				}
+				if conflict := findConflictingInterface(poolSubnet); conflict != "" {
+					d.fail(check, "pick pool subnets that aren't used on this host", "ipam.pools.%s subnet %s overlaps with an address on %s", name, cidr, conflict)
+					return
+				}
+			}
+		}
+		d.ok(check, "%s doesn't exist yet and will be created on start", cfg.BridgeName)
+		return
+	}
+
+	if _, err := os.Stat(path.Join("/sys/class/net", iface.Name, "bridge")); err != nil {
+		d.fail(check, "pick a bridge_name that isn't used by another interface", "%s exists but is not a bridge", cfg.BridgeName)
+		return
+	}
+	d.ok(check, "%s exists", cfg.BridgeName)
+}
+
+// checkNetworkModes checks that the bridge of the bridged network mode, if it's on, exists.
+func (d *diagnostics) checkNetworkModes(cfg config.ServerConfig) {
+	const check = "network_modes"
+	bridge := cfg.NetworkModes.Bridged.Bridge
+	if bridge == "" {
+		return
+	}
+	if _, err := os.Stat(path.Join("/sys/class/net", bridge, "bridge")); err != nil {
+		d.fail(check, "create the bridge of bridged VMs or unset network_modes.bridged.bridge", "%s doesn't exist or is not a bridge", bridge)
+		return
+	}
+	d.ok(check, "bridged VMs are attached to %s", bridge)
+}
+
+// checkEgress checks that egress policies can be enforced on this host.
+func (d *diagnostics) checkEgress() {
+	const check = "egress"
+	if _, err := exec.LookPath("nft"); err != nil {
+		d.warn(check, "install nftables", "nft not found, starting VMs with an egress policy fails")
+		return
+	}
+	d.ok(check, "nft is installed")
+}
+
+// checkNetworkNamespaces checks that VMs can get network namespaces of their own, if they should.
+func (d *diagnostics) checkNetworkNamespaces(cfg config.ServerConfig) {
+	const check = "network_namespaces"
+	if !cfg.NetworkNamespaces {
+		return
+	}
+	if output, err := exec.Command("ip", "netns", "list").CombinedOutput(); err != nil {
+		d.fail(check, "install iproute2 with netns support or turn network_namespaces off", "ip netns doesn't work: %s %v", output, err)
+		return
+	}
+	d.ok(check, "VMs get network namespaces of their own")
+}
+
+// checkBaseImages checks that the base images exist, and that qemu-img can make overlays of them
+// where they can't be cloned.
+func (d *diagnostics) checkBaseImages(cfg config.ServerConfig) {
+	names := make([]string, 0, len(cfg.BaseImages))
+	for name := range cfg.BaseImages {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		d.checkFile("base_images."+name, cfg.BaseImages[name], false, "create the image or remove it from base_images")
+		d.checkImageFormat("base_images."+name, cfg.BaseImages[name])
+	}
+	if len(names) > 0 {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			d.warn("base_images", "install qemu-img", "qemu-img not found, VMs can only start from base images if state_dir's file system can clone files, like XFS or btrfs")
+		}
+	}
+}
+
+// checkVolumes checks that the volumes exist, and that new data disks can be formatted.
+func (d *diagnostics) checkVolumes(cfg config.ServerConfig) {
+	names := make([]string, 0, len(cfg.Volumes))
+	for name := range cfg.Volumes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		d.checkFile("volumes."+name, cfg.Volumes[name], false, "create the image or remove it from volumes")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		d.warn("volumes", "install e2fsprogs", "mkfs.ext4 not found, VMs can only be attached volumes, not new data disks")
+	}
+}
+
+// checkHypervisorSandbox checks that the helpers confining the hypervisor can be run, if it's
+// confined by more than its seccomp filter.
+func (d *diagnostics) checkHypervisorSandbox(cfg config.ServerConfig) {
+	const check = "hypervisor_sandbox"
+	sandbox := cfg.HypervisorSandbox
+	if sandbox.Seccomp == "false" {
+		d.warn(check, "set hypervisor_sandbox.seccomp to true", "the hypervisor runs without a seccomp filter")
+	}
+	if !sandbox.Sandboxed() {
+		return
+	}
+	var tools []string
+	if sandbox.NoNewPrivs || len(sandbox.Capabilities) > 0 {
+		tools = append(tools, "setpriv")
+	}
+	if sandbox.ReadOnlyMounts {
+		tools = append(tools, "unshare", "mount", "awk")
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			d.fail(check, "install util-linux", "%s not found, VMs can't be started", tool)
+			return
+		}
+	}
+	if len(sandbox.Capabilities) > 0 && !slices.Contains(sandbox.Capabilities, "CAP_NET_ADMIN") {
+		d.warn(check, "add CAP_NET_ADMIN to hypervisor_sandbox.capabilities", "the hypervisor can't open the tap devices of VMs without CAP_NET_ADMIN")
+	}
+	d.ok(check, "the hypervisor is confined with %s", strings.Join(tools, ", "))
+}
+
+// checkJailer checks that hypervisors can be jailed, if the jailer is on: that there's chroot and
+// cgroup v2, that device nodes work in the jails, and that the hypervisor's binary runs without the
+// libraries it'd find outside its jail.
+func (d *diagnostics) checkJailer(cfg config.ServerConfig) {
+	const check = "jailer"
+	if !cfg.Jailer.Enabled {
+		return
+	}
+	if _, err := exec.LookPath("chroot"); err != nil {
+		d.fail(check, "install coreutils", "chroot not found, VMs can't be started")
+		return
+	}
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		d.fail(check, "mount cgroup v2 at /sys/fs/cgroup", "no cgroup v2 at /sys/fs/cgroup, jails can't have cgroups")
+		return
+	}
+	// The closest existing directory, the jails' is only created with the first jail.
+	dir := cfg.Jailer.ChrootBaseDir
+	var fsStat unix.Statfs_t
+	for unix.Statfs(dir, &fsStat) != nil && dir != path.Dir(dir) {
+		dir = path.Dir(dir)
+	}
+	if fsStat.Flags&unix.ST_NODEV != 0 {
+		d.fail(check, "move jailer.chroot_base_dir off the nodev mount", "%s is mounted nodev, hypervisors can't open /dev/kvm in their jails", dir)
+		return
+	}
+	if f, err := elf.Open(cfg.ChvBinPath); err == nil {
+		defer f.Close()
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_INTERP {
+				d.fail(check, "use a statically linked cloud-hypervisor", "%s is dynamically linked, its libraries aren't in the jail", cfg.ChvBinPath)
+				return
+			}
+		}
+	}
+	d.ok(check, "hypervisors run in jails under %s, as users from %d", cfg.Jailer.ChrootBaseDir, cfg.Jailer.UIDBase)
+}
+
+// checkHypervisorCgroups checks that the host has the cgroup v2 controllers hypervisors are
+// limited by, and that the IO caps can be applied to the disk holding state_dir.
+func (d *diagnostics) checkHypervisorCgroups(cfg config.ServerConfig) {
+	const check = "hypervisor_cgroups"
+	if !cfg.HypervisorCgroups.Enabled {
+		return
+	}
+	data, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		d.fail(check, "mount cgroup v2 at /sys/fs/cgroup", "no cgroup v2 at /sys/fs/cgroup, VMs can't be started")
+		return
+	}
+	controllers := strings.Fields(string(data))
+	for _, c := range []string{"cpu", "memory", "io"} {
+		if !slices.Contains(controllers, c) {
+			d.fail(check, "enable the "+c+" controller of cgroup v2", "the host has no %s controller, hypervisors can't be limited", c)
+			return
+		}
+	}
+	if io := cfg.HypervisorCgroups.IO; io.ReadBPS > 0 || io.WriteBPS > 0 || io.ReadIOPS > 0 || io.WriteIOPS > 0 {
+		var st unix.Stat_t
+		if err := unix.Stat(cfg.StateDir, &st); err == nil && unix.Major(uint64(st.Dev)) == 0 {
+			d.fail(check, "put state_dir on a block device or remove hypervisor_cgroups.io", "%s isn't on a block device, its IO can't be capped", cfg.StateDir)
+			return
+		}
+	}
+	d.ok(check, "hypervisors are limited in cgroups under %s", cfg.HypervisorCgroups.Parent)
+}
+
+// checkSharedDirs checks that virtiofsd can be run, if directories can be shared. Without it,
+// they're shared over 9P only.
+func (d *diagnostics) checkSharedDirs(cfg config.ServerConfig) {
+	const check = "shared_dirs"
+	if len(cfg.SharedDirs.AllowedPaths) == 0 {
+		return
+	}
+	if _, err := exec.LookPath(cfg.SharedDirs.Virtiofsd); err != nil {
+		d.warn(check, "install virtiofsd or point shared_dirs.virtiofsd at it", "%s not found, directories are shared over the slower 9P only", cfg.SharedDirs.Virtiofsd)
+	}
+	for _, p := range cfg.SharedDirs.AllowedPaths {
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			d.warn(check, "create the directory or remove it from shared_dirs.allowed_paths", "allowed path %s isn't a directory", p)
+			return
+		}
+	}
+	d.ok(check, "directories under %s can be shared", strings.Join(cfg.SharedDirs.AllowedPaths, ", "))
+}
+
+// findConflictingInterface returns the name of a host interface with an address in `subnet`.
+func findConflictingInterface(subnet *net.IPNet) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && (subnet.Contains(ipNet.IP) || ipNet.Contains(subnet.IP)) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+func (d *diagnostics) checkListenPort(cfg config.ServerConfig) {
+	const check = "port"
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		d.fail(check, "stop whatever is listening there (see `ss -ltnp`) or change host/port", "can't listen on %s: %v", addr, err)
+		return
+	}
+	listener.Close()
+	d.ok(check, "%s is available", addr)
+}
+
+func (d *diagnostics) checkPortForwards(portForwards []config.PortForwardConfig) {
+	const check = "port_forwards"
+	const hint = `use a single port, e.g. "5901", or an inclusive range, e.g. "5736-5740"`
+	parsePort := func(s string) (int, error) {
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("invalid port %q", s)
+		}
+		return port, nil
+	}
+
+	valid := true
+	for _, pf := range portForwards {
+		start, end, isRange := strings.Cut(pf.Port, "-")
+		startPort, err := parsePort(start)
+		if err != nil {
+			d.fail(check, hint, "%s: %v", pf.Description, err)
+			valid = false
+			continue
+		}
+		if isRange {
+			endPort, err := parsePort(end)
+			if err != nil {
+				d.fail(check, hint, "%s: %v", pf.Description, err)
+				valid = false
+				continue
+			}
+			if startPort >= endPort {
+				d.fail(check, hint, "%s: start port must be less than end port in %s", pf.Description, pf.Port)
+				valid = false
+			}
+		}
+	}
+	if valid {
+		d.ok(check, "%d configured", len(portForwards))
+	}
+}
+
+func (d *diagnostics) checkSettings(cfg config.ServerConfig) {
+	if cfg.LogLevel != "" {
+		if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+			d.fail("log_level", "use one of trace, debug, info, warn or error", "%v", err)
+		}
+	}
+	if cfg.StatefulSizeInMB <= 0 {
+		d.fail("stateful_size_in_mb", "set it to the size of each VM's stateful disk, e.g. 2048", "must be positive, got %d", cfg.StatefulSizeInMB)
+	}
+	if cfg.GuestMemPercentage <= 0 || cfg.GuestMemPercentage > 100 {
+		d.fail("guest_mem_percentage", "set it to the percentage of host memory each guest gets, e.g. 30", "must be between 1 and 100, got %d", cfg.GuestMemPercentage)
+	}
+	if cfg.Tracing.Enabled && cfg.Tracing.Endpoint == "" {
+		d.fail("tracing", "set tracing.endpoint, e.g. http://localhost:4318/v1/traces", "enabled without an endpoint")
+	}
+	if err := server.ValidateTemplates(cfg); err != nil {
+		d.fail("templates", "fix the template or add its kernel modules to kernel_module_allowlist", "%v", err)
+	}
+	if err := server.ValidateAuth(cfg); err != nil {
+		d.fail("auth", "give every entry in auth.api_keys a unique name, not starting with oidc:, and a key", "%v", err)
+	}
+	if err := server.ValidateStateDir(cfg.StateDir); err != nil {
+		d.fail("state_dir", "move state_dir to a shorter path", "%v", err)
+	}
+	d.checkMiddlewares(cfg)
+	for name, tmpl := range cfg.Templates {
+		for _, image := range []struct{ kind, src, fallback string }{
+			{"kernel", tmpl.Kernel, cfg.KernelPath},
+			{"rootfs", tmpl.Rootfs, cfg.RootfsPath},
+			{"initramfs", tmpl.Initramfs, cfg.InitramfsPath},
+		} {
+			// The server-wide images are checked separately.
+			if image.src == "" || image.src == image.fallback {
+				continue
+			}
+			check := fmt.Sprintf("templates.%s.%s", name, image.kind)
+			d.checkImage(check, image.src, "fix the path or URL in the template")
+			if image.kind == "rootfs" {
+				d.checkImageFormat(check, image.src)
+			}
+		}
+	}
+}
+
+func (d *diagnostics) checkMiddlewares(cfg config.ServerConfig) {
+	order, err := middlewareOrder(cfg.Middlewares)
+	if err != nil {
+		d.fail("middlewares", "list each middleware once, with cors before auth and validation after it", "%v", err)
+	} else if !slices.Contains(order, middlewareAuth) {
+		d.warn("middlewares", "add auth to middlewares.order unless the API should be open", "auth is disabled on every listener")
+	}
+
+	if err := validateListeners(cfg.Listeners); err != nil {
+		d.fail("listeners", `use "host:port" or "unix:/path/to.sock" and names from middlewares.order`, "%v", err)
+		return
+	}
+	for _, l := range cfg.Listeners {
+		if !strings.HasPrefix(l.Address, unixListenerPrefix) && slices.Contains(l.DisableMiddlewares, middlewareAuth) {
+			d.warn("listeners", "disable auth only on Unix sockets, whose permissions restrict who can connect", "%s serves the API without auth", l.Address)
+		}
+	}
+}
+
+// checkHost runs the checks of `cfg` against this host. `running` is the config of the server
+// running on the host, if any, whose own address isn't taken for a conflict.
+func (d *diagnostics) checkHost(cfg config.ServerConfig, running *config.ServerConfig) {
+	if os.Geteuid() != 0 {
+		d.warn("user", "run the server with sudo", "not running as root, which is needed to set up networking and iptables")
+	}
+	d.checkStateDir(cfg.StateDir)
+	d.checkFile("chv_bin", cfg.ChvBinPath, true, "run ./setup/install-images.py or point chv_bin at a cloud-hypervisor binary")
+	d.checkImage("kernel", cfg.KernelPath, "run ./setup/install-images.py or point kernel at a guest vmlinux")
+	d.checkImage("rootfs", cfg.RootfsPath, "run `make guestrootfs`")
+	d.checkImageFormat("rootfs", cfg.RootfsPath)
+	d.checkImage("initramfs", cfg.InitramfsPath, "run `make initramfs`")
+	d.checkKVM()
+	d.checkBridge(cfg)
+	d.checkNetworkModes(cfg)
+	d.checkEgress()
+	d.checkNetworkNamespaces(cfg)
+	d.checkSharedDirs(cfg)
+	d.checkBaseImages(cfg)
+	d.checkVolumes(cfg)
+	d.checkHypervisorSandbox(cfg)
+	d.checkJailer(cfg)
+	d.checkHypervisorCgroups(cfg)
+	if running != nil && running.Host == cfg.Host && running.Port == cfg.Port {
+		d.ok("port", "%s is served by the running server", net.JoinHostPort(cfg.Host, cfg.Port))
+	} else {
+		d.checkListenPort(cfg)
+	}
+	d.checkPortForwards(cfg.PortForwards)
+	d.checkSettings(cfg)
+}
+
+// toAPI converts the diagnostics for the config validation endpoint.
+func (d diagnostics) toAPI() []serverapi.ConfigCheck {
+	checks := make([]serverapi.ConfigCheck, 0, len(d))
+	for _, diag := range d {
+		check := serverapi.ConfigCheck{
+			Check:   serverapi.PtrString(diag.check),
+			Level:   serverapi.PtrString(strings.ToLower(strings.TrimSpace(diag.level.String()))),
+			Message: serverapi.PtrString(diag.message),
+		}
+		if diag.hint != "" {
+			check.SetHint(diag.hint)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// validateConfig checks `configFile` and the host it would run on, printing a line per check.
+// Returns an error if the server wouldn't be able to start.
+func validateConfig(configFile string) error {
+	var d diagnostics
+	cfg, err := config.GetServerConfig(configFile)
+	if err != nil {
+		d.fail("config", "pass the right file with --config", "%s: %v", configFile, err)
+		d.print()
+		return cli.Exit("config is invalid", 1)
+	}
+	d.ok("config", "%s", configFile)
+	d.checkHost(*cfg, nil)
+
+	d.print()
+	failures, warnings := d.count(diagnosticFail), d.count(diagnosticWarn)
+	if failures > 0 {
+		return cli.Exit(fmt.Sprintf("found %d problem(s) and %d warning(s)", failures, warnings), 1)
+	}
+	fmt.Printf("config is valid (%d warning(s))\n", warnings)
+	return nil
+}
+
+// Largest config file accepted by validateCandidateConfig.
+const maxCandidateConfigSize = 1 << 20
+
+// validateCandidateConfig checks the config file in the request body against this host and the
+// running config, without applying it.
+func (s *restServer) validateCandidateConfig(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "validateCandidateConfig")
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxCandidateConfigSize+1))
+	if err != nil {
+		logger.WithError(err).Error("Failed to read request body")
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Failed to read config: %v", err))
+		return
+	}
+	if len(data) > maxCandidateConfigSize {
+		sendErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Config is larger than %d bytes", maxCandidateConfigSize))
+		return
+	}
+
+	var d diagnostics
+	resp := serverapi.ValidateConfigResponse{
+		Changes:         []serverapi.ConfigChange{},
+		RestartRequired: []string{},
+	}
+	cfg, err := config.ParseServerConfig(data)
+	if err != nil {
+		d.fail("config", "send the whole config file, with the server's settings under hostservices.restserver", "%v", err)
+	} else {
+		d.ok("config", "parsed")
+		running := s.vmServer.Config()
+		d.checkHost(*cfg, &running)
+		resp.Changes, resp.RestartRequired = s.vmServer.DiffConfig(*cfg)
+	}
+	resp.Checks = d.toAPI()
+	resp.Valid = serverapi.PtrBool(d.count(diagnosticFail) == 0)
+
+	logger.WithFields(log.Fields{
+		"valid":   resp.GetValid(),
+		"changes": len(resp.Changes),
+	}).Info("Validated candidate config")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/callback"
+)
+
+var errOriginForbidden = errors.New("origin not allowed")
+
+// checkOrigin only lets browsers open WebSockets from the server's own origin and the configured
+// ones, those the API's CORS policy allows unless WebSockets have their own. Other clients don't
+// send an Origin header.
+func (s *restServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	cfg := s.vmServer.Config()
+	allowed := cfg.WebSocket.AllowedOrigins
+	if len(allowed) == 0 {
+		allowed = cfg.Middlewares.CORS.AllowedOrigins
+	}
+	return originAllowed(allowed, origin)
+}
+
+// originForbidden replies 403 and returns true unless checkOrigin allows the request. Handlers that
+// open something, e.g. a connection into the VM, before upgrading call it first, so that pages on
+// other origins can't get them to.
+func (s *restServer) originForbidden(w http.ResponseWriter, r *http.Request) bool {
+	if s.checkOrigin(r) {
+		return false
+	}
+	sendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Origin %s is not allowed", r.Header.Get("Origin")))
+	return true
+}
+
+// upgrade upgrades the request to a WebSocket after checking its origin. If it fails the client
+// has already had its reply.
+func (s *restServer) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if s.originForbidden(w, r) {
+		return nil, errOriginForbidden
+	}
+	upgrader := websocket.Upgrader{
+		// Checked above, with a clearer error than the upgrader gives.
+		CheckOrigin: func(*http.Request) bool { return true },
+		// permessage-deflate, if the client offers it. Callback payloads, shell output and logs
+		// are mostly text.
+		EnableCompression: true,
+	}
+	return upgrader.Upgrade(w, r, nil)
+}
+
+// vmWebSocket connects a client to the callback session of a VM, over which it answers the VM's
+// callbacks. Only the VM's owner may connect, presenting the session token from starting the VM
+// as `sessionToken` or in the X-Session-Token header. Clients reconnecting after a dropped
+// connection also pass `reconnectToken` to resume their session and receive the callbacks made in
+// the meantime.
+func (s *restServer) vmWebSocket(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmWebSocket")
+	namespace := namespaceFromRequest(r)
+	name := mux.Vars(r)["name"]
+	vmName := vmNameFromRequest(r)
+
+	sessionToken := r.Header.Get("X-Session-Token")
+	if sessionToken == "" {
+		sessionToken = r.URL.Query().Get("sessionToken")
+	}
+	if err := s.vmServer.AuthorizeSession(r.Context(), vmName, sessionToken); err != nil {
+		sendErrorResponse(w, httpStatusFromError(err), err.Error())
+		return
+	}
+
+	reconnectToken := r.URL.Query().Get("reconnectToken")
+	if err := s.sessionManager.CheckWebSocket(namespace, name, reconnectToken); err != nil {
+		code := http.StatusConflict
+		if errors.Is(err, callback.ErrBadReconnectToken) {
+			code = http.StatusForbidden
+		}
+		sendErrorResponse(w, code, err.Error())
+		return
+	}
+
+	conn, err := s.upgrade(w, r)
+	if err != nil {
+		// upgrade has already replied.
+		logger.WithField("vmName", vmName).WithError(err).Warn("Failed to upgrade to WebSocket")
+		return
+	}
+	s.sessionManager.ServeWebSocket(namespace, name, reconnectToken, conn, s.vmServer.Config().WebSocket)
+}
+
+// vmRotateSessionToken gives a VM a new session token and ends the callback session opened with
+// the old one.
+func (s *restServer) vmRotateSessionToken(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmRotateSessionToken")
+	vmName := vmNameFromRequest(r)
+
+	resp, err := s.vmServer.RotateSessionToken(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to rotate session token")
+		sendErrorResponse(
+			w,
+			httpStatusFromError(err),
+			fmt.Sprintf("Failed to rotate session token: %v", err))
+		return
+	}
+	s.sessionManager.CloseWebSocketSession(namespaceFromRequest(r), mux.Vars(r)["name"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -9,6 +9,8 @@ import (
 
 	"github.com/urfave/cli/v2"
 	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
 )
 
 const (
@@ -33,7 +35,9 @@ func runCmd(cmdName string, args ...string) error {
 	return cmd.Run()
 }
 
-func createRootfsFromDockerfile(dockerFile string, outputFile string) (retErr error) {
+// createRootfsFromDockerfile builds `dockerFile` into an ext4 image at `outputFile`. If
+// `containerRuntime` is set, e.g. "docker", that engine is installed in the image as well.
+func createRootfsFromDockerfile(dockerFile string, outputFile string, containerRuntime string) (retErr error) {
 	cleanup := cleanup.Make(func() {
 		if retErr == nil {
 			log.Info("create rootfs from docker file finished")
@@ -83,7 +87,11 @@ func createRootfsFromDockerfile(dockerFile string, outputFile string) (retErr er
 	}
 
 	log.Info("building docker image")
-	err = runCmd("docker", "build", "-f", dstDockerfile, "-t", dockerImageName, ".")
+	buildArgs := []string{"build", "-f", dstDockerfile, "-t", dockerImageName}
+	if containerRuntime != "" {
+		buildArgs = append(buildArgs, "--build-arg", "CONTAINER_RUNTIME="+containerRuntime)
+	}
+	err = runCmd("docker", append(buildArgs, ".")...)
 	if err != nil {
 		return fmt.Errorf("failed to build docker container image: %w", err)
 	}
@@ -199,9 +207,19 @@ func main() {
 						Usage:    "Path to the output rootfs file",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "container-runtime",
+						Usage: "Install a container engine, \"docker\" or \"podman\", to run containers inside the guest",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return createRootfsFromDockerfile(ctx.String("dockerfile"), ctx.String("output"))
+					containerRuntime := ctx.String("container-runtime")
+					if containerRuntime != "" {
+						if err := guesttuning.ValidateEngine(containerRuntime); err != nil {
+							return err
+						}
+					}
+					return createRootfsFromDockerfile(ctx.String("dockerfile"), ctx.String("output"), containerRuntime)
 				},
 			},
 		},
@@ -11,6 +11,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
 )
 
 const (
@@ -23,7 +25,11 @@ func getVsockPath(vmName string) string {
 	return path.Join(stateDir, vmName, vsockFileName)
 }
 
-func startInteractiveSession(socketPath string, port int) error {
+func getVsockSecretPath(vmName string) string {
+	return path.Join(stateDir, vmName, guestcall.VsockSecretFilename)
+}
+
+func startInteractiveSession(socketPath string, secretPath string, port int) error {
 	// Connect to Unix domain socket
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
@@ -50,6 +56,17 @@ func startInteractiveSession(socketPath string, port int) error {
 		return fmt.Errorf("unexpected response to CONNECT: %s", response)
 	}
 
+	// VMs started before vsock secrets were introduced have none.
+	secret, err := os.ReadFile(secretPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read vsock secret: %v", err)
+	}
+	if err == nil {
+		if err := guestcall.Authenticate(conn, reader, strings.TrimSpace(string(secret))); err != nil {
+			return fmt.Errorf("failed to authenticate: %v", err)
+		}
+	}
+
 	// Start interactive session
 	fmt.Println("Connected to vsock server. Enter commands (Ctrl+C to exit):")
 
@@ -122,7 +139,7 @@ func main() {
 				"socket": socketPath,
 			}).Info("Starting interactive session")
 
-			return startInteractiveSession(socketPath, port)
+			return startInteractiveSession(socketPath, getVsockSecretPath(vmName), port)
 		},
 	}
 
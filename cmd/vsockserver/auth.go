@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/vsock"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	// The secret is moved here, readable by root only, and a copy of the kernel command line
+	// without it is mounted over /proc/cmdline.
+	secretPath          = "/run/arrakis/vsock-secret"
+	scrubbedCmdlinePath = "/run/arrakis/cmdline"
+
+	// Connections from the host and from processes in the guest are capped separately, so that
+	// the guest can't lock the host out.
+	maxHostConns  = 16
+	maxGuestConns = 32
+	// Commands a connection may send per second, and in a burst.
+	commandRate  = 20
+	commandBurst = 40
+	// Longest command line read from a connection.
+	maxLineSize = 4 << 20
+	// How long a connection from the host may take to authenticate.
+	authTimeout = 10 * time.Second
+	// Connections from the guest are closed after waiting this long for a command.
+	guestIdleTimeout = time.Minute
+)
+
+var (
+	// Shared with the host at boot. Empty if the host didn't share one, in which case connections
+	// needn't authenticate.
+	secret string
+
+	hostConnSlots  = make(chan struct{}, maxHostConns)
+	guestConnSlots = make(chan struct{}, maxGuestConns)
+
+	errLineTooLong = errors.New("command line too long")
+)
+
+// loadSecret returns the secret shared by the host, and hides it from unprivileged processes in
+// the guest.
+func loadSecret() (string, error) {
+	if data, err := os.ReadFile(secretPath); err == nil {
+		// We've been restarted and have hidden the secret already.
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/cmdline: %w", err)
+	}
+	var value string
+	var rest []string
+	for _, part := range strings.Fields(string(data)) {
+		if v, ok := strings.CutPrefix(part, guestcall.VsockSecretCmdlineKey+"="); ok {
+			value = strings.Trim(v, "\"")
+			continue
+		}
+		rest = append(rest, part)
+	}
+	if value == "" {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(path.Dir(secretPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", path.Dir(secretPath), err)
+	}
+	if err := os.WriteFile(secretPath, []byte(value), 0600); err != nil {
+		return "", fmt.Errorf("failed to write secret: %w", err)
+	}
+	if err := os.WriteFile(scrubbedCmdlinePath, []byte(strings.Join(rest, " ")+"\n"), 0444); err != nil {
+		return "", fmt.Errorf("failed to write kernel command line: %w", err)
+	}
+	if err := syscall.Mount(scrubbedCmdlinePath, "/proc/cmdline", "", syscall.MS_BIND, ""); err != nil {
+		// Authentication still works, but processes in the guest can read the secret.
+		log.WithError(err).Warn("Failed to hide the vsock secret from /proc/cmdline")
+	}
+	return value, nil
+}
+
+// rateLimiter is a token bucket of commands.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{tokens: commandBurst, last: time.Now()}
+}
+
+// allow takes a token if one is left.
+func (l *rateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens = min(commandBurst, l.tokens+now.Sub(l.last).Seconds()*commandRate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// connState is what we know about a connection.
+type connState struct {
+	conn *vsock.Conn
+	// Set for connections from the host, as opposed to processes in the guest.
+	fromHost      bool
+	authenticated bool
+	// Nonces of the handshake, once the client has said hello.
+	clientNonce string
+	serverNonce string
+	limiter     *rateLimiter
+}
+
+// isFromHost reports whether `conn` comes from the host. Processes in the guest connect through
+// the local CID.
+func isFromHost(conn *vsock.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*vsock.Addr)
+	return ok && addr.ContextID == vsock.Host
+}
+
+// acquireConnSlot takes one of the connection slots of `conn`'s side and returns the function that
+// gives it back, or false if there's none left.
+func acquireConnSlot(fromHost bool) (func(), bool) {
+	slots := guestConnSlots
+	if fromHost {
+		slots = hostConnSlots
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// readLine reads a line of at most `maxLineSize` bytes.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineSize {
+			return "", errLineTooLong
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// isGuestCommand reports whether `cmd` is one of the commands processes in the guest may send
+// without authenticating: callbacks and reports.
+func isGuestCommand(cmd string) bool {
+	return strings.HasPrefix(cmd, guestcall.CommandPrefix) ||
+		strings.HasPrefix(cmd, guestcall.ReportPrefix) ||
+		strings.HasPrefix(cmd, "CALLBACK ")
+}
+
+// reject tells the client why `cmd` was refused, as a `guestcall.Response` unless `cmd` is one of
+// the plain text commands.
+func reject(conn *vsock.Conn, cmd string, code string, message string, retryable bool) error {
+	log.WithFields(log.Fields{
+		"remote": conn.RemoteAddr().String(),
+		"code":   code,
+		"reason": message,
+	}).Warn("Rejected vsock command")
+	var data []byte
+	if cmd == "" || strings.HasPrefix(cmd, guestcall.CommandPrefix) || strings.HasPrefix(cmd, guestcall.ReportPrefix) ||
+		strings.HasPrefix(cmd, guestcall.HelloPrefix) || strings.HasPrefix(cmd, guestcall.AuthPrefix) ||
+		strings.HasPrefix(cmd, guestcall.SocketPrefix) || strings.HasPrefix(cmd, guestcall.PTYPrefix) ||
+		strings.HasPrefix(cmd, guestcall.ProcessPrefix) || strings.HasPrefix(cmd, guestcall.FilePrefix) {
+		data, _ = json.Marshal(guestcall.Response{
+			Error: &guestcall.ResponseError{Message: message, Code: code, Retryable: retryable},
+		})
+	} else {
+		data = []byte(fmt.Sprintf("Error: %s: %s", code, message))
+	}
+	_, err := conn.Write(append(data, '\n'))
+	return err
+}
+
+// handleHello answers the HELLO command with a challenge proving we know the secret.
+func (c *connState) handleHello(cmd string) error {
+	if secret == "" {
+		return reject(c.conn, cmd, guestcall.ErrorUnauthenticated, "no secret was shared with this VM", false)
+	}
+	serverNonce, err := guestcall.NewNonce()
+	if err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+	c.clientNonce = strings.TrimSpace(strings.TrimPrefix(cmd, guestcall.HelloPrefix))
+	c.serverNonce = serverNonce
+	data, _ := json.Marshal(guestcall.AuthChallenge{
+		Nonce: serverNonce,
+		Proof: guestcall.ServerProof(secret, c.clientNonce, serverNonce),
+	})
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// handleAuth checks the client's proof of the secret. Returns an error for connections that should
+// be closed.
+func (c *connState) handleAuth(cmd string) error {
+	proof := strings.TrimSpace(strings.TrimPrefix(cmd, guestcall.AuthPrefix))
+	if secret == "" || c.serverNonce == "" || c.clientNonce == "" ||
+		!guestcall.VerifyProof(proof, guestcall.ClientProof(secret, c.clientNonce, c.serverNonce)) {
+		reject(c.conn, cmd, guestcall.ErrorUnauthenticated, "authentication failed", false)
+		return errors.New("authentication failed")
+	}
+	// Nonces are good for a single attempt.
+	c.serverNonce = ""
+	c.authenticated = true
+	log.WithField("remote", c.conn.RemoteAddr().String()).Info("Authenticated vsock connection")
+	c.conn.SetReadDeadline(time.Time{})
+	data, _ := json.Marshal(guestcall.Response{})
+	_, err := c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// admit checks whether the connection may run `cmd`, rejecting it if not. Returns false if it may
+// not, and an error if the connection should be closed.
+func (c *connState) admit(cmd string) (bool, error) {
+	if !c.limiter.allow() {
+		return false, reject(c.conn, cmd, guestcall.ErrorRateLimited, "too many commands, slow down", true)
+	}
+	if secret == "" || c.authenticated ||
+		strings.HasPrefix(cmd, guestcall.HelloPrefix) || strings.HasPrefix(cmd, guestcall.AuthPrefix) {
+		return true, nil
+	}
+	if c.fromHost {
+		// The host always authenticates first, anything else is someone posing as it.
+		reject(c.conn, cmd, guestcall.ErrorUnauthenticated, "connection must authenticate first", false)
+		return false, errors.New("unauthenticated command from the host")
+	}
+	if !isGuestCommand(cmd) {
+		return false, reject(c.conn, cmd, guestcall.ErrorUnauthenticated, "only callbacks and reports are allowed without authenticating", false)
+	}
+	return true, nil
+}
+
+// setReadDeadline bounds how long the connection may take to send its next command. Connections
+// from the host have until `authTimeout` to authenticate, and no deadline after that.
+func (c *connState) setReadDeadline() {
+	if !c.fromHost {
+		c.conn.SetReadDeadline(time.Now().Add(guestIdleTimeout))
+	}
+}
+
+// isTimeout reports whether `err` is a deadline we set running out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+const (
+	// Where the workload gets its credentials, the port of the ECS agent's credentials endpoint.
+	// AWS SDKs find it through AWS_CONTAINER_CREDENTIALS_FULL_URI and Google's through
+	// GCE_METADATA_HOST.
+	credentialsListenAddr = "127.0.0.1:51679"
+	credentialsTimeout    = 30 * time.Second
+
+	metadataFlavorHeader = "Metadata-Flavor"
+	metadataFlavorGoogle = "Google"
+)
+
+// The value of the credentials kernel command line key, set by parseKernelCmdLine.
+var credentialsCmdline string
+
+// fetchCredentials asks the restserver for credentials of `profile`.
+func fetchCredentials(profile string) (*guestcall.Credentials, int, error) {
+	client := &http.Client{
+		Timeout: credentialsTimeout,
+	}
+	query := url.Values{"vmName": {vmName}, "profile": {profile}}
+	resp, err := client.Get(restserverURL("/v1/internal/credentials?" + query.Encode()))
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("credentials HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, resp.StatusCode, fmt.Errorf("credentials returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var creds guestcall.Credentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("failed to decode credentials: %w", err)
+	}
+	return &creds, http.StatusOK, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// credentialsServer serves the credentials of the guest's profiles, AWS ones in the format of the
+// ECS container credentials endpoint and GCP ones like the GCE metadata server.
+type credentialsServer struct {
+	providers map[string]string
+	// The GCP profile served as the "default" service account, the first one.
+	defaultGCP string
+}
+
+// awsCredentials handles "/credentials/{profile}".
+func (c *credentialsServer) awsCredentials(w http.ResponseWriter, r *http.Request) {
+	profile := r.PathValue("profile")
+	if c.providers[profile] != "aws" {
+		http.Error(w, fmt.Sprintf("no AWS credential profile %q", profile), http.StatusNotFound)
+		return
+	}
+	creds, status, err := fetchCredentials(profile)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to get credentials of %s", profile)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, map[string]string{
+		"AccessKeyId":     creds.AccessKeyID,
+		"SecretAccessKey": creds.SecretAccessKey,
+		"Token":           creds.SessionToken,
+		"Expiration":      creds.Expiration.Format(time.RFC3339),
+	})
+}
+
+// gcpProfile returns the GCP profile of the service account `account` of a metadata path, which
+// is "default" or a profile's name.
+func (c *credentialsServer) gcpProfile(account string) string {
+	if account == "default" {
+		return c.defaultGCP
+	}
+	if c.providers[account] == "gcp" {
+		return account
+	}
+	return ""
+}
+
+// metadata handles the GCE metadata server paths Google's client libraries use. Like the real
+// one, it only answers requests with a "Metadata-Flavor: Google" header.
+func (c *credentialsServer) metadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(metadataFlavorHeader, metadataFlavorGoogle)
+	if r.Header.Get(metadataFlavorHeader) != metadataFlavorGoogle {
+		http.Error(w, "Missing Metadata-Flavor: Google header", http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1"), "/")
+	if path == "" {
+		// Libraries ping the root to detect the metadata server.
+		return
+	}
+	var account, item string
+	if rest, ok := strings.CutPrefix(path, "/instance/service-accounts/"); ok {
+		account, item, _ = strings.Cut(rest, "/")
+	} else if path == "/project/project-id" {
+		account, item = "default", "project-id"
+	}
+	profile := c.gcpProfile(account)
+	if profile == "" || (item != "token" && item != "email" && item != "project-id") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	creds, status, err := fetchCredentials(profile)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to get credentials of %s", profile)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	switch item {
+	case "token":
+		writeJSON(w, map[string]any{
+			"access_token": creds.AccessToken,
+			"expires_in":   int(time.Until(creds.Expiration).Seconds()),
+			"token_type":   "Bearer",
+		})
+	case "email":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, creds.ServiceAccount)
+	case "project-id":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, creds.ProjectID)
+	}
+}
+
+// serveCredentials serves the credentials of the profiles the credentials kernel command line key
+// lists, if any, on `credentialsListenAddr`.
+func serveCredentials() {
+	profiles, err := guesttuning.DecodeCredentialProfiles(credentialsCmdline)
+	if err != nil {
+		log.WithError(err).Error("Invalid credential profiles, serving no credentials")
+		return
+	}
+	if len(profiles) == 0 {
+		return
+	}
+
+	c := &credentialsServer{providers: make(map[string]string)}
+	for _, p := range profiles {
+		c.providers[p.Name] = p.Provider
+		if p.Provider == "gcp" && c.defaultGCP == "" {
+			c.defaultGCP = p.Name
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /credentials/{profile}", c.awsCredentials)
+	mux.HandleFunc("GET /computeMetadata/v1/", c.metadata)
+	mux.HandleFunc("GET /{$}", c.metadata)
+	log.Infof("Serving the credentials of %s on %s", credentialsCmdline, credentialsListenAddr)
+	if err := http.ListenAndServe(credentialsListenAddr, mux); err != nil {
+		log.WithError(err).Error("Credentials server stopped")
+	}
+}
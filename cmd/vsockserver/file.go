@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+var (
+	uploadsLock sync.Mutex
+	// Paths whose upload is being written or committed.
+	busyUploads = make(map[string]bool)
+)
+
+// claimUpload marks the upload of `path` busy and returns the function that frees it, or false
+// if it's busy already.
+func claimUpload(path string) (func(), bool) {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	if busyUploads[path] {
+		return nil, false
+	}
+	busyUploads[path] = true
+	return func() {
+		uploadsLock.Lock()
+		delete(busyUploads, path)
+		uploadsLock.Unlock()
+	}, true
+}
+
+func fileError(code string, format string, args ...any) *guestcall.ResponseError {
+	return &guestcall.ResponseError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// osFileError converts an error of the os package about `path`.
+func osFileError(path string, err error) *guestcall.ResponseError {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileError(guestcall.ErrorFileNotFound, "%s: no such file or directory", path)
+	}
+	return fileError(guestcall.ErrorFileFailed, "%v", err)
+}
+
+// uploadStatus returns the status of the upload of `path`.
+func uploadStatus(path string) (guestcall.FileStatus, error) {
+	status := guestcall.FileStatus{Path: path}
+	if info, err := os.Stat(guestcall.PartialFilePath(path)); err == nil {
+		status.Offset = info.Size()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return status, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		status.Exists = true
+		status.Size = info.Size()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return status, err
+	}
+	return status, nil
+}
+
+// writeResponse sends `result`, or `respErr` if set, as a `guestcall.Response`.
+func (c *connState) writeResponse(result any, respErr *guestcall.ResponseError) error {
+	resp := guestcall.Response{Error: respErr}
+	if respErr == nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	data, _ := json.Marshal(resp)
+	_, err := c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// handleFile runs the FILE command `cmd`, reading the chunks of writes through `reader`. Returns an
+// error if the connection should be closed, which is the case whenever chunks weren't all sent or
+// received.
+func (c *connState) handleFile(reader *bufio.Reader, cmd string) error {
+	var req guestcall.FileRequest
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd, guestcall.FilePrefix)), &req); err != nil {
+		return c.writeResponse(nil, fileError(guestcall.ErrorInvalidFile, "invalid request: %v", err))
+	}
+	if err := guestcall.ValidateFilePath(req.Path); err != nil {
+		return c.writeResponse(nil, fileError(guestcall.ErrorInvalidFile, "%v", err))
+	}
+	if req.Offset < 0 || req.Length < 0 || req.Size < 0 {
+		return c.writeResponse(nil, fileError(guestcall.ErrorInvalidFile, "offset, length and size can't be negative"))
+	}
+
+	switch req.Op {
+	case guestcall.FileOpStat:
+		status, err := uploadStatus(req.Path)
+		if err != nil {
+			return c.writeResponse(nil, osFileError(req.Path, err))
+		}
+		return c.writeResponse(status, nil)
+	case guestcall.FileOpWrite:
+		return c.writeUpload(reader, req)
+	case guestcall.FileOpCommit:
+		release, ok := claimUpload(req.Path)
+		if !ok {
+			return c.writeResponse(nil, fileError(guestcall.ErrorFileBusy, "the upload of %s is in progress", req.Path))
+		}
+		defer release()
+		status, respErr := commitUpload(req)
+		return c.writeResponse(status, respErr)
+	case guestcall.FileOpAbort:
+		release, ok := claimUpload(req.Path)
+		if !ok {
+			return c.writeResponse(nil, fileError(guestcall.ErrorFileBusy, "the upload of %s is in progress", req.Path))
+		}
+		defer release()
+		if err := os.Remove(guestcall.PartialFilePath(req.Path)); err != nil {
+			return c.writeResponse(nil, osFileError(guestcall.PartialFilePath(req.Path), err))
+		}
+		log.WithField("path", req.Path).Info("Aborted upload")
+		return c.writeResponse(guestcall.FileStatus{Path: req.Path}, nil)
+	case guestcall.FileOpRead:
+		return c.readFile(req)
+	default:
+		return c.writeResponse(nil, fileError(guestcall.ErrorInvalidFile, "unknown op %q", req.Op))
+	}
+}
+
+// writeUpload appends the chunks that follow the answer to the upload of `req.Path`, syncing them
+// before the final answer so that its offset survives a crash of the guest.
+func (c *connState) writeUpload(reader *bufio.Reader, req guestcall.FileRequest) error {
+	release, ok := claimUpload(req.Path)
+	if !ok {
+		return c.writeResponse(nil, fileError(guestcall.ErrorFileBusy, "the upload of %s is in progress", req.Path))
+	}
+	defer release()
+
+	if req.Mkdirs {
+		if err := os.MkdirAll(filepath.Dir(req.Path), 0755); err != nil {
+			return c.writeResponse(nil, osFileError(req.Path, err))
+		}
+	}
+	partialPath := guestcall.PartialFilePath(req.Path)
+	flags := os.O_WRONLY | os.O_CREATE
+	if req.Offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partialPath, flags, 0600)
+	if err != nil {
+		return c.writeResponse(nil, osFileError(req.Path, err))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return c.writeResponse(nil, osFileError(req.Path, err))
+	}
+	if info.Size() != req.Offset {
+		return c.writeResponse(nil, fileError(guestcall.ErrorFileOffset,
+			"the upload of %s is at offset %d, not %d", req.Path, info.Size(), req.Offset))
+	}
+	if _, err := file.Seek(req.Offset, io.SeekStart); err != nil {
+		return c.writeResponse(nil, osFileError(req.Path, err))
+	}
+	if err := c.writeResponse(guestcall.FileStatus{Path: req.Path, Offset: req.Offset}, nil); err != nil {
+		return err
+	}
+
+	logger := log.WithFields(log.Fields{
+		"path":   req.Path,
+		"offset": req.Offset,
+	})
+	written, err := io.Copy(file, guestcall.NewChunkReader(reader))
+	syncErr := file.Sync()
+	if err != nil {
+		logger.WithError(err).Warnf("Upload stopped after %d bytes", written)
+		// The host may still be sending chunks, so the connection can't be used anymore. Whatever
+		// was written is kept, for the upload to be resumed.
+		c.writeResponse(nil, fileError(guestcall.ErrorFileFailed, "failed to write %s: %v", req.Path, err))
+		return fmt.Errorf("upload of %s failed: %w", req.Path, err)
+	}
+	if syncErr != nil {
+		return c.writeResponse(nil, fileError(guestcall.ErrorFileFailed, "failed to sync %s: %v", req.Path, syncErr))
+	}
+	logger.Infof("Wrote %d bytes of upload", written)
+	return c.writeResponse(guestcall.FileStatus{Path: req.Path, Offset: req.Offset + written}, nil)
+}
+
+// commitUpload moves the upload of `req.Path` into place, once it's checked.
+func commitUpload(req guestcall.FileRequest) (*guestcall.FileStatus, *guestcall.ResponseError) {
+	options := cmdserver.FilePostData{Path: req.Path, Mode: req.Mode, UID: req.UID, GID: req.GID}
+	if err := options.Validate(); err != nil {
+		return nil, fileError(guestcall.ErrorInvalidFile, "%v", err)
+	}
+	partialPath := guestcall.PartialFilePath(req.Path)
+	file, err := os.Open(partialPath)
+	if err != nil {
+		return nil, osFileError(partialPath, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, osFileError(partialPath, err)
+	}
+	if info.Size() != req.Size {
+		return nil, fileError(guestcall.ErrorFileOffset, "the upload of %s has %d bytes, not %d", req.Path, info.Size(), req.Size)
+	}
+	if req.SHA256 != "" {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return nil, osFileError(partialPath, err)
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, req.SHA256) {
+			return nil, fileError(guestcall.ErrorInvalidFile, "the upload of %s has SHA-256 %s, not %s", req.Path, sum, req.SHA256)
+		}
+	}
+
+	// Like the cmdserver, the owner goes first, since changing it clears setuid and setgid.
+	if req.UID != nil || req.GID != nil {
+		uid, gid := -1, -1
+		if req.UID != nil {
+			uid = *req.UID
+		}
+		if req.GID != nil {
+			gid = *req.GID
+		}
+		if err := os.Chown(partialPath, uid, gid); err != nil {
+			return nil, osFileError(partialPath, err)
+		}
+	}
+	mode := os.FileMode(0644)
+	if m, ok, _ := options.FileMode(); ok {
+		mode = m
+	}
+	if err := os.Chmod(partialPath, mode); err != nil {
+		return nil, osFileError(partialPath, err)
+	}
+	if err := os.Rename(partialPath, req.Path); err != nil {
+		return nil, osFileError(req.Path, err)
+	}
+	log.WithFields(log.Fields{
+		"path": req.Path,
+		"size": req.Size,
+	}).Info("Committed upload")
+	return &guestcall.FileStatus{Path: req.Path, Offset: req.Size, Size: req.Size, Exists: true, Committed: true}, nil
+}
+
+// readFile sends the part of the file `req.Path` asks for as chunks after the answer.
+func (c *connState) readFile(req guestcall.FileRequest) error {
+	file, err := os.Open(req.Path)
+	if err != nil {
+		return c.writeResponse(nil, osFileError(req.Path, err))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return c.writeResponse(nil, osFileError(req.Path, err))
+	}
+	if info.IsDir() {
+		return c.writeResponse(nil, fileError(guestcall.ErrorInvalidFile, "%s is a directory", req.Path))
+	}
+	if req.Offset > info.Size() {
+		return c.writeResponse(nil, fileError(guestcall.ErrorFileOffset, "offset %d is beyond the %d bytes of %s", req.Offset, info.Size(), req.Path))
+	}
+	length := info.Size() - req.Offset
+	if req.Length > 0 && req.Length < length {
+		length = req.Length
+	}
+	status := guestcall.FileStatus{Path: req.Path, Offset: req.Offset, Size: info.Size(), Exists: true, Length: length}
+	if err := c.writeResponse(status, nil); err != nil {
+		return err
+	}
+
+	chunks := guestcall.NewChunkWriter(c.conn)
+	// The length is promised, so a file that shrinks meanwhile ends the connection early.
+	if _, err := io.CopyN(chunks, io.NewSectionReader(file, req.Offset, length), length); err != nil {
+		return fmt.Errorf("read of %s failed: %w", req.Path, err)
+	}
+	return chunks.Close()
+}
@@ -4,23 +4,28 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/mdlayher/vsock"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
 )
 
 const (
 	// Define a base directory to prevent path traversal.
 	baseDir = "/tmp/vsockserver"
-	port    = 4032
+	port    = guestcall.VsockPort
 
 	// Callback configuration
 	callbackTimeout = 30 * time.Second
@@ -45,6 +50,16 @@ type CallbackResponse struct {
 	Error  string          `json:"error,omitempty"`
 }
 
+// unreachableError marks a callback that never reached the host, so that the guest may send it
+// again.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
 // parseKernelCmdLine parses the kernel command line to extract configuration.
 func parseKernelCmdLine() error {
 	data, err := os.ReadFile("/proc/cmdline")
@@ -62,6 +77,12 @@ func parseKernelCmdLine() error {
 		if strings.HasPrefix(part, "vm_name=") {
 			vmName = strings.Trim(strings.TrimPrefix(part, "vm_name="), "\"")
 		}
+		if strings.HasPrefix(part, guesttuning.TelemetryCmdlineKey+"=") {
+			telemetryCmdline = strings.Trim(strings.TrimPrefix(part, guesttuning.TelemetryCmdlineKey+"="), "\"")
+		}
+		if strings.HasPrefix(part, guesttuning.CredentialsCmdlineKey+"=") {
+			credentialsCmdline = strings.Trim(strings.TrimPrefix(part, guesttuning.CredentialsCmdlineKey+"="), "\"")
+		}
 	}
 
 	if gatewayIP == "" {
@@ -86,15 +107,21 @@ func parseKernelCmdLine() error {
 	return nil
 }
 
-// handleCallback processes a CALLBACK command and sends it to the arrakis-restserver.
-// The restserver is responsible for routing the callback to the registered HTTP callback URL.
-func handleCallback(method string, paramsJSON string) (string, error) {
-	// Always send callbacks to the arrakis-restserver via the gateway
+// restserverURL returns the URL of `path` on the arrakis-restserver, which is reached via the
+// gateway.
+func restserverURL(path string) string {
 	hostIP := gatewayIP
 	if idx := strings.Index(hostIP, "/"); idx != -1 {
 		hostIP = hostIP[:idx]
 	}
-	url := fmt.Sprintf("http://%s:7000/v1/internal/callback", hostIP)
+	return fmt.Sprintf("http://%s:7000%s", hostIP, path)
+}
+
+// handleCallback processes a CALLBACK command and sends it to the arrakis-restserver.
+// The restserver is responsible for routing the callback to the registered HTTP callback URL.
+func handleCallback(method string, paramsJSON string, timeout time.Duration) (string, error) {
+	// Always send callbacks to the arrakis-restserver via the gateway
+	url := restserverURL("/v1/internal/callback")
 
 	// Build the callback request
 	req := CallbackRequest{
@@ -121,7 +148,7 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{
-		Timeout: callbackTimeout,
+		Timeout: timeout,
 	}
 
 	log.WithFields(log.Fields{
@@ -132,7 +159,7 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		return "", fmt.Errorf("callback HTTP request failed: %w", err)
+		return "", &unreachableError{fmt.Errorf("callback HTTP request failed: %w", err)}
 	}
 	defer resp.Body.Close()
 
@@ -144,7 +171,12 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 
 	// Check for HTTP errors
 	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf("callback returned HTTP %d: %s", resp.StatusCode, string(respBody))
+		err := fmt.Errorf("callback returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return "", &unreachableError{err}
+		}
+		return "", err
 	}
 
 	// Parse the response
@@ -158,13 +190,103 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 		return "", fmt.Errorf("callback error: %s", callbackResp.Error)
 	}
 
-	// Return the result as a string
+	// Return the result as a string, on a single line
 	if callbackResp.Result != nil {
-		return string(callbackResp.Result), nil
+		var result bytes.Buffer
+		if err := json.Compact(&result, callbackResp.Result); err != nil {
+			return "", fmt.Errorf("invalid callback result: %w", err)
+		}
+		return result.String(), nil
 	}
 	return "{}", nil
 }
 
+// handleReport processes a REPORT command, which carries a JSON `guestcall.Report`, by forwarding
+// it to the arrakis-restserver. It returns the JSON `guestcall.Response` to send back.
+func handleReport(cmd string) []byte {
+	var resp guestcall.Response
+	var report guestcall.Report
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd, guestcall.ReportPrefix)), &report); err != nil {
+		resp.Error = &guestcall.ResponseError{Message: fmt.Sprintf("invalid REPORT request: %v", err)}
+	} else if err := sendReport(report); err != nil {
+		var unreachable *unreachableError
+		resp.Error = &guestcall.ResponseError{
+			Message:   err.Error(),
+			Retryable: errors.As(err, &unreachable),
+		}
+	}
+	data, _ := json.Marshal(resp)
+	return append(data, '\n')
+}
+
+// sendReport sends `report` to the arrakis-restserver.
+func sendReport(report guestcall.Report) error {
+	body, err := json.Marshal(struct {
+		VMName string            `json:"vmName"`
+		Type   string            `json:"type"`
+		Data   map[string]string `json:"data,omitempty"`
+	}{vmName, report.Type, report.Data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	client := &http.Client{
+		Timeout: callbackTimeout,
+	}
+	resp, err := client.Post(restserverURL("/v1/internal/report"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return &unreachableError{fmt.Errorf("report HTTP request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		respBody, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("report returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return &unreachableError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// handleCall processes a CALL command, which carries a JSON `guestcall.Request`, and returns the
+// JSON `guestcall.Response` to send back.
+func handleCall(cmd string) []byte {
+	var resp guestcall.Response
+	var req guestcall.Request
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd, guestcall.CommandPrefix)), &req); err != nil {
+		resp.Error = &guestcall.ResponseError{Message: fmt.Sprintf("invalid CALL request: %v", err)}
+	} else if req.Method == "" {
+		resp.Error = &guestcall.ResponseError{Message: "CALL request requires a method"}
+	} else {
+		timeout := callbackTimeout
+		if req.TimeoutMillis > 0 {
+			timeout = time.Duration(req.TimeoutMillis) * time.Millisecond
+		}
+		result, err := handleCallback(req.Method, string(req.Params), timeout)
+		if err != nil {
+			var unreachable *unreachableError
+			resp.Error = &guestcall.ResponseError{
+				Message:   err.Error(),
+				Retryable: errors.As(err, &unreachable),
+			}
+		} else {
+			resp.Result = json.RawMessage(result)
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		// Only happens for results that aren't valid JSON.
+		data, _ = json.Marshal(guestcall.Response{
+			Error: &guestcall.ResponseError{Message: fmt.Sprintf("invalid callback result: %v", err)},
+		})
+	}
+	return append(data, '\n')
+}
+
 // parseCallbackCommand parses a CALLBACK command line.
 // Format: CALLBACK <method> [<params_json>]
 func parseCallbackCommand(cmd string) (method string, params string, err error) {
@@ -192,13 +314,37 @@ func parseCallbackCommand(cmd string) (method string, params string, err error)
 func handleConnection(conn *vsock.Conn) {
 	defer conn.Close()
 
+	state := &connState{
+		conn:     conn,
+		fromHost: isFromHost(conn),
+		limiter:  newRateLimiter(),
+	}
+	release, ok := acquireConnSlot(state.fromHost)
+	if !ok {
+		reject(conn, "", guestcall.ErrorTooManyConnections, "too many open connections", true)
+		return
+	}
+	// Also given back early by bridged sockets.
+	release = sync.OnceFunc(release)
+	defer release()
+	if state.fromHost && secret != "" {
+		conn.SetReadDeadline(time.Now().Add(authTimeout))
+	}
+
 	reader := bufio.NewReader(conn)
 
 	for {
+		state.setReadDeadline()
 		// Read command from the connection
-		cmd, err := reader.ReadString('\n')
+		cmd, err := readLine(reader)
+		if errors.Is(err, errLineTooLong) {
+			reject(conn, "", guestcall.ErrorLineTooLong, fmt.Sprintf("commands are limited to %d bytes", maxLineSize), false)
+			return
+		}
 		if err != nil {
-			if err != io.EOF {
+			if isTimeout(err) {
+				log.WithField("remote", conn.RemoteAddr().String()).Info("Closing idle vsock connection")
+			} else if err != io.EOF {
 				log.Errorf("Error reading from connection: %v", err)
 			}
 			return
@@ -211,6 +357,71 @@ func handleConnection(conn *vsock.Conn) {
 			continue
 		}
 
+		if allowed, err := state.admit(cmd); err != nil {
+			log.WithError(err).Warn("Closing vsock connection")
+			return
+		} else if !allowed {
+			continue
+		}
+
+		if strings.HasPrefix(cmd, guestcall.HelloPrefix) {
+			if err := state.handleHello(cmd); err != nil {
+				log.Errorf("Error answering hello: %v", err)
+				return
+			}
+			continue
+		}
+		if strings.HasPrefix(cmd, guestcall.AuthPrefix) {
+			if err := state.handleAuth(cmd); err != nil {
+				log.WithError(err).Warn("Closing vsock connection")
+				return
+			}
+			continue
+		}
+
+		if strings.HasPrefix(cmd, guestcall.SocketPrefix) {
+			state.handleSocket(reader, cmd, release)
+			return
+		}
+
+		if strings.HasPrefix(cmd, guestcall.PTYPrefix) {
+			state.handlePTY(reader, cmd, release)
+			return
+		}
+
+		if strings.HasPrefix(cmd, guestcall.ProcessPrefix) {
+			if _, err := conn.Write(handleProcess(cmd)); err != nil {
+				log.Errorf("Error writing process response: %v", err)
+				return
+			}
+			continue
+		}
+
+		if strings.HasPrefix(cmd, guestcall.FilePrefix) {
+			if err := state.handleFile(reader, cmd); err != nil {
+				log.WithError(err).Warn("Closing vsock connection")
+				return
+			}
+			continue
+		}
+
+		// CALL is the structured form of CALLBACK, used by arrakis-call and the guest SDKs
+		if strings.HasPrefix(cmd, guestcall.CommandPrefix) {
+			if _, err := conn.Write(handleCall(cmd)); err != nil {
+				log.Errorf("Error writing call response: %v", err)
+				return
+			}
+			continue
+		}
+
+		if strings.HasPrefix(cmd, guestcall.ReportPrefix) {
+			if _, err := conn.Write(handleReport(cmd)); err != nil {
+				log.Errorf("Error writing report response: %v", err)
+				return
+			}
+			continue
+		}
+
 		// Check if this is a CALLBACK command
 		if strings.HasPrefix(cmd, "CALLBACK ") {
 			method, params, err := parseCallbackCommand(cmd)
@@ -226,7 +437,7 @@ func handleConnection(conn *vsock.Conn) {
 				"params": params,
 			}).Info("Processing CALLBACK command")
 
-			result, err := handleCallback(method, params)
+			result, err := handleCallback(method, params, callbackTimeout)
 			if err != nil {
 				errMsg := fmt.Sprintf("Error: %v\n", err)
 				log.WithFields(log.Fields{
@@ -307,6 +518,15 @@ func main() {
 		log.Fatalf("Failed to create base directory: %v", err)
 	}
 
+	var err error
+	secret, err = loadSecret()
+	if err != nil {
+		log.Fatalf("Failed to load the vsock secret: %v", err)
+	}
+	if secret == "" {
+		log.Warn("The host shared no vsock secret, connections won't be authenticated")
+	}
+
 	// Parse kernel command line to get gateway IP and VM name
 	if err := parseKernelCmdLine(); err != nil {
 		log.Warnf("Failed to parse kernel command line: %v", err)
@@ -327,6 +547,11 @@ func main() {
 		log.Warnf("Failed to notify systemd of readiness: %v", err)
 	}
 
+	go watchAgents()
+	go watchOOMKills()
+	startTelemetry()
+	go serveCredentials()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Where the OOM kills read from the kernel log are recorded until the host has them, one file per
+// kill.
+const oomKillDir = "/run/arrakis/oom-kills"
+
+// The kernel logs every OOM kill, of the whole guest or of a memory cgroup, as e.g. "Out of memory:
+// Killed process 123 (python3) total-vm:1234kB, anon-rss:567kB, ...".
+var oomKillRegex = regexp.MustCompile(`Killed process (\d+) \(([^)]*)\)(?:.*anon-rss:(\d+)kB)?`)
+
+// watchOOMKills records the processes the kernel kills for running out of memory from now on, for
+// the watchdog to report to the host.
+func watchOOMKills() {
+	kmsg, err := os.Open("/dev/kmsg")
+	if err != nil {
+		log.WithError(err).Error("Failed to open kernel log, OOM kills won't be reported")
+		return
+	}
+	defer kmsg.Close()
+	// Kills before we started were reported by the previous vsockserver, or happened before boot.
+	if _, err := kmsg.Seek(0, io.SeekEnd); err != nil {
+		log.WithError(err).Warn("Failed to skip old kernel log records")
+	}
+
+	// Every read returns a single record.
+	buf := make([]byte, 8192)
+	for {
+		n, err := kmsg.Read(buf)
+		if errors.Is(err, syscall.EPIPE) {
+			// Records were overwritten before we read them.
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to read kernel log, OOM kills won't be reported")
+			return
+		}
+		match := oomKillRegex.FindSubmatch(buf[:n])
+		if match == nil {
+			continue
+		}
+		log.WithFields(log.Fields{"pid": string(match[1]), "process": string(match[2])}).Warn("Kernel killed process for running out of memory")
+		if err := recordOOMKill(string(match[1]), string(match[2]), string(match[3])); err != nil {
+			log.WithError(err).Error("Failed to record OOM kill")
+		}
+	}
+}
+
+// recordOOMKill records the OOM kill of the process `process` with the PID `pid`, atomically so
+// that the watchdog never reads half of it.
+func recordOOMKill(pid string, process string, anonRSSKB string) error {
+	if err := os.MkdirAll(oomKillDir, 0755); err != nil {
+		return err
+	}
+	record := fmt.Sprintf("pid=%s\nprocess=%s\nanonRssKb=%s\nkilledAt=%s\n", pid, process, anonRSSKB, time.Now().UTC().Format(time.RFC3339))
+	file := path.Join(oomKillDir, fmt.Sprintf("%d", time.Now().UnixNano()))
+	if err := os.WriteFile(file+".tmp", []byte(record), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// Processes started with PROCESS that are kept, running or not. Starting another forgets the
+// oldest exited one, or fails if all are running.
+const maxProcesses = 64
+
+var (
+	processesLock sync.Mutex
+	// Oldest first.
+	processes []*managedProcess
+)
+
+// managedProcess is a process started with PROCESS, and the end of its output.
+type managedProcess struct {
+	id        string
+	cmd       string
+	process   *os.Process
+	startedAt time.Time
+
+	lock     sync.Mutex
+	exitCode *int
+	exitedAt *time.Time
+	// The last `guestcall.MaxProcessOutput` bytes of output, which start at `outputStart`.
+	output      []byte
+	outputStart int64
+}
+
+// Write appends to the output, dropping the oldest beyond the limit.
+func (p *managedProcess) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.output = append(p.output, data...)
+	if excess := len(p.output) - guestcall.MaxProcessOutput; excess > 0 {
+		p.output = slices.Clone(p.output[excess:])
+		p.outputStart += int64(excess)
+	}
+	return len(data), nil
+}
+
+func (p *managedProcess) info() guestcall.ProcessInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.infoLocked()
+}
+
+func (p *managedProcess) infoLocked() guestcall.ProcessInfo {
+	return guestcall.ProcessInfo{
+		ID:         p.id,
+		Cmd:        p.cmd,
+		PID:        p.process.Pid,
+		Running:    p.exitCode == nil,
+		ExitCode:   p.exitCode,
+		StartedAt:  p.startedAt,
+		ExitedAt:   p.exitedAt,
+		OutputSize: p.outputStart + int64(len(p.output)),
+	}
+}
+
+// readOutput returns the output from `offset`, at most `maxBytes` of it unless zero.
+func (p *managedProcess) readOutput(offset int64, maxBytes int) guestcall.ProcessOutput {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	end := p.outputStart + int64(len(p.output))
+	resp := guestcall.ProcessOutput{Offset: min(max(offset, p.outputStart), end), Process: p.infoLocked()}
+	resp.Truncated = offset < resp.Offset
+	data := p.output[resp.Offset-p.outputStart:]
+	if maxBytes > 0 && len(data) > maxBytes {
+		data = data[:maxBytes]
+	}
+	resp.Data = slices.Clone(data)
+	resp.NextOffset = resp.Offset + int64(len(data))
+	return resp
+}
+
+func newProcessID() (string, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// findProcess returns the process `id`, or nil.
+func findProcess(id string) *managedProcess {
+	processesLock.Lock()
+	defer processesLock.Unlock()
+	for _, p := range processes {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// reserveProcessSlotLocked makes room for another process, forgetting the oldest exited one if
+// needed. Returns false if all processes are running.
+func reserveProcessSlotLocked() bool {
+	if len(processes) < maxProcesses {
+		return true
+	}
+	for i, p := range processes {
+		if !p.info().Running {
+			processes = slices.Delete(processes, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// startProcess starts `req.Cmd` in a process group of its own, with its output going to the
+// returned process.
+func startProcess(req guestcall.ProcessRequest) (*managedProcess, *guestcall.ResponseError) {
+	if strings.TrimSpace(req.Cmd) == "" {
+		return nil, &guestcall.ResponseError{Code: guestcall.ErrorInvalidProcess, Message: "cmd is required"}
+	}
+	for key := range req.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return nil, &guestcall.ResponseError{Code: guestcall.ErrorInvalidProcess, Message: fmt.Sprintf("invalid environment variable %q", key)}
+		}
+	}
+	id, err := newProcessID()
+	if err != nil {
+		return nil, &guestcall.ResponseError{Code: guestcall.ErrorProcessFailed, Message: err.Error()}
+	}
+
+	processesLock.Lock()
+	defer processesLock.Unlock()
+	if !reserveProcessSlotLocked() {
+		return nil, &guestcall.ResponseError{
+			Code:    guestcall.ErrorTooManyProcesses,
+			Message: fmt.Sprintf("%d processes are running, kill one first", maxProcesses),
+		}
+	}
+
+	p := &managedProcess{id: id, cmd: req.Cmd}
+	command := exec.Command("/bin/bash", "-c", req.Cmd)
+	command.Env = append(os.Environ(), "PATH=/usr/local/bin:/usr/bin:/bin")
+	for key, value := range req.Env {
+		command.Env = append(command.Env, key+"="+value)
+	}
+	command.Dir = baseDir
+	if req.Workdir != "" {
+		command.Dir = req.Workdir
+	}
+	command.Stdout = p
+	command.Stderr = p
+	// A group of its own, so that signals reach the processes it starts too.
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := command.Start(); err != nil {
+		return nil, &guestcall.ResponseError{Code: guestcall.ErrorProcessFailed, Message: fmt.Sprintf("failed to start process: %v", err)}
+	}
+	p.process = command.Process
+	p.startedAt = time.Now().UTC()
+	processes = append(processes, p)
+
+	logger := log.WithFields(log.Fields{"process": id, "pid": p.process.Pid})
+	logger.WithField("cmd", req.Cmd).Info("Started process")
+	go func() {
+		err := command.Wait()
+		exitCode := 0
+		if err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				logger.WithError(err).Error("Failed to wait for process")
+			}
+			exitCode = -1
+			if exitErr != nil {
+				exitCode = exitErr.ExitCode()
+			}
+		}
+		exitedAt := time.Now().UTC()
+		p.lock.Lock()
+		p.exitCode, p.exitedAt = &exitCode, &exitedAt
+		p.lock.Unlock()
+		logger.WithField("exitCode", exitCode).Info("Process exited")
+	}()
+	return p, nil
+}
+
+// signalProcess sends the signal named `name` to the process group of `p`.
+func signalProcess(p *managedProcess, name string) *guestcall.ResponseError {
+	sig := unix.SignalNum(strings.ToUpper(name))
+	if sig == 0 {
+		return &guestcall.ResponseError{Code: guestcall.ErrorInvalidProcess, Message: fmt.Sprintf("unknown signal %q", name)}
+	}
+	// Holding the lock, so that the process can't be reaped and its PID reused meanwhile.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.exitCode != nil {
+		return nil
+	}
+	if err := syscall.Kill(-p.process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return &guestcall.ResponseError{Code: guestcall.ErrorProcessFailed, Message: fmt.Sprintf("failed to signal process: %v", err)}
+	}
+	return nil
+}
+
+// handleProcess runs the PROCESS command `cmd` and returns the JSON `guestcall.Response` to send
+// back.
+func handleProcess(cmd string) []byte {
+	var req guestcall.ProcessRequest
+	var result any
+	var respErr *guestcall.ResponseError
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd, guestcall.ProcessPrefix)), &req); err != nil {
+		respErr = &guestcall.ResponseError{Code: guestcall.ErrorInvalidProcess, Message: fmt.Sprintf("invalid request: %v", err)}
+	} else {
+		result, respErr = runProcessOp(req)
+	}
+
+	resp := guestcall.Response{Error: respErr}
+	if respErr == nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	data, _ := json.Marshal(resp)
+	return append(data, '\n')
+}
+
+func runProcessOp(req guestcall.ProcessRequest) (any, *guestcall.ResponseError) {
+	switch req.Op {
+	case guestcall.ProcessOpStart:
+		p, err := startProcess(req)
+		if err != nil {
+			return nil, err
+		}
+		return p.info(), nil
+	case guestcall.ProcessOpList:
+		processesLock.Lock()
+		list := guestcall.ProcessList{Processes: make([]guestcall.ProcessInfo, len(processes))}
+		for i, p := range processes {
+			list.Processes[i] = p.info()
+		}
+		processesLock.Unlock()
+		return list, nil
+	case guestcall.ProcessOpOutput, guestcall.ProcessOpSignal, guestcall.ProcessOpKill:
+	default:
+		return nil, &guestcall.ResponseError{Code: guestcall.ErrorInvalidProcess, Message: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+
+	p := findProcess(req.ID)
+	if p == nil {
+		return nil, &guestcall.ResponseError{Code: guestcall.ErrorProcessNotFound, Message: fmt.Sprintf("process not found: %s", req.ID)}
+	}
+	switch req.Op {
+	case guestcall.ProcessOpOutput:
+		if req.Offset < 0 || req.MaxBytes < 0 {
+			return nil, &guestcall.ResponseError{Code: guestcall.ErrorInvalidProcess, Message: "offset and maxBytes can't be negative"}
+		}
+		return p.readOutput(req.Offset, req.MaxBytes), nil
+	case guestcall.ProcessOpSignal:
+		if err := signalProcess(p, req.Signal); err != nil {
+			return nil, err
+		}
+		return p.info(), nil
+	default:
+		if err := signalProcess(p, "SIGKILL"); err != nil {
+			return nil, err
+		}
+		processesLock.Lock()
+		processes = slices.DeleteFunc(processes, func(other *managedProcess) bool { return other == p })
+		processesLock.Unlock()
+		log.WithField("process", p.id).Info("Killed process")
+		return p.info(), nil
+	}
+}
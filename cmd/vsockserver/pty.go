@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	// Shells open at once.
+	maxPTYs = 16
+	// Size and TERM of shells whose request leaves them out.
+	defaultPTYCols = 80
+	defaultPTYRows = 24
+	defaultTerm    = "xterm-256color"
+	// How long output of an exited shell is still forwarded, e.g. from background processes
+	// holding the terminal, before the connection is closed.
+	ptyDrainTimeout = time.Second
+	// Size of the chunks of terminal output sent to the host.
+	ptyBufferSize = 32 << 10
+)
+
+var ptySlots = make(chan struct{}, maxPTYs)
+
+// openPTY returns the master and slave ends of a new pseudo-terminal of `size`.
+func openPTY(size guestcall.PTYSize) (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := control(master, func(fd int) error { return unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0) }); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	var n int
+	if err := control(master, func(fd int) (err error) {
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	}); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	if err := resizePTY(master, size); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// control runs `fn` on the file descriptor of `f`. Unlike `f.Fd()` it leaves the descriptor
+// non-blocking, so that closing `f` still interrupts reads.
+func control(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := rc.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func resizePTY(master *os.File, size guestcall.PTYSize) error {
+	winsize := &unix.Winsize{Row: size.Rows, Col: size.Cols}
+	if err := control(master, func(fd int) error { return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, winsize) }); err != nil {
+		return fmt.Errorf("failed to resize pty: %w", err)
+	}
+	return nil
+}
+
+// handlePTY starts the shell asked for by `cmd` on a new pseudo-terminal and relays frames between
+// the connection and the terminal until the shell exits or the host hangs up. `releaseSlot` gives
+// back the connection's command slot once the shell has taken a slot of its own.
+func (c *connState) handlePTY(reader *bufio.Reader, cmd string, releaseSlot func()) {
+	logger := log.WithField("remote", c.conn.RemoteAddr().String())
+	var req guestcall.PTYRequest
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd, guestcall.PTYPrefix)), &req); err != nil {
+		reject(c.conn, cmd, guestcall.ErrorInvalidPTY, fmt.Sprintf("invalid request: %v", err), false)
+		return
+	}
+	if req.Cols == 0 || req.Rows == 0 {
+		req.PTYSize = guestcall.PTYSize{Cols: defaultPTYCols, Rows: defaultPTYRows}
+	}
+	if req.Term == "" {
+		req.Term = defaultTerm
+	}
+	if err := guestcall.ValidateTerm(req.Term); err != nil {
+		reject(c.conn, cmd, guestcall.ErrorInvalidPTY, err.Error(), false)
+		return
+	}
+	select {
+	case ptySlots <- struct{}{}:
+		defer func() { <-ptySlots }()
+	default:
+		reject(c.conn, cmd, guestcall.ErrorTooManyConnections, "too many open shells", true)
+		return
+	}
+	releaseSlot()
+
+	master, slave, err := openPTY(req.PTYSize)
+	if err != nil {
+		reject(c.conn, cmd, guestcall.ErrorPTYFailed, fmt.Sprintf("failed to open pty: %v", err), false)
+		return
+	}
+	closeMaster := sync.OnceFunc(func() { master.Close() })
+	defer closeMaster()
+
+	shell := exec.Command("/bin/bash", "-l")
+	shell.Env = append(os.Environ(), "PATH=/usr/local/bin:/usr/bin:/bin", "TERM="+req.Term)
+	shell.Dir = baseDir
+	shell.Stdin = slave
+	shell.Stdout = slave
+	shell.Stderr = slave
+	// A session of its own, with the terminal as its controlling terminal, so that job control
+	// and Ctrl-C reach the shell's foreground process group.
+	shell.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = shell.Start()
+	slave.Close()
+	if err != nil {
+		reject(c.conn, cmd, guestcall.ErrorPTYFailed, fmt.Sprintf("failed to start shell: %v", err), false)
+		return
+	}
+
+	c.conn.SetReadDeadline(time.Time{})
+	data, _ := json.Marshal(guestcall.Response{})
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		logger.WithError(err).Error("Failed to answer PTY")
+		shell.Process.Kill()
+		shell.Wait()
+		return
+	}
+	logger.WithField("pid", shell.Process.Pid).Info("Started shell")
+
+	// Only this goroutine writes to the connection until the shell exited.
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, ptyBufferSize)
+		for {
+			n, err := master.Read(buf)
+			if n > 0 {
+				if err := guestcall.WriteFrame(c.conn, guestcall.FrameData, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				// EIO once no process holds the terminal anymore.
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			typ, payload, err := guestcall.ReadFrame(reader)
+			if err != nil {
+				// The host hung up, which hangs up the shell too.
+				closeMaster()
+				return
+			}
+			switch typ {
+			case guestcall.FrameData:
+				if _, err := master.Write(payload); err != nil {
+					return
+				}
+			case guestcall.FrameResize:
+				var size guestcall.PTYSize
+				if err := json.Unmarshal(payload, &size); err != nil || size.Cols == 0 || size.Rows == 0 {
+					logger.Warnf("Ignoring invalid resize: %s", payload)
+					continue
+				}
+				if err := resizePTY(master, size); err != nil {
+					logger.WithError(err).Warn("Failed to resize shell")
+				}
+			}
+		}
+	}()
+
+	exit := guestcall.PTYExit{}
+	if err := shell.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exit.ExitCode = exitErr.ExitCode()
+		} else {
+			exit.ExitCode = -1
+			exit.Error = err.Error()
+		}
+	}
+	select {
+	case <-outputDone:
+	case <-time.After(ptyDrainTimeout):
+	}
+	closeMaster()
+	<-outputDone
+
+	data, _ = json.Marshal(exit)
+	if err := guestcall.WriteFrame(c.conn, guestcall.FrameExit, data); err != nil {
+		logger.WithError(err).Debug("Failed to send the shell's exit code")
+	}
+	c.conn.CloseWrite()
+	logger.WithField("exitCode", exit.ExitCode).Info("Shell exited")
+}
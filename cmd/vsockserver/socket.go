@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	// Bridged sockets have slots of their own, as tools like docker open many connections at once.
+	maxSocketConns = 64
+	// How long connecting to a socket may take.
+	socketDialTimeout = 5 * time.Second
+)
+
+var socketConnSlots = make(chan struct{}, maxSocketConns)
+
+// handleSocket bridges the connection to the Unix socket named by `cmd`, copying bytes both ways
+// until either side closes. `releaseSlot` gives back the connection's command slot once the
+// bridge has taken a socket slot. The connection carries nothing else afterwards.
+func (c *connState) handleSocket(reader *bufio.Reader, cmd string, releaseSlot func()) {
+	socketPath := strings.TrimSpace(strings.TrimPrefix(cmd, guestcall.SocketPrefix))
+	logger := log.WithFields(log.Fields{
+		"remote": c.conn.RemoteAddr().String(),
+		"socket": socketPath,
+	})
+	if err := guestcall.ValidateSocketPath(socketPath); err != nil {
+		reject(c.conn, cmd, guestcall.ErrorInvalidSocket, err.Error(), false)
+		return
+	}
+	select {
+	case socketConnSlots <- struct{}{}:
+		defer func() { <-socketConnSlots }()
+	default:
+		reject(c.conn, cmd, guestcall.ErrorTooManyConnections, "too many bridged sockets", true)
+		return
+	}
+	releaseSlot()
+
+	socket, err := net.DialTimeout("unix", socketPath, socketDialTimeout)
+	if err != nil {
+		reject(c.conn, cmd, guestcall.ErrorSocketUnreachable, fmt.Sprintf("failed to connect to %s: %v", socketPath, err), false)
+		return
+	}
+	defer socket.Close()
+
+	c.conn.SetReadDeadline(time.Time{})
+	data, _ := json.Marshal(guestcall.Response{})
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		logger.WithError(err).Error("Failed to answer SOCKET")
+		return
+	}
+	logger.Info("Bridging socket")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Anything the client sent after the command is already buffered in `reader`.
+		io.Copy(socket, reader)
+		if unixConn, ok := socket.(*net.UnixConn); ok {
+			unixConn.CloseWrite()
+		}
+	}()
+	io.Copy(c.conn, socket)
+	c.conn.CloseWrite()
+	<-done
+	logger.Info("Socket closed")
+}
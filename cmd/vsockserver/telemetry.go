@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+const (
+	// Where the workload sends OTLP/HTTP logs and metrics, the collector's usual port.
+	otlpListenAddr = "127.0.0.1:4318"
+
+	// Collected log records are sent to the host when this many are buffered or when the flush
+	// interval elapses, whichever comes first. Beyond maxBufferedRecords the newest are dropped.
+	maxLogBatch        = 512
+	maxBufferedRecords = 4096
+	logFlushInterval   = 5 * time.Second
+	telemetryTimeout   = 10 * time.Second
+
+	// How often log files are checked for new lines, and the longest line kept whole.
+	logFilePollInterval = time.Second
+	maxLogLineLength    = 16 << 10
+	// How long to wait before running journalctl again after it exited.
+	journaldRestartDelay = 10 * time.Second
+
+	scopeName = "arrakis-vsockserver"
+)
+
+// The value of the telemetry kernel command line key, set by parseKernelCmdLine.
+var telemetryCmdline string
+
+// OTLP severity numbers of the levels records are collected with.
+const (
+	severityDebug = 5
+	severityInfo  = 9
+	severityWarn  = 13
+	severityError = 17
+	severityFatal = 21
+)
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func stringAttribute(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber,omitempty"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+// logBatcher buffers the log records collected from files and the journal, and sends them to the
+// host in batches.
+type logBatcher struct {
+	lock    sync.Mutex
+	records []otlpLogRecord
+	dropped int
+	// Signaled when a batch is full.
+	full chan struct{}
+}
+
+func newLogBatcher() *logBatcher {
+	return &logBatcher{full: make(chan struct{}, 1)}
+}
+
+// add buffers a record of `line`, observed now, unless the buffer is full.
+func (b *logBatcher) add(t time.Time, severity int, line string, attrs ...otlpKeyValue) {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	record := otlpLogRecord{
+		TimeUnixNano:         now,
+		ObservedTimeUnixNano: now,
+		SeverityNumber:       severity,
+		Body:                 otlpAnyValue{StringValue: &line},
+		Attributes:           attrs,
+	}
+	if !t.IsZero() {
+		record.TimeUnixNano = strconv.FormatInt(t.UnixNano(), 10)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.records) >= maxBufferedRecords {
+		b.dropped++
+		return
+	}
+	b.records = append(b.records, record)
+	if len(b.records) >= maxLogBatch {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the buffered records every flush interval, or sooner once a batch is full. Batches the
+// host refuses are dropped, so that a broken collector can't exhaust the guest's memory.
+func (b *logBatcher) run() {
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		for {
+			b.lock.Lock()
+			n := min(len(b.records), maxLogBatch)
+			batch := b.records[:n:n]
+			b.records = b.records[n:]
+			dropped := b.dropped
+			b.dropped = 0
+			b.lock.Unlock()
+			if dropped > 0 {
+				log.Warnf("Dropped %d log records, the buffer was full", dropped)
+			}
+			if n == 0 {
+				break
+			}
+
+			scope := otlpScopeLogs{LogRecords: batch}
+			scope.Scope.Name = scopeName
+			resource := otlpResourceLogs{ScopeLogs: []otlpScopeLogs{scope}}
+			resource.Resource.Attributes = []otlpKeyValue{stringAttribute("service.name", vmName)}
+			body, err := json.Marshal(otlpLogsRequest{ResourceLogs: []otlpResourceLogs{resource}})
+			if err == nil {
+				_, _, err = sendTelemetry(guestcall.TelemetryLogs, body)
+			}
+			// Only logged when sending starts or stops failing, so that the guest's own logs,
+			// which may be forwarded too, don't snowball.
+			if err != nil && !failing {
+				log.WithError(err).Warnf("Failed to send %d log records to the host, dropping them until it works again", n)
+			} else if err == nil && failing {
+				log.Info("Sending log records to the host works again")
+			}
+			failing = err != nil
+			if n < maxLogBatch {
+				break
+			}
+		}
+	}
+}
+
+// sendTelemetry posts `body`, an OTLP/HTTP JSON export request of `signal`, to the restserver,
+// which forwards it to the collector. It returns the restserver's status and response.
+func sendTelemetry(signal string, body []byte) (int, []byte, error) {
+	client := &http.Client{
+		Timeout: telemetryTimeout,
+	}
+	reqURL := restserverURL("/v1/internal/telemetry/" + signal + "?vmName=" + url.QueryEscape(vmName))
+	resp, err := client.Post(reqURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("telemetry HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, respBody, fmt.Errorf("telemetry returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// otlpHandler relays the OTLP/HTTP JSON export requests of `signal` the workload sends to the host,
+// answering with the host's response. Protobuf isn't supported.
+func otlpHandler(signal string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Only OTLP/HTTP with JSON encoding is supported", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, guestcall.MaxTelemetryBody))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read request: %v", err), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		status, respBody, err := sendTelemetry(signal, body)
+		if status == 0 {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if err != nil {
+			log.WithError(err).Debugf("Host refused OTLP %s", signal)
+		}
+		if status == http.StatusNoContent {
+			// OTLP/HTTP clients expect an export response.
+			status = http.StatusOK
+			respBody = []byte("{}")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(respBody)
+	}
+}
+
+// serveOTLP accepts OTLP/HTTP logs and metrics from the workload on `otlpListenAddr`.
+func serveOTLP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/logs", otlpHandler(guestcall.TelemetryLogs))
+	mux.HandleFunc("/v1/metrics", otlpHandler(guestcall.TelemetryMetrics))
+	log.Infof("Accepting OTLP/HTTP logs and metrics on %s", otlpListenAddr)
+	if err := http.ListenAndServe(otlpListenAddr, mux); err != nil {
+		log.WithError(err).Error("OTLP receiver stopped")
+	}
+}
+
+// tailLogFile sends the lines appended to `path` to `batcher`, starting at its current end. The
+// file may not exist yet, and is reopened once it was rotated; it's read from the start after it
+// was truncated.
+func tailLogFile(path string, batcher *logBatcher) {
+	attrs := []otlpKeyValue{stringAttribute("log.file.path", path)}
+	var file *os.File
+	var offset int64
+	var partial []byte
+	first := true
+	buf := make([]byte, 64<<10)
+
+	emit := func(data []byte) {
+		partial = append(partial, data...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			if line := strings.TrimRight(string(partial[:i]), "\r"); line != "" {
+				batcher.add(time.Time{}, 0, line, attrs...)
+			}
+			partial = partial[i+1:]
+		}
+		if len(partial) > maxLogLineLength {
+			batcher.add(time.Time{}, 0, string(partial), attrs...)
+			partial = nil
+		}
+	}
+	readToEnd := func() {
+		for {
+			n, err := file.ReadAt(buf, offset)
+			offset += int64(n)
+			emit(buf[:n])
+			if err != nil || n == 0 {
+				return
+			}
+		}
+	}
+
+	for ; ; time.Sleep(logFilePollInterval) {
+		if file == nil {
+			f, err := os.Open(path)
+			if err != nil {
+				first = false
+				continue
+			}
+			file, offset, partial = f, 0, nil
+			if first {
+				if info, err := f.Stat(); err == nil {
+					offset = info.Size()
+				}
+				first = false
+			}
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			file = nil
+			continue
+		}
+		if info.Size() < offset {
+			offset = 0
+			partial = nil
+		}
+		readToEnd()
+
+		// Rotated or removed, so whatever is at `path` now is a new file.
+		current, err := os.Stat(path)
+		if err != nil || !os.SameFile(info, current) {
+			readToEnd()
+			file.Close()
+			file = nil
+		}
+	}
+}
+
+// journalSeverity maps a syslog priority to an OTLP severity.
+func journalSeverity(priority string) int {
+	switch priority {
+	case "0", "1", "2":
+		return severityFatal
+	case "3":
+		return severityError
+	case "4":
+		return severityWarn
+	case "5", "6":
+		return severityInfo
+	case "7":
+		return severityDebug
+	}
+	return 0
+}
+
+// followJournal sends the entries added to the systemd journal to `batcher`, for as long as the
+// guest has journalctl.
+func followJournal(batcher *logBatcher) {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		log.Warn("journald telemetry is enabled but the guest has no journalctl")
+		return
+	}
+	for ; ; time.Sleep(journaldRestartDelay) {
+		cmd := exec.Command("journalctl", "--follow", "--output=json", "--lines=0")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.WithError(err).Error("Failed to follow the journal")
+			continue
+		}
+		if err := cmd.Start(); err != nil {
+			log.WithError(err).Error("Failed to follow the journal")
+			continue
+		}
+
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			var entry map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			// Binary messages are arrays of bytes, which aren't worth forwarding.
+			message, ok := entry["MESSAGE"].(string)
+			if !ok || message == "" {
+				continue
+			}
+			var t time.Time
+			if usec, err := strconv.ParseInt(fmt.Sprint(entry["__REALTIME_TIMESTAMP"]), 10, 64); err == nil {
+				t = time.UnixMicro(usec)
+			}
+			recordAttrs := []otlpKeyValue{stringAttribute("log.source", "journald")}
+			if unit, ok := entry["_SYSTEMD_UNIT"].(string); ok {
+				recordAttrs = append(recordAttrs, stringAttribute("systemd.unit", unit))
+			}
+			if identifier, ok := entry["SYSLOG_IDENTIFIER"].(string); ok {
+				recordAttrs = append(recordAttrs, stringAttribute("syslog.identifier", identifier))
+			}
+			priority, _ := entry["PRIORITY"].(string)
+			batcher.add(t, journalSeverity(priority), message, recordAttrs...)
+		}
+		err = cmd.Wait()
+		log.WithError(err).Warnf("journalctl exited, following the journal again in %s", journaldRestartDelay)
+	}
+}
+
+// startTelemetry starts collecting and forwarding what the telemetry kernel command line key asks
+// for, if anything.
+func startTelemetry() {
+	telemetry, err := guesttuning.DecodeTelemetry(telemetryCmdline)
+	if err != nil {
+		log.WithError(err).Error("Invalid telemetry settings, forwarding nothing")
+		return
+	}
+	if telemetry == nil {
+		return
+	}
+
+	if telemetry.OTLP {
+		go serveOTLP()
+	}
+	if len(telemetry.LogFiles) == 0 && !telemetry.Journald {
+		return
+	}
+	batcher := newLogBatcher()
+	go batcher.run()
+	for _, path := range telemetry.LogFiles {
+		log.Infof("Forwarding the logs of %s", path)
+		go tailLogFile(path, batcher)
+	}
+	if telemetry.Journald {
+		log.Info("Forwarding the journal")
+		go followJournal(batcher)
+	}
+}
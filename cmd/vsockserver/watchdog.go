@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	// Where arrakis-agent-stopped records the crashes of agents, one file per crash.
+	agentCrashDir = "/run/arrakis/agent-crashes"
+	// How often recorded crashes are looked for.
+	watchdogInterval = 2 * time.Second
+	// Where guestinit records the transports of the shared directories it mounted.
+	sharedDirsRecordPath = "/run/arrakis/shared-dirs"
+)
+
+// watchAgents reports the crashes of agents, including our own, to the host. systemd restarts the
+// crashed agents. It also reports the processes the kernel killed for running out of memory, and
+// how the shared directories were mounted, once guestinit has.
+func watchAgents() {
+	for {
+		reportRecords(agentCrashDir, guestcall.ReportAgentRestart, "agent crash")
+		reportRecords(oomKillDir, guestcall.ReportOOMKill, "OOM kill")
+		reportSharedDirs()
+		time.Sleep(watchdogInterval)
+	}
+}
+
+// reportRecords reports the records in `dir` as reports of `reportType`, oldest first, and deletes
+// them once the host has them.
+func reportRecords(dir string, reportType string, what string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Errorf("Failed to read %ss", what)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		recordPath := path.Join(dir, entry.Name())
+		data, err := os.ReadFile(recordPath)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to read %s %s", what, recordPath)
+			continue
+		}
+		record := parseCrashRecord(string(data))
+		logger := log.WithField("record", record)
+		if err := sendReport(guestcall.Report{Type: reportType, Data: record}); err != nil {
+			var unreachable *unreachableError
+			if errors.As(err, &unreachable) {
+				// Tried again on the next round.
+				logger.WithError(err).Warnf("Failed to report %s", what)
+				return
+			}
+			logger.WithError(err).Errorf("Host refused %s, dropping it", what)
+		} else {
+			logger.Infof("Reported %s", what)
+		}
+		if err := os.Remove(recordPath); err != nil {
+			logger.WithError(err).Errorf("Failed to delete %s", what)
+		}
+	}
+}
+
+// parseCrashRecord parses the `key=value` lines of a crash record, or of other records.
+func parseCrashRecord(record string) map[string]string {
+	crash := make(map[string]string)
+	for _, line := range strings.Split(record, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if ok && value != "" {
+			crash[key] = value
+		}
+	}
+	return crash
+}
+
+// reportSharedDirs reports the transports guestinit mounted the shared directories with, and
+// deletes the record once the host has it.
+func reportSharedDirs() {
+	data, err := os.ReadFile(sharedDirsRecordPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Error("Failed to read shared directories")
+		}
+		return
+	}
+	if err := sendReport(guestcall.Report{Type: guestcall.ReportSharedDirs, Data: parseCrashRecord(string(data))}); err != nil {
+		var unreachable *unreachableError
+		if errors.As(err, &unreachable) {
+			// Tried again on the next round.
+			log.WithError(err).Warn("Failed to report shared directories")
+			return
+		}
+		log.WithError(err).Error("Host refused shared directories, dropping them")
+	} else {
+		log.Info("Reported shared directories")
+	}
+	if err := os.Remove(sharedDirsRecordPath); err != nil {
+		log.WithError(err).Error("Failed to delete shared directories")
+	}
+}
@@ -23,10 +23,23 @@ echo "Setup essential mounts"
 echo "Setting up overlayroot..."
 
 # 3. Mount read-only rootfs
+# The image is shared by every VM on the host, so it's never written, not even to replay its
+# journal. Images holding a whole disk, like prebuilt cloud images, have their root filesystem on
+# one of its partitions, the first ext4 one with an /etc.
 echo "Mounting read-only rootfs from $LOWER_RO_DEVICE to $LOWER_RO"
 /bin/busybox mkdir -p ${LOWER_RO}
-/bin/busybox mount -t ext4 ${LOWER_RO_DEVICE} ${LOWER_RO}
-if [ $? -ne 0 ]; then
+MOUNTED=1
+for DEVICE in ${LOWER_RO_DEVICE} ${LOWER_RO_DEVICE}[0-9]*; do
+    [ -b "$DEVICE" ] || continue
+    /bin/busybox mount -t ext4 -o ro,noload ${DEVICE} ${LOWER_RO} 2>/dev/null || continue
+    if [ -d ${LOWER_RO}/etc ]; then
+        echo "Found rootfs on $DEVICE"
+        MOUNTED=0
+        break
+    fi
+    /bin/busybox umount ${LOWER_RO}
+done
+if [ $MOUNTED -ne 0 ]; then
     echo "Error mounting read-only rootfs!"
     exec /bin/busybox sh  # Drop to shell for debugging
     return 1
@@ -37,7 +50,6 @@ fi
 # 2. Mount writable device
 echo "Mounting writable device $WRITABLE_RW_DEVICE to $WRITABLE_RW"
 /bin/busybox mkdir -p ${WRITABLE_RW}
-# TODO: Add ro for good measure.
 /bin/busybox mount -t ext4 ${WRITABLE_RW_DEVICE} ${WRITABLE_RW}
 if [ $? -ne 0 ]; then
     echo "Error mounting writable device!"
@@ -69,5 +81,16 @@ fi
 echo "Verifying /mnt/overlay is a mount point..."
 echo $(/bin/busybox mount)
 
-echo "Switching root to ${NEWROOT}"
-exec switch_root ${NEWROOT} /sbin/init
+# Images with systemd boot with it, and minimal images without it with arrakis-guestinit as their
+# init, unless the VM's template picks one with arrakis_init="systemd" or "agent".
+INIT=/sbin/init
+INIT_MODE=$(/bin/busybox sed -n 's/.*arrakis_init="\([a-z]*\)".*/\1/p' /proc/cmdline)
+if [ "$INIT_MODE" = "agent" ]; then
+    INIT=/usr/local/bin/arrakis-guestinit
+elif [ "$INIT_MODE" != "systemd" ] && [ ! -e ${NEWROOT}/lib/systemd/systemd ] && [ ! -e ${NEWROOT}/usr/lib/systemd/systemd ]; then
+    echo "No systemd in the rootfs, booting with arrakis-guestinit as init"
+    INIT=/usr/local/bin/arrakis-guestinit
+fi
+
+echo "Switching root to ${NEWROOT} with ${INIT}"
+exec switch_root ${NEWROOT} ${INIT}
@@ -0,0 +1,33 @@
+// Package backoff has the exponential backoff that arrakis' clients, callbacks and guests retry
+// with.
+package backoff
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Duration returns how long to wait before retry number `retry`, counting from 1: `initial`,
+// doubling with each retry up to `max`. The wait is jittered so that callers cut off by the same
+// hiccup don't retry in step.
+func Duration(retry int, initial time.Duration, max time.Duration) time.Duration {
+	d := initial
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	d = min(d, max)
+	return d/2 + rand.N(d/2+1)
+}
+
+// Wait sleeps for `d` or until `ctx` expires.
+func Wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,42 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		retry   int
+		initial time.Duration
+		max     time.Duration
+		want    time.Duration
+	}{
+		{retry: 1, initial: 200 * time.Millisecond, max: 5 * time.Second, want: 200 * time.Millisecond},
+		{retry: 2, initial: 200 * time.Millisecond, max: 5 * time.Second, want: 400 * time.Millisecond},
+		{retry: 4, initial: 200 * time.Millisecond, max: 5 * time.Second, want: 1600 * time.Millisecond},
+		{retry: 6, initial: 200 * time.Millisecond, max: 5 * time.Second, want: 5 * time.Second},
+		{retry: 1000, initial: 200 * time.Millisecond, max: 5 * time.Second, want: 5 * time.Second},
+		{retry: 1, initial: 10 * time.Second, max: time.Second, want: time.Second},
+	}
+	for _, tt := range tests {
+		for range 20 {
+			// Jittered into the upper half of the wait.
+			if got := Duration(tt.retry, tt.initial, tt.max); got < tt.want/2 || got > tt.want {
+				t.Errorf("Duration(%d, %s, %s) = %s, want between %s and %s", tt.retry, tt.initial, tt.max, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	if err := Wait(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Wait(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+	}
+}
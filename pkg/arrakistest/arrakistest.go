@@ -0,0 +1,394 @@
+// Package arrakistest lets Go tests of projects built on arrakis run against arrakis-restserver,
+// without shell scripts around them. `Start` connects to a running server, or starts one of the
+// test's own from a binary and config file. Its helpers create VMs that are destroyed when the test
+// ends, run commands in them and wait for events.
+//
+// A server the test starts runs cloud-hypervisor VMs, so it needs root, KVM and the images its
+// config names. Give it a bridge and subnet of its own. Servers that tests start run one at a time
+// on a host, as they tear down the tap devices of any other server on it. With `Options.Fake`
+// the server runs its VMs on fakevmm instead, a stand-in for cloud-hypervisor whose guests are
+// processes in namespaces of their own running the guest agent, which needs root but neither KVM
+// nor images; see `Server.Fake`. Tests without a server to run against are skipped.
+package arrakistest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/client"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+const (
+	// Environment variables `Options` default to.
+	EnvServer     = "ARRAKIS_TEST_SERVER"
+	EnvAPIKey     = "ARRAKIS_TEST_API_KEY"
+	EnvRestserver = "ARRAKIS_TEST_RESTSERVER"
+	EnvConfig     = "ARRAKIS_TEST_CONFIG"
+	EnvFakeVMM    = "ARRAKIS_TEST_FAKEVMM"
+
+	DefaultStartTimeout = time.Minute
+	// How long a server the test started has to stop before it's killed.
+	stopTimeout = 30 * time.Second
+	// Prefix of the names of VMs created without one.
+	vmNamePrefix = "arrakistest-"
+)
+
+// Tools that servers run, besides the hypervisor.
+var serverTools = []string{"ip", "iptables", "iptables-save", "sysctl", "mkfs.ext4"}
+
+// Held by each test that runs a server it started, as servers tear down each other's tap devices.
+var serversLockFile = filepath.Join(os.TempDir(), "arrakistest.lock")
+
+// Options say which server to test against. Zero values are taken from the environment.
+type Options struct {
+	// Address of a running server as host:port, e.g. "127.0.0.1:7000". Defaults to
+	// $ARRAKIS_TEST_SERVER.
+	ServerAddr string
+	// API key to authenticate with, if the server requires one. Defaults to
+	// $ARRAKIS_TEST_API_KEY.
+	APIKey string
+	// Without a ServerAddr, a server is started from the arrakis-restserver binary at Restserver
+	// with the config file ConfigFile, defaulting to $ARRAKIS_TEST_RESTSERVER and
+	// $ARRAKIS_TEST_CONFIG. Its state dir and port are replaced by ones of the test's own.
+	Restserver string
+	ConfigFile string
+	// How long the server has to become healthy. Defaults to `DefaultStartTimeout`.
+	StartTimeout time.Duration
+	// Without a ServerAddr, start a server whose hypervisor is fakevmm. Restserver is built with
+	// `go build` unless it's set, and ConfigFile is optional.
+	Fake bool
+	// The arrakis-fakevmm binary, next to the arrakis-cmdserver it runs in guests, as `make
+	// fakevmm cmdserver` leaves them in out/. Defaults to $ARRAKIS_TEST_FAKEVMM, and both are
+	// built with `go build` without either.
+	FakeVMM string
+}
+
+func (o *Options) setDefaults() {
+	if o.ServerAddr == "" {
+		o.ServerAddr = os.Getenv(EnvServer)
+	}
+	if o.APIKey == "" {
+		o.APIKey = os.Getenv(EnvAPIKey)
+	}
+	if o.Restserver == "" {
+		o.Restserver = os.Getenv(EnvRestserver)
+	}
+	if o.ConfigFile == "" {
+		o.ConfigFile = os.Getenv(EnvConfig)
+	}
+	if o.FakeVMM == "" {
+		o.FakeVMM = os.Getenv(EnvFakeVMM)
+	}
+	if o.StartTimeout <= 0 {
+		o.StartTimeout = DefaultStartTimeout
+	}
+}
+
+// Server is the server a test runs against.
+type Server struct {
+	Addr   string
+	Client *client.Client
+	// Set for a server started with `Options.Fake`, whose VMs run on fakevmm. Their guests share
+	// the host's kernel and see its file system read-only, but for /etc, /tmp, /run, /root and
+	// /var/tmp. Snapshots, migrations, vsock and hotplugging aren't supported, so tests of those
+	// should skip on it.
+	Fake bool
+}
+
+// Start returns the server of `opts`, starting it if it isn't a running one. Servers the test
+// started are stopped when it ends. The test is skipped if there's no server to run against, or if
+// one can't be started for lack of root, KVM or the tools the server needs.
+func Start(t testing.TB, opts Options) *Server {
+	t.Helper()
+	opts.setDefaults()
+	addr := opts.ServerAddr
+	if addr == "" {
+		var reason string
+		if opts.Fake {
+			reason = fakeMissing(opts)
+		} else {
+			reason = restserverMissing(opts)
+		}
+		if reason != "" {
+			t.Skipf("no arrakis server to test against: %s", reason)
+		}
+		if opts.Fake {
+			addr = startFake(t, opts)
+		} else {
+			addr = startRestserver(t, opts.Restserver, readConfig(t, opts.ConfigFile))
+		}
+	}
+
+	// Tests fail on the first error rather than waiting out retries.
+	c, err := client.New(addr, client.Options{APIKey: opts.APIKey, Retry: &client.RetryPolicy{}})
+	if err != nil {
+		t.Fatalf("invalid arrakis server address: %v", err)
+	}
+	s := &Server{Addr: addr, Client: c, Fake: opts.Fake && opts.ServerAddr == ""}
+	s.waitHealthy(t, opts.StartTimeout)
+	return s
+}
+
+// restserverMissing returns why the server of `opts` can't be started, or "" if it can.
+func restserverMissing(opts Options) string {
+	if opts.Restserver == "" || opts.ConfigFile == "" {
+		return fmt.Sprintf("set %s, or %s and %s, or Options.Fake", EnvServer, EnvRestserver, EnvConfig)
+	}
+	if reason := toolsMissing(); reason != "" {
+		return reason
+	}
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Sprintf("starting a server needs KVM: %v", err)
+	}
+	kvm.Close()
+	return ""
+}
+
+// toolsMissing returns why this host can't run a server, or "" if it can.
+func toolsMissing() string {
+	if os.Geteuid() != 0 {
+		return "starting a server needs root"
+	}
+	for _, tool := range serverTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Sprintf("starting a server needs %s", tool)
+		}
+	}
+	return ""
+}
+
+// readConfig reads the config file `configFile` as YAML.
+func readConfig(t testing.TB, configFile string) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	var cfg map[string]any
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("invalid config %s: %v", configFile, err)
+	}
+	return cfg
+}
+
+// restserverConfig returns the hostservices.restserver section of `cfg`.
+func restserverConfig(t testing.TB, cfg map[string]any) map[string]any {
+	t.Helper()
+	hostServices, _ := cfg["hostservices"].(map[string]any)
+	restserver, _ := hostServices["restserver"].(map[string]any)
+	if restserver == nil {
+		t.Fatal("config has no hostservices.restserver")
+	}
+	return restserver
+}
+
+// startRestserver starts the server binary `binary` with the config `cfg`, a state dir in the
+// test's temporary directory and a free port on localhost, and returns its address. It waits for
+// the servers other tests on the host started to stop first.
+func startRestserver(t testing.TB, binary string, cfg map[string]any) string {
+	t.Helper()
+	restserver := restserverConfig(t, cfg)
+	lockServers(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	dir := t.TempDir()
+	restserver["host"] = "127.0.0.1"
+	restserver["port"] = fmt.Sprint(port)
+	restserver["state_dir"] = filepath.Join(dir, "state")
+	// Extra listeners would clash with the server the config was written for.
+	delete(restserver, "listeners")
+
+	configFile := filepath.Join(dir, "config.yaml")
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	logFile, err := os.Create(filepath.Join(dir, "restserver.log"))
+	if err != nil {
+		t.Fatalf("failed to create server log: %v", err)
+	}
+
+	cmd := exec.Command(binary, "--config", configFile)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		t.Fatalf("failed to start %s: %v", binary, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(stopTimeout):
+			t.Logf("arrakis server didn't stop in %s, killing it", stopTimeout)
+			cmd.Process.Kill()
+			<-exited
+		}
+		logFile.Close()
+		if t.Failed() {
+			if log, err := os.ReadFile(logFile.Name()); err == nil {
+				t.Logf("arrakis server log:\n%s", log)
+			}
+		}
+	})
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// lockServers waits until no other test on the host runs a server it started, and keeps it that
+// way until the test ends.
+func lockServers(t testing.TB) {
+	t.Helper()
+	lock, err := os.OpenFile(serversLockFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", serversLockFile, err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		t.Fatalf("failed to lock %s: %v", serversLockFile, err)
+	}
+	t.Cleanup(func() {
+		lock.Close()
+	})
+}
+
+// waitHealthy waits until the server answers its health check.
+func (s *Server) waitHealthy(t testing.TB, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, _, err := s.Client.API().V1HealthGet(ctx).Execute()
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("arrakis server at %s isn't healthy after %s: %v", s.Addr, timeout, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// apiError describes a failed request, with the server's error message if it sent one.
+func apiError(httpResp *http.Response, err error) string {
+	if httpResp != nil {
+		var errorResp serverapi.ErrorResponse
+		if json.NewDecoder(httpResp.Body).Decode(&errorResp) == nil && errorResp.Error != nil {
+			return fmt.Sprintf("%s (HTTP %d)", errorResp.Error.GetMessage(), httpResp.StatusCode)
+		}
+	}
+	return err.Error()
+}
+
+// CreateVM starts a VM as `req` says, generating its name if `req` has none, and destroys it when
+// the test ends.
+func (s *Server) CreateVM(t testing.TB, req serverapi.StartVMRequest) *serverapi.StartVMResponse {
+	t.Helper()
+	if req.VmName == nil && req.GenerateName == nil {
+		req.GenerateName = serverapi.PtrString(vmNamePrefix)
+	}
+	resp, httpResp, err := s.Client.API().V1VmsPost(context.Background()).StartVMRequest(req).Execute()
+	if err != nil {
+		t.Fatalf("failed to start VM: %s", apiError(httpResp, err))
+	}
+	vmName := resp.GetVmName()
+	t.Cleanup(func() {
+		_, httpResp, err := s.Client.API().V1VmsNameDelete(context.Background(), vmName).Force(true).Execute()
+		if err != nil && (httpResp == nil || httpResp.StatusCode != http.StatusNotFound) {
+			t.Errorf("failed to destroy VM %s: %s", vmName, apiError(httpResp, err))
+		}
+	})
+	return resp
+}
+
+// Exec runs `cmd` with bash in the VM `vmName` and returns its output and exit code.
+func (s *Server) Exec(t testing.TB, vmName string, cmd string) (string, int) {
+	t.Helper()
+	req := serverapi.NewVmCommandRequest(cmd)
+	req.SetBlocking(true)
+	resp, httpResp, err := s.Client.API().V1VmsNameCmdPost(context.Background(), vmName).VmCommandRequest(*req).Execute()
+	if err != nil {
+		t.Fatalf("failed to run %q in %s: %s", cmd, vmName, apiError(httpResp, err))
+	}
+	return resp.GetOutput(), int(resp.GetExitCode())
+}
+
+// MustExec runs `cmd` like `Exec` and fails the test unless it exits with 0.
+func (s *Server) MustExec(t testing.TB, vmName string, cmd string) string {
+	t.Helper()
+	output, exitCode := s.Exec(t, vmName, cmd)
+	if exitCode != 0 {
+		t.Fatalf("%q in %s exited with %d: %s", cmd, vmName, exitCode, output)
+	}
+	return output
+}
+
+// Events are the server's events from when `Server.Events` was called.
+type Events struct {
+	sub *client.Subscription
+}
+
+// Events follows the server's events until the test ends. Call it before what publishes the
+// events to wait for, which are only those published afterwards.
+func (s *Server) Events(t testing.TB) *Events {
+	t.Helper()
+	sub := s.Client.Subscribe(context.Background(), client.SubscribeOptions{Buffer: events.DefaultSubscriberBuffer})
+	t.Cleanup(sub.Close)
+	return &Events{sub: sub}
+}
+
+// WaitFor returns the next event `match` accepts, failing the test if none comes within `timeout`.
+func (e *Events) WaitFor(t testing.TB, timeout time.Duration, match func(events.Event) bool) events.Event {
+	t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-e.sub.Events():
+			if !ok {
+				t.Fatalf("events stream ended: %v", e.sub.Err())
+			}
+			if match(event) {
+				return event
+			}
+		case <-timer.C:
+			t.Fatalf("no matching event within %s", timeout)
+		}
+	}
+}
+
+// WaitForVM returns the next event of type `eventType`, e.g. `events.VMStarted`, of the VM
+// `vmName`, failing the test if none comes within `timeout`.
+func (e *Events) WaitForVM(t testing.TB, timeout time.Duration, eventType string, vmName string) events.Event {
+	t.Helper()
+	return e.WaitFor(t, timeout, func(event events.Event) bool {
+		return event.Type == eventType && event.VMName == vmName
+	})
+}
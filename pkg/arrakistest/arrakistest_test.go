@@ -0,0 +1,178 @@
+package arrakistest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+func TestStartWithoutServer(t *testing.T) {
+	for _, env := range []string{EnvServer, EnvRestserver, EnvConfig} {
+		t.Setenv(env, "")
+	}
+	var inner *testing.T
+	t.Run("start", func(t *testing.T) {
+		inner = t
+		Start(t, Options{})
+		t.Error("Start returned without a server")
+	})
+	if !inner.Skipped() {
+		t.Error("test without a server wasn't skipped")
+	}
+}
+
+// stubServer answers what the helpers call like a server would, with VMs that run nothing.
+type stubServer struct {
+	lock      sync.Mutex
+	vms       map[string]bool
+	destroyed []string
+	// Names of the VMs started, for the events stream.
+	started chan string
+}
+
+func newStubServer(t *testing.T) (*stubServer, *httptest.Server) {
+	s := &stubServer{vms: make(map[string]bool), started: make(chan string, 16)}
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		writeStubJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/v1/vms", s.startVM).Methods(http.MethodPost)
+	r.HandleFunc("/v1/vms/{name}", s.destroyVM).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/vms/{name}/cmd", s.vmCommand).Methods(http.MethodPost)
+	r.HandleFunc("/v1/events", s.events).Methods(http.MethodGet)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func writeStubJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *stubServer) startVM(w http.ResponseWriter, r *http.Request) {
+	var req serverapi.StartVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStubJSON(w, http.StatusBadRequest, map[string]any{"error": map[string]string{"message": err.Error()}})
+		return
+	}
+	s.lock.Lock()
+	name := req.GetVmName()
+	if name == "" {
+		name = fmt.Sprintf("%s%d", req.GetGenerateName(), len(s.vms))
+	}
+	s.vms[name] = true
+	s.lock.Unlock()
+	s.started <- name
+	writeStubJSON(w, http.StatusOK, serverapi.StartVMResponse{VmName: serverapi.PtrString(name)})
+}
+
+func (s *stubServer) destroyVM(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name := mux.Vars(r)["name"]
+	if !s.vms[name] {
+		writeStubJSON(w, http.StatusNotFound, map[string]any{"error": map[string]string{"message": "VM not found"}})
+		return
+	}
+	delete(s.vms, name)
+	s.destroyed = append(s.destroyed, name)
+	writeStubJSON(w, http.StatusOK, serverapi.VMResponse{})
+}
+
+// vmCommand answers commands that are a number with it as their exit code, and echoes them.
+func (s *stubServer) vmCommand(w http.ResponseWriter, r *http.Request) {
+	var req serverapi.VmCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStubJSON(w, http.StatusBadRequest, map[string]any{"error": map[string]string{"message": err.Error()}})
+		return
+	}
+	var exitCode int32
+	fmt.Sscan(req.Cmd, &exitCode)
+	writeStubJSON(w, http.StatusOK, serverapi.VmCommandResponse{
+		Output:   serverapi.PtrString(req.Cmd + "\n"),
+		ExitCode: serverapi.PtrInt32(exitCode),
+	})
+}
+
+func (s *stubServer) events(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for id := uint64(1); ; id++ {
+		select {
+		case <-r.Context().Done():
+			return
+		case name := <-s.started:
+			data, _ := json.Marshal(events.Event{ID: id, Time: time.Now(), Type: events.VMStarted, VMName: name})
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, events.VMStarted, data)
+			rc.Flush()
+		}
+	}
+}
+
+func TestServerHelpers(t *testing.T) {
+	stub, server := newStubServer(t)
+	var vmName string
+	t.Run("test", func(t *testing.T) {
+		s := Start(t, Options{ServerAddr: strings.TrimPrefix(server.URL, "http://")})
+		if s.Fake {
+			t.Error("running server is fake")
+		}
+		evs := s.Events(t)
+		vm := s.CreateVM(t, serverapi.StartVMRequest{})
+		vmName = vm.GetVmName()
+		if !strings.HasPrefix(vmName, vmNamePrefix) {
+			t.Errorf("VM name %q doesn't have the prefix %q", vmName, vmNamePrefix)
+		}
+		evs.WaitForVM(t, 10*time.Second, events.VMStarted, vmName)
+
+		if out := s.MustExec(t, vmName, "0"); out != "0\n" {
+			t.Errorf("MustExec() = %q", out)
+		}
+		if out, exitCode := s.Exec(t, vmName, "3"); out != "3\n" || exitCode != 3 {
+			t.Errorf("Exec() = %q, %d", out, exitCode)
+		}
+	})
+
+	// The VM is destroyed once the test ended.
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	if len(stub.destroyed) != 1 || stub.destroyed[0] != vmName {
+		t.Errorf("destroyed VMs %v, want %s", stub.destroyed, vmName)
+	}
+}
+
+func TestStartFake(t *testing.T) {
+	s := Start(t, Options{Fake: true})
+	if !s.Fake {
+		t.Error("server started with Options.Fake isn't fake")
+	}
+	evs := s.Events(t)
+	vm := s.CreateVM(t, serverapi.StartVMRequest{})
+	evs.WaitForVM(t, time.Minute, events.VMStarted, vm.GetVmName())
+
+	if out := s.MustExec(t, vm.GetVmName(), "hostname"); strings.TrimSpace(out) != vm.GetVmName() {
+		t.Errorf("hostname = %q, want %q", out, vm.GetVmName())
+	}
+	if out := s.MustExec(t, vm.GetVmName(), "ip -4 -o addr show eth0"); !strings.Contains(out, vm.GetIp()) {
+		t.Errorf("eth0 doesn't have the VM's IP %s: %s", vm.GetIp(), out)
+	}
+	// The host's file system is read-only, but for the guest's own directories.
+	if out, exitCode := s.Exec(t, vm.GetVmName(), "touch /usr/arrakistest"); exitCode == 0 {
+		t.Errorf("guest wrote to the host's /usr: %s", out)
+	}
+	s.MustExec(t, vm.GetVmName(), "echo ok > /tmp/arrakistest && echo ok > /etc/arrakistest")
+}
@@ -0,0 +1,26 @@
+package arrakistest_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/arrakistest"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// A test that runs a command in a VM of the server at $ARRAKIS_TEST_SERVER, or of one started on
+// fakevmm without it.
+func Example() {
+	testBuild := func(t *testing.T) {
+		s := arrakistest.Start(t, arrakistest.Options{Fake: true})
+		evs := s.Events(t)
+		vm := s.CreateVM(t, serverapi.StartVMRequest{})
+		evs.WaitForVM(t, time.Minute, events.VMStarted, vm.GetVmName())
+		if out := s.MustExec(t, vm.GetVmName(), "uname -s"); !strings.HasPrefix(out, "Linux") {
+			t.Fatalf("unexpected output %q", out)
+		}
+	}
+	_ = testBuild
+}
@@ -0,0 +1,123 @@
+package arrakistest
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Servers started with `Options.Fake` share this bridge and subnet, which are kept for the
+	// next one once they stop.
+	fakeBridgeName   = "arrakistest0"
+	fakeBridgeIP     = "10.234.0.1/24"
+	fakeBridgeSubnet = "10.234.0.0/24"
+
+	modulePath = "github.com/abilashraghuram/arrakis"
+)
+
+// Config of servers started with `Options.Fake` without a config file. What `startFake` sets is
+// left out.
+const fakeConfig = `
+hostservices:
+  restserver:
+    stateful_size_in_mb: "64"
+    guest_mem_percentage: "30"
+    templates:
+      default: {}
+    events:
+      history: 1000
+      subscriber_buffer: 256
+`
+
+// fakeMissing returns why a server can't be started with `Options.Fake`, or "" if it can.
+func fakeMissing(opts Options) string {
+	if reason := toolsMissing(); reason != "" {
+		return reason
+	}
+	tun, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Sprintf("fakevmm needs tap devices: %v", err)
+	}
+	tun.Close()
+	if opts.Restserver == "" || opts.FakeVMM == "" {
+		if _, err := exec.LookPath("go"); err != nil {
+			return "building the server needs go"
+		}
+	}
+	return ""
+}
+
+// startFake starts a server whose hypervisor is fakevmm, building what `opts` doesn't have, and
+// returns its address.
+func startFake(t testing.TB, opts Options) string {
+	t.Helper()
+	dir := t.TempDir()
+	restserver := opts.Restserver
+	if restserver == "" {
+		restserver = build(t, dir, "arrakis-restserver", "cmd/restserver")
+	}
+	fakeVMM := opts.FakeVMM
+	if fakeVMM == "" {
+		build(t, dir, "arrakis-cmdserver", "cmd/cmdserver")
+		fakeVMM = build(t, dir, "arrakis-fakevmm", "cmd/fakevmm")
+	}
+	fakeVMM, err := filepath.Abs(fakeVMM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg map[string]any
+	if opts.ConfigFile != "" {
+		cfg = readConfig(t, opts.ConfigFile)
+	} else if err := yaml.Unmarshal([]byte(fakeConfig), &cfg); err != nil {
+		t.Fatalf("invalid fake config: %v", err)
+	}
+	serverConfig := restserverConfig(t, cfg)
+	serverConfig["chv_bin"] = fakeVMM
+	// fakevmm doesn't read them, but the server checks they're there.
+	images := map[string]string{}
+	for _, key := range []string{"kernel", "initramfs", "rootfs"} {
+		images[key] = filepath.Join(dir, key)
+		if err := os.WriteFile(images[key], nil, 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", key, err)
+		}
+		serverConfig[key] = images[key]
+	}
+	templates, _ := serverConfig["templates"].(map[string]any)
+	for _, tmpl := range templates {
+		tmpl, _ := tmpl.(map[string]any)
+		for key, image := range images {
+			if _, ok := tmpl[key]; ok {
+				tmpl[key] = image
+			}
+		}
+	}
+	serverConfig["bridge_name"] = fakeBridgeName
+	serverConfig["bridge_ip"] = fakeBridgeIP
+	serverConfig["bridge_subnet"] = fakeBridgeSubnet
+	// Pools and network modes of the config would be outside the bridge's subnet.
+	delete(serverConfig, "ipam")
+	delete(serverConfig, "network_modes")
+	// fakevmm needs to create namespaces.
+	serverConfig["jailer"] = map[string]any{"enabled": false}
+	serverConfig["hypervisor_sandbox"] = map[string]any{"seccomp": "false"}
+	return startRestserver(t, restserver, cfg)
+}
+
+// build builds the command of the package `pkg` of the module as `name` in `dir` and returns
+// its path.
+func build(t testing.TB, dir string, name string, pkg string) string {
+	t.Helper()
+	binary := filepath.Join(dir, name)
+	cmd := exec.Command("go", "build", "-o", binary, modulePath+"/"+pkg)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build %s: %s %v", name, output, err)
+	}
+	return binary
+}
@@ -0,0 +1,129 @@
+// Package auth authenticates API clients by key and carries the result through request contexts.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// Permissions an API key can be granted.
+const (
+	// List and inspect VMs, download and search files, watch events.
+	PermissionRead = "read"
+	// Start, change and destroy VMs, run commands, upload files.
+	PermissionWrite = "write"
+	// Act on VMs owned by other keys, use the /v1/admin endpoints.
+	PermissionAdmin = "admin"
+)
+
+var allPermissions = []string{PermissionRead, PermissionWrite, PermissionAdmin}
+
+// ValidatePermissions returns an error if `permissions` is empty or has an unknown permission.
+func ValidatePermissions(permissions []string) error {
+	if len(permissions) == 0 {
+		return fmt.Errorf("at least one permission is required")
+	}
+	for _, p := range permissions {
+		if !slices.Contains(allPermissions, p) {
+			return fmt.Errorf("unknown permission %q, must be one of %v", p, allPermissions)
+		}
+	}
+	return nil
+}
+
+// Identity is an authenticated API client.
+type Identity struct {
+	// Name of the API key, recorded as the owner of the VMs it creates.
+	Name string
+	// Identifies the API key itself, which a new key with the same name doesn't share. Empty for
+	// OIDC tokens.
+	KeyID       string
+	Permissions []string
+	// Namespaces the key may use, all of them if empty.
+	Namespaces []string
+}
+
+// Has returns true if `id` was granted `permission`. Admins have every permission.
+func (id *Identity) Has(permission string) bool {
+	return id == nil || slices.Contains(id.Permissions, permission) || slices.Contains(id.Permissions, PermissionAdmin)
+}
+
+// CanUseNamespace returns true if `id` may use VMs in `namespace`.
+func (id *Identity) CanUseNamespace(namespace string) bool {
+	return id == nil || len(id.Namespaces) == 0 || slices.Contains(id.Namespaces, namespace)
+}
+
+// CanActOn returns true if `id` may change a resource owned by `owner`. Everyone can when
+// authentication is disabled.
+func (id *Identity) CanActOn(owner string) bool {
+	return id == nil || id.Has(PermissionAdmin) || (owner != "" && owner == id.Name)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of `ctx` carrying `id`.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity of the caller, or nil if authentication is disabled.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// KeyFromRequest returns the API key sent with `r` as a bearer token or in the X-API-Key header.
+// Browsers can't set headers on WebSocket upgrades, so those may pass it as the access_token query
+// parameter instead.
+func KeyFromRequest(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// Authenticate returns the identity of the API key `key`, or false if it's not one of `keys`. Keys
+// from the config file can use every namespace.
+func Authenticate(keys []config.APIKeyConfig, key string) (*Identity, bool) {
+	if key == "" {
+		return nil, false
+	}
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return configIdentity(k), true
+		}
+	}
+	return nil, false
+}
+
+// IdentityByKeyID returns the identity of the key in `keys` with the ID `keyID`.
+func IdentityByKeyID(keys []config.APIKeyConfig, keyID string) (*Identity, bool) {
+	for _, k := range keys {
+		if id := configIdentity(k); id.KeyID == keyID {
+			return id, true
+		}
+	}
+	return nil, false
+}
+
+func configIdentity(k config.APIKeyConfig) *Identity {
+	permissions := []string{PermissionRead, PermissionWrite}
+	if k.Admin {
+		permissions = append(permissions, PermissionAdmin)
+	}
+	// Keys in the config have no ID of their own. A prefix of their hash changes with the key but
+	// doesn't give it away.
+	return &Identity{Name: k.Name, KeyID: "config-" + hashKey(k.Key)[:16], Permissions: permissions}
+}
@@ -0,0 +1,477 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// OIDCNamePrefix starts the names of identities from OIDC tokens, so that users can't collide
+// with API keys.
+const OIDCNamePrefix = "oidc:"
+
+const (
+	defaultJWKSRefresh = time.Hour
+	// Tokens signed with an unknown key trigger at most one fetch this often, so that junk tokens
+	// can't hammer the provider.
+	minJWKSRefresh = time.Minute
+	// Allowed clock skew between us and the provider.
+	clockSkew     = time.Minute
+	fetchTimeout  = 10 * time.Second
+	maxJWKSLength = 1 << 20
+)
+
+var ErrTokenInvalid = errors.New("invalid token")
+
+// LooksLikeJWT returns true if `token` has the shape of a JWT, as opposed to an API key.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// OIDCVerifier validates tokens issued by an OpenID Connect provider and maps their claims to an
+// identity.
+type OIDCVerifier struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+
+	lock sync.Mutex
+	// Keyed by "kid".
+	keys      map[string]jsonWebKey
+	fetchedAt time.Time
+	// The fetch of the provider's keys in progress, if any.
+	fetch *keysFetch
+}
+
+// jsonWebKey is one of the provider's signing keys.
+type jsonWebKey struct {
+	key crypto.PublicKey
+	// The algorithm the provider signs with the key, if it says.
+	alg string
+}
+
+// keysFetch is a fetch of the provider's keys, which requests needing them while it's in progress
+// wait for instead of starting their own.
+type keysFetch struct {
+	done chan struct{}
+	// Set before `done` is closed.
+	err error
+}
+
+// signingAlgorithms are the algorithms tokens can be signed with, with their hash and, for ECDSA,
+// the curve their keys must be on. Anything else, e.g. "none" or HMAC, is rejected.
+var signingAlgorithms = map[string]struct {
+	hash  crypto.Hash
+	curve elliptic.Curve
+}{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// NewOIDCVerifier returns a verifier for `cfg`. Signing keys are fetched on first use, so the
+// provider being down doesn't stop the server from starting.
+func NewOIDCVerifier(cfg config.OIDCConfig) *OIDCVerifier {
+	if cfg.JWKSRefresh <= 0 {
+		cfg.JWKSRefresh = defaultJWKSRefresh
+	}
+	if cfg.NameClaim == "" {
+		cfg.NameClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	return &OIDCVerifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+// Config returns the config `v` was created with.
+func (v *OIDCVerifier) Config() config.OIDCConfig {
+	return v.cfg
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks the signature, issuer, audience and lifetime of `token` and returns the identity
+// its claims map to.
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return v.identity(claims)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (v *OIDCVerifier) checkClaims(claims map[string]any, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return fmt.Errorf("%w: issuer %q", ErrTokenInvalid, iss)
+	}
+	if !slices.Contains(stringsClaim(claims, "aud"), v.cfg.Audience) {
+		return fmt.Errorf("%w: audience not accepted", ErrTokenInvalid)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", ErrTokenInvalid)
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("%w: expired", ErrTokenInvalid)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrTokenInvalid)
+	}
+	return nil
+}
+
+func (v *OIDCVerifier) identity(claims map[string]any) (*Identity, error) {
+	name, _ := claim(claims, v.cfg.NameClaim).(string)
+	if name == "" {
+		return nil, fmt.Errorf("%w: no %s claim", ErrTokenInvalid, v.cfg.NameClaim)
+	}
+
+	var permissions []string
+	roles := stringsClaim(claims, v.cfg.RolesClaim)
+	for _, role := range v.cfg.Roles {
+		if !slices.Contains(roles, role.Role) {
+			continue
+		}
+		for _, p := range role.Permissions {
+			if !slices.Contains(permissions, p) {
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	if len(permissions) == 0 {
+		return nil, fmt.Errorf("%w: no role grants a permission", ErrTokenInvalid)
+	}
+
+	var namespaces []string
+	if v.cfg.NamespacesClaim != "" {
+		namespaces = stringsClaim(claims, v.cfg.NamespacesClaim)
+		if len(namespaces) == 0 {
+			return nil, fmt.Errorf("%w: no %s claim", ErrTokenInvalid, v.cfg.NamespacesClaim)
+		}
+	}
+	return &Identity{Name: OIDCNamePrefix + name, Permissions: permissions, Namespaces: namespaces}, nil
+}
+
+// claim returns the claim at the dotted `path`, e.g. "realm_access.roles".
+func claim(claims map[string]any, path string) any {
+	var value any = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+// stringsClaim returns the claim at `path` as a list, which providers send either as a single
+// string or an array.
+func stringsClaim(claims map[string]any, path string) []string {
+	switch value := claim(claims, path).(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var result []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// verifySignature checks `signature` of `signed`, which the token's header says is made with `alg`.
+// The algorithm must be the one the key is for: its type, its curve and, if the provider names
+// one, its "alg".
+func verifySignature(alg string, key jsonWebKey, signed string, signature []byte) error {
+	algorithm, ok := signingAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrTokenInvalid, alg)
+	}
+	if key.alg != "" && key.alg != alg {
+		return fmt.Errorf("%w: signing key is for %s, not %s", ErrTokenInvalid, key.alg, alg)
+	}
+	h := algorithm.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.key.(type) {
+	case *rsa.PublicKey:
+		if algorithm.curve != nil {
+			return fmt.Errorf("%w: %s with an RSA key", ErrTokenInvalid, alg)
+		}
+		if rsa.VerifyPKCS1v15(key, algorithm.hash, digest, signature) != nil {
+			return fmt.Errorf("%w: bad signature", ErrTokenInvalid)
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != algorithm.curve {
+			return fmt.Errorf("%w: %s with a %s key", ErrTokenInvalid, alg, key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("%w: bad signature", ErrTokenInvalid)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", ErrTokenInvalid)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key type", ErrTokenInvalid)
+	}
+	return nil
+}
+
+// key returns the signing key `kid`, fetching the provider's keys if they are stale or don't
+// include it.
+func (v *OIDCVerifier) key(ctx context.Context, kid string) (jsonWebKey, error) {
+	v.lock.Lock()
+	key, ok := v.lookupLocked(kid)
+	since := time.Since(v.fetchedAt)
+	if (ok && since < v.cfg.JWKSRefresh) || (!ok && since < minJWKSRefresh) {
+		v.lock.Unlock()
+		if !ok {
+			return jsonWebKey{}, fmt.Errorf("%w: unknown signing key %q", ErrTokenInvalid, kid)
+		}
+		return key, nil
+	}
+
+	// Fetch without holding the lock, so that a slow provider only holds up the requests that
+	// need new keys, and those share a single fetch.
+	fetch := v.fetch
+	if fetch == nil {
+		fetch = &keysFetch{done: make(chan struct{})}
+		v.fetch = fetch
+		v.lock.Unlock()
+
+		keys, err := v.fetchKeys(ctx)
+
+		v.lock.Lock()
+		if err != nil {
+			log.WithError(err).WithField("issuer", v.cfg.Issuer).Warn("failed to fetch oidc signing keys")
+		} else {
+			v.keys = keys
+			v.fetchedAt = time.Now()
+		}
+		fetch.err = err
+		v.fetch = nil
+		close(fetch.done)
+	} else {
+		v.lock.Unlock()
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return jsonWebKey{}, ctx.Err()
+		}
+		v.lock.Lock()
+	}
+	defer v.lock.Unlock()
+
+	key, ok = v.lookupLocked(kid)
+	if fetch.err != nil {
+		// Keep using the keys we have rather than locking everyone out while the provider is down.
+		if ok {
+			return key, nil
+		}
+		return jsonWebKey{}, fmt.Errorf("failed to fetch oidc signing keys: %w", fetch.err)
+	}
+	if !ok {
+		return jsonWebKey{}, fmt.Errorf("%w: unknown signing key %q", ErrTokenInvalid, kid)
+	}
+	return key, nil
+}
+
+// lookupLocked returns the key `kid`. Tokens without a "kid" can only be matched if the provider
+// has a single key.
+func (v *OIDCVerifier) lookupLocked(kid string) (jsonWebKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func (v *OIDCVerifier) getJSON(ctx context.Context, url string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxJWKSLength)).Decode(result)
+}
+
+func (v *OIDCVerifier) fetchKeys(ctx context.Context) (map[string]jsonWebKey, error) {
+	// Don't let a client that hangs up abort a fetch everyone else is waiting on.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+	defer cancel()
+
+	jwksURL := v.cfg.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err := v.getJSON(ctx, strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != v.cfg.Issuer {
+			return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]jsonWebKey)
+	for _, raw := range jwks.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			// Providers publish keys for other uses too, e.g. encryption.
+			log.WithError(err).Debug("skipping oidc signing key")
+			continue
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys at %s", jwksURL)
+	}
+	return keys, nil
+}
+
+func parseJWK(raw json.RawMessage) (string, jsonWebKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", jsonWebKey{}, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", jsonWebKey{}, fmt.Errorf("key %q is for %q", jwk.Kid, jwk.Use)
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return "", jsonWebKey{}, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return "", jsonWebKey{}, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31 {
+			return "", jsonWebKey{}, fmt.Errorf("key %q has an invalid exponent", jwk.Kid)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		return jwk.Kid, jsonWebKey{key: key, alg: jwk.Alg}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", jsonWebKey{}, fmt.Errorf("key %q has unsupported curve %q", jwk.Kid, jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return "", jsonWebKey{}, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return "", jsonWebKey{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return "", jsonWebKey{}, fmt.Errorf("key %q is not on its curve", jwk.Kid)
+		}
+		return jwk.Kid, jsonWebKey{key: key, alg: jwk.Alg}, nil
+	}
+	return "", jsonWebKey{}, fmt.Errorf("key %q has unsupported type %q", jwk.Kid, jwk.Kty)
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "arrakis"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testP256Key   = mustECKey(elliptic.P256())
+	testP384Key   = mustECKey(elliptic.P384())
+)
+
+func mustECKey(curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// rsaJWK and ecJWK return the JWK of the public half of `key`, with the "alg" `alg` if it's set.
+func rsaJWK(kid string, alg string, key *rsa.PrivateKey) map[string]string {
+	jwk := map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   b64(key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+	}
+	if alg != "" {
+		jwk["alg"] = alg
+	}
+	return jwk
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": key.Curve.Params().Name,
+		"x":   b64(key.X.FillBytes(make([]byte, size))),
+		"y":   b64(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// signToken returns a token with `claims` whose header says `alg` and `kid`, signed with `key`: an
+// RSA or ECDSA key, an HMAC secret, or nil for no signature.
+func signToken(t *testing.T, alg string, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header := map[string]string{"alg": alg}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		hash = crypto.SHA256
+	}
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		d := hash.New()
+		d.Write([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, d.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		d := hash.New()
+		d.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, d.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + b64(signature)
+}
+
+// startJWKS serves `keys` as a JWKS and returns its URL and how often it was fetched.
+func startJWKS(t *testing.T, keys ...map[string]string) (string, *atomic.Int32) {
+	t.Helper()
+	fetches := new(atomic.Int32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, fetches
+}
+
+func testClaims() map[string]any {
+	return map[string]any{
+		"iss":   testIssuer,
+		"aud":   []string{"other", testAudience},
+		"sub":   "alice",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{"dev"},
+	}
+}
+
+func newTestVerifier(jwksURL string) *OIDCVerifier {
+	return NewOIDCVerifier(config.OIDCConfig{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSURL:  jwksURL,
+		Roles:    []config.OIDCRoleConfig{{Role: "dev", Permissions: []string{PermissionRead, PermissionWrite}}},
+	})
+}
+
+func TestOIDCVerifyAlgorithms(t *testing.T) {
+	jwksURL, _ := startJWKS(t,
+		rsaJWK("rsa", "", testRSAKey),
+		rsaJWK("rsa-rs512", "RS512", testRSAKey),
+		ecJWK("p256", testP256Key),
+		ecJWK("p384", testP384Key),
+		// An HMAC key must never be accepted, whatever a token says.
+		map[string]string{"kty": "oct", "kid": "hmac", "k": b64([]byte("secret"))},
+		// Nor one that isn't for signatures.
+		func() map[string]string {
+			jwk := rsaJWK("enc", "", testRSAKey)
+			jwk["use"] = "enc"
+			return jwk
+		}(),
+	)
+	v := newTestVerifier(jwksURL)
+
+	tests := []struct {
+		name  string
+		alg   string
+		kid   string
+		key   any
+		valid bool
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa", key: testRSAKey, valid: true},
+		{name: "RS384", alg: "RS384", kid: "rsa", key: testRSAKey, valid: true},
+		{name: "RS512 with its alg", alg: "RS512", kid: "rsa-rs512", key: testRSAKey, valid: true},
+		{name: "RS256 with a key for RS512", alg: "RS256", kid: "rsa-rs512", key: testRSAKey},
+		{name: "ES256", alg: "ES256", kid: "p256", key: testP256Key, valid: true},
+		{name: "ES384", alg: "ES384", kid: "p384", key: testP384Key, valid: true},
+		{name: "ES384 with a P-256 key", alg: "ES384", kid: "p256", key: testP256Key},
+		{name: "ES256 with an RSA key", alg: "ES256", kid: "rsa", key: testP256Key},
+		{name: "RS256 with an EC key", alg: "RS256", kid: "p256", key: testRSAKey},
+		{name: "none", alg: "none", kid: "rsa", key: nil},
+		{name: "HS256 keyed with the public key", alg: "HS256", kid: "rsa", key: testRSAKey.N.Bytes()},
+		{name: "HS256 with an HMAC key", alg: "HS256", kid: "hmac", key: []byte("secret")},
+		{name: "encryption key", alg: "RS256", kid: "enc", key: testRSAKey},
+		{name: "unknown kid", alg: "RS256", kid: "nope", key: testRSAKey},
+		{name: "no kid with several keys", alg: "RS256", key: testRSAKey},
+		{name: "signed with another key", alg: "ES256", kid: "p256", key: mustECKey(elliptic.P256())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := v.Verify(context.Background(), signToken(t, tt.alg, tt.kid, tt.key, testClaims()))
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("Verify() = %+v, want an error", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if id.Name != OIDCNamePrefix+"alice" || id.KeyID != "" {
+				t.Errorf("Verify() = %+v, want oidc:alice without a key ID", id)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifySingleKeyWithoutKid(t *testing.T) {
+	jwksURL, _ := startJWKS(t, rsaJWK("only", "RS256", testRSAKey))
+	v := newTestVerifier(jwksURL)
+	if _, err := v.Verify(context.Background(), signToken(t, "RS256", "", testRSAKey, testClaims())); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestOIDCVerifyClaims(t *testing.T) {
+	jwksURL, _ := startJWKS(t, rsaJWK("rsa", "RS256", testRSAKey))
+	v := newTestVerifier(jwksURL)
+
+	tests := []struct {
+		name            string
+		change          func(claims map[string]any)
+		wantPermissions []string
+		wantErr         bool
+	}{
+		{name: "valid", change: func(map[string]any) {}, wantPermissions: []string{PermissionRead, PermissionWrite}},
+		{name: "other issuer", change: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "other audience", change: func(c map[string]any) { c["aud"] = "other" }, wantErr: true},
+		{name: "audience as a string", change: func(c map[string]any) { c["aud"] = testAudience }, wantPermissions: []string{PermissionRead, PermissionWrite}},
+		{name: "expired", change: func(c map[string]any) { c["exp"] = time.Now().Add(-2 * clockSkew).Unix() }, wantErr: true},
+		{name: "expired within skew", change: func(c map[string]any) { c["exp"] = time.Now().Add(-clockSkew / 2).Unix() }, wantPermissions: []string{PermissionRead, PermissionWrite}},
+		{name: "no expiry", change: func(c map[string]any) { delete(c, "exp") }, wantErr: true},
+		{name: "not valid yet", change: func(c map[string]any) { c["nbf"] = time.Now().Add(2 * clockSkew).Unix() }, wantErr: true},
+		{name: "no subject", change: func(c map[string]any) { delete(c, "sub") }, wantErr: true},
+		{name: "no matching role", change: func(c map[string]any) { c["roles"] = []string{"ops"} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testClaims()
+			tt.change(claims)
+			id, err := v.Verify(context.Background(), signToken(t, "RS256", "rsa", testRSAKey, claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Verify() = %+v, want an error", id)
+				}
+				if !errors.Is(err, ErrTokenInvalid) {
+					t.Errorf("Verify() error = %v, want ErrTokenInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if !slices.Equal(id.Permissions, tt.wantPermissions) {
+				t.Errorf("Verify() permissions = %v, want %v", id.Permissions, tt.wantPermissions)
+			}
+		})
+	}
+}
+
+func TestOIDCUnknownKidFetchesOnce(t *testing.T) {
+	jwksURL, fetches := startJWKS(t, rsaJWK("rsa", "RS256", testRSAKey))
+	v := newTestVerifier(jwksURL)
+	ctx := context.Background()
+
+	if _, err := v.Verify(ctx, signToken(t, "RS256", "rsa", testRSAKey, testClaims())); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	// Unknown keys only trigger a fetch every minJWKSRefresh, so junk tokens can't hammer the
+	// provider.
+	for range 3 {
+		if _, err := v.Verify(ctx, signToken(t, "RS256", "junk", testRSAKey, testClaims())); !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("Verify() error = %v, want ErrTokenInvalid", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched the JWKS %d times, want 1", n)
+	}
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters added to signed URLs.
+const (
+	SignatureParam = "signature"
+	expiresParam   = "expires"
+	keyIDParam     = "keyId"
+)
+
+var (
+	ErrSignatureInvalid = errors.New("invalid url signature")
+	ErrSignatureExpired = errors.New("signed url expired")
+)
+
+// URLSigner signs URLs so that they can be used without an API key until they expire.
+type URLSigner struct {
+	secret []byte
+}
+
+// NewURLSigner creates a signer using the key in `path`, generating one if the file doesn't
+// exist. Keeping the key across restarts keeps issued URLs valid.
+func NewURLSigner(path string) (*URLSigner, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		secret, err := randomHex(32)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(secret), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write url signing key: %w", err)
+		}
+		data = []byte(secret)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read url signing key: %w", err)
+	}
+
+	secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) < 16 {
+		return nil, fmt.Errorf("invalid url signing key in %s", path)
+	}
+	return &URLSigner{secret: secret}, nil
+}
+
+// signature returns the signature of a request for `method` and `path` with the query `query`,
+// which must include the expiry and key ID but not the signature.
+func (s *URLSigner) signature(method string, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.secret)
+	// `Encode` sorts by key, so the order parameters come in doesn't matter.
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, path, query.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns `u` with the parameters that let the API key with the ID `keyID` share it for
+// `method` requests until `expires`.
+func (s *URLSigner) Sign(method string, u *url.URL, keyID string, expires time.Time) *url.URL {
+	query := u.Query()
+	query.Del(SignatureParam)
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(keyIDParam, keyID)
+	query.Set(SignatureParam, s.signature(method, u.Path, query))
+
+	signed := *u
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+// Verify checks the signature of a `method` request for `u` and returns the ID of the API key
+// that signed it.
+func (s *URLSigner) Verify(method string, u *url.URL, now time.Time) (string, error) {
+	query := u.Query()
+	signature := query.Get(SignatureParam)
+	query.Del(SignatureParam)
+	expected := s.signature(method, u.Path, query)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", ErrSignatureInvalid
+	}
+
+	expires, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil {
+		return "", ErrSignatureInvalid
+	}
+	if now.Unix() > expires {
+		return "", ErrSignatureExpired
+	}
+	return query.Get(keyIDParam), nil
+}
+
+// ReadOnly returns a copy of `id` that only has the read permission, or nil if `id` doesn't have
+// it. Signed URLs act with it.
+func (id *Identity) ReadOnly() *Identity {
+	if !id.Has(PermissionRead) {
+		return nil
+	}
+	return &Identity{Name: id.Name, KeyID: id.KeyID, Permissions: []string{PermissionRead}, Namespaces: id.Namespaces}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) *URLSigner {
+	t.Helper()
+	s, err := NewURLSigner(filepath.Join(t.TempDir(), "url-signing-key"))
+	if err != nil {
+		t.Fatalf("NewURLSigner: %v", err)
+	}
+	return s
+}
+
+func TestURLSignerVerify(t *testing.T) {
+	signer := newTestSigner(t)
+	now := time.Unix(1_700_000_000, 0)
+	u, _ := url.Parse("/v1/vms/foo/files?paths=/out.log")
+	signed := signer.Sign(http.MethodGet, u, "key-1", now.Add(time.Minute))
+
+	// change returns a copy of the signed URL changed by `f`.
+	change := func(f func(u *url.URL, q url.Values)) *url.URL {
+		c := *signed
+		q := c.Query()
+		f(&c, q)
+		c.RawQuery = q.Encode()
+		return &c
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		u       *url.URL
+		now     time.Time
+		keyID   string
+		wantErr error
+	}{
+		{name: "valid", method: http.MethodGet, u: signed, now: now, keyID: "key-1"},
+		{name: "at expiry", method: http.MethodGet, u: signed, now: now.Add(time.Minute), keyID: "key-1"},
+		{name: "expired", method: http.MethodGet, u: signed, now: now.Add(time.Minute + time.Second), wantErr: ErrSignatureExpired},
+		{name: "other method", method: http.MethodPost, u: signed, now: now, wantErr: ErrSignatureInvalid},
+		{
+			name:    "other path",
+			method:  http.MethodGet,
+			u:       change(func(u *url.URL, q url.Values) { u.Path = "/v1/vms/bar/files" }),
+			now:     now,
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "changed query",
+			method:  http.MethodGet,
+			u:       change(func(u *url.URL, q url.Values) { q.Set("paths", "/etc/shadow") }),
+			now:     now,
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "added query",
+			method:  http.MethodGet,
+			u:       change(func(u *url.URL, q url.Values) { q.Add("paths", "/etc/shadow") }),
+			now:     now,
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "extended expiry",
+			method:  http.MethodGet,
+			u:       change(func(u *url.URL, q url.Values) { q.Set(expiresParam, "99999999999") }),
+			now:     now,
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "other key",
+			method:  http.MethodGet,
+			u:       change(func(u *url.URL, q url.Values) { q.Set(keyIDParam, "key-2") }),
+			now:     now,
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "no signature",
+			method:  http.MethodGet,
+			u:       change(func(u *url.URL, q url.Values) { q.Del(SignatureParam) }),
+			now:     now,
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:   "reordered query",
+			method: http.MethodGet,
+			u: func() *url.URL {
+				c := *signed
+				c.RawQuery = SignatureParam + "=" + signed.Query().Get(SignatureParam) + "&" + keyIDParam + "=key-1&" +
+					expiresParam + "=" + signed.Query().Get(expiresParam) + "&paths=%2Fout.log"
+				return &c
+			}(),
+			now:   now,
+			keyID: "key-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyID, err := signer.Verify(tt.method, tt.u, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if keyID != tt.keyID {
+				t.Errorf("Verify() = %q, want %q", keyID, tt.keyID)
+			}
+		})
+	}
+}
+
+func TestURLSignerKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "url-signing-key")
+	old, err := NewURLSigner(path)
+	if err != nil {
+		t.Fatalf("NewURLSigner: %v", err)
+	}
+	now := time.Now()
+	u, _ := url.Parse("/v1/vms/foo/logs")
+	signed := old.Sign(http.MethodGet, u, "key-1", now.Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		rotate  bool
+		wantErr error
+	}{
+		{name: "same key file", wantErr: nil},
+		{name: "rotated key file", rotate: true, wantErr: ErrSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rotate {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Like a server restarting.
+			signer, err := NewURLSigner(path)
+			if err != nil {
+				t.Fatalf("NewURLSigner: %v", err)
+			}
+			if _, err := signer.Verify(http.MethodGet, signed, now); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewURLSignerInvalidKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "not hex", key: "not a key"},
+		{name: "too short", key: "00112233445566778899aabbccddee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "url-signing-key")
+			if err := os.WriteFile(path, []byte(tt.key), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewURLSigner(path); err == nil {
+				t.Error("NewURLSigner() succeeded with an invalid key")
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Prefix of generated keys, to make them easy to spot in logs and secret scanners.
+const keyPrefix = "ak_"
+
+var (
+	ErrKeyNotFound = errors.New("api key not found")
+	ErrNameInUse   = errors.New("api key name in use")
+)
+
+// StoredKey is an API key managed through the API. Only a hash of the key itself is kept.
+type StoredKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	KeyHash     string     `json:"keyHash"`
+	Permissions []string   `json:"permissions"`
+	Namespaces  []string   `json:"namespaces,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k *StoredKey) identity() *Identity {
+	return &Identity{Name: k.Name, KeyID: k.ID, Permissions: k.Permissions, Namespaces: k.Namespaces}
+}
+
+// Store keeps API keys in a JSON file so that they survive restarts.
+type Store struct {
+	lock sync.Mutex
+	path string
+	keys []StoredKey
+}
+
+// NewStore loads the keys in `path`. A missing file is an empty store.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api key store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse api key store: %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// saveLocked writes the keys out. The file is replaced atomically so that a crash can't leave a
+// truncated store behind.
+func (s *Store) saveLocked() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save api key store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save api key store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save api key store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save api key store: %w", err)
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findLocked returns the index of the key with `id`, or -1.
+func (s *Store) findLocked(id string) int {
+	return slices.IndexFunc(s.keys, func(k StoredKey) bool { return k.ID == id })
+}
+
+// Create adds a key and returns it along with the secret to hand to the client, which can't be
+// recovered later. Names must be unique among keys that aren't revoked, reusing the name of a
+// revoked key keeps its VMs with the new key.
+func (s *Store) Create(name string, permissions []string, namespaces []string) (StoredKey, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return StoredKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return StoredKey{}, "", err
+	}
+	secret = keyPrefix + secret
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, k := range s.keys {
+		if k.Name == name && k.RevokedAt == nil {
+			return StoredKey{}, "", ErrNameInUse
+		}
+	}
+	key := StoredKey{
+		ID:          id,
+		Name:        name,
+		KeyHash:     hashKey(secret),
+		Permissions: permissions,
+		Namespaces:  namespaces,
+		CreatedAt:   time.Now().UTC(),
+	}
+	s.keys = append(s.keys, key)
+	if err := s.saveLocked(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return StoredKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// List returns all keys, including revoked ones.
+func (s *Store) List() []StoredKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Clone(s.keys)
+}
+
+// Update replaces the permissions and namespaces of the key with `id`. Nil arguments are left
+// unchanged.
+func (s *Store) Update(id string, permissions []string, namespaces []string) (StoredKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := s.findLocked(id)
+	if i == -1 || s.keys[i].RevokedAt != nil {
+		return StoredKey{}, ErrKeyNotFound
+	}
+	old := s.keys[i]
+	if permissions != nil {
+		s.keys[i].Permissions = permissions
+	}
+	if namespaces != nil {
+		s.keys[i].Namespaces = namespaces
+	}
+	if err := s.saveLocked(); err != nil {
+		s.keys[i] = old
+		return StoredKey{}, err
+	}
+	return s.keys[i], nil
+}
+
+// Revoke stops the key with `id` from authenticating. The key stays listed.
+func (s *Store) Revoke(id string) (StoredKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := s.findLocked(id)
+	if i == -1 {
+		return StoredKey{}, ErrKeyNotFound
+	}
+	if s.keys[i].RevokedAt != nil {
+		return s.keys[i], nil
+	}
+	now := time.Now().UTC()
+	s.keys[i].RevokedAt = &now
+	if err := s.saveLocked(); err != nil {
+		s.keys[i].RevokedAt = nil
+		return StoredKey{}, err
+	}
+	return s.keys[i], nil
+}
+
+// HasActiveKeys returns true if any key isn't revoked.
+func (s *Store) HasActiveKeys() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.ContainsFunc(s.keys, func(k StoredKey) bool { return k.RevokedAt == nil })
+}
+
+// HasName returns true if a key that isn't revoked is called `name`.
+func (s *Store) HasName(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.ContainsFunc(s.keys, func(k StoredKey) bool { return k.Name == name && k.RevokedAt == nil })
+}
+
+// IdentityByKeyID returns the identity of the key with the ID `keyID`, or false if there's none
+// or it's revoked.
+func (s *Store) IdentityByKeyID(keyID string) (*Identity, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := s.findLocked(keyID)
+	if i < 0 || s.keys[i].RevokedAt != nil {
+		return nil, false
+	}
+	return s.keys[i].identity(), true
+}
+
+// Authenticate returns the identity of `key`, or false if it isn't an active key in the store.
+func (s *Store) Authenticate(key string) (*Identity, bool) {
+	if key == "" {
+		return nil, false
+	}
+	hash := hashKey(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.keys {
+		k := &s.keys[i]
+		if k.RevokedAt == nil && subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(hash)) == 1 {
+			return k.identity(), true
+		}
+	}
+	return nil, false
+}
@@ -4,30 +4,46 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/internal/backoff"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
 )
 
 const (
 	// Default timeout for callback responses
 	defaultCallbackTimeout = 30 * time.Second
 
+	// Under the state dir.
+	queueFileName = "callback-queue.json"
+
 	// HTTP client timeout for HTTP callbacks
 	httpCallbackTimeout = 30 * time.Second
 )
 
 // CallbackRequest represents a callback request from the guest VM to the client.
 type CallbackRequest struct {
+	// "callback" over WebSocket, where it tells requests apart from session messages.
+	Type      string          `json:"type,omitempty"`
 	ID        string          `json:"id"`
+	Namespace string          `json:"namespace,omitempty"`
 	VMName    string          `json:"vmName,omitempty"`
 	Method    string          `json:"method"`
 	Params    json.RawMessage `json:"params,omitempty"`
 	Timestamp int64           `json:"timestamp"`
+	// Counts retries of the callback, which keep its ID. Clients that see an ID again can answer
+	// with their earlier result instead of acting twice.
+	Attempt int `json:"attempt,omitempty"`
 }
 
 // CallbackResponse represents a response from the client to a callback request.
@@ -43,41 +59,108 @@ type CallbackError struct {
 	Message string `json:"message"`
 }
 
-// Session represents an HTTP callback session for a VM.
+// Session represents a callback session for a VM. Callbacks are either POSTed to `CallbackURL` or
+// sent to a client connected over WebSocket.
 type Session struct {
 	ID          string
+	Namespace   string
 	VMName      string
 	CallbackURL string
 	httpClient  *http.Client
+
+	// WebSocket sessions only.
+	reconnectToken string
+	bufferSize     int
+	wsLock         sync.Mutex
+	// Nil while the client is away.
+	conn *websocket.Conn
+	// Limits of `conn`.
+	limits messageLimits
+	// Callbacks waiting for a response, in the order they were made. Those made while the client
+	// was away, or sent on a connection that dropped, are sent when it reconnects.
+	pending []*pendingCallback
+	// The latest progress message that couldn't be sent while the client was away.
+	lastProgress *ProgressMessage
+	graceTimer   *time.Timer
+	closed       bool
+}
+
+// sessionKey identifies a VM. VM names are only unique within a namespace.
+type sessionKey struct {
+	namespace string
+	vmName    string
 }
 
 // SessionManager manages all active callback sessions.
 type SessionManager struct {
 	lock     sync.RWMutex
-	sessions map[string]*Session // keyed by vmName
+	sessions map[sessionKey]*Session
+
+	reconnectGrace time.Duration
+	bufferSize     int
+	retry          retryPolicy
+	// Called once a WebSocket session ends for good.
+	onSessionClose func(namespace string, vmName string)
+	// Callbacks for VMs without a session. Guarded by `lock` too, so that a callback can't be
+	// queued just as its VM's session starts.
+	queue *callbackQueue
 }
 
-// NewSessionManager creates a new SessionManager.
-func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		sessions: make(map[string]*Session),
+// NewSessionManager creates a new SessionManager, loading the callbacks still queued in `stateDir`.
+func NewSessionManager(cfg config.CallbackConfig, stateDir string) (*SessionManager, error) {
+	m := &SessionManager{
+		sessions:       make(map[sessionKey]*Session),
+		reconnectGrace: cfg.ReconnectGrace,
+		bufferSize:     cfg.BufferSize,
+		retry:          newRetryPolicy(cfg.Retry),
+	}
+	if m.reconnectGrace <= 0 {
+		m.reconnectGrace = defaultReconnectGrace
+	}
+	if m.bufferSize <= 0 {
+		m.bufferSize = defaultCallbackBuffer
+	}
+
+	queueTTL := cfg.QueueTTL
+	if queueTTL <= 0 {
+		queueTTL = defaultQueueTTL
 	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	queue, err := newCallbackQueue(filepath.Join(stateDir, queueFileName), queueTTL, queueSize)
+	if err != nil {
+		return nil, err
+	}
+	m.queue = queue
+	return m, nil
+}
+
+// OnSessionClose sets `f` to be called when a WebSocket session ends because its client didn't
+// reconnect within the grace period.
+func (m *SessionManager) OnSessionClose(f func(namespace string, vmName string)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onSessionClose = f
 }
 
 // RegisterHTTPCallback registers an HTTP callback URL for a VM.
 // This is called when a VM is started with a callbackUrl parameter.
-func (m *SessionManager) RegisterHTTPCallback(vmName string, callbackURL string) (*Session, error) {
+func (m *SessionManager) RegisterHTTPCallback(namespace string, vmName string, callbackURL string) (*Session, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	// Check if session already exists for this VM
-	if existing, ok := m.sessions[vmName]; ok {
+	key := sessionKey{namespace: namespace, vmName: vmName}
+	if existing, ok := m.sessions[key]; ok {
 		// Close the existing session
 		existing.Close()
 	}
 
 	session := &Session{
-		ID:          fmt.Sprintf("%s-http-%d", vmName, time.Now().UnixNano()),
+		ID:          fmt.Sprintf("%s-%s-http-%d", namespace, vmName, time.Now().UnixNano()),
+		Namespace:   namespace,
 		VMName:      vmName,
 		CallbackURL: callbackURL,
 		httpClient: &http.Client{
@@ -85,10 +168,11 @@ func (m *SessionManager) RegisterHTTPCallback(vmName string, callbackURL string)
 		},
 	}
 
-	m.sessions[vmName] = session
+	m.sessions[key] = session
 
 	log.WithFields(log.Fields{
 		"sessionId":   session.ID,
+		"namespace":   namespace,
 		"vmName":      vmName,
 		"callbackURL": callbackURL,
 	}).Info("HTTP callback session registered")
@@ -96,43 +180,57 @@ func (m *SessionManager) RegisterHTTPCallback(vmName string, callbackURL string)
 	return session, nil
 }
 
-// GetSession returns the session for the given VM name.
-func (m *SessionManager) GetSession(vmName string) *Session {
+// GetSession returns the session for the given VM.
+func (m *SessionManager) GetSession(namespace string, vmName string) *Session {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	return m.sessions[vmName]
+	return m.sessions[sessionKey{namespace: namespace, vmName: vmName}]
 }
 
-// HasSession returns true if a session exists for the given VM name.
-func (m *SessionManager) HasSession(vmName string) bool {
+// HasSession returns true if a session exists for the given VM.
+func (m *SessionManager) HasSession(namespace string, vmName string) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	_, exists := m.sessions[vmName]
+	_, exists := m.sessions[sessionKey{namespace: namespace, vmName: vmName}]
 	return exists
 }
 
 // RemoveSession removes and closes the session for the given VM.
-func (m *SessionManager) RemoveSession(vmName string) {
+func (m *SessionManager) RemoveSession(namespace string, vmName string) {
+	key := sessionKey{namespace: namespace, vmName: vmName}
 	m.lock.Lock()
-	session := m.sessions[vmName]
-	delete(m.sessions, vmName)
+	session := m.sessions[key]
+	delete(m.sessions, key)
 	m.lock.Unlock()
 
+	// Callbacks still queued for the VM have nowhere to go.
+	m.queue.drop(namespace, vmName)
+
 	if session != nil {
 		session.Close()
 		log.WithFields(log.Fields{
 			"sessionId": session.ID,
+			"namespace": namespace,
 			"vmName":    vmName,
 		}).Info("Session removed")
 	}
 }
 
-// RouteCallback routes a callback from a VM to the registered HTTP callback URL.
-func (m *SessionManager) RouteCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
-	session := m.GetSession(vmName)
-	if session == nil {
-		return nil, fmt.Errorf("no active callback session for VM: %s", vmName)
-	}
+// RouteCallback routes a callback from a VM to the client of its session. Callbacks that fail on
+// the way, e.g. because the client's connection dropped, are retried as the retry policy says.
+func (m *SessionManager) RouteCallback(ctx context.Context, namespace string, vmName string, method string, params json.RawMessage) (_ json.RawMessage, retErr error) {
+	ctx, span := tracing.StartWithKind(
+		ctx,
+		"callback.RouteCallback",
+		tracing.SpanKindClient,
+		tracing.String("vm.namespace", namespace),
+		tracing.String("vm.name", vmName),
+		tracing.String("callback.method", method),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
 
 	// Set timeout if not already set in context
 	if _, ok := ctx.Deadline(); !ok {
@@ -141,13 +239,94 @@ func (m *SessionManager) RouteCallback(ctx context.Context, vmName string, metho
 		defer cancel()
 	}
 
-	return session.sendCallback(ctx, vmName, method, params)
+	req := newCallbackRequest(namespace, vmName, method, params)
+	retries := m.retry.retries(method)
+	for attempt := 0; ; attempt++ {
+		// Each attempt gets its own copy, the previous one may still be queued.
+		attemptReq := *req
+		attemptReq.Attempt = attempt
+		resp, err := m.routeCallback(ctx, &attemptReq)
+		if err == nil || attempt >= retries || !isRetryable(err) {
+			return resp, err
+		}
+
+		wait := m.retry.backoff(attempt + 1)
+		log.WithFields(log.Fields{
+			"namespace": namespace,
+			"vmName":    vmName,
+			"method":    method,
+			"attempt":   attempt + 1,
+			"backoff":   wait,
+		}).WithError(err).Warn("Callback failed, retrying")
+		if waitErr := backoff.Wait(ctx, wait); waitErr != nil {
+			return nil, err
+		}
+	}
+}
+
+// routeCallback makes a single attempt at `req`: it's sent to the VM's session, or queued until
+// the VM has one.
+func (m *SessionManager) routeCallback(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	namespace, vmName, method := req.Namespace, req.VMName, req.Method
+	m.lock.Lock()
+	session := m.sessions[sessionKey{namespace: namespace, vmName: vmName}]
+	if session != nil {
+		m.lock.Unlock()
+		return session.sendCallback(ctx, req)
+	}
+
+	// Hold on to the callback until a client connects. The guest may give up waiting for the
+	// response first, the callback is still delivered.
+	result, err := m.queue.push(req)
+	m.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("no active callback session for VM: %s in namespace: %s: %w", vmName, namespace, err)
+	}
+	log.WithFields(log.Fields{
+		"namespace": namespace,
+		"vmName":    vmName,
+		"method":    method,
+	}).Info("Queued callback until a client connects")
+	resp, err := awaitCallback(ctx, result)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("callback %s is queued, no client has connected yet: %w", method, err)
+	}
+	return resp, err
+}
+
+func newCallbackRequest(namespace string, vmName string, method string, params json.RawMessage) *CallbackRequest {
+	return &CallbackRequest{
+		ID:        fmt.Sprintf("%s-%d", vmName, time.Now().UnixNano()),
+		Namespace: namespace,
+		VMName:    vmName,
+		Method:    method,
+		Params:    params,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// awaitCallback waits for the response to a callback, or for `ctx` to expire.
+func awaitCallback(ctx context.Context, result chan callbackResult) (json.RawMessage, error) {
+	select {
+	case result := <-result:
+		if result.err != nil {
+			return nil, result.err
+		}
+		if result.resp.Error != nil {
+			return nil, fmt.Errorf("callback error [%d]: %s", result.resp.Error.Code, result.resp.Error.Message)
+		}
+		return result.resp.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Close closes the session and releases resources.
 func (s *Session) Close() {
 	if s.httpClient != nil {
 		s.httpClient.CloseIdleConnections()
+	} else {
+		s.closeWebSocket()
 	}
 
 	log.WithFields(log.Fields{
@@ -156,16 +335,19 @@ func (s *Session) Close() {
 	}).Debug("Session closed")
 }
 
-// sendCallback sends a callback via HTTP POST to the callback URL.
-func (s *Session) sendCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
-	// Create the callback request
-	req := &CallbackRequest{
-		ID:        fmt.Sprintf("%s-%d", vmName, time.Now().UnixNano()),
-		VMName:    vmName,
-		Method:    method,
-		Params:    params,
-		Timestamp: time.Now().Unix(),
+// sendCallback sends a callback to the session's client.
+func (s *Session) sendCallback(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	if s.httpClient == nil {
+		req.Type = callbackMessageType
+		return s.sendWebSocketCallback(ctx, req)
 	}
+	return s.sendHTTPCallback(ctx, req)
+}
+
+// sendHTTPCallback sends a callback via HTTP POST to the callback URL.
+func (s *Session) sendHTTPCallback(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	vmName := req.VMName
+	method := req.Method
 
 	// Serialize the request
 	reqBody, err := json.Marshal(req)
@@ -179,6 +361,9 @@ func (s *Session) sendCallback(ctx context.Context, vmName string, method string
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
+	// Stays the same when the callback is retried.
+	httpReq.Header.Set("Idempotency-Key", req.ID)
+	tracing.Inject(ctx, httpReq.Header)
 
 	log.WithFields(log.Fields{
 		"sessionId":   s.ID,
@@ -190,7 +375,10 @@ func (s *Session) sendCallback(ctx context.Context, vmName string, method string
 	// Send the request
 	resp, err := s.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP callback request failed: %w", err)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("HTTP callback request failed: %w", err)
+		}
+		return nil, &retryableError{fmt.Errorf("HTTP callback request failed: %w", err)}
 	}
 	defer resp.Body.Close()
 
@@ -202,7 +390,11 @@ func (s *Session) sendCallback(ctx context.Context, vmName string, method string
 
 	// Check for HTTP errors
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("HTTP callback returned status %d: %s", resp.StatusCode, string(respBody))
+		err := fmt.Errorf("HTTP callback returned status %d: %s", resp.StatusCode, string(respBody))
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &retryableError{err}
+		}
+		return nil, err
 	}
 
 	// Parse the response
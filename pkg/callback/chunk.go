@@ -0,0 +1,148 @@
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	defaultMaxMessageSize = 512 << 10
+	defaultMaxChunkedSize = 32 << 20
+	// Smaller limits would leave too little room in chunks.
+	minMaxMessageSize = 4 << 10
+
+	chunkMessageType = "chunk"
+	// Room left in every chunk message for its other fields.
+	chunkOverhead = 256
+)
+
+var (
+	errMessageTooLarge        = errors.New("message exceeds the size limit")
+	errChunkedMessageTooLarge = errors.New("chunked message exceeds the size limit")
+)
+
+// ChunkMessage carries part of a message too large for a single WebSocket message. Both sides
+// split such messages into chunks of at most the connection's maxMessageSize and send them in
+// order; the receiver concatenates the data of chunks with the same message ID and handles the
+// result once the final chunk arrives.
+type ChunkMessage struct {
+	Type      string `json:"type"`
+	MessageID string `json:"messageId"`
+	// Base64 in JSON.
+	Data  []byte `json:"data"`
+	Final bool   `json:"final"`
+}
+
+// messageLimits are the size limits of one WebSocket connection.
+type messageLimits struct {
+	// Largest single message either side sends.
+	maxMessageSize int64
+	// Largest message reassembled from chunks.
+	maxChunkedSize int64
+}
+
+func newMessageLimits(cfg config.WebSocketConfig) messageLimits {
+	limits := messageLimits{maxMessageSize: cfg.MaxMessageSize, maxChunkedSize: cfg.MaxChunkedSize}
+	if limits.maxMessageSize <= 0 {
+		limits.maxMessageSize = defaultMaxMessageSize
+	}
+	limits.maxMessageSize = max(limits.maxMessageSize, minMaxMessageSize)
+	if limits.maxChunkedSize <= 0 {
+		limits.maxChunkedSize = defaultMaxChunkedSize
+	}
+	return limits
+}
+
+// writeMessage sends `v` over `conn`, split into chunks if it doesn't fit in one message.
+func writeMessage(conn *websocket.Conn, v any, limits messageLimits) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) <= limits.maxMessageSize {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	messageID, err := randomToken()
+	if err != nil {
+		return err
+	}
+	// Base64 grows the data by a third.
+	size := int((limits.maxMessageSize - chunkOverhead) * 3 / 4)
+	for len(data) > 0 {
+		n := min(size, len(data))
+		chunk, err := json.Marshal(ChunkMessage{
+			Type:      chunkMessageType,
+			MessageID: messageID,
+			Data:      data[:n],
+			Final:     n == len(data),
+		})
+		if err != nil {
+			return err
+		}
+		// Each chunk gets the full timeout, so that large messages aren't cut off.
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, chunk); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// readMessage reads the next message from `conn`. The connection's read limit only applies to
+// the compressed size of a message, so the decompressed size is limited here as well.
+func readMessage(conn *websocket.Conn, limits messageLimits) ([]byte, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limits.maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	return data, nil
+}
+
+// chunkAssembler puts the messages a client sent in chunks back together.
+type chunkAssembler struct {
+	maxSize int64
+	// Keyed by message ID.
+	parts map[string][]byte
+	// Across all messages, so that a client can't get around the limit by interleaving them.
+	size int64
+}
+
+func newChunkAssembler(maxSize int64) *chunkAssembler {
+	return &chunkAssembler{maxSize: maxSize, parts: make(map[string][]byte)}
+}
+
+// add adds `chunk` to its message and returns the message once it's complete.
+func (a *chunkAssembler) add(chunk *ChunkMessage) ([]byte, bool, error) {
+	if chunk.MessageID == "" {
+		return nil, false, fmt.Errorf("chunk without a message id")
+	}
+	a.size += int64(len(chunk.Data))
+	if a.size > a.maxSize {
+		return nil, false, errChunkedMessageTooLarge
+	}
+	data := append(a.parts[chunk.MessageID], chunk.Data...)
+	if !chunk.Final {
+		a.parts[chunk.MessageID] = data
+		return nil, false, nil
+	}
+	delete(a.parts, chunk.MessageID)
+	a.size -= int64(len(data))
+	return data, true, nil
+}
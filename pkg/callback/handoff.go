@@ -0,0 +1,71 @@
+package callback
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Handoff is what another server needs to take over the callback session of a VM that migrates
+// there.
+type Handoff struct {
+	// Set for HTTP callback sessions.
+	CallbackURL string
+	// Set for WebSocket sessions, whose client reconnects to the other server with the token.
+	SessionID      string
+	ReconnectToken string
+}
+
+// HandOffSession returns the handoff of the VM's session, or nil if it has none. The session stays
+// here until removed.
+func (m *SessionManager) HandOffSession(namespace string, vmName string) *Handoff {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	session, ok := m.sessions[sessionKey{namespace: namespace, vmName: vmName}]
+	if !ok {
+		return nil
+	}
+	if session.httpClient != nil {
+		return &Handoff{CallbackURL: session.CallbackURL}
+	}
+	return &Handoff{SessionID: session.ID, ReconnectToken: session.reconnectToken}
+}
+
+// AdoptSession takes over the session handed off by another server for the VM. WebSocket sessions
+// start without a connection; their client has the reconnect grace period to reconnect with its
+// reconnect token, like after a dropped connection.
+func (m *SessionManager) AdoptSession(namespace string, vmName string, handoff *Handoff) {
+	if handoff.CallbackURL != "" {
+		m.RegisterHTTPCallback(namespace, vmName, handoff.CallbackURL)
+		return
+	}
+
+	key := sessionKey{namespace: namespace, vmName: vmName}
+	session := &Session{
+		ID:             handoff.SessionID,
+		Namespace:      namespace,
+		VMName:         vmName,
+		reconnectToken: handoff.ReconnectToken,
+		bufferSize:     m.bufferSize,
+	}
+	if session.ID == "" {
+		session.ID = fmt.Sprintf("%s-%s-ws-%d", namespace, vmName, time.Now().UnixNano())
+	}
+	m.lock.Lock()
+	if existing, ok := m.sessions[key]; ok {
+		existing.Close()
+	}
+	m.sessions[key] = session
+	m.lock.Unlock()
+
+	session.wsLock.Lock()
+	session.graceTimer = time.AfterFunc(m.reconnectGrace, func() { m.expireSession(key, session) })
+	session.wsLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"sessionId": session.ID,
+		"namespace": namespace,
+		"vmName":    vmName,
+	}).Info("WebSocket callback session adopted, waiting for its client to reconnect")
+}
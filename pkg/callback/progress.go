@@ -0,0 +1,69 @@
+package callback
+
+import (
+	"maps"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of progress messages.
+const (
+	ProgressUpdate    = "progress"
+	ProgressHeartbeat = "heartbeat"
+)
+
+// ProgressMessage is a status update from a task in the guest, pushed to the WebSocket client of
+// the VM's callback session. Unlike callbacks it isn't answered.
+type ProgressMessage struct {
+	// Always "progress".
+	Type      string `json:"type"`
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vmName,omitempty"`
+	// `ProgressUpdate`, or `ProgressHeartbeat` for tasks that are alive but have nothing new to say.
+	Kind      string            `json:"kind"`
+	Data      map[string]string `json:"data,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// SendProgress pushes a progress message of `kind` to the WebSocket client of the VM's session
+// without waiting for the client. While the client is away only the latest message is kept, and
+// sent when it reconnects; heartbeats don't replace updates. It returns false if the VM has no WebSocket session.
+func (m *SessionManager) SendProgress(namespace string, vmName string, kind string, data map[string]string) bool {
+	session := m.GetSession(namespace, vmName)
+	if session == nil || session.httpClient != nil {
+		return false
+	}
+	session.sendProgress(&ProgressMessage{
+		Type:      progressMessageType,
+		Namespace: namespace,
+		VMName:    vmName,
+		Kind:      kind,
+		Data:      maps.Clone(data),
+		Timestamp: time.Now().Unix(),
+	})
+	return true
+}
+
+// sendProgress sends `msg` to the client, or keeps it for when the client reconnects.
+func (s *Session) sendProgress(msg *ProgressMessage) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	if s.closed {
+		return
+	}
+	if s.conn != nil {
+		err := s.writeLocked(msg)
+		if err == nil {
+			s.lastProgress = nil
+			return
+		}
+		// The read loop notices the broken connection.
+		log.WithField("sessionId", s.ID).WithError(err).Debug("Failed to send progress, keeping it for reconnect")
+	}
+	// A heartbeat says less than the update it would replace.
+	if msg.Kind == ProgressHeartbeat && s.lastProgress != nil && s.lastProgress.Kind != ProgressHeartbeat {
+		return
+	}
+	s.lastProgress = msg
+}
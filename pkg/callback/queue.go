@@ -0,0 +1,156 @@
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultQueueTTL  = 5 * time.Minute
+	defaultQueueSize = 64
+)
+
+var errQueueFull = errors.New("callback queue for the vm is full")
+
+// queuedCallback is a callback made while its VM had no session.
+type queuedCallback struct {
+	Request   CallbackRequest `json:"request"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	// Receives the response, if the guest is still waiting for it. Not persisted.
+	result chan callbackResult
+}
+
+// callbackQueue holds callbacks for VMs without a session until a client connects. It's kept in a
+// file so that queued callbacks survive restarts, e.g. of VMs restored after a drain.
+type callbackQueue struct {
+	lock sync.Mutex
+	path string
+	ttl  time.Duration
+	// Per VM.
+	size    int
+	entries []*queuedCallback
+}
+
+// newCallbackQueue loads the callbacks queued in `path`, dropping expired ones. A missing file is
+// an empty queue.
+func newCallbackQueue(path string, ttl time.Duration, size int) (*callbackQueue, error) {
+	q := &callbackQueue{path: path, ttl: ttl, size: size}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read callback queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse callback queue: %s: %w", path, err)
+	}
+
+	now := time.Now()
+	q.entries = slices.DeleteFunc(q.entries, func(e *queuedCallback) bool { return now.After(e.ExpiresAt) })
+	for _, e := range q.entries {
+		e.result = make(chan callbackResult, 1)
+	}
+	if len(q.entries) > 0 {
+		log.WithField("callbacks", len(q.entries)).Info("Loaded queued callbacks")
+	}
+	return q, nil
+}
+
+// saveLocked writes the queue out, replacing the file atomically.
+func (q *callbackQueue) saveLocked() error {
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save callback queue: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save callback queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save callback queue: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return fmt.Errorf("failed to save callback queue: %w", err)
+	}
+	return nil
+}
+
+// pruneLocked drops expired callbacks and returns true if there were any.
+func (q *callbackQueue) pruneLocked(now time.Time) bool {
+	n := len(q.entries)
+	q.entries = slices.DeleteFunc(q.entries, func(e *queuedCallback) bool { return now.After(e.ExpiresAt) })
+	return len(q.entries) != n
+}
+
+// push queues `req` and returns the channel its response arrives on.
+func (q *callbackQueue) push(req *CallbackRequest) (chan callbackResult, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	q.pruneLocked(now)
+	queued := 0
+	for _, e := range q.entries {
+		if e.Request.Namespace == req.Namespace && e.Request.VMName == req.VMName {
+			queued++
+		}
+	}
+	if queued >= q.size {
+		return nil, errQueueFull
+	}
+
+	entry := &queuedCallback{
+		Request:   *req,
+		ExpiresAt: now.Add(q.ttl),
+		result:    make(chan callbackResult, 1),
+	}
+	q.entries = append(q.entries, entry)
+	if err := q.saveLocked(); err != nil {
+		q.entries = q.entries[:len(q.entries)-1]
+		return nil, err
+	}
+	return entry.result, nil
+}
+
+// take removes and returns the callbacks queued for a VM, oldest first.
+func (q *callbackQueue) take(namespace string, vmName string) []*queuedCallback {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	changed := q.pruneLocked(time.Now())
+	var taken []*queuedCallback
+	q.entries = slices.DeleteFunc(q.entries, func(e *queuedCallback) bool {
+		if e.Request.Namespace == namespace && e.Request.VMName == vmName {
+			taken = append(taken, e)
+			return true
+		}
+		return false
+	})
+	if changed || len(taken) > 0 {
+		if err := q.saveLocked(); err != nil {
+			log.WithError(err).Warn("Failed to save callback queue")
+		}
+	}
+	return taken
+}
+
+// drop discards the callbacks queued for a VM, e.g. once it's destroyed.
+func (q *callbackQueue) drop(namespace string, vmName string) {
+	for _, e := range q.take(namespace, vmName) {
+		e.result <- callbackResult{err: errSessionClosed}
+	}
+}
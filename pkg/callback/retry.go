@@ -0,0 +1,77 @@
+package callback
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/internal/backoff"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	defaultInitialBackoff = 200 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+)
+
+// retryableError marks a callback that failed on its way to or from the client, as opposed to one
+// the client answered with an error.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable returns true if the callback that failed with `err` may succeed when sent again.
+func isRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r) || errors.Is(err, errSessionClosed) || errors.Is(err, errCallbackBufferFull)
+}
+
+// retryPolicy says how often and how soon failed callbacks are sent again.
+type retryPolicy struct {
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// Keyed by lowercased method name.
+	methods map[string]int
+}
+
+func newRetryPolicy(cfg config.CallbackRetryConfig) retryPolicy {
+	p := retryPolicy{
+		maxRetries:     cfg.MaxRetries,
+		initialBackoff: cfg.InitialBackoff,
+		maxBackoff:     cfg.MaxBackoff,
+		methods:        make(map[string]int, len(cfg.Methods)),
+	}
+	if p.initialBackoff <= 0 {
+		p.initialBackoff = defaultInitialBackoff
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultMaxBackoff
+	}
+	// Viper lowercases map keys, so methods are matched regardless of case.
+	for method, retries := range cfg.Methods {
+		p.methods[strings.ToLower(method)] = retries
+	}
+	return p
+}
+
+// retries returns how often a callback of `method` is retried.
+func (p retryPolicy) retries(method string) int {
+	if retries, ok := p.methods[strings.ToLower(method)]; ok {
+		return retries
+	}
+	return p.maxRetries
+}
+
+// backoff returns how long to wait before retry number `retry`, counting from 1.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	return backoff.Duration(retry, p.initialBackoff, p.maxBackoff)
+}
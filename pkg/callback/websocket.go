@@ -0,0 +1,414 @@
+package callback
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	defaultReconnectGrace = 30 * time.Second
+	defaultCallbackBuffer = 64
+
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	// Connections that don't answer pings for this long are treated as dropped.
+	wsPongTimeout = 2 * wsPingInterval
+
+	sessionMessageType  = "session"
+	callbackMessageType = "callback"
+	progressMessageType = "progress"
+)
+
+var (
+	ErrSessionExists      = errors.New("vm already has a callback session, reconnect with its token")
+	ErrBadReconnectToken  = errors.New("invalid reconnect token")
+	errSessionClosed      = errors.New("callback session closed")
+	errCallbackBufferFull = errors.New("client is disconnected and the callback buffer is full")
+)
+
+// SessionMessage is the first message on every WebSocket connection. Callback requests follow,
+// each answered by the client with a CallbackResponse carrying the request's ID.
+type SessionMessage struct {
+	Type      string `json:"type"`
+	SessionID string `json:"sessionId"`
+	// Presented when reconnecting to resume the session.
+	ReconnectToken string `json:"reconnectToken"`
+	// True if the connection resumed an existing session. Callbacks made while the client was
+	// away are sent next.
+	Resumed bool `json:"resumed"`
+	// How long the session outlives a dropped connection.
+	ReconnectGraceSeconds int64 `json:"reconnectGraceSeconds"`
+	// Largest message, in bytes, the server reads. Larger responses must be sent as chunks, see
+	// ChunkMessage.
+	MaxMessageSize int64 `json:"maxMessageSize"`
+}
+
+type callbackResult struct {
+	resp CallbackResponse
+	err  error
+}
+
+type pendingCallback struct {
+	req    *CallbackRequest
+	result chan callbackResult
+}
+
+// CheckWebSocket returns an error if a WebSocket connection for the VM couldn't be attached with
+// `reconnectToken`, so that it can be refused before upgrading.
+func (m *SessionManager) CheckWebSocket(namespace string, vmName string, reconnectToken string) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	_, _, err := m.webSocketSessionLocked(sessionKey{namespace: namespace, vmName: vmName}, reconnectToken)
+	return err
+}
+
+// webSocketSessionLocked returns the session a connection presenting `reconnectToken` attaches
+// to, or nil if it starts a new one.
+func (m *SessionManager) webSocketSessionLocked(key sessionKey, reconnectToken string) (*Session, bool, error) {
+	existing, ok := m.sessions[key]
+	if !ok {
+		if reconnectToken != "" {
+			// The session expired, or the server restarted.
+			return nil, false, ErrBadReconnectToken
+		}
+		return nil, false, nil
+	}
+	if reconnectToken == "" || existing.httpClient != nil {
+		return nil, false, ErrSessionExists
+	}
+	if subtle.ConstantTimeCompare([]byte(existing.reconnectToken), []byte(reconnectToken)) != 1 {
+		return nil, false, ErrBadReconnectToken
+	}
+	return existing, true, nil
+}
+
+// ServeWebSocket attaches `conn` to the callback session of the VM and serves callbacks over it
+// until it closes. A connection without a reconnect token starts a new session; one with the token
+// of an existing session resumes it, replacing the session's connection if it still has one.
+// Sessions outlive their connection by the reconnect grace period. Messages on the connection are
+// limited in size as `cfg` says.
+func (m *SessionManager) ServeWebSocket(namespace string, vmName string, reconnectToken string, conn *websocket.Conn, cfg config.WebSocketConfig) {
+	key := sessionKey{namespace: namespace, vmName: vmName}
+	m.lock.Lock()
+	session, resumed, err := m.webSocketSessionLocked(key, reconnectToken)
+	if err != nil {
+		m.lock.Unlock()
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+			time.Now().Add(wsWriteTimeout))
+		conn.Close()
+		return
+	}
+	if session == nil {
+		token, err := randomToken()
+		if err != nil {
+			m.lock.Unlock()
+			log.WithError(err).Error("failed to create reconnect token")
+			conn.Close()
+			return
+		}
+		session = &Session{
+			ID:             fmt.Sprintf("%s-%s-ws-%d", namespace, vmName, time.Now().UnixNano()),
+			Namespace:      namespace,
+			VMName:         vmName,
+			reconnectToken: token,
+			bufferSize:     m.bufferSize,
+		}
+		// Callbacks made while the VM had no session go out first.
+		for _, queued := range m.queue.take(namespace, vmName) {
+			req := queued.Request
+			req.Type = callbackMessageType
+			session.pending = append(session.pending, &pendingCallback{req: &req, result: queued.result})
+		}
+		m.sessions[key] = session
+	}
+	m.lock.Unlock()
+
+	logger := log.WithFields(log.Fields{
+		"sessionId": session.ID,
+		"namespace": namespace,
+		"vmName":    vmName,
+	})
+	limits := newMessageLimits(cfg)
+	if err := session.attach(conn, limits, resumed, m.reconnectGrace); err != nil {
+		logger.WithError(err).Warn("failed to attach websocket to callback session")
+	} else {
+		logger.WithField("resumed", resumed).Info("WebSocket callback session connected")
+		err = session.serve(conn, limits)
+		logger.WithError(err).Info("WebSocket callback session disconnected")
+	}
+	session.detach(conn, m.reconnectGrace, func() { m.expireSession(key, session) })
+}
+
+// CloseWebSocketSession ends the WebSocket session of the VM, if it has one, without waiting for
+// its client. HTTP callback sessions are left alone.
+func (m *SessionManager) CloseWebSocketSession(namespace string, vmName string) {
+	key := sessionKey{namespace: namespace, vmName: vmName}
+	m.lock.Lock()
+	session, ok := m.sessions[key]
+	if !ok || session.httpClient != nil {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.sessions, key)
+	m.lock.Unlock()
+
+	session.Close()
+	log.WithFields(log.Fields{
+		"sessionId": session.ID,
+		"namespace": namespace,
+		"vmName":    vmName,
+	}).Info("WebSocket callback session closed")
+}
+
+// expireSession ends `session` once its client failed to reconnect in time.
+func (m *SessionManager) expireSession(key sessionKey, session *Session) {
+	m.lock.Lock()
+	if m.sessions[key] != session {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.sessions, key)
+	onClose := m.onSessionClose
+	m.lock.Unlock()
+
+	session.Close()
+	log.WithFields(log.Fields{
+		"sessionId": session.ID,
+		"namespace": key.namespace,
+		"vmName":    key.vmName,
+	}).Info("Callback session expired after its client didn't reconnect")
+	if onClose != nil {
+		onClose(key.namespace, key.vmName)
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeLocked sends `v` to the client. Must be called with `s.wsLock` held, which serializes
+// writes as the websocket package requires. Chunked messages are thereby never interleaved.
+func (s *Session) writeLocked(v any) error {
+	return writeMessage(s.conn, v, s.limits)
+}
+
+// attach makes `conn`, limited to `limits`, the session's connection and sends it the callbacks
+// still waiting for a response.
+func (s *Session) attach(conn *websocket.Conn, limits messageLimits, resumed bool, grace time.Duration) error {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	if s.closed {
+		return errSessionClosed
+	}
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+	if s.conn != nil {
+		// Its read loop fails and finds it's no longer the session's connection.
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.limits = limits
+
+	err := s.writeLocked(SessionMessage{
+		Type:                  sessionMessageType,
+		SessionID:             s.ID,
+		ReconnectToken:        s.reconnectToken,
+		Resumed:               resumed,
+		ReconnectGraceSeconds: int64(grace.Seconds()),
+		MaxMessageSize:        limits.maxMessageSize,
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range s.pending {
+		if err := s.writeLocked(p.req); err != nil {
+			return err
+		}
+	}
+	if s.lastProgress != nil {
+		if err := s.writeLocked(s.lastProgress); err != nil {
+			return err
+		}
+		s.lastProgress = nil
+	}
+	return nil
+}
+
+// detach drops `conn` from the session, if it's still the session's connection, and gives the
+// client `grace` to reconnect before `expire` is called.
+func (s *Session) detach(conn *websocket.Conn, grace time.Duration, expire func()) {
+	conn.Close()
+
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	if s.closed || s.conn != conn {
+		return
+	}
+	s.conn = nil
+	s.graceTimer = time.AfterFunc(grace, expire)
+}
+
+// serve reads responses from `conn` until it fails. Messages larger than `limits` allow make it
+// fail too.
+func (s *Session) serve(conn *websocket.Conn, limits messageLimits) error {
+	conn.SetReadLimit(limits.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Safe to call concurrently with writes.
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	chunks := newChunkAssembler(limits.maxChunkedSize)
+	for {
+		data, err := readMessage(conn, limits)
+		if errors.Is(err, errMessageTooLarge) {
+			closeTooBig(conn, err)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		var chunk ChunkMessage
+		if err := json.Unmarshal(data, &chunk); err == nil && chunk.Type == chunkMessageType {
+			var done bool
+			data, done, err = chunks.add(&chunk)
+			if errors.Is(err, errChunkedMessageTooLarge) {
+				closeTooBig(conn, err)
+				return err
+			}
+			if err != nil {
+				log.WithField("sessionId", s.ID).WithError(err).Warn("Ignoring malformed chunk")
+				continue
+			}
+			if !done {
+				continue
+			}
+		}
+
+		var resp CallbackResponse
+		if err := json.Unmarshal(data, &resp); err != nil || resp.ID == "" {
+			log.WithField("sessionId", s.ID).Warn("Ignoring malformed callback response")
+			continue
+		}
+		s.resolve(callbackResult{resp: resp}, resp.ID)
+	}
+}
+
+// closeTooBig tells the client it sent a message larger than allowed before the connection is
+// dropped.
+func closeTooBig(conn *websocket.Conn, err error) {
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseMessageTooBig, err.Error()),
+		time.Now().Add(wsWriteTimeout))
+}
+
+// resolve hands `result` to the callback with `id`, if it's still waiting.
+func (s *Session) resolve(result callbackResult, id string) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	i := slices.IndexFunc(s.pending, func(p *pendingCallback) bool { return p.req.ID == id })
+	if i == -1 {
+		return
+	}
+	s.pending[i].result <- result
+	s.pending = slices.Delete(s.pending, i, i+1)
+}
+
+// sendWebSocketCallback sends `req` to the client and waits for its response. If the client is
+// away, the request is buffered until it reconnects or `ctx` expires.
+func (s *Session) sendWebSocketCallback(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	p := &pendingCallback{req: req, result: make(chan callbackResult, 1)}
+
+	s.wsLock.Lock()
+	if s.closed {
+		s.wsLock.Unlock()
+		return nil, errSessionClosed
+	}
+	if s.conn == nil && len(s.pending) >= s.bufferSize {
+		s.wsLock.Unlock()
+		return nil, errCallbackBufferFull
+	}
+	s.pending = append(s.pending, p)
+	if s.conn != nil {
+		if err := s.writeLocked(req); err != nil {
+			// The read loop notices the broken connection; the request is sent again on reconnect.
+			log.WithField("sessionId", s.ID).WithError(err).Debug("Failed to send callback, waiting for reconnect")
+		}
+	}
+	s.wsLock.Unlock()
+
+	resp, err := awaitCallback(ctx, p.result)
+	if ctx.Err() != nil && err == ctx.Err() {
+		s.wsLock.Lock()
+		s.pending = slices.DeleteFunc(s.pending, func(other *pendingCallback) bool { return other == p })
+		s.wsLock.Unlock()
+		return nil, fmt.Errorf("callback %s: %w", req.Method, err)
+	}
+	return resp, err
+}
+
+// closeWebSocket ends the session's connection, if any, and fails the callbacks waiting on it.
+func (s *Session) closeWebSocket() {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+	}
+	if s.conn != nil {
+		s.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, errSessionClosed.Error()),
+			time.Now().Add(wsWriteTimeout))
+		s.conn.Close()
+		s.conn = nil
+	}
+	for _, p := range s.pending {
+		p.result <- callbackResult{err: errSessionClosed}
+	}
+	s.pending = nil
+}
@@ -0,0 +1,104 @@
+// Package client is a Go SDK for the arrakis REST server. It wraps the generated serverapi client
+// with iterators over paginated VM lists, event subscriptions that reconnect on their own and
+// readers for command output, so that programs don't have to reimplement pagination, retries and
+// reconnection.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// Options configure a `Client`. Zero values select the defaults.
+type Options struct {
+	// Sent as a Bearer token with every request.
+	APIKey string
+	// Defaults to http.DefaultClient. Must not have a timeout if event subscriptions are used, as
+	// event streams stay open indefinitely.
+	HTTPClient *http.Client
+	// Defaults to `DefaultRetryPolicy`.
+	Retry *RetryPolicy
+}
+
+// Client talks to a single arrakis REST server.
+type Client struct {
+	api        *serverapi.APIClient
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// New creates a client for the REST server at `serverAddr`, given as host:port.
+func New(serverAddr string, opts Options) (*Client, error) {
+	host, port, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server address: %v", err)
+	}
+
+	c := &Client{
+		baseURL:    "http://" + net.JoinHostPort(host, port),
+		apiKey:     opts.APIKey,
+		httpClient: opts.HTTPClient,
+		retry:      DefaultRetryPolicy,
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	if opts.Retry != nil {
+		c.retry = *opts.Retry
+	}
+
+	configuration := serverapi.NewConfiguration()
+	configuration.Servers = serverapi.ServerConfigurations{
+		{
+			URL:         c.baseURL,
+			Description: "arrakis server",
+		},
+	}
+	configuration.HTTPClient = c.httpClient
+	if c.apiKey != "" {
+		configuration.AddDefaultHeader("Authorization", "Bearer "+c.apiKey)
+	}
+	c.api = serverapi.NewAPIClient(configuration)
+	return c, nil
+}
+
+// API returns the generated client, for the endpoints this package has no helpers for.
+func (c *Client) API() *serverapi.DefaultAPIService {
+	return c.api.DefaultAPI
+}
+
+// Error is returned for requests the server answered with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// apiError turns the result of a failed request into an `*Error` if the server answered it, and
+// returns `err` unchanged otherwise.
+func apiError(httpResp *http.Response, err error) error {
+	if httpResp == nil || httpResp.StatusCode < 300 {
+		return err
+	}
+	defer httpResp.Body.Close()
+	body, readErr := io.ReadAll(httpResp.Body)
+	if readErr != nil {
+		return &Error{StatusCode: httpResp.StatusCode, Message: err.Error()}
+	}
+
+	var errorResp serverapi.ErrorResponse
+	if jsonErr := json.Unmarshal(body, &errorResp); jsonErr == nil && errorResp.Error != nil {
+		return &Error{StatusCode: httpResp.StatusCode, Message: errorResp.Error.GetMessage()}
+	}
+	return &Error{StatusCode: httpResp.StatusCode, Message: string(body)}
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/internal/backoff"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// Types of the notices the server sends on the event stream besides events.
+const (
+	// Sent as an event to subscribers: some events after the cursor are no longer retained by the
+	// server and were missed. Data has the "lastEventId" and "message" of the notice.
+	EventGap = "gap"
+	// Handled by the subscription, which reconnects after the last event it delivered.
+	eventOverflow = "overflow"
+)
+
+const (
+	// The server sends a keepalive every 15 seconds, so a stream that is silent for much longer
+	// than that is dead.
+	eventsIdleTimeout = 45 * time.Second
+	// Largest line read from the event stream.
+	maxEventLineSize = 1 << 20
+)
+
+var errStreamIdle = errors.New("event stream idle for too long")
+
+// SubscribeOptions select the events to receive.
+type SubscribeOptions struct {
+	// Replay the events the server still retains after this ID. Zero only delivers new events.
+	After uint64
+	// Only events for this VM.
+	VM string
+	// Events buffered by the subscription. Defaults to 64.
+	Buffer int
+}
+
+// Subscription delivers server events until it's closed, its context expires, or it fails to
+// reconnect. Dropped streams are reopened after the last delivered event, so events are only
+// missed if the server no longer retains them, in which case an `EventGap` event is delivered.
+type Subscription struct {
+	events chan events.Event
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lock sync.Mutex
+	err  error
+}
+
+// Subscribe starts streaming server events. Reconnection attempts follow the client's retry
+// policy, counting from the last successful connection. Without `After`, events published before
+// the first event was delivered may be missed when the stream drops.
+func (c *Client) Subscribe(ctx context.Context, opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 64
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		events: make(chan events.Event, opts.Buffer),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go sub.run(ctx, c, opts)
+	return sub
+}
+
+// Events returns the channel events are delivered on. It's closed when the subscription ends, after
+// which `Err` says why.
+func (s *Subscription) Events() <-chan events.Event {
+	return s.events
+}
+
+// Err returns the error that ended the subscription, or nil if it was closed or is still running.
+func (s *Subscription) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close ends the subscription and waits for it to stop.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *Subscription) run(ctx context.Context, c *Client, opts SubscribeOptions) {
+	defer close(s.done)
+	defer close(s.events)
+
+	cursor := opts.After
+	for retry := 0; ; retry++ {
+		connected, err := c.streamEvents(ctx, opts.VM, &cursor, s.events)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			retry = 0
+		}
+		if err != nil && (!retryable(err) || c.retry.exhausted(retry)) {
+			s.lock.Lock()
+			s.err = err
+			s.lock.Unlock()
+			return
+		}
+		if backoff.Wait(ctx, c.retry.backoff(retry+1)) != nil {
+			return
+		}
+	}
+}
+
+// streamEvents opens the event stream after `*cursor` and delivers events to `out` until the
+// stream ends, advancing the cursor as it goes. `connected` is set once the server accepted the
+// stream. A stream the server ends after an overflow is not an error.
+func (c *Client) streamEvents(ctx context.Context, vmName string, cursor *uint64, out chan<- events.Event) (connected bool, err error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	q := url.Values{}
+	if *cursor != 0 {
+		q.Set("after", strconv.FormatUint(*cursor, 10))
+	}
+	if vmName != "" {
+		q.Set("vm", vmName)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/events?"+q.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, apiError(resp, errors.New(resp.Status))
+	}
+	defer resp.Body.Close()
+
+	// Reading blocks until the server sends something, so a dead connection is detected by
+	// cancelling the request when nothing arrived for too long.
+	idle := time.AfterFunc(eventsIdleTimeout, func() { cancel(errStreamIdle) })
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxEventLineSize)
+	var eventType, data string
+	for scanner.Scan() {
+		idle.Reset(eventsIdleTimeout)
+		line := scanner.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				eventType = value
+			case "data":
+				data = value
+			}
+			// Comments, such as keepalives, and IDs, which are also in the data, are ignored.
+			continue
+		}
+		if eventType == "" && data == "" {
+			continue
+		}
+
+		var event events.Event
+		switch eventType {
+		case eventOverflow:
+			return true, nil
+		case EventGap:
+			var notice struct {
+				LastEventID uint64 `json:"lastEventId"`
+				Message     string `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(data), &notice); err != nil {
+				return true, err
+			}
+			event = events.Event{
+				Time: time.Now().UTC(),
+				Type: EventGap,
+				Data: map[string]string{
+					"lastEventId": strconv.FormatUint(notice.LastEventID, 10),
+					"message":     notice.Message,
+				},
+			}
+		default:
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return true, err
+			}
+		}
+		eventType, data = "", ""
+
+		// A subscriber that is slow to take events doesn't make the stream idle.
+		idle.Stop()
+		select {
+		case out <- event:
+		case <-ctx.Done():
+			return true, context.Cause(ctx)
+		}
+		idle.Reset(eventsIdleTimeout)
+		if event.ID != 0 {
+			*cursor = event.ID
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(context.Cause(ctx), errStreamIdle) {
+			return true, errStreamIdle
+		}
+		return true, err
+	}
+	// The server ended the stream, e.g. because it's shutting down.
+	return true, errors.New("event stream ended")
+}
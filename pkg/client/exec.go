@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// CommandError is returned by `CommandOutput` for commands that ran but failed. The reader returned
+// alongside it still has the command's output.
+type CommandError struct {
+	VMName  string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command failed in vm %s: %s", e.VMName, e.Message)
+}
+
+// CommandOutput runs `cmd` in the VM `vmName` and returns a reader for its output. The server has
+// no streaming exec, so the output arrives once the command finishes. Commands aren't retried,
+// since one that failed in transit may have run anyway.
+func (c *Client) CommandOutput(ctx context.Context, vmName string, cmd string) (io.Reader, error) {
+	req := serverapi.NewVmCommandRequest(cmd)
+	req.SetBlocking(true)
+	resp, httpResp, err := c.api.DefaultAPI.V1VmsNameCmdPost(ctx, vmName).VmCommandRequest(*req).Execute()
+	if err != nil {
+		return nil, apiError(httpResp, err)
+	}
+	output := strings.NewReader(resp.GetOutput())
+	if resp.GetError() != "" {
+		return output, &CommandError{VMName: vmName, Message: resp.GetError()}
+	}
+	return output, nil
+}
+
+// CommandStatus is the status and output of a background command.
+type CommandStatus = serverapi.VmCommandStatus
+
+// StartCommand starts `cmd` in the background in the VM `vmName` and returns its ID, to follow it
+// with `CommandStatus`. It's killed after `timeout` unless zero. Not retried, like CommandOutput.
+func (c *Client) StartCommand(ctx context.Context, vmName string, cmd string, timeout time.Duration) (string, error) {
+	req := serverapi.NewVmCommandRequest(cmd)
+	req.SetBlocking(false)
+	if timeout > 0 {
+		req.SetTimeoutSeconds(int32(math.Ceil(timeout.Seconds())))
+	}
+	resp, httpResp, err := c.api.DefaultAPI.V1VmsNameCmdPost(ctx, vmName).VmCommandRequest(*req).Execute()
+	if err != nil {
+		return "", apiError(httpResp, err)
+	}
+	if resp.GetError() != "" {
+		return "", &CommandError{VMName: vmName, Message: resp.GetError()}
+	}
+	if resp.GetId() == "" {
+		return "", fmt.Errorf("vm %s can't follow background commands, its cmdserver is too old", vmName)
+	}
+	return resp.GetId(), nil
+}
+
+// CommandStatus returns whether the background command `id` is running, how it exited and the end
+// of its output.
+func (c *Client) CommandStatus(ctx context.Context, vmName string, id string) (*CommandStatus, error) {
+	var resp *CommandStatus
+	err := c.retry.do(ctx, func() error {
+		r, httpResp, err := c.api.DefaultAPI.V1VmsNameCmdIdGet(ctx, vmName, id).Execute()
+		resp = r
+		return apiError(httpResp, err)
+	})
+	return resp, err
+}
+
+// KillCommand kills the background command `id` if it's still running, forgets it and returns its
+// final status.
+func (c *Client) KillCommand(ctx context.Context, vmName string, id string) (*CommandStatus, error) {
+	resp, httpResp, err := c.api.DefaultAPI.V1VmsNameCmdIdDelete(ctx, vmName, id).Execute()
+	if err != nil {
+		return nil, apiError(httpResp, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/internal/backoff"
+)
+
+// RetryPolicy says how often and how soon requests that failed in transit, or that the server
+// couldn't serve right now, are sent again.
+type RetryPolicy struct {
+	// Retries after the first attempt. Negative values retry forever.
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is used by clients created without a policy of their own.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// backoff returns how long to wait before retry number `retry`, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	initial := max(p.InitialBackoff, time.Millisecond)
+	return backoff.Duration(retry, initial, max(p.MaxBackoff, initial))
+}
+
+// exhausted returns true if no retries are left after `retries` of them.
+func (p RetryPolicy) exhausted(retries int) bool {
+	return p.MaxRetries >= 0 && retries >= p.MaxRetries
+}
+
+// retryable returns true if a request that failed with `err` may succeed when sent again. Requests
+// the server rejected are only retried if it's overloaded or failed itself.
+func retryable(err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+}
+
+// do calls `fn` until it succeeds, fails with an error that isn't retryable, or the retries of the
+// policy run out. Only use it for requests that are safe to repeat.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || !retryable(err) || p.exhausted(retry) || ctx.Err() != nil {
+			return err
+		}
+		if waitErr := backoff.Wait(ctx, p.backoff(retry+1)); waitErr != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"iter"
+	"math"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// VM is a VM as listed by the server.
+type VM = serverapi.ListAllVMsResponseVmsInner
+
+// ListOptions select the VMs to list.
+type ListOptions struct {
+	// Defaults to the default namespace.
+	Namespace string
+	// Only VMs whose labels match, e.g. "team=infra,tier!=db".
+	LabelSelector string
+	// VMs per request. Defaults to the server's choice, which is all of them.
+	PageSize int
+}
+
+// listPage fetches the page of VMs after `pageToken`.
+func (c *Client) listPage(ctx context.Context, opts ListOptions, pageToken string) (*serverapi.ListAllVMsResponse, error) {
+	limit := int32(min(opts.PageSize, math.MaxInt32))
+	var resp *serverapi.ListAllVMsResponse
+	err := c.retry.do(ctx, func() error {
+		var err error
+		if opts.Namespace == "" {
+			req := c.api.DefaultAPI.V1VmsGet(ctx)
+			if opts.LabelSelector != "" {
+				req = req.LabelSelector(opts.LabelSelector)
+			}
+			if limit > 0 {
+				req = req.Limit(limit)
+			}
+			if pageToken != "" {
+				req = req.PageToken(pageToken)
+			}
+			r, httpResp, reqErr := req.Execute()
+			resp, err = r, apiError(httpResp, reqErr)
+		} else {
+			req := c.api.DefaultAPI.V1NamespacesNsVmsGet(ctx, opts.Namespace)
+			if opts.LabelSelector != "" {
+				req = req.LabelSelector(opts.LabelSelector)
+			}
+			if limit > 0 {
+				req = req.Limit(limit)
+			}
+			if pageToken != "" {
+				req = req.PageToken(pageToken)
+			}
+			r, httpResp, reqErr := req.Execute()
+			resp, err = r, apiError(httpResp, reqErr)
+		}
+		return err
+	})
+	return resp, err
+}
+
+// VMPages iterates over the VMs the caller can see, a page at a time, sorted by name. Each page is
+// fetched when the previous one has been consumed, and failed requests are retried according to
+// the client's retry policy. Iteration ends after the first error.
+func (c *Client) VMPages(ctx context.Context, opts ListOptions) iter.Seq2[[]VM, error] {
+	return func(yield func([]VM, error) bool) {
+		pageToken := ""
+		for {
+			resp, err := c.listPage(ctx, opts, pageToken)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(resp.GetVms(), nil) {
+				return
+			}
+			pageToken = resp.GetNextPageToken()
+			if pageToken == "" {
+				return
+			}
+		}
+	}
+}
+
+// VMs is `VMPages` a VM at a time.
+func (c *Client) VMs(ctx context.Context, opts ListOptions) iter.Seq2[VM, error] {
+	return func(yield func(VM, error) bool) {
+		for page, err := range c.VMPages(ctx, opts) {
+			if err != nil {
+				yield(VM{}, err)
+				return
+			}
+			for _, vm := range page {
+				if !yield(vm, nil) {
+					return
+				}
+			}
+		}
+	}
+}
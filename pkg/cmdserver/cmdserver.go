@@ -1,21 +1,105 @@
 package cmdserver
 
-// fileData represents a single file's content and metadata.
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a container may run when ContainerRunRequest doesn't say, and at most.
+	DefaultContainerRunTimeout = 10 * time.Minute
+	MaxContainerRunTimeout     = time.Hour
+	// How much of a background command's output is kept, the end of it.
+	MaxCommandOutput = 1 << 20
+	// How many files, and how many bytes of them, the globs and directories of a download may
+	// expand to.
+	MaxDownloadFiles = 1000
+	MaxDownloadBytes = 64 << 20
+)
+
+// IndexResponse answers GET /, which the server polls until the cmdserver is up. BootMs is how
+// long after the guest kernel started the cmdserver did, by the guest's uptime. Cmdservers that
+// predate it leave it out.
+type IndexResponse struct {
+	Msg    string `json:"msg"`
+	BootMs int64  `json:"bootMs,omitempty"`
+}
+
+// fileData represents a single file's content and metadata. Pattern is the glob or directory of
+// the request that a file was found by.
 type FileData struct {
 	Content string `json:"content"`
 	Path    string `json:"path"`
+	Pattern string `json:"pattern,omitempty"`
 	Error   string `json:"error,omitempty"`
 }
 
-// FilesGetResponse represents multiple files.
+// FilesGetResponse represents multiple files. Truncated is set if globs and directories expanded
+// to more than MaxDownloadFiles files or MaxDownloadBytes bytes, which were left out.
 type FilesGetResponse struct {
-	Files []FileData `json:"files"`
+	Files     []FileData `json:"files"`
+	Truncated bool       `json:"truncated,omitempty"`
 }
 
-// FilePostData represents a single file to be uploaded.
+// IsGlob reports whether a download path is a glob pattern. Cmdservers that predate them read
+// globs as file names, so downloads with any are sent to "/files/read", which those don't have.
+func IsGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// FilePostData represents a single file to be uploaded. Mode, in octal like "0755", sets its
+// permissions and UID and GID its owner. Mkdirs creates missing parent directories, with mode 0755
+// and the same owner. Cmdservers that predate these ignore them on "/files", so requests with any
+// are sent to "/files/write", which those don't have.
 type FilePostData struct {
 	Path    string `json:"path"`
 	Content string `json:"content"`
+	Mode    string `json:"mode,omitempty"`
+	UID     *int   `json:"uid,omitempty"`
+	GID     *int   `json:"gid,omitempty"`
+	Mkdirs  bool   `json:"mkdirs,omitempty"`
+}
+
+// HasOptions reports whether the file sets a mode, owner or mkdirs.
+func (f FilePostData) HasOptions() bool {
+	return f.Mode != "" || f.UID != nil || f.GID != nil || f.Mkdirs
+}
+
+// FileMode returns the permissions of Mode, or false if it's unset.
+func (f FilePostData) FileMode() (os.FileMode, bool, error) {
+	if f.Mode == "" {
+		return 0, false, nil
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 0o7777 {
+		return 0, false, fmt.Errorf("invalid mode %q of %s, must be octal like 0755", f.Mode, f.Path)
+	}
+	// os.FileMode has its own bits for setuid, setgid and sticky.
+	fileMode := os.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode, true, nil
+}
+
+// Validate checks the mode and that the UID and GID aren't negative.
+func (f FilePostData) Validate() error {
+	if _, _, err := f.FileMode(); err != nil {
+		return err
+	}
+	if (f.UID != nil && *f.UID < 0) || (f.GID != nil && *f.GID < 0) {
+		return fmt.Errorf("uid and gid of %s can't be negative", f.Path)
+	}
+	return nil
 }
 
 // FilesPostRequest represents multiple files to be uploaded.
@@ -23,8 +107,186 @@ type FilesPostRequest struct {
 	Files []FilePostData `json:"files"`
 }
 
+// HasOptions reports whether any file sets a mode, owner or mkdirs.
+func (r FilesPostRequest) HasOptions() bool {
+	for _, f := range r.Files {
+		if f.HasOptions() {
+			return true
+		}
+	}
+	return false
+}
+
+// EnvPostRequest sets environment variables of every command run after it, replacing the ones of
+// the same name set before, and writes them to /etc/environment.
+type EnvPostRequest struct {
+	Env map[string]string `json:"env"`
+}
+
+// SecretsPostRequest delivers secrets to the guest. Env is added to the environment of every
+// command run after it, replacing secrets of the same name delivered before, and Files are written
+// with mode 0400 unless they say otherwise, creating missing parent directories. Neither the
+// values nor the file contents are ever logged.
+type SecretsPostRequest struct {
+	Env   map[string]string `json:"env,omitempty"`
+	Files []FilePostData    `json:"files,omitempty"`
+}
+
+// ModulesPostRequest lists kernel modules to load.
+type ModulesPostRequest struct {
+	Modules []string `json:"modules"`
+}
+
+// ModuleLoadResult is the outcome of loading a single kernel module.
+type ModuleLoadResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// ModulesPostResponse has a result for each module in the request, in the same order.
+type ModulesPostResponse struct {
+	Modules []ModuleLoadResult `json:"modules"`
+}
+
+// FilesSearchRequest searches file contents under Path for lines matching the regular expression
+// Pattern. Globs starting with "!" exclude matching paths.
+type FilesSearchRequest struct {
+	Pattern       string   `json:"pattern"`
+	Path          string   `json:"path,omitempty"`
+	Globs         []string `json:"globs,omitempty"`
+	IgnoreCase    bool     `json:"ignore_case,omitempty"`
+	IncludeHidden bool     `json:"include_hidden,omitempty"`
+	MaxResults    int      `json:"max_results,omitempty"`
+}
+
+// SearchMatch is a single matching line. LineNumber starts at 1.
+type SearchMatch struct {
+	Path       string `json:"path"`
+	LineNumber int    `json:"line_number"`
+	Line       string `json:"line"`
+}
+
+// FilesSearchResponse holds the matches in the order they were found.
+type FilesSearchResponse struct {
+	Matches       []SearchMatch `json:"matches"`
+	FilesSearched int           `json:"files_searched"`
+	// Set if the search stopped at MaxResults.
+	Truncated bool `json:"truncated"`
+}
+
+// FsEntry describes a single file as returned by lstat(2), i.e. symlinks aren't followed.
+type FsEntry struct {
+	Name string `json:"name"`
+	// Type and permission bits as in Linux's st_mode.
+	Mode    uint32 `json:"mode"`
+	Size    int64  `json:"size"`
+	Nlink   uint32 `json:"nlink"`
+	Uid     uint32 `json:"uid"`
+	Gid     uint32 `json:"gid"`
+	MtimeNs int64  `json:"mtime_ns"`
+	// Only set for symlinks.
+	LinkTarget string `json:"link_target,omitempty"`
+}
+
+// FsReadDirResponse lists the entries of a directory, without "." and "..".
+type FsReadDirResponse struct {
+	Entries []FsEntry `json:"entries"`
+}
+
+// FsErrorResponse is returned with a non-200 status by the "/fs" endpoints. Errno is the Linux
+// errno of the failed syscall, or 0 if the error didn't come from one.
+type FsErrorResponse struct {
+	Error string `json:"error"`
+	Errno int    `json:"errno"`
+}
+
+// RunCmdRequest runs Cmd with bash. Cwd is relative to the cmdserver's base directory unless
+// absolute, Env is added to the cmdserver's environment and User, a user name or numeric UID, runs
+// the command as that user. Cmdservers that predate the options ignore them on "/cmd", so requests
+// with any are sent to "/exec", which those don't have. If TimeoutSeconds is set, the command's
+// process group is killed once it has run that long; blocking ones are also killed when the caller
+// goes away. Older cmdservers ignore it, leaving the caller's own timeout.
+type RunCmdRequest struct {
+	Cmd            string            `json:"cmd"`
+	Blocking       bool              `json:"blocking"`
+	Cwd            string            `json:"cwd,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	User           string            `json:"user,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// HasOptions reports whether the request sets a working directory, environment or user.
+func (r RunCmdRequest) HasOptions() bool {
+	return r.Cwd != "" || len(r.Env) > 0 || r.User != ""
+}
+
+// Validate checks that environment variable names aren't empty and have no "=", that nothing has a
+// NUL and that the timeout isn't negative.
+func (r RunCmdRequest) Validate() error {
+	for key := range r.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", key)
+		}
+	}
+	if strings.ContainsRune(r.Cwd, 0) || strings.ContainsRune(r.User, 0) {
+		return fmt.Errorf("cwd and user can't contain NUL")
+	}
+	if r.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout can't be negative")
+	}
+	return nil
+}
+
 // RunCmdResponse structure for JSON responses from command execution
 type RunCmdResponse struct {
 	Output string `json:"output,omitempty"`
 	Error  string `json:"error,omitempty"`
-} 
\ No newline at end of file
+	// Set for blocking commands that ran, whether they succeeded or not.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Set for background commands, whose status is at "/cmd/{id}".
+	ID string `json:"id,omitempty"`
+}
+
+// CommandStatus reports a background command. Output is the end of its combined stdout and stderr,
+// Truncated if older output was dropped. ExitCode is set once it exited by itself, Error if it was
+// killed or couldn't be waited for.
+type CommandStatus struct {
+	ID        string     `json:"id"`
+	Cmd       string     `json:"cmd"`
+	Running   bool       `json:"running"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Output    string     `json:"output"`
+	Truncated bool       `json:"truncated,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	ExitedAt  *time.Time `json:"exitedAt,omitempty"`
+} 
+// ContainersHealthResponse reports whether the container engine in the guest can run containers.
+// Engine is empty if the image has none.
+type ContainersHealthResponse struct {
+	Engine  string `json:"engine,omitempty"`
+	Healthy bool   `json:"healthy"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ContainerRunRequest runs Image in the guest's container engine. Command overrides the image's
+// default command. Detached containers keep running after the response and aren't removed.
+type ContainerRunRequest struct {
+	Image          string            `json:"image"`
+	Command        []string          `json:"command,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Workdir        string            `json:"workdir,omitempty"`
+	Detach         bool              `json:"detach,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// ContainerRunResponse holds the output of a container that ran to completion, or the ID of a
+// detached one. Error is set if the engine couldn't be run or the container timed out.
+type ContainerRunResponse struct {
+	ContainerID string `json:"container_id,omitempty"`
+	Stdout      string `json:"stdout"`
+	Stderr      string `json:"stderr"`
+	ExitCode    *int   `json:"exit_code,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
@@ -1,7 +1,13 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -17,6 +23,1005 @@ type PortForwardConfig struct {
 	Description string `mapstructure:"description"`
 }
 
+// TracingConfig configures export of OpenTelemetry spans over OTLP/HTTP.
+type TracingConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Endpoint is the full OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces.
+	Endpoint    string            `mapstructure:"endpoint"`
+	ServiceName string            `mapstructure:"service_name"`
+	Headers     map[string]string `mapstructure:"headers"`
+}
+
+// DrainConfig configures how the restserver drains before exiting. A drain always happens on
+// SIGUSR1; `OnShutdown` extends it to SIGINT and SIGTERM.
+type DrainConfig struct {
+	OnShutdown bool `mapstructure:"on_shutdown"`
+	// Deprecated: use `timeouts.shutdown_drain`, which takes this value when it is unset.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Snapshot running VMs before they are destroyed, so they can be restored after a restart.
+	SnapshotVMs bool `mapstructure:"snapshot_vms"`
+}
+
+// TimeoutsConfig bounds how long the server waits on VMs and the agents inside them. Unset values
+// take their defaults from DefaultTimeouts when the config is loaded.
+type TimeoutsConfig struct {
+	// How long a booted, restored or forked VM has until its agent answers, and its readiness probe
+	// passes, unless the start request sets a timeout.
+	Boot time.Duration `mapstructure:"boot"`
+	// The longest boot timeout a start request may ask for.
+	BootMax time.Duration `mapstructure:"boot_max"`
+	// How long connecting to a guest's agent, over the network or vsock, may take.
+	AgentDial time.Duration `mapstructure:"agent_dial"`
+	// How long a command may run when its request doesn't set a timeout.
+	ExecDefault time.Duration `mapstructure:"exec_default"`
+	// The longest timeout a command request may ask for.
+	ExecMax time.Duration `mapstructure:"exec_max"`
+	// File uploads and downloads are aborted once no data has moved for this long.
+	FileTransferIdle time.Duration `mapstructure:"file_transfer_idle"`
+	// How long cloud-hypervisor may take to write or restore a snapshot.
+	Snapshot time.Duration `mapstructure:"snapshot"`
+	// How long a drain waits for in-flight commands and snapshots.
+	ShutdownDrain time.Duration `mapstructure:"shutdown_drain"`
+}
+
+// DefaultTimeouts are the timeouts used for settings left unset.
+var DefaultTimeouts = TimeoutsConfig{
+	Boot:             time.Minute,
+	BootMax:          10 * time.Minute,
+	AgentDial:        5 * time.Second,
+	ExecDefault:      30 * time.Second,
+	ExecMax:          10 * time.Minute,
+	FileTransferIdle: 30 * time.Second,
+	Snapshot:         5 * time.Minute,
+	ShutdownDrain:    time.Minute,
+}
+
+// resolveTimeouts fills in the unset timeouts of `c` and checks that they're consistent.
+func (c *ServerConfig) resolveTimeouts() error {
+	t := &c.Timeouts
+	if t.ShutdownDrain == 0 && c.Drain.Timeout > 0 {
+		t.ShutdownDrain = c.Drain.Timeout
+	}
+	fields := []struct {
+		key      string
+		value    *time.Duration
+		fallback time.Duration
+	}{
+		{"boot", &t.Boot, DefaultTimeouts.Boot},
+		{"boot_max", &t.BootMax, DefaultTimeouts.BootMax},
+		{"agent_dial", &t.AgentDial, DefaultTimeouts.AgentDial},
+		{"exec_default", &t.ExecDefault, DefaultTimeouts.ExecDefault},
+		{"exec_max", &t.ExecMax, DefaultTimeouts.ExecMax},
+		{"file_transfer_idle", &t.FileTransferIdle, DefaultTimeouts.FileTransferIdle},
+		{"snapshot", &t.Snapshot, DefaultTimeouts.Snapshot},
+		{"shutdown_drain", &t.ShutdownDrain, DefaultTimeouts.ShutdownDrain},
+	}
+	for _, f := range fields {
+		if *f.value < 0 {
+			return fmt.Errorf("timeouts.%s must not be negative: %s", f.key, *f.value)
+		}
+		if *f.value == 0 {
+			*f.value = f.fallback
+		}
+	}
+	if t.BootMax < t.Boot {
+		return fmt.Errorf("timeouts.boot_max (%s) must be at least timeouts.boot (%s)", t.BootMax, t.Boot)
+	}
+	if t.ExecMax < t.ExecDefault {
+		return fmt.Errorf("timeouts.exec_max (%s) must be at least timeouts.exec_default (%s)", t.ExecMax, t.ExecDefault)
+	}
+	return nil
+}
+
+// WarmPoolConfig sizes the host-wide resources kept ready ahead of VM starts.
+type WarmPoolConfig struct {
+	StatefulDisks int32 `mapstructure:"stateful_disks"`
+}
+
+// HostMountConfig controls read-only FUSE mounts of guest filesystems on the host, see the
+// guestfs package.
+type HostMountConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Let users other than the one running the server access the mounts. Requires
+	// user_allow_other in /etc/fuse.conf unless the server runs as root.
+	AllowOther bool `mapstructure:"allow_other"`
+}
+
+// EventsConfig sizes the event stream served at /v1/events. Zero values select the defaults.
+type EventsConfig struct {
+	// Number of recent events kept so that clients can resume from a cursor.
+	History int `mapstructure:"history"`
+	// Events buffered per subscriber before a slow subscriber is cut off with an overflow event.
+	SubscriberBuffer int `mapstructure:"subscriber_buffer"`
+}
+
+// CapacityConfig controls the host usage history that capacity forecasts are made from. Zero values
+// select the defaults.
+type CapacityConfig struct {
+	// How often CPU, memory and disk usage are sampled, e.g. "5m".
+	SampleInterval time.Duration `mapstructure:"sample_interval"`
+	// How long samples are kept, e.g. "336h".
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// ImageCompactionConfig controls how the stateful disks of snapshots are compacted.
+type ImageCompactionConfig struct {
+	// "raw" or "qcow2", the format snapshots are compacted to unless a request picks one. Defaults
+	// to "raw". qcow2 needs qemu-img on the host.
+	Format string `mapstructure:"format"`
+	// Compact every scheduled snapshot once its policy has deleted the expired ones.
+	ScheduledSnapshots bool `mapstructure:"scheduled_snapshots"`
+}
+
+func (c ImageCompactionConfig) validate() error {
+	switch c.Format {
+	case "", "raw", "qcow2":
+		return nil
+	default:
+		return fmt.Errorf("image_compaction.format must be raw or qcow2, not %q", c.Format)
+	}
+}
+
+// GuestTelemetryConfig configures forwarding the logs and metrics that guests collect, as their
+// templates' `telemetry` picks, to an OTLP/HTTP collector. Guests send them to the restserver, so
+// that sandboxes need no egress to the collector.
+type GuestTelemetryConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Full OTLP/HTTP URLs, e.g. http://localhost:4318/v1/logs. Unset ones are derived from
+	// `tracing.endpoint` if it ends with /v1/traces.
+	LogsEndpoint    string `mapstructure:"logs_endpoint"`
+	MetricsEndpoint string `mapstructure:"metrics_endpoint"`
+	// Sent with every export. Defaults to `tracing.headers`.
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// resolveGuestTelemetry fills in the guest telemetry endpoints and headers left unset from the
+// tracing config.
+func (c *ServerConfig) resolveGuestTelemetry() error {
+	t := &c.GuestTelemetry
+	if !t.Enabled {
+		return nil
+	}
+	if base, ok := strings.CutSuffix(c.Tracing.Endpoint, "/v1/traces"); ok {
+		if t.LogsEndpoint == "" {
+			t.LogsEndpoint = base + "/v1/logs"
+		}
+		if t.MetricsEndpoint == "" {
+			t.MetricsEndpoint = base + "/v1/metrics"
+		}
+	}
+	if t.LogsEndpoint == "" || t.MetricsEndpoint == "" {
+		return fmt.Errorf("guest_telemetry needs logs_endpoint and metrics_endpoint, or a tracing.endpoint ending with /v1/traces")
+	}
+	if t.Headers == nil {
+		t.Headers = c.Tracing.Headers
+	}
+	return nil
+}
+
+// LogRotationConfig rotates a log the server keeps once it grows too large or old, and deletes
+// old rotations.
+type LogRotationConfig struct {
+	// Rotate once the log is this large.
+	MaxSizeMB int64 `mapstructure:"max_size_mb"`
+	// Rotate once the log has been written to for this long, e.g. "24h".
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// Rotations kept, the oldest are deleted beyond this many.
+	MaxFiles int `mapstructure:"max_files"`
+	// Delete rotations older than this, e.g. "720h".
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+func (c LogRotationConfig) validate(key string) error {
+	if c.MaxSizeMB < 0 || c.MaxAge < 0 || c.MaxFiles < 0 || c.Retention < 0 {
+		return fmt.Errorf("%s can't have negative values", key)
+	}
+	return nil
+}
+
+// CrashDetectionConfig controls how the server notices that a VM crashed, its hypervisor exiting or
+// its guest agent no longer answering. Zero values select the defaults.
+type CrashDetectionConfig struct {
+	// How often every running VM is checked, e.g. "5s". Defaults to 5s.
+	Interval time.Duration `mapstructure:"interval"`
+	// Checks in a row the guest agent may fail to answer before the VM counts as crashed.
+	// Defaults to 3.
+	MissedHeartbeats int `mapstructure:"missed_heartbeats"`
+}
+
+// HealthConfig configures the deep health check, `GET /v1/health?deep=true`.
+type HealthConfig struct {
+	// VM whose guest agent has to answer, checking networking into guests end to end. Unchecked if
+	// empty.
+	SentinelVM string `mapstructure:"sentinel_vm"`
+	// Free space the state and rootfs directories need. Defaults to 1024.
+	MinFreeDiskMB int `mapstructure:"min_free_disk_mb"`
+}
+
+// HAConfig runs the server as one of several instances sharing a state dir on the same host, of
+// which only the one holding the leader lock manages VMs. The others wait on standby and take the
+// running VMs over once the leader dies.
+type HAConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// File the instances lock, on a filesystem they all can lock. Defaults to
+	// "<state_dir>/leader.lock".
+	LockFile string `mapstructure:"lock_file"`
+	// How often a standby tries to take the lock, e.g. "1s". Defaults to 1s.
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+	// Leave the VMs running on shutdown for a standby to take over, instead of destroying them.
+	KeepVMsOnShutdown bool `mapstructure:"keep_vms_on_shutdown"`
+}
+
+// GCConfig controls the periodic search for resources that no VM or snapshot accounts for, such
+// as tap devices, hypervisors and state directories left behind by crashes. Zero values select
+// the defaults.
+type GCConfig struct {
+	// How often to search, e.g. "10m". Defaults to 10m.
+	Interval time.Duration `mapstructure:"interval"`
+	// How long a resource has to exist before it can be orphaned, so that ones still being set up
+	// are left alone. Defaults to 15m.
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+	// Reclaim what the periodic search finds, instead of only reporting it.
+	Reclaim bool `mapstructure:"reclaim"`
+}
+
+// HookConfig is a command run at a lifecycle transition of every VM, before the hooks of its start
+// request.
+type HookConfig struct {
+	// "pre_start", before the VM is created, "post_boot", once it's ready, or "pre_destroy".
+	Event string `mapstructure:"event"`
+	// Run with bash, with ARRAKIS_HOOK, ARRAKIS_VM_NAME, ARRAKIS_VM_IP and ARRAKIS_VM_STATE_DIR
+	// in the environment.
+	Command string `mapstructure:"command"`
+	// Run in the guest through its agent instead of on the host. Not for pre_start.
+	Guest bool `mapstructure:"guest"`
+	// Defaults to 1m.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// IdleConfig suspends VMs nobody used for a while, to fit more of them on a host. They're resumed
+// on the next call that needs their guest.
+type IdleConfig struct {
+	// How long a VM may go without commands, file transfers, callbacks or other calls into its
+	// guest, e.g. "30m". Idle VMs are left alone if 0.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// "pause" keeps idle VMs in memory, "snapshot" snapshots them and stops their hypervisor to
+	// free their memory too, at the cost of a slower resume. Defaults to pause.
+	Action string `mapstructure:"action"`
+	// How often to look for idle VMs, e.g. "30s". Defaults to 30s.
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+}
+
+// CredentialProfileConfig configures how short-lived cloud credentials are minted for the guests of
+// templates that list the profile in their `credentials`. Guests never see the host's own keys.
+type CredentialProfileConfig struct {
+	// "aws" or "gcp".
+	Provider string `mapstructure:"provider"`
+	// How long minted credentials are valid. Defaults to 15m, the least AWS allows. GCP allows at
+	// most 1h.
+	Duration time.Duration `mapstructure:"duration"`
+
+	// AWS: the role assumed through STS with the host's AccessKeyID and SecretAccessKey, e.g.
+	// arn:aws:iam::123456789012:role/sandbox. Policy, an IAM policy document in JSON, scopes the
+	// session further down.
+	RoleARN         string `mapstructure:"role_arn"`
+	Policy          string `mapstructure:"policy"`
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+
+	// GCP: the service account impersonated with the host's service account key in
+	// CredentialsFile, for Scopes. ProjectID is what the guest's metadata endpoint reports.
+	ServiceAccount  string   `mapstructure:"service_account"`
+	CredentialsFile string   `mapstructure:"credentials_file"`
+	Scopes          []string `mapstructure:"scopes"`
+	ProjectID       string   `mapstructure:"project_id"`
+}
+
+// Default and allowed lifetimes of minted credentials.
+const (
+	DefaultCredentialDuration = 15 * time.Minute
+	maxAWSCredentialDuration  = 12 * time.Hour
+	maxGCPCredentialDuration  = time.Hour
+)
+
+// resolveCredentialProfiles fills in the durations left unset and checks each profile has what its
+// provider needs.
+func (c *ServerConfig) resolveCredentialProfiles() error {
+	for name, p := range c.CredentialProfiles {
+		if p.Duration == 0 {
+			p.Duration = DefaultCredentialDuration
+		}
+		switch p.Provider {
+		case "aws":
+			if p.RoleARN == "" || p.AccessKeyID == "" || p.SecretAccessKey == "" {
+				return fmt.Errorf("credential_profiles.%s needs role_arn, access_key_id and secret_access_key", name)
+			}
+			if p.Duration < DefaultCredentialDuration || p.Duration > maxAWSCredentialDuration {
+				return fmt.Errorf("credential_profiles.%s.duration must be between %s and %s", name, DefaultCredentialDuration, maxAWSCredentialDuration)
+			}
+		case "gcp":
+			if p.ServiceAccount == "" || p.CredentialsFile == "" {
+				return fmt.Errorf("credential_profiles.%s needs service_account and credentials_file", name)
+			}
+			if p.Duration < time.Minute || p.Duration > maxGCPCredentialDuration {
+				return fmt.Errorf("credential_profiles.%s.duration must be between 1m and %s", name, maxGCPCredentialDuration)
+			}
+		default:
+			return fmt.Errorf("credential_profiles.%s.provider must be aws or gcp, not %q", name, p.Provider)
+		}
+		c.CredentialProfiles[name] = p
+	}
+	return nil
+}
+
+// SecretConfig is a secret that VMs can be started with by name. Its value is only read when a VM
+// starts, and only ever sent to the guest.
+type SecretConfig struct {
+	// "value" for Value, "env" for the server's environment variable Env, or "vault" for Field of
+	// the secret at Path, e.g. "secret/data/ci", in Vault's KV engine. Defaults to value.
+	Source string `mapstructure:"source"`
+	Value  string `mapstructure:"value"`
+	Env    string `mapstructure:"env"`
+	Path   string `mapstructure:"path"`
+	Field  string `mapstructure:"field"`
+	// Names of the API keys that may start VMs with the secret, all of them if empty. Admins
+	// always may.
+	Keys []string `mapstructure:"keys"`
+}
+
+// VaultConfig is how secrets with the source "vault" are read.
+type VaultConfig struct {
+	// E.g. https://vault.example.com:8200. Defaults to VAULT_ADDR.
+	Address string `mapstructure:"address"`
+	// Defaults to VAULT_TOKEN.
+	Token string `mapstructure:"token"`
+	// Vault Enterprise namespace, if any.
+	Namespace string `mapstructure:"namespace"`
+}
+
+// resolveSecrets fills in the sources left unset and checks each secret has what its source needs.
+func (c *ServerConfig) resolveSecrets() error {
+	for name, secret := range c.Secrets {
+		if secret.Source == "" {
+			secret.Source = "value"
+		}
+		switch secret.Source {
+		case "value":
+		case "env":
+			if secret.Env == "" {
+				return fmt.Errorf("secrets.%s needs env", name)
+			}
+		case "vault":
+			if secret.Path == "" || secret.Field == "" {
+				return fmt.Errorf("secrets.%s needs path and field", name)
+			}
+		default:
+			return fmt.Errorf("secrets.%s.source must be value, env or vault, not %q", name, secret.Source)
+		}
+		c.Secrets[name] = secret
+	}
+	return nil
+}
+
+// IPAMConfig configures the pools guests get their IPs from.
+type IPAMConfig struct {
+	// Where allocations are saved, so that a restarted server doesn't hand out the IPs of guests
+	// that still run. Defaults to "<state_dir>/ipam.json".
+	StateFile string `mapstructure:"state_file"`
+	// Keyed by name. Guests get IPs from "default" unless they're started with another pool, and
+	// "default" is bridge_subnet unless it's configured here.
+	Pools map[string]IPPoolConfig `mapstructure:"pools"`
+}
+
+// IPPoolConfig is a set of subnets guests get IPs from. The bridge gets bridge_ip on the subnet
+// that has it and the first address of every other one, which guests on it route through.
+type IPPoolConfig struct {
+	// E.g. "10.20.2.0/24". Subnets of all pools must not overlap.
+	CIDRs []string `mapstructure:"cidrs"`
+	// IPs, e.g. "10.20.2.10", and inclusive ranges, e.g. "10.20.2.100-10.20.2.150", that are never
+	// handed out.
+	Reserved []string `mapstructure:"reserved"`
+}
+
+// NetworkModesConfig configures the network modes VMs can be started in. In "nat" they're on the
+// server's bridge and reach the outside through the host's masquerading.
+type NetworkModesConfig struct {
+	// "nat", "bridged", "host_only" or "none", for VMs started without one. Defaults to "nat".
+	Default  string                `mapstructure:"default"`
+	Bridged  BridgedNetworkConfig  `mapstructure:"bridged"`
+	HostOnly HostOnlyNetworkConfig `mapstructure:"host_only"`
+}
+
+// BridgedNetworkConfig attaches VMs to an existing bridge, e.g. one with the host's uplink, so that
+// they're on its network directly.
+type BridgedNetworkConfig struct {
+	// Empty disables the mode. The server never creates or changes it.
+	Bridge string `mapstructure:"bridge"`
+	// The IP pool of addresses on the bridge's network, which reserves those of other hosts.
+	Pool string `mapstructure:"pool"`
+	// The network's router, e.g. "192.168.1.1".
+	Gateway string `mapstructure:"gateway"`
+}
+
+// HostOnlyNetworkConfig puts VMs on a bridge of their own, on which they reach the host and each
+// other but nothing else. VMs without a network, "none", get their IPs from the same pool, on a
+// link on which the host reaches their agent but they can't start connections at all.
+type HostOnlyNetworkConfig struct {
+	// Created by the server. Defaults to "arrakis-ho".
+	Bridge string `mapstructure:"bridge"`
+	// Empty disables host_only and none.
+	Pool string `mapstructure:"pool"`
+}
+
+// EgressConfig configures how the egress policies of VMs are enforced. VMs with egress domains
+// resolve names through a DNS proxy of the server, which only answers for those domains.
+type EgressConfig struct {
+	// Port on bridge_ip the DNS proxy listens on. Defaults to 10053.
+	DNSPort int `mapstructure:"dns_port"`
+	// Resolver the DNS proxy asks, "host" or "host:port". Defaults to the first nameserver of the
+	// host's /etc/resolv.conf.
+	DNSUpstream string `mapstructure:"dns_upstream"`
+}
+
+// SharedDirsConfig configures the host directories VMs can get shared into the guest over
+// virtiofs, or over 9P for guests without it.
+type SharedDirsConfig struct {
+	// Directories that shared directories must be in. Empty disables shared directories.
+	AllowedPaths []string `mapstructure:"allowed_paths"`
+	// The virtiofsd binary serving each shared directory. Defaults to "virtiofsd" on the PATH.
+	// Without it, directories are only shared over 9P.
+	Virtiofsd string `mapstructure:"virtiofsd"`
+}
+
+// resolveSharedDirs fills in the virtiofsd binary and checks the allowed paths.
+func (c *ServerConfig) resolveSharedDirs() error {
+	if c.SharedDirs.Virtiofsd == "" {
+		c.SharedDirs.Virtiofsd = "virtiofsd"
+	}
+	for i, p := range c.SharedDirs.AllowedPaths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("shared_dirs.allowed_paths must be absolute, not %q", p)
+		}
+		c.SharedDirs.AllowedPaths[i] = path.Clean(p)
+	}
+	return nil
+}
+
+// HypervisorSandboxConfig confines the cloud-hypervisor processes of VMs, so that a guest that
+// escapes into its hypervisor gets as little of the host as possible. Applies to hypervisors
+// started after it's set.
+type HypervisorSandboxConfig struct {
+	// The hypervisor's seccomp filter: "true" for its built-in allowlist of syscalls, which kills
+	// it on any other, "log" to only log other syscalls, "false" for none. Defaults to "true".
+	Seccomp string `mapstructure:"seccomp"`
+	// Start the hypervisor with no_new_privs set, so that neither it nor anything it execs can
+	// gain privileges through setuid binaries or file capabilities.
+	NoNewPrivs bool `mapstructure:"no_new_privs"`
+	// Capabilities the hypervisor keeps, e.g. CAP_NET_ADMIN for opening tap devices it doesn't own;
+	// all others are dropped from its bounding set. Empty keeps the server's.
+	Capabilities []string `mapstructure:"capabilities"`
+	// Start the hypervisor in a mount namespace of its own in which the host's file systems are
+	// read-only, except state_dir and the volumes.
+	ReadOnlyMounts bool `mapstructure:"read_only_mounts"`
+}
+
+// Sandboxed returns whether the hypervisor is started through the sandbox's helpers.
+func (c HypervisorSandboxConfig) Sandboxed() bool {
+	return c.NoNewPrivs || len(c.Capabilities) > 0 || c.ReadOnlyMounts
+}
+
+// resolveHypervisorSandbox fills in the seccomp filter and checks the capabilities.
+func (c *ServerConfig) resolveHypervisorSandbox() error {
+	sandbox := &c.HypervisorSandbox
+	switch sandbox.Seccomp {
+	case "":
+		sandbox.Seccomp = "true"
+	case "true", "log", "false":
+	default:
+		return fmt.Errorf("hypervisor_sandbox.seccomp must be true, log or false, not %q", sandbox.Seccomp)
+	}
+	for i, capability := range sandbox.Capabilities {
+		capability = strings.ToUpper(capability)
+		name, ok := strings.CutPrefix(capability, "CAP_")
+		if !ok || name == "" || strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") != "" {
+			return fmt.Errorf("hypervisor_sandbox.capabilities must be capabilities like CAP_NET_ADMIN, not %q", sandbox.Capabilities[i])
+		}
+		sandbox.Capabilities[i] = capability
+	}
+	return nil
+}
+
+// JailerConfig runs the hypervisor of each VM like Firecracker's jailer does: chrooted into a
+// directory of its own that only has the device nodes and files the hypervisor needs bound into
+// it, as a user of its own and in a cgroup of its own.
+type JailerConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Where the chroots are created, one directory per VM. Defaults to <state_dir>/jails.
+	ChrootBaseDir string `mapstructure:"chroot_base_dir"`
+	// Each hypervisor runs as a user, and group of the same ID, of its own from uid_base up to
+	// uid_base + 65535. Defaults to 400000.
+	UIDBase int `mapstructure:"uid_base"`
+	// The cgroup v2, relative to /sys/fs/cgroup, that the cgroups of the hypervisors are created
+	// under. Defaults to "arrakis".
+	CgroupParent string `mapstructure:"cgroup_parent"`
+}
+
+// HypervisorCgroupsConfig puts the hypervisor of each VM into a cgroup v2 of its own, limited to
+// the vCPUs and memory of its VM.
+type HypervisorCgroupsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// The cgroup, relative to /sys/fs/cgroup, that the hypervisors' cgroups are created under.
+	// Jailed hypervisors stay in their jail's cgroup. Defaults to "arrakis".
+	Parent string `mapstructure:"parent"`
+	// The cpu.weight of a hypervisor for each vCPU of its VM, up to 10000 in all. Defaults to 100,
+	// the weight of other processes.
+	CPUWeightPerVCPU int `mapstructure:"cpu_weight_per_vcpu"`
+	// The CPU time a hypervisor may use, in percent of its VM's vCPUs. Defaults to 100, negative
+	// for no quota.
+	CPUQuotaPercent int `mapstructure:"cpu_quota_percent"`
+	// The memory a hypervisor may use on top of its guest's, which includes what can be
+	// hot-plugged into it. Defaults to 256.
+	MemoryOverheadMB int `mapstructure:"memory_overhead_mb"`
+	// Per hypervisor, on the disk holding state_dir.
+	IO HypervisorIOConfig `mapstructure:"io"`
+}
+
+// HypervisorIOConfig caps the IO of each hypervisor, 0 for no cap.
+type HypervisorIOConfig struct {
+	ReadBPS   int64 `mapstructure:"read_bps"`
+	WriteBPS  int64 `mapstructure:"write_bps"`
+	ReadIOPS  int64 `mapstructure:"read_iops"`
+	WriteIOPS int64 `mapstructure:"write_iops"`
+}
+
+// APIConfig configures the versions of the REST API. v2 is current, v1 is deprecated but still
+// served.
+type APIConfig struct {
+	// The date v1 stops being served on, e.g. "2027-06-30", announced to v1 callers in a Sunset
+	// header. If empty v1 responses only say it is deprecated.
+	V1Sunset string `mapstructure:"v1_sunset"`
+}
+
+// resolveHypervisorCgroups fills in the defaults of the hypervisors' cgroups.
+func (c *ServerConfig) resolveHypervisorCgroups() error {
+	cgroups := &c.HypervisorCgroups
+	if cgroups.Parent == "" {
+		cgroups.Parent = "arrakis"
+	}
+	parent := strings.Trim(path.Clean(cgroups.Parent), "/")
+	if parent == "." || strings.HasPrefix(parent, "..") {
+		return fmt.Errorf("hypervisor_cgroups.parent must be a cgroup below /sys/fs/cgroup, not %q", cgroups.Parent)
+	}
+	cgroups.Parent = parent
+	if cgroups.CPUWeightPerVCPU == 0 {
+		cgroups.CPUWeightPerVCPU = 100
+	}
+	if cgroups.CPUQuotaPercent == 0 {
+		cgroups.CPUQuotaPercent = 100
+	}
+	if cgroups.MemoryOverheadMB == 0 {
+		cgroups.MemoryOverheadMB = 256
+	}
+	if cgroups.CPUWeightPerVCPU < 0 || cgroups.MemoryOverheadMB < 0 {
+		return fmt.Errorf("hypervisor_cgroups.cpu_weight_per_vcpu and memory_overhead_mb can't be negative")
+	}
+	io := cgroups.IO
+	if io.ReadBPS < 0 || io.WriteBPS < 0 || io.ReadIOPS < 0 || io.WriteIOPS < 0 {
+		return fmt.Errorf("hypervisor_cgroups.io limits can't be negative")
+	}
+	return nil
+}
+
+// resolveAPI checks the date v1 of the API is sunset on.
+func (c *ServerConfig) resolveAPI() error {
+	if c.API.V1Sunset == "" {
+		return nil
+	}
+	if _, err := time.Parse(time.DateOnly, c.API.V1Sunset); err != nil {
+		return fmt.Errorf("api.v1_sunset must be a date like 2027-06-30, not %q", c.API.V1Sunset)
+	}
+	return nil
+}
+
+// resolveJailer fills in the jailer's defaults and makes its chroots' directory absolute, which
+// they're bound into by.
+func (c *ServerConfig) resolveJailer() error {
+	jailer := &c.Jailer
+	if jailer.ChrootBaseDir == "" {
+		jailer.ChrootBaseDir = path.Join(c.StateDir, "jails")
+	}
+	dir, err := filepath.Abs(jailer.ChrootBaseDir)
+	if err != nil {
+		return fmt.Errorf("invalid jailer.chroot_base_dir: %w", err)
+	}
+	jailer.ChrootBaseDir = dir
+	if jailer.UIDBase == 0 {
+		jailer.UIDBase = 400000
+	}
+	if jailer.UIDBase < 1 {
+		return fmt.Errorf("jailer.uid_base must be positive, not %d", jailer.UIDBase)
+	}
+	if jailer.CgroupParent == "" {
+		jailer.CgroupParent = "arrakis"
+	}
+	jailer.CgroupParent = strings.Trim(path.Clean(jailer.CgroupParent), "/")
+	if jailer.CgroupParent == "." || strings.HasPrefix(jailer.CgroupParent, "..") {
+		return fmt.Errorf("jailer.cgroup_parent must be a cgroup below /sys/fs/cgroup, not %q", c.Jailer.CgroupParent)
+	}
+	return nil
+}
+
+// resolveBaseImages checks that base images have absolute paths, since VMs' disks refer to them by
+// path, and that templates only name existing ones.
+func (c *ServerConfig) resolveBaseImages() error {
+	for name, p := range c.BaseImages {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("base_images.%s must be an absolute path, not %q", name, p)
+		}
+		c.BaseImages[name] = path.Clean(p)
+	}
+	for name, tmpl := range c.Templates {
+		if _, ok := c.BaseImages[tmpl.BaseImage]; tmpl.BaseImage != "" && !ok {
+			return fmt.Errorf("template %s has unknown base_image %q", name, tmpl.BaseImage)
+		}
+	}
+	return nil
+}
+
+// resolveVolumes checks that volumes have absolute paths, since VMs' disks refer to them by path.
+func (c *ServerConfig) resolveVolumes() error {
+	for name, p := range c.Volumes {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("volumes.%s must be an absolute path, not %q", name, p)
+		}
+		c.Volumes[name] = path.Clean(p)
+	}
+	return nil
+}
+
+// resolveEgress fills in the DNS proxy's port and checks the upstream resolver.
+func (c *ServerConfig) resolveEgress() error {
+	if c.Egress.DNSPort == 0 {
+		c.Egress.DNSPort = 10053
+	}
+	if c.Egress.DNSPort < 1 || c.Egress.DNSPort > 65535 {
+		return fmt.Errorf("egress.dns_port must be between 1 and 65535, not %d", c.Egress.DNSPort)
+	}
+	if upstream := c.Egress.DNSUpstream; upstream != "" {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			c.Egress.DNSUpstream = net.JoinHostPort(upstream, "53")
+		}
+	}
+	return nil
+}
+
+// resolveNetworkModes fills in the defaults and checks each mode's pool exists and isn't the
+// default one, whose VMs are behind NAT.
+func (c *ServerConfig) resolveNetworkModes() error {
+	modes := &c.NetworkModes
+	if modes.Default == "" {
+		modes.Default = "nat"
+	}
+	if modes.HostOnly.Bridge == "" {
+		modes.HostOnly.Bridge = "arrakis-ho"
+	}
+	switch modes.Default {
+	case "nat":
+	case "bridged":
+		if modes.Bridged.Bridge == "" {
+			return fmt.Errorf("network_modes.default is bridged but network_modes.bridged.bridge isn't set")
+		}
+	case "host_only", "none":
+		if modes.HostOnly.Pool == "" {
+			return fmt.Errorf("network_modes.default is %s but network_modes.host_only.pool isn't set", modes.Default)
+		}
+	default:
+		return fmt.Errorf("network_modes.default must be nat, bridged, host_only or none, not %q", modes.Default)
+	}
+	if modes.Bridged.Bridge == "" {
+		// The mode is off, its pool is an ordinary one.
+		modes.Bridged = BridgedNetworkConfig{}
+	} else {
+		if _, ok := c.IPAM.Pools[modes.Bridged.Pool]; !ok || modes.Bridged.Pool == "default" {
+			return fmt.Errorf("network_modes.bridged.pool must be a pool of ipam.pools other than default")
+		}
+		if modes.Bridged.Gateway == "" {
+			return fmt.Errorf("network_modes.bridged needs gateway")
+		}
+	}
+	if modes.HostOnly.Pool != "" {
+		if _, ok := c.IPAM.Pools[modes.HostOnly.Pool]; !ok || modes.HostOnly.Pool == "default" {
+			return fmt.Errorf("network_modes.host_only.pool must be a pool of ipam.pools other than default")
+		}
+		if modes.HostOnly.Pool == modes.Bridged.Pool {
+			return fmt.Errorf("network_modes.host_only.pool and network_modes.bridged.pool must differ")
+		}
+	}
+	return nil
+}
+
+// resolveIPAM fills in the state file and the default pool if they're left unset.
+func (c *ServerConfig) resolveIPAM() error {
+	if c.IPAM.StateFile == "" {
+		c.IPAM.StateFile = path.Join(c.StateDir, "ipam.json")
+	}
+	if c.IPAM.Pools == nil {
+		c.IPAM.Pools = make(map[string]IPPoolConfig)
+	}
+	if _, ok := c.IPAM.Pools["default"]; !ok {
+		c.IPAM.Pools["default"] = IPPoolConfig{CIDRs: []string{c.BridgeSubnet}}
+	}
+	for name, pool := range c.IPAM.Pools {
+		if len(pool.CIDRs) == 0 {
+			return fmt.Errorf("ipam.pools.%s needs cidrs", name)
+		}
+	}
+	return nil
+}
+
+// SnapshotStoreConfig configures the S3-compatible bucket that snapshots are exported to. Google
+// Cloud Storage works too, through its XML API at https://storage.googleapis.com with HMAC keys.
+type SnapshotStoreConfig struct {
+	// E.g. https://s3.us-east-1.amazonaws.com. Empty disables exports.
+	Endpoint string `mapstructure:"endpoint"`
+	// Defaults to us-east-1.
+	Region string `mapstructure:"region"`
+	Bucket string `mapstructure:"bucket"`
+	// Put in front of object keys, e.g. "arrakis/snapshots/".
+	Prefix          string `mapstructure:"prefix"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	// Address the bucket as <endpoint>/<bucket> instead of as a subdomain of the endpoint, as
+	// most self-hosted stores, e.g. MinIO, need.
+	PathStyle bool `mapstructure:"path_style"`
+}
+
+// APIKeyConfig is a credential clients send as "Authorization: Bearer <key>". VMs are owned by the
+// key, by name, that created them.
+type APIKeyConfig struct {
+	Name string `mapstructure:"name"`
+	Key  string `mapstructure:"key"`
+	// Admins may act on VMs owned by other keys and use the /v1/admin endpoints.
+	Admin bool `mapstructure:"admin"`
+}
+
+// OIDCRoleConfig grants permissions to OIDC tokens that carry a role.
+type OIDCRoleConfig struct {
+	Role        string   `mapstructure:"role"`
+	Permissions []string `mapstructure:"permissions"`
+}
+
+// OIDCConfig lets clients authenticate with ID or access tokens from an OpenID Connect provider
+// instead of API keys. Claims can be nested, e.g. "realm_access.roles".
+type OIDCConfig struct {
+	// Must match the "iss" claim. The provider's discovery document is read from under it.
+	Issuer string `mapstructure:"issuer"`
+	// Must be one of the token's "aud" claim.
+	Audience string `mapstructure:"audience"`
+	// Overrides the "jwks_uri" of the discovery document.
+	JWKSURL string `mapstructure:"jwks_url"`
+	// How often signing keys are re-fetched, e.g. "1h". Tokens signed with an unknown key also
+	// trigger a fetch.
+	JWKSRefresh time.Duration `mapstructure:"jwks_refresh"`
+	// Claim naming the user, who owns the VMs they create. Defaults to "sub".
+	NameClaim string `mapstructure:"name_claim"`
+	// Claim listing the user's roles, which `Roles` map to permissions. Defaults to "roles".
+	RolesClaim string           `mapstructure:"roles_claim"`
+	Roles      []OIDCRoleConfig `mapstructure:"roles"`
+	// Claim listing the namespaces the user may use. Tokens without it are rejected. If unset
+	// users may use every namespace.
+	NamespacesClaim string `mapstructure:"namespaces_claim"`
+}
+
+// AuthConfig controls API authentication. With no API keys or OIDC issuer configured the API is
+// open.
+type AuthConfig struct {
+	APIKeys []APIKeyConfig `mapstructure:"api_keys"`
+	OIDC    OIDCConfig     `mapstructure:"oidc"`
+}
+
+// CallbackConfig configures the callback sessions clients hold open over WebSocket to answer
+// callbacks from their VMs.
+type CallbackConfig struct {
+	// How long a session whose connection dropped waits for the client to reconnect, e.g. "30s".
+	ReconnectGrace time.Duration `mapstructure:"reconnect_grace"`
+	// Callbacks buffered per session while its client is away. Callbacks beyond it fail.
+	BufferSize int `mapstructure:"buffer_size"`
+	// Destroy a VM once its client has been gone for the whole grace period. Superseded by
+	// disconnect_policy.
+	DestroyVMOnClose bool `mapstructure:"destroy_vm_on_close"`
+	// What happens to VMs that didn't choose a disconnect policy once their client has been gone
+	// for the whole grace period: "destroy", "pause", "snapshot" (then destroy) or "keep".
+	// Defaults to destroy with destroy_vm_on_close, keep otherwise.
+	DisconnectPolicy string `mapstructure:"disconnect_policy"`
+	// With keep, how long a VM waits for a client to connect again before it's destroyed, e.g.
+	// "1h". Kept for good if 0.
+	DisconnectTTL time.Duration `mapstructure:"disconnect_ttl"`
+	// How long callbacks made while a VM has no session are kept for a client to connect, e.g.
+	// "5m".
+	QueueTTL time.Duration `mapstructure:"queue_ttl"`
+	// Callbacks queued per VM. Callbacks beyond it fail.
+	QueueSize int                 `mapstructure:"queue_size"`
+	Retry     CallbackRetryConfig `mapstructure:"retry"`
+}
+
+// CallbackRetryConfig configures how callbacks that fail on their way to the client, e.g. because
+// its connection dropped or its callback URL answered with a 5xx, are retried. Errors the client
+// answers with aren't retried.
+type CallbackRetryConfig struct {
+	// Retries after the first attempt. Defaults to none.
+	MaxRetries int `mapstructure:"max_retries"`
+	// Wait before the first retry, e.g. "200ms", doubled for each further retry up to
+	// MaxBackoff. Defaults to 200ms and 5s.
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	// Retries for specific methods, overriding MaxRetries, e.g. 0 for methods that mustn't run
+	// twice. Method names are matched regardless of case.
+	Methods map[string]int `mapstructure:"methods"`
+}
+
+// WebSocketConfig configures the WebSocket endpoints.
+type WebSocketConfig struct {
+	// Origins, e.g. "https://app.example.com", that browsers may open WebSockets from besides
+	// the server's own. Requests without an Origin header, i.e. not from a browser, are always
+	// allowed. If empty the origins of middlewares.cors are; "*" allows any.
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// Largest message, in bytes, read from a WebSocket client. Larger payloads are sent in chunks.
+	// Defaults to 512KiB.
+	MaxMessageSize int64 `mapstructure:"max_message_size"`
+	// Largest payload, in bytes, put back together from chunks. Defaults to 32MiB.
+	MaxChunkedSize int64 `mapstructure:"max_chunked_size"`
+}
+
+// MiddlewaresConfig orders and configures the middlewares that API requests pass through.
+type MiddlewaresConfig struct {
+	// Names of the middlewares, outermost first. Defaults to request_id, tracing, cors,
+	// rate_limit, auth, audit, validation and migration_redirect. Middlewares left out are
+	// disabled. cors must come before auth to answer preflights, and validation after it since
+	// it checks the namespaces the caller may use.
+	Order     []string        `mapstructure:"order"`
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	CORS      CORSConfig      `mapstructure:"cors"`
+	Audit     AuditConfig     `mapstructure:"audit"`
+}
+
+// RateLimitConfig limits requests per caller, i.e. per API key once auth ran and per client IP
+// before it or for anonymous callers. Guests and health checks aren't limited.
+type RateLimitConfig struct {
+	// Zero disables the limit.
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	// Requests a caller may make at once after being idle. Defaults to RequestsPerSecond,
+	// rounded up.
+	Burst int `mapstructure:"burst"`
+}
+
+// CORSConfig lets browser apps on other origins call the API.
+type CORSConfig struct {
+	// Origins, e.g. "https://app.example.com", or "*" for any. If empty no cross-origin
+	// requests are allowed.
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// Methods allowed origins may use. Defaults to GET, HEAD, POST, PUT, PATCH and DELETE.
+	AllowedMethods []string `mapstructure:"allowed_methods"`
+	// Request headers allowed origins may send, or "*" for any. Defaults to Authorization,
+	// Content-Type, If-None-Match, X-API-Key and X-Request-ID.
+	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	// How long browsers may cache a preflight, e.g. "10m". Defaults to 10m.
+	MaxAge time.Duration `mapstructure:"max_age"`
+}
+
+// AuditConfig records who changed what through the API.
+type AuditConfig struct {
+	// File that records are appended to as JSON lines. If empty they go to the server log.
+	Path string `mapstructure:"path"`
+	// Record reads as well, not only requests that change state.
+	IncludeReads bool `mapstructure:"include_reads"`
+	// Rotation of the file at Path. Unset limits don't apply, so by default it is never rotated.
+	Rotation LogRotationConfig `mapstructure:"rotation"`
+}
+
+// ListenerConfig is an extra address the API is served on besides host:port.
+type ListenerConfig struct {
+	// "host:port", or "unix:<path>" for a Unix socket.
+	Address string `mapstructure:"address"`
+	// Permissions of a Unix socket, e.g. "0660". Defaults to "0600".
+	SocketMode string `mapstructure:"socket_mode"`
+	// Middlewares skipped for requests on this listener, e.g. auth on a Unix socket whose
+	// permissions already restrict who can connect.
+	DisableMiddlewares []string `mapstructure:"disable_middlewares"`
+}
+
+// TemplateConfig is a named set of guest images that VMs can be started from. Each image is either
+// a local path or an http(s) URL that is downloaded into the server's image cache on first use.
+// Images left empty fall back to the server-wide defaults.
+type TemplateConfig struct {
+	Kernel    string `mapstructure:"kernel"`
+	Rootfs    string `mapstructure:"rootfs"`
+	Initramfs string `mapstructure:"initramfs"`
+	// Applied inside the guest at boot, each in key=value form e.g.
+	// fs.inotify.max_user_watches=524288. A list rather than a map since viper would split the
+	// dotted keys.
+	Sysctls []string `mapstructure:"sysctls"`
+	// Default resource limits for commands run inside the guest keyed by limits.conf name, e.g.
+	// nofile. Values are either a single limit or "soft:hard".
+	Ulimits map[string]string `mapstructure:"ulimits"`
+	// Kernel modules loaded inside the guest at boot. Each must be in the server's
+	// `kernel_module_allowlist`.
+	KernelModules []string `mapstructure:"kernel_modules"`
+	// HTTP services in the guest, keyed by name, and the vsock ports they listen on, e.g.
+	// metrics: 9100. The server proxies requests to them. The agent is always registered as
+	// "agent".
+	VsockServices map[string]uint32 `mapstructure:"vsock_services"`
+	// Configures the container engine of images built with one, see ContainerRuntimeConfig.
+	ContainerRuntime ContainerRuntimeConfig `mapstructure:"container_runtime"`
+	// "systemd" or "agent", which boots the guest with arrakis-guestinit as its init. Empty picks
+	// systemd if the image has it.
+	Init string `mapstructure:"init"`
+	// Logs and metrics the guest forwards to the host, if the server's `guest_telemetry` is
+	// enabled.
+	Telemetry TelemetryConfig `mapstructure:"telemetry"`
+	// Names of the `credential_profiles` the guest may get short-lived cloud credentials of.
+	Credentials []string `mapstructure:"credentials"`
+	// Number of VMs to keep pre-booted for the template.
+	PoolVMs int32 `mapstructure:"pool_vms"`
+	// Protects VMs started from the template, so that they're only stopped or destroyed when an
+	// admin forces it.
+	Protected bool `mapstructure:"protected"`
+	// Caps the traffic of VMs started from the template, unless their start caps it differently.
+	NetworkLimit NetworkLimitConfig `mapstructure:"network_limit"`
+	// Caps the IO of each disk of VMs started from the template, unless their start caps it
+	// differently.
+	DiskLimit DiskLimitConfig `mapstructure:"disk_limit"`
+	// Name of the `base_images` entry the stateful disks of the template's VMs start from, unless
+	// their start picks another. Empty starts them blank.
+	BaseImage string `mapstructure:"base_image"`
+	// tmpfs mounted in the guest at boot in path:size_mb form, e.g. /tmp:512 or /dev/shm:256,
+	// unless their start sizes them differently.
+	Tmpfs []string `mapstructure:"tmpfs"`
+	// Size of a swap file on the stateful disk of the template's VMs, none if 0, unless their start
+	// picks another.
+	SwapMB int64 `mapstructure:"swap_mb"`
+}
+
+// NetworkLimitConfig caps the traffic of a VM's network device, ingress being what the VM receives
+// and egress what it sends. 0 leaves a direction unlimited.
+type NetworkLimitConfig struct {
+	IngressMbps int32 `mapstructure:"ingress_mbps"`
+	EgressMbps  int32 `mapstructure:"egress_mbps"`
+	// Packets per second.
+	IngressPPS int32 `mapstructure:"ingress_pps"`
+	EgressPPS  int32 `mapstructure:"egress_pps"`
+}
+
+// DiskLimitConfig caps the IO of a VM's disk, reads and writes together. 0 leaves it unlimited.
+type DiskLimitConfig struct {
+	BytesPerSecond int64 `mapstructure:"bytes_per_second"`
+	IOPS           int32 `mapstructure:"iops"`
+}
+
+// ContainerRuntimeConfig sets up Docker or Podman inside guests whose rootfs was built with
+// `rootfsmaker create --container-runtime`. guestinit writes the engine's configuration at boot,
+// before the engine starts.
+type ContainerRuntimeConfig struct {
+	// "docker" or "podman". Empty leaves the engine's configuration alone.
+	Engine string `mapstructure:"engine"`
+	// Defaults to "fuse-overlayfs" for Docker and "overlay", backed by fuse-overlayfs, for Podman
+	// since the guest's root is itself an overlayfs. "vfs" needs no FUSE but copies every layer.
+	StorageDriver string `mapstructure:"storage_driver"`
+	// "systemd" or "cgroupfs". Defaults to "systemd".
+	CgroupDriver string `mapstructure:"cgroup_driver"`
+}
+
+// TelemetryConfig picks what a template's guests collect and forward to the host.
+type TelemetryConfig struct {
+	// Absolute paths of files whose new lines are forwarded as logs. Rotated files are followed.
+	LogFiles []string `mapstructure:"log_files"`
+	// Forward the systemd journal as logs.
+	Journald bool `mapstructure:"journald"`
+	// Accept OTLP/HTTP JSON logs and metrics from the workload on 127.0.0.1:4318.
+	OTLP bool `mapstructure:"otlp"`
+}
+
 type ServerConfig struct {
 	Host               string              `mapstructure:"host"`
 	Port               string              `mapstructure:"port"`
@@ -31,6 +1036,67 @@ type ServerConfig struct {
 	InitramfsPath      string              `mapstructure:"initramfs"`
 	StatefulSizeInMB   int32               `mapstructure:"stateful_size_in_mb"`
 	GuestMemPercentage int32               `mapstructure:"guest_mem_percentage"`
+	Tracing            TracingConfig       `mapstructure:"tracing"`
+	Drain              DrainConfig         `mapstructure:"drain"`
+	Timeouts           TimeoutsConfig      `mapstructure:"timeouts"`
+	WarmPool           WarmPoolConfig      `mapstructure:"warm_pool"`
+	// One of logrus' levels, e.g. "debug". Defaults to "info".
+	LogLevel string `mapstructure:"log_level"`
+	// Kernel modules that templates and the module load API may load inside guests.
+	KernelModuleAllowlist []string `mapstructure:"kernel_module_allowlist"`
+	// Keyed by template name.
+	Templates  map[string]TemplateConfig `mapstructure:"templates"`
+	HostMounts HostMountConfig           `mapstructure:"host_mounts"`
+	// How long VM listings may be served from cache, e.g. "1s". They are also refreshed as soon as
+	// a VM changes. Zero disables the cache.
+	ReadCacheTTL time.Duration   `mapstructure:"read_cache_ttl"`
+	Events       EventsConfig    `mapstructure:"events"`
+	Capacity     CapacityConfig  `mapstructure:"capacity"`
+	Auth         AuthConfig      `mapstructure:"auth"`
+	Callbacks    CallbackConfig  `mapstructure:"callbacks"`
+	WebSocket    WebSocketConfig `mapstructure:"websocket"`
+	// Rewrite invalid VM names, e.g. "my app/v1.2" to "my-app-v1-2", instead of rejecting them.
+	NormalizeVMNames bool                  `mapstructure:"normalize_vm_names"`
+	SnapshotStore    SnapshotStoreConfig   `mapstructure:"snapshot_store"`
+	Middlewares      MiddlewaresConfig     `mapstructure:"middlewares"`
+	Listeners        []ListenerConfig      `mapstructure:"listeners"`
+	ImageCompaction  ImageCompactionConfig `mapstructure:"image_compaction"`
+	GuestTelemetry   GuestTelemetryConfig  `mapstructure:"guest_telemetry"`
+	// Keyed by name.
+	CredentialProfiles map[string]CredentialProfileConfig `mapstructure:"credential_profiles"`
+	// Rotation of the serial console and hypervisor logs in each VM's state dir. Zero values
+	// select the defaults.
+	ConsoleLogs    LogRotationConfig    `mapstructure:"console_logs"`
+	CrashDetection CrashDetectionConfig `mapstructure:"crash_detection"`
+	Health         HealthConfig         `mapstructure:"health"`
+	HA             HAConfig             `mapstructure:"ha"`
+	GC             GCConfig             `mapstructure:"gc"`
+	Idle           IdleConfig           `mapstructure:"idle"`
+	Hooks          []HookConfig         `mapstructure:"hooks"`
+	// Lets admins add host hooks to start and fork requests. They run as root on the host, so
+	// they're refused while auth is disabled even with this set.
+	APIHostHooks bool `mapstructure:"api_host_hooks"`
+	// Keyed by name.
+	Secrets      map[string]SecretConfig `mapstructure:"secrets"`
+	Vault        VaultConfig             `mapstructure:"vault"`
+	IPAM         IPAMConfig              `mapstructure:"ipam"`
+	NetworkModes NetworkModesConfig      `mapstructure:"network_modes"`
+	Egress       EgressConfig            `mapstructure:"egress"`
+	SharedDirs   SharedDirsConfig        `mapstructure:"shared_dirs"`
+	// Give each VM a network namespace of its own, with its hypervisor and tap device in it and a
+	// veth to the host in the tap device's place.
+	NetworkNamespaces bool `mapstructure:"network_namespaces"`
+	// Raw ext4 images that VMs' stateful disks can start from, keyed by name, e.g. with datasets
+	// or toolchains on them. VMs get copy-on-write views of them, never full copies.
+	BaseImages map[string]string `mapstructure:"base_images"`
+	// Disk images, keyed by name, that VMs can have attached as data disks. Unlike base images,
+	// VMs write to the images themselves, so what they write outlives them.
+	Volumes map[string]string `mapstructure:"volumes"`
+	// Confines the hypervisors of VMs.
+	HypervisorSandbox HypervisorSandboxConfig `mapstructure:"hypervisor_sandbox"`
+	Jailer            JailerConfig            `mapstructure:"jailer"`
+	HypervisorCgroups HypervisorCgroupsConfig `mapstructure:"hypervisor_cgroups"`
+	API               APIConfig               `mapstructure:"api"`
 }
 
 func (c ServerConfig) String() string {
@@ -47,6 +1113,50 @@ PortForwards: %+v
 InitramfsPath: %s
 StatefulSizeInMB: %d
 GuestMemPercentage: %d
+TracingEnabled: %t
+TracingEndpoint: %s
+Drain: %+v
+Timeouts: %+v
+WarmPool: %+v
+LogLevel: %s
+KernelModuleAllowlist: %v
+Templates: %+v
+HostMounts: %+v
+ReadCacheTTL: %s
+Events: %+v
+Capacity: %+v
+APIKeys: %d
+OIDC: %+v
+Callbacks: %+v
+WebSocket: %+v
+NormalizeVMNames: %t
+SnapshotStore: %s/%s
+Middlewares: %+v
+Listeners: %+v
+ImageCompaction: %+v
+GuestTelemetry: %t %s %s
+CredentialProfiles: %d
+ConsoleLogs: %+v
+CrashDetection: %+v
+Health: %+v
+HA: %+v
+GC: %+v
+Idle: %+v
+Hooks: %d
+APIHostHooks: %t
+Secrets: %d
+Vault: %s
+IPAM: %+v
+NetworkModes: %+v
+Egress: %+v
+NetworkNamespaces: %t
+SharedDirs: %+v
+BaseImages: %v
+Volumes: %v
+HypervisorSandbox: %+v
+Jailer: %+v
+HypervisorCgroups: %+v
+API: %+v
 }`,
 		c.Host,
 		c.Port,
@@ -60,19 +1170,71 @@ GuestMemPercentage: %d
 		c.InitramfsPath,
 		c.StatefulSizeInMB,
 		c.GuestMemPercentage,
+		c.Tracing.Enabled,
+		c.Tracing.Endpoint,
+		c.Drain,
+		c.Timeouts,
+		c.WarmPool,
+		c.LogLevel,
+		c.KernelModuleAllowlist,
+		c.Templates,
+		c.HostMounts,
+		c.ReadCacheTTL,
+		c.Events,
+		c.Capacity,
+		len(c.Auth.APIKeys),
+		c.Auth.OIDC,
+		c.Callbacks,
+		c.WebSocket,
+		c.NormalizeVMNames,
+		c.SnapshotStore.Endpoint,
+		c.SnapshotStore.Bucket,
+		c.Middlewares,
+		c.Listeners,
+		c.ImageCompaction,
+		c.GuestTelemetry.Enabled,
+		c.GuestTelemetry.LogsEndpoint,
+		c.GuestTelemetry.MetricsEndpoint,
+		len(c.CredentialProfiles),
+		c.ConsoleLogs,
+		c.CrashDetection,
+		c.Health,
+		c.HA,
+		c.GC,
+		c.Idle,
+		len(c.Hooks),
+		c.APIHostHooks,
+		len(c.Secrets),
+		c.Vault.Address,
+		c.IPAM,
+		c.NetworkModes,
+		c.Egress,
+		c.NetworkNamespaces,
+		c.SharedDirs,
+		c.BaseImages,
+		c.Volumes,
+		c.HypervisorSandbox,
+		c.Jailer,
+		c.HypervisorCgroups,
+		c.API,
 	)
 }
 
 type ClientConfig struct {
 	ServerHost string `mapstructure:"server_host"`
 	ServerPort string `mapstructure:"server_port"`
+	// Sent to the server if it requires authentication.
+	APIKey string `mapstructure:"api_key"`
+	// Servers, as host:port, that the fleet commands act on. They share the API key.
+	Fleet []string `mapstructure:"fleet"`
 }
 
 func (c ClientConfig) String() string {
 	return fmt.Sprintf(`{
 ServerHost: %s
 ServerPort: %s
-}`, c.ServerHost, c.ServerPort)
+Fleet: %v
+}`, c.ServerHost, c.ServerPort, c.Fleet)
 }
 
 type CodeServerConfig struct {
@@ -91,8 +1253,22 @@ func GetServerConfig(configFile string) (*ServerConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %v", err)
 	}
+	return serverConfigFrom(viper.GetViper())
+}
+
+// ParseServerConfig reads the server config from `data`, the contents of a config file, without
+// touching the config the server was started with.
+func ParseServerConfig(data []byte) (*ServerConfig, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return serverConfigFrom(v)
+}
 
-	restServerConfig := viper.Sub(serverConfigKey)
+func serverConfigFrom(v *viper.Viper) (*ServerConfig, error) {
+	restServerConfig := v.Sub(serverConfigKey)
 	if restServerConfig == nil {
 		return nil, fmt.Errorf("restserver configuration not found")
 	}
@@ -101,6 +1277,101 @@ func GetServerConfig(configFile string) (*ServerConfig, error) {
 	if err := restServerConfig.Unmarshal(&result); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
+	if err := result.resolveTimeouts(); err != nil {
+		return nil, err
+	}
+	if err := result.ImageCompaction.validate(); err != nil {
+		return nil, err
+	}
+	if err := result.ConsoleLogs.validate("console_logs"); err != nil {
+		return nil, err
+	}
+	if result.CrashDetection.Interval < 0 || result.CrashDetection.MissedHeartbeats < 0 {
+		return nil, fmt.Errorf("crash_detection can't have negative values")
+	}
+	if result.Health.MinFreeDiskMB < 0 {
+		return nil, fmt.Errorf("health.min_free_disk_mb can't be negative")
+	}
+	if result.HA.RetryInterval < 0 {
+		return nil, fmt.Errorf("ha.retry_interval can't be negative")
+	}
+	if result.GC.Interval < 0 || result.GC.GracePeriod < 0 {
+		return nil, fmt.Errorf("gc can't have negative values")
+	}
+	if result.Idle.Timeout < 0 || result.Idle.CheckInterval < 0 {
+		return nil, fmt.Errorf("idle can't have negative values")
+	}
+	for i, hook := range result.Hooks {
+		switch hook.Event {
+		case "pre_start", "post_boot", "pre_destroy":
+		default:
+			return nil, fmt.Errorf("hooks[%d].event must be pre_start, post_boot or pre_destroy, not %q", i, hook.Event)
+		}
+		if strings.TrimSpace(hook.Command) == "" {
+			return nil, fmt.Errorf("hooks[%d] has no command", i)
+		}
+		if hook.Guest && hook.Event == "pre_start" {
+			return nil, fmt.Errorf("hooks[%d] can't run in the guest before it started", i)
+		}
+		if hook.Timeout < 0 {
+			return nil, fmt.Errorf("hooks[%d].timeout can't be negative", i)
+		}
+	}
+	switch result.Callbacks.DisconnectPolicy {
+	case "", "destroy", "pause", "snapshot", "keep":
+	default:
+		return nil, fmt.Errorf("callbacks.disconnect_policy must be destroy, pause, snapshot or keep, not %q", result.Callbacks.DisconnectPolicy)
+	}
+	if result.Callbacks.DisconnectTTL < 0 {
+		return nil, fmt.Errorf("callbacks.disconnect_ttl can't be negative")
+	}
+	switch result.Idle.Action {
+	case "", "pause", "snapshot":
+	default:
+		return nil, fmt.Errorf("idle.action must be pause or snapshot, not %q", result.Idle.Action)
+	}
+	if err := result.Middlewares.Audit.Rotation.validate("middlewares.audit.rotation"); err != nil {
+		return nil, err
+	}
+	if err := result.resolveGuestTelemetry(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveIPAM(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveNetworkModes(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveEgress(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveSharedDirs(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveBaseImages(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveVolumes(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveHypervisorSandbox(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveJailer(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveHypervisorCgroups(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveAPI(); err != nil {
+		return nil, err
+	}
+	if err := result.resolveCredentialProfiles(); err != nil {
+		return nil, err
+	}
 
 	return &result, nil
 }
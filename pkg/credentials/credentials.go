@@ -0,0 +1,425 @@
+// Package credentials mints short-lived cloud credentials for guests, from the credential profiles
+// of the server config: AWS ones by assuming a role through STS, GCP ones by impersonating a
+// service account through the IAM Credentials API. The host's own keys never leave it. Credentials
+// of destroyed VMs are revoked before they expire.
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/objectstore"
+)
+
+const (
+	ProviderAWS = "aws"
+	ProviderGCP = "gcp"
+
+	requestTimeout = 30 * time.Second
+
+	defaultAWSRegion = "us-east-1"
+	stsVersion       = "2011-06-15"
+	iamEndpoint      = "https://iam.amazonaws.com/"
+	iamVersion       = "2010-05-08"
+	// Prefix of the inline role policies that revoke sessions, followed by the revocation's Unix
+	// time and the session's name.
+	revokedPolicyPrefix = "arrakis-revoked-"
+	// The longest any role session lasts, after which its revocation policy can go.
+	maxAWSSessionDuration = 12 * time.Hour
+
+	defaultGCPScope     = "https://www.googleapis.com/auth/cloud-platform"
+	defaultGCPTokenURI  = "https://oauth2.googleapis.com/token"
+	gcpRevokeURL        = "https://oauth2.googleapis.com/revoke"
+	gcpIAMCredentialURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+	// How long the host's own GCP token, only used to impersonate, is valid.
+	gcpAssertionLifetime = 10 * time.Minute
+)
+
+// Characters AWS doesn't allow in role session names.
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// Mint returns new credentials of the profile `name`, configured by `profile`, for the VM
+// `vmName`, which AWS records as the session's name.
+func Mint(ctx context.Context, name string, profile config.CredentialProfileConfig, vmName string) (*guestcall.Credentials, error) {
+	var creds *guestcall.Credentials
+	var err error
+	switch profile.Provider {
+	case ProviderAWS:
+		creds, err = assumeRole(ctx, profile, sessionName(vmName))
+	case ProviderGCP:
+		creds, err = impersonate(ctx, profile)
+	default:
+		return nil, fmt.Errorf("unknown credential provider %q", profile.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	creds.Profile = name
+	creds.Provider = profile.Provider
+	return creds, nil
+}
+
+// sessionName returns a valid AWS role session name for `vmName`.
+func sessionName(vmName string) string {
+	name := "arrakis-" + invalidSessionNameChars.ReplaceAllString(vmName, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// assumeRole mints AWS credentials by assuming the profile's role through STS.
+func assumeRole(ctx context.Context, profile config.CredentialProfileConfig, sessionName string) (*guestcall.Credentials, error) {
+	region := profile.Region
+	endpoint := "https://sts.amazonaws.com/"
+	if region == "" {
+		region = defaultAWSRegion
+	} else {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	}
+
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {stsVersion},
+		"RoleArn":         {profile.RoleARN},
+		"RoleSessionName": {sessionName},
+		"DurationSeconds": {strconv.Itoa(int(profile.Duration.Seconds()))},
+	}
+	if profile.Policy != "" {
+		form.Set("Policy", profile.Policy)
+	}
+	respBody, err := awsQuery(ctx, profile, endpoint, region, "sts", form)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode STS response: %w", err)
+	}
+	if result.Credentials.AccessKeyID == "" {
+		return nil, errors.New("STS returned no credentials")
+	}
+	return &guestcall.Credentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expiration:      result.Credentials.Expiration.UTC(),
+	}, nil
+}
+
+// awsQuery calls the action in `form` of the AWS query API of `service` at `endpoint`, signed with
+// the profile's keys, and returns the response body.
+func awsQuery(ctx context.Context, profile config.CredentialProfileConfig, endpoint string, region string, service string, form url.Values) ([]byte, error) {
+	name := strings.ToUpper(service)
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	objectstore.SignRequest(req, body, profile.AccessKeyID, profile.SecretAccessKey, region, service, time.Now())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			} `xml:"Error"`
+		}
+		if xml.Unmarshal(respBody, &errResp) == nil && errResp.Error.Code != "" {
+			return nil, fmt.Errorf("%s returned status %d: %s: %s", name, resp.StatusCode, errResp.Error.Code, errResp.Error.Message)
+		}
+		return nil, fmt.Errorf("%s returned status %d", name, resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+// Revoke revokes `creds`, minted of `profile` for the VM `vmName`, before they expire. AWS role
+// sessions can't be ended, so the VM's sessions issued until now are denied everything by an
+// inline policy on the role instead. GCP tokens are revoked at the OAuth endpoint.
+func Revoke(ctx context.Context, profile config.CredentialProfileConfig, vmName string, creds []*guestcall.Credentials) error {
+	switch profile.Provider {
+	case ProviderAWS:
+		return revokeSessions(ctx, profile, sessionName(vmName), time.Now())
+	case ProviderGCP:
+		var errs []error
+		for _, c := range creds {
+			errs = append(errs, revokeToken(ctx, c.AccessToken))
+		}
+		return errors.Join(errs...)
+	default:
+		return fmt.Errorf("unknown credential provider %q", profile.Provider)
+	}
+}
+
+// revokeSessions denies the sessions of the profile's role named `sessionName` and issued before
+// `now` everything, through an inline policy on the role, which needs iam:PutRolePolicy. Policies
+// of earlier revocations, whose sessions have all expired since, are deleted so that they don't
+// fill up the role's policy size quota, which needs iam:ListRolePolicies and iam:DeleteRolePolicy.
+func revokeSessions(ctx context.Context, profile config.CredentialProfileConfig, sessionName string, now time.Time) error {
+	roleName := profile.RoleARN[strings.LastIndex(profile.RoleARN, "/")+1:]
+	policy, err := revocationPolicy(sessionName, now)
+	if err != nil {
+		return err
+	}
+	_, err = awsQuery(ctx, profile, iamEndpoint, defaultAWSRegion, "iam", url.Values{
+		"Action":         {"PutRolePolicy"},
+		"Version":        {iamVersion},
+		"RoleName":       {roleName},
+		"PolicyName":     {fmt.Sprintf("%s%d-%s", revokedPolicyPrefix, now.Unix(), sessionName)},
+		"PolicyDocument": {policy},
+	})
+	if err != nil {
+		return err
+	}
+
+	respBody, err := awsQuery(ctx, profile, iamEndpoint, defaultAWSRegion, "iam", url.Values{
+		"Action":   {"ListRolePolicies"},
+		"Version":  {iamVersion},
+		"RoleName": {roleName},
+		"MaxItems": {"1000"},
+	})
+	if err != nil {
+		return fmt.Errorf("revoked, but failed to list old revocations: %w", err)
+	}
+	var result struct {
+		PolicyNames []string `xml:"ListRolePoliciesResult>PolicyNames>member"`
+	}
+	if err := xml.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("failed to decode IAM response: %w", err)
+	}
+	var errs []error
+	for _, name := range result.PolicyNames {
+		if !revocationExpired(name, now) {
+			continue
+		}
+		_, err := awsQuery(ctx, profile, iamEndpoint, defaultAWSRegion, "iam", url.Values{
+			"Action":     {"DeleteRolePolicy"},
+			"Version":    {iamVersion},
+			"RoleName":   {roleName},
+			"PolicyName": {name},
+		})
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("revoked, but failed to delete old revocations: %w", err)
+	}
+	return nil
+}
+
+// revocationPolicy returns the policy document that denies the sessions named `sessionName` and
+// issued before `now` everything. Session names can't contain ":", which ends the role's ID in
+// aws:userid, or wildcards.
+func revocationPolicy(sessionName string, now time.Time) (string, error) {
+	policy, err := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":   "Deny",
+			"Action":   "*",
+			"Resource": "*",
+			"Condition": map[string]any{
+				"StringLike":   map[string]string{"aws:userid": "*:" + sessionName},
+				"DateLessThan": map[string]string{"aws:TokenIssueTime": now.UTC().Format(time.RFC3339)},
+			},
+		}},
+	})
+	return string(policy), err
+}
+
+// revocationExpired returns whether `policyName` is a revocation policy whose sessions have all
+// expired by `now`.
+func revocationExpired(policyName string, now time.Time) bool {
+	rest, ok := strings.CutPrefix(policyName, revokedPolicyPrefix)
+	if !ok {
+		return false
+	}
+	unix, _, _ := strings.Cut(rest, "-")
+	revokedAt, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return false
+	}
+	return now.Sub(time.Unix(revokedAt, 0)) > maxAWSSessionDuration
+}
+
+// revokeToken revokes the GCP access token `token`.
+func revokeToken(ctx context.Context, token string) error {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gcpRevokeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doJSON(req, "GCP token revocation", &struct{}{})
+}
+
+// serviceAccountKey holds the fields of a GCP service account key file that are used.
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// impersonate mints a GCP access token of the profile's service account, authenticating as the
+// service account of the host's key file.
+func impersonate(ctx context.Context, profile config.CredentialProfileConfig) (*guestcall.Credentials, error) {
+	hostToken, err := hostAccessToken(ctx, profile.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := profile.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{defaultGCPScope}
+	}
+	body, err := json.Marshal(map[string]any{
+		"scope":    scopes,
+		"lifetime": fmt.Sprintf("%ds", int(profile.Duration.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqURL := fmt.Sprintf(gcpIAMCredentialURL, url.PathEscape(profile.ServiceAccount))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+hostToken)
+
+	var result struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := doJSON(req, "IAM credentials", &result); err != nil {
+		return nil, err
+	}
+	return &guestcall.Credentials{
+		AccessToken:    result.AccessToken,
+		ServiceAccount: profile.ServiceAccount,
+		ProjectID:      profile.ProjectID,
+		Expiration:     result.ExpireTime.UTC(),
+	}, nil
+}
+
+// hostAccessToken returns an access token of the service account whose key is in `keyFile`, by
+// exchanging a signed JWT for it.
+func hostAccessToken(ctx context.Context, keyFile string) (string, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GCP credentials file: %w", err)
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", fmt.Errorf("invalid GCP credentials file %s: %w", keyFile, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = defaultGCPTokenURI
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("GCP credentials file %s has no private key", keyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key in %s: %w", keyFile, err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private key in %s isn't an RSA key", keyFile)
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": defaultGCPScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcpAssertionLifetime).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token request: %w", err)
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, "GCP token endpoint", &result); err != nil {
+		return "", err
+	}
+	return result.AccessToken, nil
+}
+
+// doJSON sends `req` to `service` and decodes its JSON response into `result`.
+func doJSON(req *http.Request, service string, result any) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", service, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %w", service, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d: %s", service, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", service, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package credentials
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRevocationPolicy(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	policy, err := revocationPolicy(sessionName("team-a/foo"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Statement []struct {
+			Effect    string
+			Action    string
+			Resource  string
+			Condition map[string]map[string]string
+		}
+	}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Statement) != 1 {
+		t.Fatalf("policy has %d statements, want 1: %s", len(doc.Statement), policy)
+	}
+	st := doc.Statement[0]
+	if st.Effect != "Deny" || st.Action != "*" || st.Resource != "*" {
+		t.Errorf("policy doesn't deny everything: %s", policy)
+	}
+	if got := st.Condition["StringLike"]["aws:userid"]; got != "*:arrakis-team-a-foo" {
+		t.Errorf("aws:userid condition = %q", got)
+	}
+	if got := st.Condition["DateLessThan"]["aws:TokenIssueTime"]; got != "2025-01-02T02:04:05Z" {
+		t.Errorf("aws:TokenIssueTime condition = %q", got)
+	}
+}
+
+func TestRevocationExpired(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		policyName string
+		want       bool
+	}{
+		{policyName: "arrakis-revoked-1700000000-arrakis-foo", want: false},
+		{policyName: "arrakis-revoked-1699960000-arrakis-foo", want: false},
+		{policyName: "arrakis-revoked-1699900000-arrakis-foo", want: true},
+		{policyName: "arrakis-revoked-junk-arrakis-foo", want: false},
+		{policyName: "sandbox-1699900000", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policyName, func(t *testing.T) {
+			if got := revocationExpired(tt.policyName, now); got != tt.want {
+				t.Errorf("revocationExpired(%q) = %v, want %v", tt.policyName, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Package events is an in-memory bus for server events, such as VM lifecycle changes. Recent events
+// are kept so that subscribers can resume from the last event they saw after reconnecting.
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHistorySize      = 1000
+	DefaultSubscriberBuffer = 256
+)
+
+// Event types.
+const (
+	VMStarted      = "vm.started"
+	VMStopped      = "vm.stopped"
+	VMPaused       = "vm.paused"
+	VMResumed      = "vm.resumed"
+	VMDestroyed    = "vm.destroyed"
+	VMSnapshotted  = "vm.snapshotted"
+	VMOwnerChanged = "vm.owner_changed"
+	// The VM moved to another host, named in the event's data.
+	VMMigrated = "vm.migrated"
+	// Sent by code in the guest, see guestcall.Client.Report.
+	VMProgress = "vm.progress"
+	VMArtifact = "vm.artifact"
+	// An agent in the guest, such as the cmdserver, crashed and was restarted.
+	VMAgentRestarted = "vm.agent_restarted"
+	// The guest mounted the VM's shared directories, over the transports in the event's data.
+	VMSharedDirsMounted = "vm.shared_dirs_mounted"
+	// The VM's hypervisor exited or its guest agent stopped answering, see the reason in the
+	// event's data.
+	VMCrashed = "vm.crashed"
+	// A crashed VM was started again by its restart policy.
+	VMRestarted = "vm.restarted"
+	// The OOM killer killed a process in the guest, or the VM's hypervisor on the host, see the
+	// source, process and what the VM's OOM policy does about it in the event's data.
+	VMOOMKilled = "vm.oom_killed"
+	// The VM went without calls into its guest for the idle timeout and was paused, or
+	// snapshotted and stopped, as the event's data says. Resumed on the next call.
+	VMIdleSuspended = "vm.idle_suspended"
+	VMIdleResumed   = "vm.idle_resumed"
+	// A lifecycle hook of the VM failed, see the hook and error in the event's data.
+	VMHookFailed = "vm.hook_failed"
+
+	ServerDraining     = "server.draining"
+	ServerConfigReload = "server.config_reloaded"
+	// The server took the leader lock, and over the VMs of the previous leader that still ran.
+	ServerBecameLeader = "server.became_leader"
+	HostCordoned       = "host.cordoned"
+	HostUncordoned     = "host.uncordoned"
+)
+
+// ErrClosed is returned by `Subscribe` once the bus is closed.
+var ErrClosed = errors.New("event bus closed")
+
+// Event is a single event. IDs increase by one for each event published on a bus.
+type Event struct {
+	ID     uint64            `json:"id"`
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"`
+	VMName string            `json:"vmName,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: a subscriber that falls more than
+// its buffer behind is cut off and told so via `Subscription.Overflowed`, after which it can
+// resubscribe from its last seen event.
+type Bus struct {
+	lock   sync.Mutex
+	nextID uint64
+	// Ring buffer of the most recent events, oldest first starting at `historyStart`.
+	history      []Event
+	historyStart int
+	historySize  int
+	subscribers  map[*Subscription]struct{}
+	bufferSize   int
+	closed       bool
+}
+
+// NewBus creates a bus that keeps the last `historySize` events for replay and buffers up to
+// `bufferSize` events per subscriber. Non-positive values select the defaults.
+func NewBus(historySize int, bufferSize int) *Bus {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriberBuffer
+	}
+	return &Bus{
+		nextID:      1,
+		historySize: historySize,
+		subscribers: make(map[*Subscription]struct{}),
+		bufferSize:  bufferSize,
+	}
+}
+
+// Publish records an event and delivers it to all subscribers.
+func (b *Bus) Publish(eventType string, vmName string, data map[string]string) Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	event := Event{
+		ID:     b.nextID,
+		Time:   time.Now().UTC(),
+		Type:   eventType,
+		VMName: vmName,
+		Data:   data,
+	}
+	b.nextID++
+
+	if len(b.history) < b.historySize {
+		b.history = append(b.history, event)
+	} else {
+		b.history[b.historyStart] = event
+		b.historyStart = (b.historyStart + 1) % b.historySize
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			b.overflowLocked(sub)
+		}
+	}
+	return event
+}
+
+// overflowLocked cuts off a subscriber that can't keep up.
+func (b *Bus) overflowLocked(sub *Subscription) {
+	sub.overflowed = true
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// historyAfterLocked returns the retained events with an ID greater than `afterID`. `gap` is set
+// if some of the events after `afterID` are no longer retained.
+func (b *Bus) historyAfterLocked(afterID uint64) (events []Event, gap bool) {
+	for i := 0; i < len(b.history); i++ {
+		event := b.history[(b.historyStart+i)%len(b.history)]
+		if event.ID > afterID {
+			events = append(events, event)
+		}
+	}
+	if afterID+1 < b.nextID {
+		oldest := b.nextID
+		if len(events) > 0 {
+			oldest = events[0].ID
+		}
+		gap = oldest > afterID+1
+	}
+	return events, gap
+}
+
+// Subscribe starts receiving events published after the event with ID `afterID`. Retained events
+// after `afterID` are replayed first; pass `LastID()` to only get new events.
+func (b *Bus) Subscribe(afterID uint64) (*Subscription, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	replay, gap := b.historyAfterLocked(afterID)
+	// The replay doesn't count against the buffer for new events.
+	sub := &Subscription{
+		bus:    b,
+		events: make(chan Event, b.bufferSize+len(replay)),
+		Gap:    gap,
+	}
+	for _, event := range replay {
+		sub.events <- event
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+// LastID returns the ID of the most recently published event, or 0 if there is none.
+func (b *Bus) LastID() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.nextID - 1
+}
+
+// Close ends all subscriptions. Events published afterwards are still recorded but not delivered.
+func (b *Bus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Subscription is a stream of events from a `Bus`.
+type Subscription struct {
+	bus    *Bus
+	events chan Event
+	// Guarded by the bus lock.
+	overflowed bool
+	// Set if events between the requested cursor and the first replayed event were no longer
+	// retained and can't be delivered.
+	Gap bool
+}
+
+// Events returns the channel events are delivered on. It is closed when the subscription ends,
+// see `Overflowed`.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Overflowed returns true if the subscription ended because the subscriber fell too far behind,
+// rather than being closed.
+func (s *Subscription) Overflowed() bool {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	return s.overflowed
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,119 @@
+package guestcall
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Kernel command line key carrying the secret the host shares with the vsockserver. The host
+	// also keeps it in the VM's state directory, as `VsockSecretFilename`.
+	VsockSecretCmdlineKey = "vsock_secret"
+	VsockSecretFilename   = "vsock-secret"
+
+	// Prefixes of the commands that authenticate a connection. The client sends
+	// `HELLO <nonce>`, the vsockserver answers with an `AuthChallenge` proving it knows the
+	// secret, and the client proves it knows the secret with `AUTH <proof>`, which is answered with
+	// a `Response`.
+	HelloPrefix = "HELLO "
+	AuthPrefix  = "AUTH "
+
+	// Codes of the errors the vsockserver rejects connections and commands with.
+	ErrorUnauthenticated    = "unauthenticated"
+	ErrorRateLimited        = "rate_limited"
+	ErrorTooManyConnections = "too_many_connections"
+	ErrorLineTooLong        = "line_too_long"
+
+	nonceSize = 16
+)
+
+// AuthChallenge is the vsockserver's answer to `HELLO`, sent back as a single line of JSON.
+type AuthChallenge struct {
+	// The client proves it knows the secret by signing this.
+	Nonce string `json:"nonce,omitempty"`
+	// The vsockserver's signature of the client's nonce and `Nonce`.
+	Proof string         `json:"proof,omitempty"`
+	Error *ResponseError `json:"error,omitempty"`
+}
+
+// NewNonce returns a random nonce for the handshake.
+func NewNonce() (string, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ServerProof is what the vsockserver signs to prove it knows `secret`. The proofs of the two
+// sides differ so that neither can be replayed as the other.
+func ServerProof(secret string, clientNonce string, serverNonce string) string {
+	return sign(secret, "server", clientNonce, serverNonce)
+}
+
+// ClientProof is what the client signs to prove it knows `secret`.
+func ClientProof(secret string, clientNonce string, serverNonce string) string {
+	return sign(secret, "client", clientNonce, serverNonce)
+}
+
+func sign(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyProof reports whether `proof` equals `expected`, in constant time.
+func VerifyProof(proof string, expected string) bool {
+	return hmac.Equal([]byte(proof), []byte(expected))
+}
+
+// Authenticate runs the client side of the handshake over `w` and `r`, after which the connection
+// may run any command. It fails unless the other side knows `secret` too, so that a process
+// posing as the vsockserver learns nothing it could authenticate with.
+func Authenticate(w io.Writer, r *bufio.Reader, secret string) error {
+	clientNonce, err := NewNonce()
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", HelloPrefix, clientNonce); err != nil {
+		return err
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var challenge AuthChallenge
+	if err := json.Unmarshal(line, &challenge); err != nil {
+		return fmt.Errorf("invalid challenge from vsockserver: %w", err)
+	}
+	if challenge.Error != nil {
+		return fmt.Errorf("vsockserver rejected the connection: %s", challenge.Error.Message)
+	}
+	if !VerifyProof(challenge.Proof, ServerProof(secret, clientNonce, challenge.Nonce)) {
+		return fmt.Errorf("vsockserver failed to prove it knows the secret")
+	}
+
+	proof := ClientProof(secret, clientNonce, challenge.Nonce)
+	if _, err := fmt.Fprintf(w, "%s%s\n", AuthPrefix, proof); err != nil {
+		return err
+	}
+	line, err = r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("invalid response from vsockserver: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("vsockserver rejected the connection: %s", resp.Error.Message)
+	}
+	return nil
+}
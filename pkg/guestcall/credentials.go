@@ -0,0 +1,18 @@
+package guestcall
+
+import "time"
+
+// Credentials are short-lived cloud credentials the host minted for a guest, as returned by the
+// restserver's "/v1/internal/credentials". AWS ones have AccessKeyID, SecretAccessKey and
+// SessionToken, GCP ones AccessToken.
+type Credentials struct {
+	Profile         string    `json:"profile"`
+	Provider        string    `json:"provider"`
+	AccessKeyID     string    `json:"accessKeyId,omitempty"`
+	SecretAccessKey string    `json:"secretAccessKey,omitempty"`
+	SessionToken    string    `json:"sessionToken,omitempty"`
+	AccessToken     string    `json:"accessToken,omitempty"`
+	ServiceAccount  string    `json:"serviceAccount,omitempty"`
+	ProjectID       string    `json:"projectId,omitempty"`
+	Expiration      time.Time `json:"expiration"`
+}
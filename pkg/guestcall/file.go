@@ -0,0 +1,217 @@
+package guestcall
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Prefix of the command that moves files of any size in and out of the guest,
+	// `FILE <FileRequest as JSON>`. The vsockserver answers with a `Response` whose result is a
+	// `FileStatus`. For write, the host then sends the data as chunks and gets a second `Response`
+	// once the last one is written; for read, the vsockserver sends the data as chunks right after
+	// its answer. Only authenticated connections may send it.
+	FilePrefix = "FILE "
+
+	// Ops of a `FileRequest`. Stat returns how much of an upload to `Path` was written so far.
+	FileOpStat = "stat"
+	// Writes chunks to the upload of `Path` from `Offset`, which must be where the upload is at, or
+	// zero to start over.
+	FileOpWrite = "write"
+	// Moves the upload of `Path` into place once it's `Size` bytes long, after checking `SHA256`
+	// if set, and sets its mode and owner.
+	FileOpCommit = "commit"
+	// Deletes the upload of `Path`.
+	FileOpAbort = "abort"
+	// Sends at most `Length` bytes of the file at `Path` from `Offset` as chunks, all of the rest
+	// if zero.
+	FileOpRead = "read"
+
+	// Codes of the errors a `FILE` command fails with.
+	ErrorInvalidFile  = "invalid_file"
+	ErrorFileNotFound = "file_not_found"
+	// The write's offset isn't where the upload is at, or the committed size isn't its size.
+	ErrorFileOffset = "file_offset_mismatch"
+	// Another write or commit of the same upload is in progress.
+	ErrorFileBusy   = "file_busy"
+	ErrorFileFailed = "file_failed"
+
+	// The largest chunk either side sends.
+	MaxFileChunk = 1 << 20
+	// Uploads are written next to their path, to a hidden file with this suffix, until they're
+	// committed.
+	PartialFileSuffix = ".arrakis-partial"
+)
+
+// FileRequest is the payload of the `FILE` command.
+type FileRequest struct {
+	Op string `json:"op"`
+	// Absolute path of the file in the guest.
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	// For read: at most how many bytes to send.
+	Length int64 `json:"length,omitempty"`
+	// For write: create the missing parent directories of `Path`.
+	Mkdirs bool `json:"mkdirs,omitempty"`
+	// For commit: the expected size and hex SHA-256 of the upload, and the file's mode, in octal,
+	// and owner.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	UID    *int   `json:"uid,omitempty"`
+	GID    *int   `json:"gid,omitempty"`
+}
+
+// FileStatus describes an upload or a file. For uploads, Offset is how many bytes were written so
+// far, where the next write must start; for reads, it's where the chunks start. Size is the size
+// of the file at `Path`, if it exists.
+type FileStatus struct {
+	Path      string `json:"path"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	Exists    bool   `json:"exists"`
+	Committed bool   `json:"committed,omitempty"`
+	// For read: how many bytes the chunks carry.
+	Length int64 `json:"length,omitempty"`
+}
+
+// ValidateFilePath returns an error unless `p` is an absolute, clean path that isn't an upload's
+// partial file.
+func ValidateFilePath(p string) error {
+	if !path.IsAbs(p) || path.Clean(p) != p || p == "/" || strings.ContainsAny(p, "\n\r\x00") {
+		return fmt.Errorf("file path must be absolute and clean, got %q", p)
+	}
+	if strings.HasSuffix(p, PartialFileSuffix) {
+		return fmt.Errorf("file path can't end in %s", PartialFileSuffix)
+	}
+	return nil
+}
+
+// PartialFilePath returns the path the upload of `p` is written to until it's committed.
+func PartialFilePath(p string) string {
+	dir, name := path.Split(p)
+	return dir + "." + name + PartialFileSuffix
+}
+
+// SendFileRequest sends `req` to the vsockserver on the other end of `w` and `r`, and returns its
+// answer. Errors of the vsockserver are returned as a `*ResponseError`. For write and read, the
+// chunks follow.
+func SendFileRequest(w io.Writer, r *bufio.Reader, req FileRequest) (*FileStatus, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", FilePrefix, data); err != nil {
+		return nil, err
+	}
+	return ReadFileStatus(r)
+}
+
+// ReadFileStatus reads a `Response` carrying a `FileStatus`, as the vsockserver sends once the
+// chunks of a write are written.
+func ReadFileStatus(r *bufio.Reader) (*FileStatus, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from vsockserver: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	var status FileStatus
+	if err := json.Unmarshal(resp.Result, &status); err != nil {
+		return nil, fmt.Errorf("invalid result from vsockserver: %w", err)
+	}
+	return &status, nil
+}
+
+// ChunkWriter sends what's written to it as chunks of at most `MaxFileChunk` bytes, each a line
+// with its length in decimal followed by its bytes. Close sends the empty chunk that ends them,
+// and doesn't close the underlying writer.
+type ChunkWriter struct {
+	w io.Writer
+}
+
+func NewChunkWriter(w io.Writer) *ChunkWriter {
+	return &ChunkWriter{w: w}
+}
+
+func (c *ChunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), MaxFileChunk)
+		if _, err := fmt.Fprintf(c.w, "%d\n", n); err != nil {
+			return written, err
+		}
+		if _, err := c.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *ChunkWriter) Close() error {
+	_, err := io.WriteString(c.w, "0\n")
+	return err
+}
+
+// ChunkReader reads the data of the chunks a `ChunkWriter` sent, returning io.EOF after the empty
+// chunk, and io.ErrUnexpectedEOF if the connection ends before it.
+type ChunkReader struct {
+	r *bufio.Reader
+	// What's left of the current chunk.
+	left int64
+	done bool
+}
+
+func NewChunkReader(r *bufio.Reader) *ChunkReader {
+	return &ChunkReader{r: r}
+}
+
+func (c *ChunkReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		size, err := strconv.ParseInt(strings.TrimSuffix(line, "\n"), 10, 64)
+		if err != nil || size < 0 || size > MaxFileChunk {
+			return 0, fmt.Errorf("invalid chunk header %q", strings.TrimSpace(line))
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = size
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err != nil {
+		return n, unexpectedEOF(err)
+	}
+	return n, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
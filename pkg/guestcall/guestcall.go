@@ -0,0 +1,270 @@
+// Package guestcall lets code running inside a VM invoke callbacks, i.e. tools provided by the
+// client that started the VM, with a single function call. Calls go to the vsockserver in the
+// guest, which forwards them to the arrakis-restserver on the host.
+package guestcall
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/vsock"
+
+	"github.com/abilashraghuram/arrakis/internal/backoff"
+)
+
+const (
+	// Port the vsockserver listens on.
+	VsockPort = 4032
+	// Prefix of the command that carries a `Request` to the vsockserver.
+	CommandPrefix = "CALL "
+	// Prefix of the command that carries a `Report` to the vsockserver.
+	ReportPrefix = "REPORT "
+
+	// Report types.
+	ReportProgress = "progress"
+	ReportArtifact = "artifact"
+	// Tells the VM's callback client that a long-running task is alive. Not published as an event.
+	ReportHeartbeat = "heartbeat"
+	// Sent by the vsockserver when an agent in the guest, such as the cmdserver, crashed and was
+	// restarted.
+	ReportAgentRestart = "agent_restart"
+	// Sent by the vsockserver once guestinit mounted the shared directories, with the transport of
+	// each by tag.
+	ReportSharedDirs = "shared_dirs"
+	// Sent by the vsockserver when the guest's kernel killed a process for running out of memory,
+	// with the process and its PID.
+	ReportOOMKill = "oom_kill"
+
+	DefaultTimeout        = 30 * time.Second
+	DefaultMaxRetries     = 3
+	defaultInitialBackoff = 200 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+)
+
+// Request is a callback sent to the vsockserver as a single line, `CALL <json>`.
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// How long the host may take to answer. Zero selects `DefaultTimeout`.
+	TimeoutMillis int64 `json:"timeoutMs,omitempty"`
+}
+
+// Report tells the host about the guest's own work, such as its progress or files it produced.
+// The host publishes it on its events stream as "vm.<type>", with `Data` as the event data, and
+// pushes progress and heartbeats to the client answering the VM's callbacks. Reports are sent to
+// the vsockserver as a single line, `REPORT <json>`, and answered with a `Response`.
+type Report struct {
+	Type string            `json:"type"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// Response is the vsockserver's answer to a `Request`, sent back as a single line of JSON.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ResponseError  `json:"error,omitempty"`
+}
+
+// ResponseError says why a callback failed.
+type ResponseError struct {
+	Message string `json:"message"`
+	// Set if the vsockserver rejected the request, e.g. `ErrorRateLimited`.
+	Code string `json:"code,omitempty"`
+	// Set if the callback never reached the host, so that sending it again may succeed.
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// Error is returned by `Call` for callbacks that failed.
+type Error struct {
+	Method  string
+	Message string
+	// See `ResponseError`.
+	Code      string
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("callback %s failed: %s", e.Method, e.Message)
+}
+
+// Options configure a `Client`. Zero values select the defaults.
+type Options struct {
+	// How long a single attempt may take, unless the context passed to `Call` expires sooner.
+	// Defaults to `DefaultTimeout`.
+	Timeout time.Duration
+	// Retries after the first attempt. Defaults to `DefaultMaxRetries`; negative values disable
+	// retries.
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Connects to the vsockserver. Defaults to the vsockserver in this guest.
+	Dial func(ctx context.Context) (net.Conn, error)
+}
+
+// Client invokes callbacks through the vsockserver. It's safe for concurrent use.
+type Client struct {
+	opts Options
+}
+
+// New creates a client.
+func New(opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.Dial == nil {
+		opts.Dial = dialVsock
+	}
+	return &Client{opts: opts}
+}
+
+// dialVsock connects to the vsockserver, which runs in the same guest.
+func dialVsock(ctx context.Context) (net.Conn, error) {
+	return vsock.Dial(vsock.Local, VsockPort, nil)
+}
+
+// Call invokes the callback `method` with `params` and decodes its result into `result`, unless
+// `result` is nil. `params` is encoded as JSON; nil sends no params.
+//
+// Callbacks are only sent again if they never reached the host, e.g. because the vsockserver is
+// still starting, since the tools they invoke may not be safe to run twice.
+func (c *Client) Call(ctx context.Context, method string, params any, result any) error {
+	var rawParams json.RawMessage
+	if params != nil {
+		var err error
+		if rawParams, err = json.Marshal(params); err != nil {
+			return fmt.Errorf("failed to encode params: %w", err)
+		}
+	}
+	raw, err := c.CallRaw(ctx, method, rawParams)
+	if err != nil {
+		return err
+	}
+	if result == nil || len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("failed to decode result of callback %s: %w", method, err)
+	}
+	return nil
+}
+
+// CallRaw is `Call` with params and result left as JSON.
+func (c *Client) CallRaw(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	if method == "" || strings.ContainsAny(method, " \n") {
+		return nil, fmt.Errorf("invalid callback method %q", method)
+	}
+	return c.send(ctx, method, CommandPrefix, func(timeout time.Duration) any {
+		// Let the vsockserver wait for the host as long as this attempt waits for it.
+		return Request{Method: method, Params: params, TimeoutMillis: timeout.Milliseconds()}
+	})
+}
+
+// Report sends a report of type `reportType`, e.g. `ReportProgress`, to the host. Reports are
+// retried like callbacks.
+func (c *Client) Report(ctx context.Context, reportType string, data map[string]string) error {
+	_, err := c.send(ctx, "report "+reportType, ReportPrefix, func(time.Duration) any {
+		return Report{Type: reportType, Data: data}
+	})
+	return err
+}
+
+// send sends the command `prefix` with the JSON encoding of `req(timeout)`, where `timeout` is
+// what's left of the attempt, retrying failures that never reached the host. `what` names the
+// request in errors.
+func (c *Client) send(ctx context.Context, what string, prefix string, req func(timeout time.Duration) any) (json.RawMessage, error) {
+	for retry := 0; ; retry++ {
+		result, err := c.attempt(ctx, what, prefix, req)
+		var callErr *Error
+		if err == nil || !errors.As(err, &callErr) || !callErr.Retryable ||
+			(c.opts.MaxRetries >= 0 && retry >= c.opts.MaxRetries) {
+			return result, err
+		}
+		if waitErr := backoff.Wait(ctx, c.backoff(retry+1)); waitErr != nil {
+			return nil, err
+		}
+	}
+}
+
+// attempt sends the command once.
+func (c *Client) attempt(ctx context.Context, method string, prefix string, req func(time.Duration) any) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	conn, err := c.opts.Dial(ctx)
+	if err != nil {
+		// Nothing was sent, so trying again is safe.
+		return nil, &Error{
+			Method:    method,
+			Message:   fmt.Sprintf("failed to connect to vsockserver: %v", err),
+			Retryable: true,
+		}
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	// Unblock reads and writes if the caller gives up early.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	data, err := json.Marshal(req(time.Until(deadline)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(append([]byte(prefix), data...), '\n')); err != nil {
+		return nil, connError(ctx, method, err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, connError(ctx, method, err)
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from vsockserver: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, &Error{
+			Method:    method,
+			Message:   resp.Error.Message,
+			Code:      resp.Error.Code,
+			Retryable: resp.Error.Retryable,
+		}
+	}
+	return resp.Result, nil
+}
+
+// connError describes a connection to the vsockserver that failed after the callback was sent.
+func connError(ctx context.Context, method string, err error) error {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return &Error{Method: method, Message: err.Error()}
+}
+
+// backoff returns how long to wait before retry number `retry`, counting from 1.
+func (c *Client) backoff(retry int) time.Duration {
+	return backoff.Duration(retry, c.opts.InitialBackoff, c.opts.MaxBackoff)
+}
+
+// Call invokes a callback with a default client.
+func Call(ctx context.Context, method string, params any, result any) error {
+	return New(Options{}).Call(ctx, method, params, result)
+}
@@ -0,0 +1,113 @@
+package guestcall
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// Prefix of the command that manages long-running processes in the guest,
+	// `PROCESS <ProcessRequest as JSON>`. The vsockserver answers with a `Response` whose result
+	// depends on the op, and the connection can be used for further commands. Only authenticated
+	// connections may send it.
+	ProcessPrefix = "PROCESS "
+
+	// Ops of a `ProcessRequest`. Start runs `Cmd` detached and returns its `ProcessInfo`.
+	ProcessOpStart = "start"
+	// Returns a `ProcessList`.
+	ProcessOpList = "list"
+	// Returns the `ProcessOutput` of `ID` from `Offset`.
+	ProcessOpOutput = "output"
+	// Sends `Signal` to the process group of `ID` and returns its `ProcessInfo`.
+	ProcessOpSignal = "signal"
+	// Kills the process group of `ID` if it's still running, forgets it and returns its
+	// `ProcessInfo`.
+	ProcessOpKill = "kill"
+
+	// Codes of the errors a `PROCESS` command fails with.
+	ErrorInvalidProcess   = "invalid_process"
+	ErrorProcessNotFound  = "process_not_found"
+	ErrorTooManyProcesses = "too_many_processes"
+	ErrorProcessFailed    = "process_failed"
+
+	// Output of a process the vsockserver keeps, dropping the oldest beyond that.
+	MaxProcessOutput = 1 << 20
+)
+
+// ProcessRequest is the payload of the `PROCESS` command.
+type ProcessRequest struct {
+	Op string `json:"op"`
+	// The process, for all ops but start and list.
+	ID string `json:"id,omitempty"`
+	// For start: the command, run by bash, its extra environment and working directory.
+	Cmd     string            `json:"cmd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Workdir string            `json:"workdir,omitempty"`
+	// For signal: the name of the signal, e.g. "SIGTERM".
+	Signal string `json:"signal,omitempty"`
+	// For output: the offset in the process's output to read from, and at most how many bytes.
+	// Zero reads as much as is kept.
+	Offset   int64 `json:"offset,omitempty"`
+	MaxBytes int   `json:"maxBytes,omitempty"`
+}
+
+// ProcessInfo describes a process started with `PROCESS`. ExitCode is set once it exited, -1 if
+// it was killed by a signal.
+type ProcessInfo struct {
+	ID        string     `json:"id"`
+	Cmd       string     `json:"cmd"`
+	PID       int        `json:"pid"`
+	Running   bool       `json:"running"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	ExitedAt  *time.Time `json:"exitedAt,omitempty"`
+	// Bytes written to stdout and stderr so far, including ones no longer kept.
+	OutputSize int64 `json:"outputSize"`
+}
+
+// ProcessList is the result of the list op, oldest process first.
+type ProcessList struct {
+	Processes []ProcessInfo `json:"processes"`
+}
+
+// ProcessOutput is a part of the combined stdout and stderr of a process. Offset is where Data
+// starts, which is after the requested offset if output before it was dropped, and NextOffset is
+// where to continue reading.
+type ProcessOutput struct {
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"nextOffset"`
+	Data       []byte `json:"data"`
+	// Set if output between the requested offset and Offset was dropped.
+	Truncated bool        `json:"truncated,omitempty"`
+	Process   ProcessInfo `json:"process"`
+}
+
+// CallProcess sends `req` to the vsockserver on the other end of `w` and `r`, and decodes the
+// result into `result`. Errors of the vsockserver are returned as a `*ResponseError`.
+func CallProcess(w io.Writer, r *bufio.Reader, req ProcessRequest, result any) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", ProcessPrefix, data); err != nil {
+		return err
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("invalid response from vsockserver: %w", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("invalid result from vsockserver: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package guestcall
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Prefix of the command that starts an interactive shell on a new pseudo-terminal in the
+	// guest, `PTY <PTYRequest as JSON>`. The vsockserver answers with a `Response`, after which
+	// the connection carries frames both ways, see `WriteFrame`, until the shell exits. Closing
+	// the connection hangs the shell up. Only authenticated connections may send it.
+	PTYPrefix = "PTY "
+
+	// Codes of the errors a `PTY` command fails with.
+	ErrorInvalidPTY = "invalid_pty"
+	ErrorPTYFailed  = "pty_failed"
+
+	// Terminal input from the host or output from the guest, as is.
+	FrameData byte = 'd'
+	// Sent by the host when its terminal changes size, a `PTYSize` as JSON.
+	FrameResize byte = 'r'
+	// The last frame from the guest, once the shell exited, a `PTYExit` as JSON.
+	FrameExit byte = 'x'
+
+	// Largest frame payload either side sends.
+	MaxFrameSize = 1 << 20
+)
+
+// PTYSize is the size of a terminal in characters.
+type PTYSize struct {
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+// PTYRequest is the payload of the `PTY` command.
+type PTYRequest struct {
+	PTYSize
+	// The TERM of the shell, e.g. "xterm-256color".
+	Term string `json:"term,omitempty"`
+}
+
+// PTYExit reports how the shell of a `PTY` command ended. Error is set if it couldn't be waited
+// for, in which case ExitCode is -1.
+type PTYExit struct {
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ValidateTerm returns an error unless `term` can be passed as TERM.
+func ValidateTerm(term string) error {
+	if len(term) > 64 || strings.ContainsFunc(term, func(r rune) bool { return r <= ' ' || r > '~' || r == '=' }) {
+		return fmt.Errorf("invalid terminal type %q", term)
+	}
+	return nil
+}
+
+// WriteFrame writes a frame of type `typ`: the type, the payload's length as 4 bytes big endian,
+// and the payload.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the limit of %d", len(payload), MaxFrameSize)
+	}
+	frame := make([]byte, 5+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a frame written by `WriteFrame`.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", size, MaxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// OpenPTY asks the vsockserver on the other end of `w` and `r` to start a shell on a new
+// pseudo-terminal. Once it returns, the connection, read through `r`, carries frames. Errors of the
+// vsockserver are returned as a `*ResponseError`.
+func OpenPTY(w io.Writer, r *bufio.Reader, req PTYRequest) error {
+	if err := ValidateTerm(req.Term); err != nil {
+		return err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", PTYPrefix, data); err != nil {
+		return err
+	}
+	return readResponse(r)
+}
+
+// readResponse reads the vsockserver's answer to a command that switches the connection over to
+// another protocol.
+func readResponse(r *bufio.Reader) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("invalid response from vsockserver: %w", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package guestcall
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// Prefix of the command that bridges a connection to a Unix socket in the guest,
+	// `SOCKET <path>`. The vsockserver answers with a `Response`, after which the connection
+	// carries the socket's bytes both ways until either side closes it. Only authenticated
+	// connections may send it.
+	SocketPrefix = "SOCKET "
+
+	// Codes of the errors a `SOCKET` command fails with.
+	ErrorInvalidSocket     = "invalid_socket"
+	ErrorSocketUnreachable = "socket_unreachable"
+)
+
+// ValidateSocketPath returns an error unless `p` is an absolute, clean path, as `SOCKET` expects.
+func ValidateSocketPath(p string) error {
+	if !path.IsAbs(p) || path.Clean(p) != p || strings.ContainsAny(p, "\n\r\x00") {
+		return fmt.Errorf("socket path must be absolute and clean, got %q", p)
+	}
+	return nil
+}
+
+// OpenSocket asks the vsockserver on the other end of `w` and `r` to bridge the connection to the
+// Unix socket at `socketPath`. Once it returns, the connection, read through `r`, is the socket's.
+// Errors of the vsockserver are returned as a `*ResponseError`.
+func OpenSocket(w io.Writer, r *bufio.Reader, socketPath string) error {
+	if err := ValidateSocketPath(socketPath); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", SocketPrefix, socketPath); err != nil {
+		return err
+	}
+	return readResponse(r)
+}
@@ -0,0 +1,11 @@
+package guestcall
+
+const (
+	// Signals the guest forwards to the host, as OTLP/HTTP JSON posted to the restserver's
+	// "/v1/internal/telemetry/{signal}".
+	TelemetryLogs    = "logs"
+	TelemetryMetrics = "metrics"
+
+	// Largest export request the host accepts from a guest.
+	MaxTelemetryBody = 4 << 20
+)
@@ -0,0 +1,266 @@
+// Package guestfs exposes a running guest's filesystem on the host as a read-only FUSE mount. All
+// operations are served by the guest's command server, so nothing is copied out of the guest until
+// it is actually read.
+package guestfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	// How long the kernel may cache names and attributes. The guest keeps running while mounted, so
+	// this trades freshness for fewer round trips while indexing.
+	cacheTimeout = 5 * time.Second
+
+	// Must not exceed the command server's limit for a single read.
+	maxReadSize = 1 << 20
+
+	requestTimeout = 30 * time.Second
+)
+
+// client talks to the "/fs" endpoints of a guest's command server.
+type client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func (c *client) get(ctx context.Context, endpoint string, params url.Values) (*http.Response, syscall.Errno) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, syscall.EINVAL
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		log.WithError(err).Debugf("guest fs request failed: %s", endpoint)
+		return nil, syscall.EIO
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, 0
+	}
+	defer resp.Body.Close()
+
+	var errResp cmdserver.FsErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil && errResp.Errno != 0 {
+		return nil, syscall.Errno(errResp.Errno)
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, syscall.ENOENT
+	case http.StatusForbidden:
+		return nil, syscall.EACCES
+	}
+	return nil, syscall.EIO
+}
+
+func (c *client) getJSON(ctx context.Context, endpoint string, params url.Values, v any) syscall.Errno {
+	resp, errno := c.get(ctx, endpoint, params)
+	if errno != 0 {
+		return errno
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
+func (c *client) stat(ctx context.Context, p string) (cmdserver.FsEntry, syscall.Errno) {
+	var entry cmdserver.FsEntry
+	errno := c.getJSON(ctx, "/fs/stat", url.Values{"path": {p}}, &entry)
+	return entry, errno
+}
+
+func (c *client) readDir(ctx context.Context, p string) ([]cmdserver.FsEntry, syscall.Errno) {
+	var resp cmdserver.FsReadDirResponse
+	errno := c.getJSON(ctx, "/fs/readdir", url.Values{"path": {p}}, &resp)
+	return resp.Entries, errno
+}
+
+func (c *client) read(ctx context.Context, p string, dest []byte, offset int64) (int, syscall.Errno) {
+	total := 0
+	for total < len(dest) {
+		chunk := min(len(dest)-total, maxReadSize)
+		resp, errno := c.get(ctx, "/fs/read", url.Values{
+			"path":   {p},
+			"offset": {strconv.FormatInt(offset+int64(total), 10)},
+			"length": {strconv.Itoa(chunk)},
+		})
+		if errno != 0 {
+			return total, errno
+		}
+		n, err := io.ReadFull(resp.Body, dest[total:total+chunk])
+		resp.Body.Close()
+		total += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Short read, we hit the end of the file.
+			break
+		}
+		if err != nil {
+			return total, syscall.EIO
+		}
+	}
+	return total, 0
+}
+
+// node is a file, directory or symlink in the guest.
+type node struct {
+	fs.Inode
+	client *client
+	// Absolute path in the guest.
+	path string
+}
+
+var (
+	_ fs.NodeLookuper   = (*node)(nil)
+	_ fs.NodeReaddirer  = (*node)(nil)
+	_ fs.NodeGetattrer  = (*node)(nil)
+	_ fs.NodeOpener     = (*node)(nil)
+	_ fs.NodeReader     = (*node)(nil)
+	_ fs.NodeReadlinker = (*node)(nil)
+)
+
+func fillAttr(entry cmdserver.FsEntry, out *fuse.Attr) {
+	out.Mode = entry.Mode
+	out.Size = uint64(entry.Size)
+	out.Blocks = (out.Size + 511) / 512
+	out.Nlink = entry.Nlink
+	out.Owner = fuse.Owner{Uid: entry.Uid, Gid: entry.Gid}
+	mtime := time.Unix(0, entry.MtimeNs)
+	out.SetTimes(nil, &mtime, &mtime)
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	childPath := path.Join(n.path, name)
+	entry, errno := n.client.stat(ctx, childPath)
+	if errno != 0 {
+		return nil, errno
+	}
+	fillAttr(entry, &out.Attr)
+	child := &node{client: n.client, path: childPath}
+	// Inode numbers are left to go-fuse. The guest's aren't unique across its mounts, e.g. /proc.
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: entry.Mode & syscall.S_IFMT}), 0
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, errno := n.client.readDir(ctx, n.path)
+	if errno != 0 {
+		return nil, errno
+	}
+	dirEntries := make([]fuse.DirEntry, len(entries))
+	for i, entry := range entries {
+		dirEntries[i] = fuse.DirEntry{Name: entry.Name, Mode: entry.Mode}
+	}
+	return fs.NewListDirStream(dirEntries), 0
+}
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	entry, errno := n.client.stat(ctx, n.path)
+	if errno != 0 {
+		return errno
+	}
+	fillAttr(entry, &out.Attr)
+	out.SetTimeout(cacheTimeout)
+	return 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	// Let the kernel keep what it has read, the guest may change underneath but that is fine for
+	// indexing.
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *node) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	size, errno := n.client.read(ctx, n.path, dest, off)
+	if errno != 0 {
+		return nil, errno
+	}
+	return fuse.ReadResultData(dest[:size]), 0
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	entry, errno := n.client.stat(ctx, n.path)
+	if errno != 0 {
+		return nil, errno
+	}
+	if entry.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return nil, syscall.EINVAL
+	}
+	return []byte(entry.LinkTarget), 0
+}
+
+// Mount is a guest filesystem mounted on the host.
+type Mount struct {
+	server     *fuse.Server
+	Mountpoint string
+	GuestPath  string
+}
+
+// NewMount mounts `guestPath` from the guest whose command server is at `cmdServerURL` read-only
+// at `mountpoint`, which must be an existing directory. Unless `allowOther` is set, only the user
+// running the server can access the mount.
+func NewMount(cmdServerURL string, guestPath string, mountpoint string, allowOther bool) (*Mount, error) {
+	guestPath = path.Clean(guestPath)
+	if !path.IsAbs(guestPath) {
+		return nil, fmt.Errorf("guest path must be absolute: %s", guestPath)
+	}
+
+	c := &client{
+		baseURL:    cmdServerURL,
+		httpClient: &http.Client{Timeout: requestTimeout},
+	}
+	// Fail early, rather than on first access, if the guest isn't reachable.
+	entry, errno := c.stat(context.Background(), guestPath)
+	if errno != 0 {
+		return nil, fmt.Errorf("failed to stat %s in guest: %w", guestPath, errno)
+	}
+	if entry.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, fmt.Errorf("not a directory in guest: %s", guestPath)
+	}
+
+	timeout := cacheTimeout
+	server, err := fs.Mount(mountpoint, &node{client: c, path: guestPath}, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: "arrakis-guest",
+			Name:   "arrakis",
+			// The kernel checks access against the guest's owners and permission bits, we don't.
+			Options:    []string{"ro", "default_permissions"},
+			AllowOther: allowOther,
+			// Readahead size, fewer round trips to the guest for sequential reads.
+			MaxReadAhead: maxReadSize,
+		},
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: &timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount guest filesystem: %w", err)
+	}
+	return &Mount{server: server, Mountpoint: mountpoint, GuestPath: guestPath}, nil
+}
+
+// Unmount unmounts the filesystem. It fails if the mount is still in use on the host.
+func (m *Mount) Unmount() error {
+	if err := m.server.Unmount(); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", m.Mountpoint, err)
+	}
+	return nil
+}
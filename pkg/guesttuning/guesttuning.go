@@ -0,0 +1,610 @@
+// Package guesttuning encodes the per-template sysctls, ulimits, kernel modules, container
+// runtime, telemetry, credential profile, shared directory, tmpfs and swap settings that the host passes to the guest on the kernel command line. It is shared by the restserver, which encodes
+// them, and guestinit and the vsockserver, which decode and apply them at boot.
+package guesttuning
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Kernel command line keys, i.e. sysctls="...", ulimits="...", modules="..." and
+	// container_runtime="...".
+	SysctlsCmdlineKey          = "sysctls"
+	UlimitsCmdlineKey          = "ulimits"
+	ModulesCmdlineKey          = "modules"
+	ContainerRuntimeCmdlineKey = "container_runtime"
+	// Read by the initramfs rather than guestinit, to pick the guest's init.
+	InitCmdlineKey = "arrakis_init"
+	// Read by the vsockserver, which collects and forwards the guest's logs and metrics.
+	TelemetryCmdlineKey = "telemetry"
+	// Read by the vsockserver, which serves the credentials of these profiles to the workload.
+	CredentialsCmdlineKey = "credentials"
+	// Host directories guestinit mounts, as virtiofs tags and where they go.
+	SharedDirsCmdlineKey = "shared_dirs"
+	// Data disks guestinit mounts, as the serials of their devices and where they go.
+	DataDisksCmdlineKey = "data_disks"
+	// tmpfs mounts guestinit sizes, as paths and sizes in bytes, and the size in bytes of the swap
+	// file it enables.
+	TmpfsCmdlineKey = "tmpfs"
+	SwapCmdlineKey  = "swap"
+
+	// Container engines that images can be built with.
+	EngineDocker = "docker"
+	EnginePodman = "podman"
+
+	// Inits the guest can boot with. The initramfs boots images with systemd with it, and the
+	// others with guestinit as PID 1, unless the template picks one.
+	InitSystemd = "systemd"
+	InitAgent   = "agent"
+
+	unlimited = "unlimited"
+)
+
+var (
+	// Also allows "/" as some sysctl keys embed interface names with dots replaced by slashes.
+	sysctlKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-]+(\.[a-zA-Z0-9_\-/]+)+$`)
+
+	// Names of credential profiles, which can be carried on the kernel command line.
+	credentialProfileRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_\-]*$`)
+
+	// Module names as accepted by modprobe, which treats "-" and "_" the same. A leading "-" would
+	// make them flags.
+	moduleNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_\-]*$`)
+
+	// Storage drivers each engine may be configured with, the default first. The guest's root is
+	// an overlayfs, which the kernel's overlay driver can't be stacked on, so the defaults go
+	// through fuse-overlayfs instead.
+	storageDrivers = map[string][]string{
+		EngineDocker: {"fuse-overlayfs", "vfs", "overlay2"},
+		EnginePodman: {"overlay", "vfs"},
+	}
+
+	// Cgroup drivers, the default first.
+	cgroupDrivers = []string{"systemd", "cgroupfs"}
+
+	// Maps the ulimit names used by limits.conf to the equivalent systemd directives.
+	systemdLimitDirectives = map[string]string{
+		"as":         "LimitAS",
+		"core":       "LimitCORE",
+		"cpu":        "LimitCPU",
+		"fsize":      "LimitFSIZE",
+		"locks":      "LimitLOCKS",
+		"memlock":    "LimitMEMLOCK",
+		"msgqueue":   "LimitMSGQUEUE",
+		"nice":       "LimitNICE",
+		"nofile":     "LimitNOFILE",
+		"nproc":      "LimitNPROC",
+		"rtprio":     "LimitRTPRIO",
+		"sigpending": "LimitSIGPENDING",
+		"stack":      "LimitSTACK",
+	}
+)
+
+// Sysctl is a single kernel parameter, e.g. fs.inotify.max_user_watches=524288.
+type Sysctl struct {
+	Key   string
+	Value string
+}
+
+// ProcPath returns the path under /proc/sys that the sysctl is written to.
+func (s Sysctl) ProcPath() string {
+	return "/proc/sys/" + strings.ReplaceAll(s.Key, ".", "/")
+}
+
+// Ulimit is a resource limit, e.g. nofile. Soft and Hard are either a number or "unlimited".
+type Ulimit struct {
+	Name string
+	Soft string
+	Hard string
+}
+
+// SystemdDirective returns the systemd unit directive for the limit, e.g. LimitNOFILE.
+func (u Ulimit) SystemdDirective() string {
+	return systemdLimitDirectives[u.Name]
+}
+
+// ParseSysctl parses a sysctl in "key=value" form.
+func ParseSysctl(s string) (Sysctl, error) {
+	key, value, found := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	if !found || value == "" {
+		return Sysctl{}, fmt.Errorf("sysctl %q must be in key=value form", s)
+	}
+	if !sysctlKeyRegex.MatchString(key) {
+		return Sysctl{}, fmt.Errorf("invalid sysctl key: %q", key)
+	}
+	// These would break the encoding on the kernel command line.
+	if strings.ContainsAny(value, "\",\n") {
+		return Sysctl{}, fmt.Errorf("invalid value for sysctl %s: %q", key, value)
+	}
+	return Sysctl{Key: key, Value: value}, nil
+}
+
+// ParseUlimit parses a limit given as either a single value used for both the soft and hard limit,
+// or as "soft:hard".
+func ParseUlimit(name string, value string) (Ulimit, error) {
+	if _, ok := systemdLimitDirectives[name]; !ok {
+		return Ulimit{}, fmt.Errorf("unsupported ulimit: %q", name)
+	}
+
+	soft, hard, found := strings.Cut(value, ":")
+	if !found {
+		hard = soft
+	}
+	for _, v := range []string{soft, hard} {
+		if v == unlimited {
+			continue
+		}
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			return Ulimit{}, fmt.Errorf("invalid value for ulimit %s: %q", name, value)
+		}
+	}
+	return Ulimit{Name: name, Soft: soft, Hard: hard}, nil
+}
+
+// EncodeSysctls encodes sysctls as the value of the SysctlsCmdlineKey kernel command line key.
+func EncodeSysctls(sysctls []Sysctl) string {
+	parts := make([]string, 0, len(sysctls))
+	for _, s := range sysctls {
+		parts = append(parts, s.Key+"="+s.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeSysctls is the inverse of EncodeSysctls.
+func DecodeSysctls(encoded string) ([]Sysctl, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var sysctls []Sysctl
+	for _, part := range strings.Split(encoded, ",") {
+		s, err := ParseSysctl(part)
+		if err != nil {
+			return nil, err
+		}
+		sysctls = append(sysctls, s)
+	}
+	return sysctls, nil
+}
+
+// EncodeUlimits encodes ulimits as the value of the UlimitsCmdlineKey kernel command line key.
+// Limits are sorted by name so that the command line is stable.
+func EncodeUlimits(ulimits []Ulimit) string {
+	parts := make([]string, 0, len(ulimits))
+	for _, u := range ulimits {
+		parts = append(parts, fmt.Sprintf("%s=%s:%s", u.Name, u.Soft, u.Hard))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// DecodeUlimits is the inverse of EncodeUlimits.
+func DecodeUlimits(encoded string) ([]Ulimit, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var ulimits []Ulimit
+	for _, part := range strings.Split(encoded, ",") {
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("ulimit %q must be in name=value form", part)
+		}
+		u, err := ParseUlimit(name, value)
+		if err != nil {
+			return nil, err
+		}
+		ulimits = append(ulimits, u)
+	}
+	return ulimits, nil
+}
+
+// ValidateModuleName returns an error if `name` isn't a valid kernel module name.
+func ValidateModuleName(name string) error {
+	if !moduleNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid kernel module name: %q", name)
+	}
+	return nil
+}
+
+// EncodeModules encodes kernel module names as the value of the ModulesCmdlineKey kernel command
+// line key.
+func EncodeModules(modules []string) string {
+	return strings.Join(modules, ",")
+}
+
+// DecodeModules is the inverse of EncodeModules.
+func DecodeModules(encoded string) ([]string, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	modules := strings.Split(encoded, ",")
+	for _, module := range modules {
+		if err := ValidateModuleName(module); err != nil {
+			return nil, err
+		}
+	}
+	return modules, nil
+}
+
+// ContainerRuntime configures the container engine installed in the guest image, e.g. Docker with
+// the fuse-overlayfs storage driver and systemd managing its cgroups.
+type ContainerRuntime struct {
+	Engine        string
+	StorageDriver string
+	CgroupDriver  string
+}
+
+// ValidateInit returns an error if `init` isn't an init the guest can boot with.
+func ValidateInit(init string) error {
+	if init != InitSystemd && init != InitAgent {
+		return fmt.Errorf("unsupported init: %q, must be %q or %q", init, InitSystemd, InitAgent)
+	}
+	return nil
+}
+
+// ValidateEngine returns an error if `engine` isn't a supported container engine.
+func ValidateEngine(engine string) error {
+	if _, ok := storageDrivers[engine]; !ok {
+		return fmt.Errorf("unsupported container engine: %q", engine)
+	}
+	return nil
+}
+
+// ParseContainerRuntime checks the given settings and fills in the defaults of those left empty.
+func ParseContainerRuntime(engine string, storageDriver string, cgroupDriver string) (ContainerRuntime, error) {
+	if err := ValidateEngine(engine); err != nil {
+		return ContainerRuntime{}, err
+	}
+
+	drivers := storageDrivers[engine]
+	if storageDriver == "" {
+		storageDriver = drivers[0]
+	}
+	if !slices.Contains(drivers, storageDriver) {
+		return ContainerRuntime{}, fmt.Errorf("unsupported storage driver for %s: %q", engine, storageDriver)
+	}
+	if cgroupDriver == "" {
+		cgroupDriver = cgroupDrivers[0]
+	}
+	if !slices.Contains(cgroupDrivers, cgroupDriver) {
+		return ContainerRuntime{}, fmt.Errorf("unsupported cgroup driver: %q", cgroupDriver)
+	}
+	return ContainerRuntime{Engine: engine, StorageDriver: storageDriver, CgroupDriver: cgroupDriver}, nil
+}
+
+// EncodeContainerRuntime encodes `rt` as the value of the ContainerRuntimeCmdlineKey kernel command
+// line key.
+func EncodeContainerRuntime(rt ContainerRuntime) string {
+	return strings.Join([]string{rt.Engine, rt.StorageDriver, rt.CgroupDriver}, ",")
+}
+
+// DecodeContainerRuntime is the inverse of EncodeContainerRuntime. It returns nil if `encoded` is
+// empty, i.e. the template doesn't configure a container runtime.
+func DecodeContainerRuntime(encoded string) (*ContainerRuntime, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(encoded, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("container runtime %q must be in engine,storage,cgroup form", encoded)
+	}
+	rt, err := ParseContainerRuntime(parts[0], parts[1], parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// Telemetry picks what the guest's vsockserver forwards to the host: new lines of LogFiles, the
+// systemd journal and OTLP/HTTP logs and metrics the workload sends it.
+type Telemetry struct {
+	LogFiles []string
+	Journald bool
+	OTLP     bool
+}
+
+// Items of the TelemetryCmdlineKey value, besides "file:" followed by a log file's path.
+const (
+	telemetryJournald   = "journald"
+	telemetryOTLP       = "otlp"
+	telemetryFilePrefix = "file:"
+)
+
+// ValidateLogFile returns an error unless `path` is absolute and can be carried on the kernel
+// command line.
+func ValidateLogFile(path string) error {
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "\",\\ \t\n") {
+		return fmt.Errorf("invalid log file %q, must be an absolute path without whitespace, quotes or commas", path)
+	}
+	return nil
+}
+
+// EncodeTelemetry encodes `t` as the value of the TelemetryCmdlineKey kernel command line key, or
+// "" if it collects nothing.
+func EncodeTelemetry(t Telemetry) string {
+	var parts []string
+	if t.OTLP {
+		parts = append(parts, telemetryOTLP)
+	}
+	if t.Journald {
+		parts = append(parts, telemetryJournald)
+	}
+	for _, path := range t.LogFiles {
+		parts = append(parts, telemetryFilePrefix+path)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeTelemetry is the inverse of EncodeTelemetry. It returns nil if `encoded` is empty, i.e.
+// the guest forwards nothing.
+func DecodeTelemetry(encoded string) (*Telemetry, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var t Telemetry
+	for _, part := range strings.Split(encoded, ",") {
+		switch {
+		case part == telemetryOTLP:
+			t.OTLP = true
+		case part == telemetryJournald:
+			t.Journald = true
+		case strings.HasPrefix(part, telemetryFilePrefix):
+			path := strings.TrimPrefix(part, telemetryFilePrefix)
+			if err := ValidateLogFile(path); err != nil {
+				return nil, err
+			}
+			t.LogFiles = append(t.LogFiles, path)
+		default:
+			return nil, fmt.Errorf("unknown telemetry source %q", part)
+		}
+	}
+	return &t, nil
+}
+
+// CredentialProfile is a credential profile the guest may get short-lived cloud credentials of,
+// e.g. "s3-reader" of "aws".
+type CredentialProfile struct {
+	Name     string
+	Provider string
+}
+
+// ValidateCredentialProfile returns an error if `name` isn't a valid credential profile name.
+func ValidateCredentialProfile(name string) error {
+	if !credentialProfileRegex.MatchString(name) {
+		return fmt.Errorf("invalid credential profile name: %q", name)
+	}
+	return nil
+}
+
+// EncodeCredentialProfiles encodes profiles as the value of the CredentialsCmdlineKey kernel
+// command line key.
+func EncodeCredentialProfiles(profiles []CredentialProfile) string {
+	parts := make([]string, 0, len(profiles))
+	for _, p := range profiles {
+		parts = append(parts, p.Name+":"+p.Provider)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeCredentialProfiles is the inverse of EncodeCredentialProfiles.
+func DecodeCredentialProfiles(encoded string) ([]CredentialProfile, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var profiles []CredentialProfile
+	for _, part := range strings.Split(encoded, ",") {
+		name, provider, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("credential profile %q must be in name:provider form", part)
+		}
+		if err := ValidateCredentialProfile(name); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, CredentialProfile{Name: name, Provider: provider})
+	}
+	return profiles, nil
+}
+
+// SharedDir is a directory of the host shared into the guest under the virtiofs tag Tag, mounted
+// on GuestPath.
+type SharedDir struct {
+	Tag       string
+	GuestPath string
+	ReadOnly  bool
+}
+
+// Access modes of shared directories and data disks in the SharedDirsCmdlineKey and
+// DataDisksCmdlineKey values.
+const (
+	sharedDirReadOnly  = "ro"
+	sharedDirReadWrite = "rw"
+)
+
+const (
+	// Guests without virtiofs mount the shared directories over 9P from this vsock port of the
+	// host, with their tag as the attach name.
+	SharedDirsVsockPort = 564
+
+	// Transports shared directories are mounted with.
+	SharedDirTransportVirtiofs = "virtiofs"
+	SharedDirTransport9P       = "9p"
+)
+
+// ValidateGuestPath returns an error unless `path` is absolute and can be carried on the kernel
+// command line.
+func ValidateGuestPath(path string) error {
+	if !strings.HasPrefix(path, "/") || path == "/" || strings.ContainsAny(path, "\",:\\ \t\n") {
+		return fmt.Errorf("invalid guest path %q, must be an absolute path below / without whitespace, quotes, commas or colons", path)
+	}
+	return nil
+}
+
+// EncodeSharedDirs encodes dirs as the value of the SharedDirsCmdlineKey kernel command line key.
+func EncodeSharedDirs(dirs []SharedDir) string {
+	parts := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		mode := sharedDirReadWrite
+		if d.ReadOnly {
+			mode = sharedDirReadOnly
+		}
+		parts = append(parts, d.Tag+":"+d.GuestPath+":"+mode)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeSharedDirs is the inverse of EncodeSharedDirs.
+func DecodeSharedDirs(encoded string) ([]SharedDir, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var dirs []SharedDir
+	for _, part := range strings.Split(encoded, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 || fields[0] == "" || (fields[2] != sharedDirReadOnly && fields[2] != sharedDirReadWrite) {
+			return nil, fmt.Errorf("shared directory %q must be in tag:path:ro or tag:path:rw form", part)
+		}
+		if err := ValidateGuestPath(fields[1]); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, SharedDir{Tag: fields[0], GuestPath: fields[1], ReadOnly: fields[2] == sharedDirReadOnly})
+	}
+	return dirs, nil
+}
+
+// DataDisk is a data disk of the VM whose device has the serial Serial, mounted on GuestPath.
+type DataDisk struct {
+	Serial    string
+	GuestPath string
+	ReadOnly  bool
+}
+
+// Data disk IDs double as the serials of their devices, which virtio-blk caps at 20 bytes.
+var dataDiskIdRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,19}$`)
+
+// ValidateDataDiskId returns an error unless `id` can be the ID of a data disk.
+func ValidateDataDiskId(id string) error {
+	if !dataDiskIdRegex.MatchString(id) {
+		return fmt.Errorf("invalid disk id %q, must be at most 20 lowercase letters, digits and '-', starting with a letter or digit", id)
+	}
+	return nil
+}
+
+// EncodeDataDisks encodes disks as the value of the DataDisksCmdlineKey kernel command line key.
+func EncodeDataDisks(disks []DataDisk) string {
+	parts := make([]string, 0, len(disks))
+	for _, d := range disks {
+		mode := sharedDirReadWrite
+		if d.ReadOnly {
+			mode = sharedDirReadOnly
+		}
+		parts = append(parts, d.Serial+":"+d.GuestPath+":"+mode)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeDataDisks is the inverse of EncodeDataDisks.
+func DecodeDataDisks(encoded string) ([]DataDisk, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var disks []DataDisk
+	for _, part := range strings.Split(encoded, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 || (fields[2] != sharedDirReadOnly && fields[2] != sharedDirReadWrite) {
+			return nil, fmt.Errorf("data disk %q must be in serial:path:ro or serial:path:rw form", part)
+		}
+		if err := ValidateDataDiskId(fields[0]); err != nil {
+			return nil, err
+		}
+		if err := ValidateGuestPath(fields[1]); err != nil {
+			return nil, err
+		}
+		disks = append(disks, DataDisk{Serial: fields[0], GuestPath: fields[1], ReadOnly: fields[2] == sharedDirReadOnly})
+	}
+	return disks, nil
+}
+
+// Tmpfs is a tmpfs mounted on Path, capped at SizeBytes.
+type Tmpfs struct {
+	Path      string
+	SizeBytes int64
+}
+
+// ParseTmpfs parses a tmpfs of a template in path:size_mb form, e.g. /tmp:512.
+func ParseTmpfs(s string) (Tmpfs, error) {
+	path, sizeMB, found := strings.Cut(s, ":")
+	if !found {
+		return Tmpfs{}, fmt.Errorf("tmpfs %q must be in path:size_mb form", s)
+	}
+	size, err := strconv.ParseInt(sizeMB, 10, 64)
+	if err != nil {
+		return Tmpfs{}, fmt.Errorf("invalid size of tmpfs %q: %w", s, err)
+	}
+	t := Tmpfs{Path: path, SizeBytes: size << 20}
+	return t, ValidateTmpfs(t)
+}
+
+// ValidateTmpfs returns an error unless `t` can be mounted in the guest.
+func ValidateTmpfs(t Tmpfs) error {
+	if err := ValidateGuestPath(t.Path); err != nil {
+		return err
+	}
+	for _, p := range []string{"/dev", "/proc", "/sys"} {
+		if t.Path == p || (strings.HasPrefix(t.Path, p+"/") && t.Path != "/dev/shm") {
+			return fmt.Errorf("tmpfs can't be mounted on %s", t.Path)
+		}
+	}
+	if t.SizeBytes <= 0 {
+		return fmt.Errorf("size of tmpfs %s must be positive", t.Path)
+	}
+	return nil
+}
+
+// EncodeTmpfs encodes mounts as the value of the TmpfsCmdlineKey kernel command line key.
+func EncodeTmpfs(mounts []Tmpfs) string {
+	parts := make([]string, 0, len(mounts))
+	for _, t := range mounts {
+		parts = append(parts, t.Path+":"+strconv.FormatInt(t.SizeBytes, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeTmpfs is the inverse of EncodeTmpfs.
+func DecodeTmpfs(encoded string) ([]Tmpfs, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	var mounts []Tmpfs
+	for _, part := range strings.Split(encoded, ",") {
+		path, size, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("tmpfs %q must be in path:size form", part)
+		}
+		sizeBytes, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of tmpfs %q: %w", part, err)
+		}
+		t := Tmpfs{Path: path, SizeBytes: sizeBytes}
+		if err := ValidateTmpfs(t); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, t)
+	}
+	return mounts, nil
+}
@@ -0,0 +1,275 @@
+// Package logrotate rotates the logs the server keeps by size and age, and deletes old rotations.
+// A rotation is a file next to its log, named after it and the time it was rotated, e.g.
+// serial.log.20240102T150405.000Z.
+package logrotate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const timeFormat = "20060102T150405.000Z"
+
+// Policy says when a log is rotated and how long its rotations are kept. Zero values don't limit.
+type Policy struct {
+	MaxSize   int64
+	MaxAge    time.Duration
+	MaxFiles  int
+	Retention time.Duration
+}
+
+// FromConfig returns the policy of `cfg`, with the values of `defaults` where `cfg` has none.
+func FromConfig(cfg config.LogRotationConfig, defaults Policy) Policy {
+	p := Policy{
+		MaxSize:   cfg.MaxSizeMB << 20,
+		MaxAge:    cfg.MaxAge,
+		MaxFiles:  cfg.MaxFiles,
+		Retention: cfg.Retention,
+	}
+	if p.MaxSize == 0 {
+		p.MaxSize = defaults.MaxSize
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = defaults.MaxAge
+	}
+	if p.MaxFiles == 0 {
+		p.MaxFiles = defaults.MaxFiles
+	}
+	if p.Retention == 0 {
+		p.Retention = defaults.Retention
+	}
+	return p
+}
+
+// due reports whether a log of `size` bytes, written to since `since`, is to be rotated at `now`.
+func (p Policy) due(size int64, since time.Time, now time.Time) bool {
+	return (p.MaxSize > 0 && size > p.MaxSize) || (p.MaxAge > 0 && now.Sub(since) >= p.MaxAge)
+}
+
+// Rotation is a rotated part of a log.
+type Rotation struct {
+	Path string
+	Time time.Time
+}
+
+// Rotations returns the rotations of the log at `logPath`, oldest first.
+func Rotations(logPath string) ([]Rotation, error) {
+	entries, err := os.ReadDir(filepath.Dir(logPath))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(logPath) + "."
+	var rotations []Rotation
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(timeFormat, suffix)
+		if err != nil {
+			continue
+		}
+		rotations = append(rotations, Rotation{
+			Path: filepath.Join(filepath.Dir(logPath), entry.Name()),
+			Time: t,
+		})
+	}
+	sort.Slice(rotations, func(i, j int) bool { return rotations[i].Time.Before(rotations[j].Time) })
+	return rotations, nil
+}
+
+// Prune deletes the rotations of the log at `logPath` beyond the newest `p.MaxFiles` and those
+// older than `p.Retention`.
+func Prune(logPath string, p Policy, now time.Time) error {
+	rotations, err := Rotations(logPath)
+	if err != nil {
+		return err
+	}
+	var finalErr error
+	for i, rotation := range rotations {
+		excess := p.MaxFiles > 0 && len(rotations)-i > p.MaxFiles
+		expired := p.Retention > 0 && now.Sub(rotation.Time) > p.Retention
+		if !excess && !expired {
+			continue
+		}
+		if err := os.Remove(rotation.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	return finalErr
+}
+
+// rotationPath returns an unused path for the log at `logPath` rotated at `t`.
+func rotationPath(logPath string, t time.Time) string {
+	for {
+		p := logPath + "." + t.UTC().Format(timeFormat)
+		if _, err := os.Lstat(p); errors.Is(err, os.ErrNotExist) {
+			return p
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// lastRotation returns when the log at `logPath` was last rotated, or `fallback` if it never was.
+func lastRotation(logPath string, fallback time.Time) time.Time {
+	rotations, err := Rotations(logPath)
+	if err != nil || len(rotations) == 0 {
+		return fallback
+	}
+	return rotations[len(rotations)-1].Time
+}
+
+// Writer appends to a log, which it rotates as its policy says by renaming it and starting a new
+// one. It's safe for concurrent use.
+type Writer struct {
+	path   string
+	perm   os.FileMode
+	policy Policy
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+	// When the log was last rotated, or opened if it never was.
+	since time.Time
+}
+
+// Open opens the log at `logPath` for appending, creating it with `perm` if it doesn't exist.
+func Open(logPath string, perm os.FileMode, p Policy) (*Writer, error) {
+	w := &Writer{path: logPath, perm: perm, policy: p}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	w.since = lastRotation(logPath, time.Now())
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, w.perm)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+// Write appends `b` to the log, rotating it first if it's due. A write is never split across
+// rotations.
+func (w *Writer) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	if w.size > 0 && w.policy.due(w.size+int64(len(b)), w.since, now) {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) rotate(now time.Time) error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", w.path, err)
+	}
+	renameErr := os.Rename(w.path, rotationPath(w.path, now))
+	// Without a new file, writes go on to the old one.
+	if err := w.open(); err != nil {
+		return fmt.Errorf("failed to reopen %s: %w", w.path, err)
+	}
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate %s: %w", w.path, renameErr)
+	}
+	w.since = now
+	if err := Prune(w.path, w.policy, now); err != nil {
+		log.WithError(err).Warnf("Failed to delete old rotations of %s", w.path)
+	}
+	return nil
+}
+
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+// DataStart seeks `f`, a log rotated in place, to where its data starts past the hole rotations
+// left, and returns that offset.
+func DataStart(f *os.File) (int64, error) {
+	offset, err := f.Seek(0, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		// Empty, or all hole.
+		return f.Seek(0, io.SeekEnd)
+	}
+	return offset, err
+}
+
+// RotateInPlace rotates the log at `logPath`, which another process writes to at an offset of its
+// own rather than appending, if `p` says it's due. `created` is when the log was started, which
+// counts as its last rotation if it never was rotated. It reports whether it rotated the log.
+//
+// The rotated data is copied out and punched out of the log, which keeps its size with a hole
+// where the data was, so the writer's offset stays valid and the disk space is freed. Only whole
+// filesystem blocks are rotated, so a line may be split between a rotation and the log. Readers
+// start at `DataStart`.
+func RotateInPlace(logPath string, p Policy, created time.Time, now time.Time) (bool, error) {
+	f, err := os.OpenFile(logPath, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	start, err := DataStart(f)
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+	if size == start || !p.due(size-start, lastRotation(logPath, created), now) {
+		return false, nil
+	}
+	blockSize := int64(info.Sys().(*syscall.Stat_t).Blksize)
+	end := size / blockSize * blockSize
+	if end <= start {
+		return false, nil
+	}
+
+	rotation := rotationPath(logPath, now)
+	out, err := os.OpenFile(rotation, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, start, end-start))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(rotation)
+		return false, fmt.Errorf("failed to copy %s: %w", logPath, err)
+	}
+	if err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, end); err != nil {
+		os.Remove(rotation)
+		return false, fmt.Errorf("failed to punch rotated data out of %s: %w", logPath, err)
+	}
+	return true, nil
+}
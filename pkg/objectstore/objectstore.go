@@ -0,0 +1,381 @@
+// Package objectstore uploads objects to, and downloads them from, S3-compatible object storage. Requests are signed with
+// AWS Signature Version 4, which S3, Google Cloud Storage's XML API and self-hosted stores such as
+// MinIO all accept.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	// Objects are uploaded in parts of this size, each held in memory while it's sent. S3 allows
+	// 10000 parts, so objects can be up to 640GiB.
+	partSize     = 64 << 20
+	maxParts     = 10000
+	partAttempts = 3
+)
+
+// Error is an error response from the store.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("object store returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("object store returned status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Client talks to the bucket of a store.
+type Client struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	httpClient *http.Client
+}
+
+// New returns a client for the bucket `cfg` configures. Other buckets the same credentials can
+// access are reached by setting `cfg.Bucket` to them.
+func New(cfg config.SnapshotStoreConfig) (*Client, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("object store endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid object store endpoint %q", cfg.Endpoint)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	return &Client{
+		endpoint:   endpoint,
+		region:     region,
+		bucket:     cfg.Bucket,
+		accessKey:  cfg.AccessKeyID,
+		secretKey:  cfg.SecretAccessKey,
+		pathStyle:  cfg.PathStyle,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+// URI returns the portable name of the object `key`, "s3://<bucket>/<key>".
+func (c *Client) URI(key string) string {
+	return fmt.Sprintf("s3://%s/%s", c.bucket, key)
+}
+
+// ParseURI splits an "s3://<bucket>/<key>" URI.
+func ParseURI(uri string) (bucket string, key string, err error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("not an s3:// URI: %q", uri)
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("URI %q has no bucket or key", uri)
+	}
+	return bucket, key, nil
+}
+
+// Upload stores everything read from `r` as the object `key`. Objects larger than a part are
+// uploaded in parts; an upload that fails is aborted, leaving no object behind.
+func (c *Client) Upload(ctx context.Context, key string, r io.Reader) error {
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		_, err := c.do(ctx, http.MethodPut, key, nil, buf[:n])
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadId, err := c.createMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	parts, err := c.uploadParts(ctx, key, uploadId, buf[:n], r)
+	if err == nil {
+		err = c.completeMultipartUpload(ctx, key, uploadId, parts)
+	}
+	if err != nil {
+		// Parts of an unfinished upload are kept, and billed, until it's aborted.
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		c.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil)
+		return err
+	}
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadParts uploads `first` and then the rest of `r` as parts of the upload `uploadId`.
+func (c *Client) uploadParts(ctx context.Context, key string, uploadId string, first []byte, r io.Reader) ([]completedPart, error) {
+	var parts []completedPart
+	part := first
+	for number := 1; ; number++ {
+		if number > maxParts {
+			return nil, fmt.Errorf("object is larger than %d parts", maxParts)
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadId},
+		}
+		var resp *response
+		var err error
+		for attempt := 1; ; attempt++ {
+			resp, err = c.do(ctx, http.MethodPut, key, query, part)
+			var storeErr *Error
+			if err == nil || attempt == partAttempts || ctx.Err() != nil ||
+				(errors.As(err, &storeErr) && storeErr.StatusCode < 500) {
+				break
+			}
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload part %d: %w", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		// `part` aliases the buffer, which is free again once the part is sent.
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if n == 0 && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			return parts, nil
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		part = part[:n]
+	}
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.body, &result); err != nil || result.UploadId == "" {
+		return "", fmt.Errorf("invalid response to creating a multipart upload: %s", resp.body)
+	}
+	return result.UploadId, nil
+}
+
+func (c *Client) completeMultipartUpload(ctx context.Context, key string, uploadId string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadId}}, body)
+	if err != nil {
+		return err
+	}
+	// Completing can fail after the status has been sent, the error is then in the body.
+	return parseError(http.StatusOK, resp.body)
+}
+
+// response is an HTTP response whose body has been read.
+type response struct {
+	*http.Response
+	body []byte
+}
+
+// Open starts downloading the object `key` and returns its content and size. The caller must close
+// the content.
+func (c *Client) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	httpResp, err := c.send(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return httpResp.Body, httpResp.ContentLength, nil
+}
+
+// do sends a signed request for the object `key` and returns the response if it succeeded.
+func (c *Client) do(ctx context.Context, method string, key string, query url.Values, body []byte) (*response, error) {
+	httpResp, err := c.send(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &response{Response: httpResp, body: respBody}, nil
+}
+
+// send sends a signed request for the object `key` and returns the response, whose body is left
+// unread, if it succeeded.
+func (c *Client) send(ctx context.Context, method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, body, time.Now())
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode >= 300 {
+		defer httpResp.Body.Close()
+		respBody, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseError(httpResp.StatusCode, respBody); err != nil {
+			return nil, err
+		}
+		return nil, &Error{StatusCode: httpResp.StatusCode}
+	}
+	return httpResp, nil
+}
+
+// parseError returns the error in `body`, if it holds one.
+func parseError(statusCode int, body []byte) error {
+	var errResp struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &errResp) != nil {
+		return nil
+	}
+	if statusCode < 300 {
+		statusCode = http.StatusInternalServerError
+	}
+	return &Error{StatusCode: statusCode, Code: errResp.Code, Message: errResp.Message}
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to `req`.
+func (c *Client) sign(req *http.Request, body []byte, now time.Time) {
+	SignRequest(req, body, c.accessKey, c.secretKey, c.region, "s3", now)
+}
+
+// SignRequest adds an AWS Signature Version 4 Authorization header to `req`, whose body is `body`,
+// for `service` in `region`, e.g. "s3" or "sts". It's also how other AWS APIs are called.
+func SignRequest(req *http.Request, body []byte, accessKey string, secretKey string, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// escapePath escapes everything in `path` but unreserved characters and slashes, as signing
+// requires.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes `query` sorted by key, as signing requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escape percent-encodes everything but unreserved characters.
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
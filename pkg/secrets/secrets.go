@@ -0,0 +1,113 @@
+// Package secrets reads the values of the secrets of the server config, from the config itself, the
+// server's environment or Vault's KV engine. Values are read each time they're needed, so that
+// rotated ones reach new VMs without a reload.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	SourceValue = "value"
+	SourceEnv   = "env"
+	SourceVault = "vault"
+
+	requestTimeout = 30 * time.Second
+)
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// Fetch returns the value of the secret `name`, configured by `secret`. `vault` says how to reach
+// Vault for secrets kept there. Errors never include the value.
+func Fetch(ctx context.Context, name string, secret config.SecretConfig, vault config.VaultConfig) (string, error) {
+	switch secret.Source {
+	case SourceValue, "":
+		return secret.Value, nil
+	case SourceEnv:
+		value, ok := os.LookupEnv(secret.Env)
+		if !ok {
+			return "", fmt.Errorf("secret %s: environment variable %s isn't set", name, secret.Env)
+		}
+		return value, nil
+	case SourceVault:
+		value, err := readVault(ctx, vault, secret.Path, secret.Field)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", name, err)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("secret %s has unknown source %q", name, secret.Source)
+	}
+}
+
+// readVault returns `field` of the secret at `secretPath`. Both versions of the KV engine work:
+// version 2 nests the fields in another "data".
+func readVault(ctx context.Context, vault config.VaultConfig, secretPath string, field string) (string, error) {
+	address := vault.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := vault.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" || token == "" {
+		return "", fmt.Errorf("vault.address and vault.token, or VAULT_ADDR and VAULT_TOKEN, must be set")
+	}
+
+	url := strings.TrimRight(address, "/") + "/v1/" + strings.TrimLeft(secretPath, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if vault.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vault.Namespace)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call Vault: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Vault's errors name the path, not values.
+		return "", fmt.Errorf("Vault answered %d for %s: %s", resp.StatusCode, secretPath, strings.TrimSpace(string(body)))
+	}
+
+	var parsed struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("invalid Vault response for %s: %w", secretPath, err)
+	}
+	data := parsed.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("%s has no field %s", secretPath, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("field %s of %s can't be encoded", field, secretPath)
+	}
+	return string(encoded), nil
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// How long cloud-hypervisor has to describe a VM for the host's allocation.
+const vmInfoTimeout = 2 * time.Second
+
+// reservation returns the vCPUs and memory `v` has, as cloud-hypervisor reports them, which holds
+// them for VMs started, restored, forked or migrated alike.
+func (v *vm) reservation(ctx context.Context) (int32, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, vmInfoTimeout)
+	defer cancel()
+	info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return 0, 0, err
+	}
+	var vcpus int32
+	var memory int64
+	if info.Config.Cpus != nil {
+		vcpus = info.Config.Cpus.BootVcpus
+	}
+	if info.Config.Memory != nil {
+		memory = info.Config.Memory.Size
+		if info.Config.Memory.HotpluggedSize != nil {
+			memory += *info.Config.Memory.HotpluggedSize
+		}
+	}
+	return vcpus, memory, nil
+}
+
+// HostCapacity reports the vCPUs, memory and disk of the host, how much of them the VMs on it
+// reserve, the warm pool, and whether a VM started now would fit, for schedulers to pick a host
+// before starting a VM on it.
+func (s *Server) HostCapacity(ctx context.Context) (*serverapi.HostCapacity, error) {
+	// Shared with other callers through the read cache, so not cut short by this one's context.
+	resp, err := s.readCache.get("capacity", s.Config().ReadCacheTTL, func() (any, error) {
+		return s.hostCapacity(context.Background())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*serverapi.HostCapacity), nil
+}
+
+func (s *Server) hostCapacity(ctx context.Context) (*serverapi.HostCapacity, error) {
+	cfg := s.Config()
+	memoryUsed, memoryTotal, err := readMemory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host memory: %w", err)
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cfg.StateDir, &fs); err != nil {
+		return nil, fmt.Errorf("failed to read state dir disk: %w", err)
+	}
+	diskTotal := int64(fs.Blocks * uint64(fs.Bsize))
+	diskFree := int64(fs.Bavail * uint64(fs.Bsize))
+
+	poolTemplates := make(map[string]string)
+	poolVMs := make(map[string]int32)
+	for _, template := range s.warmPool.templates() {
+		names := s.warmPool.vmNames(template)
+		poolVMs[template] = int32(len(names))
+		for _, name := range names {
+			poolTemplates[name] = template
+		}
+	}
+	warmPool := serverapi.HostWarmPool{
+		StatefulDisks: serverapi.PtrInt32(int32(s.warmPool.numStatefulDisks())),
+		Vms:           &poolVMs,
+	}
+
+	type vmEntry struct {
+		vm        *vm
+		name      string
+		status    vmStatus
+		diskPath  string
+		startedAt time.Time
+	}
+	s.lock.RLock()
+	entries := make([]vmEntry, 0, len(s.vms))
+	for name, vm := range s.vms {
+		entries = append(entries, vmEntry{
+			vm:        vm,
+			name:      name,
+			status:    vm.status,
+			diskPath:  vm.statefulDiskPath,
+			startedAt: vm.startedAt,
+		})
+	}
+	s.lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	reservations := make([]serverapi.VMReservation, len(entries))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		namespace, name := SplitQualifiedName(entry.name)
+		r := &reservations[i]
+		r.Namespace = serverapi.PtrString(namespace)
+		r.VmName = serverapi.PtrString(name)
+		r.Status = serverapi.PtrString(entry.status.String())
+		r.StartedAt = serverapi.PtrTime(entry.startedAt)
+		if template, ok := poolTemplates[entry.name]; ok {
+			r.PoolTemplate = serverapi.PtrString(template)
+		}
+		if info, err := os.Stat(entry.diskPath); err == nil {
+			r.DiskBytes = serverapi.PtrInt64(info.Size())
+		}
+		// Stopped VMs hold on to their disk only.
+		if entry.status == vmStatusStopped {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vcpus, memory, err := entry.vm.reservation(ctx)
+			if err != nil {
+				log.WithField("vmName", entry.name).WithError(err).Warn("Failed to get the VM's reservation")
+				return
+			}
+			r.Vcpus = serverapi.PtrInt32(vcpus)
+			r.MemoryBytes = serverapi.PtrInt64(memory)
+		}()
+	}
+	wg.Wait()
+
+	var vcpusAllocated, memoryAllocated, diskAllocated int64
+	for _, r := range reservations {
+		vcpusAllocated += int64(r.GetVcpus())
+		memoryAllocated += r.GetMemoryBytes()
+		diskAllocated += r.GetDiskBytes()
+	}
+
+	// What a VM started now would get.
+	nextMemoryMB, err := calculateGuestMemorySizeInMB(cfg.GuestMemPercentage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate guest memory size: %w", err)
+	}
+	next := serverapi.VMReservation{
+		Vcpus:       serverapi.PtrInt32(calculateVCPUCount()),
+		MemoryBytes: serverapi.PtrInt64(int64(nextMemoryMB) * 1024 * 1024),
+		DiskBytes:   serverapi.PtrInt64(int64(cfg.StatefulSizeInMB) * 1024 * 1024),
+	}
+	var reasons []string
+	if s.IsDraining() {
+		reasons = append(reasons, "the server is draining")
+	}
+	if err := s.checkCordon(); err != nil {
+		reasons = append(reasons, status.Convert(err).Message())
+	}
+	if memoryAvailable := int64(memoryTotal - memoryUsed); memoryAvailable < next.GetMemoryBytes() {
+		reasons = append(reasons, fmt.Sprintf("%d bytes of memory are available, a VM needs %d", memoryAvailable, next.GetMemoryBytes()))
+	}
+	// A pooled disk is already there, and so are pool VMs for their templates.
+	if warmPool.GetStatefulDisks() == 0 && diskFree < next.GetDiskBytes() {
+		reasons = append(reasons, fmt.Sprintf("%d bytes of disk are free, a VM needs %d", diskFree, next.GetDiskBytes()))
+	}
+
+	cpus := int64(runtime.NumCPU())
+	return &serverapi.HostCapacity{
+		GeneratedAt: serverapi.PtrTime(time.Now().UTC()),
+		Vcpus: &serverapi.HostResourceCapacity{
+			Total:     serverapi.PtrInt64(cpus),
+			Allocated: serverapi.PtrInt64(vcpusAllocated),
+			Free:      serverapi.PtrInt64(max(0, cpus-vcpusAllocated)),
+		},
+		Memory: &serverapi.HostResourceCapacity{
+			Total:     serverapi.PtrInt64(int64(memoryTotal)),
+			Allocated: serverapi.PtrInt64(memoryAllocated),
+			Free:      serverapi.PtrInt64(int64(memoryTotal - memoryUsed)),
+		},
+		Disk: &serverapi.HostResourceCapacity{
+			Total:     serverapi.PtrInt64(diskTotal),
+			Allocated: serverapi.PtrInt64(diskAllocated),
+			Free:      serverapi.PtrInt64(diskFree),
+		},
+		WarmPool:     &warmPool,
+		NextVm:       &next,
+		Fits:         serverapi.PtrBool(len(reasons) == 0),
+		Reasons:      reasons,
+		Reservations: reservations,
+	}, nil
+}
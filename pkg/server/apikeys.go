@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+// Under the state dir.
+const apiKeysFileName = "apikeys.json"
+
+// AuthEnabled returns true if any API key exists, in the config or created through the API, or an
+// OIDC issuer is configured, in which case every request needs a key or token.
+func (s *Server) AuthEnabled() bool {
+	return len(s.Config().Auth.APIKeys) > 0 || s.apiKeys.HasActiveKeys() || s.oidcVerifier() != nil
+}
+
+// Authenticate returns the identity of `key`, either an API key or an OIDC token.
+func (s *Server) Authenticate(ctx context.Context, key string) (*auth.Identity, bool) {
+	if verifier := s.oidcVerifier(); verifier != nil && auth.LooksLikeJWT(key) {
+		id, err := verifier.Verify(ctx, key)
+		if err != nil {
+			log.WithError(err).Info("rejected oidc token")
+			return nil, false
+		}
+		return id, true
+	}
+	if id, ok := auth.Authenticate(s.Config().Auth.APIKeys, key); ok {
+		return id, true
+	}
+	return s.apiKeys.Authenticate(key)
+}
+
+// isAPIKeyName returns true if an API key, from the config or the store, is called `name`.
+func (s *Server) isAPIKeyName(name string) bool {
+	for _, key := range s.Config().Auth.APIKeys {
+		if key.Name == name {
+			return true
+		}
+	}
+	return s.apiKeys.HasName(name)
+}
+
+// isKnownOwner returns true if `name` can own VMs: an API key, or any OIDC user while OIDC is
+// enabled since users aren't known until they show up.
+func (s *Server) isKnownOwner(name string) bool {
+	if strings.HasPrefix(name, auth.OIDCNamePrefix) {
+		return s.oidcVerifier() != nil && len(name) > len(auth.OIDCNamePrefix)
+	}
+	return s.isAPIKeyName(name)
+}
+
+func apiKeyInfo(key auth.StoredKey) serverapi.ApiKeyInfo {
+	info := serverapi.ApiKeyInfo{
+		Id:          serverapi.PtrString(key.ID),
+		Name:        serverapi.PtrString(key.Name),
+		Permissions: key.Permissions,
+		Namespaces:  key.Namespaces,
+		CreatedAt:   serverapi.PtrTime(key.CreatedAt),
+	}
+	if key.RevokedAt != nil {
+		info.RevokedAt = serverapi.PtrTime(*key.RevokedAt)
+	}
+	return info
+}
+
+// validateAPIKeyScope checks the permissions and namespaces an API key is to be granted. Nil
+// values are left alone, for updates.
+func validateAPIKeyScope(permissions []string, namespaces []string) error {
+	if permissions != nil {
+		if err := auth.ValidatePermissions(permissions); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	for _, ns := range namespaces {
+		if err := ValidateNamespace(ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apiKeyStoreError(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, auth.ErrNameInUse):
+		return status.Error(codes.AlreadyExists, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+}
+
+// CreateAPIKey creates an API key. The response carries the key itself, which isn't stored and
+// can't be retrieved again.
+func (s *Server) CreateAPIKey(ctx context.Context, req *serverapi.CreateApiKeyRequest) (*serverapi.CreateApiKeyResponse, error) {
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if strings.HasPrefix(name, auth.OIDCNamePrefix) {
+		// The key would own the VMs of the OIDC user of that name, and the user the key's.
+		return nil, status.Errorf(codes.InvalidArgument, "api key names can't start with %q", auth.OIDCNamePrefix)
+	}
+	if err := validateAPIKeyScope(req.Permissions, req.Namespaces); err != nil {
+		return nil, err
+	}
+	if req.Permissions == nil {
+		return nil, status.Error(codes.InvalidArgument, "permissions are required")
+	}
+	for _, key := range s.Config().Auth.APIKeys {
+		if key.Name == name {
+			return nil, status.Errorf(codes.AlreadyExists, "api key %s is defined in the config", name)
+		}
+	}
+
+	key, secret, err := s.apiKeys.Create(name, req.Permissions, req.Namespaces)
+	if err != nil {
+		return nil, apiKeyStoreError(err)
+	}
+	log.WithFields(log.Fields{
+		"id":          key.ID,
+		"name":        key.Name,
+		"permissions": key.Permissions,
+		"namespaces":  key.Namespaces,
+	}).Info("created api key")
+
+	info := apiKeyInfo(key)
+	return &serverapi.CreateApiKeyResponse{
+		ApiKey: &info,
+		Key:    serverapi.PtrString(secret),
+	}, nil
+}
+
+// ListAPIKeys lists the API keys created through the API, revoked ones included. Keys from the
+// config file aren't listed.
+func (s *Server) ListAPIKeys(ctx context.Context) *serverapi.ListApiKeysResponse {
+	resp := &serverapi.ListApiKeysResponse{
+		ApiKeys: []serverapi.ApiKeyInfo{},
+	}
+	for _, key := range s.apiKeys.List() {
+		resp.ApiKeys = append(resp.ApiKeys, apiKeyInfo(key))
+	}
+	return resp
+}
+
+// UpdateAPIKey changes what the API key `id` may do. It takes effect on the key's next request.
+func (s *Server) UpdateAPIKey(ctx context.Context, id string, req *serverapi.UpdateApiKeyRequest) (*serverapi.ApiKeyInfo, error) {
+	if err := validateAPIKeyScope(req.Permissions, req.Namespaces); err != nil {
+		return nil, err
+	}
+	key, err := s.apiKeys.Update(id, req.Permissions, req.Namespaces)
+	if err != nil {
+		return nil, apiKeyStoreError(err)
+	}
+	log.WithFields(log.Fields{
+		"id":          key.ID,
+		"permissions": key.Permissions,
+		"namespaces":  key.Namespaces,
+	}).Info("updated api key")
+
+	info := apiKeyInfo(key)
+	return &info, nil
+}
+
+// RevokeAPIKey stops the API key `id` from authenticating. VMs it owns are kept; an admin can
+// transfer them, or a new key with the same name takes them over.
+func (s *Server) RevokeAPIKey(ctx context.Context, id string) (*serverapi.ApiKeyInfo, error) {
+	key, err := s.apiKeys.Revoke(id)
+	if err != nil {
+		return nil, apiKeyStoreError(err)
+	}
+	log.WithFields(log.Fields{
+		"id":        key.ID,
+		"name":      key.Name,
+		"revokedAt": key.RevokedAt.Format(time.RFC3339),
+	}).Info("revoked api key")
+
+	info := apiKeyInfo(key)
+	return &info, nil
+}
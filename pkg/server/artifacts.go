@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/pkg/server/ipallocator"
+)
+
+// Host resources of a VM are named after a hash of its namespace, name and instance rather than
+// after the name itself, which is up to 127 characters qualified. That would overflow interface
+// names and Unix socket paths, and could collide with the other directories under the state dir.
+const (
+	// VM state directories live under "<state_dir>/vms".
+	vmsDirName = "vms"
+	// Hex digits of the hash that name a VM's resources.
+	artifactIDLength = 12
+	// Tap devices are "ak<id>", or "ai<id>" for isolated VMs.
+	tapDevicePrefix = "ak"
+
+	apiSocketFilename   = "api.sock"
+	vsockSocketFilename = "vsock.sock"
+	// cloud-hypervisor listens on "<vsock socket>_<port>" for connections from the guest.
+	longestVsockPortSuffix = "_4294967295"
+)
+
+var (
+	tapDeviceNameRegexp = regexp.MustCompile(`^(` + tapDevicePrefix + `|` + isolatedTapDevicePrefix + `)[0-9a-f]{` + strconv.Itoa(artifactIDLength) + `}$`)
+	// Tap devices of servers that numbered them.
+	legacyTapDeviceNameRegexp = regexp.MustCompile(`^tap[0-9]+$`)
+)
+
+// vmArtifacts names the host resources of one instance of a VM. A VM that is destroyed and
+// started again under the same name gets new ones, so it never races the teardown of the old.
+type vmArtifacts struct {
+	id        string
+	stateDir  string
+	tapDevice string
+	// The IP and MAC the start asked for, allocated and picked by cloud-hypervisor if nil.
+	ip  net.IP
+	mac net.HardwareAddr
+	// The pool an IP is allocated from if the start asked for none.
+	ipPool string
+	// Set along with ipPool by setNetworkMode.
+	networkMode string
+	// Host directories the start asked to share into the guest.
+	sharedDirs []*sharedDir
+	// Data disks the start asked to attach.
+	dataDisks []*dataDisk
+	// The tmpfs and swap of the guest, nil for the image's own.
+	guestMemory *guestMemory
+	// Sets aside memory to hot-plug if it grows the guest's memory.
+	oomPolicy oomPolicy
+	// The base image the stateful disk starts from, empty for a blank one.
+	baseImage string
+	// Caps the IO of each disk without a limit of its own, nil for none.
+	diskLimit *diskLimit
+}
+
+// newVMArtifacts returns the names of the resources of a new instance of the VM `vmName`, whose
+// state directory is under `stateDir`.
+func newVMArtifacts(stateDir string, vmName string) vmArtifacts {
+	id := artifactID(vmName, strconv.FormatInt(time.Now().UnixNano(), 36))
+	return vmArtifacts{
+		id:          id,
+		stateDir:    path.Join(stateDir, vmsDirName, id),
+		tapDevice:   tapDevicePrefix + id,
+		ipPool:      ipallocator.DefaultPool,
+		networkMode: networkModeNAT,
+	}
+}
+
+// artifactID hashes the namespace and name of the VM `qualifiedName` together with `instance`.
+func artifactID(qualifiedName string, instance string) string {
+	namespace, name := SplitQualifiedName(qualifiedName)
+	sum := sha256.Sum256([]byte(namespace + "\x00" + name + "\x00" + instance))
+	return hex.EncodeToString(sum[:])[:artifactIDLength]
+}
+
+// isServerTapDevice returns whether the interface `name` is a tap device created by this server,
+// or by one that numbered them.
+func isServerTapDevice(name string) bool {
+	return tapDeviceNameRegexp.MatchString(name) || legacyTapDeviceNameRegexp.MatchString(name)
+}
+
+// ValidateStateDir returns an error if the sockets of VMs would be too long to bind under
+// `stateDir`.
+func ValidateStateDir(stateDir string) error {
+	longest := path.Join(newVMArtifacts(stateDir, "").stateDir, vsockSocketFilename+longestVsockPortSuffix)
+	if len(longest) > maxUnixSocketPath {
+		return fmt.Errorf(
+			"state_dir %q is too long: VM sockets such as %s would exceed the %d byte limit of Unix socket paths",
+			stateDir, longest, maxUnixSocketPath)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errCloneUnsupported is returned by cloneFile when the file system can't share blocks between
+// files.
+var errCloneUnsupported = errors.New("file system can't clone files")
+
+// baseImagePath returns the path of the base image `name`.
+func (s *Server) baseImagePath(name string) (string, error) {
+	imagePath, ok := s.Config().BaseImages[name]
+	if !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unknown base image %q", name)
+	}
+	if _, err := os.Stat(imagePath); err != nil {
+		return "", status.Errorf(codes.FailedPrecondition, "base image %s is unavailable: %v", name, err)
+	}
+	return imagePath, nil
+}
+
+// createDiskFromBaseImage creates the stateful disk at `diskPath` from the base image at
+// `imagePath` without copying it: as a clone sharing its blocks where the file system can, and as a
+// qcow2 overlay backed by it otherwise. Returns whether it's an overlay, which the hypervisor must
+// be allowed to open the base image of.
+func createDiskFromBaseImage(imagePath string, diskPath string) (bool, error) {
+	err := cloneFile(imagePath, diskPath)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, errCloneUnsupported) {
+		return false, err
+	}
+	format, err := diskFormat(imagePath)
+	if err != nil {
+		return false, fmt.Errorf("base image not found: %w", err)
+	}
+	log.WithField("baseImage", imagePath).Debug("can't clone base image, creating a qcow2 overlay")
+	cmd := exec.Command("qemu-img", "create", "-q", "-f", diskFormatQcow2, "-F", format, "-b", imagePath, diskPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(diskPath)
+		return false, fmt.Errorf("failed to create overlay of base image: %w out: %s", err, string(out))
+	}
+	return true, nil
+}
+
+// cloneFile makes `dst` a copy of `src` that shares its blocks until either is written, e.g. on
+// XFS or btrfs. Returns errCloneUnsupported if the file system can't, leaving no `dst` behind.
+func cloneFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer out.Close()
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		os.Remove(dst)
+		switch {
+		case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EXDEV), errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOTTY):
+			return errCloneUnsupported
+		default:
+			return fmt.Errorf("failed to clone file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// bootTiming is where the time of a VM start went, for users cutting cold start latency. Phases a
+// start skipped, e.g. tap setup when restoring, stay zero.
+type bootTiming struct {
+	start time.Time
+	// Tap device, guest IP and port forwards.
+	tapSetup time.Duration
+	// From spawning cloud-hypervisor until its API answers.
+	hypervisorSpawn time.Duration
+	// Formatting, or copying from a snapshot, the stateful disk.
+	statefulDisk time.Duration
+	// cloud-hypervisor's CreateVM, BootVM and restore calls.
+	createVM time.Duration
+	boot     time.Duration
+	restore  time.Duration
+	// From the guest kernel starting until the guest agent did, as the guest's uptime says.
+	kernelBoot time.Duration
+	// From the VM booting or being restored until the guest agent answers.
+	guestAgentReady time.Duration
+	// From the guest agent answering until the start's readiness probe passed.
+	readiness time.Duration
+	// A pre-booted pool VM was handed out.
+	pooled bool
+}
+
+type bootTimingKey struct{}
+
+// withBootTiming returns a context under which the phases of a VM start are recorded in the
+// returned timing.
+func withBootTiming(ctx context.Context) (context.Context, *bootTiming) {
+	t := &bootTiming{start: time.Now()}
+	return context.WithValue(ctx, bootTimingKey{}, t), t
+}
+
+// bootTimingFromContext returns the timing that phases under `ctx` are recorded in, which is
+// thrown away unless the start asked for one with `withBootTiming`.
+func bootTimingFromContext(ctx context.Context) *bootTiming {
+	if t, ok := ctx.Value(bootTimingKey{}).(*bootTiming); ok {
+		return t
+	}
+	return &bootTiming{}
+}
+
+func (t *bootTiming) toAPI() *serverapi.BootTiming {
+	ms := func(d time.Duration) *int64 {
+		if d == 0 {
+			return nil
+		}
+		return serverapi.PtrInt64(d.Milliseconds())
+	}
+	timing := &serverapi.BootTiming{
+		TotalMs:           serverapi.PtrInt64(time.Since(t.start).Milliseconds()),
+		TapSetupMs:        ms(t.tapSetup),
+		HypervisorSpawnMs: ms(t.hypervisorSpawn),
+		StatefulDiskMs:    ms(t.statefulDisk),
+		CreateVmMs:        ms(t.createVM),
+		BootMs:            ms(t.boot),
+		RestoreMs:         ms(t.restore),
+		GuestAgentReadyMs: ms(t.guestAgentReady),
+		ReadinessMs:       ms(t.readiness),
+		Pooled:            serverapi.PtrBool(t.pooled),
+	}
+	// Restored guests report when they first booted, long before.
+	if t.boot > 0 {
+		timing.KernelBootMs = ms(t.kernelBoot)
+	}
+	return timing
+}
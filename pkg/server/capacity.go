@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const (
+	// Under the state dir.
+	capacityHistoryFileName = "capacity-history.json"
+
+	defaultCapacitySampleInterval = 5 * time.Minute
+	defaultCapacityRetention      = 14 * 24 * time.Hour
+	defaultForecastWindow         = 7 * 24 * time.Hour
+	// Forecasts need this many samples in their window; fewer don't show a trend.
+	minForecastSamples = 12
+	// Usage is reported as the average over this much of the end of the window, since single
+	// samples of CPU usage are noisy.
+	recentUsagePeriod = time.Hour
+	// Exhaustion further out than this is reported as not in sight.
+	maxForecastDays = 10 * 365
+)
+
+// capacitySample is the host's usage at one point in time. Capacities are sampled too, since memory
+// and disks can be resized.
+type capacitySample struct {
+	Time time.Time `json:"time"`
+	// Busy CPUs, averaged since the previous sample.
+	CPUCores    float64 `json:"cpuCores"`
+	CPUs        int     `json:"cpus"`
+	MemoryUsed  uint64  `json:"memoryUsed"`
+	MemoryTotal uint64  `json:"memoryTotal"`
+	// Of the filesystem holding the state dir.
+	DiskUsed  uint64 `json:"diskUsed"`
+	DiskTotal uint64 `json:"diskTotal"`
+	VMs       int    `json:"vms"`
+}
+
+// capacityHistory is the usage history of the host, kept in a file so that it outlives restarts.
+type capacityHistory struct {
+	path     string
+	stateDir string
+	lock     sync.Mutex
+	samples  []capacitySample
+	// /proc/stat counters of the previous sample, to turn into the CPU usage since.
+	lastCPUBusy, lastCPUTotal uint64
+}
+
+func newCapacityHistory(stateDir string) (*capacityHistory, error) {
+	h := &capacityHistory{
+		path:     filepath.Join(stateDir, capacityHistoryFileName),
+		stateDir: stateDir,
+	}
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capacity history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.samples); err != nil {
+		// Only forecasts suffer, so start over rather than refusing to start.
+		log.WithError(err).Warnf("Ignoring invalid capacity history %s", h.path)
+		h.samples = nil
+	}
+	return h, nil
+}
+
+// readCPUCounters returns the busy and total jiffies of all CPUs from /proc/stat.
+func readCPUCounters() (uint64, uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var busy, total uint64
+		for i, field := range fields[1:] {
+			n, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid /proc/stat: %w", err)
+			}
+			total += n
+			// idle and iowait.
+			if i != 3 && i != 4 {
+				busy += n
+			}
+		}
+		return busy, total, nil
+	}
+	return 0, 0, errors.New("no cpu line in /proc/stat")
+}
+
+// readMemory returns the used and total memory of the host in bytes from /proc/meminfo.
+func readMemory() (uint64, uint64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[strings.TrimSuffix(fields[0], ":")] = kb * 1024
+		}
+	}
+	total, available := values["MemTotal"], values["MemAvailable"]
+	if total == 0 || available > total {
+		return 0, 0, errors.New("invalid /proc/meminfo")
+	}
+	return total - available, total, nil
+}
+
+// sample records the host's current usage and returns the sample. The first sample after a start
+// has no CPU usage yet, and isn't recorded.
+func (h *capacityHistory) sample(now time.Time, vms int, retention time.Duration) (capacitySample, bool, error) {
+	busy, total, err := readCPUCounters()
+	if err != nil {
+		return capacitySample{}, false, err
+	}
+	memoryUsed, memoryTotal, err := readMemory()
+	if err != nil {
+		return capacitySample{}, false, err
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(h.stateDir, &fs); err != nil {
+		return capacitySample{}, false, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	lastBusy, lastTotal := h.lastCPUBusy, h.lastCPUTotal
+	h.lastCPUBusy, h.lastCPUTotal = busy, total
+	if lastTotal == 0 || total <= lastTotal {
+		return capacitySample{}, false, nil
+	}
+	cpus := runtime.NumCPU()
+	s := capacitySample{
+		Time:        now.UTC(),
+		CPUCores:    float64(busy-lastBusy) / float64(total-lastTotal) * float64(cpus),
+		CPUs:        cpus,
+		MemoryUsed:  memoryUsed,
+		MemoryTotal: memoryTotal,
+		DiskUsed:    (fs.Blocks - fs.Bfree) * uint64(fs.Bsize),
+		DiskTotal:   fs.Blocks * uint64(fs.Bsize),
+		VMs:         vms,
+	}
+	h.samples = append(h.samples, s)
+	cutoff := now.Add(-retention)
+	for len(h.samples) > 0 && h.samples[0].Time.Before(cutoff) {
+		h.samples = h.samples[1:]
+	}
+	return s, true, h.saveLocked()
+}
+
+// saveLocked writes the history out, replacing the file atomically.
+func (h *capacityHistory) saveLocked() error {
+	data, err := json.Marshal(h.samples)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save capacity history: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save capacity history: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save capacity history: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), h.path); err != nil {
+		return fmt.Errorf("failed to save capacity history: %w", err)
+	}
+	return nil
+}
+
+// since returns the samples taken at or after `start`.
+func (h *capacityHistory) since(start time.Time) []capacitySample {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, s := range h.samples {
+		if !s.Time.Before(start) {
+			return append([]capacitySample(nil), h.samples[i:]...)
+		}
+	}
+	return nil
+}
+
+// capacityIntervals returns the sample interval and retention of `s`'s config, or their defaults.
+func (s *Server) capacityIntervals() (time.Duration, time.Duration) {
+	cfg := s.Config().Capacity
+	interval, retention := cfg.SampleInterval, cfg.Retention
+	if interval <= 0 {
+		interval = defaultCapacitySampleInterval
+	}
+	if retention <= 0 {
+		retention = defaultCapacityRetention
+	}
+	return interval, retention
+}
+
+// runCapacitySampler samples the host's usage every sample interval, forever.
+func (s *Server) runCapacitySampler() {
+	interval, retention := s.capacityIntervals()
+	for {
+		s.lock.RLock()
+		vms := len(s.vms)
+		s.lock.RUnlock()
+		if _, _, err := s.capacity.sample(time.Now(), vms, retention); err != nil {
+			log.WithError(err).Warn("Failed to sample host capacity")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// fitLine returns the intercept and slope of the least squares line through `xs` and `ys`.
+func fitLine(xs []float64, ys []float64) (float64, float64) {
+	n := float64(len(xs))
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return sumY / n, 0
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	return (sumY - slope*sumX) / n, slope
+}
+
+// forecastResource forecasts when the usage `used(sample)` of `samples` reaches the capacity of
+// the latest sample.
+func forecastResource(
+	resource string,
+	unit string,
+	samples []capacitySample,
+	now time.Time,
+	used func(capacitySample) float64,
+	capacity func(capacitySample) float64,
+) serverapi.CapacityResource {
+	result := serverapi.CapacityResource{
+		Resource: serverapi.PtrString(resource),
+		Unit:     serverapi.PtrString(unit),
+	}
+	if len(samples) == 0 {
+		result.Message = serverapi.PtrString("no samples yet")
+		return result
+	}
+	last := samples[len(samples)-1]
+	total := capacity(last)
+	result.Capacity = serverapi.PtrFloat64(total)
+
+	var recent float64
+	var recentCount int
+	for _, sample := range samples {
+		if !sample.Time.Before(last.Time.Add(-recentUsagePeriod)) {
+			recent += used(sample)
+			recentCount++
+		}
+	}
+	result.Used = serverapi.PtrFloat64(recent / float64(recentCount))
+
+	if len(samples) < minForecastSamples {
+		result.Message = serverapi.PtrString(fmt.Sprintf("not enough samples yet, %d of %d", len(samples), minForecastSamples))
+		return result
+	}
+	xs := make([]float64, len(samples))
+	ys := make([]float64, len(samples))
+	for i, sample := range samples {
+		xs[i] = sample.Time.Sub(samples[0].Time).Hours() / 24
+		ys[i] = used(sample)
+	}
+	intercept, slope := fitLine(xs, ys)
+	result.GrowthPerDay = serverapi.PtrFloat64(slope)
+	if slope <= 0 {
+		result.Message = serverapi.PtrString("usage isn't growing")
+		return result
+	}
+	fittedNow := intercept + slope*now.Sub(samples[0].Time).Hours()/24
+	daysLeft := max(0, (total-fittedNow)/slope)
+	if daysLeft > maxForecastDays {
+		result.Message = serverapi.PtrString(fmt.Sprintf("not exhausted within %d years at the current growth", maxForecastDays/365))
+		return result
+	}
+	result.DaysLeft = serverapi.PtrFloat64(daysLeft)
+	result.ExhaustsAt = serverapi.PtrTime(now.Add(time.Duration(daysLeft * 24 * float64(time.Hour))).UTC())
+	return result
+}
+
+// CapacityForecast forecasts when the host runs out of CPU, memory or disk, from its usage over
+// `window`, or the default window if zero.
+func (s *Server) CapacityForecast(window time.Duration) (*serverapi.CapacityForecast, error) {
+	if window < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid window %s", window)
+	}
+	if window == 0 {
+		window = defaultForecastWindow
+	}
+	now := time.Now()
+	samples := s.capacity.since(now.Add(-window))
+
+	resp := &serverapi.CapacityForecast{
+		GeneratedAt: serverapi.PtrTime(now.UTC()),
+		Window:      serverapi.PtrString(window.String()),
+		Samples:     serverapi.PtrInt32(int32(len(samples))),
+		Resources: []serverapi.CapacityResource{
+			forecastResource("cpu", "cores", samples, now,
+				func(s capacitySample) float64 { return s.CPUCores },
+				func(s capacitySample) float64 { return float64(s.CPUs) }),
+			forecastResource("memory", "bytes", samples, now,
+				func(s capacitySample) float64 { return float64(s.MemoryUsed) },
+				func(s capacitySample) float64 { return float64(s.MemoryTotal) }),
+			forecastResource("disk", "bytes", samples, now,
+				func(s capacitySample) float64 { return float64(s.DiskUsed) },
+				func(s capacitySample) float64 { return float64(s.DiskTotal) }),
+		},
+	}
+	if len(samples) > 0 {
+		resp.FirstSampleAt = serverapi.PtrTime(samples[0].Time)
+	}
+	return resp, nil
+}
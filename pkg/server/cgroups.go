@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// The period of cpu.max, in microseconds.
+const cpuMaxPeriod = 100000
+
+// The controllers hypervisors are limited by.
+var hypervisorControllers = []string{"cpu", "memory", "io"}
+
+// cgroupLimit is a value written to a file of a cgroup.
+type cgroupLimit struct {
+	file  string
+	value string
+}
+
+// createCgroup creates the cgroup v2 `cgroup`, relative to cgroupRoot, with the controllers that
+// limit hypervisors enabled for it where the host has them.
+func createCgroup(cgroup string) error {
+	// Each cgroup only gets the controllers its parent enables for its children.
+	parent := ""
+	for _, name := range strings.Split(cgroup, "/") {
+		if err := enableCgroupControllers(parent); err != nil {
+			return err
+		}
+		parent = path.Join(parent, name)
+		if err := os.Mkdir(path.Join(cgroupRoot, parent), 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create cgroup %s: %w", parent, err)
+		}
+	}
+	return nil
+}
+
+// enableCgroupControllers enables the hypervisors' controllers the cgroup `cgroup` has for its
+// children.
+func enableCgroupControllers(cgroup string) error {
+	data, err := os.ReadFile(path.Join(cgroupRoot, cgroup, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read controllers of cgroup /%s, is cgroup v2 mounted at %s: %w", cgroup, cgroupRoot, err)
+	}
+	available := strings.Fields(string(data))
+	var enable []string
+	for _, c := range hypervisorControllers {
+		if slices.Contains(available, c) {
+			enable = append(enable, "+"+c)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	err = os.WriteFile(path.Join(cgroupRoot, cgroup, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to enable controllers of cgroup /%s: %w", cgroup, err)
+	}
+	return nil
+}
+
+// removeCgroup deletes the cgroup `cgroup` once its processes exited. An empty cgroup does
+// nothing.
+func removeCgroup(cgroup string) {
+	if cgroup == "" {
+		return
+	}
+	if err := os.Remove(path.Join(cgroupRoot, cgroup)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.WithError(err).Warnf("failed to delete cgroup %s", cgroup)
+	}
+}
+
+// cleanupHypervisorCgroups deletes the cgroups under hypervisor_cgroups' parent left behind by hypervisors that are
+// gone, except those in `keep`. Cgroups with processes left can't be deleted and stay.
+func cleanupHypervisorCgroups(cfg config.HypervisorCgroupsConfig, keep map[string]bool) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	entries, err := os.ReadDir(path.Join(cgroupRoot, cfg.Parent))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		cgroup := path.Join(cfg.Parent, entry.Name())
+		if !entry.IsDir() || keep[cgroup] {
+			continue
+		}
+		if err := os.Remove(path.Join(cgroupRoot, cgroup)); err == nil {
+			log.Infof("deleted leftover cgroup: %s", cgroup)
+		}
+	}
+	return nil
+}
+
+// limitHypervisor limits the cgroup of `vm`'s hypervisor to the vCPUs and memory of the VM, as
+// cloud-hypervisor reports them, which holds them for VMs started, restored, forked or migrated
+// alike. Does nothing for hypervisors that aren't in a cgroup of their own.
+func (s *Server) limitHypervisor(ctx context.Context, vm *vm) error {
+	cfg := s.Config()
+	if !cfg.HypervisorCgroups.Enabled || vm.cgroup == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, vmInfoTimeout)
+	defer cancel()
+	info, _, err := vm.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to get vm info: %w", err)
+	}
+	var vcpus int32
+	var memory int64
+	if info.Config.Cpus != nil {
+		vcpus = info.Config.Cpus.MaxVcpus
+	}
+	if m := info.Config.Memory; m != nil {
+		// Up to what the guest can have hot-plugged, so that growing it doesn't get it killed.
+		memory = m.Size + m.GetHotplugSize()
+	}
+	limits, err := hypervisorLimits(cfg.HypervisorCgroups, cfg.StateDir, vcpus, memory)
+	if err != nil {
+		return err
+	}
+	for _, l := range limits {
+		if err := os.WriteFile(path.Join(cgroupRoot, vm.cgroup, l.file), []byte(l.value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s of cgroup %s to %q: %w", l.file, vm.cgroup, l.value, err)
+		}
+	}
+	log.WithFields(log.Fields{
+		"vmName": vm.name,
+		"cgroup": vm.cgroup,
+		"vcpus":  vcpus,
+		"memory": memory,
+	}).Info("limited hypervisor")
+	return nil
+}
+
+// hypervisorLimits returns the limits of a hypervisor whose VM has `vcpus` vCPUs and `memory`
+// bytes of memory, with its disks on the disk holding `stateDir`.
+func hypervisorLimits(cfg config.HypervisorCgroupsConfig, stateDir string, vcpus int32, memory int64) ([]cgroupLimit, error) {
+	var limits []cgroupLimit
+	if vcpus > 0 {
+		weight := min(max(int64(vcpus)*int64(cfg.CPUWeightPerVCPU), 1), 10000)
+		limits = append(limits, cgroupLimit{"cpu.weight", strconv.FormatInt(weight, 10)})
+		quota := "max"
+		if cfg.CPUQuotaPercent > 0 {
+			quota = strconv.FormatInt(int64(vcpus)*cpuMaxPeriod*int64(cfg.CPUQuotaPercent)/100, 10)
+		}
+		limits = append(limits, cgroupLimit{"cpu.max", quota + " " + strconv.Itoa(cpuMaxPeriod)})
+	}
+	if memory > 0 {
+		limits = append(limits, cgroupLimit{"memory.max", strconv.FormatInt(memory+int64(cfg.MemoryOverheadMB)<<20, 10)})
+	}
+	if io := cfg.IO; io.ReadBPS > 0 || io.WriteBPS > 0 || io.ReadIOPS > 0 || io.WriteIOPS > 0 {
+		device, err := blockDevice(stateDir)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, cgroupLimit{"io.max", fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s", device,
+			ioMax(io.ReadBPS), ioMax(io.WriteBPS), ioMax(io.ReadIOPS), ioMax(io.WriteIOPS))})
+	}
+	return limits, nil
+}
+
+// ioMax returns the io.max value of the limit `limit`, where 0 is none.
+func ioMax(limit int64) string {
+	if limit <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// blockDevice returns the "<major>:<minor>" of the disk holding `p`. io.max only takes whole
+// disks, so that of partitions is their disk's.
+func blockDevice(p string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return "", err
+	}
+	major, minor := unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))
+	if major == 0 {
+		return "", fmt.Errorf("%s isn't on a block device, its IO can't be limited", p)
+	}
+	device := fmt.Sprintf("%d:%d", major, minor)
+	sysPath, err := filepath.EvalSymlinks(path.Join("/sys/dev/block", device))
+	if err != nil {
+		return device, nil
+	}
+	if _, err := os.Stat(path.Join(sysPath, "partition")); err != nil {
+		return device, nil
+	}
+	disk, err := os.ReadFile(path.Join(path.Dir(sysPath), "dev"))
+	if err != nil {
+		return "", fmt.Errorf("failed to find the disk of partition %s: %w", device, err)
+	}
+	return strings.TrimSpace(string(disk)), nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// commandCall sends a `method` request for the background command `id` to the cmdserver of the
+// running VM `vmName`. Errors are NotFound for unknown VMs or commands and FailedPrecondition if
+// the VM isn't running.
+func (s *Server) commandCall(ctx context.Context, vmName string, method string, id string) (*serverapi.VmCommandStatus, error) {
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	reqURL := fmt.Sprintf("http://%s:4031/cmd/%s", vm.ip.IP.String(), url.PathEscape(id))
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	resp, err := s.agentClient(s.Config().Timeouts.ExecDefault).Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to reach the cmdserver: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// Also what cmdservers that don't keep background commands answer.
+		return nil, status.Errorf(codes.NotFound, "command not found: %s", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, status.Errorf(codes.Internal, "cmdserver failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var cmdStatus cmdserver.CommandStatus
+	if err := json.NewDecoder(resp.Body).Decode(&cmdStatus); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	result := &serverapi.VmCommandStatus{
+		Id:        serverapi.PtrString(cmdStatus.ID),
+		Cmd:       serverapi.PtrString(cmdStatus.Cmd),
+		Running:   serverapi.PtrBool(cmdStatus.Running),
+		Output:    serverapi.PtrString(strings.ToValidUTF8(cmdStatus.Output, "�")),
+		Truncated: serverapi.PtrBool(cmdStatus.Truncated),
+		StartedAt: serverapi.PtrTime(cmdStatus.StartedAt),
+	}
+	if cmdStatus.ExitCode != nil {
+		result.SetExitCode(int32(*cmdStatus.ExitCode))
+	}
+	if cmdStatus.Error != "" {
+		result.SetError(cmdStatus.Error)
+	}
+	if cmdStatus.ExitedAt != nil {
+		result.SetExitedAt(*cmdStatus.ExitedAt)
+	}
+	return result, nil
+}
+
+// VMCommandStatus returns the status and buffered output of the background command `id`, started
+// in `vmName` with a non-blocking VMCommand.
+func (s *Server) VMCommandStatus(ctx context.Context, vmName string, id string) (*serverapi.VmCommandStatus, error) {
+	return s.commandCall(ctx, vmName, http.MethodGet, id)
+}
+
+// KillVMCommand kills the process group of the background command `id` if it's still running,
+// forgets it and returns its final status.
+func (s *Server) KillVMCommand(ctx context.Context, vmName string, id string) (*serverapi.VmCommandStatus, error) {
+	return s.commandCall(ctx, vmName, http.MethodDelete, id)
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	operationSnapshotCompact = "snapshot.compact"
+	operationVMCompact       = "vm.compact"
+
+	// Formats of stateful disks. VMs run on raw disks, or qcow2 overlays of their base image, and
+	// snapshots may keep theirs as qcow2.
+	diskFormatRaw   = "raw"
+	diskFormatQcow2 = "qcow2"
+
+	// Runs of zeros become holes at this granularity, the block size of ext4.
+	sparseBlockSize = 4096
+	// How much of a disk is read at once while looking for zeros.
+	sparseBufferSize = 1 << 20
+)
+
+var (
+	qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+	zeroBlock  = make([]byte, sparseBlockSize)
+)
+
+// guestTrimScript trims the free space of the stateful disk, which the initramfs mounted before
+// switching root and is only reachable through the overlay root, where fstrim doesn't work. Mounting
+// it again shares the mounted file system. %s is replaced by guestZeroFillScript, or nothing.
+const guestTrimScript = `set -e
+dir=$(mktemp -d)
+mount -t ext4 /dev/vdb "$dir"
+trap 'umount "$dir"; rmdir "$dir"' EXIT
+%s
+sync
+fstrim -v "$dir" || echo "trimming isn't supported, zero blocks are still dropped by the host"
+`
+
+// guestZeroFillScript fills the free space of the stateful disk with zeros, for the host to turn
+// into holes, and frees it again. dd stops with ENOSPC once the disk is full.
+const guestZeroFillScript = `dd if=/dev/zero of="$dir/.arrakis-zero-fill" bs=1M 2>/dev/null || true
+sync
+rm -f "$dir/.arrakis-zero-fill"`
+
+// imageFormat returns `format`, or the configured format if it's empty.
+func (s *Server) imageFormat(format string) (string, error) {
+	if format == "" {
+		format = s.Config().ImageCompaction.Format
+	}
+	switch format {
+	case "", diskFormatRaw:
+		return diskFormatRaw, nil
+	case diskFormatQcow2:
+		return diskFormatQcow2, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "invalid format %q, must be raw or qcow2", format)
+	}
+}
+
+// CompactSnapshot starts rewriting the stateful disk of the snapshot `snapshotId` without its zero
+// blocks, in `req.Format`, and returns the operation that tracks the rewrite.
+func (s *Server) CompactSnapshot(ctx context.Context, snapshotId string, req *serverapi.CompactSnapshotRequest) (*serverapi.Operation, error) {
+	if err := validSnapshotID(snapshotId); err != nil {
+		return nil, err
+	}
+	format, err := s.imageFormat(req.GetFormat())
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Join(s.config.StateDir, "snapshots", snapshotId)
+	diskPath := path.Join(dir, statefulDiskFilename)
+	current, err := diskFormat(diskPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotId)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read stateful disk of snapshot %s: %v", snapshotId, err)
+	}
+	if current != diskFormatRaw || format != diskFormatRaw {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, "qcow2 disks need qemu-img, which isn't installed")
+		}
+	}
+
+	// Drains wait for compactions like for exports.
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	op, err := s.operations.startExclusive(ctx, operationSnapshotCompact, snapshotId, allocatedBytes(diskPath))
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	logger := log.WithFields(log.Fields{
+		"snapshotId":  snapshotId,
+		"operationId": op.id,
+		"format":      format,
+	})
+	logger.Info("compacting snapshot")
+	go func() {
+		defer done()
+		result, err := s.compactSnapshotDisk(dir, format, op)
+		if err != nil {
+			logger.WithError(err).Error("failed to compact snapshot")
+		} else {
+			logger.WithField("result", result).Info("compacted snapshot")
+		}
+		s.operations.finish(op, result, err)
+	}()
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return convertOperation(op), nil
+}
+
+// compactSnapshotScheduled compacts a snapshot that a policy just took, if the config says so.
+func (s *Server) compactSnapshotScheduled(snapshotId string) {
+	cfg := s.Config().ImageCompaction
+	if !cfg.ScheduledSnapshots {
+		return
+	}
+	logger := log.WithField("snapshotId", snapshotId)
+	format, err := s.imageFormat(cfg.Format)
+	if err != nil {
+		logger.WithError(err).Error("failed to compact scheduled snapshot")
+		return
+	}
+	dir := path.Join(s.config.StateDir, "snapshots", snapshotId)
+	op, err := s.operations.startExclusive(context.Background(), operationSnapshotCompact, snapshotId,
+		allocatedBytes(path.Join(dir, statefulDiskFilename)))
+	if err != nil {
+		logger.WithError(err).Error("failed to compact scheduled snapshot")
+		return
+	}
+	result, err := s.compactSnapshotDisk(dir, format, op)
+	s.operations.finish(op, result, err)
+	if err != nil {
+		logger.WithError(err).Error("failed to compact scheduled snapshot")
+		return
+	}
+	logger.WithField("result", result).Info("compacted scheduled snapshot")
+}
+
+// compactSnapshotDisk rewrites the stateful disk of the snapshot in `dir` in `format`, leaving out
+// its zero blocks, and replaces the disk with the result.
+func (s *Server) compactSnapshotDisk(dir string, format string, op *operation) (map[string]string, error) {
+	diskPath := path.Join(dir, statefulDiskFilename)
+	before := allocatedBytes(diskPath)
+	current, err := diskFormat(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	// Hidden, so that it's neither taken for a snapshot nor exported with this one.
+	tmpPath := path.Join(path.Dir(dir), fmt.Sprintf(".compact-%s-%s", path.Base(dir), statefulDiskFilename))
+	defer os.Remove(tmpPath)
+
+	if current == diskFormatRaw && format == diskFormatRaw {
+		err = copySparse(diskPath, tmpPath, func(n int64) { s.operations.progress(op, n) })
+	} else {
+		// qemu-img leaves out zero blocks by itself.
+		err = convertDisk(diskPath, tmpPath, format)
+		s.operations.progress(op, before)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, diskPath); err != nil {
+		return nil, fmt.Errorf("failed to replace stateful disk: %w", err)
+	}
+	return map[string]string{
+		"format":      format,
+		"bytesBefore": strconv.FormatInt(before, 10),
+		"bytesAfter":  strconv.FormatInt(allocatedBytes(diskPath), 10),
+	}, nil
+}
+
+// CompactVM starts trimming the stateful disk of the running VM `vmName` and returns the operation
+// that tracks it.
+func (s *Server) CompactVM(ctx context.Context, vmName string, req *serverapi.CompactVMRequest) (*serverapi.Operation, error) {
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	op, err := s.operations.startExclusive(ctx, operationVMCompact, vmName, allocatedBytes(vm.statefulDiskPath))
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	logger := log.WithFields(log.Fields{
+		"vmName":      vmName,
+		"operationId": op.id,
+		"zeroFill":    req.GetZeroFill(),
+	})
+	logger.Info("compacting VM disk")
+	go func() {
+		defer done()
+		result, err := s.compactVM(context.Background(), vm, req.GetZeroFill(), op)
+		if err != nil {
+			logger.WithError(err).Error("failed to compact VM disk")
+		} else {
+			logger.WithField("result", result).Info("compacted VM disk")
+		}
+		s.operations.finish(op, result, err)
+	}()
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return convertOperation(op), nil
+}
+
+// compactVM trims the stateful disk of `vm` in the guest, then pauses the VM to punch holes where
+// the disk only holds zeros, which leaves what the guest reads unchanged.
+func (s *Server) compactVM(ctx context.Context, vm *vm, zeroFill bool, op *operation) (map[string]string, error) {
+	before := allocatedBytes(vm.statefulDiskPath)
+	zeroFillScript := ""
+	if zeroFill {
+		zeroFillScript = guestZeroFillScript
+	}
+	resp, err := s.VMCommand(ctx, vm.name, cmdserver.RunCmdRequest{
+		Cmd:      fmt.Sprintf(guestTrimScript, zeroFillScript),
+		Blocking: true,
+	}, s.Config().Timeouts.ExecMax)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trim the disk in the guest: %w", err)
+	}
+	if resp.GetExitCode() != 0 || resp.GetError() != "" {
+		return nil, fmt.Errorf("failed to trim the disk in the guest: %s %s", resp.GetError(), resp.GetOutput())
+	}
+
+	if err := vm.pause(ctx); err != nil {
+		return nil, err
+	}
+	err = punchZeroBlocks(vm.statefulDiskPath, func(n int64) { s.operations.progress(op, n) })
+	if resumeErr := vm.resume(ctx); resumeErr != nil {
+		err = errors.Join(err, resumeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"bytesBefore": strconv.FormatInt(before, 10),
+		"bytesAfter":  strconv.FormatInt(allocatedBytes(vm.statefulDiskPath), 10),
+	}, nil
+}
+
+// diskFormat returns the format of the disk image at `diskPath`.
+func diskFormat(diskPath string) (string, error) {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, magic); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if bytes.Equal(magic, qcow2Magic) {
+		return diskFormatQcow2, nil
+	}
+	return diskFormatRaw, nil
+}
+
+// allocatedBytes returns how much of the file at `filePath` is allocated on disk, or 0 if it can't
+// tell.
+func allocatedBytes(filePath string) int64 {
+	var st unix.Stat_t
+	if err := unix.Stat(filePath, &st); err != nil {
+		return 0
+	}
+	return st.Blocks * 512
+}
+
+// convertDisk writes the disk image at `src` to `dst` in `format` with qemu-img.
+func convertDisk(src string, dst string, format string) error {
+	cmd := exec.Command("qemu-img", "convert", "-O", format, src, dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to convert disk to %s: %w out: %s", format, err, string(out))
+	}
+	return nil
+}
+
+// copyStatefulDisk copies the stateful disk at `src` to `dst` as a sparse raw disk, converting it if
+// it's a qcow2 disk of a compacted snapshot or an overlay of a base image. Raw disks are cloned
+// where the file system can, and copied otherwise.
+func copyStatefulDisk(src string, dst string) error {
+	format, err := diskFormat(src)
+	if err != nil {
+		return fmt.Errorf("source file not found: %w", err)
+	}
+	if format == diskFormatQcow2 {
+		return convertDisk(src, dst, diskFormatRaw)
+	}
+	if err := cloneFile(src, dst); !errors.Is(err, errCloneUnsupported) {
+		return err
+	}
+	return copySparse(src, dst, nil)
+}
+
+// copySparse copies the file at `src` to `dst`, leaving holes where `src` has holes or zero blocks.
+// `progress`, unless nil, is called with the number of bytes of data read as the copy goes.
+func copySparse(src string, dst string, progress func(int64)) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer out.Close()
+	if err := out.Truncate(info.Size()); err != nil {
+		return fmt.Errorf("failed to size destination file: %w", err)
+	}
+	err = scanBlocks(in, info.Size(), func(offset int64, data []byte, zero bool) error {
+		if progress != nil {
+			progress(int64(len(data)))
+		}
+		if zero {
+			return nil
+		}
+		_, err := out.WriteAt(data, offset)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync destination file: %w", err)
+	}
+	return nil
+}
+
+// punchZeroBlocks turns the zero blocks of the file at `filePath` into holes, without changing its
+// contents or size. `progress` is called like for copySparse.
+func punchZeroBlocks(filePath string, progress func(int64)) error {
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = scanBlocks(f, info.Size(), func(offset int64, data []byte, zero bool) error {
+		progress(int64(len(data)))
+		if !zero {
+			return nil
+		}
+		return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, int64(len(data)))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to punch holes: %w", err)
+	}
+	return f.Sync()
+}
+
+// scanBlocks calls `fn` with the data of `f`, whose size is `size`, in runs of blocks that are all
+// zero or all not. Holes are skipped.
+func scanBlocks(f *os.File, size int64, fn func(offset int64, data []byte, zero bool) error) error {
+	buf := make([]byte, sparseBufferSize)
+	var offset int64
+	for offset < size {
+		dataStart, err := f.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Only a hole is left.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dataEnd, err := f.Seek(dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		for offset = dataStart; offset < dataEnd; {
+			chunk := buf[:min(dataEnd-offset, int64(len(buf)))]
+			if _, err := f.ReadAt(chunk, offset); err != nil {
+				return err
+			}
+			for start := 0; start < len(chunk); {
+				zero := isZeroBlock(chunk[start:min(start+sparseBlockSize, len(chunk))])
+				end := start + sparseBlockSize
+				for end < len(chunk) && isZeroBlock(chunk[end:min(end+sparseBlockSize, len(chunk))]) == zero {
+					end += sparseBlockSize
+				}
+				end = min(end, len(chunk))
+				if err := fn(offset+int64(start), chunk[start:end], zero); err != nil {
+					return err
+				}
+				start = end
+			}
+			offset += int64(len(chunk))
+		}
+	}
+	return nil
+}
+
+func isZeroBlock(b []byte) bool {
+	return bytes.Equal(b, zeroBlock[:len(b)])
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// Settings, by dotted key, whose values DiffConfig leaves out.
+var secretSettings = map[string]bool{
+	"auth.api_keys":                    true,
+	"tracing.headers":                  true,
+	"guest_telemetry.headers":          true,
+	"credential_profiles":              true,
+	"snapshot_store.access_key_id":     true,
+	"snapshot_store.secret_access_key": true,
+}
+
+// DiffConfig compares `candidate` with the running config, setting by setting, and returns the
+// changes along with the top-level settings that would need a restart.
+func (s *Server) DiffConfig(candidate config.ServerConfig) ([]serverapi.ConfigChange, []string) {
+	running := s.Config()
+	changes := []serverapi.ConfigChange{}
+	diffConfigValues("", reflect.ValueOf(running), reflect.ValueOf(candidate), &changes)
+	return changes, restartRequiredSettings(running, candidate)
+}
+
+// diffConfigValues appends the differences between `running` and `candidate`, the values of `key`,
+// to `changes`. Structs and maps are compared field by field and entry by entry.
+func diffConfigValues(key string, running reflect.Value, candidate reflect.Value, changes *[]serverapi.ConfigChange) {
+	switch {
+	case running.Kind() == reflect.Struct:
+		for i := 0; i < running.NumField(); i++ {
+			if tag := running.Type().Field(i).Tag.Get("mapstructure"); tag != "" {
+				diffConfigValues(joinConfigKey(key, tag), running.Field(i), candidate.Field(i), changes)
+			}
+		}
+	case running.Kind() == reflect.Map && running.Type().Key().Kind() == reflect.String && !secretSettings[key]:
+		var names []string
+		for _, k := range append(running.MapKeys(), candidate.MapKeys()...) {
+			if !slices.Contains(names, k.String()) {
+				names = append(names, k.String())
+			}
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			r := running.MapIndex(reflect.ValueOf(name))
+			c := candidate.MapIndex(reflect.ValueOf(name))
+			switch {
+			case r.IsValid() && c.IsValid():
+				diffConfigValues(joinConfigKey(key, name), r, c, changes)
+			case r.IsValid():
+				*changes = append(*changes, configChange(joinConfigKey(key, name), fmt.Sprintf("%+v", r.Interface()), "", false))
+			default:
+				*changes = append(*changes, configChange(joinConfigKey(key, name), "", fmt.Sprintf("%+v", c.Interface()), false))
+			}
+		}
+	default:
+		if reflect.DeepEqual(running.Interface(), candidate.Interface()) {
+			return
+		}
+		if secretSettings[key] {
+			*changes = append(*changes, configChange(key, "", "", true))
+			return
+		}
+		*changes = append(*changes, configChange(key, fmt.Sprintf("%+v", running.Interface()), fmt.Sprintf("%+v", candidate.Interface()), false))
+	}
+}
+
+func configChange(key string, running string, candidate string, redacted bool) serverapi.ConfigChange {
+	topLevel, _, _ := strings.Cut(key, ".")
+	return serverapi.ConfigChange{
+		Key:        serverapi.PtrString(key),
+		Running:    serverapi.PtrString(running),
+		Candidate:  serverapi.PtrString(candidate),
+		Redacted:   serverapi.PtrBool(redacted),
+		Reloadable: serverapi.PtrBool(reloadableSettings[topLevel]),
+	}
+}
+
+func joinConfigKey(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
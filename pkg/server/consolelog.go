@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/pkg/logrotate"
+)
+
+const (
+	// Under the VM's state dir. cloud-hypervisor writes the guest's serial console to it.
+	serialLogFilename = "serial.log"
+	// How often a followed console log is checked for more output.
+	consoleLogPollInterval = 250 * time.Millisecond
+	// Size of the blocks the end of a console log is read in, to find where its tail starts.
+	consoleTailBlockSize = 64 << 10
+	// Under the VM's state dir. cloud-hypervisor's own output goes to it.
+	hypervisorLogFilename = "log"
+	// How often the console and hypervisor logs of VMs are checked for rotation.
+	consoleLogRotationInterval = time.Minute
+)
+
+// Unless configured otherwise, console and hypervisor logs are rotated every 16 MiB and 4 rotations
+// of each are kept, so a VM's logs take at most 160 MiB.
+var defaultConsoleLogRotation = logrotate.Policy{MaxSize: 16 << 20, MaxFiles: 4}
+
+// ConsoleLog reads the serial console output of a VM. When following, reads wait for more output
+// and only end once the VM is destroyed or the context is done. It must be closed.
+type ConsoleLog struct {
+	file   *os.File
+	ctx    context.Context
+	follow bool
+	// Reports whether the VM whose console this is still exists.
+	alive func() bool
+}
+
+func (l *ConsoleLog) Read(p []byte) (int, error) {
+	for {
+		n, err := l.file.Read(p)
+		if n > 0 || err != io.EOF || !l.follow {
+			return n, err
+		}
+		if !l.alive() {
+			return 0, io.EOF
+		}
+		select {
+		case <-l.ctx.Done():
+			return 0, l.ctx.Err()
+		case <-time.After(consoleLogPollInterval):
+		}
+	}
+}
+
+func (l *ConsoleLog) Close() error {
+	return l.file.Close()
+}
+
+// tailOffset returns where the last `lines` lines of the bytes of `f` from `start` to `end` start.
+// A final line without a newline counts as a line.
+func tailOffset(f *os.File, start int64, end int64, lines int) (int64, error) {
+	buf := make([]byte, consoleTailBlockSize)
+	// A newline ending the file doesn't start another line.
+	skipLast := true
+	for end > start {
+		blockStart := max(start, end-consoleTailBlockSize)
+		block := buf[:end-blockStart]
+		if _, err := f.ReadAt(block, blockStart); err != nil {
+			return 0, err
+		}
+		for i := len(block) - 1; i >= 0; i-- {
+			if block[i] != '\n' {
+				skipLast = false
+				continue
+			}
+			if skipLast {
+				skipLast = false
+				continue
+			}
+			lines--
+			if lines == 0 {
+				return blockStart + int64(i) + 1, nil
+			}
+		}
+		end = blockStart
+	}
+	return start, nil
+}
+
+// OpenConsoleLog opens the serial console output of the VM `vmName`, which outlives crashes of the
+// guest for as long as the VM isn't destroyed, less what was rotated out of it. Only the last `tailLines` lines are read, unless
+// it's zero. With `follow`, reads wait for more output until `ctx` is done or the VM is destroyed.
+func (s *Server) OpenConsoleLog(ctx context.Context, vmName string, tailLines int, follow bool) (*ConsoleLog, error) {
+	if tailLines < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "tail can't be negative")
+	}
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Errorf(codes.NotFound, "vm not found: %s", vmName)
+	}
+	f, err := os.Open(path.Join(vm.stateDirPath, serialLogFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "the console of %s isn't captured, it was booted by an older server", vmName)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to open console log: %v", err)
+	}
+
+	// Rotations leave a hole at the start of the log.
+	start, err := logrotate.DataStart(f)
+	if err != nil {
+		f.Close()
+		return nil, status.Errorf(codes.Internal, "failed to read console log: %v", err)
+	}
+	if tailLines > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, status.Errorf(codes.Internal, "failed to read console log: %v", err)
+		}
+		offset, err := tailOffset(f, start, info.Size(), tailLines)
+		if err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return nil, status.Errorf(codes.Internal, "failed to read console log: %v", err)
+		}
+	}
+	return &ConsoleLog{
+		file:   f,
+		ctx:    ctx,
+		follow: follow,
+		alive:  func() bool { return s.getVMAtomic(vmName) == vm },
+	}, nil
+}
+
+// consoleLogConfig returns the serial console config of VMs booted in `stateDir`, which writes the
+// console to a file there.
+func consoleLogConfig(stateDir string) *chvapi.ConsoleConfig {
+	config := chvapi.NewConsoleConfig(serialPortMode)
+	config.File = String(path.Join(stateDir, serialLogFilename))
+	return config
+}
+
+// runConsoleLogRotator rotates the console and hypervisor logs of VMs as the config says, forever.
+func (s *Server) runConsoleLogRotator() {
+	for {
+		time.Sleep(consoleLogRotationInterval)
+		s.rotateConsoleLogs(time.Now())
+	}
+}
+
+// rotateConsoleLogs rotates the console and hypervisor logs of all VMs that are due at `now`, and
+// deletes their expired rotations. cloud-hypervisor keeps writing the logs, so they are rotated in
+// place.
+func (s *Server) rotateConsoleLogs(now time.Time) {
+	policy := logrotate.FromConfig(s.Config().ConsoleLogs, defaultConsoleLogRotation)
+	type vmEntry struct {
+		name      string
+		stateDir  string
+		startedAt time.Time
+	}
+	s.lock.RLock()
+	entries := make([]vmEntry, 0, len(s.vms))
+	for name, vm := range s.vms {
+		entries = append(entries, vmEntry{name: name, stateDir: vm.stateDirPath, startedAt: vm.startedAt})
+	}
+	s.lock.RUnlock()
+
+	for _, entry := range entries {
+		for _, filename := range []string{serialLogFilename, hypervisorLogFilename} {
+			logPath := path.Join(entry.stateDir, filename)
+			logger := log.WithFields(log.Fields{
+				"vmName": entry.name,
+				"log":    filename,
+			})
+			rotated, err := logrotate.RotateInPlace(logPath, policy, entry.startedAt, now)
+			if errors.Is(err, os.ErrNotExist) {
+				// Booted by an older server, or destroyed meanwhile.
+				continue
+			}
+			if err != nil {
+				logger.WithError(err).Warn("Failed to rotate log")
+				continue
+			}
+			if rotated {
+				logger.Debug("Rotated log")
+			}
+			if err := logrotate.Prune(logPath, policy, now); err != nil {
+				logger.WithError(err).Warn("Failed to delete old log rotations")
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	// Time on top of a container's own timeout for the cmdserver to clean up and reply.
+	containerRunGrace = 30 * time.Second
+	// The cmdserver's probe gives up after 10 seconds.
+	containersHealthTimeout = 15 * time.Second
+)
+
+// VMContainersHealth reports whether the container engine inside the VM can run containers.
+func (s *Server) VMContainersHealth(ctx context.Context, vmName string) (*serverapi.ContainersHealthResponse, error) {
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	client := &http.Client{
+		Timeout: containersHealthTimeout,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/containers/health", nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var cmdResp cmdserver.ContainersHealthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cmdResp); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	apiResp := &serverapi.ContainersHealthResponse{
+		Healthy: serverapi.PtrBool(cmdResp.Healthy),
+	}
+	if cmdResp.Engine != "" {
+		apiResp.SetEngine(cmdResp.Engine)
+	}
+	if cmdResp.Version != "" {
+		apiResp.SetVersion(cmdResp.Version)
+	}
+	if cmdResp.Error != "" {
+		apiResp.SetError(cmdResp.Error)
+	}
+	return apiResp, nil
+}
+
+// VMRunContainer runs a container with the container engine inside the VM.
+func (s *Server) VMRunContainer(ctx context.Context, vmName string, runReq *serverapi.ContainerRunRequest) (*serverapi.ContainerRunResponse, error) {
+	if runReq.GetImage() == "" {
+		return nil, status.Error(codes.InvalidArgument, "image is required")
+	}
+	if runReq.GetTimeoutSeconds() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid timeout: %d", runReq.GetTimeoutSeconds())
+	}
+	timeout := cmdserver.DefaultContainerRunTimeout
+	if runReq.GetTimeoutSeconds() > 0 {
+		timeout = time.Duration(runReq.GetTimeoutSeconds()) * time.Second
+		if timeout > cmdserver.MaxContainerRunTimeout {
+			return nil, status.Errorf(codes.InvalidArgument, "timeout must be at most %s", cmdserver.MaxContainerRunTimeout)
+		}
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	client := &http.Client{
+		Timeout: timeout + containerRunGrace,
+	}
+
+	body, err := json.Marshal(cmdserver.ContainerRunRequest{
+		Image:          runReq.GetImage(),
+		Command:        runReq.GetCommand(),
+		Env:            runReq.GetEnv(),
+		Workdir:        runReq.GetWorkdir(),
+		Detach:         runReq.GetDetach(),
+		TimeoutSeconds: int(runReq.GetTimeoutSeconds()),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/containers", bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The cmdserver explains requests it rejects in plain text.
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusPreconditionFailed {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		code := codes.InvalidArgument
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			code = codes.FailedPrecondition
+		}
+		return nil, status.Error(code, strings.TrimSpace(string(msg)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var cmdResp cmdserver.ContainerRunResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cmdResp); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	apiResp := &serverapi.ContainerRunResponse{
+		Stdout: serverapi.PtrString(cmdResp.Stdout),
+		Stderr: serverapi.PtrString(cmdResp.Stderr),
+	}
+	if cmdResp.ContainerID != "" {
+		apiResp.SetContainerId(cmdResp.ContainerID)
+	}
+	if cmdResp.ExitCode != nil {
+		apiResp.SetExitCode(int32(*cmdResp.ExitCode))
+	}
+	if cmdResp.Error != "" {
+		apiResp.SetError(cmdResp.Error)
+	}
+	return apiResp, nil
+}
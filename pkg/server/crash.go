@@ -0,0 +1,347 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// Restart policies of VMs.
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+const (
+	defaultCrashCheckInterval = 5 * time.Second
+	defaultMissedHeartbeats   = 3
+
+	defaultRestartBackoff = time.Second
+	maxRestartBackoff     = 5 * time.Minute
+	// A VM that ran this long before it crashed is restarted after the initial backoff again.
+	restartBackoffReset = 10 * time.Minute
+)
+
+// restartPolicy says whether and when a crashed VM is started again.
+type restartPolicy struct {
+	policy string
+	// 0 for no limit.
+	maxRestarts int32
+	backoff     time.Duration
+}
+
+// newRestartPolicy validates the restart policy of a start, which may be nil.
+func newRestartPolicy(p *serverapi.RestartPolicy) (restartPolicy, error) {
+	policy := restartPolicy{policy: restartNever, backoff: defaultRestartBackoff}
+	if p == nil {
+		return policy, nil
+	}
+	switch p.GetPolicy() {
+	case "", restartNever:
+	case restartOnFailure, restartAlways:
+		policy.policy = p.GetPolicy()
+	default:
+		return policy, status.Errorf(codes.InvalidArgument, "restart policy must be never, on-failure or always, not %q", p.GetPolicy())
+	}
+	if p.GetMaxRestarts() < 0 || p.GetBackoffSeconds() < 0 {
+		return policy, status.Error(codes.InvalidArgument, "restart policy maxRestarts and backoffSeconds can't be negative")
+	}
+	policy.maxRestarts = p.GetMaxRestarts()
+	if p.GetBackoffSeconds() > 0 {
+		policy.backoff = time.Duration(p.GetBackoffSeconds()) * time.Second
+	}
+	return policy, nil
+}
+
+// restarts returns true if a VM that crashed after being restarted `restarts` times is started
+// again. `failed` is unset for hypervisors that exited cleanly.
+func (p restartPolicy) restarts(failed bool, restarts int32) bool {
+	if p.maxRestarts > 0 && restarts >= p.maxRestarts {
+		return false
+	}
+	return p.policy == restartAlways || (p.policy == restartOnFailure && failed)
+}
+
+// backoffAfter returns how long to wait before restarting a VM that crashed `streak` times in a
+// row before.
+func (p restartPolicy) backoffAfter(streak int32) time.Duration {
+	backoff := p.backoff
+	for i := int32(0); i < streak && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRestartBackoff)
+}
+
+// restartSpec is how a VM was started, to start it again the same way once it crashed.
+type restartSpec struct {
+	policy restartPolicy
+	req    serverapi.StartVMRequest
+	// Forks are started again from the snapshot they were forked from.
+	forkSnapshotID string
+}
+
+// vmCrash is the last crash of a VM.
+type vmCrash struct {
+	reason string
+	time   time.Time
+}
+
+func convertVMCrash(crash *vmCrash) *serverapi.VmCrash {
+	if crash == nil {
+		return nil
+	}
+	return &serverapi.VmCrash{
+		Reason: serverapi.PtrString(crash.reason),
+		Time:   serverapi.PtrTime(crash.time),
+	}
+}
+
+// watchForCrashes has the crash monitor check the VM `vmName`, which just got ready, and restart
+// it as `spec` says once it crashes.
+func (s *Server) watchForCrashes(vmName string, spec *restartSpec) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.restart = spec
+		vm.missedHeartbeats = 0
+	}
+}
+
+// unwatchForCrashesLocked stops the crash monitor from checking `vm`, e.g. because it's being
+// destroyed and its hypervisor is about to exit. Must be called with `s.lock` held.
+func unwatchForCrashesLocked(vm *vm) {
+	vm.restart = nil
+}
+
+// crashDetection returns how often VMs are checked for crashes, and how many checks in a row their
+// guest agent may miss.
+func (s *Server) crashDetection() (time.Duration, int) {
+	cfg := s.Config().CrashDetection
+	interval, missed := cfg.Interval, cfg.MissedHeartbeats
+	if interval <= 0 {
+		interval = defaultCrashCheckInterval
+	}
+	if missed <= 0 {
+		missed = defaultMissedHeartbeats
+	}
+	return interval, missed
+}
+
+// runCrashMonitor checks the VMs for crashes every crash detection interval, forever.
+func (s *Server) runCrashMonitor() {
+	for {
+		interval, missedHeartbeats := s.crashDetection()
+		time.Sleep(interval)
+		s.checkForCrashes(missedHeartbeats)
+	}
+}
+
+// checkForCrashes checks every running VM that got ready, concurrently, and handles the ones that
+// crashed: their hypervisor exited, or their guest agent didn't answer `missedHeartbeats` checks in
+// a row.
+func (s *Server) checkForCrashes(missedHeartbeats int) {
+	watched := make(map[string]*vm)
+	s.lock.Lock()
+	for name, vm := range s.vms {
+		if vm.restart == nil || vm.status != vmStatusRunning || vm.migrating || vm.process == nil {
+			// Paused and stopped guests don't answer, that mustn't count once they run again.
+			vm.missedHeartbeats = 0
+			continue
+		}
+		watched[name] = vm
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for name, vm := range watched {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if exited, reason, failed := hypervisorExit(vm.process.Pid); exited {
+				if failed && hypervisorOOMKilled(vm) {
+					reason = "hypervisor killed by the host's OOM killer"
+					s.recordOOMKill(name, vm, &oomKill{source: oomSourceHost, process: "cloud-hypervisor", pid: vm.process.Pid, time: time.Now().UTC()})
+				}
+				s.handleCrash(name, vm, reason, failed)
+				return
+			}
+			err := s.pingAgent(vm)
+			s.lock.Lock()
+			if err == nil {
+				vm.missedHeartbeats = 0
+			} else {
+				vm.missedHeartbeats++
+			}
+			missed := vm.missedHeartbeats
+			s.lock.Unlock()
+			if missed >= missedHeartbeats {
+				s.handleCrash(name, vm, fmt.Sprintf("guest agent missed %d heartbeats: %v", missed, err), true)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// hypervisorExit returns true if the hypervisor process `pid` exited, with how it exited and
+// whether that was a failure. Exited hypervisors stay zombies until their VM is destroyed, which
+// reaps them, so their exit status is read from /proc/<pid>/stat.
+func hypervisorExit(pid int) (bool, string, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true, "hypervisor is gone", true
+	}
+	// The command name before the fields can contain spaces and parentheses.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return false, "", false
+	}
+	// Starting with the third field, the state. The 52nd is the exit status as waitpid reports it.
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) == 0 || (fields[0] != "Z" && fields[0] != "X") {
+		return false, "", false
+	}
+	if len(fields) < 50 {
+		return true, "hypervisor exited", true
+	}
+	code, err := strconv.ParseUint(fields[49], 10, 32)
+	if err != nil {
+		return true, "hypervisor exited", true
+	}
+	ws := syscall.WaitStatus(code)
+	if ws.Signaled() {
+		return true, fmt.Sprintf("hypervisor killed by signal %d", ws.Signal()), true
+	}
+	return true, fmt.Sprintf("hypervisor exited with code %d", ws.ExitStatus()), ws.ExitStatus() != 0
+}
+
+// pingAgent returns an error if the guest agent of `vm` doesn't answer.
+func (s *Server) pingAgent(vm *vm) error {
+	resp, err := s.agentClient(s.Config().Timeouts.AgentDial).Get(fmt.Sprintf("http://%s:4031/", vm.ip.IP.String()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("guest agent answered with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleCrash marks `vm` as crashed for `reason`, unless it changed since it was checked, and
+// restarts it if its restart policy says so.
+func (s *Server) handleCrash(vmName string, vm *vm, reason string, failed bool) {
+	s.lock.Lock()
+	if s.vms[vmName] != vm || vm.restart == nil || vm.status != vmStatusRunning || vm.migrating {
+		s.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if now.Sub(vm.startedAt) >= restartBackoffReset {
+		vm.crashStreak = 0
+	}
+	vm.status = vmStatusCrashed
+	vm.lastCrash = &vmCrash{reason: reason, time: now.UTC()}
+	spec := vm.restart
+	unwatchForCrashesLocked(vm)
+	restart := spec.policy.restarts(failed, vm.restarts)
+	backoff := spec.policy.backoffAfter(vm.crashStreak)
+	s.lock.Unlock()
+	s.vmsChanged()
+
+	log.WithFields(log.Fields{
+		"vmName":  vmName,
+		"reason":  reason,
+		"policy":  spec.policy.policy,
+		"restart": restart,
+	}).Warn("VM crashed")
+	s.events.Publish(events.VMCrashed, vmName, map[string]string{
+		"reason":  reason,
+		"restart": strconv.FormatBool(restart),
+	})
+	if restart {
+		go s.restartCrashedVM(vmName, vm, spec, backoff)
+	}
+}
+
+// restartCrashedVM tears the crashed VM `crashed` down after `backoff` and starts it again as
+// `spec` says, with the owner, protection, labels, snapshot policies, session token, disconnect
+// policy and OOM kills it had.
+func (s *Server) restartCrashedVM(vmName string, crashed *vm, spec *restartSpec, backoff time.Duration) {
+	logger := log.WithField("vmName", vmName)
+	time.Sleep(backoff)
+
+	s.lock.RLock()
+	current := s.vms[vmName]
+	owner, protected, labels := crashed.owner, crashed.protected, crashed.labels
+	snapshotPolicies, sessionToken := crashed.snapshotPolicies, crashed.sessionToken
+	disconnect := crashed.disconnect
+	restarts, streak, lastCrash := crashed.restarts+1, crashed.crashStreak+1, crashed.lastCrash
+	oomKills, lastOOMKill := crashed.oomKills, crashed.lastOOMKill
+	s.lock.RUnlock()
+	if current != crashed || crashed.status != vmStatusCrashed {
+		logger.Info("Crashed VM changed since, not restarting it")
+		return
+	}
+
+	ctx := context.Background()
+	if err := s.destroyVM(ctx, vmName); err != nil {
+		logger.WithError(err).Error("Failed to tear down crashed VM, not restarting it")
+		return
+	}
+	req := spec.req
+	var err error
+	if spec.forkSnapshotID != "" {
+		_, err = s.ForkSnapshot(ctx, spec.forkSnapshotID, &req)
+	} else {
+		_, err = s.StartVM(ctx, &req)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to restart crashed VM")
+		s.events.Publish(events.VMCrashed, vmName, map[string]string{
+			"reason":  "restart failed: " + err.Error(),
+			"restart": "false",
+		})
+		return
+	}
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if ok {
+		vm.owner = owner
+		vm.protected = vm.protected || protected
+		if len(labels) > 0 {
+			vm.labels = labels
+		}
+		vm.snapshotPolicies = snapshotPolicies
+		vm.sessionToken = sessionToken
+		vm.disconnect = disconnect
+		vm.restarts = restarts
+		vm.crashStreak = streak
+		vm.lastCrash = lastCrash
+		vm.oomKills = oomKills
+		vm.lastOOMKill = lastOOMKill
+	}
+	s.lock.Unlock()
+	s.vmsChanged()
+	if !ok {
+		return
+	}
+	logger.WithField("restarts", restarts).Info("Restarted crashed VM")
+	s.events.Publish(events.VMRestarted, vmName, map[string]string{
+		"restarts": strconv.Itoa(int(restarts)),
+	})
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/credentials"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// Snapshots keep the credential profiles of their VM here, since restored VMs don't know their
+// template.
+const credentialProfilesFilename = "credential-profiles.json"
+
+func writeCredentialProfiles(dir string, profiles []string) error {
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, credentialProfilesFilename), data, 0644)
+}
+
+// readCredentialProfiles returns the credential profiles stored in `dir`. Snapshots taken before
+// credentials could be minted have none.
+func readCredentialProfiles(dir string) ([]string, error) {
+	data, err := os.ReadFile(path.Join(dir, credentialProfilesFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles []string
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", credentialProfilesFilename, err)
+	}
+	return profiles, nil
+}
+
+// GuestCredentials returns short-lived cloud credentials of the profile `profileName` for the
+// guest `guestName`, whose template must list the profile. Credentials are minted once and handed
+// out again until less than a third of their lifetime is left, and revoked once the VM is
+// destroyed. Like reports, requests are only accepted from the VM's own IP.
+func (s *Server) GuestCredentials(ctx context.Context, guestName string, sourceIP net.IP, profileName string) (*guestcall.Credentials, error) {
+	vmName, vm, err := s.guestVM(guestName, sourceIP, "credential requests")
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(vm.credentialProfiles, profileName) {
+		return nil, status.Errorf(codes.PermissionDenied, "vm %s may not use credential profile %q", vmName, profileName)
+	}
+	profile, ok := s.Config().CredentialProfiles[profileName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "credential profile %q not found", profileName)
+	}
+
+	s.lock.RLock()
+	cached := vm.credentials[profileName]
+	s.lock.RUnlock()
+	if cached != nil && time.Until(cached.Expiration) > profile.Duration/3 {
+		return cached, nil
+	}
+
+	creds, err := credentials.Mint(ctx, profileName, profile, vmName)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"vmName":  vmName,
+			"profile": profileName,
+		}).WithError(err).Error("failed to mint credentials")
+		return nil, status.Errorf(codes.Unavailable, "failed to mint credentials of %s: %v", profileName, err)
+	}
+	s.lock.Lock()
+	if vm.credentials == nil {
+		vm.credentials = make(map[string]*guestcall.Credentials)
+	}
+	vm.credentials[profileName] = creds
+	vm.mintedCredentials = append(slices.DeleteFunc(vm.mintedCredentials, func(c *guestcall.Credentials) bool {
+		return time.Now().After(c.Expiration)
+	}), creds)
+	s.lock.Unlock()
+	log.WithFields(log.Fields{
+		"vmName":     vmName,
+		"profile":    profileName,
+		"expiration": creds.Expiration,
+	}).Info("minted credentials for guest")
+	return creds, nil
+}
+
+// revokeCredentials revokes the credentials minted for the destroyed VM `vm` that haven't expired
+// yet, in the background, so that credentials leaked by its guest stop working. Failures are only
+// logged, the credentials then expire as usual.
+func (s *Server) revokeCredentials(vmName string, vm *vm) {
+	s.lock.Lock()
+	minted := vm.mintedCredentials
+	vm.mintedCredentials = nil
+	s.lock.Unlock()
+
+	byProfile := make(map[string][]*guestcall.Credentials)
+	for _, creds := range minted {
+		if time.Now().Before(creds.Expiration) {
+			byProfile[creds.Profile] = append(byProfile[creds.Profile], creds)
+		}
+	}
+	if len(byProfile) == 0 {
+		return
+	}
+	profiles := s.Config().CredentialProfiles
+	go func() {
+		for profileName, creds := range byProfile {
+			logger := log.WithFields(log.Fields{
+				"vmName":  vmName,
+				"profile": profileName,
+			})
+			profile, ok := profiles[profileName]
+			if !ok {
+				logger.Warn("credential profile was removed, its credentials stay valid until they expire")
+				continue
+			}
+			if err := credentials.Revoke(context.Background(), profile, vmName, creds); err != nil {
+				logger.WithError(err).Error("failed to revoke credentials")
+				continue
+			}
+			logger.Info("revoked credentials")
+		}
+	}()
+}
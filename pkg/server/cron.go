@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedules only need to run once within this long to be valid, which rules out dates such as
+// February 30th.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronField is the set of values, below 64, a cron field matches.
+type cronField uint64
+
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// cronSchedule is a parsed cron expression. Times are matched in UTC.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	// Whether the day of month or the day of week field is "*". If neither is, days matching
+	// either field match, as in cron.
+	domStar, dowStar bool
+	// Set for "@every <duration>" schedules, which ignore the fields.
+	every time.Duration
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCronSchedule parses a cron expression with minute, hour, day of month, month and day of
+// week fields, or one of the macros such as "@daily" or "@every 30m".
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if every, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %q: %w", every, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval %s is shorter than a minute", d)
+		}
+		return &cronSchedule{every: d}, nil
+	}
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	var sched cronSchedule
+	var err error
+	if sched.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if sched.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// Both 0 and 7 are Sunday.
+	if sched.dow.has(7) {
+		sched.dow |= 1
+	}
+	sched.domStar = strings.HasPrefix(fields[2], "*")
+	sched.dowStar = strings.HasPrefix(fields[4], "*")
+
+	if _, ok := sched.next(time.Now()); !ok {
+		return nil, fmt.Errorf("schedule never runs")
+	}
+	return &sched, nil
+}
+
+// parseCronField parses a comma separated list of "*", values and ranges, each optionally with a
+// step, e.g. "*/15" or "1-5,10".
+func parseCronField(field string, low int, high int) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := low, high
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				// "5/15" means from 5 on.
+				end = high
+			}
+		}
+		if start < low || end > high || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", rangePart, low, high)
+		}
+		for v := start; v <= end; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+// dayMatches returns true if the day of `t` matches the schedule.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom.has(t.Day())
+	dow := c.dow.has(int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after `after` that the schedule runs at, and false if it doesn't
+// run within the search limit.
+func (c *cronSchedule) next(after time.Time) (time.Time, bool) {
+	if c.every > 0 {
+		return after.Add(c.every), true
+	}
+
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case !c.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !c.hour.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
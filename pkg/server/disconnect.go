@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// What happens to a VM once its callback session closes.
+const (
+	disconnectDestroy  = "destroy"
+	disconnectPause    = "pause"
+	disconnectSnapshot = "snapshot"
+	disconnectKeep     = "keep"
+)
+
+// disconnectPolicy says what happens to a VM once the client answering its callbacks is gone.
+type disconnectPolicy struct {
+	action string
+	// With keep, how long the VM waits for a client to connect again before it's destroyed. 0
+	// keeps it for good.
+	ttl time.Duration
+}
+
+// newDisconnectPolicy validates the disconnect policy of a start or change, nil if `p` is.
+func newDisconnectPolicy(p *serverapi.DisconnectPolicy) (*disconnectPolicy, error) {
+	if p == nil {
+		return nil, nil
+	}
+	switch p.GetAction() {
+	case disconnectDestroy, disconnectPause, disconnectSnapshot, disconnectKeep:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "disconnect policy action must be destroy, pause, snapshot or keep, not %q", p.GetAction())
+	}
+	if p.GetTtlSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "disconnect policy ttlSeconds can't be negative")
+	}
+	if p.GetTtlSeconds() > 0 && p.GetAction() != disconnectKeep {
+		return nil, status.Error(codes.InvalidArgument, "disconnect policy ttlSeconds only applies to keep")
+	}
+	return &disconnectPolicy{
+		action: p.GetAction(),
+		ttl:    time.Duration(p.GetTtlSeconds()) * time.Second,
+	}, nil
+}
+
+// defaultDisconnectPolicy returns the policy of VMs that didn't choose one.
+func defaultDisconnectPolicy(cfg config.CallbackConfig) disconnectPolicy {
+	if cfg.DisconnectPolicy != "" {
+		return disconnectPolicy{action: cfg.DisconnectPolicy, ttl: cfg.DisconnectTTL}
+	}
+	if cfg.DestroyVMOnClose {
+		return disconnectPolicy{action: disconnectDestroy}
+	}
+	return disconnectPolicy{action: disconnectKeep, ttl: cfg.DisconnectTTL}
+}
+
+func convertDisconnectPolicy(p disconnectPolicy) *serverapi.DisconnectPolicy {
+	return &serverapi.DisconnectPolicy{
+		Action:     serverapi.PtrString(p.action),
+		TtlSeconds: serverapi.PtrInt32(int32(p.ttl / time.Second)),
+	}
+}
+
+// disconnectPolicyLocked returns what happens to `vm` once its callback session closes. Must be
+// called with `s.lock` held.
+func (s *Server) disconnectPolicyLocked(vm *vm) disconnectPolicy {
+	if vm.disconnect != nil {
+		return *vm.disconnect
+	}
+	return defaultDisconnectPolicy(s.Config().Callbacks)
+}
+
+// setDisconnectPolicy gives the VM `vmName`, which was just started, the disconnect policy it was
+// started with.
+func (s *Server) setDisconnectPolicy(vmName string, p *disconnectPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.disconnect = p
+	}
+}
+
+// SetDisconnectPolicy changes what happens to the VM `vmName` once its callback session closes.
+func (s *Server) SetDisconnectPolicy(ctx context.Context, vmName string, p *serverapi.DisconnectPolicy) (*serverapi.VMResponse, error) {
+	policy, err := newDisconnectPolicy(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if err := authorizeVMLocked(ctx, vm); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	vm.disconnect = policy
+	s.lock.Unlock()
+	s.vmsChanged()
+
+	log.WithFields(log.Fields{
+		"vmName": vmName,
+		"action": policy.action,
+		"ttl":    policy.ttl,
+	}).Info("changed VM disconnect policy")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
+
+// HandleSessionClose applies the disconnect policy of the VM `vmName` in `namespace`, whose
+// callback session closed because its client didn't reconnect in time. Protected VMs are never
+// destroyed this way.
+func (s *Server) HandleSessionClose(namespace string, vmName string) {
+	qualifiedName := QualifiedName(namespace, vmName)
+	logger := log.WithField("vmName", qualifiedName)
+
+	s.lock.Lock()
+	vm, ok := s.vms[qualifiedName]
+	var policy disconnectPolicy
+	if ok {
+		policy = s.disconnectPolicyLocked(vm)
+	} else if h, hibernated := s.hibernated[qualifiedName]; hibernated && h.disconnect != nil {
+		// Hibernated VMs are suspended already, they're only destroyed if that's their policy.
+		policy = *h.disconnect
+	} else {
+		policy = defaultDisconnectPolicy(s.Config().Callbacks)
+	}
+	if ok && vm.disconnectTimer != nil {
+		vm.disconnectTimer.Stop()
+		vm.disconnectTimer = nil
+	}
+	if ok && policy.action == disconnectKeep && policy.ttl > 0 {
+		vm.disconnectTimer = time.AfterFunc(policy.ttl, func() {
+			s.expireDisconnectedVM(namespace, vmName, vm)
+		})
+	}
+	s.lock.Unlock()
+
+	logger = logger.WithField("action", policy.action)
+	ctx := context.Background()
+	req := serverapi.VMRequest{VmName: &qualifiedName}
+	var err error
+	switch policy.action {
+	case disconnectDestroy:
+		_, err = s.DestroyVM(ctx, &req)
+	case disconnectPause:
+		if ok {
+			_, err = s.PauseVM(ctx, &req)
+		}
+	case disconnectSnapshot:
+		if ok {
+			snapshotID := fmt.Sprintf("disconnect-%s-%s", qualifiedName, time.Now().UTC().Format("20060102T150405Z"))
+			if _, err = s.SnapshotVM(ctx, qualifiedName, snapshotID); err == nil {
+				logger = logger.WithField("snapshotId", snapshotID)
+				_, err = s.DestroyVM(ctx, &req)
+			}
+		}
+	case disconnectKeep:
+		logger.WithField("ttl", policy.ttl).Info("Keeping VM after its callback session closed")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to apply disconnect policy after callback session closed")
+		return
+	}
+	logger.Info("Applied disconnect policy after callback session closed")
+}
+
+// expireDisconnectedVM destroys `vm`, kept after its callback session closed, unless a client
+// connected to it again since or it changed.
+func (s *Server) expireDisconnectedVM(namespace string, vmName string, vm *vm) {
+	qualifiedName := QualifiedName(namespace, vmName)
+	s.lock.Lock()
+	current := s.vms[qualifiedName] == vm
+	if current {
+		vm.disconnectTimer = nil
+	}
+	s.lock.Unlock()
+	if !current || s.sessionManager.HasSession(namespace, vmName) {
+		return
+	}
+
+	logger := log.WithField("vmName", qualifiedName)
+	req := serverapi.VMRequest{VmName: &qualifiedName}
+	if _, err := s.DestroyVM(context.Background(), &req); err != nil {
+		logger.WithError(err).Error("Failed to destroy VM whose client didn't reconnect")
+		return
+	}
+	logger.Info("Destroyed VM whose client didn't reconnect")
+}
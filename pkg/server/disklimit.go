@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// cloud-hypervisor refills the token buckets of its rate limiters every this many milliseconds.
+// Refilling a second's worth every second lets bursts of up to a second's worth through.
+const diskLimitRefillMs = 1000
+
+// diskLimit caps the IO of a disk of a VM, reads and writes together, with cloud-hypervisor's rate
+// limiter. 0 leaves it unlimited.
+type diskLimit struct {
+	bytesPerSecond int64
+	iops           int32
+}
+
+// newDiskLimit returns the disk limit of a VM started from `template` with `r`, whose fields win
+// over the template's. Nil if neither limits anything.
+func (s *Server) newDiskLimit(template string, r *serverapi.DiskLimit) (*diskLimit, error) {
+	tmpl, _ := s.templateConfig(strings.ToLower(template))
+	return mergeDiskLimit(diskLimit{bytesPerSecond: tmpl.DiskLimit.BytesPerSecond, iops: tmpl.DiskLimit.IOPS}, r)
+}
+
+// mergeDiskLimit returns `limit` with the fields `r` has, nil if the result limits nothing.
+func mergeDiskLimit(limit diskLimit, r *serverapi.DiskLimit) (*diskLimit, error) {
+	if r != nil {
+		if r.GetBytesPerSecond() < 0 || r.GetIops() < 0 {
+			return nil, status.Error(codes.InvalidArgument, "diskLimit can't be negative")
+		}
+		if r.BytesPerSecond != nil {
+			limit.bytesPerSecond = *r.BytesPerSecond
+		}
+		if r.Iops != nil {
+			limit.iops = *r.Iops
+		}
+	}
+	if limit == (diskLimit{}) {
+		return nil, nil
+	}
+	return &limit, nil
+}
+
+// validateDiskLimit checks the disk limit of a template.
+func validateDiskLimit(cfg config.DiskLimitConfig) error {
+	if cfg.BytesPerSecond < 0 || cfg.IOPS < 0 {
+		return fmt.Errorf("disk_limit can't be negative")
+	}
+	return nil
+}
+
+func convertDiskLimit(l *diskLimit) *serverapi.DiskLimit {
+	if l == nil {
+		return nil
+	}
+	return &serverapi.DiskLimit{
+		BytesPerSecond: serverapi.PtrInt64(l.bytesPerSecond),
+		Iops:           serverapi.PtrInt32(l.iops),
+	}
+}
+
+// rateLimiter returns the hypervisor's rate limiter for a disk limited by `l`, nil if `l` is.
+func (l *diskLimit) rateLimiter() *chvapi.RateLimiterConfig {
+	if l == nil {
+		return nil
+	}
+	limiter := &chvapi.RateLimiterConfig{}
+	if l.bytesPerSecond > 0 {
+		limiter.Bandwidth = &chvapi.TokenBucket{Size: l.bytesPerSecond, RefillTime: diskLimitRefillMs}
+	}
+	if l.iops > 0 {
+		limiter.Ops = &chvapi.TokenBucket{Size: int64(l.iops), RefillTime: diskLimitRefillMs}
+	}
+	return limiter
+}
+
+// snapshotDiskLimit returns the limit of the rootfs in the snapshot's VM config `data`, which the
+// VM's other disks got too unless they had their own. Nil if it had none.
+func snapshotDiskLimit(data []byte) *diskLimit {
+	var config chvapi.VmConfig
+	if err := json.Unmarshal(data, &config); err != nil || len(config.Disks) == 0 {
+		return nil
+	}
+	limiter := config.Disks[0].RateLimiterConfig
+	if limiter == nil {
+		return nil
+	}
+	var limit diskLimit
+	if b := limiter.Bandwidth; b != nil && b.RefillTime > 0 {
+		limit.bytesPerSecond = b.Size * 1000 / b.RefillTime
+	}
+	if o := limiter.Ops; o != nil && o.RefillTime > 0 {
+		limit.iops = int32(o.Size * 1000 / o.RefillTime)
+	}
+	if limit == (diskLimit{}) {
+		return nil
+	}
+	return &limit
+}
@@ -0,0 +1,673 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+const (
+	// The disks of a VM, by the IDs the API knows them by: the shared rootfs, which the guest sees
+	// as /dev/vda, and the stateful disk, /dev/vdb. Data disks have IDs of their own.
+	diskIdRootfs   = "rootfs"
+	diskIdStateful = "stateful"
+
+	statefulDiskGuestDevice = "vdb"
+
+	// How long cloud-hypervisor has to resize, add or remove a disk.
+	diskResizeTimeout = 30 * time.Second
+
+	maxDataDisks = 8
+	// New data disks get an ext4 file system, which needs some room.
+	minDataDiskSize = 16 << 20
+	// New data disks are "disk-<id>.img" in the VM's state dir, and the hypervisor knows data disks
+	// as "data-<id>". The guest finds them by their serial, their ID.
+	dataDiskFilePrefix     = "disk-"
+	dataDiskDeviceIdPrefix = "data-"
+)
+
+// guestFindDiskScript sets `dev` to the device in the guest of the data disk with the serial %s,
+// waiting for it to show up after a hot-plug.
+const guestFindDiskScript = `dev=""
+for i in $(seq 50); do
+    for f in /sys/block/vd*/serial; do
+        [ "$(cat "$f" 2>/dev/null)" = "%s" ] && dev=$(basename "$(dirname "$f")")
+    done
+    [ -n "$dev" ] && break
+    sleep 0.1
+done
+if [ -z "$dev" ]; then
+    echo "no disk with serial %s in the guest" >&2
+    exit 1
+fi
+`
+
+// guestGrowDiskScript waits for the guest to see the disk `dev`, set by %s, grow to `want` sectors,
+// grows its last partition if it has any, and then grows the ext4 file system on it. Like in
+// guestTrimScript, the file system is mounted again so that resize2fs finds it mounted and grows
+// it online.
+const guestGrowDiskScript = `set -e
+%s
+want=%d
+for i in $(seq 50); do
+    [ "$(cat /sys/block/$dev/size)" -ge "$want" ] && break
+    sleep 0.1
+done
+if [ "$(cat /sys/block/$dev/size)" -lt "$want" ]; then
+    echo "/dev/$dev didn't grow in the guest" >&2
+    exit 1
+fi
+target=/dev/$dev
+part=$(ls -d /sys/block/$dev/$dev* 2>/dev/null | sort -V | tail -n 1)
+if [ -n "$part" ]; then
+    growpart /dev/$dev "${part##*[!0-9]}" || [ $? -eq 1 ]
+    target=/dev/${part##*/}
+fi
+dir=$(mktemp -d)
+mount -t ext4 "$target" "$dir"
+trap 'umount "$dir"; rmdir "$dir"' EXIT
+resize2fs "$target"
+`
+
+// guestMountDiskScript mounts the hot-plugged data disk found by %s, or its last partition, on %s
+// with the options %s, like guestinit mounts the ones the VM started with.
+const guestMountDiskScript = `set -e
+%s
+target=/dev/$dev
+part=$(ls -d /sys/block/$dev/$dev* 2>/dev/null | sort -V | tail -n 1)
+[ -n "$part" ] && target=/dev/${part##*/}
+mkdir -p %s
+mount -o %s "$target" %s
+`
+
+// guestUnmountDiskScript unmounts the data disk mounted on %s, failing while it's busy.
+const guestUnmountDiskScript = `if mountpoint -q %s; then
+    sync
+    umount %s
+fi
+`
+
+// dataDisk is a disk of a VM besides its rootfs and stateful disk: a new, empty one, or a volume
+// of the server's config.
+type dataDisk struct {
+	id string
+	// The size of a new disk, 0 for volumes.
+	sizeBytes int64
+	volume    string
+	// The disk's image, set once it's created or its volume is resolved.
+	path string
+	// Where the guest mounts it, empty to leave it unmounted.
+	guestPath string
+	readOnly  bool
+	// Nil for none. Disks without a limit of their own get their VM's.
+	limit *diskLimit
+}
+
+// newDataDisk validates a data disk a start or attach asks for.
+func (s *Server) newDataDisk(d serverapi.DataDisk) (*dataDisk, error) {
+	id := d.GetId()
+	if err := guesttuning.ValidateDataDiskId(id); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if id == diskIdRootfs || id == diskIdStateful {
+		return nil, status.Errorf(codes.InvalidArgument, "disk id %s is taken by the VM's own disks", id)
+	}
+	disk := &dataDisk{id: id, sizeBytes: d.GetSizeBytes(), volume: d.GetVolume(), readOnly: d.GetReadOnly()}
+	limit, err := mergeDiskLimit(diskLimit{}, d.Limit)
+	if err != nil {
+		return nil, err
+	}
+	disk.limit = limit
+	if d.GetGuestPath() != "" {
+		disk.guestPath = path.Clean(d.GetGuestPath())
+		if err := guesttuning.ValidateGuestPath(disk.guestPath); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	switch {
+	case (disk.sizeBytes == 0) == (disk.volume == ""):
+		return nil, status.Errorf(codes.InvalidArgument, "disk %s needs either sizeBytes or volume", id)
+	case disk.volume != "":
+		volumePath, ok := s.Config().Volumes[disk.volume]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown volume %q", disk.volume)
+		}
+		if _, err := os.Stat(volumePath); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is unavailable: %v", disk.volume, err)
+		}
+		disk.path = volumePath
+		// Read-only volumes are read from a raw copy, like rootfs images. The hypervisor opens
+		// writable ones as they are, qcow2 or raw, so that what the guest writes lands in them.
+		if disk.readOnly {
+			rawPath, err := s.rawImage(volumePath)
+			if err != nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "can't attach volume %s: %v", disk.volume, err)
+			}
+			disk.path = rawPath
+		}
+	case disk.readOnly:
+		return nil, status.Errorf(codes.InvalidArgument, "disk %s would be empty, new disks can't be read-only", id)
+	case disk.sizeBytes < minDataDiskSize || disk.sizeBytes%512 != 0:
+		return nil, status.Errorf(codes.InvalidArgument, "sizeBytes of disk %s must be a multiple of 512 of at least %d", id, minDataDiskSize)
+	}
+	return disk, nil
+}
+
+// newDataDisks validates the data disks a start asks for.
+func (s *Server) newDataDisks(disks []serverapi.DataDisk) ([]*dataDisk, error) {
+	if len(disks) > maxDataDisks {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d data disks can be attached", maxDataDisks)
+	}
+	var result []*dataDisk
+	for _, d := range disks {
+		disk, err := s.newDataDisk(d)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDataDiskConflicts(result, disk); err != nil {
+			return nil, err
+		}
+		result = append(result, disk)
+	}
+	return result, nil
+}
+
+// checkDataDiskConflicts returns an error if `disk` can't be attached along with `disks`.
+func checkDataDiskConflicts(disks []*dataDisk, disk *dataDisk) error {
+	for _, d := range disks {
+		if d.id == disk.id {
+			return status.Errorf(codes.AlreadyExists, "disk %s is attached already", disk.id)
+		}
+		if disk.guestPath != "" && d.guestPath == disk.guestPath {
+			return status.Errorf(codes.InvalidArgument, "guest path %s has disk %s mounted already", disk.guestPath, d.id)
+		}
+		if disk.volume != "" && d.volume == disk.volume {
+			return status.Errorf(codes.InvalidArgument, "volume %s is attached already as disk %s", disk.volume, d.id)
+		}
+	}
+	return nil
+}
+
+// hasDataDisksOf returns whether `vm` has all the data disks a start asks for, `requested`.
+func (s *Server) hasDataDisksOf(vm *vm, requested []*dataDisk) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	disks := vm.dataDisks
+	for _, r := range requested {
+		i := slices.IndexFunc(disks, func(d *dataDisk) bool { return d.id == r.id })
+		if i < 0 {
+			return false
+		}
+		d := disks[i]
+		if d.sizeBytes != r.sizeBytes || d.volume != r.volume || d.guestPath != r.guestPath || d.readOnly != r.readOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// claimVolumesLocked claims the volumes of `disks` for the VM `vmName`. A volume can be attached
+// to any number of VMs read-only, or to a single one read-write. Must be called with the server
+// lock held.
+func (s *Server) claimVolumesLocked(vmName string, disks []*dataDisk) error {
+	for i, d := range disks {
+		if d.volume == "" {
+			continue
+		}
+		for other, readOnly := range s.volumeClaims[d.volume] {
+			if other != vmName && (!readOnly || !d.readOnly) {
+				s.releaseVolumesLocked(vmName, disks[:i])
+				return status.Errorf(codes.FailedPrecondition, "volume %s is attached to vm %s, and can only be shared read-only", d.volume, other)
+			}
+		}
+		if s.volumeClaims[d.volume] == nil {
+			s.volumeClaims[d.volume] = make(map[string]bool)
+		}
+		s.volumeClaims[d.volume][vmName] = d.readOnly
+	}
+	return nil
+}
+
+// releaseVolumesLocked releases the volumes of `disks` claimed for the VM `vmName`. Must be called
+// with the server lock held.
+func (s *Server) releaseVolumesLocked(vmName string, disks []*dataDisk) {
+	for _, d := range disks {
+		if d.volume == "" {
+			continue
+		}
+		delete(s.volumeClaims[d.volume], vmName)
+		if len(s.volumeClaims[d.volume]) == 0 {
+			delete(s.volumeClaims, d.volume)
+		}
+	}
+}
+
+// hasDataDisks returns whether `vm` has data disks attached.
+func (s *Server) hasDataDisks(vm *vm) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(vm.dataDisks) > 0
+}
+
+// prepareDataDisks creates the new disks among `disks` in the VM state dir `stateDir`, removing them
+// on `cu`. Returns the hypervisor's devices for them and the value of the guest's kernel command
+// line key.
+func prepareDataDisks(cu *cleanup.Cleanup, stateDir string, disks []*dataDisk) ([]chvapi.DiskConfig, string, error) {
+	if len(disks) == 0 {
+		return nil, "", nil
+	}
+	var diskConfigs []chvapi.DiskConfig
+	var guestDisks []guesttuning.DataDisk
+	for _, d := range disks {
+		if d.volume == "" {
+			d.path = path.Join(stateDir, dataDiskFilePrefix+d.id+".img")
+			if err := createDataDiskImage(d.path, d.sizeBytes); err != nil {
+				return nil, "", err
+			}
+			cu.Add(func() {
+				os.Remove(d.path)
+			})
+		}
+		diskConfigs = append(diskConfigs, d.config())
+		if d.guestPath != "" {
+			guestDisks = append(guestDisks, guesttuning.DataDisk{Serial: d.id, GuestPath: d.guestPath, ReadOnly: d.readOnly})
+		}
+	}
+	if len(guestDisks) == 0 {
+		return diskConfigs, "", nil
+	}
+	return diskConfigs, guesttuning.DataDisksCmdlineKey + "=\"" + guesttuning.EncodeDataDisks(guestDisks) + "\"", nil
+}
+
+// config returns the hypervisor's device for `d`.
+func (d *dataDisk) config() chvapi.DiskConfig {
+	return chvapi.DiskConfig{
+		Path:     d.path,
+		Readonly: Bool(d.readOnly),
+		Id:       String(dataDiskDeviceIdPrefix + d.id),
+		Serial:   String(d.id),
+
+		RateLimiterConfig: d.limit.rateLimiter(),
+	}
+}
+
+// createDataDiskImage creates an empty ext4 disk of `size` bytes at `diskPath`. Like stateful
+// disks, it's sparse.
+func createDataDiskImage(diskPath string, size int64) error {
+	f, err := os.Create(diskPath)
+	if err != nil {
+		return fmt.Errorf("failed to create data disk: %w", err)
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(diskPath)
+		return fmt.Errorf("failed to size data disk: %w", err)
+	}
+	cmd := exec.Command("mkfs.ext4", "-q", "-E", "lazy_itable_init=1,lazy_journal_init=1", diskPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(diskPath)
+		return fmt.Errorf("failed to format data disk with ext4: %w out: %s", err, string(out))
+	}
+	return nil
+}
+
+// diskSize returns the size of the disk with the image at `diskPath` as the guest sees it.
+func diskSize(diskPath string) (int64, error) {
+	format, err := diskFormat(diskPath)
+	if err != nil {
+		return 0, err
+	}
+	if format == diskFormatRaw {
+		info, err := os.Stat(diskPath)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	// The virtual size is a big-endian field of the qcow2 header.
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var size [8]byte
+	if _, err := f.ReadAt(size[:], 24); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(size[:])), nil
+}
+
+// convertDisks converts the disks of `vm` to the API format. Must be called with the server lock
+// held.
+func convertDisks(vm *vm) []serverapi.Disk {
+	var disks []serverapi.Disk
+	if vm.statefulDiskPath != "" {
+		disk := serverapi.Disk{Id: serverapi.PtrString(diskIdStateful), ReadOnly: serverapi.PtrBool(false), Limit: convertDiskLimit(vm.diskLimit)}
+		if size, err := diskSize(vm.statefulDiskPath); err == nil {
+			disk.SizeBytes = serverapi.PtrInt64(size)
+		}
+		disks = append(disks, disk)
+	}
+	for _, d := range vm.dataDisks {
+		disks = append(disks, convertDataDisk(d))
+	}
+	return disks
+}
+
+func convertDataDisk(d *dataDisk) serverapi.Disk {
+	disk := serverapi.Disk{Id: serverapi.PtrString(d.id), ReadOnly: serverapi.PtrBool(d.readOnly), Limit: convertDiskLimit(d.limit)}
+	if size, err := diskSize(d.path); err == nil {
+		disk.SizeBytes = serverapi.PtrInt64(size)
+	}
+	if d.guestPath != "" {
+		disk.GuestPath = serverapi.PtrString(d.guestPath)
+	}
+	if d.volume != "" {
+		disk.Volume = serverapi.PtrString(d.volume)
+	}
+	return disk
+}
+
+// AttachDisk hot-plugs the data disk `req` into the running VM `vmName` and mounts it in the guest
+// if it has a guest path.
+func (s *Server) AttachDisk(ctx context.Context, vmName string, req *serverapi.DataDisk) (*serverapi.Disk, error) {
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := s.newDataDisk(*req)
+	if err != nil {
+		return nil, err
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// The disk is listed from here on, so that concurrent attaches see it.
+	s.lock.Lock()
+	if disk.limit == nil {
+		disk.limit = vm.diskLimit
+	}
+	err = checkDataDiskConflicts(vm.dataDisks, disk)
+	if err == nil && len(vm.dataDisks) >= maxDataDisks {
+		err = status.Errorf(codes.FailedPrecondition, "vm %s has %d data disks attached already", vmName, maxDataDisks)
+	}
+	if err == nil {
+		err = s.claimVolumesLocked(vmName, []*dataDisk{disk})
+	}
+	if err == nil {
+		vm.dataDisks = append(vm.dataDisks, disk)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	cu := cleanup.Make(func() {
+		s.lock.Lock()
+		vm.dataDisks = slices.DeleteFunc(vm.dataDisks, func(d *dataDisk) bool { return d == disk })
+		s.releaseVolumesLocked(vmName, []*dataDisk{disk})
+		s.lock.Unlock()
+	})
+	defer cu.Clean()
+
+	logger := log.WithFields(log.Fields{"vmName": vmName, "disk": disk.id, "volume": disk.volume})
+	logger.Info("attaching disk")
+	if disk.volume == "" {
+		disk.path = path.Join(vm.stateDirPath, dataDiskFilePrefix+disk.id+".img")
+		if err := createDataDiskImage(disk.path, disk.sizeBytes); err != nil {
+			return nil, err
+		}
+		cu.Add(func() {
+			os.Remove(disk.path)
+		})
+	}
+	if err := vm.jail.shareDataDisk(disk); err != nil {
+		return nil, err
+	}
+	if err := vm.addDisk(ctx, disk); err != nil {
+		return nil, err
+	}
+	cu.Add(func() {
+		if err := vm.removeDevice(context.Background(), dataDiskDeviceIdPrefix+disk.id); err != nil {
+			logger.WithError(err).Warn("failed to remove disk from hypervisor")
+		}
+	})
+	if disk.guestPath != "" {
+		options := "rw"
+		if disk.readOnly {
+			options = "ro"
+		}
+		findDevice := fmt.Sprintf(guestFindDiskScript, disk.id, disk.id)
+		script := fmt.Sprintf(guestMountDiskScript, findDevice, disk.guestPath, options, disk.guestPath)
+		if err := s.runGuestDiskScript(ctx, vm, script); err != nil {
+			return nil, fmt.Errorf("failed to mount the disk in the guest: %w", err)
+		}
+	}
+	cu.Release()
+	s.vmsChanged()
+	logger.Info("attached disk")
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	resp := convertDataDisk(disk)
+	return &resp, nil
+}
+
+// DetachDisk unmounts the data disk `diskId` of the running VM `vmName` in the guest and unplugs
+// it. New disks are deleted, volumes are left as the guest left them.
+func (s *Server) DetachDisk(ctx context.Context, vmName string, diskId string) (*serverapi.VMResponse, error) {
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	if diskId == diskIdRootfs || diskId == diskIdStateful {
+		return nil, status.Errorf(codes.InvalidArgument, "the %s disk can't be detached", diskId)
+	}
+	disk := s.dataDisk(vm, diskId)
+	if disk == nil {
+		return nil, status.Errorf(codes.NotFound, "vm %s has no disk %q", vmName, diskId)
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	logger := log.WithFields(log.Fields{"vmName": vmName, "disk": disk.id, "volume": disk.volume})
+	logger.Info("detaching disk")
+	if disk.guestPath != "" {
+		script := fmt.Sprintf(guestUnmountDiskScript, disk.guestPath, disk.guestPath)
+		if err := s.runGuestDiskScript(ctx, vm, script); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to unmount the disk in the guest: %v", err)
+		}
+	}
+	if err := vm.removeDevice(ctx, dataDiskDeviceIdPrefix+disk.id); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	vm.dataDisks = slices.DeleteFunc(vm.dataDisks, func(d *dataDisk) bool { return d == disk })
+	s.releaseVolumesLocked(vmName, []*dataDisk{disk})
+	s.lock.Unlock()
+	if disk.volume == "" {
+		if err := os.Remove(disk.path); err != nil {
+			logger.WithError(err).Warn("failed to remove disk image")
+		}
+	}
+	s.vmsChanged()
+	logger.Info("detached disk")
+	return &serverapi.VMResponse{Success: serverapi.PtrBool(true)}, nil
+}
+
+// dataDisk returns the data disk `diskId` of `vm`, nil if it has none.
+func (s *Server) dataDisk(vm *vm, diskId string) *dataDisk {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if i := slices.IndexFunc(vm.dataDisks, func(d *dataDisk) bool { return d.id == diskId }); i >= 0 {
+		return vm.dataDisks[i]
+	}
+	return nil
+}
+
+// runGuestDiskScript runs `script` in the guest of `vm` through its agent.
+func (s *Server) runGuestDiskScript(ctx context.Context, vm *vm, script string) error {
+	resp, err := s.VMCommand(ctx, vm.name, cmdserver.RunCmdRequest{
+		Cmd:      script,
+		Blocking: true,
+	}, s.Config().Timeouts.ExecMax)
+	if err != nil {
+		return err
+	}
+	if resp.GetExitCode() != 0 || resp.GetError() != "" {
+		return fmt.Errorf("%s %s", resp.GetError(), resp.GetOutput())
+	}
+	return nil
+}
+
+// ResizeDisk grows the disk `diskId` of the running VM `vmName` to `req.SizeBytes`: its image on
+// the host, the hypervisor's view of it, and the file system on it in the guest, without stopping
+// the VM.
+func (s *Server) ResizeDisk(ctx context.Context, vmName string, diskId string, req *serverapi.ResizeDiskRequest) (*serverapi.Disk, error) {
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	var diskPath, findDevice string
+	var disk *dataDisk
+	switch diskId {
+	case diskIdStateful:
+		if vm.diskOverlay {
+			return nil, status.Errorf(codes.FailedPrecondition, "vm %s's stateful disk is a qcow2 overlay of its base image and can't be resized", vmName)
+		}
+		diskPath, findDevice = vm.statefulDiskPath, "dev="+statefulDiskGuestDevice
+	case diskIdRootfs:
+		return nil, status.Error(codes.InvalidArgument, "the rootfs is shared by VMs and can't be resized, resize the stateful disk instead")
+	default:
+		disk = s.dataDisk(vm, diskId)
+		if disk == nil {
+			return nil, status.Errorf(codes.NotFound, "vm %s has no disk %q", vmName, diskId)
+		}
+		if disk.readOnly {
+			return nil, status.Errorf(codes.InvalidArgument, "disk %s is read-only and can't be resized", diskId)
+		}
+		diskPath, findDevice = disk.path, fmt.Sprintf(guestFindDiskScript, disk.id, disk.id)
+	}
+	if format, err := diskFormat(diskPath); err != nil || format != diskFormatRaw {
+		return nil, status.Errorf(codes.FailedPrecondition, "only raw disks can be resized, and %s isn't one", diskId)
+	}
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat disk image: %w", err)
+	}
+	size := req.GetSizeBytes()
+	if size <= info.Size() {
+		return nil, status.Errorf(codes.InvalidArgument, "disks can only grow, and %s is %d bytes already", diskId, info.Size())
+	}
+	if size%512 != 0 {
+		return nil, status.Error(codes.InvalidArgument, "sizeBytes must be a multiple of 512")
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	logger := log.WithFields(log.Fields{"vmName": vmName, "disk": diskId, "sizeBytes": size})
+	logger.Info("resizing disk")
+	// Sparse, so growing it takes no space on the host until the guest writes.
+	if err := os.Truncate(diskPath, size); err != nil {
+		return nil, fmt.Errorf("failed to grow disk image: %w", err)
+	}
+	if err := vm.resizeDisk(ctx, diskPath, size); err != nil {
+		// The guest doesn't see the image grow until the hypervisor tells it.
+		if truncErr := os.Truncate(diskPath, info.Size()); truncErr != nil {
+			logger.WithError(truncErr).Warn("failed to shrink disk image back")
+		}
+		return nil, err
+	}
+	if err := s.runGuestDiskScript(ctx, vm, fmt.Sprintf(guestGrowDiskScript, findDevice, size/512)); err != nil {
+		return nil, fmt.Errorf("failed to grow the file system in the guest: %w", err)
+	}
+	logger.Info("resized disk")
+	if disk != nil {
+		resp := convertDataDisk(disk)
+		return &resp, nil
+	}
+	return &serverapi.Disk{
+		Id:        serverapi.PtrString(diskId),
+		SizeBytes: serverapi.PtrInt64(size),
+		ReadOnly:  serverapi.PtrBool(false),
+	}, nil
+}
+
+// resizeDisk has cloud-hypervisor tell the guest that the disk with the image at `diskPath` is now
+// `size` bytes.
+func (v *vm) resizeDisk(ctx context.Context, diskPath string, size int64) error {
+	ctx, cancel := context.WithTimeout(ctx, diskResizeTimeout)
+	defer cancel()
+	info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to get vm info: %w", err)
+	}
+	// cloud-hypervisor names the VM's own disks, so the disk is looked up by its image.
+	var diskId string
+	for _, disk := range info.Config.Disks {
+		if disk.Path == diskPath {
+			diskId = disk.GetId()
+		}
+	}
+	if diskId == "" {
+		return fmt.Errorf("hypervisor has no disk %s", diskPath)
+	}
+	resp, err := v.apiClient.DefaultAPI.VmResizeDiskPut(ctx).VmResizeDisk(chvapi.VmResizeDisk{
+		Id:          String(diskId),
+		DesiredSize: chvapi.PtrInt64(size),
+	}).Execute()
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) {
+		return status.Error(codes.FailedPrecondition, "this cloud-hypervisor can't resize disks, it needs one with the vm.resize-disk API")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resize disk in hypervisor: %w", err)
+	}
+	return nil
+}
+
+// addDisk hot-plugs `d` into the VM.
+func (v *vm) addDisk(ctx context.Context, d *dataDisk) error {
+	ctx, cancel := context.WithTimeout(ctx, diskResizeTimeout)
+	defer cancel()
+	if _, _, err := v.apiClient.DefaultAPI.VmAddDiskPut(ctx).DiskConfig(d.config()).Execute(); err != nil {
+		return fmt.Errorf("failed to add disk to hypervisor: %w", err)
+	}
+	return nil
+}
+
+// removeDevice unplugs the device `id` from the VM.
+func (v *vm) removeDevice(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, diskResizeTimeout)
+	defer cancel()
+	if _, err := v.apiClient.DefaultAPI.VmRemoveDevicePut(ctx).VmRemoveDevice(chvapi.VmRemoveDevice{Id: String(id)}).Execute(); err != nil {
+		return fmt.Errorf("failed to remove device from hypervisor: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// drainState tracks in-flight operations so that a drain can wait for them to finish.
+type drainState struct {
+	lock     sync.Mutex
+	draining bool
+	inflight int
+	// Closed once `inflight` drops to zero while draining.
+	idle chan struct{}
+}
+
+// beginOp registers an in-flight operation. Operations that would start new work, like starting a
+// VM, pass `rejectIfDraining` so that they are refused once a drain has begun. The returned
+// function must be called when the operation is done.
+func (s *Server) beginOp(rejectIfDraining bool) (func(), error) {
+	s.drain.lock.Lock()
+	defer s.drain.lock.Unlock()
+
+	if rejectIfDraining && s.drain.draining {
+		return nil, status.Error(codes.Unavailable, "server is draining")
+	}
+	s.drain.inflight++
+	return func() {
+		s.drain.lock.Lock()
+		defer s.drain.lock.Unlock()
+
+		s.drain.inflight--
+		if s.drain.inflight == 0 && s.drain.idle != nil {
+			close(s.drain.idle)
+			s.drain.idle = nil
+		}
+	}, nil
+}
+
+// IsDraining returns true once `Drain` has been called.
+func (s *Server) IsDraining() bool {
+	s.drain.lock.Lock()
+	defer s.drain.lock.Unlock()
+	return s.drain.draining
+}
+
+// Drain stops the server from accepting new VMs and waits until in-flight operations, such as
+// commands and snapshots, have finished or `ctx` is done. There is no way back from draining.
+func (s *Server) Drain(ctx context.Context) error {
+	s.drain.lock.Lock()
+	if !s.drain.draining {
+		s.events.Publish(events.ServerDraining, "", nil)
+	}
+	s.drain.draining = true
+	if s.drain.inflight == 0 {
+		s.drain.lock.Unlock()
+		return nil
+	}
+	if s.drain.idle == nil {
+		s.drain.idle = make(chan struct{})
+	}
+	idle := s.drain.idle
+	log.Infof("draining: waiting for %d in-flight operations", s.drain.inflight)
+	s.drain.lock.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		s.drain.lock.Lock()
+		inflight := s.drain.inflight
+		s.drain.lock.Unlock()
+		return fmt.Errorf("gave up waiting for %d in-flight operations: %w", inflight, ctx.Err())
+	}
+}
+
+// SnapshotAllVMs snapshots every running VM so that it can be restored after the server comes
+// back. Returns the snapshot ID taken for each VM.
+func (s *Server) SnapshotAllVMs(ctx context.Context) (map[string]string, error) {
+	s.lock.RLock()
+	var vmNames []string
+	for name, vm := range s.vms {
+		if vm.status == vmStatusRunning {
+			vmNames = append(vmNames, name)
+		}
+	}
+	s.lock.RUnlock()
+
+	suffix := time.Now().UTC().Format("20060102T150405Z")
+	snapshotIds := make(map[string]string)
+	var finalErr error
+	for _, vmName := range vmNames {
+		snapshotId := fmt.Sprintf("drain-%s-%s", vmName, suffix)
+		if _, err := s.SnapshotVM(ctx, vmName, snapshotId); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to snapshot vm %s: %w", vmName, err))
+			continue
+		}
+		log.WithFields(log.Fields{"vmName": vmName, "snapshotId": snapshotId}).Info("snapshotted VM for drain")
+		snapshotIds[vmName] = snapshotId
+	}
+	return snapshotIds, finalErr
+}
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// What happens to connections of a VM that no egress rule matches.
+const (
+	egressAllow = "allow"
+	egressDeny  = "deny"
+)
+
+const (
+	// The nftables tables enforcing the egress policy of a VM are "arrakis_egress_<tap device>",
+	// one of the inet family for routed traffic and one of the bridge family for traffic to other
+	// guests on the same bridge.
+	egressTablePrefix = "arrakis_egress_"
+	// Set of the inet table with the IPs that the egress domains of the VM resolved to.
+	egressDomainsSet = "domains"
+	// Protocols egress rules can match, besides any.
+	egressProtocolTCP  = "tcp"
+	egressProtocolUDP  = "udp"
+	egressProtocolICMP = "icmp"
+)
+
+var (
+	egressPortRegexp   = regexp.MustCompile(`^([0-9]+)(-([0-9]+))?$`)
+	egressDomainRegexp = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// egressRule matches connections of a VM by destination.
+type egressRule struct {
+	// Nil for any destination.
+	cidr *net.IPNet
+	// One of the egress protocols, empty for any.
+	protocol string
+	// Destination ports and inclusive port ranges, e.g. "443" or "8000-9000". Only for TCP and UDP.
+	ports []string
+}
+
+// egressPolicy says where a VM may connect to.
+type egressPolicy struct {
+	// egressAllow or egressDeny.
+	defaultAction string
+	allow         []egressRule
+	// Win over `allow` and `domains`.
+	deny []egressRule
+	// Names the VM may resolve through the server's DNS proxy, along with their subdomains, and
+	// connect to the IPs of.
+	domains []string
+}
+
+// newEgressPolicy validates the egress policy of a start or migration of a VM in `networkMode`, nil
+// if `p` is.
+func newEgressPolicy(p *serverapi.EgressPolicy, networkMode string) (*egressPolicy, error) {
+	if p == nil {
+		return nil, nil
+	}
+	// Bridged guests reach their network without the host routing their traffic, and isolated
+	// ones reach nothing anyway.
+	if networkMode == networkModeBridged || networkMode == networkModeNone {
+		return nil, status.Errorf(codes.InvalidArgument, "egress policies don't apply to VMs in network mode %s", networkMode)
+	}
+	policy := &egressPolicy{defaultAction: p.GetDefault()}
+	var err error
+	if policy.allow, err = newEgressRules("allow", p.Allow); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = newEgressRules("deny", p.Deny); err != nil {
+		return nil, err
+	}
+	for i, domain := range p.Domains {
+		domain = strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(domain), "*."), ".")
+		if !egressDomainRegexp.MatchString(domain) {
+			return nil, status.Errorf(codes.InvalidArgument, "egress domains[%d] %q is not a domain name", i, p.Domains[i])
+		}
+		policy.domains = append(policy.domains, domain)
+	}
+	switch policy.defaultAction {
+	case egressAllow, egressDeny:
+	case "":
+		// Allowing some destinations only makes sense if the rest are denied.
+		policy.defaultAction = egressAllow
+		if len(policy.allow) > 0 || len(policy.domains) > 0 {
+			policy.defaultAction = egressDeny
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "egress default must be allow or deny, not %q", policy.defaultAction)
+	}
+	return policy, nil
+}
+
+// newEgressRules validates the egress rules `rules` of the list `field`.
+func newEgressRules(field string, rules []serverapi.EgressRule) ([]egressRule, error) {
+	var result []egressRule
+	for i, r := range rules {
+		rule := egressRule{protocol: strings.ToLower(r.GetProtocol())}
+		if cidr := r.GetCidr(); cidr != "" {
+			// Single addresses are /32s.
+			if !strings.Contains(cidr, "/") {
+				cidr += "/32"
+			}
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil || ipNet.IP.To4() == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "egress %s[%d] cidr %q is not an IPv4 address or subnet", field, i, r.GetCidr())
+			}
+			rule.cidr = ipNet
+		}
+		switch rule.protocol {
+		case "", egressProtocolTCP, egressProtocolUDP, egressProtocolICMP:
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "egress %s[%d] protocol must be tcp, udp or icmp, not %q", field, i, r.GetProtocol())
+		}
+		if len(r.Ports) > 0 && rule.protocol == egressProtocolICMP {
+			return nil, status.Errorf(codes.InvalidArgument, "egress %s[%d] has ports, which icmp doesn't", field, i)
+		}
+		for _, port := range r.Ports {
+			if err := validateEgressPort(port); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "egress %s[%d] port %q %v", field, i, port, err)
+			}
+			rule.ports = append(rule.ports, port)
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// validateEgressPort checks that `port` is a port or an inclusive range of ports.
+func validateEgressPort(port string) error {
+	match := egressPortRegexp.FindStringSubmatch(port)
+	if match == nil {
+		return fmt.Errorf("is not a port or a range of ports")
+	}
+	low, err := strconv.Atoi(match[1])
+	if err != nil || low < 1 || low > 65535 {
+		return fmt.Errorf("must be between 1 and 65535")
+	}
+	if match[3] == "" {
+		return nil
+	}
+	high, err := strconv.Atoi(match[3])
+	if err != nil || high < 1 || high > 65535 {
+		return fmt.Errorf("must be between 1 and 65535")
+	}
+	if high <= low {
+		return fmt.Errorf("must end after it starts")
+	}
+	return nil
+}
+
+func convertEgressPolicy(p *egressPolicy) *serverapi.EgressPolicy {
+	if p == nil {
+		return nil
+	}
+	return &serverapi.EgressPolicy{
+		Default: serverapi.PtrString(p.defaultAction),
+		Allow:   convertEgressRules(p.allow),
+		Deny:    convertEgressRules(p.deny),
+		Domains: p.domains,
+	}
+}
+
+func convertEgressRules(rules []egressRule) []serverapi.EgressRule {
+	var result []serverapi.EgressRule
+	for _, r := range rules {
+		rule := serverapi.EgressRule{Ports: r.ports}
+		if r.cidr != nil {
+			rule.SetCidr(r.cidr.String())
+		}
+		if r.protocol != "" {
+			rule.SetProtocol(r.protocol)
+		}
+		result = append(result, rule)
+	}
+	return result
+}
+
+// allowsDomain returns whether the policy lets the VM resolve `name`.
+func (p *egressPolicy) allowsDomain(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, domain := range p.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// nftMatch returns the nftables expression matching the connections of `r`.
+func (r egressRule) nftMatch() string {
+	var parts []string
+	if r.cidr != nil {
+		parts = append(parts, "ip daddr "+r.cidr.String())
+	}
+	switch {
+	case len(r.ports) > 0 && r.protocol == "":
+		parts = append(parts, "meta l4proto { tcp, udp } th dport { "+strings.Join(r.ports, ", ")+" }")
+	case len(r.ports) > 0:
+		parts = append(parts, r.protocol+" dport { "+strings.Join(r.ports, ", ")+" }")
+	case r.protocol == egressProtocolICMP:
+		parts = append(parts, "ip protocol icmp")
+	case r.protocol != "":
+		parts = append(parts, "meta l4proto "+r.protocol)
+	}
+	return strings.Join(parts, " ")
+}
+
+// nftEgressChain writes the chain "egress", which decides on the connections of a VM with `p`.
+// `dnsProxy` is the DNS proxy the VM's queries are redirected to, nil if the table has no set of
+// the IPs of its domains.
+func (p *egressPolicy) nftEgressChain(b *bytes.Buffer, dnsProxy *net.UDPAddr) {
+	b.WriteString("\tchain egress {\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	if dnsProxy != nil {
+		fmt.Fprintf(b, "\t\tip daddr %s udp dport %d accept\n", dnsProxy.IP, dnsProxy.Port)
+	}
+	for _, r := range p.deny {
+		fmt.Fprintf(b, "\t\t%s drop\n", r.nftMatch())
+	}
+	for _, r := range p.allow {
+		fmt.Fprintf(b, "\t\t%s accept\n", r.nftMatch())
+	}
+	if dnsProxy != nil {
+		fmt.Fprintf(b, "\t\tip daddr @%s accept\n", egressDomainsSet)
+	}
+	if p.defaultAction == egressDeny {
+		b.WriteString("\t\tdrop\n")
+	}
+	b.WriteString("\t}\n")
+}
+
+// egressRuleset returns the nftables script that replaces the egress rules of the VM with the tap
+// device `tapDevice` and the IP `guestIP` with the ones of `p`, or only removes them if `p` is
+// nil. VMs with domains have their DNS queries redirected to `dnsProxy`.
+func egressRuleset(tapDevice string, guestIP net.IP, p *egressPolicy, dnsProxy *net.UDPAddr) string {
+	table := egressTablePrefix + tapDevice
+	var b bytes.Buffer
+	// Declaring the tables first makes deleting them succeed whether they exist or not.
+	for _, family := range []string{"inet", "bridge"} {
+		fmt.Fprintf(&b, "table %s %s\ndelete table %s %s\n", family, table, family, table)
+	}
+	if p == nil {
+		return b.String()
+	}
+
+	if len(p.domains) == 0 {
+		dnsProxy = nil
+	}
+	// Routed traffic has the bridge as its input interface, so the guest is told apart by its IP,
+	// which the bridge table keeps it from spoofing. Filters run just before iptables' and NAT
+	// just before the port forwards'.
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	if dnsProxy != nil {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv4_addr\n\t\tflags timeout\n\t}\n", egressDomainsSet)
+		b.WriteString("\tchain prerouting {\n\t\ttype nat hook prerouting priority -101; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tip saddr %s udp dport 53 dnat ip to %s\n\t}\n", guestIP, dnsProxy)
+	}
+	for _, hook := range []string{"forward", "input"} {
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook %s priority -1; policy accept;\n", hook, hook)
+		fmt.Fprintf(&b, "\t\tip saddr %s jump egress\n\t}\n", guestIP)
+	}
+	p.nftEgressChain(&b, dnsProxy)
+	b.WriteString("}\n")
+
+	// Guests on the same bridge reach each other without being routed.
+	fmt.Fprintf(&b, "table bridge %s {\n", table)
+	b.WriteString("\tchain prerouting {\n\t\ttype filter hook prerouting priority -1; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ether type ip ip saddr != %s drop\n", tapDevice, guestIP)
+	fmt.Fprintf(&b, "\t\tiifname %q ether type ip6 drop\n\t}\n", tapDevice)
+	b.WriteString("\tchain forward {\n\t\ttype filter hook forward priority -1; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ether type ip jump egress\n\t}\n", tapDevice)
+	p.nftEgressChain(&b, nil)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// runNft runs the nftables script `script` as one transaction.
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %s %w", output, err)
+	}
+	return nil
+}
+
+// applyEgressPolicy enforces `p` on the connections `vm` starts, replacing its previous policy,
+// or lets it connect anywhere again if `p` is nil.
+func (s *Server) applyEgressPolicy(vm *vm, p *egressPolicy) error {
+	s.lock.RLock()
+	previous := vm.egress
+	s.lock.RUnlock()
+	if p == nil && previous == nil {
+		return nil
+	}
+	if err := runNft(egressRuleset(vm.tapDevice.Name, vm.ip.IP, p, s.egressDNS.addr)); err != nil {
+		return status.Errorf(codes.Internal, "failed to apply egress policy: %v", err)
+	}
+	s.lock.Lock()
+	vm.egress = p
+	s.lock.Unlock()
+	if p != nil {
+		log.WithFields(log.Fields{
+			"vmName":  vm.name,
+			"default": p.defaultAction,
+			"allow":   len(p.allow),
+			"deny":    len(p.deny),
+			"domains": len(p.domains),
+		}).Info("applied egress policy")
+	}
+	return nil
+}
+
+// deleteEgressRules removes the egress rules of the VM with the tap device `tapDevice`, if it has
+// any.
+func deleteEgressRules(tapDevice string) error {
+	return runNft(egressRuleset(tapDevice, nil, nil, nil))
+}
+
+// listEgressTables returns the tap devices that have egress rules.
+func listEgressTables() ([]string, error) {
+	output, err := exec.Command("nft", "list", "tables").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables tables: %w", err)
+	}
+	seen := make(map[string]bool)
+	var tapDevices []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// "table <family> <name>"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], egressTablePrefix) {
+			continue
+		}
+		tapDevice := strings.TrimPrefix(fields[2], egressTablePrefix)
+		if !seen[tapDevice] {
+			seen[tapDevice] = true
+			tapDevices = append(tapDevices, tapDevice)
+		}
+	}
+	return tapDevices, nil
+}
+
+// cleanupEgressRules removes the egress rules of all tap devices but the ones in `keep`.
+func cleanupEgressRules(keep map[string]bool) error {
+	// Hosts without nftables never had any.
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil
+	}
+	tapDevices, err := listEgressTables()
+	if err != nil {
+		return err
+	}
+	for _, tapDevice := range tapDevices {
+		if keep[tapDevice] {
+			continue
+		}
+		log.Infof("deleting egress rules of tap device: %s", tapDevice)
+		if err := deleteEgressRules(tapDevice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Upstream resolvers get this long to answer a query of a guest.
+	egressDNSUpstreamTimeout = 5 * time.Second
+	// IPs of egress domains stay allowed for the TTL of their record, but at least this long, so
+	// that guests which cache answers a little longer than they should can still connect.
+	minEgressDNSTimeout = time.Minute
+	maxEgressDNSTimeout = 24 * time.Hour
+	// Largest DNS message over UDP with EDNS.
+	maxDNSMessageSize = 4096
+)
+
+// egressDNSProxy answers the DNS queries of VMs with egress domains, which are redirected to it. It
+// only resolves names of the domains of the querying VM and allows the VM to connect to the IPs
+// they resolve to.
+type egressDNSProxy struct {
+	s        *Server
+	conn     *net.UDPConn
+	upstream string
+	// Where it listens, for the rules redirecting queries.
+	addr *net.UDPAddr
+}
+
+// startEgressDNSProxy starts the DNS proxy of `s` on `ip`.
+func (s *Server) startEgressDNSProxy(ip net.IP) (*egressDNSProxy, error) {
+	cfg := s.config.Egress
+	upstream := cfg.DNSUpstream
+	if upstream == "" {
+		var err error
+		if upstream, err = systemNameserver(); err != nil {
+			return nil, err
+		}
+	}
+	addr := &net.UDPAddr{IP: ip, Port: cfg.DNSPort}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DNS queries of guests: %w", err)
+	}
+	proxy := &egressDNSProxy{s: s, conn: conn, upstream: upstream, addr: addr}
+	go proxy.serve()
+	log.WithFields(log.Fields{"addr": addr, "upstream": upstream}).Info("started egress DNS proxy")
+	return proxy, nil
+}
+
+// systemNameserver returns the first nameserver of the host's resolv.conf as "host:53".
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("failed to find a DNS resolver, set egress.dns_upstream: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("failed to find a DNS resolver in /etc/resolv.conf, set egress.dns_upstream")
+}
+
+func (p *egressDNSProxy) serve() {
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, client, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.WithError(err).Error("egress DNS proxy stopped")
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go p.handle(query, client)
+	}
+}
+
+// handle answers the DNS query `query` of the guest `client`, refusing it unless the guest's egress
+// policy has the name.
+func (p *egressDNSProxy) handle(query []byte, client *net.UDPAddr) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{"guestIP": client.IP, "name": question.Name.String()})
+
+	vm, policy := p.s.egressPolicyOf(client.IP)
+	if policy == nil || !policy.allowsDomain(question.Name.String()) {
+		logger.Debug("refused DNS query of guest")
+		p.reply(refusedDNSResponse(header, question), client)
+		return
+	}
+	response, err := p.forward(query)
+	if err != nil {
+		logger.WithError(err).Warn("failed to forward DNS query of guest")
+		return
+	}
+	if ips := answeredIPs(response); len(ips) > 0 {
+		if err := allowEgressIPs(vm.tapDevice.Name, ips); err != nil {
+			logger.WithError(err).Warn("failed to allow IPs of egress domain")
+			p.reply(refusedDNSResponse(header, question), client)
+			return
+		}
+	}
+	p.reply(response, client)
+}
+
+func (p *egressDNSProxy) reply(response []byte, client *net.UDPAddr) {
+	if response == nil {
+		return
+	}
+	if _, err := p.conn.WriteToUDP(response, client); err != nil {
+		log.WithField("guestIP", client.IP).WithError(err).Warn("failed to answer DNS query of guest")
+	}
+}
+
+// forward asks the upstream resolver `query`, returning its response.
+func (p *egressDNSProxy) forward(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", p.upstream, egressDNSUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(egressDNSUpstreamTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// refusedDNSResponse returns the response refusing the query with `header` and `question`, nil if
+// it can't be built.
+func refusedDNSResponse(header dnsmessage.Header, question dnsmessage.Question) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeRefused,
+	})
+	if err := builder.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := builder.Question(question); err != nil {
+		return nil
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// answeredIPs returns the IPv4 addresses of the A records answering `response`, with how long
+// they're valid.
+func answeredIPs(response []byte) map[string]time.Duration {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(response); err != nil {
+		return nil
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	ips := make(map[string]time.Duration)
+	for {
+		header, err := parser.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if header.Type != dnsmessage.TypeA {
+			if err := parser.SkipAnswer(); err != nil {
+				break
+			}
+			continue
+		}
+		a, err := parser.AResource()
+		if err != nil {
+			break
+		}
+		ttl := time.Duration(header.TTL) * time.Second
+		ttl = max(ttl, minEgressDNSTimeout)
+		ttl = min(ttl, maxEgressDNSTimeout)
+		ips[net.IP(a.A[:]).String()] = ttl
+	}
+	return ips
+}
+
+// allowEgressIPs lets the VM with the tap device `tapDevice` connect to `ips` for as long as they
+// say, renewing IPs that were allowed already.
+func allowEgressIPs(tapDevice string, ips map[string]time.Duration) error {
+	set := fmt.Sprintf("inet %s%s %s", egressTablePrefix, tapDevice, egressDomainsSet)
+	var script strings.Builder
+	for ip, ttl := range ips {
+		// Elements are only added with a timeout, so they're deleted and added again.
+		fmt.Fprintf(&script, "add element %s { %s }\n", set, ip)
+		fmt.Fprintf(&script, "delete element %s { %s }\n", set, ip)
+		fmt.Fprintf(&script, "add element %s { %s timeout %ds }\n", set, ip, int(ttl/time.Second))
+	}
+	return runNft(script.String())
+}
+
+// egressPolicyOf returns the VM with the IP `ip` and its egress policy, nil if there's no such VM
+// or it has none.
+func (s *Server) egressPolicyOf(ip net.IP) (*vm, *egressPolicy) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, vm := range s.vms {
+		if vm.egress != nil && vm.ip != nil && vm.ip.IP.Equal(ip) {
+			return vm, vm.egress
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+// Names /etc/environment and shells agree on.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateVMEnv checks the environment of a start, which also ends up in /etc/environment and so
+// can't have multi-line values.
+func validateVMEnv(env map[string]string) error {
+	for key, value := range env {
+		if !envNamePattern.MatchString(key) {
+			return status.Errorf(codes.InvalidArgument, "invalid environment variable name %q", key)
+		}
+		if strings.ContainsAny(value, "\n\r\x00") {
+			return status.Errorf(codes.InvalidArgument, "environment variable %s can't contain newlines or NUL", key)
+		}
+	}
+	return nil
+}
+
+// deliverEnv hands the environment of the start request to the agent of the VM `vmName`, which
+// exports it for every command run afterwards and writes it to /etc/environment.
+func (s *Server) deliverEnv(ctx context.Context, vmName string, env map[string]string) error {
+	if len(env) == 0 {
+		return nil
+	}
+	if err := s.postAgent(ctx, vmName, "/env", cmdserver.EnvPostRequest{Env: env}, "environment"); err != nil {
+		return err
+	}
+	log.WithField("vmName", vmName).WithField("env", len(env)).Info("set VM environment")
+	return nil
+}
+
+// deliverGuestSetup hands the environment and secrets of the start request to the agent of the VM
+// `vmName`, once it's ready.
+func (s *Server) deliverGuestSetup(ctx context.Context, vmName string, env map[string]string, refs []secretRef) error {
+	if err := s.deliverEnv(ctx, vmName, env); err != nil {
+		return err
+	}
+	return s.deliverSecrets(ctx, vmName, refs)
+}
+
+// postAgent sends `reqBody` to `path` of the agent of the VM `vmName`. `what` names it in errors,
+// which never include the body.
+func (s *Server) postAgent(ctx context.Context, vmName string, path string, reqBody any, what string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to marshal request: %v", err)
+	}
+	url := fmt.Sprintf("http://%s:4031%s", vm.ip.IP.String(), path)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.agentClient(s.Config().Timeouts.ExecDefault).Do(req)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to deliver %s: %v", what, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return status.Errorf(codes.Unavailable, "the guest's cmdserver is too old for %s", what)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The agent's errors name variables and paths, not values.
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return status.Errorf(codes.Internal, "failed to deliver %s, status %d: %s", what, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
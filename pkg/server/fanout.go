@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	defaultFanOutParallelism = 8
+	maxFanOutParallelism     = 64
+)
+
+// fanOutTarget is a VM selected to run a fanned out command.
+type fanOutTarget struct {
+	// Within the namespace.
+	name string
+	vm   *vm
+	// Set if the VM can't run the command.
+	err string
+}
+
+// FanOutCommand runs `req.Cmd` in every VM of `namespace` that matches `req.LabelSelector` and that
+// the caller may change, at most `req.Parallelism` VMs at a time. The command's failure in one VM
+// doesn't stop the others; every VM's outcome is reported in the response.
+func (s *Server) FanOutCommand(ctx context.Context, namespace string, req *serverapi.FanOutCommandRequest) (*serverapi.FanOutCommandResponse, error) {
+	if req.GetCmd() == "" {
+		return nil, status.Error(codes.InvalidArgument, "command cannot be empty")
+	}
+	runReq := cmdserver.RunCmdRequest{
+		Cmd:      req.GetCmd(),
+		Blocking: true,
+		Cwd:      req.GetCwd(),
+		Env:      req.GetEnv(),
+		User:     req.GetUser(),
+	}
+	if err := runReq.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if strings.TrimSpace(req.GetLabelSelector()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "label selector cannot be empty")
+	}
+	selector, err := parseLabelSelector(req.GetLabelSelector())
+	if err != nil {
+		return nil, err
+	}
+	parallelism := int(req.GetParallelism())
+	if parallelism < 0 || parallelism > maxFanOutParallelism {
+		return nil, status.Errorf(codes.InvalidArgument, "parallelism must be between 1 and %d", maxFanOutParallelism)
+	}
+	if parallelism == 0 {
+		parallelism = defaultFanOutParallelism
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	s.lock.RLock()
+	var targets []fanOutTarget
+	for qualifiedName, vm := range s.vms {
+		ns, name := SplitQualifiedName(qualifiedName)
+		if ns != namespace || !selector.matches(vm.labels) || authorizeVMLocked(ctx, vm) != nil {
+			continue
+		}
+		target := fanOutTarget{name: name, vm: vm}
+		// VMs paused for being idle are resumed like for any other command.
+		if vm.status != vmStatusRunning && !vm.idleSuspended {
+			target.err = fmt.Sprintf("vm is %s", strings.ToLower(vm.status.String()))
+		}
+		targets = append(targets, target)
+	}
+	s.lock.RUnlock()
+	slices.SortFunc(targets, func(a, b fanOutTarget) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	logger := log.WithFields(log.Fields{
+		"namespace":     namespace,
+		"labelSelector": req.GetLabelSelector(),
+		"cmd":           req.GetCmd(),
+		"vms":           len(targets),
+	})
+	logger.Info("Fanning out command")
+
+	timeout := s.Config().Timeouts.ExecDefault
+	runReq.TimeoutSeconds = timeoutSeconds(timeout)
+	client := s.agentClient(timeout + commandGrace)
+	results := make([]serverapi.FanOutCommandResult, len(targets))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		results[i].VmName = target.name
+		if target.err != "" {
+			results[i].SetError(target.err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i].SetError(ctx.Err().Error())
+				return
+			}
+
+			release, err := s.WakeVM(ctx, QualifiedName(namespace, target.name))
+			if err != nil {
+				results[i].SetError(err.Error())
+				return
+			}
+			defer release()
+			url := fmt.Sprintf("http://%s:4031", target.vm.ip.IP.String())
+			resp, err := target.vm.handleRun(ctx, client, url, runReq)
+			if err != nil {
+				results[i].SetError(err.Error())
+				return
+			}
+			results[i].Output = resp.Output
+			results[i].ExitCode = resp.ExitCode
+			if resp.GetError() != "" {
+				results[i].SetError(resp.GetError())
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := &serverapi.FanOutCommandResponse{Results: results}
+	var succeeded, failed int32
+	for _, result := range results {
+		if result.HasError() || result.GetExitCode() != 0 {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	resp.SetSucceeded(succeeded)
+	resp.SetFailed(failed)
+	logger.WithFields(log.Fields{
+		"succeeded": succeeded,
+		"failed":    failed,
+	}).Info("Fanned out command")
+	return resp, nil
+}
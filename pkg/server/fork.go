@@ -0,0 +1,605 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/server/fountain"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
+)
+
+const (
+	// Holds the snapshot a fork or restored VM is restored from, with the VM config rewritten for
+	// it.
+	forkSourceDirname = "fork-source"
+	// The guest's network interface, as set up by guestinit.
+	guestNetInterface = "eth0"
+	// How long the guest may take to take on the fork's identity.
+	reidentifyTimeout = 30 * time.Second
+	// Where the vsockserver keeps the kernel command line, mounted over /proc/cmdline, and reads
+	// the VM's name from when it starts.
+	guestCmdlinePath = "/run/arrakis/cmdline"
+)
+
+var (
+	guestIPCmdlineRegex = regexp.MustCompile(`guest_ip="[^"]*"`)
+	vmNameCmdlineRegex  = regexp.MustCompile(`vm_name="[^"]*"`)
+)
+
+// forkIdentity is what sets a fork apart from the VM it was snapshotted from.
+type forkIdentity struct {
+	name      string
+	stateDir  string
+	tap       string
+	mac       string
+	guestIP   *net.IPNet
+	cid       uint32
+	vsockPath string
+}
+
+// ForkSnapshot boots the new VM `req.VmName` from the snapshot `snapshotId`. Unlike restoring, the
+// fork gets a name, MAC, IP and CID of its own, so that any number of VMs can be started from the
+// same snapshot while the snapshotted VM keeps running.
+func (s *Server) ForkSnapshot(ctx context.Context, snapshotId string, req *serverapi.StartVMRequest) (_ *serverapi.StartVMResponse, retErr error) {
+	vmName := req.GetVmName()
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+	if req.GetKernel() != "" || req.GetInitramfs() != "" || req.GetRootfs() != "" || req.GetTemplate() != "" || req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "forks take their images from the snapshot, kernel, initramfs, rootfs, template and snapshotId can't be given")
+	}
+	if len(req.SharedDirs) > 0 {
+		return nil, status.Error(codes.InvalidArgument, "snapshots have no shared directories, forks can't be given sharedDirs")
+	}
+	if len(req.Disks) > 0 {
+		return nil, status.Error(codes.InvalidArgument, "snapshots have no data disks, forks can't be given disks")
+	}
+	if len(req.Tmpfs) > 0 || req.SwapSizeBytes != nil {
+		return nil, status.Error(codes.InvalidArgument, "forks keep the tmpfs and swap of the snapshot, tmpfs and swapSizeBytes can't be given")
+	}
+	if req.GetBaseImage() != "" {
+		return nil, status.Error(codes.InvalidArgument, "forks get the stateful disk of the snapshot, baseImage can't be given")
+	}
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, err
+	}
+	if err := validSnapshotID(snapshotId); err != nil {
+		return nil, err
+	}
+	bootTimeout, err := s.bootTimeout(req.GetBootTimeoutSeconds())
+	if err != nil {
+		return nil, err
+	}
+	if err := validateReadinessProbe(req.Readiness); err != nil {
+		return nil, err
+	}
+	restartPolicy, err := newRestartPolicy(req.RestartPolicy)
+	if err != nil {
+		return nil, err
+	}
+	oomPolicy, err := newOOMPolicy(req.OomPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if oomPolicy.action == oomActionGrowMemory {
+		return nil, status.Error(codes.InvalidArgument, "forks keep the memory of the snapshot, oomPolicy grow-memory can't be given")
+	}
+	if req.DiskLimit != nil {
+		return nil, status.Error(codes.InvalidArgument, "forks keep the disk limits of the snapshot, diskLimit can't be given")
+	}
+	restart := &restartSpec{policy: restartPolicy, req: *req, forkSnapshotID: snapshotId}
+	restart.req.GenerateName = nil
+	disconnect, err := newDisconnectPolicy(req.DisconnectPolicy)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := s.newHooks(ctx, req.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	secretRefs, err := s.newSecretRefs(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateVMEnv(req.GetEnv()); err != nil {
+		return nil, err
+	}
+	staticIP, staticMAC, err := parseStaticNetwork(req.GetIp(), req.GetMac())
+	if err != nil {
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{
+		"vmName":     vmName,
+		"snapshotId": snapshotId,
+	})
+
+	ctx, span := tracing.Start(
+		ctx,
+		"server.ForkSnapshot",
+		tracing.String("vm.name", vmName),
+		tracing.String("snapshot.id", snapshotId),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+	defer s.vmsChanged()
+
+	done, err := s.beginOp(true)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, releaseName, err := s.claimVMName(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseName()
+
+	if s.getVMAtomic(vmName) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+	if err := s.checkCordon(); err != nil {
+		return nil, err
+	}
+	if err := s.checkStaticMAC(vmName, staticMAC); err != nil {
+		return nil, err
+	}
+	if err := s.runHooks(ctx, hookPreStart, vmName, hooks); err != nil {
+		return nil, err
+	}
+	snapshotPath := path.Join(s.config.StateDir, "snapshots", snapshotId)
+	if _, err := os.Stat(snapshotPath); errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotId)
+	}
+	// Forks stay in the network mode of the snapshotted VM unless asked otherwise.
+	networkMode := req.GetNetworkMode()
+	if networkMode == "" {
+		if networkMode, err = readNetworkMode(snapshotPath); err != nil {
+			return nil, fmt.Errorf("failed to read network mode from snapshot: %w", err)
+		}
+	}
+	networkMode, ipPool, err := s.parseNetworkMode(networkMode, req.GetIpPool(), staticIP)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Forking snapshot")
+	vm, err := s.forkVM(ctx, vmName, snapshotPath, staticIP, staticMAC, networkMode, ipPool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fork snapshot: %w", err)
+	}
+
+	// Only mark the VM as ready when we can do things inside the sandbox via the API.
+	logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for VM to be ready")
+	if err := s.waitForVMReady(ctx, vm, req.Readiness, bootTimeout); err != nil {
+		logger.WithError(err).Warn("VM not ready, destroying it")
+		s.destroyUnreadyVM(ctx, vmName)
+		return nil, err
+	}
+	logger.Infof("VM ready")
+	if err := s.deliverGuestSetup(ctx, vmName, req.GetEnv(), secretRefs); err != nil {
+		logger.WithError(err).Warn("Failed to set up guest, destroying VM")
+		s.destroyUnreadyVM(ctx, vmName)
+		return nil, err
+	}
+	s.watchForCrashes(vmName, restart)
+	s.events.Publish(events.VMStarted, vmName, map[string]string{
+		"ip":         vm.ip.String(),
+		"snapshotId": snapshotId,
+	})
+
+	if req.GetProtected() {
+		s.protectVM(vmName)
+	}
+	if req.HasLabels() {
+		s.setVMLabels(vmName, req.GetLabels())
+	}
+	if disconnect != nil {
+		s.setDisconnectPolicy(vmName, disconnect)
+	}
+	s.setOOMPolicy(vmName, oomPolicy)
+	s.setVMHooks(vmName, hooks)
+	// Failures are logged and published, the VM is up either way.
+	s.runHooks(ctx, hookPostBoot, vmName, hooks)
+	sessionToken, err := s.issueSessionToken(vmName)
+	if err != nil {
+		return nil, err
+	}
+	return &serverapi.StartVMResponse{
+		VmName:        serverapi.PtrString(vmName),
+		Ip:            serverapi.PtrString(vm.ip.String()),
+		Status:        serverapi.PtrString(vm.status.String()),
+		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
+		PortForwards:  convertPortForward(vm.portForwards),
+		SessionToken:  serverapi.PtrString(sessionToken),
+	}, nil
+}
+
+// forkVM restores the snapshot at `snapshotPath` as the new VM `vmName`, and has the guest take on
+// the new VM's network identity in `networkMode`, with `staticIP` and `staticMAC` unless nil and
+// otherwise an IP of `ipPool`.
+func (s *Server) forkVM(ctx context.Context, vmName string, snapshotPath string, staticIP net.IP, staticMAC net.HardwareAddr, networkMode string, ipPool string) (*vm, error) {
+	logger := log.WithFields(log.Fields{
+		"vmName":       vmName,
+		"snapshotPath": snapshotPath,
+	})
+	cleanup := cleanup.Make(func() {
+		logger.Info("fork VM clean up done")
+	})
+	defer cleanup.Clean()
+
+	configData, err := os.ReadFile(path.Join(snapshotPath, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot config: %w", err)
+	}
+
+	artifacts := newVMArtifacts(s.config.StateDir, vmName)
+	artifacts.ip = staticIP
+	artifacts.setNetworkMode(networkMode, ipPool)
+	tapDevice, guestIP, cid, err := s.allocateGuestDevices(&cleanup, logger, artifacts)
+	if err != nil {
+		return nil, err
+	}
+	var mac string
+	if staticMAC != nil {
+		mac = staticMAC.String()
+	} else if mac, err = randomMAC(); err != nil {
+		return nil, fmt.Errorf("failed to generate MAC address: %w", err)
+	}
+
+	vm, err := s.createVM(ctx, vmName, artifacts, "", "", "", "", true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM for fork: %w", err)
+	}
+	vm.tapDevice = tapDevice
+	vm.ip = guestIP
+	if staticMAC != nil {
+		vm.mac = mac
+	}
+	vm.cid = cid
+	vm.vsockPath = path.Join(vm.stateDirPath, vsockSocketFilename)
+	// The tap device, IP and CID are freed by the cleanups above, not `destroyVM`.
+	cleanup.Add(func() {
+		if err := vm.destroy(ctx); err != nil {
+			logger.WithError(err).Error("failed to destroy VM during fork cleanup")
+		}
+		s.lock.Lock()
+		delete(s.vms, vmName)
+		s.lock.Unlock()
+	})
+
+	identity := forkIdentity{
+		name:      vmName,
+		stateDir:  vm.stateDirPath,
+		tap:       tapDevice.Name,
+		mac:       mac,
+		guestIP:   guestIP,
+		cid:       cid,
+		vsockPath: vm.vsockPath,
+	}
+	vm.diskLimit = snapshotDiskLimit(configData)
+	forkConfig, err := rewriteForkConfig(configData, identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite snapshot config: %w", err)
+	}
+	sourceDir := path.Join(vm.stateDirPath, forkSourceDirname)
+	if err := linkForkSource(snapshotPath, sourceDir, forkConfig); err != nil {
+		return nil, fmt.Errorf("failed to prepare snapshot: %w", err)
+	}
+	// The hypervisor is done with the snapshot once restored.
+	defer os.RemoveAll(sourceDir)
+
+	if err := copyStatefulDisk(path.Join(snapshotPath, statefulDiskFilename), path.Join(vm.stateDirPath, statefulDiskFilename)); err != nil {
+		return nil, fmt.Errorf("failed to copy stateful disk from snapshot: %w", err)
+	}
+	// The guest keeps the snapshotted VM's secret, it can't be told a new one without it.
+	if err := copyVsockSecret(snapshotPath, vm.stateDirPath); err != nil {
+		return nil, fmt.Errorf("failed to copy vsock secret from snapshot: %w", err)
+	}
+	vm.services, err = readVsockServices(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vsock services from snapshot: %w", err)
+	}
+	vm.credentialProfiles, err = readCredentialProfiles(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential profiles from snapshot: %w", err)
+	}
+
+	portForwards, err := s.setupPortForwardsToVM(guestIP.IP.String(), s.portForwardsOf(vm.networkMode))
+	if err != nil {
+		cleanupAllIPTablesRulesForIP(guestIP.IP.String())
+		return nil, fmt.Errorf("failed to forward ports to VM: %w", err)
+	}
+	vm.portForwards = portForwards
+
+	if err := vm.restore(ctx, sourceDir, s.Config().Timeouts.Snapshot); err != nil {
+		return nil, fmt.Errorf("failed to restore VM: %w", err)
+	}
+	if err := s.limitHypervisor(ctx, vm); err != nil {
+		return nil, err
+	}
+	if err := vm.resume(ctx); err != nil {
+		return nil, fmt.Errorf("failed to resume VM: %w", err)
+	}
+	if err := s.reidentifyGuest(ctx, vm, identity); err != nil {
+		return nil, fmt.Errorf("failed to change the identity of the guest: %w", err)
+	}
+	logger.WithFields(log.Fields{
+		"ip":  guestIP.String(),
+		"mac": mac,
+		"cid": cid,
+	}).Info("forked VM")
+
+	cleanup.Release()
+	return vm, nil
+}
+
+// allocateGuestDevices creates the tap device of `artifacts` and allocates its IP, or any if it has
+// none, and a CID for a VM whose config isn't created by `createVM`. They are released by `cu`.
+func (s *Server) allocateGuestDevices(cu *cleanup.Cleanup, logger *log.Entry, artifacts vmArtifacts) (*fountain.TapDevice, *net.IPNet, uint32, error) {
+	tapDevice, err := s.createTapDevice(artifacts)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to create tap device: %w", err)
+	}
+	cu.Add(func() {
+		if err := s.fountain.DestroyTapDevice(tapDevice); err != nil {
+			logger.WithError(err).Errorf("failed to delete tap device: %s", tapDevice)
+		}
+	})
+	var guestIP *net.IPNet
+	if artifacts.ip != nil {
+		guestIP, err = s.ipAllocator.AllocateSpecificIP(artifacts.ip, artifacts.stateDir)
+		if err != nil {
+			return nil, nil, 0, status.Errorf(codes.AlreadyExists, "can't assign the requested IP: %v", err)
+		}
+	} else {
+		guestIP, err = s.ipAllocator.AllocateIP(artifacts.ipPool, artifacts.stateDir)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("error allocating guest ip: %w", err)
+		}
+	}
+	cu.Add(func() {
+		s.ipAllocator.FreeIP(guestIP.IP)
+	})
+	if err := s.connectTapDevice(artifacts.networkMode, tapDevice, guestIP); err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to connect tap device: %w", err)
+	}
+	cid, err := s.cidAllocator.AllocateCID()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to allocate CID: %w", err)
+	}
+	cu.Add(func() {
+		if err := s.cidAllocator.FreeCID(cid); err != nil {
+			logger.WithError(err).Errorf("failed to free CID: %d", cid)
+		}
+	})
+	return tapDevice, guestIP, cid, nil
+}
+
+// rewriteForkConfig returns the snapshot's VM config `data` with the snapshotted VM's tap device,
+// MAC, vsock device and files replaced by the fork's. Settings we don't know about are kept. Also
+// moves the config of a VM migrating here to the destination's devices.
+func rewriteForkConfig(data []byte, identity forkIdentity) ([]byte, error) {
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	vsock, ok := config["vsock"].(map[string]any)
+	if !ok {
+		return nil, errors.New("the snapshotted VM has no vsock device")
+	}
+	if socket, _ := vsock["socket"].(string); socket == "" {
+		return nil, errors.New("the snapshotted VM has no vsock socket")
+	}
+	if err := relocateSnapshotConfig(config, identity.stateDir, identity.vsockPath, identity.tap); err != nil {
+		return nil, err
+	}
+	vsock["cid"] = identity.cid
+	config["net"].([]any)[0].(map[string]any)["mac"] = identity.mac
+
+	// The guest doesn't reread its command line, but snapshots of the fork are parsed for it.
+	if payload, ok := config["payload"].(map[string]any); ok {
+		if cmdline, ok := payload["cmdline"].(string); ok {
+			cmdline = guestIPCmdlineRegex.ReplaceAllLiteralString(cmdline, fmt.Sprintf("guest_ip=%q", identity.guestIP.String()))
+			cmdline = vmNameCmdlineRegex.ReplaceAllLiteralString(cmdline, fmt.Sprintf("vm_name=%q", identity.name))
+			payload["cmdline"] = cmdline
+		}
+	}
+	return json.Marshal(config)
+}
+
+// rewriteRestoreConfig returns the snapshot's VM config `data` with the snapshotted VM's files,
+// vsock socket and tap device moved to those of the VM restoring it, see relocateSnapshotConfig.
+func rewriteRestoreConfig(data []byte, stateDir string, vsockPath string, tap string) ([]byte, error) {
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if err := relocateSnapshotConfig(config, stateDir, vsockPath, tap); err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+// relocateSnapshotConfig moves the files in the snapshotted VM's state directory, e.g. the
+// stateful disk, to `stateDir` and has `config` use the vsock socket `vsockPath`, if it has a vsock
+// device, and the tap device `tap`. State directories are named per VM instance, so even a VM
+// restored under its old name has a new one.
+func relocateSnapshotConfig(config map[string]any, stateDir string, vsockPath string, tap string) error {
+	if oldStateDir := snapshotStateDir(config); oldStateDir != "" {
+		replaceStatePaths(config, oldStateDir, stateDir)
+	}
+	if vsock, ok := config["vsock"].(map[string]any); ok {
+		vsock["socket"] = vsockPath
+	}
+
+	nets, _ := config["net"].([]any)
+	if len(nets) != 1 {
+		return fmt.Errorf("the snapshotted VM has %d network devices, expected 1", len(nets))
+	}
+	netConfig, ok := nets[0].(map[string]any)
+	if !ok {
+		return errors.New("invalid network device in config")
+	}
+	netConfig["tap"] = tap
+	// Taken from the new tap device.
+	delete(netConfig, "host_mac")
+	return nil
+}
+
+// snapshotStateDir returns the state directory of the VM that `config` was snapshotted from, or ""
+// if it can't tell. VMs without a vsock device predate it and still have their stateful disk.
+func snapshotStateDir(config map[string]any) string {
+	if vsock, ok := config["vsock"].(map[string]any); ok {
+		if socket, _ := vsock["socket"].(string); socket != "" {
+			return path.Dir(socket)
+		}
+	}
+	disks, _ := config["disks"].([]any)
+	for _, d := range disks {
+		disk, _ := d.(map[string]any)
+		if diskPath, _ := disk["path"].(string); path.Base(diskPath) == statefulDiskFilename {
+			return path.Dir(diskPath)
+		}
+	}
+	return ""
+}
+
+// replaceStatePaths returns `value` with every path under `oldDir` moved under `newDir`. Paths that
+// would leave `newDir`, through "..", are left alone.
+func replaceStatePaths(value any, oldDir string, newDir string) any {
+	switch v := value.(type) {
+	case string:
+		if rest, ok := strings.CutPrefix(v, oldDir+"/"); ok && filepath.IsLocal(rest) {
+			return path.Join(newDir, rest)
+		}
+		return v
+	case map[string]any:
+		for key, elem := range v {
+			v[key] = replaceStatePaths(elem, oldDir, newDir)
+		}
+		return v
+	case []any:
+		for i, elem := range v {
+			v[i] = replaceStatePaths(elem, oldDir, newDir)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// linkForkSource fills `dir` with hard links to the snapshot's files, so that the memory isn't
+// copied, and with `config` as the VM config.
+func linkForkSource(snapshotPath string, dir string, config []byte) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(snapshotPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// The fork gets copies of the stateful disk and secret in its state directory.
+		if !entry.Type().IsRegular() || entry.Name() == "config.json" ||
+			entry.Name() == statefulDiskFilename || entry.Name() == guestcall.VsockSecretFilename {
+			continue
+		}
+		src := path.Join(snapshotPath, entry.Name())
+		dst := path.Join(dir, entry.Name())
+		if err := os.Link(src, dst); err != nil {
+			// E.g. if the state directory spans file systems.
+			if err := copyFile(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+	return os.WriteFile(path.Join(dir, "config.json"), config, 0644)
+}
+
+// randomMAC returns a random, locally administered, unicast MAC address.
+func randomMAC() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[0] = b[0]&0xfe | 0x02
+	return net.HardwareAddr(b).String(), nil
+}
+
+// reidentifyGuest has the guest of a fork, which still thinks it's the snapshotted VM, take on the
+// fork's MAC, IP and name. The vsockserver is restarted to pick up the new name, which it reports
+// callbacks and reports under.
+func (s *Server) reidentifyGuest(ctx context.Context, vm *vm, identity forkIdentity) error {
+	ctx, cancel := context.WithTimeout(ctx, reidentifyTimeout)
+	defer cancel()
+	conn, reader, err := s.dialAgent(ctx, vm)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The fork may be on another subnet than the snapshotted VM.
+	gateway, err := s.ipAllocator.Gateway(identity.guestIP.IP)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", reidentifyScript(identity, gateway)); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read result: %w", err)
+	}
+	if result := strings.TrimSpace(line); result != "ok" {
+		return errors.New(result)
+	}
+	return nil
+}
+
+// reidentifyScript returns the shell command, a single line, that moves the guest to `identity`.
+// `gateway` is the host's address on the guest's subnet. It prints "ok", or "failed: " and the
+// output of the step that failed.
+func reidentifyScript(identity forkIdentity, gateway *net.IPNet) string {
+	steps := []string{
+		fmt.Sprintf("ip link set %s down", guestNetInterface),
+		fmt.Sprintf("ip link set %s address %s", guestNetInterface, identity.mac),
+		fmt.Sprintf("ip addr flush dev %s", guestNetInterface),
+		fmt.Sprintf("ip addr add %s dev %s", identity.guestIP.String(), guestNetInterface),
+		fmt.Sprintf("ip link set %s up", guestNetInterface),
+		fmt.Sprintf("ip route replace default via %s dev %s", gateway.IP, guestNetInterface),
+		fmt.Sprintf("ip neigh flush dev %s", guestNetInterface),
+		// Written in place, rather than replaced, to keep the mount over /proc/cmdline.
+		fmt.Sprintf(
+			`{ [ ! -e %[1]s ] || { sed -e 's|guest_ip="[^"]*"|guest_ip="%[2]s"|' -e 's|gateway_ip="[^"]*"|gateway_ip="%[4]s"|' -e 's|vm_name="[^"]*"|vm_name="%[3]s"|' %[1]s > %[1]s.new && cat %[1]s.new > %[1]s && rm %[1]s.new; }; }`,
+			guestCmdlinePath, identity.guestIP.String(), identity.name, gateway.String()),
+		// Restarted once it has answered us. Without systemd, guestinit is the init and restarts
+		// it once it's stopped.
+		`if [ -d /run/systemd/system ]; then systemd-run --on-active=1 systemctl restart arrakis-vsockserver.service; ` +
+			`else { sleep 1; kill $(cat /run/arrakis/arrakis-vsockserver.pid); } >/dev/null 2>&1 & fi`,
+	}
+	return fmt.Sprintf(`out=$( { %s; } 2>&1 ) && echo ok || echo "failed: $(echo $out)"`, strings.Join(steps, " && "))
+}
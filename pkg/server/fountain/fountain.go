@@ -3,173 +3,169 @@ package fountain
 import (
 	"fmt"
 	"os/exec"
+	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/cleanup"
 )
 
-const (
-	LowID  int32 = 0
-	HighID int32 = 65535
-)
+// MaxNameLength is the longest interface name the kernel accepts, IFNAMSIZ less the terminating
+// NUL. Longer names are refused rather than truncated, since truncation could make two collide.
+const MaxNameLength = 15
 
 // TapDevice represents a tap network device
 type TapDevice struct {
 	Name string
-	ID   int32
+	// The network namespace the tap device is in, empty if it's on the host. The host then has
+	// a veth of the same name in its place.
+	Namespace string
 }
 
 // String implements the fmt.Stringer interface.
 func (t *TapDevice) String() string {
-	return fmt.Sprintf("TapDevice{Name: %s, ID: %d}", t.Name, t.ID)
+	if t.Namespace != "" {
+		return fmt.Sprintf("TapDevice{Name: %s, Namespace: %s}", t.Name, t.Namespace)
+	}
+	return fmt.Sprintf("TapDevice{Name: %s}", t.Name)
 }
 
 type Fountain struct {
 	bridgeDevice string
 	mutex        sync.Mutex
-	available    []int32 // Available tap IDs
-	lowID        int32   // Lowest ID to allocate
-	highID       int32   // Highest ID to allocate
+	inUse        map[string]bool // Names of the tap devices created and not yet destroyed
 }
 
 func NewFountain(bridgeDevice string) *Fountain {
-	f := &Fountain{
+	return &Fountain{
 		bridgeDevice: bridgeDevice,
-		lowID:        LowID,
-		highID:       HighID,
-		available:    make([]int32, 0, HighID-LowID+1),
-	}
-
-	for id := LowID; id <= HighID; id++ {
-		f.available = append(f.available, id)
+		inUse:        make(map[string]bool),
 	}
-	return f
 }
 
-// allocateTapID allocates a new tap device ID (internal use).
-func (f *Fountain) allocateTapID() (int32, error) {
+// claimName reserves `name` for a new tap device (internal use).
+func (f *Fountain) claimName(name string) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	if len(f.available) == 0 {
-		return -1, fmt.Errorf("no available tap device IDs in range %d-%d", f.lowID, f.highID)
+	if name == "" || len(name) > MaxNameLength {
+		return fmt.Errorf("invalid tap device name %q: must be 1 to %d characters", name, MaxNameLength)
 	}
-
-	id := f.available[0]
-	f.available = f.available[1:]
-	return id, nil
+	if f.inUse[name] {
+		return fmt.Errorf("tap device %s is already in use", name)
+	}
+	f.inUse[name] = true
+	return nil
 }
 
-// freeTapID returns a tap ID to the pool of available IDs (internal use).
-func (f *Fountain) freeTapID(id int32) error {
+// freeName releases `name` (internal use).
+func (f *Fountain) freeName(name string) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-
-	if id < f.lowID || id > f.highID {
-		return fmt.Errorf("tap ID %d is outside allocator range %d-%d", id, f.lowID, f.highID)
-	}
-
-	for _, i := range f.available {
-		if i == id {
-			return fmt.Errorf("tap ID %d is already free", id)
-		}
-	}
-	f.available = append(f.available, id)
-	return nil
+	delete(f.inUse, name)
 }
 
-// claimID attempts to claim a specific tap ID from the pool
-// It returns an error if the ID is not available or outside the valid range
-func (f *Fountain) claimID(id int32) error {
+// InUse returns true if the tap device `name` was created or adopted and not destroyed since.
+func (f *Fountain) InUse(name string) bool {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	return f.inUse[name]
+}
 
-	// Check if ID is in valid range
-	if id < f.lowID || id > f.highID {
-		return fmt.Errorf("tap ID %d is outside allocator range %d-%d", id, f.lowID, f.highID)
-	}
-
-	// Check if ID is available
-	isAvailable := false
-	for i, availableID := range f.available {
-		if availableID == id {
-			// Remove this ID from the available pool
-			f.available = append(f.available[:i], f.available[i+1:]...)
-			isAvailable = true
-			break
-		}
-	}
-
-	if !isAvailable {
-		return fmt.Errorf("tap ID %d is not available", id)
-	}
-
-	return nil
+// CreateTapDevice creates the tap device `name`, attached to the bridge, and returns a TapDevice.
+// Fails if a device of that name was already created and not destroyed.
+func (f *Fountain) CreateTapDevice(name string) (*TapDevice, error) {
+	return f.CreateTapDeviceOn(name, f.bridgeDevice)
 }
 
-// CreateTapDevice creates a new tap device with an auto-allocated ID and returns a TapDevice
-// If id is provided, it will attempt to claim that specific ID instead of auto-allocating
-func (f *Fountain) CreateTapDevice(id *int32) (*TapDevice, error) {
+// CreateTapDeviceOn is CreateTapDevice with the tap device attached to `bridge` instead, or to no
+// bridge if it's empty.
+func (f *Fountain) CreateTapDeviceOn(name string, bridge string) (*TapDevice, error) {
 	logger := log.WithField("action", "CreateTapDevice")
 	cleanup := cleanup.Make(func() {
 		logger.Debug("createTapDevice cleanup")
 	})
 	defer cleanup.Clean()
 
-	var allocatedID int32
-	var err error
-	if id != nil {
-		if err := f.claimID(*id); err != nil {
-			return nil, err
-		}
-		allocatedID = *id
-	} else {
-		// Use existing auto-allocation logic
-		allocatedID, err = f.allocateTapID()
-		if err != nil {
-			return nil, fmt.Errorf("failed to allocate tap ID: %w", err)
-		}
+	if err := f.claimName(name); err != nil {
+		return nil, err
 	}
 	cleanup.Add(func() {
-		if err := f.freeTapID(allocatedID); err != nil {
-			logger.WithError(err).Errorf("failed to free tap ID %d during cleanup", allocatedID)
-		}
+		f.freeName(name)
 	})
 
-	deviceName := fmt.Sprintf("tap%d", allocatedID)
 	if output, err := exec.Command(
-		"ip", "tuntap", "add", "dev", deviceName, "mode", "tap",
+		"ip", "tuntap", "add", "dev", name, "mode", "tap",
 	).CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to create: %v: %s %w", deviceName, output, err)
+		return nil, fmt.Errorf("failed to create: %v: %s %w", name, output, err)
 	}
+	cleanup.Add(func() {
+		if err := exec.Command("ip", "tuntap", "del", "dev", name, "mode", "tap").Run(); err != nil {
+			logger.WithError(err).Errorf("failed to delete %s during cleanup", name)
+		}
+	})
 
-	if output, err := exec.Command(
-		"ip", "l", "set", "dev", deviceName, "master", f.bridgeDevice,
-	).CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to add: %v to: %v: %s %w", deviceName, f.bridgeDevice, output, err)
+	if bridge != "" {
+		if output, err := exec.Command(
+			"ip", "l", "set", "dev", name, "master", bridge,
+		).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to add: %v to: %v: %s %w", name, bridge, output, err)
+		}
 	}
 
 	if output, err := exec.Command(
-		"ip", "l", "set", deviceName, "up",
+		"ip", "l", "set", name, "up",
 	).CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to up: %v: %s %w", deviceName, output, err)
+		return nil, fmt.Errorf("failed to up: %v: %s %w", name, output, err)
 	}
 
 	cleanup.Release()
 	return &TapDevice{
-		Name: deviceName,
-		ID:   allocatedID,
+		Name: name,
 	}, nil
 }
 
-// DestroyTapDevice destroys a tap device and frees its ID.
+// SetTapOwner hands the tap device `name`, in the network namespace `netns` if it's set, to the
+// user and group `id`, so that processes of that user can open it without CAP_NET_ADMIN.
+func (f *Fountain) SetTapOwner(name string, netns string, id int) error {
+	var args []string
+	if netns != "" {
+		args = append(args, "-n", netns)
+	}
+	// Adding an existing tap device attaches to it, which sets its owner.
+	args = append(args, "tuntap", "add", "dev", name, "mode", "tap", "user", strconv.Itoa(id), "group", strconv.Itoa(id))
+	if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set owner of %v: %s %w", name, output, err)
+	}
+	return nil
+}
+
+// AdoptTapDevice takes over the existing tap device `name`, e.g. one created by another server
+// that managed the same VMs before, so that it's destroyed along with its VM.
+func (f *Fountain) AdoptTapDevice(name string) (*TapDevice, error) {
+	if err := f.claimName(name); err != nil {
+		return nil, err
+	}
+	device := &TapDevice{
+		Name: name,
+	}
+	if NetnsExists(NetnsName(name)) {
+		device.Namespace = NetnsName(name)
+	}
+	return device, nil
+}
+
+// DestroyTapDevice destroys a tap device and frees its name.
 func (f *Fountain) DestroyTapDevice(device *TapDevice) error {
 	log.WithFields(log.Fields{
 		"deviceName": device.Name,
-		"deviceID":   device.ID,
+		"namespace":  device.Namespace,
 	}).Info("destroy tap device")
 
+	if device.Namespace != "" {
+		return f.destroyNamespacedTapDevice(device)
+	}
+
 	// Remove the tap device from the bridge
 	if err := exec.Command("ip", "link", "set", device.Name, "nomaster").Run(); err != nil {
 		return fmt.Errorf("failed to remove %v from bridge: %w", device.Name, err)
@@ -185,11 +181,6 @@ func (f *Fountain) DestroyTapDevice(device *TapDevice) error {
 		return fmt.Errorf("failed to delete %v: %w", device.Name, err)
 	}
 
-	// Free the ID if it's valid
-	if device.ID >= f.lowID && device.ID <= f.highID {
-		// Ignore error from freeTapID as the device is already deleted
-		_ = f.freeTapID(device.ID)
-	}
-
+	f.freeName(device.Name)
 	return nil
 }
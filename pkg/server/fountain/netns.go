@@ -0,0 +1,174 @@
+package fountain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/cleanup"
+)
+
+const (
+	// Network namespaces of tap devices are "arrakis-<tap device>".
+	NetnsPrefix = "arrakis-"
+	// Where `ip netns` keeps the namespaces it names.
+	netnsDir = "/run/netns"
+	// Inside a namespace, the tap device and the veth to the host, "eth0", are joined by "br0".
+	netnsBridge = "br0"
+	netnsVeth   = "eth0"
+)
+
+// NetnsName returns the network namespace of the tap device `name`.
+func NetnsName(name string) string {
+	return NetnsPrefix + name
+}
+
+// NetnsPath returns the file that keeps the network namespace `netns`.
+func NetnsPath(netns string) string {
+	return path.Join(netnsDir, netns)
+}
+
+// NetnsExists returns whether the network namespace `netns` exists.
+func NetnsExists(netns string) bool {
+	_, err := os.Stat(NetnsPath(netns))
+	return err == nil
+}
+
+// CreateNetns creates the network namespace `netns` with its loopback up. Returns false if it
+// already existed.
+func CreateNetns(netns string) (bool, error) {
+	if NetnsExists(netns) {
+		return false, nil
+	}
+	if output, err := exec.Command("ip", "netns", "add", netns).CombinedOutput(); err != nil {
+		return false, fmt.Errorf("failed to create network namespace %s: %s %w", netns, output, err)
+	}
+	if output, err := exec.Command("ip", "-n", netns, "l", "set", "lo", "up").CombinedOutput(); err != nil {
+		DeleteNetns(netns)
+		return false, fmt.Errorf("failed to up lo in %s: %s %w", netns, output, err)
+	}
+	return true, nil
+}
+
+// DeleteNetns deletes the network namespace `netns` along with the devices in it. It's not an
+// error if it doesn't exist. Processes in it keep it until they exit.
+func DeleteNetns(netns string) error {
+	if !NetnsExists(netns) {
+		return nil
+	}
+	if output, err := exec.Command("ip", "netns", "delete", netns).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete network namespace %s: %s %w", netns, output, err)
+	}
+	return nil
+}
+
+// ListNetns returns the network namespaces of tap devices.
+func ListNetns() ([]string, error) {
+	entries, err := os.ReadDir(netnsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network namespaces: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), NetnsPrefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// CreateTapDeviceIn is CreateTapDeviceOn with the tap device in the network namespace `netns`,
+// which is created if it doesn't exist. A veth pair links it to the host, where its end is named
+// like the tap device and attached to `bridge`, so that the host's rules for the tap device apply
+// to it unchanged. An empty `netns` creates the tap device on the host.
+func (f *Fountain) CreateTapDeviceIn(name string, bridge string, netns string) (*TapDevice, error) {
+	if netns == "" {
+		return f.CreateTapDeviceOn(name, bridge)
+	}
+	logger := log.WithFields(log.Fields{"action": "CreateTapDevice", "namespace": netns})
+	cleanup := cleanup.Make(func() {
+		logger.Debug("createTapDevice cleanup")
+	})
+	defer cleanup.Clean()
+
+	if err := f.claimName(name); err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		f.freeName(name)
+	})
+
+	created, err := CreateNetns(netns)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		cleanup.Add(func() {
+			if err := DeleteNetns(netns); err != nil {
+				logger.WithError(err).Errorf("failed to delete %s during cleanup", netns)
+			}
+		})
+	}
+
+	steps := [][]string{
+		{"-n", netns, "tuntap", "add", "dev", name, "mode", "tap"},
+		{"-n", netns, "l", "add", netnsBridge, "type", "bridge"},
+		{"l", "add", name, "type", "veth", "peer", "name", netnsVeth, "netns", netns},
+	}
+	for _, args := range steps {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to create: %v in %v: %s %w", name, netns, output, err)
+		}
+	}
+	// Deleting the host's end deletes the pair, the rest goes with the namespace.
+	cleanup.Add(func() {
+		if err := exec.Command("ip", "l", "del", name).Run(); err != nil {
+			logger.WithError(err).Errorf("failed to delete %s during cleanup", name)
+		}
+	})
+
+	steps = [][]string{
+		{"-n", netns, "l", "set", "dev", name, "master", netnsBridge},
+		{"-n", netns, "l", "set", "dev", netnsVeth, "master", netnsBridge},
+		{"-n", netns, "l", "set", netnsBridge, "up"},
+		{"-n", netns, "l", "set", name, "up"},
+		{"-n", netns, "l", "set", netnsVeth, "up"},
+	}
+	if bridge != "" {
+		steps = append(steps, []string{"l", "set", "dev", name, "master", bridge})
+	}
+	steps = append(steps, []string{"l", "set", name, "up"})
+	for _, args := range steps {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to set up: %v in %v: %s %w", name, netns, output, err)
+		}
+	}
+
+	cleanup.Release()
+	return &TapDevice{
+		Name:      name,
+		Namespace: netns,
+	}, nil
+}
+
+// destroyNamespacedTapDevice destroys the tap device `device` of a network namespace, the veth
+// linking it to the host and the namespace, and frees its name.
+func (f *Fountain) destroyNamespacedTapDevice(device *TapDevice) error {
+	if err := exec.Command("ip", "l", "show", device.Name).Run(); err == nil {
+		if output, err := exec.Command("ip", "l", "del", device.Name).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to delete %v: %s %w", device.Name, output, err)
+		}
+	}
+	if err := DeleteNetns(device.Namespace); err != nil {
+		return err
+	}
+	f.freeName(device.Name)
+	return nil
+}
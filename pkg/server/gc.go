@@ -0,0 +1,391 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const (
+	defaultGCInterval    = 10 * time.Minute
+	defaultGCGracePeriod = 15 * time.Minute
+)
+
+// Kinds of orphaned resources.
+const (
+	orphanTapDevice   = "tap_device"
+	orphanHypervisor  = "hypervisor"
+	orphanSocket      = "socket"
+	orphanVMStateDir  = "vm_state_dir"
+	orphanSnapshotDir = "snapshot_dir"
+	orphanEgressRules = "egress_rules"
+	orphanNetns       = "network_namespace"
+)
+
+// orphan is a resource that no VM or snapshot accounts for.
+type orphan struct {
+	kind   string
+	name   string
+	detail string
+	// Removes the resource.
+	reclaim func() error
+}
+
+// gcKnown is what the VMs of the server use, as of the start of a garbage collection.
+type gcKnown struct {
+	pids      map[int]bool
+	stateDirs map[string]bool
+	sockets   map[string]bool
+}
+
+// gcSettings returns how often to search for orphaned resources, and how old they have to be.
+func (s *Server) gcSettings() (time.Duration, time.Duration) {
+	cfg := s.Config().GC
+	interval, grace := cfg.Interval, cfg.GracePeriod
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	if grace <= 0 {
+		grace = defaultGCGracePeriod
+	}
+	return interval, grace
+}
+
+// runGarbageCollector searches for orphaned resources every GC interval, forever, and reclaims
+// them if the config says so.
+func (s *Server) runGarbageCollector() {
+	for {
+		interval, _ := s.gcSettings()
+		time.Sleep(interval)
+		s.CollectGarbage(s.Config().GC.Reclaim)
+	}
+}
+
+// CollectGarbage returns the resources no VM or snapshot accounts for: tap devices, their egress
+// rules and network namespaces, hypervisor processes, state directories and socket files of VMs,
+// and incomplete snapshot directories. With `reclaim` it also removes them, hypervisors first so
+// that nothing uses the rest anymore.
+func (s *Server) CollectGarbage(reclaim bool) *serverapi.GarbageCollectionReport {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+
+	_, grace := s.gcSettings()
+	stateDir := s.Config().StateDir
+	now := time.Now()
+	known := s.knownResources()
+
+	var orphans []orphan
+	orphans = append(orphans, findOrphanedHypervisors(stateDir, known, now.Add(-grace))...)
+	orphans = append(orphans, s.findOrphanedTapDevices()...)
+	orphans = append(orphans, s.findOrphanedEgressRules()...)
+	orphans = append(orphans, s.findOrphanedNetns(now.Add(-grace))...)
+	orphans = append(orphans, findOrphanedSockets(known, now.Add(-grace))...)
+	orphans = append(orphans, findOrphanedVMStateDirs(stateDir, known, now.Add(-grace))...)
+	orphans = append(orphans, findOrphanedSnapshotDirs(stateDir, now.Add(-grace))...)
+
+	report := &serverapi.GarbageCollectionReport{
+		Time:      serverapi.PtrTime(now.UTC()),
+		Reclaim:   serverapi.PtrBool(reclaim),
+		Resources: make([]serverapi.OrphanedResource, 0, len(orphans)),
+	}
+	for _, o := range orphans {
+		resource := serverapi.OrphanedResource{
+			Kind:      serverapi.PtrString(o.kind),
+			Name:      serverapi.PtrString(o.name),
+			Detail:    serverapi.PtrString(o.detail),
+			Reclaimed: serverapi.PtrBool(false),
+		}
+		logger := log.WithFields(log.Fields{"kind": o.kind, "name": o.name, "detail": o.detail})
+		if !reclaim {
+			logger.Warn("found orphaned resource")
+		} else if err := o.reclaim(); err != nil {
+			logger.WithError(err).Error("failed to reclaim orphaned resource")
+			resource.SetError(err.Error())
+		} else {
+			logger.Info("reclaimed orphaned resource")
+			resource.SetReclaimed(true)
+			// The IPs of a VM are kept across restarts for as long as its state dir is there.
+			if o.kind == orphanVMStateDir {
+				if err := s.ipAllocator.FreeOwner(o.name); err != nil {
+					logger.WithError(err).Warn("failed to free IPs of orphaned state dir")
+				}
+			}
+		}
+		report.Resources = append(report.Resources, resource)
+	}
+	return report
+}
+
+// knownResources returns the hypervisors, state directories and socket files of the VMs, including
+// the ones being received from other hosts.
+func (s *Server) knownResources() gcKnown {
+	known := gcKnown{
+		pids:      make(map[int]bool),
+		stateDirs: make(map[string]bool),
+		sockets:   make(map[string]bool),
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	vms := make([]*vm, 0, len(s.vms)+len(s.incomingMigrations))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	for _, m := range s.incomingMigrations {
+		vms = append(vms, m.vm)
+	}
+	for _, vm := range vms {
+		if vm.process != nil {
+			known.pids[vm.process.Pid] = true
+		}
+		known.stateDirs[path.Clean(vm.stateDirPath)] = true
+		for _, forward := range vm.socketForwards {
+			known.sockets[forward.hostPath] = true
+		}
+	}
+	return known
+}
+
+// findOrphanedHypervisors returns the cloud-hypervisor processes with an API socket in `stateDir`
+// that aren't of a VM. Hypervisors this server spawned for VMs that are still being created count
+// only once they're older than `cutoff`.
+func findOrphanedHypervisors(stateDir string, known gcKnown, cutoff time.Time) []orphan {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		log.WithError(err).Warn("failed to list processes")
+		return nil
+	}
+	prefix := path.Clean(stateDir) + "/"
+	var orphans []orphan
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || known.pids[pid] {
+			continue
+		}
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		apiSocket := ""
+		for i, arg := range args[:len(args)-1] {
+			if arg == "--api-socket" {
+				apiSocket = args[i+1]
+			}
+		}
+		if !strings.HasPrefix(apiSocket, prefix) {
+			continue
+		}
+		ours := parentPID(pid) == os.Getpid()
+		if info, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); ours && (err != nil || info.ModTime().After(cutoff)) {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:   orphanHypervisor,
+			name:   strconv.Itoa(pid),
+			detail: apiSocket,
+			reclaim: func() error {
+				if !ours {
+					return syscall.Kill(pid, syscall.SIGKILL)
+				}
+				process, _ := os.FindProcess(pid)
+				if err := process.Kill(); err != nil {
+					return err
+				}
+				go process.Wait()
+				return nil
+			},
+		})
+	}
+	return orphans
+}
+
+// parentPID returns the parent of process `pid`, 0 if it's gone.
+func parentPID(pid int) int {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// Fields after the command name, which can contain spaces, start with the state.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
+
+// findOrphanedTapDevices returns the tap devices named like the server's that it didn't create.
+// Devices are claimed before they're created and destroyed before they're released, so no grace
+// period is needed.
+func (s *Server) findOrphanedTapDevices() []orphan {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		log.WithError(err).Warn("failed to list interfaces")
+		return nil
+	}
+	var orphans []orphan
+	for _, iface := range interfaces {
+		if !isServerTapDevice(iface.Name) || s.fountain.InUse(iface.Name) {
+			continue
+		}
+		name := iface.Name
+		orphans = append(orphans, orphan{
+			kind:   orphanTapDevice,
+			name:   name,
+			detail: iface.HardwareAddr.String(),
+			reclaim: func() error {
+				if output, err := exec.Command("ip", "link", "delete", name).CombinedOutput(); err != nil {
+					return fmt.Errorf("%w: %s", err, output)
+				}
+				return nil
+			},
+		})
+	}
+	return orphans
+}
+
+// findOrphanedEgressRules returns the egress rules of tap devices that no VM uses.
+func (s *Server) findOrphanedEgressRules() []orphan {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil
+	}
+	tapDevices, err := listEgressTables()
+	if err != nil {
+		log.WithError(err).Warn("failed to list egress rules")
+		return nil
+	}
+	var orphans []orphan
+	for _, tapDevice := range tapDevices {
+		if s.fountain.InUse(tapDevice) {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:   orphanEgressRules,
+			name:   egressTablePrefix + tapDevice,
+			detail: tapDevice,
+			reclaim: func() error {
+				return deleteEgressRules(tapDevice)
+			},
+		})
+	}
+	return orphans
+}
+
+// findOrphanedSockets returns the host sockets in the socket forwards directories of the VMs that
+// no forward listens on anymore.
+func findOrphanedSockets(known gcKnown, cutoff time.Time) []orphan {
+	var orphans []orphan
+	for stateDir := range known.stateDirs {
+		dir := path.Join(stateDir, socketForwardsDirname)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			p := path.Join(dir, entry.Name())
+			if entry.Type()&os.ModeSocket == 0 || known.sockets[p] || lastModified(p).After(cutoff) {
+				continue
+			}
+			orphans = append(orphans, orphan{
+				kind:    orphanSocket,
+				name:    p,
+				detail:  "no socket forward listens on it",
+				reclaim: func() error { return os.Remove(p) },
+			})
+		}
+	}
+	return orphans
+}
+
+// findOrphanedVMStateDirs returns the VM state directories of `stateDir` that belong to no VM.
+func findOrphanedVMStateDirs(stateDir string, known gcKnown, cutoff time.Time) []orphan {
+	dir := path.Join(stateDir, vmsDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var orphans []orphan
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if !entry.IsDir() || known.stateDirs[p] || lastModified(p).After(cutoff) {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:    orphanVMStateDir,
+			name:    p,
+			detail:  "belongs to no VM",
+			reclaim: func() error { return os.RemoveAll(p) },
+		})
+	}
+	return orphans
+}
+
+// findOrphanedSnapshotDirs returns what's left of snapshots that were never completed: directories
+// without the VM config cloud-hypervisor writes, and the temporary files of imports and
+// compactions.
+func findOrphanedSnapshotDirs(stateDir string, cutoff time.Time) []orphan {
+	dir := path.Join(stateDir, "snapshots")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var orphans []orphan
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if lastModified(p).After(cutoff) {
+			continue
+		}
+		detail := ""
+		if strings.HasPrefix(entry.Name(), ".") {
+			detail = "left over from an import or compaction"
+		} else if _, err := os.Stat(path.Join(p, "config.json")); entry.IsDir() && os.IsNotExist(err) {
+			detail = "incomplete snapshot"
+		} else {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:    orphanSnapshotDir,
+			name:    p,
+			detail:  detail,
+			reclaim: func() error { return os.RemoveAll(p) },
+		})
+	}
+	return orphans
+}
+
+// lastModified returns when `p`, or if it's a directory any of its entries, was last modified. Zero
+// if it's gone.
+func lastModified(p string) time.Time {
+	info, err := os.Stat(p)
+	if err != nil {
+		return time.Time{}
+	}
+	latest := info.ModTime()
+	if !info.IsDir() {
+		return latest
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return latest
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"math/rand/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// No vowels, so that suffixes don't spell words, and no characters that are easy to confuse.
+	generatedNameAlphabet = "bcdfghjklmnpqrstvwxz2456789"
+	// Length of the suffix `GenerateVMName` appends.
+	GeneratedNameLength = 5
+	// Attempts before giving up on finding a free name, which only happens if the prefix's names
+	// are nearly used up.
+	generateNameAttempts = 16
+)
+
+// nameClaimKey is the context key of the VM name a create holds, see `claimVMName`.
+type nameClaimKey struct{}
+
+// GenerateVMName returns an unused name for a new VM in `namespace` made of `prefix` and a random
+// suffix, e.g. "test-" gives "test-x7k2p". The name is held until `release` is called, which should
+// happen once the VM exists or failed to start, so that parallel starts can't be handed the same
+// name. Only creates given the returned context can use it.
+func (s *Server) GenerateVMName(ctx context.Context, namespace string, prefix string) (_ context.Context, name string, release func(), err error) {
+	if err := ValidateVMNamePrefix(prefix, GeneratedNameLength); err != nil {
+		return nil, "", nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for range generateNameAttempts {
+		suffix := make([]byte, GeneratedNameLength)
+		for i := range suffix {
+			suffix[i] = generatedNameAlphabet[rand.IntN(len(generatedNameAlphabet))]
+		}
+		name := prefix + string(suffix)
+		qualifiedName := QualifiedName(namespace, name)
+		if _, ok := s.vms[qualifiedName]; ok || s.reservedNames[qualifiedName] {
+			continue
+		}
+		ctx, release := s.reserveVMNameLocked(ctx, qualifiedName)
+		return ctx, name, release, nil
+	}
+	return nil, "", nil, status.Errorf(codes.AlreadyExists, "no free vm name with prefix %q", prefix)
+}
+
+// claimVMName holds the qualified `vmName` for the VM created with `ctx` until `release` is called,
+// failing if another start, fork, restore or migration is creating a VM of that name, or
+// `GenerateVMName` handed it to another request. Creates with the returned context, or with a
+// context the name was generated with, hold it already.
+func (s *Server) claimVMName(ctx context.Context, vmName string) (_ context.Context, release func(), err error) {
+	if held, _ := ctx.Value(nameClaimKey{}).(string); held == vmName {
+		return ctx, func() {}, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.reservedNames[vmName] {
+		return nil, nil, status.Errorf(codes.AlreadyExists, "vm %s is being created", vmName)
+	}
+	ctx, release = s.reserveVMNameLocked(ctx, vmName)
+	return ctx, release, nil
+}
+
+// reserveVMNameLocked holds `vmName` for `ctx`. Must be called with `s.lock` held.
+func (s *Server) reserveVMNameLocked(ctx context.Context, vmName string) (context.Context, func()) {
+	s.reservedNames[vmName] = true
+	release := func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.reservedNames, vmName)
+	}
+	return context.WithValue(ctx, nameClaimKey{}, vmName), release
+}
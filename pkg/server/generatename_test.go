@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newNamingServer() *Server {
+	return &Server{vms: make(map[string]*vm), reservedNames: make(map[string]bool)}
+}
+
+func TestClaimVMName(t *testing.T) {
+	s := newNamingServer()
+	ctx := context.Background()
+
+	genCtx, name, releaseGenerated, err := s.GenerateVMName(ctx, "", "test-")
+	if err != nil {
+		t.Fatalf("GenerateVMName() error = %v", err)
+	}
+	if !strings.HasPrefix(name, "test-") || len(name) != len("test-")+GeneratedNameLength {
+		t.Fatalf("GenerateVMName() = %q", name)
+	}
+	claimedCtx, releaseFoo, err := s.claimVMName(ctx, "foo")
+	if err != nil {
+		t.Fatalf("claimVMName(foo) error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		vmName  string
+		wantErr bool
+	}{
+		{name: "generated name by another request", ctx: ctx, vmName: name, wantErr: true},
+		{name: "generated name by its request", ctx: genCtx, vmName: name},
+		{name: "claimed name by another request", ctx: ctx, vmName: "foo", wantErr: true},
+		{name: "claimed name by another generated request", ctx: genCtx, vmName: "foo", wantErr: true},
+		{name: "claimed name by its create", ctx: claimedCtx, vmName: "foo"},
+		{name: "free name", ctx: ctx, vmName: "bar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, release, err := s.claimVMName(tt.ctx, tt.vmName)
+			if tt.wantErr {
+				if status.Code(err) != codes.AlreadyExists {
+					t.Fatalf("claimVMName(%s) error = %v, want AlreadyExists", tt.vmName, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("claimVMName(%s) error = %v", tt.vmName, err)
+			}
+			release()
+		})
+	}
+
+	// Claims by their holders don't release them early.
+	if _, _, err := s.claimVMName(ctx, "foo"); err == nil {
+		t.Error("claimVMName(foo) succeeded while foo is held")
+	}
+	releaseFoo()
+	releaseGenerated()
+	for _, vmName := range []string{"foo", name} {
+		if _, _, err := s.claimVMName(ctx, vmName); err != nil {
+			t.Errorf("claimVMName(%s) after release error = %v", vmName, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+)
+
+const maxTmpfsMounts = 8
+
+// guestMemory is the tmpfs and swap the guest sets up at boot.
+type guestMemory struct {
+	tmpfs     []guesttuning.Tmpfs
+	swapBytes int64
+}
+
+// newGuestMemory returns the tmpfs and swap of a VM of `template`, with the tmpfs and swap its start
+// asked for, `tmpfs` and `swapBytes`, in place of the template's. Returns nil if there are none.
+func (s *Server) newGuestMemory(template string, tmpfs []serverapi.TmpfsMount, swapBytes *int64) (*guestMemory, error) {
+	tmpl, _ := s.templateConfig(strings.ToLower(template))
+	memory, err := templateGuestMemory(tmpl)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "invalid template %s: %v", template, err)
+	}
+	if memory == nil {
+		memory = &guestMemory{}
+	}
+	for _, t := range tmpfs {
+		mount := guesttuning.Tmpfs{Path: t.GetPath(), SizeBytes: t.GetSizeBytes()}
+		if err := guesttuning.ValidateTmpfs(mount); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		memory.setTmpfs(mount)
+	}
+	if len(memory.tmpfs) > maxTmpfsMounts {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d tmpfs can be mounted", maxTmpfsMounts)
+	}
+	if swapBytes != nil {
+		if *swapBytes < 0 || *swapBytes%4096 != 0 {
+			return nil, status.Error(codes.InvalidArgument, "swapSizeBytes must be a multiple of 4096, or 0 for no swap")
+		}
+		memory.swapBytes = *swapBytes
+	}
+	if len(memory.tmpfs) == 0 && memory.swapBytes == 0 {
+		return nil, nil
+	}
+	return memory, nil
+}
+
+// templateGuestMemory returns the tmpfs and swap of the VMs of `tmpl`, nil if it has none.
+func templateGuestMemory(tmpl config.TemplateConfig) (*guestMemory, error) {
+	if len(tmpl.Tmpfs) == 0 && tmpl.SwapMB == 0 {
+		return nil, nil
+	}
+	memory := &guestMemory{swapBytes: tmpl.SwapMB << 20}
+	for _, t := range tmpl.Tmpfs {
+		mount, err := guesttuning.ParseTmpfs(t)
+		if err != nil {
+			return nil, err
+		}
+		memory.setTmpfs(mount)
+	}
+	if len(memory.tmpfs) > maxTmpfsMounts {
+		return nil, fmt.Errorf("at most %d tmpfs can be mounted", maxTmpfsMounts)
+	}
+	if memory.swapBytes < 0 {
+		return nil, fmt.Errorf("swap_mb can't be negative")
+	}
+	return memory, nil
+}
+
+// setTmpfs adds `mount`, replacing the tmpfs on its path if there's one.
+func (m *guestMemory) setTmpfs(mount guesttuning.Tmpfs) {
+	if i := slices.IndexFunc(m.tmpfs, func(t guesttuning.Tmpfs) bool { return t.Path == mount.Path }); i >= 0 {
+		m.tmpfs[i] = mount
+		return
+	}
+	m.tmpfs = append(m.tmpfs, mount)
+}
+
+// cmdline returns the guest's kernel command line keys for `m`.
+func (m *guestMemory) cmdline() string {
+	if m == nil {
+		return ""
+	}
+	var args []string
+	if len(m.tmpfs) > 0 {
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.TmpfsCmdlineKey, guesttuning.EncodeTmpfs(m.tmpfs)))
+	}
+	if m.swapBytes > 0 {
+		args = append(args, fmt.Sprintf("%s=\"%d\"", guesttuning.SwapCmdlineKey, m.swapBytes))
+	}
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// Free space the state and rootfs directories need for the deep health check to pass, unless
+// configured.
+const defaultHealthMinFreeDiskMB = 1024
+
+// Written and removed in the state dir to check that it can be written to.
+const healthProbeFileName = ".health-probe"
+
+// DeepHealth checks the host's dependencies one by one: KVM, the bridge, free disk space in the
+// state and rootfs directories, the guest agent of the sentinel VM if one is configured, and the
+// state dir itself. Every check runs even if earlier ones failed, so that callers can tell the
+// failures apart.
+func (s *Server) DeepHealth() *serverapi.DeepHealthResponse {
+	cfg := s.Config()
+	minFreeMB := cfg.Health.MinFreeDiskMB
+	if minFreeMB <= 0 {
+		minFreeMB = defaultHealthMinFreeDiskMB
+	}
+	rootfsDir := path.Join(cfg.StateDir, imageCacheDirName)
+	if u, err := url.Parse(cfg.RootfsPath); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		rootfsDir = path.Dir(cfg.RootfsPath)
+	}
+
+	type check struct {
+		name string
+		run  func() (string, error)
+	}
+	toRun := []check{
+		{"kvm", checkKVM},
+		{"bridge", func() (string, error) { return checkBridgeUp(cfg.BridgeName) }},
+		{"disk.state_dir", func() (string, error) { return checkFreeDisk(cfg.StateDir, minFreeMB) }},
+		{"disk.rootfs", func() (string, error) { return checkFreeDisk(rootfsDir, minFreeMB) }},
+	}
+	if cfg.Health.SentinelVM != "" {
+		toRun = append(toRun, check{"sentinel_vm", func() (string, error) { return s.checkSentinelVM(cfg.Health.SentinelVM) }})
+	}
+	toRun = append(toRun, check{"state_store", func() (string, error) { return checkStateStore(cfg.StateDir) }})
+
+	checks := make([]serverapi.HealthCheck, 0, len(toRun))
+	for _, c := range toRun {
+		message, err := c.run()
+		checks = append(checks, healthCheck(c.name, message, err))
+	}
+
+	healthy := true
+	for _, check := range checks {
+		healthy = healthy && check.GetHealthy()
+	}
+	return &serverapi.DeepHealthResponse{
+		Healthy: serverapi.PtrBool(healthy),
+		Checks:  checks,
+	}
+}
+
+// healthCheck converts the outcome of the check `name`, which passed if `err` is nil.
+func healthCheck(name string, message string, err error) serverapi.HealthCheck {
+	check := serverapi.HealthCheck{
+		Name:    serverapi.PtrString(name),
+		Healthy: serverapi.PtrBool(err == nil),
+	}
+	if err != nil {
+		message = err.Error()
+	}
+	check.SetMessage(message)
+	return check
+}
+
+func checkKVM() (string, error) {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("can't open /dev/kvm: %v", err)
+	}
+	f.Close()
+	return "/dev/kvm is accessible", nil
+}
+
+// checkBridgeUp checks that the bridge exists and is up. A bridge without VMs has no carrier, so
+// only its administrative state counts.
+func checkBridgeUp(bridgeName string) (string, error) {
+	iface, err := net.InterfaceByName(bridgeName)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", bridgeName, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return "", fmt.Errorf("%s is down", bridgeName)
+	}
+	return fmt.Sprintf("%s is up", bridgeName), nil
+}
+
+func checkFreeDisk(dir string, minFreeMB int) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return "", fmt.Errorf("%s: %v", dir, err)
+	}
+	freeMB := fs.Bavail * uint64(fs.Bsize) / (1024 * 1024)
+	if freeMB < uint64(minFreeMB) {
+		return "", fmt.Errorf("%s has %d MB free, less than %d MB", dir, freeMB, minFreeMB)
+	}
+	return fmt.Sprintf("%s has %d MB free", dir, freeMB), nil
+}
+
+// checkSentinelVM checks that the guest agent of the VM `vmName` answers, which exercises the
+// bridge, the tap devices and the guests end to end.
+func (s *Server) checkSentinelVM(vmName string) (string, error) {
+	s.lock.RLock()
+	vm, ok := s.vms[vmName]
+	running := ok && vm.status == vmStatusRunning
+	s.lock.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%s doesn't exist", vmName)
+	}
+	if !running {
+		return "", fmt.Errorf("%s isn't running", vmName)
+	}
+	if err := s.pingAgent(vm); err != nil {
+		return "", fmt.Errorf("guest agent of %s doesn't answer: %v", vmName, err)
+	}
+	return fmt.Sprintf("guest agent of %s answers", vmName), nil
+}
+
+// checkStateStore checks that the state dir can be written to and is in the format this server
+// reads.
+func checkStateStore(stateDir string) (string, error) {
+	probe := path.Join(stateDir, healthProbeFileName)
+	f, err := os.Create(probe)
+	if err != nil {
+		return "", fmt.Errorf("%s isn't writable: %v", stateDir, err)
+	}
+	_, err = f.WriteString("ok")
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	os.Remove(probe)
+	if err != nil {
+		return "", fmt.Errorf("can't write to %s: %v", stateDir, err)
+	}
+	version, latest, err := StateDirVersion(stateDir)
+	if err != nil {
+		return "", err
+	}
+	if version != latest {
+		return "", fmt.Errorf("%s is at format version %d, not %d", stateDir, version, latest)
+	}
+	return fmt.Sprintf("%s is writable, format version %d", stateDir, version), nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// Lifecycle transitions hooks run at.
+const (
+	hookPreStart   = "pre_start"
+	hookPostBoot   = "post_boot"
+	hookPreDestroy = "pre_destroy"
+)
+
+const defaultHookTimeout = time.Minute
+
+// Output of a failed hook kept in its error.
+const maxHookErrorOutput = 1024
+
+// hook is a command run at a lifecycle transition of a VM.
+type hook struct {
+	event   string
+	command string
+	// Run in the guest rather than on the host.
+	guest   bool
+	timeout time.Duration
+}
+
+// validateHook checks that a hook runs at a known transition, and in the guest only once there is
+// one.
+func validateHook(event string, command string, guest bool) error {
+	switch event {
+	case hookPreStart, hookPostBoot, hookPreDestroy:
+	default:
+		return fmt.Errorf("hook event must be pre_start, post_boot or pre_destroy, not %q", event)
+	}
+	if strings.TrimSpace(command) == "" {
+		return fmt.Errorf("%s hook has no command", event)
+	}
+	if guest && event == hookPreStart {
+		return fmt.Errorf("pre_start hooks can't run in the guest, it isn't up yet")
+	}
+	return nil
+}
+
+// hooksFromConfig returns the hooks every VM runs. They were validated with the config.
+func hooksFromConfig(cfgs []config.HookConfig) []hook {
+	hooks := make([]hook, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		hooks = append(hooks, hook{
+			event:   cfg.Event,
+			command: cfg.Command,
+			guest:   cfg.Guest,
+			timeout: cfg.Timeout,
+		})
+	}
+	return hooks
+}
+
+// newHooks validates the hooks of a start. Host hooks run as root, so they need api_host_hooks set,
+// auth enabled and an admin caller.
+func (s *Server) newHooks(ctx context.Context, requested []serverapi.LifecycleHook) ([]hook, error) {
+	var hooks []hook
+	for _, h := range requested {
+		if err := validateHook(h.GetEvent(), h.GetCommand(), h.GetGuest()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if h.GetTimeoutSeconds() < 0 {
+			return nil, status.Error(codes.InvalidArgument, "hook timeoutSeconds can't be negative")
+		}
+		if !h.GetGuest() {
+			if err := s.checkHostHook(ctx); err != nil {
+				return nil, err
+			}
+		}
+		hooks = append(hooks, hook{
+			event:   h.GetEvent(),
+			command: h.GetCommand(),
+			guest:   h.GetGuest(),
+			timeout: time.Duration(h.GetTimeoutSeconds()) * time.Second,
+		})
+	}
+	return hooks, nil
+}
+
+// checkHostHook returns an error unless the caller may add a host hook to a start.
+func (s *Server) checkHostHook(ctx context.Context) error {
+	if !s.Config().APIHostHooks {
+		return status.Error(codes.PermissionDenied, "host hooks aren't allowed in requests, see api_host_hooks")
+	}
+	if !s.AuthEnabled() {
+		return status.Error(codes.PermissionDenied, "host hooks aren't allowed in requests while auth is disabled")
+	}
+	if id := auth.FromContext(ctx); id == nil || !id.Has(auth.PermissionAdmin) {
+		return status.Error(codes.PermissionDenied, "only admins can run hooks on the host")
+	}
+	return nil
+}
+
+// setVMHooks gives the VM `vmName`, which was just started, the hooks it was started with.
+func (s *Server) setVMHooks(vmName string, hooks []hook) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.hooks = hooks
+	}
+}
+
+// vmHooks returns the hooks the VM `vmName` was started with.
+func (s *Server) vmHooks(vmName string) []hook {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if vm, ok := s.vms[vmName]; ok {
+		return vm.hooks
+	}
+	return nil
+}
+
+// runHooks runs the hooks for `event` of the server config, then `vmHooks`, one after the other.
+// Host hooks run with bash and get the hook, the VM's name and, once it exists, its IP and state
+// dir in ARRAKIS_* environment variables; guest hooks run through the guest agent, resuming the VM
+// if it's suspended for being idle. A failed pre_start hook stops the rest, other hooks all run.
+// Failures are published as `vm.hook_failed` and returned.
+func (s *Server) runHooks(ctx context.Context, event string, vmName string, vmHooks []hook) error {
+	var hooks []hook
+	for _, h := range append(hooksFromConfig(s.Config().Hooks), vmHooks...) {
+		if h.event == event {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	env := map[string]string{
+		"ARRAKIS_HOOK":    event,
+		"ARRAKIS_VM_NAME": vmName,
+	}
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		env["ARRAKIS_VM_IP"] = vm.ip.IP.String()
+		env["ARRAKIS_VM_STATE_DIR"] = vm.stateDirPath
+	}
+
+	var errs error
+	for _, h := range hooks {
+		logger := log.WithFields(log.Fields{
+			"vmName":  vmName,
+			"hook":    event,
+			"command": h.command,
+			"guest":   h.guest,
+		})
+		timeout := h.timeout
+		if timeout <= 0 {
+			timeout = defaultHookTimeout
+		}
+		var err error
+		if h.guest {
+			err = s.runGuestHook(ctx, vmName, h.command, env, timeout)
+		} else {
+			err = runHostHook(ctx, h.command, env, timeout)
+		}
+		if err == nil {
+			logger.Info("ran hook")
+			continue
+		}
+		logger.WithError(err).Error("hook failed")
+		s.events.Publish(events.VMHookFailed, vmName, map[string]string{
+			"hook":    event,
+			"command": h.command,
+			"error":   err.Error(),
+		})
+		err = fmt.Errorf("%s hook %q failed: %w", event, h.command, err)
+		if event == hookPreStart {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		errs = errors.Join(errs, err)
+	}
+	return errs
+}
+
+func runHostHook(ctx context.Context, command string, env map[string]string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, truncateHookOutput(string(output)))
+	}
+	return nil
+}
+
+func (s *Server) runGuestHook(ctx context.Context, vmName string, command string, env map[string]string, timeout time.Duration) error {
+	release, err := s.WakeVM(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	defer release()
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return fmt.Errorf("vm %s not found", vmName)
+	}
+	req := cmdserver.RunCmdRequest{
+		Cmd:            command,
+		Blocking:       true,
+		Env:            env,
+		TimeoutSeconds: timeoutSeconds(timeout),
+	}
+	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	resp, err := vm.handleRun(ctx, s.agentClient(timeout+commandGrace), url, req)
+	if err != nil {
+		return err
+	}
+	if resp.GetError() != "" {
+		return errors.New(resp.GetError())
+	}
+	if resp.GetExitCode() != 0 {
+		return fmt.Errorf("exited with %d: %s", resp.GetExitCode(), truncateHookOutput(resp.GetOutput()))
+	}
+	return nil
+}
+
+func truncateHookOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > maxHookErrorOutput {
+		output = "..." + output[len(output)-maxHookErrorOutput:]
+	}
+	return output
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+func TestNewHooks(t *testing.T) {
+	adminKeys := []config.APIKeyConfig{{Name: "ops", Key: "secret", Admin: true}}
+	admin := auth.WithIdentity(context.Background(), &auth.Identity{Name: "ops", Permissions: []string{auth.PermissionAdmin}})
+	user := auth.WithIdentity(context.Background(), &auth.Identity{Name: "ci", Permissions: []string{auth.PermissionRead, auth.PermissionWrite}})
+	hostHook := serverapi.LifecycleHook{Event: serverapi.PtrString(hookPostBoot), Command: serverapi.PtrString("register-dns")}
+	guestHook := serverapi.LifecycleHook{Event: serverapi.PtrString(hookPostBoot), Command: serverapi.PtrString("true"), Guest: serverapi.PtrBool(true)}
+
+	tests := []struct {
+		name         string
+		apiHostHooks bool
+		apiKeys      []config.APIKeyConfig
+		ctx          context.Context
+		hook         serverapi.LifecycleHook
+		wantCode     codes.Code
+	}{
+		{name: "host hook by an admin", apiHostHooks: true, apiKeys: adminKeys, ctx: admin, hook: hostHook, wantCode: codes.OK},
+		{name: "host hook without opting in", apiKeys: adminKeys, ctx: admin, hook: hostHook, wantCode: codes.PermissionDenied},
+		{name: "host hook without auth", apiHostHooks: true, ctx: context.Background(), hook: hostHook, wantCode: codes.PermissionDenied},
+		{name: "host hook by a user", apiHostHooks: true, apiKeys: adminKeys, ctx: user, hook: hostHook, wantCode: codes.PermissionDenied},
+		{name: "guest hook without auth", ctx: context.Background(), hook: guestHook, wantCode: codes.OK},
+		{name: "guest hook by a user", apiKeys: adminKeys, ctx: user, hook: guestHook, wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				config:  config.ServerConfig{APIHostHooks: tt.apiHostHooks, Auth: config.AuthConfig{APIKeys: tt.apiKeys}},
+				apiKeys: new(auth.Store),
+			}
+			hooks, err := s.newHooks(tt.ctx, []serverapi.LifecycleHook{tt.hook})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("newHooks() error = %v, want %v", err, tt.wantCode)
+			}
+			if err == nil && len(hooks) != 1 {
+				t.Errorf("newHooks() = %v, want 1 hook", hooks)
+			}
+		})
+	}
+}
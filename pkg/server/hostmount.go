@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/guestfs"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
+)
+
+const (
+	hostMountsDirName = "mounts"
+	defaultGuestPath  = "/"
+)
+
+// MountVMFilesystem mounts `guestPath` from the VM read-only on the host, under the state
+// directory. Only one mount per VM is supported at a time.
+func (s *Server) MountVMFilesystem(ctx context.Context, vmName string, guestPath string) (_ *serverapi.VmMountResponse, retErr error) {
+	if guestPath == "" {
+		guestPath = defaultGuestPath
+	}
+
+	_, span := tracing.Start(
+		ctx,
+		"server.MountVMFilesystem",
+		tracing.String("vm.name", vmName),
+		tracing.String("guest.path", guestPath),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+
+	cfg := s.Config().HostMounts
+	if !cfg.Enabled {
+		return nil, status.Error(codes.PermissionDenied, "host mounts are disabled")
+	}
+	if !path.IsAbs(guestPath) {
+		return nil, status.Errorf(codes.InvalidArgument, "guest path must be absolute: %s", guestPath)
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	if vm.status != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, not running", vmName, vm.status)
+	}
+	if vm.hostMount != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s is already mounted at %s", vmName, vm.hostMount.Mountpoint)
+	}
+
+	mountpoint := path.Join(s.config.StateDir, hostMountsDirName, vmName)
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create mountpoint: %v", err)
+	}
+
+	cmdServerURL := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	mount, err := guestfs.NewMount(cmdServerURL, guestPath, mountpoint, cfg.AllowOther)
+	if err != nil {
+		os.Remove(mountpoint)
+		return nil, status.Errorf(codes.Internal, "failed to mount vm filesystem: %v", err)
+	}
+	vm.hostMount = mount
+
+	log.WithFields(log.Fields{
+		"vmName":     vmName,
+		"guestPath":  mount.GuestPath,
+		"mountpoint": mountpoint,
+	}).Info("mounted VM filesystem on host")
+	return &serverapi.VmMountResponse{
+		MountPath: serverapi.PtrString(mountpoint),
+		GuestPath: serverapi.PtrString(mount.GuestPath),
+	}, nil
+}
+
+// UnmountVMFilesystem undoes `MountVMFilesystem`.
+func (s *Server) UnmountVMFilesystem(ctx context.Context, vmName string) (*serverapi.VMResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	if vm.hostMount == nil {
+		return nil, status.Errorf(codes.NotFound, "vm %s is not mounted", vmName)
+	}
+	if err := vm.unmountHostFilesystem(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
+
+// unmountHostFilesystem removes the VM's host mount, if any. Must be called with `v.lock` held.
+func (v *vm) unmountHostFilesystem() error {
+	if v.hostMount == nil {
+		return nil
+	}
+	if err := v.hostMount.Unmount(); err != nil {
+		return err
+	}
+	if err := os.Remove(v.hostMount.Mountpoint); err != nil {
+		log.WithError(err).Warnf("failed to remove mountpoint: %s", v.hostMount.Mountpoint)
+	}
+	log.WithField("vmName", v.name).Info("unmounted VM filesystem from host")
+	v.hostMount = nil
+	return nil
+}
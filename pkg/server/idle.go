@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// What the idle suspender does with idle VMs.
+const (
+	idleActionPause    = "pause"
+	idleActionSnapshot = "snapshot"
+)
+
+const defaultIdleCheckInterval = 30 * time.Second
+
+// hibernatedVM is a VM the idle suspender snapshotted and stopped. It's restored from the
+// snapshot under its name, with what it had, on the next call into its guest.
+type hibernatedVM struct {
+	snapshotID string
+	// Kept reserved so that the VM gets them back.
+	ip  *net.IPNet
+	mac string
+	cid uint32
+
+	owner            string
+	sessionToken     string
+	labels           map[string]string
+	snapshotPolicies []*snapshotPolicy
+	restart          *restartSpec
+	disconnect       *disconnectPolicy
+	oomPolicy        oomPolicy
+	oomKills         int32
+	lastOOMKill      *oomKill
+	hooks            []hook
+	egress           *egressPolicy
+	networkLimit     *networkLimit
+	restarts         int32
+	startedAt        time.Time
+	lastActivity     time.Time
+}
+
+// idleSettings returns how long VMs may go without calls into their guest, 0 if they're never
+// suspended, what to do with them then and how often to check.
+func (s *Server) idleSettings() (time.Duration, string, time.Duration) {
+	cfg := s.Config().Idle
+	action, interval := cfg.Action, cfg.CheckInterval
+	if action == "" {
+		action = idleActionPause
+	}
+	if interval <= 0 {
+		interval = defaultIdleCheckInterval
+	}
+	return cfg.Timeout, action, interval
+}
+
+// WakeVM records a call into the guest of the VM `vmName`, resuming the VM first if the idle
+// suspender paused or hibernated it. The VM isn't idle until the returned function is called, at
+// the end of the call. VMs that don't exist are left to the operation to report.
+func (s *Server) WakeVM(ctx context.Context, vmName string) (func(), error) {
+	if done := s.beginActivity(vmName); done != nil {
+		return done, nil
+	}
+	if err := s.resumeIdleVM(ctx, vmName); err != nil {
+		return nil, err
+	}
+	if done := s.beginActivity(vmName); done != nil {
+		return done, nil
+	}
+	return func() {}, nil
+}
+
+// RecordVMActivity records a call from the guest of the VM `vmName`, such as a callback.
+func (s *Server) RecordVMActivity(vmName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.lastActivity = time.Now()
+	}
+}
+
+// beginActivity marks a call into the guest of the VM `vmName` as running and returns the
+// function that ends it. Returns nil if the VM is suspended for being idle, and a no-op if it
+// doesn't exist.
+func (s *Server) beginActivity(vmName string) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		if _, hibernated := s.hibernated[vmName]; hibernated {
+			return nil
+		}
+		return func() {}
+	}
+	if vm.idleSuspended {
+		return nil
+	}
+	vm.lastActivity = time.Now()
+	vm.activeCalls++
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		vm.lastActivity = time.Now()
+		vm.activeCalls--
+	}
+}
+
+// runIdleSuspender suspends the VMs that went without calls into their guest for the idle
+// timeout, every check interval, forever.
+func (s *Server) runIdleSuspender() {
+	for {
+		timeout, action, interval := s.idleSettings()
+		time.Sleep(interval)
+		if timeout > 0 {
+			s.suspendIdleVMs(timeout, action)
+		}
+	}
+}
+
+// suspendIdleVMs suspends the running VMs without calls into their guest for `timeout`, one by
+// one, as `action` says. Protected VMs and VMs with shared directories are only ever paused, and
+// the health check's sentinel VM is left running.
+func (s *Server) suspendIdleVMs(timeout time.Duration, action string) {
+	s.idleLock.Lock()
+	defer s.idleLock.Unlock()
+
+	sentinel := s.Config().Health.SentinelVM
+	now := time.Now()
+	idle := make(map[string]*vm)
+	s.lock.Lock()
+	for name, vm := range s.vms {
+		lastActivity := vm.lastActivity
+		if lastActivity.IsZero() {
+			lastActivity = vm.startedAt
+		}
+		if vm.status != vmStatusRunning || vm.migrating || vm.process == nil || vm.idleSuspended ||
+			vm.activeCalls > 0 || name == sentinel || now.Sub(lastActivity) < timeout {
+			continue
+		}
+		// From now on, calls into the guest wait for the suspension to finish and then resume it.
+		vm.idleSuspended = true
+		idle[name] = vm
+	}
+	s.lock.Unlock()
+
+	for name, vm := range idle {
+		logger := log.WithField("vmName", name)
+		vmAction := action
+		// VMs with shared directories or data disks can't be snapshotted.
+		if vm.protected || len(vm.sharedDirs) > 0 || s.hasDataDisks(vm) {
+			vmAction = idleActionPause
+		}
+		var err error
+		if vmAction == idleActionSnapshot {
+			err = s.hibernateVM(name, vm)
+		} else {
+			err = vm.pause(context.Background())
+		}
+		if err != nil {
+			logger.WithError(err).Error("failed to suspend idle VM")
+			s.lock.Lock()
+			vm.idleSuspended = false
+			s.lock.Unlock()
+			continue
+		}
+		logger.WithFields(log.Fields{"action": vmAction, "timeout": timeout}).Info("suspended idle VM")
+		s.events.Publish(events.VMIdleSuspended, name, map[string]string{"action": vmAction})
+	}
+	if len(idle) > 0 {
+		s.vmsChanged()
+	}
+}
+
+// hibernateVM snapshots `vm` and tears it down, keeping what it takes to restore it under its name.
+// Must be called with `s.idleLock` held.
+func (s *Server) hibernateVM(vmName string, vm *vm) error {
+	ctx := context.Background()
+	snapshotID := fmt.Sprintf("idle-%s-%s", vmName, time.Now().UTC().Format("20060102T150405Z"))
+	if _, err := s.SnapshotVM(ctx, vmName, snapshotID); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	h := &hibernatedVM{
+		snapshotID:       snapshotID,
+		ip:               vm.ip,
+		mac:              vm.mac,
+		cid:              vm.cid,
+		owner:            vm.owner,
+		sessionToken:     vm.sessionToken,
+		labels:           vm.labels,
+		snapshotPolicies: vm.snapshotPolicies,
+		restart:          vm.restart,
+		disconnect:       vm.disconnect,
+		oomPolicy:        vm.oomPolicy,
+		oomKills:         vm.oomKills,
+		lastOOMKill:      vm.lastOOMKill,
+		hooks:            vm.hooks,
+		egress:           vm.egress,
+		networkLimit:     vm.networkLimit,
+		restarts:         vm.restarts,
+		startedAt:        vm.startedAt,
+		lastActivity:     vm.lastActivity,
+	}
+	// Recorded before the VM is gone, so that calls into it never find neither.
+	s.hibernated[vmName] = h
+	s.lock.Unlock()
+
+	if err := s.destroyVM(ctx, vmName); err != nil {
+		s.lock.Lock()
+		delete(s.hibernated, vmName)
+		s.lock.Unlock()
+		os.RemoveAll(path.Join(s.config.StateDir, "snapshots", snapshotID))
+		return err
+	}
+	// Freed by the teardown, and claimed again before another VM can get them in all likelihood.
+	if err := s.ipAllocator.ClaimIP(vm.ip.IP, ""); err != nil {
+		log.WithField("vmName", vmName).WithError(err).Warn("failed to keep IP of hibernated VM")
+	}
+	if err := s.cidAllocator.ClaimCID(vm.cid); err != nil {
+		log.WithField("vmName", vmName).WithError(err).Warn("failed to keep CID of hibernated VM")
+	}
+	return nil
+}
+
+// resumeIdleVM resumes the VM `vmName` if the idle suspender paused or hibernated it, waiting for
+// a suspension in progress to finish first.
+func (s *Server) resumeIdleVM(ctx context.Context, vmName string) error {
+	s.idleLock.Lock()
+	defer s.idleLock.Unlock()
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	h := s.hibernated[vmName]
+	// Taken out while it's restored, so that it's restored only once.
+	delete(s.hibernated, vmName)
+	s.lock.Unlock()
+
+	logger := log.WithField("vmName", vmName)
+	switch {
+	case ok && vm.idleSuspended:
+		// Unless it was resumed explicitly since.
+		if vm.status == vmStatusPaused {
+			if err := vm.resume(ctx); err != nil {
+				return status.Errorf(codes.Internal, "failed to resume idle VM: %v", err)
+			}
+		}
+		s.lock.Lock()
+		vm.idleSuspended = false
+		vm.lastActivity = time.Now()
+		s.lock.Unlock()
+	case h != nil:
+		if err := s.restoreHibernatedVM(ctx, vmName, h); err != nil {
+			s.lock.Lock()
+			s.hibernated[vmName] = h
+			s.lock.Unlock()
+			return status.Errorf(codes.Internal, "failed to restore hibernated VM: %v", err)
+		}
+	default:
+		return nil
+	}
+	s.vmsChanged()
+	logger.Info("resumed idle VM")
+	s.events.Publish(events.VMIdleResumed, vmName, nil)
+	return nil
+}
+
+// restoreHibernatedVM starts the VM `vmName` again from the snapshot it was hibernated to, with
+// the owner, labels, snapshot policies, session token, restart, disconnect, OOM and egress
+// policies, OOM kills and network limit it had, and deletes the snapshot.
+func (s *Server) restoreHibernatedVM(ctx context.Context, vmName string, h *hibernatedVM) error {
+	req := serverapi.StartVMRequest{}
+	if h.restart != nil {
+		req.BootTimeoutSeconds = h.restart.req.BootTimeoutSeconds
+		req.Readiness = h.restart.req.Readiness
+	}
+	req.SetVmName(vmName)
+	req.SetSnapshotId(h.snapshotID)
+	req.Egress = convertEgressPolicy(h.egress)
+	req.NetworkLimit = convertNetworkLimit(h.networkLimit)
+
+	s.ipAllocator.FreeIP(h.ip.IP)
+	s.cidAllocator.FreeCID(h.cid)
+	if _, err := s.StartVM(ctx, &req); err != nil {
+		s.ipAllocator.ClaimIP(h.ip.IP, "")
+		s.cidAllocator.ClaimCID(h.cid)
+		return err
+	}
+
+	s.lock.Lock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.owner = h.owner
+		vm.sessionToken = h.sessionToken
+		vm.labels = h.labels
+		vm.snapshotPolicies = h.snapshotPolicies
+		vm.restart = h.restart
+		vm.disconnect = h.disconnect
+		vm.oomPolicy = h.oomPolicy
+		vm.oomKills = h.oomKills
+		vm.lastOOMKill = h.lastOOMKill
+		vm.mac = h.mac
+		vm.hooks = h.hooks
+		vm.restarts = h.restarts
+		vm.startedAt = h.startedAt
+		vm.lastActivity = time.Now()
+	}
+	s.lock.Unlock()
+
+	if err := os.RemoveAll(path.Join(s.config.StateDir, "snapshots", h.snapshotID)); err != nil {
+		log.WithFields(log.Fields{"vmName": vmName, "snapshotId": h.snapshotID}).WithError(err).Warn("failed to delete snapshot of hibernated VM")
+	}
+	return nil
+}
+
+// dropHibernatedVM forgets the hibernated VM `vmName`, deleting its snapshot and releasing its IP
+// and CID. Returns false if there's no such VM.
+func (s *Server) dropHibernatedVM(vmName string) bool {
+	s.lock.Lock()
+	h, ok := s.hibernated[vmName]
+	delete(s.hibernated, vmName)
+	s.lock.Unlock()
+	if !ok {
+		return false
+	}
+	s.ipAllocator.FreeIP(h.ip.IP)
+	s.cidAllocator.FreeCID(h.cid)
+	if err := os.RemoveAll(path.Join(s.config.StateDir, "snapshots", h.snapshotID)); err != nil {
+		log.WithFields(log.Fields{"vmName": vmName, "snapshotId": h.snapshotID}).WithError(err).Warn("failed to delete snapshot of hibernated VM")
+	}
+	s.vmsChanged()
+	s.events.Publish(events.VMDestroyed, vmName, nil)
+	return true
+}
+
+// authorizeHibernatedVMLocked returns a PermissionDenied error if the caller may not change the
+// hibernated VM `vmName`. Must be called with `s.lock` held.
+func (s *Server) authorizeHibernatedVMLocked(ctx context.Context, vmName string) error {
+	h, ok := s.hibernated[vmName]
+	if ok && !auth.FromContext(ctx).CanActOn(h.owner) {
+		return status.Errorf(codes.PermissionDenied, "vm %s is owned by another api key", vmName)
+	}
+	return nil
+}
+
+// listHibernatedVMLocked describes the hibernated VM `vmName` like a VM, nil if there's no such
+// VM. Must be called with `s.lock` held.
+func (s *Server) listHibernatedVMLocked(vmName string) *serverapi.ListVMResponse {
+	h, ok := s.hibernated[vmName]
+	if !ok {
+		return nil
+	}
+	return &serverapi.ListVMResponse{
+		VmName:         serverapi.PtrString(vmName),
+		Ip:             serverapi.PtrString(h.ip.String()),
+		Status:         serverapi.PtrString(vmStatusHibernated.String()),
+		Owner:          serverapi.PtrString(h.owner),
+		Protected:      serverapi.PtrBool(false),
+		Labels:         labelsPtr(h.labels),
+		Restarts:       serverapi.PtrInt32(h.restarts),
+		StartedAt:      serverapi.PtrTime(h.startedAt),
+		LastActivityAt: activityTime(h.lastActivity, h.startedAt),
+		IdleSuspended:  serverapi.PtrBool(true),
+	}
+}
+
+// activityTime returns the last activity of a VM started at `startedAt`, which is when it was
+// started if there was none.
+func activityTime(lastActivity time.Time, startedAt time.Time) *time.Time {
+	if lastActivity.IsZero() {
+		lastActivity = startedAt
+	}
+	return serverapi.PtrTime(lastActivity.UTC())
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/callback"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	// cloud-hypervisor listens for, or connects to, the migration stream on this socket in the VM's
+	// state directory.
+	migrationSocketFilename = "migration.sock"
+	// How long cloud-hypervisor may take to listen for the migration stream.
+	migrationSocketTimeout = 10 * time.Second
+	// Migrations the source doesn't complete in time are aborted.
+	incomingMigrationTimeout = time.Hour
+	// How long completing waits for cloud-hypervisor to take in the rest of the migration stream.
+	migrationReceiveTimeout = 5 * time.Minute
+)
+
+// incomingMigration is a VM being received from another host. Its VM is in `s.vms`, MIGRATING, but
+// only usable once the migration completes.
+type incomingMigration struct {
+	id  string
+	vm  *vm
+	req *serverapi.IncomingMigrationRequest
+	// Where the VM's cloud-hypervisor listens for the migration stream.
+	socketPath string
+	// Gets the result of cloud-hypervisor's receive-migration.
+	received chan error
+	// Releases the VM and everything set up for it.
+	abort func()
+	// Aborts the migration after incomingMigrationTimeout.
+	timer *time.Timer
+}
+
+// PrepareIncomingMigration sets up a VM to receive `req.VmName` from another host into. The host
+// sending it connects to the migration's memory stream, sends its stateful disk and completes the
+// migration once cloud-hypervisor sent the VM.
+func (s *Server) PrepareIncomingMigration(ctx context.Context, req *serverapi.IncomingMigrationRequest) (*serverapi.IncomingMigration, error) {
+	vmName := req.VmName
+	namespace, name := SplitQualifiedName(vmName)
+	if err := ValidateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if err := ValidateVMName(name); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, err
+	}
+	if req.StatefulDiskSize <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid stateful disk size %d", req.StatefulDiskSize)
+	}
+	services := make(map[string]uint32)
+	for _, service := range req.Services {
+		port := service.GetPort()
+		if port < 0 || port > math.MaxUint32 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid port %d for vsock service %s", port, service.GetName())
+		}
+		services[service.GetName()] = uint32(port)
+	}
+	// The agent is registered for every VM, services only list it for completeness.
+	delete(services, agentServiceName)
+	if err := validateVsockServices(services); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	services[agentServiceName] = guestcall.VsockPort
+	// Sources that don't send the network mode only have NAT VMs.
+	networkMode := req.GetNetworkMode()
+	if networkMode == "" {
+		networkMode = networkModeNAT
+	}
+	networkMode, ipPool, err := s.parseNetworkMode(networkMode, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	egress, err := newEgressPolicy(req.Egress, networkMode)
+	if err != nil {
+		return nil, err
+	}
+	// The limits the VM had on the source, which has already merged in its template's.
+	limit, err := s.newNetworkLimit("", req.NetworkLimit)
+	if err != nil {
+		return nil, err
+	}
+	// The hypervisor's config comes with the limits of the disks, this is for disks attached later.
+	diskLimit, err := mergeDiskLimit(diskLimit{}, req.DiskLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := s.beginOp(true)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, releaseName, err := s.claimVMName(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseName()
+	if s.getVMAtomic(vmName) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+	if err := s.checkCordon(); err != nil {
+		return nil, err
+	}
+	// The VM config names the kernel, initramfs and read-only disks of the source host.
+	for _, image := range req.Images {
+		if _, err := os.Stat(image); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "image %s of the vm isn't on this host: %v", image, err)
+		}
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create migration id: %v", err)
+	}
+	id := hex.EncodeToString(b)
+	logger := log.WithFields(log.Fields{
+		"vmName":      vmName,
+		"migrationId": id,
+	})
+	cleanup := cleanup.Make(func() {
+		logger.Info("incoming migration clean up done")
+	})
+	defer cleanup.Clean()
+
+	artifacts := newVMArtifacts(s.config.StateDir, vmName)
+	artifacts.setNetworkMode(networkMode, ipPool)
+	tapDevice, guestIP, cid, err := s.allocateGuestDevices(&cleanup, logger, artifacts)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	vm, err := s.createVM(ctx, vmName, artifacts, "", "", "", "", true)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create VM to migrate into: %v", err)
+	}
+	s.lock.Lock()
+	vm.tapDevice = tapDevice
+	vm.ip = guestIP
+	vm.cid = cid
+	vm.vsockPath = path.Join(vm.stateDirPath, vsockSocketFilename)
+	vm.statefulDiskPath = path.Join(vm.stateDirPath, statefulDiskFilename)
+	vm.guestName = req.GetGuestName()
+	if vm.guestName == "" {
+		vm.guestName = vmName
+	}
+	vm.services = services
+	vm.status = vmStatusMigrating
+	s.lock.Unlock()
+	// cloud-hypervisor may be busy receiving, so it's killed rather than shut down through its API.
+	// The tap device, IP and CID are freed by the cleanups above.
+	cleanup.Add(func() {
+		if err := vm.process.Kill(); err != nil {
+			logger.WithError(err).Warn("failed to kill VMM process")
+		}
+		if err := reapProcess(vm.process, logger, reapVmTimeout); err != nil {
+			logger.WithError(err).Warn("failed to reap VMM process")
+		}
+		cleanupAllIPTablesRulesForIP(guestIP.IP.String())
+		if err := s.applyEgressPolicy(vm, nil); err != nil {
+			logger.WithError(err).Warn("failed to delete egress rules")
+		}
+		if err := os.RemoveAll(vm.stateDirPath); err != nil {
+			logger.WithError(err).Warnf("failed to remove vm state dir: %s", vm.stateDirPath)
+		}
+		s.lock.Lock()
+		delete(s.vms, vmName)
+		s.lock.Unlock()
+		s.vmsChanged()
+	})
+
+	// In place before the guest resumes here.
+	if err := s.applyEgressPolicy(vm, egress); err != nil {
+		return nil, err
+	}
+	if err := s.setNetworkLimit(vm, limit); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	vm.diskLimit = diskLimit
+	s.lock.Unlock()
+
+	// Sparse, so that the blocks the source skips as zeros take no space.
+	disk, err := os.Create(vm.statefulDiskPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create stateful disk: %v", err)
+	}
+	err = disk.Truncate(req.StatefulDiskSize)
+	disk.Close()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to size stateful disk: %v", err)
+	}
+	if secret := req.GetVsockSecret(); secret != "" {
+		if err := os.WriteFile(path.Join(vm.stateDirPath, guestcall.VsockSecretFilename), []byte(secret), 0600); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to write vsock secret: %v", err)
+		}
+	}
+
+	socketPath := path.Join(vm.stateDirPath, migrationSocketFilename)
+	if len(socketPath) > maxUnixSocketPath {
+		return nil, status.Errorf(codes.FailedPrecondition, "migration socket path %s is longer than %d bytes, use a shorter state_dir", socketPath, maxUnixSocketPath)
+	}
+	received := make(chan error, 1)
+	go func() {
+		received <- vm.receiveMigration(context.Background(), socketPath)
+	}()
+	if err := waitForMigrationSocket(socketPath, received); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to receive vm: %v", err)
+	}
+
+	m := &incomingMigration{
+		id:         id,
+		vm:         vm,
+		req:        req,
+		socketPath: socketPath,
+		received:   received,
+		abort:      cleanup.Release(),
+	}
+	s.lock.Lock()
+	s.incomingMigrations[id] = m
+	m.timer = time.AfterFunc(incomingMigrationTimeout, func() {
+		if m := s.takeIncomingMigration(id); m != nil {
+			logger.Warn("incoming migration timed out")
+			m.abort()
+		}
+	})
+	s.lock.Unlock()
+
+	logger.WithFields(log.Fields{
+		"ip":  guestIP.String(),
+		"cid": cid,
+	}).Info("prepared incoming migration")
+	return &serverapi.IncomingMigration{
+		Id:          serverapi.PtrString(id),
+		VmName:      serverapi.PtrString(vmName),
+		Ip:          serverapi.PtrString(guestIP.String()),
+		TapDevice:   serverapi.PtrString(tapDevice.Name),
+		Cid:         serverapi.PtrInt64(int64(cid)),
+		StateDir:    serverapi.PtrString(vm.stateDirPath),
+		VsockSocket: serverapi.PtrString(vm.vsockPath),
+	}, nil
+}
+
+// waitForMigrationSocket waits for cloud-hypervisor to listen on `socketPath`, or to fail to, as
+// reported on `received`.
+func waitForMigrationSocket(socketPath string, received chan error) error {
+	deadline := time.Now().Add(migrationSocketTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(socketPath); err == nil {
+			return nil
+		}
+		select {
+		case err := <-received:
+			// Put back for `CompleteIncomingMigration`, though it won't get that far.
+			received <- err
+			if err == nil {
+				err = errors.New("cloud-hypervisor stopped receiving")
+			}
+			return err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return errors.New("timed out waiting for cloud-hypervisor to listen for the migration")
+}
+
+// receiveMigration has cloud-hypervisor receive the VM over `socketPath`. It returns once the VM was
+// received, and is resumed, or the migration failed. `v.lock` isn't held, so that the VM can be
+// torn down while it waits.
+func (v *vm) receiveMigration(ctx context.Context, socketPath string) error {
+	// The hypervisor listens on the socket and writes the disks it receives to the state directory.
+	if err := v.jail.own(v.stateDirPath); err != nil {
+		return err
+	}
+	req := migrationApiClient(v.apiSocketPath).DefaultAPI.VmReceiveMigrationPut(ctx)
+	req = req.ReceiveMigrationData(chvapi.ReceiveMigrationData{
+		ReceiverUrl: "unix:" + socketPath,
+	})
+	resp, err := req.Execute()
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to receive migration: %d: %s: %w", resp.StatusCode, string(body), err)
+		}
+		return fmt.Errorf("failed to receive migration: %w", err)
+	}
+	if resp.StatusCode != 204 {
+		return fmt.Errorf("failed to receive migration. bad status: %v", resp)
+	}
+	return nil
+}
+
+// incomingMigration returns the migration `id`.
+func (s *Server) incomingMigration(id string) (*incomingMigration, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	m, ok := s.incomingMigrations[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "migration %s not found", id)
+	}
+	return m, nil
+}
+
+// takeIncomingMigration removes the migration `id` and returns it, or nil if there is none.
+func (s *Server) takeIncomingMigration(id string) *incomingMigration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m, ok := s.incomingMigrations[id]
+	if !ok {
+		return nil
+	}
+	delete(s.incomingMigrations, id)
+	m.timer.Stop()
+	return m
+}
+
+// DialIncomingMigration connects to the cloud-hypervisor receiving the VM of migration `id`, for
+// relaying the memory stream of the source to.
+func (s *Server) DialIncomingMigration(ctx context.Context, id string) (net.Conn, error) {
+	m, err := s.incomingMigration(id)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", m.socketPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to connect to cloud-hypervisor: %v", err)
+	}
+	return conn, nil
+}
+
+// ReceiveMigrationDisk writes the stateful disk blocks read from `r` to the VM of migration `id`.
+// The source sends the whole disk first and the blocks that changed once the VM is paused.
+func (s *Server) ReceiveMigrationDisk(ctx context.Context, id string, r io.Reader) (*serverapi.VMResponse, error) {
+	m, err := s.incomingMigration(id)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := os.OpenFile(m.vm.statefulDiskPath, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to open stateful disk: %v", err)
+	}
+	defer disk.Close()
+	if err := readDiskBlocks(r, disk, m.req.StatefulDiskSize); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to receive stateful disk: %v", err)
+	}
+	if err := disk.Sync(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sync stateful disk: %v", err)
+	}
+	return &serverapi.VMResponse{Success: serverapi.PtrBool(true)}, nil
+}
+
+// CompleteIncomingMigration finishes migration `id` once cloud-hypervisor received the VM: the
+// guest moves to the IP it was given here and the VM takes over the owner, labels, protection and
+// callback session it had on the source.
+func (s *Server) CompleteIncomingMigration(ctx context.Context, id string) (*serverapi.ListVMResponse, error) {
+	m := s.takeIncomingMigration(id)
+	if m == nil {
+		return nil, status.Errorf(codes.NotFound, "migration %s not found", id)
+	}
+	vm := m.vm
+	logger := log.WithFields(log.Fields{
+		"vmName":      vm.name,
+		"migrationId": id,
+	})
+
+	var err error
+	select {
+	case err = <-m.received:
+	case <-time.After(migrationReceiveTimeout):
+		err = errors.New("timed out waiting for cloud-hypervisor to receive the vm")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		m.abort()
+		return nil, status.Errorf(codes.Internal, "failed to receive vm: %v", err)
+	}
+	os.Remove(m.socketPath)
+
+	info, _, err := vm.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		m.abort()
+		return nil, status.Errorf(codes.Internal, "failed to get info of received vm: %v", err)
+	}
+	if len(info.Config.Net) != 1 || info.Config.Net[0].Mac == nil {
+		m.abort()
+		return nil, status.Error(codes.Internal, "received vm has no MAC address")
+	}
+	portForwards, err := s.setupPortForwardsToVM(vm.ip.IP.String(), s.portForwardsOf(vm.networkMode))
+	if err != nil {
+		m.abort()
+		return nil, status.Errorf(codes.Internal, "failed to forward ports to VM: %v", err)
+	}
+	// The guest keeps its MAC, cloud-hypervisor moved it to our tap device.
+	identity := forkIdentity{
+		name:      vm.guestName,
+		stateDir:  vm.stateDirPath,
+		tap:       vm.tapDevice.Name,
+		mac:       *info.Config.Net[0].Mac,
+		guestIP:   vm.ip,
+		cid:       vm.cid,
+		vsockPath: vm.vsockPath,
+	}
+	// Not fatal, the VM runs here either way, and the source is gone.
+	reidentifyErr := s.reidentifyGuest(ctx, vm, identity)
+	if reidentifyErr != nil {
+		logger.WithError(reidentifyErr).Error("failed to move the guest to its new IP")
+	}
+	if err := s.limitHypervisor(ctx, vm); err != nil {
+		logger.WithError(err).Error("failed to limit the hypervisor of the received vm")
+	}
+
+	s.lock.Lock()
+	vm.portForwards = portForwards
+	vm.status = vmStatusRunning
+	vm.owner = m.req.GetOwner()
+	vm.protected = m.req.GetProtected()
+	vm.labels = maps.Clone(m.req.GetLabels())
+	vm.sessionToken = m.req.GetSessionToken()
+	s.lock.Unlock()
+	s.vmsChanged()
+
+	namespace, name := SplitQualifiedName(vm.name)
+	if m.req.GetCallbackUrl() != "" || m.req.GetCallbackSessionId() != "" {
+		s.sessionManager.AdoptSession(namespace, name, &callback.Handoff{
+			CallbackURL:    m.req.GetCallbackUrl(),
+			SessionID:      m.req.GetCallbackSessionId(),
+			ReconnectToken: m.req.GetReconnectToken(),
+		})
+	}
+	logger.WithField("ip", vm.ip.String()).Info("received migrated VM")
+	s.events.Publish(events.VMStarted, vm.name, map[string]string{"migrationId": id})
+
+	if reidentifyErr != nil {
+		return nil, status.Errorf(codes.Internal, "vm received, but failed to move the guest to %s: %v", vm.ip.String(), reidentifyErr)
+	}
+	return s.listVM(vm.name)
+}
+
+// AbortIncomingMigration gives up on migration `id` and tears down its VM.
+func (s *Server) AbortIncomingMigration(ctx context.Context, id string) (*serverapi.VMResponse, error) {
+	m := s.takeIncomingMigration(id)
+	if m == nil {
+		return nil, status.Errorf(codes.NotFound, "migration %s not found", id)
+	}
+	log.WithFields(log.Fields{
+		"vmName":      m.vm.name,
+		"migrationId": id,
+	}).Info("aborting incoming migration")
+	m.abort()
+	return &serverapi.VMResponse{Success: serverapi.PtrBool(true)}, nil
+}
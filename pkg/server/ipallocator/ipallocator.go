@@ -1,15 +1,61 @@
 package ipallocator
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 )
 
-type IPAllocator struct {
-	subnet    *net.IPNet
+// DefaultPool is the pool guests get addresses from unless they ask for another.
+const DefaultPool = "default"
+
+// PoolSpec describes a pool of guest addresses.
+type PoolSpec struct {
+	// Subnets of the pool in CIDR notation, e.g. "10.20.1.0/24".
+	CIDRs []string
+	// Addresses, e.g. "10.20.1.10", and inclusive ranges, e.g. "10.20.1.100-10.20.1.150", that are
+	// never handed out.
+	Reserved []string
+	// The address guests route through, if it's not the host's, e.g. the router of a network the
+	// host only bridges guests onto.
+	Gateway string
+}
+
+// subnet is a subnet of a pool and the address on it that guests route through.
+type subnet struct {
+	*net.IPNet
+	gateway net.IP
+}
+
+type pool struct {
+	subnets   []subnet
 	available []net.IP
-	mutex     sync.Mutex
+}
+
+// allocation is an allocated address as saved in the state file. Allocations without an owner
+// don't outlive the server.
+type allocation struct {
+	IP    string `json:"ip"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// IPAllocator hands out guest addresses from named pools. If it has a state file, allocations are
+// saved to it on every change and loaded from it when the allocator is created, so that a restarted
+// server doesn't hand out the addresses of guests that still run.
+type IPAllocator struct {
+	pools     map[string]*pool
+	stateFile string
+
+	mutex sync.Mutex
+	// Allocated addresses and their owners. Guarded by mutex.
+	allocated map[string]string
 }
 
 func incrementIP(ip net.IP) net.IP {
@@ -29,73 +75,351 @@ func copyIP(ip net.IP) net.IP {
 	return dup
 }
 
-func NewIPAllocator(subnetCIDR string) (*IPAllocator, error) {
-	_, subnet, err := net.ParseCIDR(subnetCIDR)
-	if err != nil {
-		return nil, fmt.Errorf("invalid subnet CIDR: %v", err)
+// broadcast returns the last address of `n`.
+func broadcast(n *net.IPNet) net.IP {
+	ip := copyIP(n.IP)
+	for i := range ip {
+		ip[i] |= ^n.Mask[i]
 	}
+	return ip
+}
+
+// ParseRange parses a reserved address, e.g. "10.20.1.10", or inclusive range, e.g.
+// "10.20.1.100-10.20.1.150".
+func ParseRange(s string) (net.IP, net.IP, error) {
+	firstStr, lastStr, isRange := strings.Cut(s, "-")
+	first := net.ParseIP(strings.TrimSpace(firstStr)).To4()
+	last := first
+	if isRange {
+		last = net.ParseIP(strings.TrimSpace(lastStr)).To4()
+	}
+	if first == nil || last == nil || bytes.Compare(first, last) > 0 {
+		return nil, nil, fmt.Errorf("invalid IPv4 address or range %q", s)
+	}
+	return first, last, nil
+}
 
+// NewPoolAllocator creates an allocator with `pools`, saving allocations to `stateFile` unless it's
+// empty. The gateway of each subnet is the pool's if the subnet has it, else `hostIP` if the subnet
+// has it, otherwise the first address after the network address. Network, host and broadcast addresses are never handed out.
+func NewPoolAllocator(pools map[string]PoolSpec, hostIP net.IP, stateFile string) (*IPAllocator, error) {
 	allocator := &IPAllocator{
-		subnet:    subnet,
-		available: []net.IP{},
+		pools:     make(map[string]*pool),
+		stateFile: stateFile,
+		allocated: make(map[string]string),
 	}
+	var all []*net.IPNet
+	for name, spec := range pools {
+		if len(spec.CIDRs) == 0 {
+			return nil, fmt.Errorf("pool %s has no subnets", name)
+		}
+		type ipRange struct{ first, last net.IP }
+		var reserved []ipRange
+		for _, r := range spec.Reserved {
+			first, last, err := ParseRange(r)
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: %w", name, err)
+			}
+			reserved = append(reserved, ipRange{first, last})
+		}
+		isReserved := func(ip net.IP) bool {
+			for _, r := range reserved {
+				if bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0 {
+					return true
+				}
+			}
+			return false
+		}
+
+		var poolGateway net.IP
+		if spec.Gateway != "" {
+			if poolGateway = net.ParseIP(spec.Gateway).To4(); poolGateway == nil {
+				return nil, fmt.Errorf("pool %s: invalid gateway %q", name, spec.Gateway)
+			}
+		}
 
-	// The first one will be reserved as the gateway. Start from x.x.x.2.
-	ip := incrementIP(subnet.IP)
+		p := &pool{}
+		for _, cidr := range spec.CIDRs {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil || n.IP.To4() == nil {
+				return nil, fmt.Errorf("pool %s: invalid IPv4 subnet CIDR %q", name, cidr)
+			}
+			n.IP = n.IP.To4()
+			if ones, _ := n.Mask.Size(); ones > 30 {
+				return nil, fmt.Errorf("pool %s: subnet %s has no room for guests", name, cidr)
+			}
+			for _, other := range all {
+				if other.Contains(n.IP) || n.Contains(other.IP) {
+					return nil, fmt.Errorf("pool %s: subnet %s overlaps with %s", name, cidr, other)
+				}
+			}
+			all = append(all, n)
 
-	// Generate all available IPs in the subnet
-	for ip := incrementIP(ip); subnet.Contains(ip); ip = incrementIP(ip) {
-		allocator.available = append(allocator.available, copyIP(ip))
+			gateway := incrementIP(n.IP)
+			if poolGateway != nil && n.Contains(poolGateway) {
+				gateway = poolGateway
+			} else if hostIP != nil && n.Contains(hostIP) {
+				gateway = hostIP.To4()
+			}
+			p.subnets = append(p.subnets, subnet{IPNet: n, gateway: gateway})
+			last := broadcast(n)
+			for ip := incrementIP(n.IP); !ip.Equal(last); ip = incrementIP(ip) {
+				if !ip.Equal(gateway) && !isReserved(ip) {
+					p.available = append(p.available, ip)
+				}
+			}
+		}
+		allocator.pools[name] = p
+	}
+	if err := allocator.load(); err != nil {
+		return nil, err
 	}
-
 	return allocator, nil
 }
 
-func (a *IPAllocator) AllocateIP() (*net.IPNet, error) {
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
+// load takes the allocations of the state file, if any, out of the pools.
+func (a *IPAllocator) load() error {
+	if a.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(a.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read IP allocations: %w", err)
+	}
+	var allocations []allocation
+	if err := json.Unmarshal(data, &allocations); err != nil {
+		return fmt.Errorf("failed to parse IP allocations %s: %w", a.stateFile, err)
+	}
+	for _, alloc := range allocations {
+		ip := net.ParseIP(alloc.IP).To4()
+		if ip == nil {
+			continue
+		}
+		// Addresses of subnets that aren't configured anymore can't be handed out anyway.
+		if p, _ := a.subnetOf(ip); p != nil && p.take(ip) {
+			a.allocated[ip.String()] = alloc.Owner
+		}
+	}
+	return nil
+}
 
-	if len(a.available) == 0 {
-		return nil, fmt.Errorf("no available IPs")
+// save writes the allocations to the state file, if any. Callers must hold the mutex.
+func (a *IPAllocator) save() error {
+	if a.stateFile == "" {
+		return nil
 	}
+	allocations := make([]allocation, 0, len(a.allocated))
+	for ip, owner := range a.allocated {
+		allocations = append(allocations, allocation{IP: ip, Owner: owner})
+	}
+	sort.Slice(allocations, func(i, j int) bool { return allocations[i].IP < allocations[j].IP })
+	data, err := json.Marshal(allocations)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.stateFile), 0755); err != nil {
+		return err
+	}
+	tmp := a.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.stateFile)
+}
 
-	ip := a.available[0]
-	a.available = a.available[1:]
+// subnetOf returns the pool and subnet that `ip` is in, nil if none.
+func (a *IPAllocator) subnetOf(ip net.IP) (*pool, *subnet) {
+	for _, p := range a.pools {
+		for i := range p.subnets {
+			if p.subnets[i].Contains(ip) {
+				return p, &p.subnets[i]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// take removes `ip` from the available addresses of the pool, returning whether it was available.
+func (p *pool) take(ip net.IP) bool {
+	for i, availIP := range p.available {
+		if availIP.Equal(ip) {
+			p.available = append(p.available[:i], p.available[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
 
+// allocate records `ip` as allocated to `owner`, undoing it if it can't be saved. Callers must
+// hold the mutex and have taken `ip` out of `p`.
+func (a *IPAllocator) allocate(p *pool, s *subnet, ip net.IP, owner string) (*net.IPNet, error) {
+	a.allocated[ip.String()] = owner
+	if err := a.save(); err != nil {
+		delete(a.allocated, ip.String())
+		p.available = append(p.available, ip)
+		return nil, fmt.Errorf("failed to save IP allocations: %w", err)
+	}
 	return &net.IPNet{
 		IP:   ip,
-		Mask: a.subnet.Mask,
+		Mask: s.Mask,
 	}, nil
 }
 
+// Pools returns the names of the pools.
+func (a *IPAllocator) Pools() []string {
+	names := make([]string, 0, len(a.pools))
+	for name := range a.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PoolOf returns the name of the pool `ip` is in, empty if none.
+func (a *IPAllocator) PoolOf(ip net.IP) string {
+	for name, p := range a.pools {
+		for _, s := range p.subnets {
+			if s.Contains(ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Subnets returns the subnets of the pool `poolName` and the gateway of each, e.g. "10.20.1.1/24".
+func (a *IPAllocator) Subnets(poolName string) ([]*net.IPNet, []*net.IPNet) {
+	var subnets, gateways []*net.IPNet
+	if p, ok := a.pools[poolName]; ok {
+		for _, s := range p.subnets {
+			subnets = append(subnets, s.IPNet)
+			gateways = append(gateways, &net.IPNet{IP: s.gateway, Mask: s.Mask})
+		}
+	}
+	return subnets, gateways
+}
+
+// Gateway returns the gateway of the subnet of `ip`, e.g. "10.20.1.1/24".
+func (a *IPAllocator) Gateway(ip net.IP) (*net.IPNet, error) {
+	_, s := a.subnetOf(ip)
+	if s == nil {
+		return nil, fmt.Errorf("IP %v is in no pool", ip)
+	}
+	return &net.IPNet{IP: s.gateway, Mask: s.Mask}, nil
+}
+
+// AllocateIP allocates an address of the pool `poolName` to `owner`.
+func (a *IPAllocator) AllocateIP(poolName string, owner string) (*net.IPNet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	p, ok := a.pools[poolName]
+	if !ok {
+		return nil, fmt.Errorf("no IP pool %q", poolName)
+	}
+	if len(p.available) == 0 {
+		return nil, fmt.Errorf("no available IPs in pool %s", poolName)
+	}
+	ip := p.available[0]
+	p.available = p.available[1:]
+	_, s := a.subnetOf(ip)
+	return a.allocate(p, s, ip, owner)
+}
+
 func (a *IPAllocator) FreeIP(ip net.IP) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	if !a.subnet.Contains(ip) {
-		return fmt.Errorf("IP %v is not in the subnet", ip)
+	p, _ := a.subnetOf(ip)
+	if p == nil {
+		return fmt.Errorf("IP %v is in no pool", ip)
+	}
+	if _, ok := a.allocated[ip.String()]; !ok {
+		return nil
+	}
+	delete(a.allocated, ip.String())
+	p.available = append(p.available, copyIP(ip.To4()))
+	return a.save()
+}
+
+// ClaimIP attempts to claim a specific IP address for `owner`, e.g. one a restored guest already
+// has. It's not an error if the IP is already allocated, its owner is replaced.
+// Returns error if the IP is in no pool.
+func (a *IPAllocator) ClaimIP(ip net.IP, owner string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	p, _ := a.subnetOf(ip)
+	if p == nil {
+		return fmt.Errorf("IP %v is in no pool", ip)
 	}
+	p.take(ip)
+	a.allocated[ip.To4().String()] = owner
+	return a.save()
+}
 
-	a.available = append(a.available, copyIP(ip))
-	return nil
+// AllocateSpecificIP allocates `ip`, which a caller asked for by address, to `owner`. Unlike
+// ClaimIP it fails if the IP isn't free, e.g. because it's allocated, reserved or the gateway.
+func (a *IPAllocator) AllocateSpecificIP(ip net.IP, owner string) (*net.IPNet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	p, s := a.subnetOf(ip)
+	if p == nil {
+		return nil, fmt.Errorf("IP %v is in no pool", ip)
+	}
+	if !p.take(ip) {
+		return nil, fmt.Errorf("IP %v is in use or reserved", ip)
+	}
+	return a.allocate(p, s, copyIP(ip.To4()), owner)
 }
 
-// ClaimIP attempts to claim a specific IP address from the pool.
-// Returns error if the IP is already allocated or not in the subnet.
-func (a *IPAllocator) ClaimIP(ip net.IP) error {
+// FreeUnowned frees the allocations without an owner and those whose owner `keep` returns false
+// for, returning how many it freed.
+func (a *IPAllocator) FreeUnowned(keep func(owner string) bool) (int, error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	if !a.subnet.Contains(ip) {
-		return fmt.Errorf("IP %v is not in the subnet", ip)
+	freed := 0
+	for ipStr, owner := range a.allocated {
+		if owner != "" && keep(owner) {
+			continue
+		}
+		ip := net.ParseIP(ipStr).To4()
+		if p, _ := a.subnetOf(ip); p != nil {
+			p.available = append(p.available, ip)
+		}
+		delete(a.allocated, ipStr)
+		freed++
+	}
+	if freed == 0 {
+		return 0, nil
 	}
+	return freed, a.save()
+}
 
-	for i, availIP := range a.available {
-		if availIP.Equal(ip) {
-			// Remove this IP from available pool
-			a.available = append(a.available[:i], a.available[i+1:]...)
-			break
+// FreeOwner frees the allocations of `owner`.
+func (a *IPAllocator) FreeOwner(owner string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	freed := false
+	for ipStr, o := range a.allocated {
+		if o != owner {
+			continue
 		}
+		ip := net.ParseIP(ipStr).To4()
+		if p, _ := a.subnetOf(ip); p != nil {
+			p.available = append(p.available, ip)
+		}
+		delete(a.allocated, ipStr)
+		freed = true
 	}
-	return nil
+	if !freed {
+		return nil
+	}
+	return a.save()
 }
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// Jails are given users from uid_base up, one per VM. The user's group has the same ID.
+const jailUIDCount = 65536
+
+// Device nodes the hypervisor opens, bound into every jail.
+var jailDevices = []string{"/dev/urandom", "/dev/null"}
+
+// Device nodes only root or the kvm group may open on the host, created in every jail for its user
+// alone.
+var jailOwnedDevices = []string{"/dev/kvm", "/dev/net/tun"}
+
+// jail is the chroot, user and cgroup the hypervisor of a VM runs in with the jailer on, like
+// Firecracker's jailer sets up. The chroot only has the device nodes and files the hypervisor
+// needs bound into it, each at its path on the host, so that the hypervisor is configured with the
+// same paths either way.
+type jail struct {
+	// The chroot, in a directory of its own under the jailer's chroot_base_dir.
+	root string
+	// The hypervisor's user and group.
+	uid int
+	// Relative to cgroupRoot.
+	cgroup string
+
+	lock sync.Mutex
+	// Host paths bound into the chroot.
+	bound map[string]bool
+}
+
+// newJail sets up the jail of the VM whose artifacts have the ID `id`, with its state directory
+// `stateDir` and the images `images` bound into it. The images of the config are bound too, so
+// that restores and migrations find the images their VMs were booted from.
+func (s *Server) newJail(id string, stateDir string, images ...string) (_ *jail, retErr error) {
+	cfg := s.config.Jailer
+	uid, err := s.allocateJailUID()
+	if err != nil {
+		return nil, err
+	}
+	j := &jail{
+		root:   path.Join(cfg.ChrootBaseDir, id, "root"),
+		uid:    uid,
+		cgroup: path.Join(cfg.CgroupParent, id),
+		bound:  make(map[string]bool),
+	}
+	defer func() {
+		if retErr != nil {
+			s.removeJail(j)
+		}
+	}()
+
+	if err := os.MkdirAll(j.root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chroot: %w", err)
+	}
+	// Shared, so that what's bound into the jail later also reaches hypervisors whose network
+	// namespace came with a mount namespace of their own.
+	if err := unix.Mount(j.root, j.root, "", unix.MS_BIND, ""); err != nil {
+		return nil, fmt.Errorf("failed to bind chroot: %w", err)
+	}
+	if err := unix.Mount("", j.root, "", unix.MS_SHARED, ""); err != nil {
+		return nil, fmt.Errorf("failed to share chroot: %w", err)
+	}
+	if err := createCgroup(j.cgroup); err != nil {
+		return nil, err
+	}
+
+	for _, device := range jailDevices {
+		if err := j.bind(device, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, device := range jailOwnedDevices {
+		if err := j.mknod(device); err != nil {
+			return nil, err
+		}
+	}
+	if err := j.bind(s.config.ChvBinPath, true); err != nil {
+		return nil, err
+	}
+	if err := j.bind(stateDir, false); err != nil {
+		return nil, err
+	}
+	if err := j.own(stateDir); err != nil {
+		return nil, err
+	}
+	images = append(images, s.config.KernelPath, s.config.InitramfsPath, s.config.RootfsPath)
+	for _, tmpl := range s.Config().Templates {
+		images = append(images, tmpl.Kernel, tmpl.Initramfs, tmpl.Rootfs)
+	}
+	for _, p := range s.Config().BaseImages {
+		images = append(images, p)
+	}
+	for _, image := range images {
+		// Images that are downloaded or converted first are bound once they're in place.
+		if _, err := os.Stat(image); image == "" || err != nil {
+			continue
+		}
+		if err := j.bind(image, true); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// recordJail returns the record of `j`, nil for a nil jail.
+func recordJail(j *jail) *vmRecordJail {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	record := &vmRecordJail{Root: j.root, UID: j.uid, Cgroup: j.cgroup}
+	for p := range j.bound {
+		record.Bound = append(record.Bound, p)
+	}
+	slices.Sort(record.Bound)
+	return record
+}
+
+// allocateJailUID returns the lowest user of the jailer's range that no jail has.
+func (s *Server) allocateJailUID() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for uid := s.config.Jailer.UIDBase; uid < s.config.Jailer.UIDBase+jailUIDCount; uid++ {
+		if !s.jailUIDs[uid] {
+			s.jailUIDs[uid] = true
+			return uid, nil
+		}
+	}
+	return 0, errors.New("all users of the jailer are taken")
+}
+
+// removeJail unmounts what's bound into `j` and deletes its chroot and cgroup, once its
+// hypervisor exited. Nothing's deleted while anything's still mounted in the chroot, which would
+// delete what's bound there on the host.
+func (s *Server) removeJail(j *jail) {
+	if j == nil {
+		return
+	}
+	logger := log.WithField("jail", j.root)
+	jailDir := path.Dir(j.root)
+	if err := unmountUnder(jailDir); err != nil {
+		logger.WithError(err).Error("failed to unmount jail, leaving it behind")
+		return
+	}
+	if err := os.RemoveAll(jailDir); err != nil {
+		logger.WithError(err).Warn("failed to delete jail")
+	}
+	if err := os.Remove(path.Join(cgroupRoot, j.cgroup)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.WithError(err).Warn("failed to delete jail cgroup")
+	}
+	s.lock.Lock()
+	delete(s.jailUIDs, j.uid)
+	s.lock.Unlock()
+}
+
+// cleanupJails deletes the jails of the jailer's chroot_base_dir whose VMs are gone, except those in
+// `keep`, by chroot.
+func cleanupJails(cfg config.JailerConfig, keep map[string]bool) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	entries, err := os.ReadDir(cfg.ChrootBaseDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		jailDir := path.Join(cfg.ChrootBaseDir, entry.Name())
+		if !entry.IsDir() || keep[path.Join(jailDir, "root")] {
+			continue
+		}
+		if err := unmountUnder(jailDir); err != nil {
+			log.WithError(err).Warnf("failed to unmount leftover jail %s", jailDir)
+			continue
+		}
+		if err := os.RemoveAll(jailDir); err != nil {
+			log.WithError(err).Warnf("failed to delete leftover jail %s", jailDir)
+			continue
+		}
+		os.Remove(path.Join(cgroupRoot, cfg.CgroupParent, entry.Name()))
+		log.Infof("deleted leftover jail: %s", jailDir)
+	}
+	return nil
+}
+
+// bind binds the host path `src` into the jail at the same path, read-only if `readOnly` is set.
+func (j *jail) bind(src string, readOnly bool) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.bound[src] {
+		return nil
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to bind %s into jail: %w", src, err)
+	}
+	target := path.Join(j.root, src)
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(path.Dir(target), 0755); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create mount point of %s in jail: %w", src, err)
+	}
+	if err := unix.Mount(src, target, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind %s into jail: %w", src, err)
+	}
+	j.bound[src] = true
+	if readOnly {
+		if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("failed to make %s read-only in jail: %w", src, err)
+		}
+	}
+	return nil
+}
+
+// unbind undoes `bind`, e.g. once a snapshot was written to `src`.
+func (j *jail) unbind(src string) error {
+	if j == nil {
+		return nil
+	}
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.bound[src] {
+		return nil
+	}
+	target := path.Join(j.root, src)
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unbind %s from jail: %w", src, err)
+	}
+	delete(j.bound, src)
+	os.Remove(target)
+	return nil
+}
+
+// own hands `paths`, and what's in them, to the jail's user, which the hypervisor writes them as.
+// A nil jail leaves them to root.
+func (j *jail) own(paths ...string) error {
+	if j == nil {
+		return nil
+	}
+	for _, p := range paths {
+		if err := j.ownExcept(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownExcept is `own` for `dir`, leaving out `skip` and what's in it. A nil jail does nothing.
+func (j *jail) ownExcept(dir string, skip string) error {
+	if j == nil {
+		return nil
+	}
+	err := filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == skip {
+			return filepath.SkipDir
+		}
+		return os.Lchown(p, j.uid, j.uid)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to hand %s to the jail's user: %w", dir, err)
+	}
+	return nil
+}
+
+// mknod creates the character device `device` of the host at the same path in the jail, readable
+// and writable by the jail's user only.
+func (j *jail) mknod(device string) error {
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", device, err)
+	}
+	target := path.Join(j.root, device)
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create %s in jail: %w", path.Dir(device), err)
+	}
+	if err := unix.Mknod(target, unix.S_IFCHR|0600, int(st.Rdev)); err != nil {
+		return fmt.Errorf("failed to create %s in jail: %w", device, err)
+	}
+	if err := os.Chown(target, j.uid, j.uid); err != nil {
+		return fmt.Errorf("failed to hand %s to the jail's user: %w", device, err)
+	}
+	return nil
+}
+
+// share binds `src` into the jail and hands it to the jail's user unless it's read-only, for
+// images the hypervisor opens after it started, like volumes. A nil jail does nothing.
+func (j *jail) share(src string, readOnly bool) error {
+	if j == nil {
+		return nil
+	}
+	if err := j.bind(src, readOnly); err != nil {
+		return err
+	}
+	if readOnly {
+		return nil
+	}
+	return j.own(src)
+}
+
+// command returns `command` run chrooted into the jail as its user. A nil jail returns it as is.
+func (j *jail) command(command []string) []string {
+	if j == nil {
+		return command
+	}
+	id := strconv.Itoa(j.uid)
+	return append([]string{"chroot", "--userspec=" + id + ":" + id, "--groups=" + id, j.root}, command...)
+}
+
+// unmountUnder lazily unmounts everything mounted at or below `dir`, deepest first.
+func unmountUnder(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	// Binds into a shared chroot can show up more than once.
+	for range 3 {
+		mounts, err := mountsUnder(dir)
+		if err != nil {
+			return err
+		}
+		if len(mounts) == 0 {
+			return nil
+		}
+		for _, m := range mounts {
+			if err := unix.Unmount(m, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+				return fmt.Errorf("failed to unmount %s: %w", m, err)
+			}
+		}
+	}
+	if mounts, err := mountsUnder(dir); err != nil || len(mounts) > 0 {
+		return fmt.Errorf("%d mounts left under %s: %v", len(mounts), dir, err)
+	}
+	return nil
+}
+
+// mountsUnder returns the mount points at or below `dir`, deepest first.
+func mountsUnder(dir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		// Spaces and the like are escaped as octal.
+		m, err := strconv.Unquote(`"` + strings.ReplaceAll(fields[4], `"`, `\"`) + `"`)
+		if err != nil {
+			m = fields[4]
+		}
+		if m == dir || strings.HasPrefix(m, dir+"/") {
+			mounts = append(mounts, m)
+		}
+	}
+	slices.SortFunc(mounts, func(a, b string) int {
+		if d := len(b) - len(a); d != 0 {
+			return d
+		}
+		return strings.Compare(a, b)
+	})
+	return slices.Compact(mounts), scanner.Err()
+}
+
+// shareDataDisk gives the jail's hypervisor the data disk `d`: new disks are in the VM's state
+// directory already and only change hands, volumes are bound into the jail too.
+func (j *jail) shareDataDisk(d *dataDisk) error {
+	if d.volume == "" {
+		return j.own(d.path)
+	}
+	return j.share(d.path, d.readOnly)
+}
+
+// shareTapDevice hands the tap device `name` to the jail's user, whose hypervisor couldn't open it
+// otherwise. A nil jail does nothing.
+func (s *Server) shareTapDevice(j *jail, name string) error {
+	if j == nil {
+		return nil
+	}
+	return s.fountain.SetTapOwner(name, s.netnsOf(name), j.uid)
+}
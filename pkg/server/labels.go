@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxLabels = 64
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]{0,61}[a-zA-Z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9._-]{0,61}[a-zA-Z0-9])?)?$`)
+)
+
+// validateLabels returns an InvalidArgument error if `labels` can't be set on a VM.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return status.Errorf(codes.InvalidArgument, "a vm can have at most %d labels", maxLabels)
+	}
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return status.Errorf(codes.InvalidArgument, "invalid label key %q", key)
+		}
+		if !labelValuePattern.MatchString(value) {
+			return status.Errorf(codes.InvalidArgument, "invalid value %q for label %s", value, key)
+		}
+	}
+	return nil
+}
+
+// setVMLabels replaces the labels of the VM `vmName`.
+func (s *Server) setVMLabels(vmName string, labels map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.labels = maps.Clone(labels)
+	}
+}
+
+// labelsPtr returns a copy of `labels` for API responses, nil if there are none.
+func labelsPtr(labels map[string]string) *map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	labels = maps.Clone(labels)
+	return &labels
+}
+
+// labelRequirement is one comma separated part of a label selector.
+type labelRequirement struct {
+	key   string
+	value string
+	// One of "=", "!=", "exists" and "!exists".
+	op string
+}
+
+// labelSelector selects VMs whose labels meet all of its requirements.
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses selectors such as "team=infra,tier!=db,canary,!legacy". The empty
+// selector matches every VM.
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var sel labelSelector
+	if strings.TrimSpace(selector) == "" {
+		return sel, nil
+	}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		var req labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			req.key, req.value, _ = strings.Cut(part, "!=")
+			req.op = "!="
+		case strings.Contains(part, "="):
+			req.key, req.value, _ = strings.Cut(part, "=")
+			req.value = strings.TrimPrefix(req.value, "=")
+			req.op = "="
+		case strings.HasPrefix(part, "!"):
+			req.key = strings.TrimPrefix(part, "!")
+			req.op = "!exists"
+		default:
+			req.key = part
+			req.op = "exists"
+		}
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if !labelKeyPattern.MatchString(req.key) || !labelValuePattern.MatchString(req.value) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid label selector requirement %q", part))
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// matches returns true if `labels` meet all requirements of the selector.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		switch req.op {
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	// Under the state dir, unless ha.lock_file says otherwise.
+	leaderLockFileName = "leader.lock"
+
+	defaultLeaderRetryInterval = time.Second
+)
+
+// LeaderInfo describes the server holding the leader lock. It's written to the lock file so that
+// standbys can say who they're waiting on.
+type LeaderInfo struct {
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Address string    `json:"address"`
+	Since   time.Time `json:"since"`
+}
+
+// LeaderLock is an exclusive lock on the leader lock file. The kernel releases it when the process
+// holding it dies, however it dies, which is what hands leadership to a standby.
+type LeaderLock struct {
+	file *os.File
+}
+
+// LeaderLockPath returns the lock file of the high-availability setup `cfg` is part of.
+func LeaderLockPath(cfg config.ServerConfig) string {
+	if cfg.HA.LockFile != "" {
+		return cfg.HA.LockFile
+	}
+	return path.Join(cfg.StateDir, leaderLockFileName)
+}
+
+// AcquireLeaderLock blocks until this server holds the leader lock at `lockPath`, trying every
+// `retry`, and records `info` in it with the time it took over. `onStandby` is called with the
+// current leader, if known, whenever a try fails. Fails only if the lock file can't be opened or
+// `ctx` is done.
+func AcquireLeaderLock(ctx context.Context, lockPath string, retry time.Duration, info LeaderInfo, onStandby func(*LeaderInfo)) (*LeaderLock, error) {
+	if retry <= 0 {
+		retry = defaultLeaderRetryInterval
+	}
+	if err := os.MkdirAll(path.Dir(lockPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory of leader lock: %w", err)
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open leader lock: %w", err)
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", lockPath, err)
+		}
+		leader, _ := CurrentLeader(lockPath)
+		onStandby(leader)
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+
+	info.Since = time.Now().UTC()
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteAt(data, 0)
+	}
+	if err != nil {
+		// Only standbys read it, the lock is what counts.
+		log.WithError(err).Warn("failed to record leader in lock file")
+	}
+	return &LeaderLock{file: file}, nil
+}
+
+// Release gives up leadership, letting a standby take over.
+func (l *LeaderLock) Release() {
+	l.file.Close()
+}
+
+// CurrentLeader returns the server that last took the leader lock at `lockPath`, nil if none ever
+// did.
+func CurrentLeader(lockPath string) (*LeaderInfo, error) {
+	data, err := os.ReadFile(lockPath)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var info LeaderInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid leader lock %s: %w", lockPath, err)
+	}
+	return &info, nil
+}
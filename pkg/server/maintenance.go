@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// Under the state dir.
+const maintenanceFileName = "maintenance.json"
+
+// maintenanceWindow is a scheduled period during which the host is cordoned.
+type maintenanceWindow struct {
+	ID     string    `json:"id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (w *maintenanceWindow) activeAt(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+// maintenanceState is what's kept in the maintenance file.
+type maintenanceState struct {
+	// Set through the API, as opposed to by a window.
+	Cordoned     bool                 `json:"cordoned"`
+	CordonReason string               `json:"cordonReason,omitempty"`
+	CordonedAt   time.Time            `json:"cordonedAt"`
+	Windows      []*maintenanceWindow `json:"windows,omitempty"`
+}
+
+// maintenance tracks whether the host is cordoned, i.e. refuses new VMs so that schedulers place
+// them elsewhere. It's kept in a file so that a cordon survives restarts.
+type maintenance struct {
+	lock  sync.Mutex
+	path  string
+	state maintenanceState
+	// Fire at the start and end of each window, keyed by window ID.
+	timers map[string][]*time.Timer
+	// Whether the last published event said the host is cordoned.
+	announced bool
+}
+
+// newMaintenance loads the maintenance state in `path`, dropping windows that are over. A missing
+// file means the host isn't cordoned.
+func newMaintenance(path string) (*maintenance, error) {
+	m := &maintenance{path: path, timers: make(map[string][]*time.Timer)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance state: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.state); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance state: %s: %w", path, err)
+	}
+	m.pruneLocked(time.Now())
+	return m, nil
+}
+
+// saveLocked writes the state out, replacing the file atomically.
+func (m *maintenance) saveLocked() error {
+	data, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save maintenance state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save maintenance state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save maintenance state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return fmt.Errorf("failed to save maintenance state: %w", err)
+	}
+	return nil
+}
+
+// pruneLocked drops the windows that are over and returns true if there were any.
+func (m *maintenance) pruneLocked(now time.Time) bool {
+	n := len(m.state.Windows)
+	m.state.Windows = slices.DeleteFunc(m.state.Windows, func(w *maintenanceWindow) bool {
+		if now.Before(w.End) {
+			return false
+		}
+		delete(m.timers, w.ID)
+		return true
+	})
+	return len(m.state.Windows) != n
+}
+
+// cordonReasonLocked returns why the host is cordoned, and false if it isn't.
+func (m *maintenance) cordonReasonLocked(now time.Time) (string, bool) {
+	if m.state.Cordoned {
+		return m.state.CordonReason, true
+	}
+	for _, w := range m.state.Windows {
+		if w.activeAt(now) {
+			return w.Reason, true
+		}
+	}
+	return "", false
+}
+
+// CordonReason returns why the host is cordoned, and false if it isn't. New VMs are refused while
+// the host is cordoned.
+func (s *Server) CordonReason() (string, bool) {
+	s.maintenance.lock.Lock()
+	defer s.maintenance.lock.Unlock()
+	return s.maintenance.cordonReasonLocked(time.Now())
+}
+
+// checkCordon returns an Unavailable error if the host is cordoned.
+func (s *Server) checkCordon() error {
+	reason, cordoned := s.CordonReason()
+	if !cordoned {
+		return nil
+	}
+	if reason == "" {
+		return status.Error(codes.Unavailable, "host is cordoned")
+	}
+	return status.Errorf(codes.Unavailable, "host is cordoned: %s", reason)
+}
+
+// scheduleMaintenanceTimers arranges for cordon events at the start and end of every window.
+func (s *Server) scheduleMaintenanceTimers() {
+	s.maintenance.lock.Lock()
+	defer s.maintenance.lock.Unlock()
+	for _, w := range s.maintenance.state.Windows {
+		s.scheduleWindowLocked(w)
+	}
+	s.announceCordonLocked(time.Now())
+}
+
+func (s *Server) scheduleWindowLocked(w *maintenanceWindow) {
+	now := time.Now()
+	var timers []*time.Timer
+	for _, at := range []time.Time{w.Start, w.End} {
+		if at.After(now) {
+			timers = append(timers, time.AfterFunc(at.Sub(now), s.maintenanceTick))
+		}
+	}
+	s.maintenance.timers[w.ID] = timers
+}
+
+// maintenanceTick runs when a window starts or ends.
+func (s *Server) maintenanceTick() {
+	s.maintenance.lock.Lock()
+	defer s.maintenance.lock.Unlock()
+
+	now := time.Now()
+	if s.maintenance.pruneLocked(now) {
+		if err := s.maintenance.saveLocked(); err != nil {
+			log.WithError(err).Warn("failed to save maintenance state")
+		}
+	}
+	s.announceCordonLocked(now)
+}
+
+// announceCordonLocked publishes an event if the host was cordoned or uncordoned since the last
+// one.
+func (s *Server) announceCordonLocked(now time.Time) {
+	reason, cordoned := s.maintenance.cordonReasonLocked(now)
+	if cordoned == s.maintenance.announced {
+		return
+	}
+	s.maintenance.announced = cordoned
+	if cordoned {
+		log.WithField("reason", reason).Info("host cordoned")
+		s.events.Publish(events.HostCordoned, "", map[string]string{"reason": reason})
+	} else {
+		log.Info("host uncordoned")
+		s.events.Publish(events.HostUncordoned, "", nil)
+	}
+}
+
+// CordonHost cordons the host until UncordonHost is called.
+func (s *Server) CordonHost(ctx context.Context, reason string) (*serverapi.MaintenanceStatus, error) {
+	s.maintenance.lock.Lock()
+	old := s.maintenance.state
+	s.maintenance.state.Cordoned = true
+	s.maintenance.state.CordonReason = reason
+	if !old.Cordoned {
+		s.maintenance.state.CordonedAt = time.Now().UTC()
+	}
+	if err := s.maintenance.saveLocked(); err != nil {
+		s.maintenance.state = old
+		s.maintenance.lock.Unlock()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.announceCordonLocked(time.Now())
+	s.maintenance.lock.Unlock()
+	return s.MaintenanceStatus(ctx), nil
+}
+
+// UncordonHost lifts the cordon set by CordonHost. Windows in progress still keep the host
+// cordoned.
+func (s *Server) UncordonHost(ctx context.Context) (*serverapi.MaintenanceStatus, error) {
+	s.maintenance.lock.Lock()
+	old := s.maintenance.state
+	s.maintenance.state.Cordoned = false
+	s.maintenance.state.CordonReason = ""
+	s.maintenance.state.CordonedAt = time.Time{}
+	if err := s.maintenance.saveLocked(); err != nil {
+		s.maintenance.state = old
+		s.maintenance.lock.Unlock()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.announceCordonLocked(time.Now())
+	s.maintenance.lock.Unlock()
+	return s.MaintenanceStatus(ctx), nil
+}
+
+// ScheduleMaintenance adds a window during which the host is cordoned.
+func (s *Server) ScheduleMaintenance(ctx context.Context, req *serverapi.MaintenanceWindowRequest) (*serverapi.MaintenanceWindow, error) {
+	if !req.End.After(req.Start) {
+		return nil, status.Error(codes.InvalidArgument, "maintenance window must end after it starts")
+	}
+	now := time.Now()
+	if !req.End.After(now) {
+		return nil, status.Error(codes.InvalidArgument, "maintenance window is already over")
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create window id: %v", err)
+	}
+	w := &maintenanceWindow{
+		ID:     hex.EncodeToString(b),
+		Start:  req.Start.UTC(),
+		End:    req.End.UTC(),
+		Reason: req.GetReason(),
+	}
+
+	s.maintenance.lock.Lock()
+	defer s.maintenance.lock.Unlock()
+	s.maintenance.state.Windows = append(s.maintenance.state.Windows, w)
+	if err := s.maintenance.saveLocked(); err != nil {
+		s.maintenance.state.Windows = s.maintenance.state.Windows[:len(s.maintenance.state.Windows)-1]
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.scheduleWindowLocked(w)
+	s.announceCordonLocked(now)
+
+	log.WithFields(log.Fields{
+		"id":     w.ID,
+		"start":  w.Start,
+		"end":    w.End,
+		"reason": w.Reason,
+	}).Info("scheduled maintenance window")
+	return convertMaintenanceWindow(w, now), nil
+}
+
+// CancelMaintenance removes the window with `id`, ending it if it's in progress.
+func (s *Server) CancelMaintenance(ctx context.Context, id string) (*serverapi.MaintenanceStatus, error) {
+	s.maintenance.lock.Lock()
+	i := slices.IndexFunc(s.maintenance.state.Windows, func(w *maintenanceWindow) bool { return w.ID == id })
+	if i == -1 {
+		s.maintenance.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "maintenance window %s not found", id)
+	}
+	old := s.maintenance.state.Windows
+	s.maintenance.state.Windows = slices.Delete(slices.Clone(old), i, i+1)
+	if err := s.maintenance.saveLocked(); err != nil {
+		s.maintenance.state.Windows = old
+		s.maintenance.lock.Unlock()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, t := range s.maintenance.timers[id] {
+		t.Stop()
+	}
+	delete(s.maintenance.timers, id)
+	s.announceCordonLocked(time.Now())
+	s.maintenance.lock.Unlock()
+
+	log.WithField("id", id).Info("cancelled maintenance window")
+	return s.MaintenanceStatus(ctx), nil
+}
+
+// MaintenanceStatus returns whether the host is cordoned, its upcoming maintenance windows and the
+// VMs that would have to move off the host for maintenance.
+func (s *Server) MaintenanceStatus(ctx context.Context) *serverapi.MaintenanceStatus {
+	now := time.Now()
+	resp := &serverapi.MaintenanceStatus{}
+
+	s.maintenance.lock.Lock()
+	reason, cordoned := s.maintenance.cordonReasonLocked(now)
+	resp.Cordoned = serverapi.PtrBool(cordoned)
+	resp.Reason = serverapi.PtrString(reason)
+	resp.ManuallyCordoned = serverapi.PtrBool(s.maintenance.state.Cordoned)
+	if s.maintenance.state.Cordoned {
+		resp.CordonedAt = serverapi.PtrTime(s.maintenance.state.CordonedAt)
+	}
+	for _, w := range s.maintenance.state.Windows {
+		if now.Before(w.End) {
+			resp.Windows = append(resp.Windows, *convertMaintenanceWindow(w, now))
+		}
+	}
+	s.maintenance.lock.Unlock()
+	sort.Slice(resp.Windows, func(i, j int) bool {
+		return resp.Windows[i].GetStart().Before(resp.Windows[j].GetStart())
+	})
+
+	s.lock.RLock()
+	for name, vm := range s.vms {
+		namespace, vmName := SplitQualifiedName(name)
+		resp.Vms = append(resp.Vms, serverapi.MaintenanceVm{
+			Namespace: serverapi.PtrString(namespace),
+			VmName:    serverapi.PtrString(vmName),
+			Status:    serverapi.PtrString(vm.status.String()),
+			Owner:     serverapi.PtrString(vm.owner),
+			Protected: serverapi.PtrBool(vm.protected),
+		})
+	}
+	s.lock.RUnlock()
+	sort.Slice(resp.Vms, func(i, j int) bool {
+		if resp.Vms[i].GetNamespace() != resp.Vms[j].GetNamespace() {
+			return resp.Vms[i].GetNamespace() < resp.Vms[j].GetNamespace()
+		}
+		return resp.Vms[i].GetVmName() < resp.Vms[j].GetVmName()
+	})
+	return resp
+}
+
+func convertMaintenanceWindow(w *maintenanceWindow, now time.Time) *serverapi.MaintenanceWindow {
+	return &serverapi.MaintenanceWindow{
+		Id:     serverapi.PtrString(w.ID),
+		Start:  serverapi.PtrTime(w.Start),
+		End:    serverapi.PtrTime(w.End),
+		Reason: serverapi.PtrString(w.Reason),
+		Active: serverapi.PtrBool(w.activeAt(now)),
+	}
+}
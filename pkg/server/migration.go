@@ -0,0 +1,528 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
+)
+
+const (
+	operationVMMigrate = "vm.migrate"
+	// Clients of a migrated VM are redirected to its destination for this long.
+	migratedVMRedirectTTL = 24 * time.Hour
+)
+
+// migratedVM is where a VM sent to another host went.
+type migratedVM struct {
+	destination string
+	migratedAt  time.Time
+}
+
+// migrationPeer talks to the server a VM migrates to.
+type migrationPeer struct {
+	// host:port of the server.
+	destination string
+	apiKey      string
+	api         *serverapi.DefaultAPIService
+}
+
+func newMigrationPeer(destination string, apiKey string) *migrationPeer {
+	configuration := serverapi.NewConfiguration()
+	configuration.Servers = serverapi.ServerConfigurations{
+		{
+			URL:         "http://" + destination,
+			Description: "migration destination",
+		},
+	}
+	if apiKey != "" {
+		configuration.AddDefaultHeader("Authorization", "Bearer "+apiKey)
+	}
+	return &migrationPeer{
+		destination: destination,
+		apiKey:      apiKey,
+		api:         serverapi.NewAPIClient(configuration).DefaultAPI,
+	}
+}
+
+func (p *migrationPeer) header() http.Header {
+	header := http.Header{}
+	if p.apiKey != "" {
+		header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	return header
+}
+
+// sendDisk sends the blocks of the stateful disk `f` whose hashes differ from `sent` to migration
+// `id`, see writeChangedDiskBlocks.
+func (p *migrationPeer) sendDisk(ctx context.Context, id string, f *os.File, size int64, sent [][sha256.Size]byte) ([][sha256.Size]byte, int64, error) {
+	pr, pw := io.Pipe()
+	var hashes [][sha256.Size]byte
+	var written int64
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		var err error
+		hashes, written, err = writeChangedDiskBlocks(pw, f, size, sent)
+		pw.CloseWithError(err)
+	}()
+
+	u := fmt.Sprintf("http://%s/v1/admin/migrations/%s/disk", p.destination, url.PathEscape(id))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		<-writeDone
+		return nil, 0, err
+	}
+	req.Header = p.header()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	// Unblocks the writer if the request ended before the body was read.
+	pr.CloseWithError(errors.New("request done"))
+	<-writeDone
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to send stateful disk: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, 0, peerError("receive the stateful disk", resp, errors.New(resp.Status))
+	}
+	resp.Body.Close()
+	if hashes == nil {
+		return nil, 0, errors.New("failed to send stateful disk: destination stopped reading")
+	}
+	return hashes, written, nil
+}
+
+// dialMemory connects to the memory stream of migration `id`.
+func (p *migrationPeer) dialMemory(ctx context.Context, id string) (*websocket.Conn, error) {
+	u := fmt.Sprintf("ws://%s/v1/admin/migrations/%s/memory", p.destination, url.PathEscape(id))
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, u, p.header())
+	if err != nil {
+		if resp != nil {
+			return nil, peerError("open the memory stream", resp, err)
+		}
+		return nil, fmt.Errorf("failed to open the memory stream: %w", err)
+	}
+	return ws, nil
+}
+
+// peerError returns an error with the message the destination answered a failed request with.
+func peerError(action string, httpResp *http.Response, err error) error {
+	if httpResp == nil {
+		return fmt.Errorf("destination failed to %s: %w", action, err)
+	}
+	defer httpResp.Body.Close()
+	body, _ := io.ReadAll(httpResp.Body)
+	var errorResp serverapi.ErrorResponse
+	if json.Unmarshal(body, &errorResp) == nil && errorResp.Error != nil {
+		return fmt.Errorf("destination failed to %s: %s (HTTP %d)", action, errorResp.Error.GetMessage(), httpResp.StatusCode)
+	}
+	return fmt.Errorf("destination failed to %s: %w (HTTP %d)", action, err, httpResp.StatusCode)
+}
+
+// migrationApiClient returns a cloud-hypervisor client for sending or receiving migrations, which
+// take as long as the VM's memory takes to copy.
+func migrationApiClient(apiSocketPath string) *chvapi.APIClient {
+	client := createApiClient(apiSocketPath)
+	client.GetConfig().HTTPClient.Timeout = 0
+	return client
+}
+
+// MigrateVM moves the running VM `vmName` to the arrakis server `req.Destination`, keeping its name.
+// The memory is copied with cloud-hypervisor's live migration while the VM runs, and the VM is only
+// paused for the last pass. Returns the operation to follow the migration with. Once done, requests
+// for the VM are redirected to the destination.
+func (s *Server) MigrateVM(ctx context.Context, vmName string, req *serverapi.MigrateVMRequest) (*serverapi.Operation, error) {
+	destination := req.Destination
+	if _, _, err := net.SplitHostPort(destination); err != nil || strings.ContainsAny(destination, "/?#@") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid destination %q: must be the host:port of an arrakis server", destination)
+	}
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if vm.status != vmStatusRunning {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, not running", vmName, vm.status)
+	}
+	if vm.migrating {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is already migrating", vmName)
+	}
+	if len(vm.sharedDirs) > 0 {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s has shared directories and can't be migrated", vmName)
+	}
+	if len(vm.dataDisks) > 0 {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s has data disks and can't be migrated", vmName)
+	}
+	if vm.diskOverlay {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "the stateful disk of vm %s is an overlay of base image %s and can't be migrated, snapshot it instead", vmName, vm.baseImage)
+	}
+	vm.migrating = true
+	incoming := serverapi.IncomingMigrationRequest{
+		VmName:       vmName,
+		GuestName:    serverapi.PtrString(vm.guestName),
+		Owner:        serverapi.PtrString(vm.owner),
+		Protected:    serverapi.PtrBool(vm.protected),
+		SessionToken: serverapi.PtrString(vm.sessionToken),
+		Services:     convertVsockServices(vm.services),
+		NetworkMode:  serverapi.PtrString(vm.networkMode),
+		Egress:       convertEgressPolicy(vm.egress),
+		NetworkLimit: convertNetworkLimit(vm.networkLimit),
+		DiskLimit:    convertDiskLimit(vm.diskLimit),
+	}
+	if len(vm.labels) > 0 {
+		labels := maps.Clone(vm.labels)
+		incoming.Labels = &labels
+	}
+	s.lock.Unlock()
+
+	started := false
+	defer func() {
+		if !started {
+			s.lock.Lock()
+			vm.migrating = false
+			s.lock.Unlock()
+		}
+	}()
+
+	info, _, err := vm.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get vm info: %v", err)
+	}
+	// The destination needs the same files at the same paths.
+	for _, image := range []*string{info.Config.Payload.Kernel, info.Config.Payload.Initramfs} {
+		if image != nil && *image != "" {
+			incoming.Images = append(incoming.Images, *image)
+		}
+	}
+	for _, disk := range info.Config.Disks {
+		if disk.Readonly != nil && *disk.Readonly {
+			incoming.Images = append(incoming.Images, disk.Path)
+		}
+	}
+	var memorySize int64
+	if info.Config.Memory != nil {
+		memorySize = info.Config.Memory.Size
+	}
+	diskInfo, err := os.Stat(vm.statefulDiskPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat stateful disk: %v", err)
+	}
+	incoming.StatefulDiskSize = diskInfo.Size()
+	secret, err := os.ReadFile(path.Join(vm.stateDirPath, guestcall.VsockSecretFilename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.Internal, "failed to read vsock secret: %v", err)
+	}
+	if len(secret) > 0 {
+		incoming.VsockSecret = serverapi.PtrString(strings.TrimSpace(string(secret)))
+	}
+	namespace, name := SplitQualifiedName(vmName)
+	if handoff := s.sessionManager.HandOffSession(namespace, name); handoff != nil {
+		incoming.CallbackUrl = serverapi.PtrString(handoff.CallbackURL)
+		incoming.CallbackSessionId = serverapi.PtrString(handoff.SessionID)
+		incoming.ReconnectToken = serverapi.PtrString(handoff.ReconnectToken)
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	op, err := s.operations.start(ctx, operationVMMigrate, vmName, incoming.StatefulDiskSize+memorySize)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	started = true
+
+	logger := log.WithFields(log.Fields{
+		"vmName":      vmName,
+		"operationId": op.id,
+		"destination": destination,
+	})
+	logger.Info("migrating VM")
+	go func() {
+		defer done()
+		peer := newMigrationPeer(destination, req.GetApiKey())
+		result, err := s.migrateVM(context.Background(), vm, &incoming, peer, op)
+		if err != nil {
+			logger.WithError(err).Error("failed to migrate VM")
+		} else {
+			logger.Info("migrated VM")
+		}
+		s.lock.Lock()
+		vm.migrating = false
+		s.lock.Unlock()
+		s.operations.finish(op, result, err)
+	}()
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return convertOperation(op), nil
+}
+
+// migrateVM sends `vm` to the server of `peer`. Until cloud-hypervisor sent the VM, failures leave
+// the VM running here.
+func (s *Server) migrateVM(ctx context.Context, vm *vm, incoming *serverapi.IncomingMigrationRequest, peer *migrationPeer, op *operation) (_ map[string]string, retErr error) {
+	ctx, span := tracing.Start(ctx, "server.migrateVM", tracing.String("vm.name", vm.name))
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+	logger := log.WithFields(log.Fields{
+		"vmName":      vm.name,
+		"destination": peer.destination,
+	})
+
+	prepared, httpResp, err := peer.api.V1AdminMigrationsPost(ctx).IncomingMigrationRequest(*incoming).Execute()
+	if err != nil {
+		return nil, peerError("prepare the migration", httpResp, err)
+	}
+	id := prepared.GetId()
+	sent := false
+	defer func() {
+		if sent {
+			return
+		}
+		if _, httpResp, err := peer.api.V1AdminMigrationsIdDelete(context.Background(), id).Execute(); err != nil {
+			logger.WithError(peerError("abort the migration", httpResp, err)).Warn("failed to abort migration")
+		}
+	}()
+	ip, ipNet, err := net.ParseCIDR(prepared.GetIp())
+	if err != nil {
+		return nil, fmt.Errorf("destination gave an invalid IP %q: %w", prepared.GetIp(), err)
+	}
+	identity := forkIdentity{
+		name:      vm.guestName,
+		stateDir:  prepared.GetStateDir(),
+		tap:       prepared.GetTapDevice(),
+		guestIP:   &net.IPNet{IP: ip, Mask: ipNet.Mask},
+		cid:       uint32(prepared.GetCid()),
+		vsockPath: prepared.GetVsockSocket(),
+	}
+
+	// The disk is sent whole while the VM runs, and what changed since once it's paused.
+	disk, err := os.Open(vm.statefulDiskPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stateful disk: %w", err)
+	}
+	defer disk.Close()
+	hashes, n, err := peer.sendDisk(ctx, id, disk, incoming.StatefulDiskSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.operations.progress(op, n)
+
+	socketPath := path.Join(vm.stateDirPath, migrationSocketFilename)
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the migration stream: %w", err)
+	}
+	defer os.Remove(socketPath)
+	defer listener.Close()
+	if err := vm.jail.own(socketPath); err != nil {
+		return nil, err
+	}
+	ws, err := peer.dialMemory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	relay := &migrationRelay{
+		rewriteConfig: func(config []byte) ([]byte, error) {
+			return rewriteMigrationConfig(config, identity)
+		},
+		onPaused: func() error {
+			_, n, err := peer.sendDisk(ctx, id, disk, incoming.StatefulDiskSize, hashes)
+			s.operations.progress(op, n)
+			return err
+		},
+		progress: func(n int64) {
+			s.operations.progress(op, n)
+		},
+	}
+	relayDone := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			ws.Close()
+			relayDone <- err
+			return
+		}
+		relayDone <- relay.run(conn, ws)
+	}()
+
+	sendErr := vm.sendMigration(ctx, socketPath)
+	// Unblocks the relay if cloud-hypervisor never connected.
+	listener.Close()
+	relayErr := <-relayDone
+	if sendErr != nil {
+		if relayErr != nil && !errors.Is(relayErr, net.ErrClosed) {
+			sendErr = fmt.Errorf("%w: %v", sendErr, relayErr)
+		}
+		// cloud-hypervisor resumes the VM if the migration fails after pausing it, make sure.
+		if info, _, err := vm.apiClient.DefaultAPI.VmInfoGet(ctx).Execute(); err == nil && info.State == "Paused" {
+			if err := vm.resume(ctx); err != nil {
+				logger.WithError(err).Error("failed to resume VM after failed migration")
+			}
+		}
+		return nil, sendErr
+	}
+	sent = true
+
+	// Past this point the VM only exists on the destination.
+	s.releaseMigratedVM(vm, peer.destination)
+	resp, httpResp, err := peer.api.V1AdminMigrationsIdCompletePost(ctx, id).Execute()
+	if err != nil {
+		return nil, peerError("complete the migration", httpResp, err)
+	}
+	return map[string]string{
+		"destination": peer.destination,
+		"ip":          resp.GetIp(),
+	}, nil
+}
+
+// sendMigration has cloud-hypervisor send the VM to the receiver listening on `socketPath`. It
+// returns once the VM was sent, after which cloud-hypervisor exits, or the migration failed.
+// `v.lock` isn't held, so that the VM can be used while its memory is copied.
+func (v *vm) sendMigration(ctx context.Context, socketPath string) error {
+	req := migrationApiClient(v.apiSocketPath).DefaultAPI.VmSendMigrationPut(ctx)
+	req = req.SendMigrationData(chvapi.SendMigrationData{
+		DestinationUrl: "unix:" + socketPath,
+	})
+	resp, err := req.Execute()
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to send migration: %d: %s: %w", resp.StatusCode, string(body), err)
+		}
+		return fmt.Errorf("failed to send migration: %w", err)
+	}
+	if resp.StatusCode != 204 {
+		return fmt.Errorf("failed to send migration. bad status: %v", resp)
+	}
+	return nil
+}
+
+// rewriteMigrationConfig returns the payload `data` of the migration's config request with the VM
+// config moved to the destination's devices and state directory. The guest keeps its MAC.
+func rewriteMigrationConfig(data []byte, identity forkIdentity) ([]byte, error) {
+	// Besides the VM config, the payload has CPU and memory state we pass on as is.
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal migration config: %w", err)
+	}
+	vmConfig, ok := payload["vm_config"]
+	if !ok {
+		return nil, errors.New("migration config has no vm_config")
+	}
+	var netConfig struct {
+		Net []struct {
+			Mac string `json:"mac"`
+		} `json:"net"`
+	}
+	if err := json.Unmarshal(vmConfig, &netConfig); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vm config: %w", err)
+	}
+	if len(netConfig.Net) != 1 || netConfig.Net[0].Mac == "" {
+		return nil, errors.New("the migrating VM has no MAC address")
+	}
+	identity.mac = netConfig.Net[0].Mac
+	vmConfig, err := rewriteForkConfig(vmConfig, identity)
+	if err != nil {
+		return nil, err
+	}
+	payload["vm_config"] = vmConfig
+	return json.Marshal(payload)
+}
+
+// releaseMigratedVM forgets `vm`, which cloud-hypervisor sent to `destination` and then exited, and
+// frees what it used here. Its clients are redirected to the destination from now on.
+func (s *Server) releaseMigratedVM(vm *vm, destination string) {
+	logger := log.WithField("vmName", vm.name)
+	s.closeSocketForwards(vm)
+	vm.lock.Lock()
+	if err := vm.unmountHostFilesystem(); err != nil {
+		logger.Warnf("failed to unmount VM filesystem from host: %v", err)
+	}
+	if err := reapProcess(vm.process, logger, reapVmTimeout); err != nil {
+		logger.Warnf("failed to reap VM process: %v", err)
+	}
+	vm.lock.Unlock()
+	if err := cleanupAllIPTablesRulesForIP(vm.ip.IP.String()); err != nil {
+		logger.Warnf("failed to delete iptables rules: %v", err)
+	}
+	if err := s.applyEgressPolicy(vm, nil); err != nil {
+		logger.WithError(err).Warn("failed to delete egress rules")
+	}
+	if err := os.RemoveAll(vm.stateDirPath); err != nil {
+		logger.Warnf("failed to delete directory %s: %v", vm.stateDirPath, err)
+	}
+	if err := s.fountain.DestroyTapDevice(vm.tapDevice); err != nil {
+		logger.WithError(err).Errorf("failed to delete tap device: %s", vm.tapDevice)
+	}
+	if err := s.ipAllocator.FreeIP(vm.ip.IP); err != nil {
+		logger.WithError(err).Errorf("failed to free IP: %s", vm.ip.String())
+	}
+	if err := s.cidAllocator.FreeCID(vm.cid); err != nil {
+		logger.WithError(err).Errorf("failed to free CID: %d", vm.cid)
+	}
+
+	now := time.Now()
+	s.lock.Lock()
+	delete(s.vms, vm.name)
+	for name, migrated := range s.migratedVMs {
+		if now.Sub(migrated.migratedAt) > migratedVMRedirectTTL {
+			delete(s.migratedVMs, name)
+		}
+	}
+	s.migratedVMs[vm.name] = migratedVM{destination: destination, migratedAt: now}
+	s.lock.Unlock()
+	s.warmPool.removeVM(vm.name)
+	namespace, name := SplitQualifiedName(vm.name)
+	s.sessionManager.RemoveSession(namespace, name)
+	s.vmsChanged()
+	s.events.Publish(events.VMMigrated, vm.name, map[string]string{"destination": destination})
+}
+
+// MigratedTo returns the host:port of the server `vmName` was migrated to, if it was recently and
+// no VM of that name has been created here since.
+func (s *Server) MigratedTo(vmName string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if _, ok := s.vms[vmName]; ok {
+		return "", false
+	}
+	migrated, ok := s.migratedVMs[vmName]
+	if !ok || time.Since(migrated.migratedAt) > migratedVMRedirectTTL {
+		return "", false
+	}
+	return migrated.destination, true
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+// cloud-hypervisor's migration protocol, see vm-migration/src/protocol.rs of cloud-hypervisor. The
+// sender writes requests, each a header of a 2 byte command, 6 bytes of padding and an 8 byte
+// payload length, little endian, followed by the payload. The receiver answers every request with
+// a response of the same shape.
+const (
+	migrationCommandConfig = 2
+	migrationCommandState  = 3
+	migrationCommandMemory = 4
+
+	migrationHeaderSize = 16
+	// Memory requests list the ranges of guest memory that follow as a guest address and a length.
+	migrationMemoryRangeSize = 16
+	// Largest config or memory range table read into memory.
+	maxMigrationPayload = 64 << 20
+	// Memory is relayed in messages of at most this size.
+	migrationChunkSize = 1 << 20
+)
+
+// The stateful disk is compared and sent in blocks of this size. Every block on the wire has a
+// header of an 8 byte offset and a 4 byte length, big endian.
+const (
+	diskBlockSize       = 1 << 20
+	diskBlockHeaderSize = 12
+)
+
+// migrationRelay forwards the migration stream of the source's cloud-hypervisor to the
+// destination, rewriting the VM config on the way and holding the stream once the source VM is
+// paused for good.
+type migrationRelay struct {
+	// Returns the VM config for the destination.
+	rewriteConfig func(config []byte) ([]byte, error)
+	// Called before the VM's device state is sent, which cloud-hypervisor does once it paused the
+	// VM for the last pass over its memory.
+	onPaused func() error
+	// Called with the number of bytes of memory relayed.
+	progress func(n int64)
+}
+
+// run relays between the connection `chv` of cloud-hypervisor and the WebSocket `ws` to the
+// destination until cloud-hypervisor closes the connection, which it does once the migration is
+// over.
+func (r *migrationRelay) run(chv net.Conn, ws *websocket.Conn) error {
+	responsesDone := make(chan struct{})
+	go func() {
+		defer close(responsesDone)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := chv.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := r.forwardRequests(chv, ws)
+	// cloud-hypervisor only hangs up once it read the last response, or on errors.
+	ws.Close()
+	chv.Close()
+	<-responsesDone
+	return err
+}
+
+func (r *migrationRelay) forwardRequests(chv net.Conn, ws *websocket.Conn) error {
+	header := make([]byte, migrationHeaderSize)
+	buf := make([]byte, migrationChunkSize)
+	for {
+		if _, err := io.ReadFull(chv, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read migration request: %w", err)
+		}
+		command := binary.LittleEndian.Uint16(header[0:2])
+		length := binary.LittleEndian.Uint64(header[8:16])
+
+		switch command {
+		case migrationCommandConfig:
+			config, err := readMigrationPayload(chv, length)
+			if err != nil {
+				return err
+			}
+			if config, err = r.rewriteConfig(config); err != nil {
+				return fmt.Errorf("failed to rewrite VM config: %w", err)
+			}
+			binary.LittleEndian.PutUint64(header[8:16], uint64(len(config)))
+			if err := ws.WriteMessage(websocket.BinaryMessage, append(header, config...)); err != nil {
+				return err
+			}
+
+		case migrationCommandMemory:
+			table, err := readMigrationPayload(chv, length)
+			if err != nil {
+				return err
+			}
+			if len(table)%migrationMemoryRangeSize != 0 {
+				return fmt.Errorf("invalid memory range table of %d bytes", len(table))
+			}
+			var size uint64
+			for i := 0; i < len(table); i += migrationMemoryRangeSize {
+				size += binary.LittleEndian.Uint64(table[i+8 : i+16])
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, append(header, table...)); err != nil {
+				return err
+			}
+			if err := relayBytes(ws, chv, size, buf); err != nil {
+				return err
+			}
+			r.progress(int64(size))
+
+		default:
+			if command == migrationCommandState {
+				if err := r.onPaused(); err != nil {
+					return err
+				}
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, header); err != nil {
+				return err
+			}
+			if err := relayBytes(ws, chv, length, buf); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readMigrationPayload(r io.Reader, length uint64) ([]byte, error) {
+	if length > maxMigrationPayload {
+		return nil, fmt.Errorf("migration request of %d bytes is too large", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read migration request: %w", err)
+	}
+	return payload, nil
+}
+
+// relayBytes sends the next `n` bytes of `r` over `ws`, using `buf` to read them.
+func relayBytes(ws *websocket.Conn, r io.Reader, n uint64, buf []byte) error {
+	for n > 0 {
+		chunk := buf[:min(n, uint64(len(buf)))]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("failed to read migration stream: %w", err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+			return err
+		}
+		n -= uint64(len(chunk))
+	}
+	return nil
+}
+
+// writeChangedDiskBlocks writes the blocks of the disk `f`, `size` bytes long, whose hashes
+// differ from `sent` to `w`, and returns the hashes of all blocks and the number of bytes written.
+// A nil `sent` stands for a disk of zeros, as the destination's starts out.
+func writeChangedDiskBlocks(w io.Writer, f *os.File, size int64, sent [][sha256.Size]byte) ([][sha256.Size]byte, int64, error) {
+	blocks := int((size + diskBlockSize - 1) / diskBlockSize)
+	hashes := make([][sha256.Size]byte, blocks)
+	zeroHash := sha256.Sum256(make([]byte, diskBlockSize))
+	buf := make([]byte, diskBlockHeaderSize+diskBlockSize)
+	var written int64
+	for i := range blocks {
+		offset := int64(i) * diskBlockSize
+		block := buf[diskBlockHeaderSize : diskBlockHeaderSize+min(diskBlockSize, size-offset)]
+		if _, err := f.ReadAt(block, offset); err != nil {
+			return nil, 0, fmt.Errorf("failed to read disk: %w", err)
+		}
+		hashes[i] = sha256.Sum256(block)
+		previous := zeroHash
+		if sent != nil {
+			previous = sent[i]
+		} else if len(block) < diskBlockSize {
+			previous = sha256.Sum256(make([]byte, len(block)))
+		}
+		if hashes[i] == previous {
+			continue
+		}
+		binary.BigEndian.PutUint64(buf[0:8], uint64(offset))
+		binary.BigEndian.PutUint32(buf[8:12], uint32(len(block)))
+		if _, err := w.Write(buf[:diskBlockHeaderSize+len(block)]); err != nil {
+			return nil, 0, err
+		}
+		written += int64(len(block))
+	}
+	return hashes, written, nil
+}
+
+// readDiskBlocks writes the blocks read from `r` to the disk `f`, `size` bytes long.
+func readDiskBlocks(r io.Reader, f *os.File, size int64) error {
+	header := make([]byte, diskBlockHeaderSize)
+	buf := make([]byte, diskBlockSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read block header: %w", err)
+		}
+		offset := int64(binary.BigEndian.Uint64(header[0:8]))
+		length := int64(binary.BigEndian.Uint32(header[8:12]))
+		if length > diskBlockSize || offset < 0 || offset+length > size {
+			return fmt.Errorf("block of %d bytes at %d lies outside the disk", length, offset)
+		}
+		block := buf[:length]
+		if _, err := io.ReadFull(r, block); err != nil {
+			return fmt.Errorf("failed to read block: %w", err)
+		}
+		if _, err := f.WriteAt(block, offset); err != nil {
+			return fmt.Errorf("failed to write block: %w", err)
+		}
+	}
+}
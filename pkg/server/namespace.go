@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// DefaultNamespace holds the VMs of clients that don't use namespaces.
+const DefaultNamespace = "default"
+
+// VMs outside the default namespace are known server-wide as "<name>.<namespace>". Default namespace
+// VMs keep their plain name, so that existing clients, snapshots and state dirs are unaffected.
+const namespaceSeparator = "."
+
+// Namespaces are DNS labels, so that qualified names can also serve as guest hostnames.
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// ValidateNamespace returns an InvalidArgument error if `namespace` isn't a valid namespace name.
+func ValidateNamespace(namespace string) error {
+	if !namespaceRegexp.MatchString(namespace) {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"invalid namespace %q: must be lowercase letters, digits and '-', at most 63 characters",
+			namespace,
+		)
+	}
+	return nil
+}
+
+// QualifiedName returns the server-wide name of the VM `name` in `namespace`. An empty namespace is
+// the default one.
+func QualifiedName(namespace string, name string) string {
+	if namespace == "" || namespace == DefaultNamespace {
+		return name
+	}
+	return name + namespaceSeparator + namespace
+}
+
+// SplitQualifiedName is the inverse of `QualifiedName`.
+func SplitQualifiedName(qualifiedName string) (namespace string, name string) {
+	i := strings.LastIndex(qualifiedName, namespaceSeparator)
+	if i == -1 {
+		return DefaultNamespace, qualifiedName
+	}
+	return qualifiedName[i+1:], qualifiedName[:i]
+}
+
+// DestroyNamespaceVMs destroys all VMs in `namespace` that the caller may change. Protected VMs
+// are skipped and reported unless `force` is set and the caller is an admin.
+func (s *Server) DestroyNamespaceVMs(ctx context.Context, namespace string, force bool) (*serverapi.DestroyAllVMsResponse, error) {
+	log.WithField("namespace", namespace).Infof("received request to destroy all VMs in namespace")
+
+	s.lock.RLock()
+	var vmNames []string
+	var protected []string
+	for name, vm := range s.vms {
+		if ns, _ := SplitQualifiedName(name); ns != namespace || authorizeVMLocked(ctx, vm) != nil {
+			continue
+		}
+		if checkProtectionLocked(ctx, vm, force) != nil {
+			_, vmName := SplitQualifiedName(name)
+			protected = append(protected, vmName)
+			continue
+		}
+		vmNames = append(vmNames, name)
+	}
+	s.lock.RUnlock()
+
+	var finalErr error
+	for _, vmName := range vmNames {
+		s.runHooks(ctx, hookPreDestroy, vmName, s.vmHooks(vmName))
+		if err := s.destroyVM(ctx, vmName); err != nil {
+			log.Warnf("failed to destroy and clean up vm: %s", vmName)
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	if finalErr != nil {
+		return nil, status.Errorf(codes.Internal, "failed to destroy VMs in namespace %s: %v", namespace, finalErr)
+	}
+
+	slices.Sort(protected)
+	return &serverapi.DestroyAllVMsResponse{
+		Success:      serverapi.PtrBool(true),
+		ProtectedVms: protected,
+	}, nil
+}
+
+// ListNamespaceVMs lists the VMs in `namespace` whose labels match `labelSelector`, under their
+// names within the namespace and sorted by name. If `limit` is positive, at most that many VMs are
+// returned along with a token for the next page, which is passed back as `pageToken`.
+func (s *Server) ListNamespaceVMs(ctx context.Context, namespace string, labelSelector string, limit int, pageToken string) (*serverapi.ListAllVMsResponse, error) {
+	selector, err := parseLabelSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var after string
+	if pageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		after = string(decoded)
+	}
+
+	all, err := s.ListAllVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// `all` may be shared through the read cache, so it's copied rather than modified.
+	resp := &serverapi.ListAllVMsResponse{}
+	for _, vm := range all.Vms {
+		ns, name := SplitQualifiedName(vm.GetVmName())
+		if ns != namespace || (after != "" && name <= after) || !selector.matches(vm.GetLabels()) {
+			continue
+		}
+		vm.VmName = serverapi.PtrString(name)
+		resp.Vms = append(resp.Vms, vm)
+	}
+	slices.SortFunc(resp.Vms, func(a, b serverapi.ListAllVMsResponseVmsInner) int {
+		return strings.Compare(a.GetVmName(), b.GetVmName())
+	})
+	if limit > 0 && len(resp.Vms) > limit {
+		resp.Vms = resp.Vms[:limit]
+		last := resp.Vms[limit-1].GetVmName()
+		resp.NextPageToken = serverapi.PtrString(base64.RawURLEncoding.EncodeToString([]byte(last)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/server/fountain"
+)
+
+// Network modes of VMs.
+const (
+	// On the server's bridge, behind the host's masquerading.
+	networkModeNAT = "nat"
+	// On an existing bridge, e.g. one with the host's uplink.
+	networkModeBridged = "bridged"
+	// On a bridge of their own, reaching only the host and each other.
+	networkModeHostOnly = "host_only"
+	// On a link of their own that the host reaches their agent over, and which they can't start
+	// connections on.
+	networkModeNone = "none"
+)
+
+const (
+	// Tap devices of VMs in networkModeNone are "ai<id>", so that one set of firewall rules covers
+	// all of them.
+	isolatedTapDevicePrefix = "ai"
+	// Snapshots keep the network mode of their VM in this file, VMs in networkModeNAT have none.
+	networkModeFilename = "network-mode"
+)
+
+// parseNetworkMode validates the network mode, IP pool and IP a start asks for, returning the mode,
+// the configured default if it asks for none, and the pool to allocate the VM's IP from.
+func (s *Server) parseNetworkMode(mode string, ipPool string, staticIP net.IP) (string, string, error) {
+	modes := s.config.NetworkModes
+	if mode == "" {
+		mode = modes.Default
+	}
+	var pool string
+	switch mode {
+	case networkModeNAT:
+		var err error
+		if pool, err = s.parseIPPool(ipPool); err != nil {
+			return "", "", err
+		}
+		if pool == modes.Bridged.Pool || pool == modes.HostOnly.Pool {
+			return "", "", status.Errorf(codes.InvalidArgument, "IP pool %s isn't for VMs in network mode nat", pool)
+		}
+		if staticIP != nil {
+			if p := s.ipAllocator.PoolOf(staticIP); p == modes.Bridged.Pool || p == modes.HostOnly.Pool {
+				return "", "", status.Errorf(codes.InvalidArgument, "IP %s isn't for VMs in network mode nat", staticIP)
+			}
+		}
+		return mode, pool, nil
+	case networkModeBridged:
+		if modes.Bridged.Bridge == "" {
+			return "", "", status.Errorf(codes.FailedPrecondition, "network mode bridged isn't configured on this server")
+		}
+		pool = modes.Bridged.Pool
+	case networkModeHostOnly, networkModeNone:
+		if modes.HostOnly.Pool == "" {
+			return "", "", status.Errorf(codes.FailedPrecondition, "network mode %s isn't configured on this server", mode)
+		}
+		pool = modes.HostOnly.Pool
+	default:
+		return "", "", status.Errorf(codes.InvalidArgument, "network mode must be nat, bridged, host_only or none, not %q", mode)
+	}
+	if ipPool != "" && ipPool != pool {
+		return "", "", status.Errorf(codes.InvalidArgument, "VMs in network mode %s get IPs of pool %s", mode, pool)
+	}
+	if staticIP != nil && s.ipAllocator.PoolOf(staticIP) != pool {
+		return "", "", status.Errorf(codes.InvalidArgument, "VMs in network mode %s get IPs of pool %s", mode, pool)
+	}
+	return mode, pool, nil
+}
+
+// setNetworkMode puts the VM of `a` in the network mode `mode`, with an IP of `ipPool`.
+func (a *vmArtifacts) setNetworkMode(mode string, ipPool string) {
+	a.networkMode, a.ipPool = mode, ipPool
+	if mode == networkModeNone {
+		a.tapDevice = isolatedTapDevicePrefix + a.id
+	}
+}
+
+// createTapDevice creates the tap device of `artifacts`, attached to the bridge of its network mode,
+// in the VM's network namespace if it has one.
+func (s *Server) createTapDevice(artifacts vmArtifacts) (*fountain.TapDevice, error) {
+	var bridge string
+	switch artifacts.networkMode {
+	case networkModeBridged:
+		bridge = s.config.NetworkModes.Bridged.Bridge
+	case networkModeHostOnly:
+		bridge = s.config.NetworkModes.HostOnly.Bridge
+	case networkModeNone:
+	default:
+		bridge = s.config.BridgeName
+	}
+	return s.fountain.CreateTapDeviceIn(artifacts.tapDevice, bridge, s.netnsOf(artifacts.tapDevice))
+}
+
+// connectTapDevice gives the host its end of the link to the guest `guestIP` of a VM in `mode`, if
+// the mode has one. Bridges are the link of the other modes.
+func (s *Server) connectTapDevice(mode string, tapDevice *fountain.TapDevice, guestIP *net.IPNet) error {
+	if mode != networkModeNone {
+		return nil
+	}
+	gateway, err := s.ipAllocator.Gateway(guestIP.IP)
+	if err != nil {
+		return err
+	}
+	// The guest's subnet stays routed to the host-only bridge, only the guest itself is behind
+	// the tap device. The host answers ARP for the gateway on it like on the bridge.
+	args := []string{"a", "add", gateway.IP.String() + "/32", "peer", guestIP.IP.String() + "/32", "dev", tapDevice.Name}
+	if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to address %s: %s %w", tapDevice.Name, output, err)
+	}
+	return nil
+}
+
+// portForwardsOf returns the port forwards of the server that reach VMs in `mode`. Only NAT guests
+// are behind the host's addresses, the others are either reachable themselves or must stay
+// unreachable.
+func (s *Server) portForwardsOf(mode string) []config.PortForwardConfig {
+	if mode != "" && mode != networkModeNAT {
+		return nil
+	}
+	return s.config.PortForwards
+}
+
+// writeNetworkMode keeps `mode` in the snapshot directory `dir`.
+func writeNetworkMode(dir string, mode string) error {
+	if mode == "" || mode == networkModeNAT {
+		return nil
+	}
+	return os.WriteFile(path.Join(dir, networkModeFilename), []byte(mode), 0644)
+}
+
+// readNetworkMode returns the network mode of the VM snapshotted to `dir`.
+func readNetworkMode(dir string) (string, error) {
+	data, err := os.ReadFile(path.Join(dir, networkModeFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return networkModeNAT, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// iptablesEnsure inserts the rule `args` of the chain `chain`, unless it's already there.
+func iptablesEnsure(chain string, args ...string) error {
+	if exec.Command("iptables", append([]string{"-C", chain}, args...)...).Run() == nil {
+		return nil
+	}
+	if output, err := exec.Command("iptables", append([]string{"-I", chain}, args...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add iptables rule to %s: %s %w", chain, output, err)
+	}
+	return nil
+}
+
+// setupNetworkModes creates the host-only bridge, with its addresses `gateways`, and the firewall
+// rules of the host-only and isolated VMs, if `modes` enables them. Run after the NAT rules, which
+// it has to take precedence over.
+func setupNetworkModes(modes config.NetworkModesConfig, gateways []*net.IPNet) error {
+	if modes.HostOnly.Pool == "" {
+		return nil
+	}
+	bridge := modes.HostOnly.Bridge
+	exists, err := bridgeExists(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to detect if bridge exists: %w", err)
+	}
+	if !exists {
+		commands := [][]string{
+			{"l", "add", bridge, "type", "bridge"},
+			{"l", "set", bridge, "up"},
+		}
+		for _, gateway := range gateways {
+			commands = append(commands, []string{"a", "add", gateway.String(), "dev", bridge, "scope", "host"})
+		}
+		for _, args := range commands {
+			if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to execute command 'ip %s': %s %w", strings.Join(args, " "), output, err)
+			}
+		}
+	}
+
+	isolatedTaps := isolatedTapDevicePrefix + "+"
+	rules := []struct {
+		chain string
+		args  []string
+	}{
+		{"FORWARD", []string{"-i", bridge, "-j", "DROP"}},
+		{"FORWARD", []string{"-o", bridge, "-j", "DROP"}},
+		{"FORWARD", []string{"-i", isolatedTaps, "-j", "DROP"}},
+		{"FORWARD", []string{"-o", isolatedTaps, "-j", "DROP"}},
+		{"INPUT", []string{"-i", isolatedTaps, "-m", "conntrack", "!", "--ctstate", "ESTABLISHED,RELATED", "-j", "DROP"}},
+	}
+	for _, rule := range rules {
+		if err := iptablesEnsure(rule.chain, rule.args...); err != nil {
+			return err
+		}
+	}
+	log.WithField("bridge", bridge).Info("set up host-only and isolated networking")
+	return nil
+}
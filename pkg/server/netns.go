@@ -0,0 +1,94 @@
+package server
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/server/fountain"
+)
+
+// netnsOf returns the network namespace of the VM with the tap device `tapDevice`, empty if VMs
+// don't get their own.
+func (s *Server) netnsOf(tapDevice string) string {
+	if !s.config.NetworkNamespaces {
+		return ""
+	}
+	return fountain.NetnsName(tapDevice)
+}
+
+// hypervisorCommand returns the command running cloud-hypervisor with `args`, in the jail `j` if
+// there's one, confined by the hypervisor sandbox and in the network namespace `netns` if there's
+// one.
+func (s *Server) hypervisorCommand(netns string, j *jail, args ...string) *exec.Cmd {
+	cfg := s.Config()
+	sandbox := cfg.HypervisorSandbox
+	chvBin := cfg.ChvBinPath
+	if j != nil {
+		// Bound into the jail at its absolute path.
+		chvBin, _ = filepath.Abs(chvBin)
+		// The jail's user has no capabilities and only sees the jail, and chroot needs
+		// CAP_SYS_CHROOT.
+		sandbox.Capabilities = nil
+		sandbox.ReadOnlyMounts = false
+	}
+	command := append([]string{chvBin}, args...)
+	if seccomp := sandbox.Seccomp; seccomp != "" {
+		command = append(command, "--seccomp", seccomp)
+	}
+	command = j.command(command)
+	command = sandboxCommand(sandbox, hypervisorWritablePaths(cfg), command)
+	if netns != "" {
+		// `ip netns exec` execs the hypervisor, which keeps its PID.
+		command = append([]string{"ip", "netns", "exec", netns}, command...)
+	}
+	return exec.Command(command[0], command[1:]...)
+}
+
+// cleanupNetns deletes the network namespaces of tap devices, except those in `keep`.
+func cleanupNetns(keep map[string]bool) error {
+	names, err := fountain.ListNetns()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if keep[strings.TrimPrefix(name, fountain.NetnsPrefix)] {
+			continue
+		}
+		if err := fountain.DeleteNetns(name); err != nil {
+			log.WithError(err).Warnf("failed to delete network namespace %s", name)
+			continue
+		}
+		log.Infof("deleted network namespace: %s", name)
+	}
+	return nil
+}
+
+// findOrphanedNetns returns the network namespaces of tap devices that no VM uses. VMs being
+// created get theirs before their tap device, so only namespaces older than `cutoff` count.
+func (s *Server) findOrphanedNetns(cutoff time.Time) []orphan {
+	names, err := fountain.ListNetns()
+	if err != nil {
+		log.WithError(err).Warn("failed to list network namespaces")
+		return nil
+	}
+	var orphans []orphan
+	for _, name := range names {
+		tapDevice := strings.TrimPrefix(name, fountain.NetnsPrefix)
+		if s.fountain.InUse(tapDevice) || lastModified(fountain.NetnsPath(name)).After(cutoff) {
+			continue
+		}
+		orphans = append(orphans, orphan{
+			kind:   orphanNetns,
+			name:   name,
+			detail: tapDevice,
+			reclaim: func() error {
+				return fountain.DeleteNetns(name)
+			},
+		})
+	}
+	return orphans
+}
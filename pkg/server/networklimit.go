@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	// Bursts let through this much of a second's worth of traffic at once, but at least the
+	// minimums, so that slow links still pass full-sized packets and TCP can ramp up.
+	networkLimitBurstDivisor    = 10
+	minNetworkLimitBurstBytes   = 64 * 1024
+	minNetworkLimitBurstPackets = 16
+)
+
+// networkLimit caps the traffic of a VM, ingress being what it receives and egress what it sends. 0
+// leaves a direction unlimited.
+type networkLimit struct {
+	ingressMbps int32
+	egressMbps  int32
+	ingressPPS  int32
+	egressPPS   int32
+}
+
+// newNetworkLimit returns the network limit of a VM started from `template` with `r`, whose fields win
+// over the template's. Nil if neither limits anything.
+func (s *Server) newNetworkLimit(template string, r *serverapi.NetworkLimit) (*networkLimit, error) {
+	if r == nil {
+		r = &serverapi.NetworkLimit{}
+	}
+	tmpl, _ := s.templateConfig(strings.ToLower(template))
+	limit := networkLimit{
+		ingressMbps: tmpl.NetworkLimit.IngressMbps,
+		egressMbps:  tmpl.NetworkLimit.EgressMbps,
+		ingressPPS:  tmpl.NetworkLimit.IngressPPS,
+		egressPPS:   tmpl.NetworkLimit.EgressPPS,
+	}
+	for _, field := range []struct {
+		name  string
+		value *int32
+		limit *int32
+	}{
+		{"ingressMbps", r.IngressMbps, &limit.ingressMbps},
+		{"egressMbps", r.EgressMbps, &limit.egressMbps},
+		{"ingressPps", r.IngressPps, &limit.ingressPPS},
+		{"egressPps", r.EgressPps, &limit.egressPPS},
+	} {
+		if field.value == nil {
+			continue
+		}
+		if *field.value < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "networkLimit %s can't be negative", field.name)
+		}
+		*field.limit = *field.value
+	}
+	if limit == (networkLimit{}) {
+		return nil, nil
+	}
+	return &limit, nil
+}
+
+// validateNetworkLimit checks the network limit of a template.
+func validateNetworkLimit(cfg config.NetworkLimitConfig) error {
+	if cfg.IngressMbps < 0 || cfg.EgressMbps < 0 || cfg.IngressPPS < 0 || cfg.EgressPPS < 0 {
+		return fmt.Errorf("network_limit can't be negative")
+	}
+	return nil
+}
+
+func convertNetworkLimit(l *networkLimit) *serverapi.NetworkLimit {
+	if l == nil {
+		return nil
+	}
+	return &serverapi.NetworkLimit{
+		IngressMbps: serverapi.PtrInt32(l.ingressMbps),
+		EgressMbps:  serverapi.PtrInt32(l.egressMbps),
+		IngressPps:  serverapi.PtrInt32(l.ingressPPS),
+		EgressPps:   serverapi.PtrInt32(l.egressPPS),
+	}
+}
+
+// tcPoliceArgs returns the tc actions that drop traffic over `mbps` and `pps`, nil if neither is
+// set.
+func tcPoliceArgs(mbps int32, pps int32) []string {
+	var policers [][]string
+	if mbps > 0 {
+		bytesPerSecond := int64(mbps) * 1000 * 1000 / 8
+		burst := max(bytesPerSecond/networkLimitBurstDivisor, minNetworkLimitBurstBytes)
+		policers = append(policers, []string{"rate", strconv.Itoa(int(mbps)) + "mbit", "burst", strconv.FormatInt(burst, 10)})
+	}
+	if pps > 0 {
+		burst := max(int64(pps)/networkLimitBurstDivisor, minNetworkLimitBurstPackets)
+		policers = append(policers, []string{"pkts_rate", strconv.Itoa(int(pps)), "pkts_burst", strconv.FormatInt(burst, 10)})
+	}
+	var args []string
+	for i, policer := range policers {
+		// Conforming packets go on to the next policer, if there is one.
+		conform := "ok"
+		if i < len(policers)-1 {
+			conform = "pipe"
+		}
+		args = append(args, "action", "police")
+		args = append(args, policer...)
+		args = append(args, "conform-exceed", "drop/"+conform)
+	}
+	return args
+}
+
+// applyNetworkLimit polices the traffic of the tap device `tapDevice` by `l`, replacing its previous
+// limits, or lifts them if `l` is nil. The host receives what the VM sends on the tap device, so
+// the VM's egress is policed on the tap's ingress and the other way around.
+func applyNetworkLimit(tapDevice string, l *networkLimit) error {
+	// Deleting the qdisc deletes its filters, and fails if there's none.
+	exec.Command("tc", "qdisc", "del", "dev", tapDevice, "clsact").Run()
+	if l == nil {
+		return nil
+	}
+	commands := [][]string{{"qdisc", "add", "dev", tapDevice, "clsact"}}
+	if police := tcPoliceArgs(l.egressMbps, l.egressPPS); police != nil {
+		commands = append(commands, append([]string{"filter", "add", "dev", tapDevice, "ingress", "matchall"}, police...))
+	}
+	if police := tcPoliceArgs(l.ingressMbps, l.ingressPPS); police != nil {
+		commands = append(commands, append([]string{"filter", "add", "dev", tapDevice, "egress", "matchall"}, police...))
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to execute command 'tc %s': %s %w", strings.Join(args, " "), output, err)
+		}
+	}
+	return nil
+}
+
+// setNetworkLimit caps the traffic of `vm` by `l`, replacing its previous limits, or lifts them if `l`
+// is nil.
+func (s *Server) setNetworkLimit(vm *vm, l *networkLimit) error {
+	s.lock.RLock()
+	previous := vm.networkLimit
+	s.lock.RUnlock()
+	if l == nil && previous == nil {
+		return nil
+	}
+	if err := applyNetworkLimit(vm.tapDevice.Name, l); err != nil {
+		return status.Errorf(codes.Internal, "failed to apply network limit: %v", err)
+	}
+	s.lock.Lock()
+	vm.networkLimit = l
+	s.lock.Unlock()
+	if l != nil {
+		log.WithFields(log.Fields{
+			"vmName":      vm.name,
+			"ingressMbps": l.ingressMbps,
+			"egressMbps":  l.egressMbps,
+			"ingressPps":  l.ingressPPS,
+			"egressPps":   l.egressPPS,
+		}).Info("applied network limit")
+	}
+	return nil
+}
@@ -0,0 +1,951 @@
+// Package ninep serves host directories over 9P2000.L, for guests whose kernel has no virtiofs. It
+// speaks just what the Linux client needs to mount a directory with `trans=fd`. Paths are resolved
+// with openat2 beneath the directory, so that symlinks and ".." in it can't lead out of it.
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Largest message, further limited by what the client asks for.
+	maxMsize = 1 << 20
+	// Header of read and write messages, taken off the msize for their data.
+	ioHeaderSize = 24
+	version      = "9P2000.L"
+	noFid        = ^uint32(0)
+)
+
+// Message types, each answered by the one after it.
+const (
+	tlerror      = 6
+	tstatfs      = 8
+	tlopen       = 12
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	trename      = 20
+	treadlink    = 22
+	tgetattr     = 24
+	tsetattr     = 26
+	txattrwalk   = 30
+	txattrcreate = 32
+	treaddir     = 40
+	tfsync       = 50
+	tlock        = 52
+	tgetlock     = 54
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	tauth        = 102
+	tattach      = 104
+	tflush       = 108
+	twalk        = 110
+	tread        = 116
+	twrite       = 118
+	tclunk       = 120
+	tremove      = 122
+)
+
+// Bits of getattr and setattr.
+const (
+	getattrBasic = 0x7ff
+
+	setattrMode     = 0x1
+	setattrUID      = 0x2
+	setattrGID      = 0x4
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+)
+
+// Export is a directory served to clients attaching with its name.
+type Export struct {
+	Path     string
+	ReadOnly bool
+}
+
+// export is an Export a client attached to.
+type export struct {
+	// O_PATH descriptor of the directory, everything is opened beneath it.
+	root     int
+	readOnly bool
+}
+
+// fid is a file of a client.
+type fid struct {
+	export *export
+	// Relative to the export, "." for its directory.
+	path string
+	uid  uint32
+	// Once opened, -1 before.
+	fd int
+	// Directory entries, listed on the first readdir.
+	dirents []dirent
+}
+
+type dirent struct {
+	qid  qid
+	typ  uint8
+	name string
+}
+
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+type conn struct {
+	rw      io.ReadWriter
+	exports map[string]Export
+	// Exports attached to, by name.
+	attached map[string]*export
+	fids     map[uint32]*fid
+	msize    uint32
+}
+
+// Serve serves `exports` by name on `rw` until it's closed or the client misbehaves.
+func Serve(rw io.ReadWriter, exports map[string]Export) error {
+	c := &conn{
+		rw:       rw,
+		exports:  exports,
+		attached: make(map[string]*export),
+		fids:     make(map[uint32]*fid),
+		msize:    maxMsize,
+	}
+	defer c.close()
+
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(rw, size[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < 7 || n > c.msize {
+			return fmt.Errorf("bad message size %d", n)
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(rw, msg); err != nil {
+			return err
+		}
+		typ, tag := msg[0], binary.LittleEndian.Uint16(msg[1:3])
+		d := &decoder{buf: msg[3:]}
+		e := &encoder{}
+		if err := c.handle(typ, d, e); err != nil {
+			e = &encoder{}
+			e.u32(errnoOf(err))
+			typ = tlerror
+		}
+		if err := c.reply(typ+1, tag, e.buf); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) reply(typ uint8, tag uint16, payload []byte) error {
+	msg := make([]byte, 7, 7+len(payload))
+	binary.LittleEndian.PutUint32(msg, uint32(7+len(payload)))
+	msg[4] = typ
+	binary.LittleEndian.PutUint16(msg[5:], tag)
+	_, err := c.rw.Write(append(msg, payload...))
+	return err
+}
+
+func (c *conn) close() {
+	for id := range c.fids {
+		c.clunk(id)
+	}
+	for _, x := range c.attached {
+		unix.Close(x.root)
+	}
+}
+
+func (c *conn) handle(typ uint8, d *decoder, e *encoder) error {
+	var err error
+	switch typ {
+	case tversion:
+		err = c.version(d, e)
+	case tauth, txattrwalk, txattrcreate:
+		return unix.EOPNOTSUPP
+	case tattach:
+		err = c.attach(d, e)
+	case tflush:
+	case twalk:
+		err = c.walk(d, e)
+	case tclunk:
+		c.clunk(d.u32())
+	case tremove:
+		err = c.remove(d)
+	case tstatfs:
+		err = c.statfs(d, e)
+	case tlopen:
+		err = c.lopen(d, e)
+	case tlcreate:
+		err = c.lcreate(d, e)
+	case tread:
+		err = c.read(d, e)
+	case twrite:
+		err = c.write(d, e)
+	case treaddir:
+		err = c.readdir(d, e)
+	case tgetattr:
+		err = c.getattr(d, e)
+	case tsetattr:
+		err = c.setattr(d)
+	case tfsync:
+		err = c.fsync(d)
+	case tmkdir:
+		err = c.mkdir(d, e)
+	case tsymlink:
+		err = c.symlink(d, e)
+	case tmknod:
+		return unix.EPERM
+	case treadlink:
+		err = c.readlink(d, e)
+	case tlink:
+		err = c.link(d)
+	case trename:
+		err = c.rename(d)
+	case trenameat:
+		err = c.renameat(d)
+	case tunlinkat:
+		err = c.unlinkat(d)
+	case tlock:
+		// Locks are local to the guest.
+		e.u8(0)
+	case tgetlock:
+		err = c.getlock(d, e)
+	default:
+		return unix.EOPNOTSUPP
+	}
+	if err == nil && d.err != nil {
+		return unix.EINVAL
+	}
+	return err
+}
+
+func (c *conn) version(d *decoder, e *encoder) error {
+	msize, v := d.u32(), d.str()
+	if msize < c.msize {
+		c.msize = msize
+	}
+	if c.msize < 4096 {
+		return unix.EINVAL
+	}
+	for id := range c.fids {
+		c.clunk(id)
+	}
+	if !strings.HasPrefix(v, version) {
+		v = "unknown"
+	} else {
+		v = version
+	}
+	e.u32(c.msize)
+	e.str(v)
+	return nil
+}
+
+func (c *conn) attach(d *decoder, e *encoder) error {
+	id, _, _, aname, uid := d.u32(), d.u32(), d.str(), d.str(), d.u32()
+	if _, ok := c.fids[id]; ok {
+		return unix.EBADF
+	}
+	x, ok := c.attached[aname]
+	if !ok {
+		exp, ok := c.exports[aname]
+		if !ok {
+			return unix.ENOENT
+		}
+		root, err := unix.Open(exp.Path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		x = &export{root: root, readOnly: exp.ReadOnly}
+		c.attached[aname] = x
+	}
+	st, err := x.lstat(".")
+	if err != nil {
+		return err
+	}
+	c.fids[id] = &fid{export: x, path: ".", uid: uid, fd: -1}
+	e.qid(qidOf(&st))
+	return nil
+}
+
+func (c *conn) walk(d *decoder, e *encoder) error {
+	id, newID, n := d.u32(), d.u32(), d.u16()
+	f, err := c.fid(id)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.fids[newID]; ok && newID != id {
+		return unix.EBADF
+	}
+	p := f.path
+	var qids []qid
+	for i := 0; i < int(n); i++ {
+		name := d.str()
+		if name == ".." {
+			p = path.Dir(p)
+		} else if validName(name) {
+			p = path.Join(p, name)
+		} else {
+			return unix.EINVAL
+		}
+		st, err := f.export.lstat(p)
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			break
+		}
+		qids = append(qids, qidOf(&st))
+	}
+	// Only a complete walk gets the new fid.
+	if len(qids) == int(n) {
+		if newID == id {
+			f.path = p
+			f.dirents = nil
+		} else {
+			c.fids[newID] = &fid{export: f.export, path: p, uid: f.uid, fd: -1}
+		}
+	}
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return nil
+}
+
+func (c *conn) clunk(id uint32) {
+	if f, ok := c.fids[id]; ok {
+		if f.fd >= 0 {
+			unix.Close(f.fd)
+		}
+		delete(c.fids, id)
+	}
+}
+
+func (c *conn) remove(d *decoder) error {
+	id := d.u32()
+	f, err := c.fid(id)
+	if err != nil {
+		return err
+	}
+	// The fid goes whether or not the file does.
+	defer c.clunk(id)
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	st, err := f.export.lstat(f.path)
+	if err != nil {
+		return err
+	}
+	flags := 0
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		flags = unix.AT_REMOVEDIR
+	}
+	return f.export.inParent(f.path, func(dir int, name string) error {
+		return unix.Unlinkat(dir, name, flags)
+	})
+}
+
+func (c *conn) statfs(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(f.export.root, &st); err != nil {
+		return err
+	}
+	e.u32(uint32(st.Type))
+	e.u32(uint32(st.Bsize))
+	e.u64(st.Blocks)
+	e.u64(st.Bfree)
+	e.u64(st.Bavail)
+	e.u64(st.Files)
+	e.u64(st.Ffree)
+	e.u64(uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32)
+	e.u32(uint32(st.Namelen))
+	return nil
+}
+
+func (c *conn) lopen(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	// Files are created with lcreate.
+	flags := openFlags(d.u32()) &^ (unix.O_CREAT | unix.O_EXCL)
+	if f.fd >= 0 {
+		return unix.EBADF
+	}
+	if flags&unix.O_ACCMODE != unix.O_RDONLY || flags&unix.O_TRUNC != 0 {
+		if err := f.export.writable(); err != nil {
+			return err
+		}
+	}
+	fd, err := f.export.open(f.path, flags|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	f.fd = fd
+	f.dirents = nil
+	e.qid(qidOf(&st))
+	e.u32(c.msize - ioHeaderSize)
+	return nil
+}
+
+func (c *conn) lcreate(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	name, flags, mode, gid := d.str(), openFlags(d.u32()), d.u32(), d.u32()
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	if !validName(name) || f.fd >= 0 {
+		return unix.EINVAL
+	}
+	p := path.Join(f.path, name)
+	fd, err := f.export.open(p, flags|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW, mode&0o7777)
+	if err != nil {
+		return err
+	}
+	// Owned like the guest's user would own it. Only works with the privileges we usually run with.
+	unix.Fchown(fd, int(f.uid), int(gid))
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	f.path, f.fd = p, fd
+	e.qid(qidOf(&st))
+	e.u32(c.msize - ioHeaderSize)
+	return nil
+}
+
+func (c *conn) read(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	offset, count := d.u64(), d.u32()
+	if f.fd < 0 {
+		return unix.EBADF
+	}
+	if max := c.msize - ioHeaderSize; count > max {
+		count = max
+	}
+	buf := make([]byte, count)
+	n, err := unix.Pread(f.fd, buf, int64(offset))
+	if err != nil {
+		return err
+	}
+	e.u32(uint32(n))
+	e.bytes(buf[:n])
+	return nil
+}
+
+func (c *conn) write(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	offset, count := d.u64(), d.u32()
+	data := d.next(int(count))
+	if f.fd < 0 {
+		return unix.EBADF
+	}
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	n, err := unix.Pwrite(f.fd, data, int64(offset))
+	if err != nil {
+		return err
+	}
+	e.u32(uint32(n))
+	return nil
+}
+
+func (c *conn) readdir(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	offset, count := d.u64(), d.u32()
+	if f.fd < 0 {
+		return unix.EBADF
+	}
+	if f.dirents == nil || offset == 0 {
+		if f.dirents, err = f.export.list(f.path); err != nil {
+			return err
+		}
+	}
+	if max := c.msize - ioHeaderSize; count > max {
+		count = max
+	}
+	entries := &encoder{}
+	for i := offset; i < uint64(len(f.dirents)); i++ {
+		ent := f.dirents[i]
+		if len(entries.buf)+13+8+1+2+len(ent.name) > int(count) {
+			break
+		}
+		entries.qid(ent.qid)
+		// The offset of the next entry.
+		entries.u64(i + 1)
+		entries.u8(ent.typ)
+		entries.str(ent.name)
+	}
+	e.u32(uint32(len(entries.buf)))
+	e.bytes(entries.buf)
+	return nil
+}
+
+func (c *conn) getattr(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	st, err := f.export.lstat(f.path)
+	if err != nil {
+		return err
+	}
+	e.u64(getattrBasic)
+	e.qid(qidOf(&st))
+	e.u32(st.Mode)
+	e.u32(st.Uid)
+	e.u32(st.Gid)
+	e.u64(uint64(st.Nlink))
+	e.u64(st.Rdev)
+	e.u64(uint64(st.Size))
+	e.u64(uint64(st.Blksize))
+	e.u64(uint64(st.Blocks))
+	for _, ts := range []unix.Timespec{st.Atim, st.Mtim, st.Ctim, {}} {
+		e.u64(uint64(ts.Sec))
+		e.u64(uint64(ts.Nsec))
+	}
+	// gen and data_version.
+	e.u64(0)
+	e.u64(0)
+	return nil
+}
+
+func (c *conn) setattr(d *decoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	valid, mode, uid, gid, size := d.u32(), d.u32(), d.u32(), d.u32(), d.u64()
+	atime := unix.Timespec{Sec: int64(d.u64()), Nsec: int64(d.u64())}
+	mtime := unix.Timespec{Sec: int64(d.u64()), Nsec: int64(d.u64())}
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	fd, err := f.export.open(f.path, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	symlink := st.Mode&unix.S_IFMT == unix.S_IFLNK
+	// O_PATH descriptors can't be changed directly, but their /proc link can.
+	procPath := "/proc/self/fd/" + strconv.Itoa(fd)
+
+	if valid&setattrMode != 0 && !symlink {
+		if err := unix.Chmod(procPath, mode&0o7777); err != nil {
+			return err
+		}
+	}
+	if valid&(setattrUID|setattrGID) != 0 {
+		newUID, newGID := -1, -1
+		if valid&setattrUID != 0 {
+			newUID = int(uid)
+		}
+		if valid&setattrGID != 0 {
+			newGID = int(gid)
+		}
+		if err := unix.Fchownat(fd, "", newUID, newGID, unix.AT_EMPTY_PATH); err != nil {
+			return err
+		}
+	}
+	if valid&setattrSize != 0 {
+		if st.Mode&unix.S_IFMT != unix.S_IFREG {
+			return unix.EINVAL
+		}
+		if err := unix.Truncate(procPath, int64(size)); err != nil {
+			return err
+		}
+	}
+	if valid&(setattrAtime|setattrMtime) != 0 && !symlink {
+		times := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+		if valid&setattrAtime != 0 {
+			times[0] = unix.Timespec{Nsec: unix.UTIME_NOW}
+			if valid&setattrAtimeSet != 0 {
+				times[0] = atime
+			}
+		}
+		if valid&setattrMtime != 0 {
+			times[1] = unix.Timespec{Nsec: unix.UTIME_NOW}
+			if valid&setattrMtimeSet != 0 {
+				times[1] = mtime
+			}
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, procPath, times, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) fsync(d *decoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	if f.fd < 0 {
+		return unix.EBADF
+	}
+	return unix.Fsync(f.fd)
+}
+
+func (c *conn) mkdir(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	name, mode, gid := d.str(), d.u32(), d.u32()
+	return c.create(f, name, gid, e, func(dir int) error {
+		return unix.Mkdirat(dir, name, mode&0o7777)
+	})
+}
+
+func (c *conn) symlink(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	name, target, gid := d.str(), d.str(), d.u32()
+	// The target is never followed by us, so it may point anywhere.
+	return c.create(f, name, gid, e, func(dir int) error {
+		return unix.Symlinkat(target, dir, name)
+	})
+}
+
+// create creates `name` in the directory of `f` with `mk`, owned by the fid's user and `gid`, and
+// replies with its qid.
+func (c *conn) create(f *fid, name string, gid uint32, e *encoder, mk func(dir int) error) error {
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	if !validName(name) {
+		return unix.EINVAL
+	}
+	dir, err := f.export.open(f.path, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := mk(dir); err != nil {
+		return err
+	}
+	unix.Fchownat(dir, name, int(f.uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
+	var st unix.Stat_t
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	e.qid(qidOf(&st))
+	return nil
+}
+
+func (c *conn) readlink(d *decoder, e *encoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	var target string
+	err = f.export.inParent(f.path, func(dir int, name string) error {
+		buf := make([]byte, unix.PathMax)
+		n, err := unix.Readlinkat(dir, name, buf)
+		target = string(buf[:n])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	e.str(target)
+	return nil
+}
+
+func (c *conn) link(d *decoder) error {
+	dirFid, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	if !validName(name) || f.export != dirFid.export {
+		return unix.EINVAL
+	}
+	return f.export.inParent(f.path, func(oldDir int, oldName string) error {
+		newDir, err := f.export.open(dirFid.path, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(newDir)
+		return unix.Linkat(oldDir, oldName, newDir, name, 0)
+	})
+}
+
+func (c *conn) rename(d *decoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	dirFid, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	if !validName(name) || f.export != dirFid.export {
+		return unix.EINVAL
+	}
+	err = f.export.inParent(f.path, func(oldDir int, oldName string) error {
+		newDir, err := f.export.open(dirFid.path, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(newDir)
+		return unix.Renameat(oldDir, oldName, newDir, name)
+	})
+	if err != nil {
+		return err
+	}
+	f.path = path.Join(dirFid.path, name)
+	return nil
+}
+
+func (c *conn) renameat(d *decoder) error {
+	oldDirFid, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	oldName := d.str()
+	newDirFid, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	newName := d.str()
+	if err := oldDirFid.export.writable(); err != nil {
+		return err
+	}
+	if !validName(oldName) || !validName(newName) || oldDirFid.export != newDirFid.export {
+		return unix.EINVAL
+	}
+	x := oldDirFid.export
+	oldDir, err := x.open(oldDirFid.path, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(oldDir)
+	newDir, err := x.open(newDirFid.path, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newDir)
+	return unix.Renameat(oldDir, oldName, newDir, newName)
+}
+
+func (c *conn) unlinkat(d *decoder) error {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return err
+	}
+	name, flags := d.str(), d.u32()
+	if err := f.export.writable(); err != nil {
+		return err
+	}
+	if !validName(name) {
+		return unix.EINVAL
+	}
+	dir, err := f.export.open(f.path, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	return unix.Unlinkat(dir, name, int(flags&unix.AT_REMOVEDIR))
+}
+
+func (c *conn) getlock(d *decoder, e *encoder) error {
+	if _, err := c.fid(d.u32()); err != nil {
+		return err
+	}
+	d.u8()
+	start, length, procID, clientID := d.u64(), d.u64(), d.u32(), d.str()
+	// Nothing is locked on this side.
+	e.u8(unix.F_UNLCK)
+	e.u64(start)
+	e.u64(length)
+	e.u32(procID)
+	e.str(clientID)
+	return nil
+}
+
+func (c *conn) fid(id uint32) (*fid, error) {
+	f, ok := c.fids[id]
+	if !ok || id == noFid {
+		return nil, unix.EBADF
+	}
+	return f, nil
+}
+
+// open opens `rel` beneath the export.
+func (x *export) open(rel string, flags int, mode uint32) (int, error) {
+	for {
+		fd, err := unix.Openat2(x.root, rel, &unix.OpenHow{
+			Flags:   uint64(flags | unix.O_CLOEXEC),
+			Mode:    uint64(mode),
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+		})
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+func (x *export) lstat(rel string) (unix.Stat_t, error) {
+	var st unix.Stat_t
+	fd, err := x.open(rel, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return st, err
+	}
+	defer unix.Close(fd)
+	err = unix.Fstat(fd, &st)
+	return st, err
+}
+
+// inParent calls `fn` with the directory of `rel` and its name in it.
+func (x *export) inParent(rel string, fn func(dir int, name string) error) error {
+	if rel == "." {
+		return unix.EBUSY
+	}
+	dir, err := x.open(path.Dir(rel), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	return fn(dir, path.Base(rel))
+}
+
+// list returns the entries of the directory `rel`.
+func (x *export) list(rel string) ([]dirent, error) {
+	fd, err := x.open(rel, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	dir := os.NewFile(uintptr(fd), rel)
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	dirents := make([]dirent, 0, len(names))
+	for _, name := range names {
+		var st unix.Stat_t
+		// Gone since it was listed.
+		if err := unix.Fstatat(fd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			continue
+		}
+		dirents = append(dirents, dirent{qid: qidOf(&st), typ: uint8(st.Mode & unix.S_IFMT >> 12), name: name})
+	}
+	return dirents, nil
+}
+
+func (x *export) writable() error {
+	if x.readOnly {
+		return unix.EROFS
+	}
+	return nil
+}
+
+func qidOf(st *unix.Stat_t) qid {
+	q := qid{path: st.Ino, version: uint32(st.Mtim.Sec ^ st.Mtim.Nsec)}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		q.typ = 0x80
+	case unix.S_IFLNK:
+		q.typ = 0x02
+	}
+	return q
+}
+
+// validName returns whether `name` names an entry of a directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// openFlags converts the open flags of the 9P2000.L protocol, those of Linux on x86, to ours.
+func openFlags(flags uint32) int {
+	result := int(flags & unix.O_ACCMODE)
+	for p9, ours := range map[uint32]int{
+		0o100:     unix.O_CREAT,
+		0o200:     unix.O_EXCL,
+		0o1000:    unix.O_TRUNC,
+		0o2000:    unix.O_APPEND,
+		0o4000:    unix.O_NONBLOCK,
+		0o40000:   unix.O_DIRECT,
+		0o200000:  unix.O_DIRECTORY,
+		0o1000000: unix.O_NOATIME,
+		0o4010000: unix.O_SYNC,
+		0o10000:   unix.O_DSYNC,
+	} {
+		if flags&p9 == p9 {
+			result |= ours
+		}
+	}
+	return result
+}
+
+func errnoOf(err error) uint32 {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return uint32(errno)
+	}
+	return uint32(unix.EIO)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// validateOIDC checks the OIDC settings in `cfg`, if an issuer is configured.
+func validateOIDC(cfg config.OIDCConfig) error {
+	if cfg.Issuer == "" {
+		return nil
+	}
+	if u, err := url.Parse(cfg.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("oidc issuer must be an http(s) URL: %s", cfg.Issuer)
+	}
+	if cfg.Audience == "" {
+		return fmt.Errorf("oidc audience is required")
+	}
+	if len(cfg.Roles) == 0 {
+		return fmt.Errorf("oidc roles are required, tokens would have no permissions")
+	}
+	for _, role := range cfg.Roles {
+		if role.Role == "" {
+			return fmt.Errorf("oidc role has no name")
+		}
+		if err := auth.ValidatePermissions(role.Permissions); err != nil {
+			return fmt.Errorf("oidc role %s: %w", role.Role, err)
+		}
+	}
+	return nil
+}
+
+// newOIDCVerifier returns a verifier for `cfg`, or nil if OIDC is disabled.
+func newOIDCVerifier(cfg config.OIDCConfig) *auth.OIDCVerifier {
+	if cfg.Issuer == "" {
+		return nil
+	}
+	return auth.NewOIDCVerifier(cfg)
+}
+
+// oidcVerifier returns the verifier for the current config, or nil if OIDC is disabled.
+func (s *Server) oidcVerifier() *auth.OIDCVerifier {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.oidc
+}
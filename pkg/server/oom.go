@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// What's done when the guest's kernel kills a process for running out of memory. Either way, the
+// kill is recorded on the VM and published.
+const (
+	oomActionNone = "none"
+	// Hot-plugs more memory into the guest, up to the policy's maximum.
+	oomActionGrowMemory = "grow-memory"
+	// Reboots the guest, keeping its disks.
+	oomActionRestart = "restart"
+)
+
+const (
+	defaultOOMGrowMB = 512
+	// virtio-mem plugs memory in blocks of this size.
+	memoryHotplugBlock = 128 << 20
+
+	// Where the OOM killer ran: in the guest, or on the host, killing the VM's hypervisor.
+	oomSourceGuest = "guest"
+	oomSourceHost  = "host"
+
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// oomPolicy says what's done when the guest runs out of memory.
+type oomPolicy struct {
+	action string
+	// How much memory each OOM kill adds, and the most the guest may have, for grow-memory.
+	growBytes      int64
+	maxMemoryBytes int64
+}
+
+// newOOMPolicy validates the OOM policy of a start, which may be nil.
+func newOOMPolicy(p *serverapi.OomPolicy) (oomPolicy, error) {
+	policy := oomPolicy{action: oomActionNone}
+	if p == nil {
+		return policy, nil
+	}
+	switch p.GetAction() {
+	case "", oomActionNone:
+	case oomActionRestart:
+		policy.action = oomActionRestart
+	case oomActionGrowMemory:
+		policy.action = oomActionGrowMemory
+		if p.GetMaxMemoryMb() <= 0 {
+			return policy, status.Error(codes.InvalidArgument, "oomPolicy grow-memory needs maxMemoryMb")
+		}
+		if p.GetGrowMb() < 0 {
+			return policy, status.Error(codes.InvalidArgument, "oomPolicy growMb can't be negative")
+		}
+		policy.growBytes = int64(p.GetGrowMb()) << 20
+		if policy.growBytes == 0 {
+			policy.growBytes = defaultOOMGrowMB << 20
+		}
+		policy.maxMemoryBytes = int64(p.GetMaxMemoryMb()) << 20
+	default:
+		return policy, status.Errorf(codes.InvalidArgument, "oomPolicy action must be none, grow-memory or restart, not %q", p.GetAction())
+	}
+	return policy, nil
+}
+
+func convertOOMPolicy(p oomPolicy) *serverapi.OomPolicy {
+	if p.action == oomActionNone {
+		return nil
+	}
+	resp := &serverapi.OomPolicy{Action: serverapi.PtrString(p.action)}
+	if p.action == oomActionGrowMemory {
+		resp.GrowMb = serverapi.PtrInt32(int32(p.growBytes >> 20))
+		resp.MaxMemoryMb = serverapi.PtrInt32(int32(p.maxMemoryBytes >> 20))
+	}
+	return resp
+}
+
+// hotplugConfig sets up `memory`, the guest's boot memory, so that memory can be plugged in up to
+// the policy's maximum, if it grows memory.
+func (p oomPolicy) hotplugConfig(memory *chvapi.MemoryConfig) error {
+	if p.action != oomActionGrowMemory {
+		return nil
+	}
+	hotplug := (p.maxMemoryBytes - memory.Size) / memoryHotplugBlock * memoryHotplugBlock
+	if hotplug <= 0 {
+		return status.Errorf(codes.InvalidArgument, "oomPolicy maxMemoryMb must be at least %d MiB above the guest's %d MiB", memoryHotplugBlock>>20, memory.Size>>20)
+	}
+	memory.HotplugMethod = String("VirtioMem")
+	memory.HotplugSize = chvapi.PtrInt64(hotplug)
+	return nil
+}
+
+func (s *Server) setOOMPolicy(vmName string, p oomPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.oomPolicy = p
+	}
+}
+
+// oomKill is the last process the OOM killer killed in a VM, or the VM's hypervisor.
+type oomKill struct {
+	source  string
+	process string
+	pid     int
+	time    time.Time
+}
+
+// newOOMKill returns the kill a guest's OOM kill report describes.
+func newOOMKill(data map[string]string) *oomKill {
+	pid, _ := strconv.Atoi(data["pid"])
+	killedAt, err := time.Parse(time.RFC3339, data["killedAt"])
+	if err != nil {
+		killedAt = time.Now().UTC()
+	}
+	return &oomKill{source: oomSourceGuest, process: data["process"], pid: pid, time: killedAt}
+}
+
+func convertOOMKill(kill *oomKill) *serverapi.OomKill {
+	if kill == nil {
+		return nil
+	}
+	return &serverapi.OomKill{
+		Source:  serverapi.PtrString(kill.source),
+		Process: serverapi.PtrString(kill.process),
+		Pid:     serverapi.PtrInt32(int32(kill.pid)),
+		Time:    serverapi.PtrTime(kill.time),
+	}
+}
+
+// recordOOMKill records `kill` on `vm` and publishes it, with what the VM's OOM policy does about
+// it.
+func (s *Server) recordOOMKill(vmName string, vm *vm, kill *oomKill) {
+	s.lock.Lock()
+	action := oomActionNone
+	if kill.source == oomSourceGuest {
+		action = vm.oomPolicy.action
+	}
+	vm.oomKills++
+	vm.lastOOMKill = kill
+	s.lock.Unlock()
+	s.vmsChanged()
+
+	log.WithFields(log.Fields{
+		"vmName":  vmName,
+		"source":  kill.source,
+		"process": kill.process,
+		"pid":     kill.pid,
+		"action":  action,
+	}).Warn("process killed for running out of memory")
+	s.events.Publish(events.VMOOMKilled, vmName, map[string]string{
+		"source":  kill.source,
+		"process": kill.process,
+		"pid":     strconv.Itoa(kill.pid),
+		"action":  action,
+	})
+}
+
+// applyOOMPolicy does what the OOM policy of `vm` says once a process in its guest was killed for
+// running out of memory.
+func (s *Server) applyOOMPolicy(vmName string, vm *vm) {
+	logger := log.WithField("vmName", vmName)
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config().Timeouts.ExecMax)
+	defer cancel()
+	s.lock.RLock()
+	policy := vm.oomPolicy
+	s.lock.RUnlock()
+	switch policy.action {
+	case oomActionGrowMemory:
+		size, err := vm.growMemory(ctx, policy.growBytes)
+		if err != nil {
+			logger.WithError(err).Error("failed to grow guest memory after OOM kill")
+			return
+		}
+		logger.WithField("memoryMb", size>>20).Info("grew guest memory after OOM kill")
+	case oomActionRestart:
+		if _, err := vm.apiClient.DefaultAPI.RebootVM(ctx).Execute(); err != nil {
+			logger.WithError(err).Error("failed to reboot guest after OOM kill")
+			return
+		}
+		logger.Info("rebooted guest after OOM kill")
+	}
+}
+
+// growMemory plugs `grow` more bytes of memory into the guest, up to what was reserved for
+// hot-plugging when the VM was created. Returns the guest's new memory size.
+func (v *vm) growMemory(ctx context.Context, grow int64) (int64, error) {
+	info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get vm info: %w", err)
+	}
+	memory := info.Config.Memory
+	if memory == nil || memory.GetHotplugSize() == 0 {
+		return 0, fmt.Errorf("vm has no memory to hot-plug")
+	}
+	current := memory.Size + memory.GetHotpluggedSize()
+	limit := memory.Size + memory.GetHotplugSize()
+	if current >= limit {
+		return 0, fmt.Errorf("vm has the most memory its policy allows, %d MiB", limit>>20)
+	}
+	desired := min(current+(grow+memoryHotplugBlock-1)/memoryHotplugBlock*memoryHotplugBlock, limit)
+	if _, err := v.apiClient.DefaultAPI.VmResizePut(ctx).VmResize(chvapi.VmResize{DesiredRam: chvapi.PtrInt64(desired)}).Execute(); err != nil {
+		return 0, fmt.Errorf("failed to resize vm memory: %w", err)
+	}
+	return desired, nil
+}
+
+// hypervisorCgroup returns the cgroup v2 of the process `pid`, empty if it can't be read.
+func hypervisorCgroup(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// cgroupOOMKills returns how many processes of the cgroup `cgroup`, and the cgroups below it, the
+// OOM killer killed.
+func cgroupOOMKills(cgroup string) int64 {
+	if cgroup == "" {
+		return 0
+	}
+	f, err := os.Open(path.Join(cgroupRoot, cgroup, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			kills, _ := strconv.ParseInt(value, 10, 64)
+			return kills
+		}
+	}
+	return 0
+}
+
+// hypervisorOOMKilled returns whether the OOM killer killed processes of the cgroup of the VM's
+// hypervisor since it started, taking them for the hypervisor once it exited.
+func hypervisorOOMKilled(vm *vm) bool {
+	return vm.hypervisorCgroup != "" && cgroupOOMKills(vm.hypervisorCgroup) > vm.hypervisorOOMKills
+}
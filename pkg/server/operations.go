@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+// Finished operations kept for their callers to look up. Older ones are forgotten.
+const maxFinishedOperations = 100
+
+// Operation states.
+const (
+	operationRunning   = "running"
+	operationSucceeded = "succeeded"
+	operationFailed    = "failed"
+)
+
+// operation is long-running work, such as a snapshot export, that callers follow through the
+// operations API. Guarded by the lock of `operations`.
+type operation struct {
+	id   string
+	kind string
+	// What the operation works on, e.g. a snapshot ID.
+	target string
+	// Name of the API key that started it, see ownerFromContext.
+	owner      string
+	status     string
+	bytesDone  int64
+	bytesTotal int64
+	err        string
+	result     map[string]string
+	createdAt  time.Time
+	updatedAt  time.Time
+}
+
+// operations tracks running operations and the most recent finished ones. Operations don't survive
+// restarts.
+type operations struct {
+	lock sync.Mutex
+	ops  map[string]*operation
+	// IDs of finished operations, oldest first.
+	finished []string
+}
+
+func newOperations() *operations {
+	return &operations{ops: make(map[string]*operation)}
+}
+
+// start registers a running operation of `kind` on `target` for the caller of `ctx`.
+func (o *operations) start(ctx context.Context, kind string, target string, bytesTotal int64) (*operation, error) {
+	return o.begin(ctx, kind, target, bytesTotal, false)
+}
+
+// startExclusive is like start, but fails with FailedPrecondition while another operation of
+// `kind` runs on `target`.
+func (o *operations) startExclusive(ctx context.Context, kind string, target string, bytesTotal int64) (*operation, error) {
+	return o.begin(ctx, kind, target, bytesTotal, true)
+}
+
+func (o *operations) begin(ctx context.Context, kind string, target string, bytesTotal int64, exclusive bool) (*operation, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create operation id: %v", err)
+	}
+	now := time.Now().UTC()
+	op := &operation{
+		id:         hex.EncodeToString(b),
+		kind:       kind,
+		target:     target,
+		owner:      ownerFromContext(ctx),
+		status:     operationRunning,
+		bytesTotal: bytesTotal,
+		createdAt:  now,
+		updatedAt:  now,
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if exclusive {
+		for _, other := range o.ops {
+			if other.kind == kind && other.target == target && other.status == operationRunning {
+				return nil, status.Errorf(codes.FailedPrecondition, "%s of %s is running already as operation %s", kind, target, other.id)
+			}
+		}
+	}
+	o.ops[op.id] = op
+	return op, nil
+}
+
+// progress records that `bytesDone` more bytes of `op` are done.
+func (o *operations) progress(op *operation, bytesDone int64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	op.bytesDone += bytesDone
+	op.updatedAt = time.Now().UTC()
+}
+
+// finish ends `op`, successfully with `result` if `err` is nil.
+func (o *operations) finish(op *operation, result map[string]string, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err != nil {
+		op.status = operationFailed
+		op.err = err.Error()
+	} else {
+		op.status = operationSucceeded
+		op.result = result
+	}
+	op.updatedAt = time.Now().UTC()
+
+	o.finished = append(o.finished, op.id)
+	if len(o.finished) > maxFinishedOperations {
+		delete(o.ops, o.finished[0])
+		o.finished = o.finished[1:]
+	}
+}
+
+// GetOperation returns the operation `id`. Callers only see the operations they started, admins
+// see all.
+func (s *Server) GetOperation(ctx context.Context, id string) (*serverapi.Operation, error) {
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	op, ok := s.operations.ops[id]
+	if !ok || !auth.FromContext(ctx).CanActOn(op.owner) {
+		return nil, status.Errorf(codes.NotFound, "operation %s not found", id)
+	}
+	return convertOperation(op), nil
+}
+
+// ListOperations returns the operations the caller can see, newest first.
+func (s *Server) ListOperations(ctx context.Context) *serverapi.ListOperationsResponse {
+	s.operations.lock.Lock()
+	resp := &serverapi.ListOperationsResponse{
+		Operations: []serverapi.Operation{},
+	}
+	id := auth.FromContext(ctx)
+	for _, op := range s.operations.ops {
+		if id.CanActOn(op.owner) {
+			resp.Operations = append(resp.Operations, *convertOperation(op))
+		}
+	}
+	s.operations.lock.Unlock()
+	slices.SortFunc(resp.Operations, func(a, b serverapi.Operation) int {
+		if c := b.GetCreatedAt().Compare(a.GetCreatedAt()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.GetId(), b.GetId())
+	})
+	return resp
+}
+
+// convertOperation must be called with the lock of `operations` held.
+func convertOperation(op *operation) *serverapi.Operation {
+	resp := &serverapi.Operation{
+		Id:         serverapi.PtrString(op.id),
+		Type:       serverapi.PtrString(op.kind),
+		Target:     serverapi.PtrString(op.target),
+		Status:     serverapi.PtrString(op.status),
+		BytesDone:  serverapi.PtrInt64(op.bytesDone),
+		BytesTotal: serverapi.PtrInt64(op.bytesTotal),
+		CreatedAt:  serverapi.PtrTime(op.createdAt),
+		UpdatedAt:  serverapi.PtrTime(op.updatedAt),
+	}
+	if op.err != "" {
+		resp.SetError(op.err)
+	}
+	if len(op.result) > 0 {
+		resp.SetResult(maps.Clone(op.result))
+	}
+	return resp
+}
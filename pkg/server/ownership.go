@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// ValidateAuth checks that every API key in `cfg` has a distinct name that can't be taken for an
+// OIDC user's and a key, and the OIDC settings.
+func ValidateAuth(cfg config.ServerConfig) error {
+	names := make(map[string]bool)
+	for i, key := range cfg.Auth.APIKeys {
+		if key.Name == "" {
+			return fmt.Errorf("api key %d has no name", i)
+		}
+		if key.Key == "" {
+			return fmt.Errorf("api key %s has no key", key.Name)
+		}
+		if strings.HasPrefix(key.Name, auth.OIDCNamePrefix) {
+			return fmt.Errorf("api key %s: names can't start with %q, which OIDC users' do", key.Name, auth.OIDCNamePrefix)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("duplicate api key name: %s", key.Name)
+		}
+		names[key.Name] = true
+	}
+	return validateOIDC(cfg.Auth.OIDC)
+}
+
+// ownerFromContext returns the name VMs created on behalf of `ctx` are owned by. VMs created with
+// authentication disabled have no owner.
+func ownerFromContext(ctx context.Context) string {
+	if id := auth.FromContext(ctx); id != nil {
+		return id.Name
+	}
+	return ""
+}
+
+// authorizeVMLocked returns a PermissionDenied error if the caller may not change `vm`. Must be
+// called with `s.lock` held.
+func authorizeVMLocked(ctx context.Context, vm *vm) error {
+	if !auth.FromContext(ctx).CanActOn(vm.owner) {
+		return status.Errorf(codes.PermissionDenied, "vm %s is owned by another api key", vm.name)
+	}
+	return nil
+}
+
+// AuthorizeVM returns a PermissionDenied error if the caller may not change the VM `vmName`, which
+// may be hibernated. VMs that don't exist are left to the operation to report.
+func (s *Server) AuthorizeVM(ctx context.Context, vmName string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	vm, ok := s.vms[vmName]
+	if !ok {
+		return s.authorizeHibernatedVMLocked(ctx, vmName)
+	}
+	return authorizeVMLocked(ctx, vm)
+}
+
+// TransferVMOwnership hands the VM `vmName` over to the API key named `newOwner`. Only the current
+// owner and admins may do so.
+func (s *Server) TransferVMOwnership(ctx context.Context, vmName string, newOwner string) (*serverapi.VMResponse, error) {
+	if !s.isKnownOwner(newOwner) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown api key or oidc user: %s", newOwner)
+	}
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if err := authorizeVMLocked(ctx, vm); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	oldOwner := vm.owner
+	vm.owner = newOwner
+	// The old owner's token mustn't outlive the transfer, the new owner rotates in its own.
+	vm.sessionToken = ""
+	s.lock.Unlock()
+	s.vmsChanged()
+
+	log.WithFields(log.Fields{
+		"vmName":   vmName,
+		"oldOwner": oldOwner,
+		"newOwner": newOwner,
+	}).Info("transferred VM ownership")
+	s.events.Publish(events.VMOwnerChanged, vmName, map[string]string{"owner": newOwner})
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
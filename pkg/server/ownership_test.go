@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+func TestValidateAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []config.APIKeyConfig
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "valid", keys: []config.APIKeyConfig{{Name: "ci", Key: "secret"}, {Name: "ops", Key: "other", Admin: true}}},
+		{name: "no name", keys: []config.APIKeyConfig{{Key: "secret"}}, wantErr: true},
+		{name: "no key", keys: []config.APIKeyConfig{{Name: "ci"}}, wantErr: true},
+		{name: "duplicate name", keys: []config.APIKeyConfig{{Name: "ci", Key: "secret"}, {Name: "ci", Key: "other"}}, wantErr: true},
+		{name: "oidc name", keys: []config.APIKeyConfig{{Name: "oidc:alice", Key: "secret"}}, wantErr: true},
+		{name: "oidc in the name", keys: []config.APIKeyConfig{{Name: "ci-oidc:alice", Key: "secret"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.ServerConfig
+			cfg.Auth.APIKeys = tt.keys
+			if err := ValidateAuth(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateAuth() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
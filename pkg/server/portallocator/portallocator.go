@@ -68,3 +68,17 @@ func (a *PortAllocator) FreePort(port int32) error {
 	a.available = append(a.available, port)
 	return nil
 }
+
+// ClaimPort takes a specific port out of the pool of available ports
+func (a *PortAllocator) ClaimPort(port int32) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i, p := range a.available {
+		if p == port {
+			a.available = append(a.available[:i], a.available[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("port %d is not available", port)
+}
@@ -0,0 +1,552 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
+)
+
+const (
+	imageCacheDirName    = "images"
+	prewarmDisksDirName  = "prewarm-disks"
+	pooledDiskSuffix     = ".img"
+	imageDownloadTimeout = 30 * time.Minute
+	// Raw copies of qcow2 rootfs images in the image cache.
+	rawImageSuffix = ".raw"
+
+	// Upper bounds for a single prewarm request. Pool VMs reserve real host resources (IPs, tap
+	// devices, guest memory) so we don't let a typo take the whole host down.
+	maxPrewarmStatefulDisks = 64
+	maxPrewarmPoolVMs       = 16
+)
+
+// warmPool tracks host resources prepared ahead of time by `Prewarm`.
+type warmPool struct {
+	lock sync.Mutex
+	// Directory holding formatted stateful disks that haven't been handed to a VM yet.
+	disksDir      string
+	statefulDisks []string
+	// Names of booted VMs that haven't been claimed yet, keyed by template.
+	vms      map[string][]string
+	nextVMID int
+}
+
+// newWarmPool creates the pool, adopting stateful disks left over from a previous run as long as
+// they still match the configured size.
+func newWarmPool(disksDir string, diskSizeInMB int32) (*warmPool, error) {
+	if err := os.MkdirAll(disksDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create prewarm disks directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(disksDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prewarm disks directory: %w", err)
+	}
+
+	p := &warmPool{
+		disksDir: disksDir,
+		vms:      make(map[string][]string),
+	}
+	for _, entry := range entries {
+		diskPath := path.Join(disksDir, entry.Name())
+		info, err := entry.Info()
+		// Anything else is a disk that was still being formatted when we went down.
+		if err != nil || !strings.HasSuffix(entry.Name(), pooledDiskSuffix) || info.Size() != int64(diskSizeInMB)*1024*1024 {
+			if err := os.Remove(diskPath); err != nil {
+				log.WithError(err).Warnf("failed to remove stale prewarm disk: %s", diskPath)
+			}
+			continue
+		}
+		p.statefulDisks = append(p.statefulDisks, diskPath)
+	}
+	if len(p.statefulDisks) > 0 {
+		log.Infof("Adopted %d prewarmed stateful disks", len(p.statefulDisks))
+	}
+	return p, nil
+}
+
+func (p *warmPool) takeStatefulDisk() (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.statefulDisks) == 0 {
+		return "", false
+	}
+	diskPath := p.statefulDisks[len(p.statefulDisks)-1]
+	p.statefulDisks = p.statefulDisks[:len(p.statefulDisks)-1]
+	return diskPath, true
+}
+
+func (p *warmPool) addStatefulDisk(diskPath string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.statefulDisks = append(p.statefulDisks, diskPath)
+}
+
+// removeStatefulDisk deletes one disk from the pool.
+func (p *warmPool) removeStatefulDisk() error {
+	diskPath, ok := p.takeStatefulDisk()
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(diskPath); err != nil {
+		return fmt.Errorf("failed to remove prewarmed stateful disk: %w", err)
+	}
+	return nil
+}
+
+func (p *warmPool) numStatefulDisks() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.statefulDisks)
+}
+
+func (p *warmPool) newVMName(template string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.nextVMID++
+	// Pool VMs live in the default namespace, template names mustn't make them look otherwise.
+	template = strings.ReplaceAll(template, namespaceSeparator, "-")
+	return fmt.Sprintf("pool-%s-%d", template, p.nextVMID)
+}
+
+func (p *warmPool) takeVM(template string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	names := p.vms[template]
+	if len(names) == 0 {
+		return "", false
+	}
+	p.vms[template] = names[1:]
+	return names[0], true
+}
+
+func (p *warmPool) addVM(template string, vmName string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.vms[template] = append(p.vms[template], vmName)
+}
+
+// removeVM forgets a pooled VM, e.g. when it is destroyed before being claimed.
+func (p *warmPool) removeVM(vmName string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for template, names := range p.vms {
+		for i, name := range names {
+			if name == vmName {
+				p.vms[template] = append(names[:i:i], names[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// templates returns the templates that currently have pooled VMs.
+func (p *warmPool) templates() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var templates []string
+	for template, names := range p.vms {
+		if len(names) > 0 {
+			templates = append(templates, template)
+		}
+	}
+	return templates
+}
+
+func (p *warmPool) vmNames(template string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.vms[template]...)
+}
+
+// resolveImage returns a local path for `src`. Local paths are returned as is, http(s) URLs are
+// downloaded into the image cache once and served from there afterwards.
+func (s *Server) resolveImage(ctx context.Context, src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		if _, err := os.Stat(src); err != nil {
+			return "", fmt.Errorf("image not found: %w", err)
+		}
+		return src, nil
+	}
+
+	sum := sha256.Sum256([]byte(src))
+	cachedPath := path.Join(
+		s.config.StateDir,
+		imageCacheDirName,
+		hex.EncodeToString(sum[:8])+"-"+path.Base(u.Path),
+	)
+	if _, err := os.Stat(cachedPath); err == nil {
+		return cachedPath, nil
+	}
+
+	log.WithFields(log.Fields{"url": src, "path": cachedPath}).Info("downloading image")
+	if err := downloadImage(ctx, src, cachedPath); err != nil {
+		return "", fmt.Errorf("failed to download image %s: %w", src, err)
+	}
+	return cachedPath, nil
+}
+
+// downloadImage fetches `src` into `destPath`. The image only appears at `destPath` once it has
+// been fully written, so concurrent or interrupted downloads never leave a truncated image behind.
+func downloadImage(ctx context.Context, src string, destPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, imageDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	tmpFile, err := os.CreateTemp(path.Dir(destPath), ".download-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	// No-op once the rename below succeeds.
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync image: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), destPath); err != nil {
+		return fmt.Errorf("failed to move image into place: %w", err)
+	}
+	return nil
+}
+
+// rawImage returns the path of a raw copy of the disk image at `imagePath` if it's a qcow2 image,
+// as most prebuilt cloud images are, and `imagePath` itself otherwise. The copy is converted with
+// qemu-img into the image cache once per version of the image, so that the hypervisor reads the
+// disks of every VM without going through qcow2, whose compressed clusters it can't read.
+func (s *Server) rawImage(imagePath string) (string, error) {
+	format, err := diskFormat(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("image not found: %w", err)
+	}
+	if format != diskFormatQcow2 {
+		return imagePath, nil
+	}
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("image not found: %w", err)
+	}
+	absPath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve image path: %w", err)
+	}
+	// A new version of the image gets a copy of its own.
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", absPath, info.Size(), info.ModTime().UnixNano())))
+	rawPath := path.Join(
+		s.config.StateDir,
+		imageCacheDirName,
+		hex.EncodeToString(sum[:8])+"-"+strings.TrimSuffix(path.Base(imagePath), path.Ext(imagePath))+rawImageSuffix,
+	)
+	if _, err := os.Stat(rawPath); err == nil {
+		return rawPath, nil
+	}
+
+	log.WithFields(log.Fields{"image": imagePath, "path": rawPath}).Info("converting qcow2 image to raw")
+	if err := convertImage(imagePath, rawPath); err != nil {
+		return "", fmt.Errorf("failed to convert image %s: %w", imagePath, err)
+	}
+	return rawPath, nil
+}
+
+// convertImage writes the qcow2 image at `src` to `destPath` as a sparse raw image. Like
+// downloaded ones, the image only appears at `destPath` once it has been fully written.
+func convertImage(src string, destPath string) error {
+	tmpFile, err := os.CreateTemp(path.Dir(destPath), ".convert-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpFile.Close()
+	// No-op once the rename below succeeds.
+	defer os.Remove(tmpFile.Name())
+
+	if err := convertDisk(src, tmpFile.Name(), diskFormatRaw); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), destPath); err != nil {
+		return fmt.Errorf("failed to move image into place: %w", err)
+	}
+	return nil
+}
+
+// NeedsConversion returns whether the image at `imagePath` is a qcow2 image that is converted to
+// raw before VMs boot from it.
+func NeedsConversion(imagePath string) bool {
+	format, err := diskFormat(imagePath)
+	return err == nil && format == diskFormatQcow2
+}
+
+// warmImage reads the whole image once so that it sits in the host page cache when the next VM
+// boots from it.
+func warmImage(imagePath string) error {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.Discard, f); err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	return nil
+}
+
+// templateImages returns local kernel, initramfs and rootfs paths for the named template, fetching
+// remote images and converting qcow2 rootfs images as needed. Images the template doesn't set fall back to the server defaults.
+func (s *Server) templateImages(ctx context.Context, template string) (string, string, string, error) {
+	tmpl, ok := s.templateConfig(template)
+	if !ok {
+		return "", "", "", status.Errorf(codes.NotFound, "template not found: %s", template)
+	}
+
+	images := []struct {
+		src      string
+		fallback string
+	}{
+		{tmpl.Kernel, s.config.KernelPath},
+		{tmpl.Initramfs, s.config.InitramfsPath},
+		{tmpl.Rootfs, s.config.RootfsPath},
+	}
+	resolved := make([]string, len(images))
+	for i, image := range images {
+		src := image.src
+		if src == "" {
+			src = image.fallback
+		}
+		p, err := s.resolveImage(ctx, src)
+		if err != nil {
+			return "", "", "", err
+		}
+		resolved[i] = p
+	}
+	rootfs, err := s.rawImage(resolved[2])
+	if err != nil {
+		return "", "", "", err
+	}
+	return resolved[0], resolved[1], rootfs, nil
+}
+
+// prepareStatefulDisk places a formatted stateful disk at `diskPath`, preferring one from the warm
+// pool over formatting a new one.
+func (s *Server) prepareStatefulDisk(diskPath string) error {
+	if pooled, ok := s.warmPool.takeStatefulDisk(); ok {
+		err := os.Rename(pooled, diskPath)
+		if err == nil {
+			log.Infof("Using prewarmed stateful disk %s for %s", pooled, diskPath)
+			return nil
+		}
+		log.WithError(err).Warnf("failed to use prewarmed stateful disk: %s", pooled)
+		os.Remove(pooled)
+	}
+	return createStatefulDisk(diskPath, s.config.StatefulSizeInMB)
+}
+
+// addPooledStatefulDisk formats a new stateful disk and adds it to the warm pool.
+func (s *Server) addPooledStatefulDisk() error {
+	name := fmt.Sprintf("%d", time.Now().UnixNano())
+	// Formatted under a temporary name so that a crash mid-way isn't mistaken for a usable disk.
+	tmpPath := path.Join(s.warmPool.disksDir, name+".tmp")
+	if err := createStatefulDisk(tmpPath, s.config.StatefulSizeInMB); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	diskPath := path.Join(s.warmPool.disksDir, name+pooledDiskSuffix)
+	if err := os.Rename(tmpPath, diskPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move stateful disk into the pool: %w", err)
+	}
+	s.warmPool.addStatefulDisk(diskPath)
+	return nil
+}
+
+// bootPoolVM boots a VM for `template` and parks it in the warm pool until a StartVM request for
+// the template claims it.
+func (s *Server) bootPoolVM(ctx context.Context, template string, kernelPath string, initramfsPath string, rootfsPath string) (string, error) {
+	vmName := s.warmPool.newVMName(template)
+	for s.getVMAtomic(vmName) != nil {
+		vmName = s.warmPool.newVMName(template)
+	}
+	logger := log.WithFields(log.Fields{"template": template, "vmName": vmName})
+	defer s.vmsChanged()
+
+	artifacts := newVMArtifacts(s.config.StateDir, vmName)
+	tmpl, _ := s.templateConfig(template)
+	artifacts.baseImage = tmpl.BaseImage
+	// Validated along with the template.
+	artifacts.guestMemory, _ = templateGuestMemory(tmpl)
+	artifacts.diskLimit, _ = s.newDiskLimit(template, nil)
+	vm, err := s.createVM(ctx, vmName, artifacts, kernelPath, initramfsPath, rootfsPath, template, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to create pool VM: %w", err)
+	}
+	if err := vm.boot(ctx); err != nil {
+		if err := s.destroyVM(ctx, vmName); err != nil {
+			logger.WithError(err).Error("failed to destroy pool VM after boot failure")
+		}
+		return "", fmt.Errorf("failed to boot pool VM: %w", err)
+	}
+	if err := s.waitForCmdServerReady(ctx, vm.ip.IP.String(), s.Config().Timeouts.Boot); err != nil {
+		logger.WithError(err).Warn("command server not ready in pool VM")
+	}
+
+	s.warmPool.addVM(template, vmName)
+	logger.Info("pool VM ready")
+	return vmName, nil
+}
+
+// claimPooledVM hands a pre-booted VM for `template` over to `vmName`, owned by `owner`. Returns nil
+// if there is no pooled VM available.
+func (s *Server) claimPooledVM(template string, vmName string, owner string) *vm {
+	for {
+		poolName, ok := s.warmPool.takeVM(template)
+		if !ok {
+			return nil
+		}
+
+		s.lock.Lock()
+		vm, exists := s.vms[poolName]
+		if !exists {
+			// Destroyed behind our back, try the next one.
+			s.lock.Unlock()
+			continue
+		}
+		if _, taken := s.vms[vmName]; taken {
+			s.lock.Unlock()
+			s.warmPool.addVM(template, poolName)
+			return nil
+		}
+		delete(s.vms, poolName)
+		vm.name = vmName
+		vm.owner = owner
+		s.vms[vmName] = vm
+		s.lock.Unlock()
+		s.vmsChanged()
+
+		log.WithFields(log.Fields{
+			"template": template,
+			"poolVM":   poolName,
+			"vmName":   vmName,
+		}).Info("claimed pool VM")
+		return vm
+	}
+}
+
+// ResolveGuestName maps the name a guest was booted with to the name the VM is currently known by.
+// They differ for VMs that were claimed from the warm pool.
+func (s *Server) ResolveGuestName(guestName string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for name, vm := range s.vms {
+		if vm.guestName == guestName {
+			return name
+		}
+	}
+	return guestName
+}
+
+// Prewarm prepares this host for bursts of VMs started from `req.Template`. It fetches and warms
+// the template images, tops up the stateful disk pool and pre-boots pool VMs.
+func (s *Server) Prewarm(ctx context.Context, req *serverapi.PrewarmRequest) (_ *serverapi.PrewarmResponse, retErr error) {
+	// Config keys, and therefore template names, are case insensitive.
+	template := strings.ToLower(req.GetTemplate())
+	wantDisks := int(req.GetStatefulDisks())
+	wantVMs := int(req.GetPoolVms())
+
+	ctx, span := tracing.Start(
+		ctx,
+		"server.Prewarm",
+		tracing.String("template", template),
+		tracing.Int("prewarm.stateful_disks", int64(wantDisks)),
+		tracing.Int("prewarm.pool_vms", int64(wantVMs)),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+
+	if wantDisks < 0 || wantDisks > maxPrewarmStatefulDisks {
+		return nil, status.Errorf(codes.InvalidArgument, "statefulDisks must be between 0 and %d", maxPrewarmStatefulDisks)
+	}
+	if wantVMs < 0 || wantVMs > maxPrewarmPoolVMs {
+		return nil, status.Errorf(codes.InvalidArgument, "poolVms must be between 0 and %d", maxPrewarmPoolVMs)
+	}
+
+	done, err := s.beginOp(true)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	logger := log.WithField("template", template)
+	logger.Info("received request to prewarm host")
+
+	kernelPath, initramfsPath, rootfsPath, err := s.templateImages(ctx, template)
+	if err != nil {
+		return nil, err
+	}
+	images := []string{kernelPath, initramfsPath, rootfsPath}
+	for _, image := range images {
+		if err := warmImage(image); err != nil {
+			return nil, fmt.Errorf("failed to warm image %s: %w", image, err)
+		}
+	}
+	logger.WithField("images", images).Info("images warmed")
+
+	for i := s.warmPool.numStatefulDisks(); i < wantDisks; i++ {
+		if err := s.addPooledStatefulDisk(); err != nil {
+			return nil, fmt.Errorf("failed to pre-create stateful disk: %w", err)
+		}
+	}
+
+	for i := len(s.warmPool.vmNames(template)); i < wantVMs; i++ {
+		if _, err := s.bootPoolVM(ctx, template, kernelPath, initramfsPath, rootfsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Info("host prewarmed")
+	return &serverapi.PrewarmResponse{
+		Template:           serverapi.PtrString(template),
+		Images:             images,
+		StatefulDisksReady: serverapi.PtrInt32(int32(s.warmPool.numStatefulDisks())),
+		PooledVms:          s.warmPool.vmNames(template),
+	}, nil
+}
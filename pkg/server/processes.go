@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// processCall sends `req` to the vsockserver of the running VM `vmName` and decodes the result
+// into `result`. Errors are NotFound for unknown VMs or processes, InvalidArgument for bad
+// requests, FailedPrecondition if the VM isn't running or the process can't be started, and
+// Unavailable if the vsockserver can't be reached or doesn't know the command.
+func (s *Server) processCall(ctx context.Context, vmName string, req guestcall.ProcessRequest, result any) error {
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Config().Timeouts.ExecDefault)
+	defer cancel()
+	conn, reader, err := s.dialAgent(ctx, vm)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := guestcall.CallProcess(conn, reader, req, result); err != nil {
+		var respErr *guestcall.ResponseError
+		if !errors.As(err, &respErr) {
+			return status.Errorf(codes.Unavailable, "failed to call the vsockserver, it may be too old to manage processes: %v", err)
+		}
+		switch respErr.Code {
+		case guestcall.ErrorInvalidProcess:
+			return status.Error(codes.InvalidArgument, respErr.Message)
+		case guestcall.ErrorProcessNotFound:
+			return status.Error(codes.NotFound, respErr.Message)
+		case guestcall.ErrorTooManyProcesses, guestcall.ErrorProcessFailed:
+			return status.Error(codes.FailedPrecondition, respErr.Message)
+		default:
+			// E.g. an unknown command, from a vsockserver that predates processes.
+			return status.Errorf(codes.Unavailable, "vsockserver failed, it may be too old to manage processes: %s", respErr.Message)
+		}
+	}
+	return nil
+}
+
+func processToAPI(info guestcall.ProcessInfo) serverapi.Process {
+	process := serverapi.Process{
+		Id:         serverapi.PtrString(info.ID),
+		Cmd:        serverapi.PtrString(info.Cmd),
+		Pid:        serverapi.PtrInt32(int32(info.PID)),
+		Running:    serverapi.PtrBool(info.Running),
+		StartedAt:  serverapi.PtrTime(info.StartedAt),
+		OutputSize: serverapi.PtrInt64(info.OutputSize),
+	}
+	if info.ExitCode != nil {
+		process.ExitCode = serverapi.PtrInt32(int32(*info.ExitCode))
+	}
+	if info.ExitedAt != nil {
+		process.ExitedAt = serverapi.PtrTime(*info.ExitedAt)
+	}
+	return process
+}
+
+// StartProcess starts `req.Cmd` detached in the guest of `vmName`.
+func (s *Server) StartProcess(ctx context.Context, vmName string, req *serverapi.ProcessStartRequest) (*serverapi.Process, error) {
+	if strings.TrimSpace(req.GetCmd()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "cmd is required")
+	}
+	var info guestcall.ProcessInfo
+	err := s.processCall(ctx, vmName, guestcall.ProcessRequest{
+		Op:      guestcall.ProcessOpStart,
+		Cmd:     req.GetCmd(),
+		Env:     req.GetEnv(),
+		Workdir: req.GetWorkdir(),
+	}, &info)
+	if err != nil {
+		return nil, err
+	}
+	process := processToAPI(info)
+	return &process, nil
+}
+
+// ListProcesses returns the processes started in the guest of `vmName`, oldest first.
+func (s *Server) ListProcesses(ctx context.Context, vmName string) (*serverapi.ListProcessesResponse, error) {
+	var list guestcall.ProcessList
+	if err := s.processCall(ctx, vmName, guestcall.ProcessRequest{Op: guestcall.ProcessOpList}, &list); err != nil {
+		return nil, err
+	}
+	resp := &serverapi.ListProcessesResponse{Processes: []serverapi.Process{}}
+	for _, info := range list.Processes {
+		resp.Processes = append(resp.Processes, processToAPI(info))
+	}
+	return resp, nil
+}
+
+// ProcessOutput returns the output of the process `id` from `offset`, at most `maxBytes` of it
+// unless zero.
+func (s *Server) ProcessOutput(ctx context.Context, vmName string, id string, offset int64, maxBytes int) (*serverapi.ProcessOutputResponse, error) {
+	if offset < 0 || maxBytes < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset and maxBytes can't be negative")
+	}
+	var output guestcall.ProcessOutput
+	err := s.processCall(ctx, vmName, guestcall.ProcessRequest{
+		Op:       guestcall.ProcessOpOutput,
+		ID:       id,
+		Offset:   offset,
+		MaxBytes: maxBytes,
+	}, &output)
+	if err != nil {
+		return nil, err
+	}
+	process := processToAPI(output.Process)
+	return &serverapi.ProcessOutputResponse{
+		Offset:     serverapi.PtrInt64(output.Offset),
+		NextOffset: serverapi.PtrInt64(output.NextOffset),
+		Data:       serverapi.PtrString(strings.ToValidUTF8(string(output.Data), "�")),
+		Truncated:  serverapi.PtrBool(output.Truncated),
+		Process:    &process,
+	}, nil
+}
+
+// SignalProcess sends the signal named `signal` to the process group of the process `id`.
+func (s *Server) SignalProcess(ctx context.Context, vmName string, id string, signal string) (*serverapi.Process, error) {
+	if signal == "" {
+		return nil, status.Error(codes.InvalidArgument, "signal is required")
+	}
+	if !strings.HasPrefix(strings.ToUpper(signal), "SIG") {
+		signal = "SIG" + signal
+	}
+	var info guestcall.ProcessInfo
+	if err := s.processCall(ctx, vmName, guestcall.ProcessRequest{Op: guestcall.ProcessOpSignal, ID: id, Signal: signal}, &info); err != nil {
+		return nil, err
+	}
+	process := processToAPI(info)
+	return &process, nil
+}
+
+// KillProcess kills the process group of the process `id` and forgets it.
+func (s *Server) KillProcess(ctx context.Context, vmName string, id string) (*serverapi.Process, error) {
+	var info guestcall.ProcessInfo
+	if err := s.processCall(ctx, vmName, guestcall.ProcessRequest{Op: guestcall.ProcessOpKill, ID: id}, &info); err != nil {
+		return nil, err
+	}
+	process := processToAPI(info)
+	return &process, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+// checkProtectionLocked returns an error if `vm` is protected and the caller may not stop or
+// destroy it. Protected VMs only go down when the request is forced by an admin, or by anyone with
+// authentication disabled. Must be called with `s.lock` held.
+func checkProtectionLocked(ctx context.Context, vm *vm, force bool) error {
+	if !vm.protected {
+		return nil
+	}
+	if !force {
+		return status.Errorf(codes.FailedPrecondition, "vm %s is protected, pass force with an admin key", vm.name)
+	}
+	if id := auth.FromContext(ctx); id != nil && !id.Has(auth.PermissionAdmin) {
+		return status.Errorf(codes.PermissionDenied, "only admins can force changes to protected vm %s", vm.name)
+	}
+	return nil
+}
+
+// checkProtection is checkProtectionLocked for the VM `vmName`. VMs that don't exist are left to
+// the operation to report.
+func (s *Server) checkProtection(ctx context.Context, vmName string, force bool) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	vm, ok := s.vms[vmName]
+	if !ok {
+		return nil
+	}
+	return checkProtectionLocked(ctx, vm, force)
+}
+
+// protectVM marks the VM `vmName` protected. Restarting a VM never drops its protection.
+func (s *Server) protectVM(vmName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.vms[vmName]; ok {
+		vm.protected = true
+	}
+}
+
+// SetVMProtection turns the protection of the VM `vmName` on or off. Anyone who may change the VM
+// can protect it, but only admins can lift the protection again.
+func (s *Server) SetVMProtection(ctx context.Context, vmName string, protected bool) (*serverapi.VMResponse, error) {
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if err := authorizeVMLocked(ctx, vm); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	if !protected {
+		if err := checkProtectionLocked(ctx, vm, true); err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+	}
+	vm.protected = protected
+	s.lock.Unlock()
+	s.vmsChanged()
+
+	log.WithFields(log.Fields{
+		"vmName":    vmName,
+		"protected": protected,
+	}).Info("changed VM protection")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// readCache holds responses of hot read endpoints for a short time, so that many clients polling
+// at once don't all contend for the server lock. Concurrent misses for the same key share a single
+// fill. Everything is dropped whenever a VM changes, so the TTL only bounds how stale a response
+// can be if an invalidation is missed.
+type readCache struct {
+	lock    sync.Mutex
+	entries map[string]readCacheEntry
+	// Bumped on every invalidation, fills that started before one aren't stored.
+	generation uint64
+	fills      singleflight.Group
+}
+
+type readCacheEntry struct {
+	value   any
+	expires time.Time
+}
+
+func newReadCache() *readCache {
+	return &readCache{
+		entries: make(map[string]readCacheEntry),
+	}
+}
+
+// get returns the cached value for `key`, calling `fill` to compute it if it's missing or older
+// than `ttl`. A non-positive `ttl` disables caching. Errors aren't cached. Cached values are
+// shared between callers so they must not be modified.
+func (c *readCache) get(key string, ttl time.Duration, fill func() (any, error)) (any, error) {
+	if ttl <= 0 {
+		return fill()
+	}
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err, _ := c.fills.Do(fmt.Sprintf("%d/%s", generation, key), func() (any, error) {
+		value, err := fill()
+		if err != nil {
+			return nil, err
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.generation == generation {
+			c.entries[key] = readCacheEntry{value: value, expires: time.Now().Add(ttl)}
+		}
+		return value, nil
+	})
+	return value, err
+}
+
+// invalidate drops all cached values.
+func (c *readCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	clear(c.entries)
+}
+
+// vmsChanged must be called whenever a VM is added, removed, renamed or changes status.
+func (s *Server) vmsChanged() {
+	s.readCache.invalidate()
+	s.saveVMRegistry()
+}
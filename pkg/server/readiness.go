@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+)
+
+const (
+	// How often a readiness probe is retried until it passes, unless the start says otherwise.
+	defaultReadinessInterval = 500 * time.Millisecond
+	// The longest a readiness command runs before it counts as failed, or the time left to boot if
+	// that's shorter.
+	maxReadinessCommandTimeout = 10 * time.Second
+	// How much of a failed readiness command's output its error quotes, the end of it.
+	readinessOutputLimit = 256
+)
+
+// bootTimeout returns how long a start may take to get the VM ready, `seconds` if it's set and
+// the boot timeout of the config otherwise.
+func (s *Server) bootTimeout(seconds int32) (time.Duration, error) {
+	timeouts := s.Config().Timeouts
+	if seconds == 0 {
+		return timeouts.Boot, nil
+	}
+	timeout := time.Duration(seconds) * time.Second
+	if seconds < 0 || timeout > timeouts.BootMax {
+		return 0, status.Errorf(codes.InvalidArgument, "bootTimeoutSeconds must be between 0 and %d", int64(timeouts.BootMax/time.Second))
+	}
+	return timeout, nil
+}
+
+// validateReadinessProbe checks the readiness probe of a start, which may be nil.
+func validateReadinessProbe(probe *serverapi.ReadinessProbe) error {
+	if probe == nil {
+		return nil
+	}
+	if port, ok := probe.GetPortOk(); ok && (*port < 1 || *port > 65535) {
+		return status.Errorf(codes.InvalidArgument, "readiness port must be between 1 and 65535, not %d", *port)
+	}
+	if probe.GetIntervalMs() < 0 {
+		return status.Errorf(codes.InvalidArgument, "readiness intervalMs can't be negative")
+	}
+	return nil
+}
+
+// waitForVMReady waits, for at most `timeout`, until the guest agent of `vm` answers and then
+// `probe`, if any, passes. Returns a DeadlineExceeded error saying what didn't get ready otherwise.
+func (s *Server) waitForVMReady(ctx context.Context, vm *vm, probe *serverapi.ReadinessProbe, timeout time.Duration) error {
+	timing := bootTimingFromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.waitForCmdServerReady(ctx, vm.ip.IP.String(), timeout); err != nil {
+		return status.Errorf(codes.DeadlineExceeded, "boot timed out after %s, the guest agent didn't answer: %v", timeout, err)
+	}
+	timing.guestAgentReady = time.Since(start)
+	if probe == nil {
+		return nil
+	}
+
+	start = time.Now()
+	interval := defaultReadinessInterval
+	if probe.GetIntervalMs() > 0 {
+		interval = time.Duration(probe.GetIntervalMs()) * time.Millisecond
+	}
+	for {
+		err := s.probeReadiness(ctx, vm, probe)
+		if err == nil {
+			timing.readiness = time.Since(start)
+			return nil
+		}
+		log.WithField("vmName", vm.name).WithError(err).Debug("VM not ready yet")
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.DeadlineExceeded, "boot timed out after %s, the readiness probe didn't pass: %v", timeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probeReadiness checks `probe` against `vm` once, returning why it failed if it did.
+func (s *Server) probeReadiness(ctx context.Context, vm *vm, probe *serverapi.ReadinessProbe) error {
+	if port, ok := probe.GetPortOk(); ok {
+		dialer := &net.Dialer{Timeout: s.Config().Timeouts.AgentDial}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(vm.ip.IP.String(), strconv.Itoa(int(*port))))
+		if err != nil {
+			return fmt.Errorf("port %d isn't accepting connections: %w", *port, err)
+		}
+		conn.Close()
+	}
+
+	if command, ok := probe.GetCommandOk(); ok && *command != "" {
+		timeout := maxReadinessCommandTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = min(timeout, time.Until(deadline))
+		}
+		if timeout <= 0 {
+			return errors.New("no time left to run the readiness command")
+		}
+		req := cmdserver.RunCmdRequest{
+			Cmd:            *command,
+			Blocking:       true,
+			TimeoutSeconds: timeoutSeconds(timeout),
+		}
+		url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+		resp, err := vm.handleRun(ctx, s.agentClient(timeout+commandGrace), url, req)
+		if err != nil {
+			return fmt.Errorf("failed to run the readiness command: %w", err)
+		}
+		// Commands killed for running too long have an error and no exit code.
+		exitCode, ok := resp.GetExitCodeOk()
+		if !ok {
+			return fmt.Errorf("the readiness command failed: %s", resp.GetError())
+		}
+		if *exitCode != 0 {
+			return fmt.Errorf("the readiness command exited with %d: %s", *exitCode, lastBytes(resp.GetOutput(), readinessOutputLimit))
+		}
+	}
+	return nil
+}
+
+// destroyUnreadyVM destroys the VM `vmName` that a start brought up but that didn't get ready.
+func (s *Server) destroyUnreadyVM(ctx context.Context, vmName string) {
+	// Cleaned up even if the caller has gone.
+	if err := s.destroyVM(context.WithoutCancel(ctx), vmName); err != nil {
+		log.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM that didn't get ready")
+	}
+}
+
+// lastBytes returns the last `n` bytes of `s`, trimmed of surrounding whitespace.
+func lastBytes(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) > n {
+		s = "..." + s[len(s)-n:]
+	}
+	return s
+}
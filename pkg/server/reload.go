@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// Settings, by mapstructure key, that `ApplyConfig` picks up without a restart. It copies them
+// over by this table alone, so settings only need to be listed here.
+var reloadableSettings = map[string]bool{
+	"log_level":               true,
+	"templates":               true,
+	"warm_pool":               true,
+	"drain":                   true,
+	"timeouts":                true,
+	"kernel_module_allowlist": true,
+	"host_mounts":             true,
+	"read_cache_ttl":          true,
+	"auth":                    true,
+	"websocket":               true,
+	"normalize_vm_names":      true,
+	"snapshot_store":          true,
+	"image_compaction":        true,
+	"credential_profiles":     true,
+	"console_logs":            true,
+	"crash_detection":         true,
+	"health":                  true,
+	"gc":                      true,
+	"idle":                    true,
+	"hooks":                   true,
+	"api_host_hooks":          true,
+	"secrets":                 true,
+	"vault":                   true,
+	"shared_dirs":             true,
+	"base_images":             true,
+	"volumes":                 true,
+	"hypervisor_sandbox":      true,
+	"hypervisor_cgroups":      true,
+	"api":                     true,
+}
+
+// restartRequiredSettings returns the settings that differ between `old` and `new` but only take
+// effect after a restart.
+func restartRequiredSettings(old config.ServerConfig, new config.ServerConfig) []string {
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(new)
+	structType := oldValue.Type()
+
+	var changed []string
+	for i := 0; i < structType.NumField(); i++ {
+		key := structType.Field(i).Tag.Get("mapstructure")
+		if reloadableSettings[key] {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// applyReloadableSettings copies the settings in `reloadableSettings` from `new` to `cfg`,
+// leaving the others alone.
+func applyReloadableSettings(cfg *config.ServerConfig, new config.ServerConfig) {
+	configValue := reflect.ValueOf(cfg).Elem()
+	newValue := reflect.ValueOf(new)
+	structType := configValue.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		if reloadableSettings[structType.Field(i).Tag.Get("mapstructure")] {
+			configValue.Field(i).Set(newValue.Field(i))
+		}
+	}
+}
+
+// Config returns the server's current configuration.
+func (s *Server) Config() config.ServerConfig {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+func (s *Server) templateConfig(template string) (config.TemplateConfig, bool) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	tmpl, ok := s.config.Templates[template]
+	return tmpl, ok
+}
+
+// ApplyConfig switches the server over to `newConfig` for all reloadable settings and resizes the
+// warm pool in the background to match. Returns the changed settings that need a restart to take
+// effect; those keep their current values until then.
+func (s *Server) ApplyConfig(newConfig config.ServerConfig) ([]string, error) {
+	if err := ValidateTemplates(newConfig); err != nil {
+		return nil, err
+	}
+	if err := ValidateAuth(newConfig); err != nil {
+		return nil, err
+	}
+
+	s.configLock.Lock()
+	restartRequired := restartRequiredSettings(s.config, newConfig)
+	if !reflect.DeepEqual(s.config.Auth.OIDC, newConfig.Auth.OIDC) {
+		// Drops the cached signing keys too, in case the issuer changed.
+		s.oidc = newOIDCVerifier(newConfig.Auth.OIDC)
+	}
+	applyReloadableSettings(&s.config, newConfig)
+	s.configLock.Unlock()
+	s.readCache.invalidate()
+
+	log.WithField("restartRequired", restartRequired).Info("applied new server config")
+	s.events.Publish(events.ServerConfigReload, "", map[string]string{
+		"restartRequired": strings.Join(restartRequired, ","),
+	})
+	go func() {
+		if err := s.ReconcileWarmPool(context.Background()); err != nil {
+			log.WithError(err).Error("failed to resize warm pool after config reload")
+		}
+	}()
+	return restartRequired, nil
+}
+
+// ReconcileWarmPool grows or shrinks the stateful disk pool and each template's pool of pre-booted
+// VMs to the sizes in the config. Pool VMs of templates that are no longer configured are destroyed.
+func (s *Server) ReconcileWarmPool(ctx context.Context) error {
+	// Growing the pool is slow, don't let overlapping reloads both do it.
+	s.reconcileLock.Lock()
+	defer s.reconcileLock.Unlock()
+
+	// Pool VMs are new work, so there is no point in booting them while draining.
+	done, err := s.beginOp(true)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	cfg := s.Config()
+	var finalErr error
+
+	wantDisks := int(cfg.WarmPool.StatefulDisks)
+	for s.warmPool.numStatefulDisks() < wantDisks {
+		if err := s.addPooledStatefulDisk(); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to pre-create stateful disk: %w", err))
+			break
+		}
+	}
+	for s.warmPool.numStatefulDisks() > wantDisks {
+		if err := s.warmPool.removeStatefulDisk(); err != nil {
+			finalErr = errors.Join(finalErr, err)
+			break
+		}
+	}
+
+	templates := s.warmPool.templates()
+	for name := range cfg.Templates {
+		templates = append(templates, name)
+	}
+	for _, template := range templates {
+		want := int(cfg.Templates[template].PoolVMs)
+		have := len(s.warmPool.vmNames(template))
+		if have < want {
+			kernelPath, initramfsPath, rootfsPath, err := s.templateImages(ctx, template)
+			if err != nil {
+				finalErr = errors.Join(finalErr, err)
+				continue
+			}
+			for ; have < want; have++ {
+				if _, err := s.bootPoolVM(ctx, template, kernelPath, initramfsPath, rootfsPath); err != nil {
+					finalErr = errors.Join(finalErr, err)
+					break
+				}
+			}
+		}
+		for ; have > want; have-- {
+			vmName, ok := s.warmPool.takeVM(template)
+			if !ok {
+				break
+			}
+			if err := s.destroyVM(ctx, vmName); err != nil {
+				finalErr = errors.Join(finalErr, fmt.Errorf("failed to destroy pool VM %s: %w", vmName, err))
+			}
+		}
+	}
+	return finalErr
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+)
+
+// Types of the reports guests send about their own work.
+const (
+	ReportProgress = "progress"
+	ReportArtifact = "artifact"
+	// Sent periodically by long-running tasks. Heartbeats only go to the VM's callback client,
+	// they'd crowd the other events out of the events stream's history.
+	ReportHeartbeat = "heartbeat"
+	// Sent by the guest's watchdog after an agent crashed and was restarted.
+	ReportAgentRestart = "agent_restart"
+	// Sent by the guest once it mounted the VM's shared directories, with the transport of each by
+	// tag.
+	ReportSharedDirs = "shared_dirs"
+	// Sent by the guest after its kernel killed a process for running out of memory.
+	ReportOOMKill = "oom_kill"
+)
+
+// Largest report, counting the keys and values of its data.
+const maxReportSize = 16 << 10
+
+var reportEvents = map[string]string{
+	ReportProgress: events.VMProgress,
+	ReportArtifact: events.VMArtifact,
+	// Not published.
+	ReportHeartbeat:    "",
+	ReportAgentRestart: events.VMAgentRestarted,
+	ReportSharedDirs:   events.VMSharedDirsMounted,
+	// Published by recordOOMKill.
+	ReportOOMKill: "",
+}
+
+// agentCrash is the last crash of an agent in a VM's guest.
+type agentCrash struct {
+	agent  string
+	reason string
+	time   time.Time
+}
+
+// newAgentCrash returns the crash an agent restart report describes.
+func newAgentCrash(data map[string]string) *agentCrash {
+	// e.g. "signal (killed SEGV)" or "exit-code (exited 1)".
+	reason := data["result"]
+	if detail := strings.TrimSpace(data["exitCode"] + " " + data["exitStatus"]); detail != "" {
+		reason += " (" + detail + ")"
+	}
+	crashedAt, err := time.Parse(time.RFC3339, data["crashedAt"])
+	if err != nil {
+		crashedAt = time.Now().UTC()
+	}
+	return &agentCrash{agent: data["agent"], reason: reason, time: crashedAt}
+}
+
+func convertAgentCrash(crash *agentCrash) *serverapi.AgentCrash {
+	if crash == nil {
+		return nil
+	}
+	return &serverapi.AgentCrash{
+		Agent:  serverapi.PtrString(crash.agent),
+		Reason: serverapi.PtrString(crash.reason),
+		Time:   serverapi.PtrTime(crash.time),
+	}
+}
+
+// guestVM returns the qualified name and the VM of the guest `guestName`, checking that `what` it
+// sent came from the VM's own IP, so that guests can't speak for other VMs.
+func (s *Server) guestVM(guestName string, sourceIP net.IP, what string) (string, *vm, error) {
+	vmName := s.ResolveGuestName(guestName)
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return "", nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if vm.ip == nil || !vm.ip.IP.Equal(sourceIP) {
+		log.WithFields(log.Fields{
+			"vmName":   vmName,
+			"sourceIP": sourceIP,
+		}).Warnf("rejected %s from another address", what)
+		return "", nil, status.Errorf(codes.PermissionDenied, "%s for vm %s must come from the vm", what, vmName)
+	}
+	return vmName, vm, nil
+}
+
+// PublishGuestReport publishes a report the guest `guestName` sent about its own work as an event,
+// and returns the qualified name of the VM. Reports are only accepted from the VM's own IP, so that
+// guests can't speak for other VMs.
+func (s *Server) PublishGuestReport(guestName string, sourceIP net.IP, reportType string, data map[string]string) (string, error) {
+	eventType, ok := reportEvents[reportType]
+	if !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unknown report type %q", reportType)
+	}
+	size := 0
+	for key, value := range data {
+		size += len(key) + len(value)
+	}
+	if size > maxReportSize {
+		return "", status.Errorf(codes.InvalidArgument, "report exceeds %d bytes", maxReportSize)
+	}
+
+	vmName, vm, err := s.guestVM(guestName, sourceIP, "reports")
+	if err != nil {
+		return "", err
+	}
+
+	if reportType == ReportAgentRestart {
+		crash := newAgentCrash(data)
+		log.WithFields(log.Fields{
+			"vmName": vmName,
+			"agent":  crash.agent,
+			"reason": crash.reason,
+		}).Warn("agent in guest crashed and was restarted")
+		s.lock.Lock()
+		vm.agentRestarts++
+		vm.lastAgentCrash = crash
+		s.lock.Unlock()
+		s.vmsChanged()
+	}
+	if reportType == ReportSharedDirs {
+		s.lock.Lock()
+		recordSharedDirTransports(vm.sharedDirs, data)
+		s.lock.Unlock()
+		s.vmsChanged()
+	}
+	if reportType == ReportOOMKill {
+		s.recordOOMKill(vmName, vm, newOOMKill(data))
+		// The report's answer mustn't wait for, or be cut off by, a reboot of the guest.
+		go s.applyOOMPolicy(vmName, vm)
+	}
+	if eventType != "" {
+		s.events.Publish(eventType, vmName, data)
+	}
+	return vmName, nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+// readOnlyMountsScript remounts every file system of the hypervisor's mount namespace read-only,
+// except the kernel's own, then makes the paths it's given writable again and execs the rest of
+// its arguments. The paths come first, up to a "--".
+const readOnlyMountsScript = `set -e
+awk '{print $5}' /proc/self/mountinfo | while read -r m; do
+	case "$m" in /proc|/proc/*|/sys|/sys/*|/dev|/dev/*) continue ;; esac
+	mount -o remount,bind,ro "$m" 2>/dev/null || true
+done
+while [ "$1" != "--" ]; do
+	mount --bind "$1" "$1"
+	mount -o remount,bind,rw "$1"
+	shift
+done
+shift
+exec "$@"`
+
+// sandboxCommand returns the helpers that confine the hypervisor as `sandbox` says, each exec'ing
+// the next so that the hypervisor keeps their PID, followed by `command`. `writable` are the paths
+// the hypervisor may write to with read-only mounts.
+func sandboxCommand(sandbox config.HypervisorSandboxConfig, writable []string, command []string) []string {
+	if !sandbox.Sandboxed() {
+		return command
+	}
+	if sandbox.NoNewPrivs || len(sandbox.Capabilities) > 0 {
+		setpriv := []string{"setpriv"}
+		if sandbox.NoNewPrivs {
+			setpriv = append(setpriv, "--no-new-privs")
+		}
+		if len(sandbox.Capabilities) > 0 {
+			caps := []string{"-all"}
+			for _, c := range sandbox.Capabilities {
+				caps = append(caps, "+"+strings.ToLower(strings.TrimPrefix(c, "CAP_")))
+			}
+			// Root gets the bounding set as its capabilities when it execs, nothing's inherited.
+			setpriv = append(setpriv, "--inh-caps=-all", "--bounding-set="+strings.Join(caps, ","))
+		}
+		command = append(setpriv, command...)
+	}
+	if sandbox.ReadOnlyMounts {
+		// Mounts need the capabilities setpriv drops, so they're done before it runs.
+		mounts := []string{"unshare", "--mount", "--propagation", "private", "sh", "-c", readOnlyMountsScript, "sh"}
+		mounts = append(mounts, writable...)
+		mounts = append(mounts, "--")
+		command = append(mounts, command...)
+	}
+	return command
+}
+
+// hypervisorWritablePaths returns what the hypervisor writes to: the VMs' state, including their
+// disks and snapshots, and the volumes they can have attached.
+func hypervisorWritablePaths(cfg config.ServerConfig) []string {
+	writable := []string{cfg.StateDir}
+	for _, p := range cfg.Volumes {
+		writable = append(writable, p)
+	}
+	// Volumes are kept in a map, their order mustn't change the command.
+	slices.Sort(writable[1:])
+	return writable
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
+	"github.com/abilashraghuram/arrakis/pkg/secrets"
+)
+
+// secretRef is a secret of the server config that a VM is started with, and how the guest gets it.
+// Only the name is kept, the value is read when the secret is delivered.
+type secretRef struct {
+	name string
+	// Environment variable of the guest's commands, if any.
+	env string
+	// File in the guest, if any, with its mode.
+	path string
+	mode string
+}
+
+// newSecretRefs validates the secrets of a start. Callers may only use secrets their API key is
+// allowed.
+func (s *Server) newSecretRefs(ctx context.Context, requested []serverapi.SecretRef) ([]secretRef, error) {
+	configured := s.Config().Secrets
+	id := auth.FromContext(ctx)
+	var refs []secretRef
+	for _, r := range requested {
+		secret, ok := configured[r.GetName()]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown secret %q", r.GetName())
+		}
+		if id != nil && !id.Has(auth.PermissionAdmin) && len(secret.Keys) > 0 && !slices.Contains(secret.Keys, id.Name) {
+			return nil, status.Errorf(codes.PermissionDenied, "secret %s isn't allowed for this API key", r.GetName())
+		}
+		if r.GetEnv() == "" && r.GetPath() == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "secret %s needs env, path or both", r.GetName())
+		}
+		if strings.ContainsAny(r.GetEnv(), "=\x00") {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid environment variable name %q for secret %s", r.GetEnv(), r.GetName())
+		}
+		if r.GetPath() != "" && !filepath.IsAbs(r.GetPath()) {
+			return nil, status.Errorf(codes.InvalidArgument, "path of secret %s must be absolute", r.GetName())
+		}
+		if err := (cmdserver.FilePostData{Path: r.GetPath(), Mode: r.GetMode()}).Validate(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		refs = append(refs, secretRef{
+			name: r.GetName(),
+			env:  r.GetEnv(),
+			path: r.GetPath(),
+			mode: r.GetMode(),
+		})
+	}
+	return refs, nil
+}
+
+// deliverSecrets reads the values of `refs` and hands them to the agent of the VM `vmName`, which
+// adds them to the environment of its commands and writes them to files. Values never leave this
+// function other than to the guest.
+func (s *Server) deliverSecrets(ctx context.Context, vmName string, refs []secretRef) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	cfg := s.Config()
+	reqBody := cmdserver.SecretsPostRequest{Env: make(map[string]string)}
+	for _, ref := range refs {
+		value, err := secrets.Fetch(ctx, ref.name, cfg.Secrets[ref.name], cfg.Vault)
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition, "failed to read secret: %v", err)
+		}
+		if ref.env != "" {
+			reqBody.Env[ref.env] = value
+		}
+		if ref.path != "" {
+			reqBody.Files = append(reqBody.Files, cmdserver.FilePostData{
+				Path:    ref.path,
+				Content: value,
+				Mode:    ref.mode,
+			})
+		}
+	}
+
+	if err := s.postAgent(ctx, vmName, "/secrets", reqBody, "secrets"); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.name)
+	}
+	log.WithFields(log.Fields{"vmName": vmName, "secrets": names}).Info("delivered secrets")
+	return nil
+}
@@ -3,15 +3,19 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
@@ -25,13 +29,19 @@ import (
 
 	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
 	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
 	"github.com/abilashraghuram/arrakis/pkg/callback"
 	"github.com/abilashraghuram/arrakis/pkg/cmdserver"
 	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/events"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/guestfs"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
 	"github.com/abilashraghuram/arrakis/pkg/server/cidallocator"
 	"github.com/abilashraghuram/arrakis/pkg/server/fountain"
 	"github.com/abilashraghuram/arrakis/pkg/server/ipallocator"
 	"github.com/abilashraghuram/arrakis/pkg/server/portallocator"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"gvisor.dev/gvisor/pkg/cleanup"
@@ -45,6 +55,12 @@ const (
 	vmStatusRunning
 	vmStatusStopped
 	vmStatusPaused
+	// Being received from another host.
+	vmStatusMigrating
+	// The hypervisor exited or the guest agent stopped answering, see crash.go.
+	vmStatusCrashed
+	// Snapshotted and stopped for being idle, see idle.go. Only listed, no VM has this status.
+	vmStatusHibernated
 )
 
 func (status vmStatus) String() string {
@@ -57,14 +73,21 @@ func (status vmStatus) String() string {
 		return "STOPPED"
 	case vmStatusPaused:
 		return "PAUSED"
+	case vmStatusMigrating:
+		return "MIGRATING"
+	case vmStatusCrashed:
+		return "CRASHED"
+	case vmStatusHibernated:
+		return "HIBERNATED"
 	default:
 		return "UNKNOWN"
 	}
 }
 
 const (
-	// Case sensitive.
-	serialPortMode = "Tty"
+	// Case sensitive. The serial console is written to a file in the VM's state dir, see
+	// consoleLogConfig.
+	serialPortMode = "File"
 	// Case sensitive.
 	consolePortMode = "Off"
 
@@ -81,11 +104,11 @@ const (
 
 	statefulDiskFilename      = "stateful.img"
 	cidFilename               = "cid"
+	vsockSecretBytes          = 32
 	minGuestMemoryMB          = 1024
 	maxGuestMemoryMB          = 32768
 	defaultGuestMemPercentage = 50
 
-	cmdServerReadyTimeout    = 1 * time.Minute
 	cmdServerReadyRetryDelay = 10 * time.Millisecond
 )
 
@@ -118,6 +141,10 @@ type vm struct {
 	tapDevice     *fountain.TapDevice
 	status        vmStatus
 	portForwards  []portForward
+	// Set if the start asked for the MAC, empty if cloud-hypervisor picked it.
+	mac string
+	// One of the network modes.
+	networkMode string
 	// This is actually a unix domain socket path that maps to all vsock server
 	// running inside the VM. A "CONNECT <port>" command sent on this socket
 	// will be forwarded to the vsock server listening on the given port inside
@@ -125,6 +152,101 @@ type vm struct {
 	vsockPath        string
 	cid              uint32
 	statefulDiskPath string
+	// The name passed to the guest on the kernel command line. Differs from `name` once a pool VM
+	// has been claimed.
+	guestName string
+	// Set while the guest filesystem is mounted on the host.
+	hostMount *guestfs.Mount
+	// Name of the API key that created the VM, empty if authentication was disabled. Guarded by
+	// the server lock, like `name`.
+	owner string
+	// Presented to connect to the VM's callback session. Issued on every start and cleared when
+	// the VM changes owner. Guarded by the server lock.
+	sessionToken string
+	// Protected VMs are only stopped or destroyed when forced by an admin. Guarded by the server
+	// lock.
+	protected bool
+	// Select the VM for commands run on groups of VMs. Guarded by the server lock.
+	labels map[string]string
+	// Snapshot the VM on a schedule. Guarded by the server lock.
+	snapshotPolicies []*snapshotPolicy
+	// Times agents in the guest crashed and were restarted, and the last crash, as reported by
+	// the guest's watchdog. Guarded by the server lock.
+	agentRestarts  int32
+	lastAgentCrash *agentCrash
+	// Vsock ports of the services in the guest, keyed by name. Set before the VM is published and
+	// never changed.
+	services map[string]uint32
+	// Unix sockets of the guest exposed on the host. Guarded by the server lock.
+	socketForwards []*socketForward
+	// Set while the VM is sent to another host. Guarded by the server lock.
+	migrating bool
+	// When the VM was created on this host, by a start, restore or migration. Never changed.
+	startedAt time.Time
+	// Credential profiles the guest may get credentials of. Set before the VM is published and
+	// never changed.
+	credentialProfiles []string
+	// The credentials last minted for the guest, keyed by profile, handed out again until they're
+	// about to expire. Guarded by the server lock.
+	credentials map[string]*guestcall.Credentials
+	// Every credential minted for the guest that may not have expired yet, revoked once the VM is
+	// destroyed. Guarded by the server lock.
+	mintedCredentials []*guestcall.Credentials
+	// How the VM is started again once it crashes, nil while the crash monitor leaves it alone,
+	// e.g. before it got ready. Guarded by the server lock, like the rest of the crash state.
+	restart *restartSpec
+	// Checks in a row the guest agent didn't answer.
+	missedHeartbeats int
+	// Times the VM was restarted after crashing, and crashed in a row without running for long.
+	restarts    int32
+	crashStreak int32
+	lastCrash   *vmCrash
+	// What's done when the guest runs out of memory, and the processes the OOM killer killed, in
+	// the guest or the hypervisor itself. Guarded by the server lock.
+	oomPolicy   oomPolicy
+	oomKills    int32
+	lastOOMKill *oomKill
+	// The cgroup of the hypervisor, and its OOM kills before the hypervisor started, to tell
+	// whether it was killed by the OOM killer once it exits. Never changed.
+	hypervisorCgroup   string
+	hypervisorOOMKills int64
+	// The chroot, user and cgroup the hypervisor runs in, nil without the jailer. Never changed.
+	jail *jail
+	// The cgroup, relative to cgroupRoot, the server put the hypervisor in, its jail's or one of its
+	// own, empty if neither. Never changed.
+	cgroup string
+	// Last call into the guest, and calls into it still running, which keep the VM from being
+	// idle. Guarded by the server lock.
+	lastActivity time.Time
+	activeCalls  int
+	// Set while the idle suspender pauses or snapshots the VM, and until it's resumed. Guarded by
+	// the server lock.
+	idleSuspended bool
+	// What happens once the VM's callback session closes, nil for the server's default, and the
+	// timer that destroys the VM if it's kept for a while. Guarded by the server lock.
+	disconnect      *disconnectPolicy
+	disconnectTimer *time.Timer
+	// The hooks the VM was started with, run after the server's. Guarded by the server lock.
+	hooks []hook
+	// Where the VM may connect to, nil for anywhere. Guarded by the server lock.
+	egress *egressPolicy
+	// Caps the VM's traffic, nil if it's unlimited. Guarded by the server lock.
+	networkLimit *networkLimit
+	// Caps the IO of each of its disks without a limit of their own, nil for none. Never changed.
+	diskLimit *diskLimit
+	// Host directories shared into the guest. Set before the VM is published and never changed.
+	sharedDirs []*sharedDir
+	// Serves the shared directories over 9P, nil without any or once the VM was taken over from
+	// another server.
+	ninePListener net.Listener
+	// The base image the stateful disk started from, empty if it started blank or came from a
+	// snapshot. Never changed.
+	baseImage string
+	// Set if the stateful disk is a qcow2 overlay of the base image rather than a clone of it, which
+	// then must stay in place for as long as the VM exists. Never changed.
+	diskOverlay bool
+	// Disks attached besides the rootfs and stateful disk. Guarded by the server lock.
+	dataDisks []*dataDisk
 }
 
 // calculateVCPUCount returns an appropriate number of vCPUs based on host's CPU count.
@@ -195,13 +317,172 @@ func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
 	return int32(suggestedMemoryKB / 1024), nil
 }
 
-func getKernelCmdLine(gatewayIP string, guestIP string, vmName string) string {
-	return fmt.Sprintf(
-		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\" vm_name=\"%s\"",
+func getKernelCmdLine(gatewayIP string, guestIP string, vmName string, vsockSecret string, guestTuning string) string {
+	cmdline := fmt.Sprintf(
+		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\" vm_name=\"%s\" %s=\"%s\"",
 		gatewayIP,
 		guestIP,
 		vmName,
+		guestcall.VsockSecretCmdlineKey,
+		vsockSecret,
 	)
+	if guestTuning != "" {
+		cmdline += " " + guestTuning
+	}
+	return cmdline
+}
+
+// newVsockSecret creates the secret shared with a VM's vsockserver and stores it in `vmStateDir`,
+// readable only by us, for host-side clients.
+func newVsockSecret(vmStateDir string) (string, error) {
+	b := make([]byte, vsockSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+	if err := os.WriteFile(path.Join(vmStateDir, guestcall.VsockSecretFilename), []byte(secret), 0600); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// copyVsockSecret copies the vsock secret in `srcDir`, if any, to `destDir`.
+func copyVsockSecret(srcDir string, destDir string) error {
+	secret, err := os.ReadFile(path.Join(srcDir, guestcall.VsockSecretFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(destDir, guestcall.VsockSecretFilename), secret, 0600)
+}
+
+// getGuestTuningCmdLine returns the kernel command line arguments carrying the template's sysctls,
+// ulimits, kernel modules, container runtime, init, telemetry and credential profiles, which must be
+// among `profiles`, to the guest, or "" if it has none of them.
+func getGuestTuningCmdLine(tmpl config.TemplateConfig, profiles map[string]config.CredentialProfileConfig) (string, error) {
+	var sysctls []guesttuning.Sysctl
+	for _, s := range tmpl.Sysctls {
+		sysctl, err := guesttuning.ParseSysctl(s)
+		if err != nil {
+			return "", err
+		}
+		sysctls = append(sysctls, sysctl)
+	}
+
+	var ulimits []guesttuning.Ulimit
+	for name, value := range tmpl.Ulimits {
+		ulimit, err := guesttuning.ParseUlimit(name, value)
+		if err != nil {
+			return "", err
+		}
+		ulimits = append(ulimits, ulimit)
+	}
+
+	var args []string
+	if len(sysctls) > 0 {
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.SysctlsCmdlineKey, guesttuning.EncodeSysctls(sysctls)))
+	}
+	if len(ulimits) > 0 {
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.UlimitsCmdlineKey, guesttuning.EncodeUlimits(ulimits)))
+	}
+	if len(tmpl.KernelModules) > 0 {
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.ModulesCmdlineKey, guesttuning.EncodeModules(tmpl.KernelModules)))
+	}
+	if rtConfig := tmpl.ContainerRuntime; rtConfig.Engine != "" {
+		rt, err := guesttuning.ParseContainerRuntime(rtConfig.Engine, rtConfig.StorageDriver, rtConfig.CgroupDriver)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.ContainerRuntimeCmdlineKey, guesttuning.EncodeContainerRuntime(rt)))
+	}
+	if tmpl.Init != "" {
+		if err := guesttuning.ValidateInit(tmpl.Init); err != nil {
+			return "", err
+		}
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.InitCmdlineKey, tmpl.Init))
+	}
+	for _, path := range tmpl.Telemetry.LogFiles {
+		if err := guesttuning.ValidateLogFile(path); err != nil {
+			return "", err
+		}
+	}
+	telemetry := guesttuning.EncodeTelemetry(guesttuning.Telemetry{
+		LogFiles: tmpl.Telemetry.LogFiles,
+		Journald: tmpl.Telemetry.Journald,
+		OTLP:     tmpl.Telemetry.OTLP,
+	})
+	if telemetry != "" {
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.TelemetryCmdlineKey, telemetry))
+	}
+	var credentialProfiles []guesttuning.CredentialProfile
+	for _, name := range tmpl.Credentials {
+		if err := guesttuning.ValidateCredentialProfile(name); err != nil {
+			return "", err
+		}
+		profile, ok := profiles[name]
+		if !ok {
+			return "", fmt.Errorf("unknown credential profile %q", name)
+		}
+		credentialProfiles = append(credentialProfiles, guesttuning.CredentialProfile{Name: name, Provider: profile.Provider})
+	}
+	if len(credentialProfiles) > 0 {
+		args = append(args, fmt.Sprintf("%s=\"%s\"", guesttuning.CredentialsCmdlineKey, guesttuning.EncodeCredentialProfiles(credentialProfiles)))
+	}
+	return strings.Join(args, " "), nil
+}
+
+// checkModulesAllowed returns an error unless every module is on the allow-list.
+func checkModulesAllowed(modules []string, allowlist []string) error {
+	for _, module := range modules {
+		if err := guesttuning.ValidateModuleName(module); err != nil {
+			return err
+		}
+		// modprobe treats "-" and "_" the same, so should we.
+		normalized := strings.ReplaceAll(module, "-", "_")
+		allowed := false
+		for _, a := range allowlist {
+			if strings.ReplaceAll(a, "-", "_") == normalized {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("kernel module %s is not in the allow-list", module)
+		}
+	}
+	return nil
+}
+
+// ValidateTemplates checks the templates in `cfg` so that bad settings are caught when the config
+// is loaded rather than on the first VM started from them.
+func ValidateTemplates(cfg config.ServerConfig) error {
+	for name, tmpl := range cfg.Templates {
+		if _, err := getGuestTuningCmdLine(tmpl, cfg.CredentialProfiles); err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		if err := checkModulesAllowed(tmpl.KernelModules, cfg.KernelModuleAllowlist); err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		if err := validateVsockServices(tmpl.VsockServices); err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		if err := validateNetworkLimit(tmpl.NetworkLimit); err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		if err := validateDiskLimit(tmpl.DiskLimit); err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		if _, err := templateGuestMemory(tmpl); err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		telemetry := tmpl.Telemetry
+		if (len(telemetry.LogFiles) > 0 || telemetry.Journald || telemetry.OTLP) && !cfg.GuestTelemetry.Enabled {
+			return fmt.Errorf("invalid template %s: telemetry needs guest_telemetry to be enabled", name)
+		}
+	}
+	return nil
 }
 
 // bridgeExists checks if a bridge with the given name exists.
@@ -390,7 +671,8 @@ func cleanupAllIPTablesRulesForIP(ip string) error {
 	return finalErr
 }
 
-func cleanupTapDevices() error {
+// cleanupTapDevices deletes the tap devices of VMs, except those in `keep`.
+func cleanupTapDevices(keep map[string]bool) error {
 	// List all network interfaces.
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -398,8 +680,7 @@ func cleanupTapDevices() error {
 	}
 
 	for _, iface := range interfaces {
-		// Check if interface name starts with "tap".
-		if strings.HasPrefix(iface.Name, "tap") {
+		if isServerTapDevice(iface.Name) && !keep[iface.Name] {
 			if err := exec.Command("ip", "link", "delete", iface.Name).Run(); err != nil {
 				log.Warnf("failed to delete tap device %s: %v", iface.Name, err)
 			}
@@ -425,12 +706,14 @@ func cleanupBridge() error {
 	return nil
 }
 
-// setupBridgeAndFirewall sets up a bridge and firewall rules for the given bridge name, IP address, and subnet.
+// setupBridgeAndFirewall sets up a bridge and firewall rules for the given bridge name, IP address,
+// and the subnets of the IP pools with the bridge's address on each.
 func setupBridgeAndFirewall(
 	backupFile string,
 	bridgeName string,
 	bridgeIP string,
-	bridgeSubnet string,
+	subnets []*net.IPNet,
+	gateways []*net.IPNet,
 ) error {
 	output, err := exec.Command("iptables-save").Output()
 	if err != nil {
@@ -460,18 +743,30 @@ func setupBridgeAndFirewall(
 	}
 
 	// Setup bridge and firewall rules
-	commands := []struct {
+	type command struct {
 		name string
 		args []string
-	}{
+	}
+	commands := []command{
 		{"ip", []string{"l", "add", bridgeName, "type", "bridge"}},
 		{"ip", []string{"l", "set", bridgeName, "up"}},
 		{"ip", []string{"a", "add", bridgeIP, "dev", bridgeName, "scope", "host"}},
-		{"iptables", []string{"-t", "nat", "-A", "POSTROUTING", "-s", bridgeSubnet, "-o", hostDefaultNetworkInterface, "-j", "MASQUERADE"}},
 		{"sysctl", []string{"-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", hostDefaultNetworkInterface)}},
 		{"sysctl", []string{"-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", bridgeName)}},
-		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-s", bridgeSubnet, "-j", "ACCEPT"}},
-		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-d", bridgeSubnet, "-j", "ACCEPT"}},
+	}
+	bridgeAddr, _, err := net.ParseCIDR(bridgeIP)
+	if err != nil {
+		return fmt.Errorf("invalid bridge IP: %w", err)
+	}
+	for i, subnet := range subnets {
+		if !gateways[i].IP.Equal(bridgeAddr) {
+			commands = append(commands, command{"ip", []string{"a", "add", gateways[i].String(), "dev", bridgeName, "scope", "host"}})
+		}
+		commands = append(commands,
+			command{"iptables", []string{"-t", "nat", "-A", "POSTROUTING", "-s", subnet.String(), "-o", hostDefaultNetworkInterface, "-j", "MASQUERADE"}},
+			command{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-s", subnet.String(), "-j", "ACCEPT"}},
+			command{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-d", subnet.String(), "-j", "ACCEPT"}},
+		)
 	}
 
 	for _, cmd := range commands {
@@ -483,10 +778,6 @@ func setupBridgeAndFirewall(
 	return nil
 }
 
-func getVmStateDirPath(stateDir string, vmName string) string {
-	return path.Join(stateDir, vmName)
-}
-
 // copyFile copies a file from sourcePath to destPath.
 // Both parent directories should exist before calling this function.
 func copyFile(sourcePath, destPath string) error {
@@ -518,10 +809,6 @@ func copyFile(sourcePath, destPath string) error {
 	return nil
 }
 
-func getVmSocketPath(vmStateDir string, vmName string) string {
-	return path.Join(vmStateDir, vmName+".sock")
-}
-
 func unixSocketClient(socketPath string) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
@@ -544,6 +831,36 @@ func createApiClient(apiSocketPath string) *chvapi.APIClient {
 	return chvapi.NewAPIClient(configuration)
 }
 
+// snapshotApiClient returns a cloud-hypervisor client for writing or restoring snapshots, which
+// take as long as the VM's memory takes to copy.
+func snapshotApiClient(apiSocketPath string, timeout time.Duration) *chvapi.APIClient {
+	client := createApiClient(apiSocketPath)
+	client.GetConfig().HTTPClient.Timeout = timeout
+	return client
+}
+
+// Time on top of a command's timeout for the cmdserver to kill it and reply with its output.
+const commandGrace = 5 * time.Second
+
+// timeoutSeconds rounds `timeout` up to whole seconds.
+func timeoutSeconds(timeout time.Duration) int {
+	return int((timeout + time.Second - 1) / time.Second)
+}
+
+// agentClient returns a client for the guest agent's HTTP API whose requests are abandoned after
+// `timeout`, or never if it is zero.
+func (s *Server) agentClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: s.Config().Timeouts.AgentDial}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+			// Each client is only used for one call, idle connections would leak.
+			DisableKeepAlives: true,
+		},
+		Timeout: timeout,
+	}
+}
+
 func waitForServer(ctx context.Context, apiClient *chvapi.APIClient, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -625,6 +942,11 @@ type PayloadConfig struct {
 type VMConfig struct {
 	Net     *[]NetworkConfig `json:"net"`
 	Payload PayloadConfig    `json:"payload"`
+	Vsock   *VsockConfig     `json:"vsock"`
+}
+
+type VsockConfig struct {
+	Socket string `json:"socket"`
 }
 
 func extractGuestIPFromCmdline(cmdline string) (*net.IPNet, error) {
@@ -644,31 +966,39 @@ func extractGuestIPFromCmdline(cmdline string) (*net.IPNet, error) {
 	return ipNet, nil
 }
 
-// Returns the tap device name and the guest IP address from the snapshot config.
-func parseNetworkDataFromSnapshotConfig(configPath string) (string, *net.IPNet, error) {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to read config file: %w", err)
-	}
-
+// Returns the guest IP address from the snapshot's VM config `data`.
+func parseGuestIPFromSnapshotConfig(data []byte) (*net.IPNet, error) {
 	var config VMConfig
 	if err := json.Unmarshal(data, &config); err != nil {
-		return "", nil, fmt.Errorf("failed to unmarshal config: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
 	if config.Net == nil || len(*config.Net) == 0 {
-		return "", nil, fmt.Errorf("no network configuration found")
+		return nil, fmt.Errorf("no network configuration found")
 	}
 
 	if config.Payload.Cmdline == nil {
-		return "", nil, fmt.Errorf("no cmdline found")
+		return nil, fmt.Errorf("no cmdline found")
 	}
 
 	guestIP, err := extractGuestIPFromCmdline(*config.Payload.Cmdline)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to extract guest IP from cmdline: %w", err)
+		return nil, fmt.Errorf("failed to extract guest IP from cmdline: %w", err)
+	}
+	return guestIP, nil
+}
+
+// parseVsockSocketFromSnapshotConfig returns the path of the vsock socket in the snapshot's VM
+// config `data`, or "" if the VM had no vsock device.
+func parseVsockSocketFromSnapshotConfig(data []byte) (string, error) {
+	var config VMConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if config.Vsock == nil {
+		return "", nil
 	}
-	return (*config.Net)[0].Tap, guestIP, nil
+	return config.Vsock.Socket, nil
 }
 
 // getIPPrefix returns the IP prefix from the given CIDR taking into account the mask.
@@ -710,7 +1040,10 @@ func createStatefulDisk(path string, sizeInMB int32) error {
 		return fmt.Errorf("failed to create stateful disk: %w out: %s", err, string(out))
 	}
 
-	cmd = exec.Command("mkfs.ext4", path)
+	// The disk only holds the guest's changes to the shared read-only rootfs. A new sparse file reads
+	// as zeros, so the inode tables and journal needn't be zeroed, which would allocate tens of MB
+	// of every VM's disk before it wrote anything.
+	cmd = exec.Command("mkfs.ext4", "-E", "lazy_itable_init=1,lazy_journal_init=1", path)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to format stateful disk with ext4: %w out: %s", err, string(out))
 	}
@@ -718,23 +1051,100 @@ func createStatefulDisk(path string, sizeInMB int32) error {
 }
 
 func NewServer(config config.ServerConfig, sessionManager *callback.SessionManager) (*Server, error) {
+	if err := ValidateTemplates(config); err != nil {
+		return nil, err
+	}
+	if err := ValidateAuth(config); err != nil {
+		return nil, err
+	}
+	if err := ValidateStateDir(config.StateDir); err != nil {
+		return nil, err
+	}
+
+	// A standby that just took the leader lock takes over the VMs of the previous leader that
+	// still run, along with their tap devices and the bridge.
+	var adoptable []*vmRecord
+	keepTapDevices := make(map[string]bool)
+	keepJails := make(map[string]bool)
+	keepCgroups := make(map[string]bool)
+	if config.HA.Enabled {
+		var err error
+		adoptable, err = loadLiveVMRecords(config.StateDir)
+		if err != nil {
+			log.WithError(err).Error("failed to load VMs of previous leader, not taking them over")
+		}
+		for _, record := range adoptable {
+			keepTapDevices[record.TapDevice] = true
+			if record.Jail != nil {
+				keepJails[record.Jail.Root] = true
+			}
+			if record.Cgroup != "" {
+				keepCgroups[record.Cgroup] = true
+			}
+		}
+	}
+
 	// Cleanup any existing resources.
-	if err := cleanupTapDevices(); err != nil {
+	if err := cleanupTapDevices(keepTapDevices); err != nil {
 		return nil, fmt.Errorf("failed to cleanup tap devices: %w", err)
 	}
+	if err := cleanupEgressRules(keepTapDevices); err != nil {
+		return nil, fmt.Errorf("failed to cleanup egress rules: %w", err)
+	}
+	if err := cleanupNetns(keepTapDevices); err != nil {
+		return nil, fmt.Errorf("failed to cleanup network namespaces: %w", err)
+	}
+	if err := cleanupJails(config.Jailer, keepJails); err != nil {
+		return nil, fmt.Errorf("failed to cleanup jails: %w", err)
+	}
+	if err := cleanupHypervisorCgroups(config.HypervisorCgroups, keepCgroups); err != nil {
+		return nil, fmt.Errorf("failed to cleanup hypervisor cgroups: %w", err)
+	}
 
-	if err := cleanupBridge(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup bridge: %w", err)
+	if len(adoptable) == 0 {
+		if err := cleanupBridge(); err != nil {
+			return nil, fmt.Errorf("failed to cleanup bridge: %w", err)
+		}
 	}
 
-	ipPrefix, err := getIPPrefix(config.BridgeSubnet)
+	bridgeIP, _, err := net.ParseCIDR(config.BridgeIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge IP: %w", err)
+	}
+	modes := config.NetworkModes
+	pools := make(map[string]ipallocator.PoolSpec, len(config.IPAM.Pools))
+	for name, pool := range config.IPAM.Pools {
+		spec := ipallocator.PoolSpec{CIDRs: pool.CIDRs, Reserved: pool.Reserved}
+		if name == modes.Bridged.Pool {
+			spec.Gateway = modes.Bridged.Gateway
+		}
+		pools[name] = spec
+	}
+	ipAllocator, err := ipallocator.NewPoolAllocator(pools, bridgeIP, config.IPAM.StateFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get IP prefix: %w", err)
+		return nil, fmt.Errorf("failed to create ip allocator: %w", err)
 	}
+	// Only the guests of pools that aren't a network mode's are behind NAT.
+	var subnets, gateways []*net.IPNet
+	for _, name := range ipAllocator.Pools() {
+		if name == modes.Bridged.Pool || name == modes.HostOnly.Pool {
+			continue
+		}
+		poolSubnets, poolGateways := ipAllocator.Subnets(name)
+		subnets = append(subnets, poolSubnets...)
+		gateways = append(gateways, poolGateways...)
+	}
+
+	for _, subnet := range subnets {
+		ipPrefix, err := getIPPrefix(subnet.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get IP prefix: %w", err)
+		}
 
-	log.Infof("Cleaning up iptables rules for IP prefix: %s", ipPrefix)
-	if err := cleanupAllIPTablesRulesForIP(ipPrefix); err != nil {
-		return nil, fmt.Errorf("failed to cleanup iptables rules: %w", err)
+		log.Infof("Cleaning up iptables rules for IP prefix: %s", ipPrefix)
+		if err := cleanupAllIPTablesRulesForIP(ipPrefix); err != nil {
+			return nil, fmt.Errorf("failed to cleanup iptables rules: %w", err)
+		}
 	}
 
 	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
@@ -752,14 +1162,14 @@ func NewServer(config config.ServerConfig, sessionManager *callback.SessionManag
 		ipBackupFile,
 		config.BridgeName,
 		config.BridgeIP,
-		config.BridgeSubnet,
+		subnets,
+		gateways,
 	); err != nil {
 		return nil, fmt.Errorf("failed to setup networking on the host: %w", err)
 	}
-
-	ipAllocator, err := ipallocator.NewIPAllocator(config.BridgeSubnet)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create ip allocator: %w", err)
+	_, hostOnlyGateways := ipAllocator.Subnets(modes.HostOnly.Pool)
+	if err := setupNetworkModes(modes, hostOnlyGateways); err != nil {
+		return nil, fmt.Errorf("failed to setup networking on the host: %w", err)
 	}
 
 	portAllocator, err := portallocator.NewPortAllocator(
@@ -775,8 +1185,38 @@ func NewServer(config config.ServerConfig, sessionManager *callback.SessionManag
 		return nil, fmt.Errorf("failed to create CID allocator: %w", err)
 	}
 
+	if err := os.MkdirAll(path.Join(config.StateDir, imageCacheDirName), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+
+	apiKeys, err := auth.NewStore(path.Join(config.StateDir, apiKeysFileName))
+	if err != nil {
+		return nil, err
+	}
+	urlSigner, err := auth.NewURLSigner(path.Join(config.StateDir, urlSigningKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	maintenance, err := newMaintenance(path.Join(config.StateDir, maintenanceFileName))
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := newCapacityHistory(config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := newUsageTracker(config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	warmPool, err := newWarmPool(path.Join(config.StateDir, prewarmDisksDirName), config.StatefulSizeInMB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create warm pool: %w", err)
+	}
+
 	log.Infof("Server config: %+v", config)
-	return &Server{
+	s := &Server{
 		vms:            make(map[string]*vm),
 		fountain:       fountain.NewFountain(config.BridgeName),
 		ipAllocator:    ipAllocator,
@@ -784,7 +1224,68 @@ func NewServer(config config.ServerConfig, sessionManager *callback.SessionManag
 		cidAllocator:   cidAllocator,
 		config:         config,
 		sessionManager: sessionManager,
-	}, nil
+		warmPool:       warmPool,
+		readCache:      newReadCache(),
+		events:         events.NewBus(config.Events.History, config.Events.SubscriberBuffer),
+		apiKeys:        apiKeys,
+		urlSigner:      urlSigner,
+		oidc:           newOIDCVerifier(config.Auth.OIDC),
+		reservedNames:  make(map[string]bool),
+		volumeClaims:   make(map[string]map[string]bool),
+		jailUIDs:       make(map[int]bool),
+		maintenance:    maintenance,
+		operations:     newOperations(),
+		capacity:       capacity,
+		usage:          usage,
+
+		incomingMigrations: make(map[string]*incomingMigration),
+		migratedVMs:        make(map[string]migratedVM),
+		hibernated:         make(map[string]*hibernatedVM),
+	}
+	if t := config.GuestTelemetry; t.Enabled {
+		s.telemetry = tracing.NewForwarder(t.LogsEndpoint, t.MetricsEndpoint, t.Headers)
+	}
+	if s.egressDNS, err = s.startEgressDNSProxy(bridgeIP); err != nil {
+		return nil, err
+	}
+	if config.HA.Enabled {
+		adopted := s.adoptVMs(adoptable)
+		s.registry = &vmRegistry{path: path.Join(config.StateDir, vmRegistryFileName)}
+		s.saveVMRegistry()
+		s.events.Publish(events.ServerBecameLeader, "", map[string]string{
+			"adoptedVMs": strconv.Itoa(adopted),
+		})
+	}
+	// IPs stay allocated as long as the state directory of their VM is there, e.g. for VMs that
+	// were taken over or whose hypervisor still runs, until garbage collection reclaims it.
+	freed, err := ipAllocator.FreeUnowned(func(owner string) bool {
+		_, err := os.Stat(owner)
+		return err == nil
+	})
+	if err != nil {
+		log.WithError(err).Warn("failed to save IP allocations")
+	} else if freed > 0 {
+		log.WithField("ips", freed).Info("freed IPs of VMs that are gone")
+	}
+	s.scheduleMaintenanceTimers()
+	go s.runSnapshotScheduler()
+	go s.runCapacitySampler()
+	go s.runUsageSampler()
+	go s.runConsoleLogRotator()
+	go s.runCrashMonitor()
+	go s.runGarbageCollector()
+	go s.runIdleSuspender()
+	go func() {
+		if err := s.ReconcileWarmPool(context.Background()); err != nil {
+			log.WithError(err).Error("failed to fill warm pool")
+		}
+	}()
+	return s, nil
+}
+
+// Events returns the bus that VM lifecycle and server events are published on.
+func (s *Server) Events() *events.Bus {
+	return s.events
 }
 
 // GetVMNameByCID returns the VM name for the given CID.
@@ -811,14 +1312,32 @@ func (s *Server) getVMAtomic(vmName string) *vm {
 	return vm
 }
 
+// createVM spawns cloud-hypervisor for the VM `vmName`, with its resources named by `artifacts`,
+// and unless `forRestore` is set creates and boots the VM.
 func (s *Server) createVM(
 	ctx context.Context,
 	vmName string,
+	artifacts vmArtifacts,
 	kernelPath string,
 	initramfsPath string,
 	rootfsPath string,
+	template string,
 	forRestore bool,
-) (*vm, error) {
+) (_ *vm, retErr error) {
+	ctx, span := tracing.Start(
+		ctx,
+		"server.createVM",
+		tracing.String("vm.name", vmName),
+		tracing.String("vm.artifact_id", artifacts.id),
+		tracing.Bool("vm.for_restore", forRestore),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+	defer s.vmsChanged()
+	timing := bootTimingFromContext(ctx)
+
 	cleanup := cleanup.Make(func() {
 		log.WithFields(
 			log.Fields{
@@ -833,9 +1352,15 @@ func (s *Server) createVM(
 		// Won't do anything if no error since we call `Release` it at the end.
 		cleanup.Clean()
 	}()
+	// Held until the VM is in `s.vms`, by the caller if it claimed the name first.
+	ctx, releaseName, err := s.claimVMName(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseName()
 
-	vmStateDir := getVmStateDirPath(s.config.StateDir, vmName)
-	err := os.MkdirAll(vmStateDir, 0755)
+	vmStateDir := artifacts.stateDir
+	err = os.MkdirAll(vmStateDir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create vm state dir: %w", err)
 	}
@@ -847,17 +1372,58 @@ func (s *Server) createVM(
 	log.Infof("CREATED: %v", vmStateDir)
 
 	// This will be cleaned up by the clean up function above nuking the directory.
-	apiSocketPath := getVmSocketPath(vmStateDir, vmName)
+	apiSocketPath := path.Join(vmStateDir, apiSocketFilename)
 	apiClient := createApiClient(apiSocketPath)
 
 	// This will be cleaned up by the clean up function above nuking the directory.
-	logFilePath := path.Join(vmStateDir, "log")
+	logFilePath := path.Join(vmStateDir, hypervisorLogFilename)
 	logFile, err := os.Create(logFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log file: %w", err)
 	}
 
-	cmd := exec.Command(s.config.ChvBinPath, "--api-socket", apiSocketPath)
+	netns := s.netnsOf(artifacts.tapDevice)
+	if netns != "" {
+		created, err := fountain.CreateNetns(netns)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			cleanup.Add(func() {
+				if err := fountain.DeleteNetns(netns); err != nil {
+					log.WithError(err).Errorf("failed to delete network namespace: %s", netns)
+				}
+			})
+		}
+	}
+	var vmJail *jail
+	var vmCgroup string
+	if s.config.Jailer.Enabled {
+		vmJail, err = s.newJail(artifacts.id, vmStateDir, kernelPath, initramfsPath, rootfsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up jail: %w", err)
+		}
+		// Runs after the hypervisor is reaped.
+		cleanup.Add(func() {
+			s.removeJail(vmJail)
+		})
+		if forRestore {
+			// Restores get their tap device before their hypervisor.
+			if err := s.shareTapDevice(vmJail, artifacts.tapDevice); err != nil {
+				return nil, err
+			}
+		}
+		vmCgroup = vmJail.cgroup
+	} else if cfg := s.Config().HypervisorCgroups; cfg.Enabled {
+		vmCgroup = path.Join(cfg.Parent, artifacts.id)
+		if err := createCgroup(vmCgroup); err != nil {
+			return nil, err
+		}
+		cleanup.Add(func() {
+			removeCgroup(vmCgroup)
+		})
+	}
+	cmd := s.hypervisorCommand(netns, vmJail, "--api-socket", apiSocketPath)
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 	// Add VMs to a separate process group. Otherwise Ctrl-C goes to the VMs
@@ -866,9 +1432,22 @@ func (s *Server) createVM(
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	if vmCgroup != "" {
+		cgroup, err := os.Open(path.Join(cgroupRoot, vmCgroup))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cgroup: %w", err)
+		}
+		defer cgroup.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
 
+	_, spawnSpan := tracing.Start(ctx, "vm.spawn_hypervisor")
+	spawnStart := time.Now()
 	err = cmd.Start()
 	if err != nil {
+		spawnSpan.RecordError(err)
+		spawnSpan.End()
 		return nil, fmt.Errorf("error spawning vm: %w", err)
 	}
 	cleanup.Add(func() {
@@ -877,9 +1456,12 @@ func (s *Server) createVM(
 	})
 
 	err = waitForServer(ctx, apiClient, 10*time.Second)
+	spawnSpan.RecordError(err)
+	spawnSpan.End()
 	if err != nil {
 		return nil, fmt.Errorf("error waiting for vm: %w", err)
 	}
+	timing.hypervisorSpawn = time.Since(spawnStart)
 	cleanup.Add(func() {
 		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("kill VMM process")
 		if err := cmd.Process.Kill(); err != nil {
@@ -887,6 +1469,8 @@ func (s *Server) createVM(
 		}
 	})
 	log.WithField("vmname", vmName).Infof("VM started Pid:%d", cmd.Process.Pid)
+	hypervisorCgroup := hypervisorCgroup(cmd.Process.Pid)
+	hypervisorOOMKills := cgroupOOMKills(hypervisorCgroup)
 
 	var guestIP *net.IPNet
 	var tapDevice *fountain.TapDevice
@@ -894,11 +1478,19 @@ func (s *Server) createVM(
 	var vsockPath string
 	var cid uint32
 	var statefulDiskPath string
+	var services map[string]uint32
+	var credentialProfiles []string
+	var ninePListener net.Listener
+	var diskOverlay bool
 	// We only need to setup the network and call the chv create VM API if we are not restoring
 	// from a snapshot.
 	if !forRestore {
 		var err error
-		tapDevice, err = s.fountain.CreateTapDevice(nil)
+		_, tapSpan := tracing.Start(ctx, "vm.setup_tap")
+		tapStart := time.Now()
+		tapDevice, err = s.createTapDevice(artifacts)
+		tapSpan.RecordError(err)
+		tapSpan.End()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create tap device: %w", err)
 		}
@@ -907,9 +1499,22 @@ func (s *Server) createVM(
 				log.WithError(err).Errorf("failed to delete tap device: %s", tapDevice)
 			}
 		})
+		if err := s.shareTapDevice(vmJail, tapDevice.Name); err != nil {
+			return nil, err
+		}
 
-		guestIP, err = s.ipAllocator.AllocateIP()
+		_, networkSpan := tracing.Start(ctx, "vm.setup_network")
+		if artifacts.ip != nil {
+			guestIP, err = s.ipAllocator.AllocateSpecificIP(artifacts.ip, artifacts.stateDir)
+			if err != nil {
+				err = status.Errorf(codes.AlreadyExists, "can't assign the requested IP: %v", err)
+			}
+		} else {
+			guestIP, err = s.ipAllocator.AllocateIP(artifacts.ipPool, artifacts.stateDir)
+		}
 		if err != nil {
+			networkSpan.RecordError(err)
+			networkSpan.End()
 			return nil, fmt.Errorf("error allocating guest ip: %w", err)
 		}
 		log.Infof("Allocated IP: %v", guestIP)
@@ -917,12 +1522,20 @@ func (s *Server) createVM(
 			log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM", "ip": guestIP.String()}).Info("freeing IP")
 			s.ipAllocator.FreeIP(guestIP.IP)
 		})
+		if err := s.connectTapDevice(artifacts.networkMode, tapDevice, guestIP); err != nil {
+			networkSpan.RecordError(err)
+			networkSpan.End()
+			return nil, err
+		}
 
-		portForwards, err = s.setupPortForwardsToVM(guestIP.IP.String(), s.config.PortForwards)
+		portForwards, err = s.setupPortForwardsToVM(guestIP.IP.String(), s.portForwardsOf(artifacts.networkMode))
+		networkSpan.RecordError(err)
+		networkSpan.End()
 		if err != nil {
 			cleanupAllIPTablesRulesForIP(guestIP.IP.String())
 			return nil, fmt.Errorf("failed to forward ports to VM: %w", err)
 		}
+		timing.tapSetup = time.Since(tapStart)
 		cleanup.Add(func() {
 			log.WithFields(
 				log.Fields{
@@ -935,7 +1548,13 @@ func (s *Server) createVM(
 			cleanupAllIPTablesRulesForIP(guestIP.IP.String())
 		})
 
-		vsockPath = path.Join(vmStateDir, "vsock.sock")
+		vsockPath = path.Join(vmStateDir, vsockSocketFilename)
+		// Connections to the vsockserver authenticate with this, so that processes in the guest
+		// can't pose as the host or as the vsockserver.
+		vsockSecret, err := newVsockSecret(vmStateDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create vsock secret: %w", err)
+		}
 		cid, err = s.cidAllocator.AllocateCID()
 		if err != nil {
 			return nil, fmt.Errorf("failed to allocate CID: %w", err)
@@ -947,7 +1566,27 @@ func (s *Server) createVM(
 		})
 
 		statefulDiskPath = path.Join(vmStateDir, statefulDiskFilename)
-		err = createStatefulDisk(statefulDiskPath, s.config.StatefulSizeInMB)
+		_, diskSpan := tracing.Start(ctx, "vm.create_stateful_disk")
+		diskStart := time.Now()
+		if artifacts.baseImage != "" {
+			var imagePath string
+			imagePath, err = s.baseImagePath(artifacts.baseImage)
+			if err == nil {
+				imagePath, err = s.rawImage(imagePath)
+			}
+			if err == nil {
+				diskOverlay, err = createDiskFromBaseImage(imagePath, statefulDiskPath)
+			}
+			if err == nil && diskOverlay {
+				// The raw copy of a qcow2 base image isn't bound into the jail with the base images.
+				err = vmJail.share(imagePath, true)
+			}
+		} else {
+			err = s.prepareStatefulDisk(statefulDiskPath)
+		}
+		timing.statefulDisk = time.Since(diskStart)
+		diskSpan.RecordError(err)
+		diskSpan.End()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create stateful disk: %w", err)
 		}
@@ -965,30 +1604,90 @@ func (s *Server) createVM(
 			return nil, fmt.Errorf("failed to calculate guest memory size: %w", err)
 		}
 		log.Infof("Calculated vCPUs: %d, memory size: %d MB", vcpus, memorySizeMB)
+		tmpl, _ := s.templateConfig(template)
+		guestTuning, err := getGuestTuningCmdLine(tmpl, s.Config().CredentialProfiles)
+		if err != nil {
+			return nil, fmt.Errorf("invalid guest tuning for template %s: %w", template, err)
+		}
+		services = vsockServices(tmpl)
+		credentialProfiles = tmpl.Credentials
+		var fsConfigs []chvapi.FsConfig
+		var sharedDirsCmdline string
+		fsConfigs, sharedDirsCmdline, ninePListener, err = s.shareDirs(&cleanup, vmStateDir, vsockPath, artifacts.sharedDirs)
+		if err != nil {
+			return nil, err
+		}
+		if sharedDirsCmdline != "" {
+			guestTuning = strings.TrimSpace(guestTuning + " " + sharedDirsCmdline)
+		}
+		dataDiskConfigs, dataDisksCmdline, err := prepareDataDisks(&cleanup, vmStateDir, artifacts.dataDisks)
+		if err != nil {
+			return nil, err
+		}
+		if dataDisksCmdline != "" {
+			guestTuning = strings.TrimSpace(guestTuning + " " + dataDisksCmdline)
+		}
+		if memoryCmdline := artifacts.guestMemory.cmdline(); memoryCmdline != "" {
+			guestTuning = strings.TrimSpace(guestTuning + " " + memoryCmdline)
+		}
+		gatewayIP, err := s.ipAllocator.Gateway(guestIP.IP)
+		if err != nil {
+			return nil, err
+		}
+		netConfig := chvapi.NetConfig{Tap: String(tapDevice.Name), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)}
+		if artifacts.mac != nil {
+			netConfig.Mac = String(artifacts.mac.String())
+		}
+		memoryConfig := &chvapi.MemoryConfig{Size: int64(memorySizeMB) * 1024 * 1024}
+		if err := artifacts.oomPolicy.hotplugConfig(memoryConfig); err != nil {
+			return nil, err
+		}
+		if memoryConfig.HotplugSize != nil {
+			// Plugged memory is only used once the guest onlines it.
+			guestTuning = strings.TrimSpace(guestTuning + " memhp_default_state=online")
+		}
+		if len(fsConfigs) > 0 {
+			// virtiofsd maps the guest's memory.
+			memoryConfig.Shared = Bool(true)
+		}
 		vmConfig := chvapi.VmConfig{
 			Payload: chvapi.PayloadConfig{
 				Kernel:    String(kernelPath),
-				Cmdline:   String(getKernelCmdLine(s.config.BridgeIP, guestIP.String(), vmName)),
+				Cmdline:   String(getKernelCmdLine(gatewayIP.String(), guestIP.String(), vmName, vsockSecret, guestTuning)),
 				Initramfs: String(initramfsPath),
 			},
-			Disks: []chvapi.DiskConfig{
-				{Path: rootfsPath, Readonly: Bool(true), NumQueues: &numBlockDeviceQueues},
-				{Path: statefulDiskPath, NumQueues: &numBlockDeviceQueues},
-			},
+			Disks: append([]chvapi.DiskConfig{
+				{Path: rootfsPath, Readonly: Bool(true), NumQueues: &numBlockDeviceQueues, RateLimiterConfig: artifacts.diskLimit.rateLimiter()},
+				// Overlays of base images are qcow2, whose backing files must be allowed.
+				{Path: statefulDiskPath, NumQueues: &numBlockDeviceQueues, BackingFiles: Bool(diskOverlay), RateLimiterConfig: artifacts.diskLimit.rateLimiter()},
+			}, dataDiskConfigs...),
 			Cpus:    &chvapi.CpusConfig{BootVcpus: vcpus, MaxVcpus: vcpus},
-			Memory:  &chvapi.MemoryConfig{Size: int64(memorySizeMB) * 1024 * 1024},
-			Serial:  chvapi.NewConsoleConfig(serialPortMode),
+			Memory:  memoryConfig,
+			Serial:  consoleLogConfig(vmStateDir),
 			Console: chvapi.NewConsoleConfig(consolePortMode),
-			Net: []chvapi.NetConfig{
-				{Tap: String(tapDevice.Name), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)},
-			},
-			Vsock: &chvapi.VsockConfig{Cid: int64(cid), Socket: vsockPath},
+			Net:     []chvapi.NetConfig{netConfig},
+			Vsock:   &chvapi.VsockConfig{Cid: int64(cid), Socket: vsockPath},
+			Fs:      fsConfigs,
+		}
+		// The disks, sockets and files created since the jail was set up.
+		if err := vmJail.own(vmStateDir); err != nil {
+			return nil, err
+		}
+		for _, d := range artifacts.dataDisks {
+			if err := vmJail.shareDataDisk(d); err != nil {
+				return nil, err
+			}
 		}
 		log.Info("Calling CreateVM")
-		req := apiClient.DefaultAPI.CreateVM(ctx)
+		createCtx, createSpan := tracing.Start(ctx, "vm.create_hypervisor_vm")
+		req := apiClient.DefaultAPI.CreateVM(createCtx)
 		req = req.VmConfig(vmConfig)
 
+		createStart := time.Now()
 		resp, err := req.Execute()
+		timing.createVM = time.Since(createStart)
+		createSpan.RecordError(err)
+		createSpan.End()
 		if err != nil {
 			log.Errorf("CreateVM API call failed with error: %v", err)
 			if resp != nil {
@@ -1031,6 +1730,33 @@ func (s *Server) createVM(
 		vsockPath:        vsockPath,
 		cid:              cid,
 		statefulDiskPath: statefulDiskPath,
+		guestName:        vmName,
+		owner:            ownerFromContext(ctx),
+		services:         services,
+		startedAt:        time.Now(),
+		networkMode:      artifacts.networkMode,
+		sharedDirs:       artifacts.sharedDirs,
+		ninePListener:    ninePListener,
+		baseImage:        artifacts.baseImage,
+		diskOverlay:      diskOverlay,
+		dataDisks:        artifacts.dataDisks,
+		oomPolicy:        artifacts.oomPolicy,
+		diskLimit:        artifacts.diskLimit,
+
+		hypervisorCgroup:   hypervisorCgroup,
+		hypervisorOOMKills: hypervisorOOMKills,
+		jail:               vmJail,
+		cgroup:             vmCgroup,
+		credentialProfiles: credentialProfiles,
+	}
+	if artifacts.mac != nil {
+		vm.mac = artifacts.mac.String()
+	}
+	// Restores are limited once they're restored, as what they have comes from the snapshot.
+	if !forRestore {
+		if err := s.limitHypervisor(ctx, vm); err != nil {
+			return nil, err
+		}
 	}
 	log.Infof("Successfully created VM: %s", vmName)
 
@@ -1044,11 +1770,19 @@ func (s *Server) createVM(
 
 func (v *vm) boot(
 	ctx context.Context,
-) error {
+) (retErr error) {
+	ctx, span := tracing.Start(ctx, "vm.boot", tracing.String("vm.name", v.name))
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
+	bootStart := time.Now()
 	resp, err := v.apiClient.DefaultAPI.BootVM(ctx).Execute()
+	bootTimingFromContext(ctx).boot = time.Since(bootStart)
 	if err != nil {
 		return fmt.Errorf("failed to boot VM resp.Body: %v: %w", resp.Body, err)
 	}
@@ -1083,12 +1817,21 @@ func (v *vm) resume(
 func (v *vm) restore(
 	ctx context.Context,
 	snapshotPath string,
+	timeout time.Duration,
 ) error {
 	v.lock.Lock()
 	defer v.lock.Unlock()
+	defer func(start time.Time) {
+		bootTimingFromContext(ctx).restore = time.Since(start)
+	}(time.Now())
 
+	// What's copied into the state directory for the restore. The snapshot itself is hard linked
+	// from the snapshot store, which other jails restore from too, and only needs to be readable.
+	if err := v.jail.ownExcept(v.stateDirPath, snapshotPath); err != nil {
+		return err
+	}
 	// The snapshot path is a "file://" URL.
-	req := v.apiClient.DefaultAPI.VmRestorePut(ctx)
+	req := snapshotApiClient(v.apiSocketPath, timeout).DefaultAPI.VmRestorePut(ctx)
 	req = req.RestoreConfig(chvapi.RestoreConfig{
 		SourceUrl: fmt.Sprintf("file://%s", snapshotPath),
 	})
@@ -1115,6 +1858,47 @@ func (v *vm) destroy(
 
 	logger := log.WithField("vmName", v.name)
 
+	// The mount would only return errors once the guest is gone.
+	if err := v.unmountHostFilesystem(); err != nil {
+		logger.Warnf("failed to unmount VM filesystem from host: %v", err)
+	}
+
+	// A crashed hypervisor can't be asked to shut down, it only needs reaping.
+	if exited, reason, _ := hypervisorExit(v.process.Pid); exited {
+		logger.Infof("skipping VM shutdown, %s", reason)
+	} else if err := v.shutdownHypervisor(ctx, logger); err != nil {
+		return err
+	}
+
+	// At this point `v.process` is guaranteed to be non-nil.
+	err := reapProcess(v.process, logger, reapVmTimeout)
+	if err != nil {
+		logger.Warnf("failed to reap VM process: %v", err)
+	}
+	for _, d := range v.sharedDirs {
+		stopVirtiofsd(d)
+	}
+	if v.ninePListener != nil {
+		v.ninePListener.Close()
+	}
+
+	// This should be done at the very end in case we need to communicate with the VM during cleanup.
+	log.Infof("Deleting iptables rules for IP: %s", v.ip.String())
+	err = cleanupAllIPTablesRulesForIP(v.ip.IP.String())
+	if err != nil {
+		logger.Warnf("failed to delete iptables rules: %v", err)
+	}
+
+	// Once deleted remove its directory and remove it from the internal store of VMs.
+	err = os.RemoveAll(v.stateDirPath)
+	if err != nil {
+		log.Warnf("Failed to delete directory %s: %v", v.stateDirPath, err)
+	}
+	return nil
+}
+
+// shutdownHypervisor shuts down the VM and then its hypervisor, which exits.
+func (v *vm) shutdownHypervisor(ctx context.Context, logger *log.Entry) error {
 	// Shutdown for a graceful exit before full deletion. Don't error out if this fails as we still
 	// want to try a deletion after this.
 	shutdownReq := v.apiClient.DefaultAPI.ShutdownVM(ctx)
@@ -1144,27 +1928,8 @@ func (v *vm) destroy(
 	if resp.StatusCode >= 300 {
 		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM. bad status: %v", resp))
 	}
-
-	// At this point `v.process` is guaranteed to be non-nil.
-	err = reapProcess(v.process, logger, reapVmTimeout)
-	if err != nil {
-		logger.Warnf("failed to reap VM process: %v", err)
-	}
-
-	// This should be done at the very end in case we need to communicate with the VM during cleanup.
-	log.Infof("Deleting iptables rules for IP: %s", v.ip.String())
-	err = cleanupAllIPTablesRulesForIP(v.ip.IP.String())
-	if err != nil {
-		logger.Warnf("failed to delete iptables rules: %v", err)
-	}
-
-	// Once deleted remove its directory and remove it from the internal store of VMs.
-	err = os.RemoveAll(v.stateDirPath)
-	if err != nil {
-		log.Warnf("Failed to delete directory %s: %v", v.stateDirPath, err)
-	}
-	return nil
-}
+	return nil
+}
 
 func (v *vm) pause(
 	ctx context.Context,
@@ -1186,51 +1951,276 @@ func (v *vm) pause(
 }
 
 type Server struct {
-	lock           sync.RWMutex
-	vms            map[string]*vm
-	fountain       *fountain.Fountain
-	ipAllocator    *ipallocator.IPAllocator
-	portAllocator  *portallocator.PortAllocator
-	cidAllocator   *cidallocator.CIDAllocator
+	lock          sync.RWMutex
+	vms           map[string]*vm
+	fountain      *fountain.Fountain
+	ipAllocator   *ipallocator.IPAllocator
+	portAllocator *portallocator.PortAllocator
+	cidAllocator  *cidallocator.CIDAllocator
+	// Guards the settings in `config` that can be changed by `ApplyConfig`. The rest are fixed
+	// for the lifetime of the server.
+	configLock     sync.RWMutex
 	config         config.ServerConfig
 	sessionManager *callback.SessionManager
+	warmPool       *warmPool
+	reconcileLock  sync.Mutex
+	drain          drainState
+	readCache      *readCache
+	events         *events.Bus
+	apiKeys        *auth.Store
+	urlSigner      *auth.URLSigner
+	// Replaced when the OIDC config changes, guarded by `configLock`. Nil if OIDC is disabled.
+	oidc *auth.OIDCVerifier
+	// Names of VMs being created, and generated ones handed out for VMs still to be. Guarded by
+	// `lock`.
+	reservedNames map[string]bool
+	// The VMs each volume is attached to, and whether read-only. Guarded by `lock`.
+	volumeClaims map[string]map[string]bool
+	maintenance  *maintenance
+	operations   *operations
+	capacity     *capacityHistory
+	usage        *usageTracker
+	// The users of the jailer's range that jails have. Guarded by `lock`.
+	jailUIDs map[int]bool
+	// VMs being received from other hosts, keyed by migration ID. Guarded by `lock`.
+	incomingMigrations map[string]*incomingMigration
+	// Destinations of the VMs sent to other hosts, for redirecting their clients. Guarded by `lock`.
+	migratedVMs map[string]migratedVM
+	// Exports the logs and metrics guests forward. Nil if guest telemetry is disabled.
+	telemetry *tracing.Forwarder
+	// Keeps the VMs for a standby to take over. Nil unless high availability is enabled.
+	registry *vmRegistry
+	// Held while searching for orphaned resources.
+	gcLock sync.Mutex
+	// VMs snapshotted and stopped for being idle, keyed by name. Guarded by `lock`.
+	hibernated map[string]*hibernatedVM
+	// Held while suspending or resuming idle VMs.
+	idleLock sync.Mutex
+	// Resolves the egress domains of VMs.
+	egressDNS *egressDNSProxy
 }
 
-func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (_ *serverapi.StartVMResponse, retErr error) {
 	vmName := req.GetVmName()
 	if vmName == "" {
 		return nil, fmt.Errorf("vmName is required")
 	}
 	logger := log.WithField("vmName", vmName)
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, err
+	}
+	bootTimeout, err := s.bootTimeout(req.GetBootTimeoutSeconds())
+	if err != nil {
+		return nil, err
+	}
+	if err := validateReadinessProbe(req.Readiness); err != nil {
+		return nil, err
+	}
+	restartPolicy, err := newRestartPolicy(req.RestartPolicy)
+	if err != nil {
+		return nil, err
+	}
+	oomPolicy, err := newOOMPolicy(req.OomPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if oomPolicy.action == oomActionGrowMemory && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots keep the memory of their VM, oomPolicy grow-memory can't be given with snapshotId")
+	}
+	restart := &restartSpec{policy: restartPolicy, req: *req}
+	// Restarts start the VM under the name it got.
+	restart.req.GenerateName = nil
+	disconnect, err := newDisconnectPolicy(req.DisconnectPolicy)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := s.newHooks(ctx, req.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	secretRefs, err := s.newSecretRefs(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateVMEnv(req.GetEnv()); err != nil {
+		return nil, err
+	}
+	staticIP, staticMAC, err := parseStaticNetwork(req.GetIp(), req.GetMac())
+	if err != nil {
+		return nil, err
+	}
+	networkMode, ipPool, err := s.parseNetworkMode(req.GetNetworkMode(), req.GetIpPool(), staticIP)
+	if err != nil {
+		return nil, err
+	}
+	egress, err := newEgressPolicy(req.Egress, networkMode)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := s.newNetworkLimit(req.GetTemplate(), req.NetworkLimit)
+	if err != nil {
+		return nil, err
+	}
+	sharedDirs, err := s.newSharedDirs(req.SharedDirs)
+	if err != nil {
+		return nil, err
+	}
+	if len(sharedDirs) > 0 && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots have no shared directories, sharedDirs can't be given with snapshotId")
+	}
+	dataDisks, err := s.newDataDisks(req.Disks)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataDisks) > 0 && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots have no data disks, disks can't be given with snapshotId")
+	}
+	if req.DiskLimit != nil && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots keep the disk limits of their VM, diskLimit can't be given with snapshotId")
+	}
+	diskLimit, err := s.newDiskLimit(req.GetTemplate(), req.DiskLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dataDisks {
+		if d.limit == nil {
+			d.limit = diskLimit
+		}
+	}
+	if (len(req.Tmpfs) > 0 || req.SwapSizeBytes != nil) && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots keep the tmpfs and swap of their VM, tmpfs and swapSizeBytes can't be given with snapshotId")
+	}
+	memory, err := s.newGuestMemory(req.GetTemplate(), req.Tmpfs, req.SwapSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	baseImage := req.GetBaseImage()
+	if baseImage != "" && req.GetSnapshotId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshots have their own stateful disk, baseImage can't be given with snapshotId")
+	}
+	if baseImage != "" {
+		if _, err := s.baseImagePath(baseImage); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, "server.StartVM", tracing.String("vm.name", vmName))
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+	defer s.vmsChanged()
+	ctx, timing := withBootTiming(ctx)
+
+	done, err := s.beginOp(true)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, releaseName, err := s.claimVMName(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseName()
+
+	// Starting over an existing VM, stopped or not, is up to its owner.
+	if err := s.AuthorizeVM(ctx, vmName); err != nil {
+		return nil, err
+	}
+	// The new VM replaces a hibernated one of the same name.
+	s.dropHibernatedVM(vmName)
+	if err := s.runHooks(ctx, hookPreStart, vmName, hooks); err != nil {
+		return nil, err
+	}
 
 	if snapshotId := req.GetSnapshotId(); snapshotId != "" {
 		logger.WithField("snapshotId", snapshotId).Infof("Restoring VM")
-		vm, err := s.restoreVM(ctx, vmName, snapshotId)
+		vm, err := s.restoreVM(ctx, vmName, snapshotId, req.GetNetworkMode())
 		if err != nil {
 			return nil, fmt.Errorf("failed to restore VM from snapshot: %w", err)
 		}
+		if err := s.applyEgressPolicy(vm, egress); err != nil {
+			s.destroyUnreadyVM(ctx, vmName)
+			return nil, err
+		}
+		if err := s.setNetworkLimit(vm, limit); err != nil {
+			s.destroyUnreadyVM(ctx, vmName)
+			return nil, err
+		}
 
 		// Only mark the VM as ready when we can do things inside the sandbox via the API.
-		logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-		if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
-			logger.WithError(err).Warnf("command server not ready")
+		logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for VM to be ready")
+		if err := s.waitForVMReady(ctx, vm, req.Readiness, bootTimeout); err != nil {
+			logger.WithError(err).Warn("VM not ready, destroying it")
+			s.destroyUnreadyVM(ctx, vmName)
+			return nil, err
 		}
 		logger.Infof("VM ready")
+		if err := s.deliverGuestSetup(ctx, vmName, req.GetEnv(), secretRefs); err != nil {
+			logger.WithError(err).Warn("Failed to set up guest, destroying VM")
+			s.destroyUnreadyVM(ctx, vmName)
+			return nil, err
+		}
+		s.watchForCrashes(vmName, restart)
 
+		if req.GetProtected() {
+			s.protectVM(vmName)
+		}
+		if req.HasLabels() {
+			s.setVMLabels(vmName, req.GetLabels())
+		}
+		if disconnect != nil {
+			s.setDisconnectPolicy(vmName, disconnect)
+		}
+		s.setVMHooks(vmName, hooks)
+		// Failures are logged and published, the VM is up either way.
+		s.runHooks(ctx, hookPostBoot, vmName, hooks)
+		sessionToken, err := s.issueSessionToken(vmName)
+		if err != nil {
+			return nil, err
+		}
 		return &serverapi.StartVMResponse{
 			VmName:        serverapi.PtrString(vmName),
 			Ip:            serverapi.PtrString(vm.ip.String()),
 			Status:        serverapi.PtrString(vm.status.String()),
 			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
 			PortForwards:  convertPortForward(vm.portForwards),
+			SessionToken:  serverapi.PtrString(sessionToken),
+			Timing:        timing.toAPI(),
 		}, nil
 	}
 
 	kernelPath := req.GetKernel()
 	rootfsPath := req.GetRootfs()
 	initramfsPath := req.GetInitramfs()
+	template := strings.ToLower(req.GetTemplate())
 	logger.Infof("Starting VM")
 
+	// A pool VM can only stand in if the caller didn't ask for specific images or addresses.
+	var poolTemplate string
+	if kernelPath == "" && rootfsPath == "" && initramfsPath == "" && staticIP == nil && staticMAC == nil && networkMode == networkModeNAT && ipPool == ipallocator.DefaultPool && len(sharedDirs) == 0 && len(dataDisks) == 0 && len(req.Tmpfs) == 0 && req.SwapSizeBytes == nil && oomPolicy.action != oomActionGrowMemory && baseImage == "" && req.DiskLimit == nil {
+		poolTemplate = template
+	}
+	if baseImage == "" && template != "" {
+		tmpl, _ := s.templateConfig(template)
+		baseImage = tmpl.BaseImage
+	}
+	if template != "" {
+		tmplKernel, tmplInitramfs, tmplRootfs, err := s.templateImages(ctx, template)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve template %s: %w", template, err)
+		}
+		if kernelPath == "" {
+			kernelPath = tmplKernel
+		}
+		if initramfsPath == "" {
+			initramfsPath = tmplInitramfs
+		}
+		if rootfsPath == "" {
+			rootfsPath = tmplRootfs
+		}
+	}
+
 	// If not specified, set kernel and rootfs to defaults.
 	if kernelPath == "" {
 		kernelPath = s.config.KernelPath
@@ -1239,17 +2229,53 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 	if rootfsPath == "" {
 		rootfsPath = s.config.RootfsPath
 	}
+	rootfsPath, err = s.rawImage(rootfsPath)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "can't boot from rootfs: %v", err)
+	}
 
 	if initramfsPath == "" {
 		initramfsPath = s.config.InitramfsPath
 	}
 
 	vm := s.getVMAtomic(vmName)
+	// VMs this start brings up are destroyed if they don't get ready, existing ones are left be.
+	created := vm == nil
+	if vm == nil {
+		// Schedulers place new VMs elsewhere while the host is cordoned.
+		if err := s.checkCordon(); err != nil {
+			return nil, err
+		}
+	}
+	if vm != nil && ((staticIP != nil && !vm.ip.IP.Equal(staticIP)) || (staticMAC != nil && vm.mac != staticMAC.String())) {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s exists with another IP or MAC, destroy it first", vmName)
+	}
+	if vm != nil && staticIP == nil && s.ipAllocator.PoolOf(vm.ip.IP) != ipPool {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s exists with an IP of another pool, destroy it first", vmName)
+	}
+	if vm != nil && vm.networkMode != networkMode {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s exists in network mode %s, destroy it first", vmName, vm.networkMode)
+	}
+	if vm != nil && !sameSharedDirs(vm.sharedDirs, sharedDirs) {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s exists with other shared directories, destroy it first", vmName)
+	}
+	if vm != nil && !s.hasDataDisksOf(vm, dataDisks) {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s exists without the disks asked for, destroy it first", vmName)
+	}
+	if vm != nil && req.GetBaseImage() != "" && vm.baseImage != req.GetBaseImage() {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s exists with a stateful disk from another base image, destroy it first", vmName)
+	}
+	if err := s.checkStaticMAC(vmName, staticMAC); err != nil {
+		return nil, err
+	}
 	if vm != nil {
 		err := vm.boot(ctx)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to boot existing VM: %v", err)
 		}
+	} else if pooled := s.claimPooledVM(poolTemplate, vmName, ownerFromContext(ctx)); pooled != nil {
+		vm = pooled
+		timing.pooled = true
 	} else {
 		cleanup := cleanup.Make(func() {
 			logger.Info("start VM clean up done")
@@ -1259,8 +2285,27 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 			cleanup.Clean()
 		}()
 
-		var err error
-		vm, err = s.createVM(ctx, vmName, kernelPath, initramfsPath, rootfsPath, false)
+		artifacts := newVMArtifacts(s.config.StateDir, vmName)
+		artifacts.ip, artifacts.mac = staticIP, staticMAC
+		artifacts.setNetworkMode(networkMode, ipPool)
+		artifacts.sharedDirs = sharedDirs
+		artifacts.dataDisks = dataDisks
+		artifacts.guestMemory = memory
+		artifacts.oomPolicy = oomPolicy
+		artifacts.baseImage = baseImage
+		artifacts.diskLimit = diskLimit
+		s.lock.Lock()
+		err := s.claimVolumesLocked(vmName, dataDisks)
+		s.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		cleanup.Add(func() {
+			s.lock.Lock()
+			s.releaseVolumesLocked(vmName, dataDisks)
+			s.lock.Unlock()
+		})
+		vm, err = s.createVM(ctx, vmName, artifacts, kernelPath, initramfsPath, rootfsPath, template, false)
 		if err != nil {
 			logger.Errorf("failed to create VM: %v", err)
 			return nil, err
@@ -1285,21 +2330,66 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 		}
 		cleanup.Release()
 	}
+	// Before the guest runs anything it was started for, which a start over an existing VM replaces
+	// the policy and limits of.
+	if err := s.applyEgressPolicy(vm, egress); err != nil {
+		if created {
+			s.destroyUnreadyVM(ctx, vmName)
+		}
+		return nil, err
+	}
+	if err := s.setNetworkLimit(vm, limit); err != nil {
+		if created {
+			s.destroyUnreadyVM(ctx, vmName)
+		}
+		return nil, err
+	}
 
 	// Only mark the VM as ready when we can do things inside the sandbox via the API.
-	logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-	err := waitForCmdServerReady(ctx, vm.ip.IP.String())
-	if err != nil {
-		logger.WithError(err).Warnf("command server not ready")
+	logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for VM to be ready")
+	if err := s.waitForVMReady(ctx, vm, req.Readiness, bootTimeout); err != nil {
+		if created {
+			logger.WithError(err).Warn("VM not ready, destroying it")
+			s.destroyUnreadyVM(ctx, vmName)
+		}
+		return nil, err
 	}
 	logger.Infof("VM ready")
+	if err := s.deliverGuestSetup(ctx, vmName, req.GetEnv(), secretRefs); err != nil {
+		if created {
+			logger.WithError(err).Warn("Failed to set up guest, destroying VM")
+			s.destroyUnreadyVM(ctx, vmName)
+		}
+		return nil, err
+	}
+	s.watchForCrashes(vmName, restart)
+	s.events.Publish(events.VMStarted, vmName, map[string]string{"ip": vm.ip.String()})
 
+	if tmpl, _ := s.templateConfig(template); req.GetProtected() || tmpl.Protected {
+		s.protectVM(vmName)
+	}
+	if req.HasLabels() {
+		s.setVMLabels(vmName, req.GetLabels())
+	}
+	if disconnect != nil {
+		s.setDisconnectPolicy(vmName, disconnect)
+	}
+	s.setOOMPolicy(vmName, oomPolicy)
+	s.setVMHooks(vmName, hooks)
+	// Failures are logged and published, the VM is up either way.
+	s.runHooks(ctx, hookPostBoot, vmName, hooks)
+	sessionToken, err := s.issueSessionToken(vmName)
+	if err != nil {
+		return nil, err
+	}
 	return &serverapi.StartVMResponse{
 		VmName:        serverapi.PtrString(vmName),
 		Ip:            serverapi.PtrString(vm.ip.String()),
 		Status:        serverapi.PtrString(vm.status.String()),
 		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
 		PortForwards:  convertPortForward(vm.portForwards),
+		SessionToken:  serverapi.PtrString(sessionToken),
+		Timing:        timing.toAPI(),
 	}, nil
 }
 
@@ -1307,11 +2397,15 @@ func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*servera
 	vmName := req.GetVmName()
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to stop VM")
+	defer s.vmsChanged()
 
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
 	}
+	if err := s.checkProtection(ctx, vmName, req.GetForce()); err != nil {
+		return nil, err
+	}
 
 	shutdown_req := vm.apiClient.DefaultAPI.ShutdownVM(ctx)
 	resp, err := shutdown_req.Execute()
@@ -1325,23 +2419,48 @@ func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*servera
 
 	vm.status = vmStatusStopped
 	logger.Infof("VM stopped")
+	s.events.Publish(events.VMStopped, vmName, nil)
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
 }
 
-func (s *Server) destroyVM(ctx context.Context, vmName string) error {
+func (s *Server) destroyVM(ctx context.Context, vmName string) (retErr error) {
+	ctx, span := tracing.Start(ctx, "server.destroyVM", tracing.String("vm.name", vmName))
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+	defer s.vmsChanged()
+
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to destroy VM")
-	vm := s.getVMAtomic(vmName)
+	s.lock.Lock()
+	vm := s.vms[vmName]
+	if vm != nil {
+		// Its hypervisor exiting isn't a crash.
+		unwatchForCrashesLocked(vm)
+	}
+	s.lock.Unlock()
 	if vm == nil {
 		return fmt.Errorf("vm %s not found", vmName)
 	}
 
+	s.closeSocketForwards(vm)
 	err := vm.destroy(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to destroy vm: %s: %w", vmName, err)
 	}
+	s.revokeCredentials(vmName, vm)
+	if vm.jail != nil {
+		s.removeJail(vm.jail)
+	} else {
+		removeCgroup(vm.cgroup)
+	}
+
+	if err := s.applyEgressPolicy(vm, nil); err != nil {
+		logger.WithError(err).Warn("failed to delete egress rules")
+	}
 
 	err = s.fountain.DestroyTapDevice(vm.tapDevice)
 	if err != nil {
@@ -1360,12 +2479,25 @@ func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 
 	s.lock.Lock()
 	delete(s.vms, vmName)
+	s.releaseVolumesLocked(vmName, vm.dataDisks)
 	s.lock.Unlock()
+	s.warmPool.removeVM(vmName)
+	s.events.Publish(events.VMDestroyed, vmName, nil)
 	return nil
 }
 
 func (s *Server) DestroyVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
 	vmName := req.GetVmName()
+	if s.getVMAtomic(vmName) == nil && s.dropHibernatedVM(vmName) {
+		return &serverapi.VMResponse{
+			Success: serverapi.PtrBool(true),
+		}, nil
+	}
+	if err := s.checkProtection(ctx, vmName, req.GetForce()); err != nil {
+		return nil, err
+	}
+	// Failures are logged and published, they don't keep the VM around.
+	s.runHooks(ctx, hookPreDestroy, vmName, s.vmHooks(vmName))
 	err := s.destroyVM(ctx, vmName)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to destroy vm: %s: %v", vmName, err)
@@ -1387,11 +2519,19 @@ func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsRes
 	for name := range s.vms {
 		vmNames = append(vmNames, name)
 	}
+	hibernated := make([]string, 0, len(s.hibernated))
+	for name := range s.hibernated {
+		hibernated = append(hibernated, name)
+	}
 	s.lock.RUnlock()
 
+	for _, vmName := range hibernated {
+		s.dropHibernatedVM(vmName)
+	}
 	var finalErr error
 	for _, vmName := range vmNames {
 		// Each invocation grabs the same lock on `s`. No point spawning a goroutine for each VM.
+		s.runHooks(ctx, hookPreDestroy, vmName, s.vmHooks(vmName))
 		err := s.destroyVM(ctx, vmName)
 		if err != nil {
 			log.Warnf("failed to destroy and clean up vm: %s", vmName)
@@ -1409,6 +2549,16 @@ func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsRes
 }
 
 func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse, error) {
+	resp, err := s.readCache.get("vms", s.Config().ReadCacheTTL, func() (any, error) {
+		return s.listAllVMs(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*serverapi.ListAllVMsResponse), nil
+}
+
+func (s *Server) listAllVMs() *serverapi.ListAllVMsResponse {
 	resp := &serverapi.ListAllVMsResponse{}
 	var vms []serverapi.ListAllVMsResponseVmsInner
 
@@ -1422,20 +2572,100 @@ func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse,
 		}
 
 		vmInfo := serverapi.ListAllVMsResponseVmsInner{
-			VmName:        serverapi.PtrString(vm.name),
-			Ip:            serverapi.PtrString(ipString),
-			Status:        serverapi.PtrString(vm.status.String()),
-			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-			PortForwards:  convertPortForward(vm.portForwards),
+			VmName:         serverapi.PtrString(vm.name),
+			Ip:             serverapi.PtrString(ipString),
+			Status:         serverapi.PtrString(vm.status.String()),
+			TapDeviceName:  serverapi.PtrString(vm.tapDevice.Name),
+			PortForwards:   convertPortForward(vm.portForwards),
+			Owner:          serverapi.PtrString(vm.owner),
+			Protected:      serverapi.PtrBool(vm.protected),
+			Labels:         labelsPtr(vm.labels),
+			AgentRestarts:  serverapi.PtrInt32(vm.agentRestarts),
+			LastAgentCrash: convertAgentCrash(vm.lastAgentCrash),
+			Restarts:       serverapi.PtrInt32(vm.restarts),
+			LastCrash:      convertVMCrash(vm.lastCrash),
+			OomKills:       serverapi.PtrInt32(vm.oomKills),
+			LastOomKill:    convertOOMKill(vm.lastOOMKill),
+			Services:       convertVsockServices(vm.services),
+			StartedAt:      serverapi.PtrTime(vm.startedAt),
+			LastActivityAt: activityTime(vm.lastActivity, vm.startedAt),
+			IdleSuspended:  serverapi.PtrBool(vm.idleSuspended),
 		}
 		vms = append(vms, vmInfo)
 	}
+	for name := range s.hibernated {
+		h := s.listHibernatedVMLocked(name)
+		vms = append(vms, serverapi.ListAllVMsResponseVmsInner{
+			VmName:         h.VmName,
+			Ip:             h.Ip,
+			Status:         h.Status,
+			Owner:          h.Owner,
+			Protected:      h.Protected,
+			Labels:         h.Labels,
+			Restarts:       h.Restarts,
+			StartedAt:      h.StartedAt,
+			LastActivityAt: h.LastActivityAt,
+			IdleSuspended:  h.IdleSuspended,
+		})
+	}
 	resp.Vms = vms
-	return resp, nil
+	return resp
 }
 
 func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMResponse, error) {
-	vm := s.getVMAtomic(vmName)
+	resp, err := s.readCache.get("vms/"+vmName, s.Config().ReadCacheTTL, func() (any, error) {
+		return s.listVM(vmName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*serverapi.ListVMResponse), nil
+}
+
+func (s *Server) listVM(vmName string) (*serverapi.ListVMResponse, error) {
+	s.lock.RLock()
+	vm := s.vms[vmName]
+	var owner string
+	var protected bool
+	var labels *map[string]string
+	var agentRestarts int32
+	var lastAgentCrash *agentCrash
+	var restarts int32
+	var lastCrash *vmCrash
+	var oomKills int32
+	var lastOOMKill *oomKill
+	var lastActivity time.Time
+	var idleSuspended bool
+	var disconnect disconnectPolicy
+	var egress *egressPolicy
+	var limit *networkLimit
+	var diskLimit *diskLimit
+	var sharedDirs []serverapi.SharedDir
+	var disks []serverapi.Disk
+	hibernated := s.listHibernatedVMLocked(vmName)
+	if vm != nil {
+		owner = vm.owner
+		protected = vm.protected
+		labels = labelsPtr(vm.labels)
+		agentRestarts = vm.agentRestarts
+		lastAgentCrash = vm.lastAgentCrash
+		restarts = vm.restarts
+		lastCrash = vm.lastCrash
+		oomKills = vm.oomKills
+		lastOOMKill = vm.lastOOMKill
+		lastActivity = vm.lastActivity
+		idleSuspended = vm.idleSuspended
+		disconnect = s.disconnectPolicyLocked(vm)
+		egress = vm.egress
+		limit = vm.networkLimit
+		diskLimit = vm.diskLimit
+		sharedDirs = convertSharedDirs(vm.sharedDirs)
+		disks = convertDisks(vm)
+	}
+	s.lock.RUnlock()
+	if vm == nil && hibernated != nil {
+		return hibernated, nil
+	}
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
@@ -1445,29 +2675,81 @@ func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMRe
 		ipString = vm.ip.String()
 	}
 
-	return &serverapi.ListVMResponse{
-		VmName:        serverapi.PtrString(vm.name),
-		Ip:            serverapi.PtrString(ipString),
-		Status:        serverapi.PtrString(vm.status.String()),
-		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-		PortForwards:  convertPortForward(vm.portForwards),
-	}, nil
+	resp := &serverapi.ListVMResponse{
+		VmName:           serverapi.PtrString(vm.name),
+		Ip:               serverapi.PtrString(ipString),
+		Mac:              serverapi.PtrString(vm.mac),
+		NetworkMode:      serverapi.PtrString(vm.networkMode),
+		Status:           serverapi.PtrString(vm.status.String()),
+		TapDeviceName:    serverapi.PtrString(vm.tapDevice.Name),
+		PortForwards:     convertPortForward(vm.portForwards),
+		Owner:            serverapi.PtrString(owner),
+		Protected:        serverapi.PtrBool(protected),
+		Labels:           labels,
+		AgentRestarts:    serverapi.PtrInt32(agentRestarts),
+		LastAgentCrash:   convertAgentCrash(lastAgentCrash),
+		Restarts:         serverapi.PtrInt32(restarts),
+		LastCrash:        convertVMCrash(lastCrash),
+		OomKills:         serverapi.PtrInt32(oomKills),
+		LastOomKill:      convertOOMKill(lastOOMKill),
+		Services:         convertVsockServices(vm.services),
+		StartedAt:        serverapi.PtrTime(vm.startedAt),
+		LastActivityAt:   activityTime(lastActivity, vm.startedAt),
+		IdleSuspended:    serverapi.PtrBool(idleSuspended),
+		DisconnectPolicy: convertDisconnectPolicy(disconnect),
+		Egress:           convertEgressPolicy(egress),
+		NetworkLimit:     convertNetworkLimit(limit),
+		DiskLimit:        convertDiskLimit(diskLimit),
+		SharedDirs:       sharedDirs,
+		Disks:            disks,
+		DiskUsageBytes:   serverapi.PtrInt64(allocatedBytes(vm.statefulDiskPath)),
+	}
+	if vm.baseImage != "" {
+		resp.BaseImage = serverapi.PtrString(vm.baseImage)
+	}
+	return resp, nil
 }
 
-func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId string) (*serverapi.VMSnapshotResponse, error) {
+func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId string) (_ *serverapi.VMSnapshotResponse, retErr error) {
+	ctx, span := tracing.Start(
+		ctx,
+		"server.SnapshotVM",
+		tracing.String("vm.name", vmName),
+		tracing.String("snapshot.id", snapshotId),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+	defer s.vmsChanged()
+
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to snapshot VM with ID: %s", snapshotId)
 
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
+	// cloud-hypervisor can't snapshot the state of virtiofs devices.
+	if len(vm.sharedDirs) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s has shared directories and can't be snapshotted", vmName)
+	}
+	// Snapshots only carry the stateful disk.
+	if s.hasDataDisks(vm) {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s has data disks and can't be snapshotted", vmName)
+	}
 
 	snapshotsDir := path.Join(s.config.StateDir, "snapshots")
 	outputDir := path.Join(snapshotsDir, snapshotId)
 	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
 		logger.WithField("snapshotId", snapshotId).Error("snapshot directory already exists")
-		return nil, fmt.Errorf("snapshot with ID %s already exists", snapshotId)
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot with ID %s already exists", snapshotId)
 	}
 
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -1513,12 +2795,13 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 	}()
 
 	// Copy the stateful disk to the snapshot directory; since VMM snapshot doesn't save this.
+	// Overlays of base images are flattened, so that snapshots don't depend on them.
 	statefulDiskDest := path.Join(outputDir, statefulDiskFilename)
 	logger.WithFields(log.Fields{
 		"source":      vm.statefulDiskPath,
 		"destination": statefulDiskDest,
 	}).Info("copying stateful disk to snapshot directory")
-	err = copyFile(vm.statefulDiskPath, statefulDiskDest)
+	err = copyStatefulDisk(vm.statefulDiskPath, statefulDiskDest)
 	if err != nil {
 		logger.WithError(err).Error("failed to copy stateful disk")
 		return nil, fmt.Errorf("failed to copy stateful disk to snapshot directory: %w", err)
@@ -1537,6 +2820,25 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		return nil, fmt.Errorf("failed to write CID to file: %w", err)
 	}
 
+	// The guest keeps the vsock secret across restores, so the snapshot has to too. VMs started
+	// before secrets were introduced have none.
+	if err := copyVsockSecret(vm.stateDirPath, outputDir); err != nil {
+		logger.WithError(err).Error("failed to copy vsock secret")
+		return nil, fmt.Errorf("failed to copy vsock secret to snapshot directory: %w", err)
+	}
+	if err := writeVsockServices(outputDir, vm.services); err != nil {
+		logger.WithError(err).Error("failed to write vsock services")
+		return nil, fmt.Errorf("failed to write vsock services to snapshot directory: %w", err)
+	}
+	if err := writeCredentialProfiles(outputDir, vm.credentialProfiles); err != nil {
+		logger.WithError(err).Error("failed to write credential profiles")
+		return nil, fmt.Errorf("failed to write credential profiles to snapshot directory: %w", err)
+	}
+	if err := writeNetworkMode(outputDir, vm.networkMode); err != nil {
+		logger.WithError(err).Error("failed to write network mode")
+		return nil, fmt.Errorf("failed to write network mode to snapshot directory: %w", err)
+	}
+
 	// The API expects a "file://" URL.
 	outputUrl := fmt.Sprintf("file://%s", outputDir)
 	snapshotConfig := chvapi.VmSnapshotConfig{
@@ -1544,7 +2846,11 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 	}
 	logger.WithField("destination", outputDir).Info("initiating VM snapshot")
 
-	snapshotReq := vm.apiClient.DefaultAPI.VmSnapshotPut(ctx)
+	if err := vm.jail.share(outputDir, false); err != nil {
+		return nil, err
+	}
+	defer vm.jail.unbind(outputDir)
+	snapshotReq := snapshotApiClient(vm.apiSocketPath, s.Config().Timeouts.Snapshot).DefaultAPI.VmSnapshotPut(ctx)
 	snapshotReq = snapshotReq.VmSnapshotConfig(snapshotConfig)
 	resp, err = snapshotReq.Execute()
 	if err != nil {
@@ -1564,6 +2870,7 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		"destination": outputDir,
 		"statusCode":  resp.StatusCode,
 	}).Info("VM snapshot created successfully")
+	s.events.Publish(events.VMSnapshotted, vmName, map[string]string{"snapshotId": snapshotId})
 	return &serverapi.VMSnapshotResponse{
 		SnapshotId: serverapi.PtrString(snapshotId),
 	}, nil
@@ -1573,7 +2880,19 @@ func (s *Server) restoreVM(
 	ctx context.Context,
 	vmName string,
 	snapshotId string,
-) (*vm, error) {
+	networkMode string,
+) (_ *vm, retErr error) {
+	ctx, span := tracing.Start(
+		ctx,
+		"server.restoreVM",
+		tracing.String("vm.name", vmName),
+		tracing.String("snapshot.id", snapshotId),
+	)
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+
 	// Construct the snapshot path from the snapshot ID
 	snapshotPath := path.Join(s.config.StateDir, "snapshots", snapshotId)
 
@@ -1594,33 +2913,45 @@ func (s *Server) restoreVM(
 		cleanup.Clean()
 	}()
 
-	oldtapdeviceName, guestIP, err := parseNetworkDataFromSnapshotConfig(snapshotPath + "/config.json")
+	configData, err := os.ReadFile(path.Join(snapshotPath, "config.json"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get tap device from config: %w", err)
+		return nil, fmt.Errorf("failed to read snapshot config: %w", err)
 	}
-	oldTapDeviceID, err := parseTapDeviceId(oldtapdeviceName)
+	guestIP, err := parseGuestIPFromSnapshotConfig(configData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse tap device ID: %w", err)
+		return nil, fmt.Errorf("failed to get guest IP from config: %w", err)
+	}
+	logger.WithField("guestIP", guestIP.IP.String()).Info("parse network data from snapshot config")
+
+	// The guest keeps its IP, and with it the network mode it has.
+	snapshotMode, err := readNetworkMode(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network mode from snapshot: %w", err)
+	}
+	if networkMode != "" && networkMode != snapshotMode {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is of a VM in network mode %s", snapshotId, snapshotMode)
 	}
-	logger.WithFields(log.Fields{
-		"oldTapDevice": oldtapdeviceName,
-		"guestIP":      guestIP.IP.String(),
-	}).Info("parse network data from snapshot config")
 
-	err = s.ipAllocator.ClaimIP(guestIP.IP)
+	artifacts := newVMArtifacts(s.config.StateDir, vmName)
+	artifacts.setNetworkMode(snapshotMode, s.ipAllocator.PoolOf(guestIP.IP))
+	err = s.ipAllocator.ClaimIP(guestIP.IP, artifacts.stateDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to claim IP: %w", err)
 	}
 
-	oldTapDevice, err := s.fountain.CreateTapDevice(&oldTapDeviceID)
+	// The snapshotted VM's tap device may be gone or in use by now, the guest only sees its MAC.
+	tapDevice, err := s.createTapDevice(artifacts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tap device: %w", err)
 	}
 	cleanup.Add(func() {
-		logger.Errorf("TODO: destroy tap device: %s", oldTapDevice.Name)
+		logger.Errorf("TODO: destroy tap device: %s", tapDevice.Name)
 	})
+	if err := s.connectTapDevice(artifacts.networkMode, tapDevice, guestIP); err != nil {
+		return nil, fmt.Errorf("failed to connect tap device: %w", err)
+	}
 
-	vm, err := s.createVM(ctx, vmName, "", "", "", true)
+	vm, err := s.createVM(ctx, vmName, artifacts, "", "", "", "", true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create VM for restore: %w", err)
 	}
@@ -1629,7 +2960,7 @@ func (s *Server) restoreVM(
 		err := s.destroyVM(ctx, vmName)
 		logger.WithError(err).Errorf("failed to destroy VM during restore cleanup")
 	})
-	vm.tapDevice = oldTapDevice
+	vm.tapDevice = tapDevice
 	vm.ip = guestIP
 
 	// Copy the stateful disk from the snapshot to the VM state directory.
@@ -1639,14 +2970,46 @@ func (s *Server) restoreVM(
 		"source":      sourcePath,
 		"destination": destPath,
 	}).Info("copying stateful disk from snapshot")
-	err = copyFile(sourcePath, destPath)
+	diskStart := time.Now()
+	err = copyStatefulDisk(sourcePath, destPath)
+	bootTimingFromContext(ctx).statefulDisk = time.Since(diskStart)
 	if err != nil {
 		logger.WithError(err).Error("failed to copy stateful disk from snapshot")
 		return nil, fmt.Errorf("failed to copy stateful disk from snapshot: %w", err)
 	}
 	logger.Info("successfully copied stateful disk from snapshot")
 
-	portForwards, err := s.setupPortForwardsToVM(guestIP.IP.String(), s.config.PortForwards)
+	if err := copyVsockSecret(snapshotPath, vm.stateDirPath); err != nil {
+		return nil, fmt.Errorf("failed to copy vsock secret from snapshot: %w", err)
+	}
+	vm.services, err = readVsockServices(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vsock services from snapshot: %w", err)
+	}
+	vm.credentialProfiles, err = readCredentialProfiles(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential profiles from snapshot: %w", err)
+	}
+	oldVsockPath, err := parseVsockSocketFromSnapshotConfig(configData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vsock socket from config: %w", err)
+	}
+	if oldVsockPath != "" {
+		vm.vsockPath = path.Join(vm.stateDirPath, vsockSocketFilename)
+	}
+	vm.diskLimit = snapshotDiskLimit(configData)
+	restoreConfig, err := rewriteRestoreConfig(configData, vm.stateDirPath, vm.vsockPath, tapDevice.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite snapshot config: %w", err)
+	}
+	sourceDir := path.Join(vm.stateDirPath, forkSourceDirname)
+	if err := linkForkSource(snapshotPath, sourceDir, restoreConfig); err != nil {
+		return nil, fmt.Errorf("failed to prepare snapshot: %w", err)
+	}
+	// The hypervisor is done with the snapshot once restored.
+	defer os.RemoveAll(sourceDir)
+
+	portForwards, err := s.setupPortForwardsToVM(guestIP.IP.String(), s.portForwardsOf(vm.networkMode))
 	if err != nil {
 		cleanupAllIPTablesRulesForIP(guestIP.IP.String())
 		return nil, fmt.Errorf("failed to forward ports to VM: %w", err)
@@ -1679,11 +3042,14 @@ func (s *Server) restoreVM(
 		}
 	})
 
-	err = vm.restore(ctx, snapshotPath)
+	err = vm.restore(ctx, sourceDir, s.Config().Timeouts.Snapshot)
 	if err != nil {
 		return nil, fmt.Errorf("failed to restore VM: %w", err)
 	}
 	logger.Info("restored VM")
+	if err := s.limitHypervisor(ctx, vm); err != nil {
+		return nil, err
+	}
 
 	err = vm.resume(ctx)
 	if err != nil {
@@ -1698,6 +3064,7 @@ func (s *Server) PauseVM(ctx context.Context, req *serverapi.VMRequest) (*server
 	vmName := req.GetVmName()
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to pause VM")
+	defer s.vmsChanged()
 
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
@@ -1708,6 +3075,7 @@ func (s *Server) PauseVM(ctx context.Context, req *serverapi.VMRequest) (*server
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to pause VM: %v", err))
 	}
+	s.events.Publish(events.VMPaused, vmName, nil)
 
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
@@ -1718,6 +3086,7 @@ func (s *Server) ResumeVM(ctx context.Context, req *serverapi.VMRequest) (*serve
 	vmName := req.GetVmName()
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to resume VM")
+	defer s.vmsChanged()
 
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
@@ -1730,36 +3099,64 @@ func (s *Server) ResumeVM(ctx context.Context, req *serverapi.VMRequest) (*serve
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to resume VM: %v", err))
 	}
+	s.events.Publish(events.VMResumed, vmName, nil)
 
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
 }
 
-func (s *Server) VMCommand(ctx context.Context, vmName string, cmd string, blocking bool) (*serverapi.VmCommandResponse, error) {
+// VMCommand runs `req.Cmd` in the VM `vmName`. A blocking command is waited for up to `timeout`,
+// or the configured default if it is zero.
+func (s *Server) VMCommand(ctx context.Context, vmName string, req cmdserver.RunCmdRequest, timeout time.Duration) (*serverapi.VmCommandResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	timeouts := s.Config().Timeouts
+	if timeout < 0 || timeout > timeouts.ExecMax {
+		return nil, status.Errorf(codes.InvalidArgument, "timeout must be between 0 and %s", timeouts.ExecMax)
+	}
+	explicit := timeout > 0
+	if timeout == 0 {
+		timeout = timeouts.ExecDefault
+	}
+	// The guest kills a blocking command once it's out of time, a background one only if it was
+	// given a timeout of its own.
+	if req.Blocking || explicit {
+		req.TimeoutSeconds = timeoutSeconds(timeout)
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
 	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	return vm.handleRun(ctx, client, url, cmd, blocking)
+	return vm.handleRun(ctx, s.agentClient(timeout+commandGrace), url, req)
 }
 
 func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []serverapi.VmFileUploadRequestFilesInner) (*serverapi.VmFileUploadResponse, error) {
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
 	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	client := s.agentClient(0)
+	ctx, idle, cancel := withIdleTimeout(ctx, s.Config().Timeouts.FileTransferIdle)
+	defer cancel()
 
 	reqBody := cmdserver.FilesPostRequest{
 		Files: make([]cmdserver.FilePostData, len(files)),
@@ -1769,6 +3166,19 @@ func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []server
 		reqBody.Files[i] = cmdserver.FilePostData{
 			Path:    file.GetPath(),
 			Content: file.GetContent(),
+			Mode:    file.GetMode(),
+			Mkdirs:  file.GetMkdirs(),
+		}
+		if file.HasUid() {
+			uid := int(file.GetUid())
+			reqBody.Files[i].UID = &uid
+		}
+		if file.HasGid() {
+			gid := int(file.GetGid())
+			reqBody.Files[i].GID = &gid
+		}
+		if err := reqBody.Files[i].Validate(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 	}
 
@@ -1777,40 +3187,47 @@ func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []server
 		return nil, status.Errorf(codes.Internal, "failed to marshal request: %v", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url+"/files", bytes.NewReader(body))
+	// Cmdservers that would ignore the file options don't have "/files/write".
+	path := "/files"
+	if reqBody.HasOptions() {
+		path = "/files/write"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url+path, idle.reader(bytes.NewReader(body)))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
 	}
+	req.ContentLength = int64(len(body))
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+		return nil, idle.error(ctx, "execute request", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound && path == "/files/write" {
+		return nil, status.Error(codes.Unavailable, "the guest's cmdserver is too old for mode, uid, gid or mkdirs")
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, status.Errorf(codes.Internal, "request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 
 	return &serverapi.VmFileUploadResponse{}, nil
 }
 
-func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string, cmd string, blocking bool) (*serverapi.VmCommandResponse, error) {
-	reqBody := struct {
-		Cmd      string `json:"cmd"`
-		Blocking bool   `json:"blocking"`
-	}{
-		Cmd:      cmd,
-		Blocking: blocking,
-	}
-
+func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string, reqBody cmdserver.RunCmdRequest) (*serverapi.VmCommandResponse, error) {
 	body, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/cmd", bytes.NewReader(body))
+	// Cmdservers that would ignore the options don't have "/exec".
+	path := "/cmd"
+	if reqBody.HasOptions() {
+		path = "/exec"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+path, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -1822,6 +3239,9 @@ func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string,
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound && path == "/exec" {
+		return nil, status.Error(codes.Unavailable, "the guest's cmdserver is too old for cwd, env or user")
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
 	}
@@ -1831,41 +3251,72 @@ func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string,
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return &serverapi.VmCommandResponse{
+	cmdResult := &serverapi.VmCommandResponse{
 		Output: serverapi.PtrString(cmdResp.Output),
 		Error:  serverapi.PtrString(cmdResp.Error),
-	}, nil
+	}
+	if cmdResp.ExitCode != nil {
+		cmdResult.SetExitCode(int32(*cmdResp.ExitCode))
+	}
+	if cmdResp.ID != "" {
+		cmdResult.SetId(cmdResp.ID)
+	}
+	return cmdResult, nil
 }
 
+// VMFileDownload returns the files at the comma-separated `paths` in the VM. Paths may be globs or
+// directories, which the guest expands to the files they match or contain.
 func (s *Server) VMFileDownload(ctx context.Context, vmName string, paths string) (*serverapi.VmFileDownloadResponse, error) {
+	// Cmdservers that would read globs as file names don't have "/files/read".
+	path := "/files"
+	for _, p := range strings.Split(paths, ",") {
+		if !cmdserver.IsGlob(p) {
+			continue
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid glob %q: %v", p, err)
+		}
+		path = "/files/read"
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
-	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	baseURL := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	client := s.agentClient(0)
+	ctx, idle, cancel := withIdleTimeout(ctx, s.Config().Timeouts.FileTransferIdle)
+	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url+"/files?paths="+paths, nil)
+	query := url.Values{"paths": {paths}}
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+path+"?"+query.Encode(), nil)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+		return nil, idle.error(ctx, "execute request", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound && path == "/files/read" {
+		return nil, status.Error(codes.Unavailable, "the guest's cmdserver is too old for glob patterns")
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
 	}
 
 	var cmdResp cmdserver.FilesGetResponse
-	if err := json.NewDecoder(resp.Body).Decode(&cmdResp); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	if err := json.NewDecoder(idle.reader(resp.Body)).Decode(&cmdResp); err != nil {
+		return nil, idle.error(ctx, "decode response", err)
 	}
 
 	apiResp := &serverapi.VmFileDownloadResponse{
@@ -1877,40 +3328,110 @@ func (s *Server) VMFileDownload(ctx context.Context, vmName string, paths string
 			Content: serverapi.PtrString(file.Content),
 			Error:   serverapi.PtrString(file.Error),
 		}
+		if file.Pattern != "" {
+			apiResp.Files[i].Pattern = serverapi.PtrString(file.Pattern)
+		}
+	}
+	if cmdResp.Truncated {
+		apiResp.Truncated = serverapi.PtrBool(true)
 	}
 	return apiResp, nil
 }
 
-// parseTapDeviceId extracts the numeric ID from a tap device name.
-// It expects the name to be in the format "tap<id>" where <id> is an integer.
-func parseTapDeviceId(tapDeviceName string) (int32, error) {
-	if !strings.HasPrefix(tapDeviceName, "tap") {
-		return 0, fmt.Errorf("invalid tap device name format: %s, expected format: tap<id>", tapDeviceName)
+// VMFileSearch searches the contents of files in the VM and returns the matching lines. The search
+// runs in the guest so only the matches cross the network.
+func (s *Server) VMFileSearch(ctx context.Context, vmName string, searchReq *serverapi.VmFileSearchRequest) (*serverapi.VmFileSearchResponse, error) {
+	// Checked here as well so that a bad pattern is reported as such, not as a failed request.
+	if _, err := regexp.Compile(searchReq.GetPattern()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid pattern: %v", err)
+	}
+	for _, glob := range searchReq.GetGlobs() {
+		if _, err := filepath.Match(strings.TrimPrefix(glob, "!"), ""); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid glob %q: %v", glob, err)
+		}
 	}
 
-	idStr := strings.TrimPrefix(tapDeviceName, "tap")
-	if idStr == "" {
-		return 0, fmt.Errorf("missing numeric ID in tap device name: %s", tapDeviceName)
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	client := s.agentClient(s.Config().Timeouts.ExecDefault)
+
+	body, err := json.Marshal(cmdserver.FilesSearchRequest{
+		Pattern:       searchReq.GetPattern(),
+		Path:          searchReq.GetPath(),
+		Globs:         searchReq.GetGlobs(),
+		IgnoreCase:    searchReq.GetIgnoreCase(),
+		IncludeHidden: searchReq.GetIncludeHidden(),
+		MaxResults:    int(searchReq.GetMaxResults()),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/files/search", bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-	id, err := strconv.ParseInt(idStr, 10, 32)
+	resp, err := client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse tap device ID from %s: %w", tapDeviceName, err)
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
 	}
+	defer resp.Body.Close()
 
-	return int32(id), nil
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, status.Errorf(codes.NotFound, "path not found in vm: %s", searchReq.GetPath())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var cmdResp cmdserver.FilesSearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cmdResp); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	apiResp := &serverapi.VmFileSearchResponse{
+		Matches:       make([]serverapi.VmFileSearchResponseMatchesInner, len(cmdResp.Matches)),
+		FilesSearched: serverapi.PtrInt32(int32(cmdResp.FilesSearched)),
+		Truncated:     serverapi.PtrBool(cmdResp.Truncated),
+	}
+	for i, match := range cmdResp.Matches {
+		apiResp.Matches[i] = serverapi.VmFileSearchResponseMatchesInner{
+			Path:       serverapi.PtrString(match.Path),
+			LineNumber: serverapi.PtrInt32(int32(match.LineNumber)),
+			Line:       serverapi.PtrString(match.Line),
+		}
+	}
+	return apiResp, nil
 }
 
 // waitForCmdServerReady checks if the command server in the guest VM is ready by sending a GET
-// request to it. Returns nil if the command server is ready, or an error if the timeout is reached.
-func waitForCmdServerReady(ctx context.Context, vmIP string) error {
-	ctx, cancel := context.WithTimeout(ctx, cmdServerReadyTimeout)
+// request to it. Returns nil if the command server is ready, or an error if `timeout` is reached.
+// How long the guest took to boot the command server goes to the start's timing.
+func (s *Server) waitForCmdServerReady(ctx context.Context, vmIP string, timeout time.Duration) (retErr error) {
+	ctx, span := tracing.Start(ctx, "vm.wait_guest_agent", tracing.String("vm.ip", vmIP))
+	defer func() {
+		span.RecordError(retErr)
+		span.End()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	cmdServerURL := fmt.Sprintf("http://%s:4031/", vmIP)
-	client := &http.Client{
-		Timeout: 5 * time.Second, // Short timeout for individual requests
-	}
+	// Individual requests only get as long as connecting would take.
+	client := s.agentClient(s.Config().Timeouts.AgentDial)
 
 	errCh := make(chan error, 1)
 	go func() {
@@ -1922,6 +3443,10 @@ func waitForCmdServerReady(ctx context.Context, vmIP string) error {
 			default:
 				resp, err := client.Get(cmdServerURL)
 				if err == nil && resp.StatusCode == http.StatusOK {
+					var index cmdserver.IndexResponse
+					if json.NewDecoder(resp.Body).Decode(&index) == nil {
+						bootTimingFromContext(ctx).kernelBoot = time.Duration(index.BootMs) * time.Millisecond
+					}
 					resp.Body.Close()
 					errCh <- nil
 					return
@@ -1935,3 +3460,63 @@ func waitForCmdServerReady(ctx context.Context, vmIP string) error {
 	}()
 	return <-errCh
 }
+
+// VMLoadModules loads kernel modules inside a running VM. Only modules on the allow-list can be
+// loaded.
+func (s *Server) VMLoadModules(ctx context.Context, vmName string, modules []string) (*serverapi.VmLoadModulesResponse, error) {
+	if err := checkModulesAllowed(modules, s.Config().KernelModuleAllowlist); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
+	client := s.agentClient(s.Config().Timeouts.ExecDefault)
+
+	body, err := json.Marshal(cmdserver.ModulesPostRequest{Modules: modules})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/modules", bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var cmdResp cmdserver.ModulesPostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cmdResp); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	apiResp := &serverapi.VmLoadModulesResponse{
+		Modules: make([]serverapi.VmLoadModulesResponseModulesInner, len(cmdResp.Modules)),
+	}
+	for i, module := range cmdResp.Modules {
+		apiResp.Modules[i] = serverapi.VmLoadModulesResponseModulesInner{
+			Name:   serverapi.PtrString(module.Name),
+			Loaded: serverapi.PtrBool(module.Error == ""),
+			Error:  serverapi.PtrString(module.Error),
+		}
+	}
+	return apiResp, nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/config"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	// The vsockserver, registered for every VM.
+	agentServiceName = "agent"
+	// Snapshots keep the services of their VM here, since restored VMs don't know their template.
+	vsockServicesFilename = "vsock-services.json"
+	// Longest reply to CONNECT we expect, e.g. "OK 1073741824".
+	maxVsockConnectReply = 64
+)
+
+var vsockServiceNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// vsockServices returns the services of VMs started from `tmpl`, the agent included.
+func vsockServices(tmpl config.TemplateConfig) map[string]uint32 {
+	services := map[string]uint32{agentServiceName: guestcall.VsockPort}
+	maps.Copy(services, tmpl.VsockServices)
+	return services
+}
+
+// validateVsockServices checks the services a template declares. Each needs a port of its own,
+// and none may take the agent's name or port.
+func validateVsockServices(services map[string]uint32) error {
+	ports := map[uint32]string{guestcall.VsockPort: agentServiceName}
+	for _, name := range slices.Sorted(maps.Keys(services)) {
+		port := services[name]
+		if !vsockServiceNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid vsock service name %q", name)
+		}
+		if name == agentServiceName {
+			return fmt.Errorf("vsock service name %s is reserved", name)
+		}
+		// VMADDR_PORT_ANY.
+		if port == 0 || port == math.MaxUint32 {
+			return fmt.Errorf("invalid port %d for vsock service %s", port, name)
+		}
+		if other, ok := ports[port]; ok {
+			return fmt.Errorf("vsock services %s and %s both use port %d", other, name, port)
+		}
+		ports[port] = name
+	}
+	return nil
+}
+
+// writeVsockServices stores `services` in `dir`.
+func writeVsockServices(dir string, services map[string]uint32) error {
+	data, err := json.Marshal(services)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, vsockServicesFilename), data, 0644)
+}
+
+// readVsockServices returns the services stored in `dir`. Snapshots taken before services were
+// configurable only have the agent.
+func readVsockServices(dir string) (map[string]uint32, error) {
+	data, err := os.ReadFile(path.Join(dir, vsockServicesFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return vsockServices(config.TemplateConfig{}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var services map[string]uint32
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", vsockServicesFilename, err)
+	}
+	return services, nil
+}
+
+// convertVsockServices returns `services` sorted by name.
+func convertVsockServices(services map[string]uint32) []serverapi.VsockService {
+	var result []serverapi.VsockService
+	for _, name := range slices.Sorted(maps.Keys(services)) {
+		result = append(result, serverapi.VsockService{
+			Name: serverapi.PtrString(name),
+			Port: serverapi.PtrInt64(int64(services[name])),
+		})
+	}
+	return result
+}
+
+// VsockService returns the vsock socket of `vmName` and the port of its service `name`, for
+// proxying requests to the service with `DialVsock`.
+func (s *Server) VsockService(vmName string, name string) (string, uint32, error) {
+	s.lock.RLock()
+	vm := s.vms[vmName]
+	s.lock.RUnlock()
+	if vm == nil {
+		return "", 0, status.Errorf(codes.NotFound, "vm not found: %s", vmName)
+	}
+	port, ok := vm.services[name]
+	if !ok {
+		return "", 0, status.Errorf(codes.NotFound, "vm %s has no service %s", vmName, name)
+	}
+	if name == agentServiceName {
+		return "", 0, status.Errorf(codes.FailedPrecondition, "the %s service isn't HTTP, use the cmd and files APIs instead", name)
+	}
+	if vm.status != vmStatusRunning {
+		return "", 0, status.Errorf(codes.FailedPrecondition, "vm %s is %s, not running", vmName, vm.status)
+	}
+	if vm.vsockPath == "" {
+		return "", 0, status.Errorf(codes.FailedPrecondition, "vm %s has no vsock device", vmName)
+	}
+	return vm.vsockPath, port, nil
+}
+
+// DialVsock connects to `port` in the guest through cloud-hypervisor's vsock socket at
+// `socketPath`, giving up after `timeout`. The connection carries the service's own protocol once
+// returned.
+func DialVsock(ctx context.Context, socketPath string, port uint32, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+	// Read a byte at a time so that we don't swallow what the service sends first.
+	var reply []byte
+	b := make([]byte, 1)
+	for len(reply) < maxVsockConnectReply {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to vsock port %d: %w", port, err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		reply = append(reply, b[0])
+	}
+	if !strings.HasPrefix(string(reply), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to vsock port %d: unexpected reply %q", port, reply)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to create session token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorizeSessionLocked returns a PermissionDenied error unless the caller is the API key that
+// owns `vm`. Unlike other changes to a VM, admins can't step in for the owner: whoever answers a
+// VM's callbacks steers it. Must be called with `s.lock` held.
+func authorizeSessionLocked(ctx context.Context, vm *vm) error {
+	id := auth.FromContext(ctx)
+	if id == nil || (vm.owner != "" && id.Name == vm.owner) || (vm.owner == "" && id.Has(auth.PermissionAdmin)) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "only the owner of vm %s can hold its callback session", vm.name)
+}
+
+// issueSessionToken gives the VM `vmName` a new session token, which has to be presented to
+// connect to its callback session, and returns it.
+func (s *Server) issueSessionToken(vmName string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		return "", status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	vm.sessionToken = token
+	return token, nil
+}
+
+// RotateSessionToken replaces the session token of the VM `vmName`, e.g. after its ownership was
+// transferred or the old token leaked. Callers should close the VM's callback session, which was
+// opened with the old token.
+func (s *Server) RotateSessionToken(ctx context.Context, vmName string) (*serverapi.SessionTokenResponse, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if err := authorizeSessionLocked(ctx, vm); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	vm.sessionToken = token
+	s.lock.Unlock()
+
+	log.WithField("vmName", vmName).Info("rotated session token")
+	return &serverapi.SessionTokenResponse{
+		SessionToken: serverapi.PtrString(token),
+	}, nil
+}
+
+// AuthorizeSession returns an error unless the caller may connect to the callback session of the
+// VM `vmName` with `token`: the token must be the one issued when the VM was started, or last
+// rotated, and the caller must own the VM.
+func (s *Server) AuthorizeSession(ctx context.Context, vmName string, token string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	vm, ok := s.vms[vmName]
+	if !ok {
+		return status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if err := authorizeSessionLocked(ctx, vm); err != nil {
+		return err
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(vm.sessionToken)) != 1 {
+		return status.Errorf(codes.PermissionDenied, "invalid session token for vm %s", vmName)
+	}
+	return nil
+}
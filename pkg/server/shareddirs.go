@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/arrakis/out/gen/chvapi"
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/guesttuning"
+	"github.com/abilashraghuram/arrakis/pkg/server/ninep"
+)
+
+const (
+	maxSharedDirs = 8
+	// Shared directories are tagged "share<n>" for the guest, and their virtiofsd listens on
+	// "virtiofs-<n>.sock" in the VM's state dir and logs to "virtiofsd-<n>.log".
+	sharedDirTagPrefix    = "share"
+	virtiofsSocketPrefix  = "virtiofs-"
+	virtiofsdLogPrefix    = "virtiofsd-"
+	virtiofsdStartTimeout = 5 * time.Second
+	// virtiofsd exits once its hypervisor is gone, and is killed if it takes longer.
+	virtiofsdStopTimeout = 5 * time.Second
+	virtiofsQueueSize    = 1024
+)
+
+// sharedDir is a host directory shared into a VM's guest.
+type sharedDir struct {
+	// Resolved, and under one of the allowed paths.
+	hostPath  string
+	guestPath string
+	readOnly  bool
+	// The virtiofsd serving it, once started. Nil when the server has no virtiofsd, then it's only
+	// served over 9P.
+	process *os.Process
+	// What the guest mounted it with, as it reported, empty until then. Guarded by the server lock.
+	transport string
+}
+
+// newSharedDirs validates the shared directories a start asks for.
+func (s *Server) newSharedDirs(dirs []serverapi.SharedDir) ([]*sharedDir, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	allowed := s.Config().SharedDirs.AllowedPaths
+	if len(allowed) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "shared directories aren't enabled on this server")
+	}
+	if len(dirs) > maxSharedDirs {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d directories can be shared", maxSharedDirs)
+	}
+	guestPaths := make(map[string]bool)
+	result := make([]*sharedDir, 0, len(dirs))
+	for _, d := range dirs {
+		hostPath := d.GetHostPath()
+		if !path.IsAbs(hostPath) {
+			return nil, status.Errorf(codes.InvalidArgument, "hostPath must be absolute, not %q", hostPath)
+		}
+		resolved, err := filepath.EvalSymlinks(hostPath)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "can't share %s: %v", hostPath, err)
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			return nil, status.Errorf(codes.InvalidArgument, "can't share %s: not a directory", hostPath)
+		}
+		if !underAllowedPath(resolved, allowed) {
+			return nil, status.Errorf(codes.PermissionDenied, "%s isn't under the shared_dirs.allowed_paths of this server", hostPath)
+		}
+		guestPath := path.Clean(d.GetGuestPath())
+		if err := guesttuning.ValidateGuestPath(guestPath); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if guestPaths[guestPath] {
+			return nil, status.Errorf(codes.InvalidArgument, "guest path %s is shared twice", guestPath)
+		}
+		guestPaths[guestPath] = true
+		result = append(result, &sharedDir{hostPath: resolved, guestPath: guestPath, readOnly: d.GetReadOnly()})
+	}
+	return result, nil
+}
+
+// underAllowedPath returns whether `p` is one of `allowed` or in one of them. Symlinks in the
+// allowed paths are resolved like in `p`.
+func underAllowedPath(p string, allowed []string) bool {
+	for _, dir := range allowed {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// convertSharedDirs converts the shared directories of a VM to the API format. Must be called with
+// the server lock held.
+func convertSharedDirs(dirs []*sharedDir) []serverapi.SharedDir {
+	if len(dirs) == 0 {
+		return nil
+	}
+	result := make([]serverapi.SharedDir, 0, len(dirs))
+	for _, d := range dirs {
+		dir := serverapi.SharedDir{
+			HostPath:  serverapi.PtrString(d.hostPath),
+			GuestPath: serverapi.PtrString(d.guestPath),
+			ReadOnly:  serverapi.PtrBool(d.readOnly),
+		}
+		if d.transport != "" {
+			dir.Transport = serverapi.PtrString(d.transport)
+		}
+		result = append(result, dir)
+	}
+	return result
+}
+
+// sameSharedDirs returns whether the VM sharing `dirs` shares what a start asks for, `requested`.
+func sameSharedDirs(dirs []*sharedDir, requested []*sharedDir) bool {
+	if len(dirs) != len(requested) {
+		return false
+	}
+	for i, d := range dirs {
+		r := requested[i]
+		if d.hostPath != r.hostPath || d.guestPath != r.guestPath || d.readOnly != r.readOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// shareDirs starts a virtiofsd for each of `dirs` in the VM state dir `stateDir`, and serves them
+// over 9P on the VM's vsock socket `vsockPath` for guests without virtiofs, stopping both on `cu`.
+// Returns the hypervisor's devices for them, the value of the guest's kernel command line key and
+// the 9P listener. Without a virtiofsd on the server, they're only served over 9P.
+func (s *Server) shareDirs(cu *cleanup.Cleanup, stateDir string, vsockPath string, dirs []*sharedDir) ([]chvapi.FsConfig, string, net.Listener, error) {
+	if len(dirs) == 0 {
+		return nil, "", nil, nil
+	}
+	virtiofsd, err := exec.LookPath(s.Config().SharedDirs.Virtiofsd)
+	if err != nil {
+		log.WithError(err).Warn("no virtiofsd, sharing directories over 9P only")
+	}
+	var fsConfigs []chvapi.FsConfig
+	guestDirs := make([]guesttuning.SharedDir, 0, len(dirs))
+	exports := make(map[string]ninep.Export, len(dirs))
+	for i, d := range dirs {
+		tag := sharedDirTagPrefix + strconv.Itoa(i)
+		guestDirs = append(guestDirs, guesttuning.SharedDir{Tag: tag, GuestPath: d.guestPath, ReadOnly: d.readOnly})
+		exports[tag] = ninep.Export{Path: d.hostPath, ReadOnly: d.readOnly}
+		if virtiofsd == "" {
+			continue
+		}
+		socket := path.Join(stateDir, virtiofsSocketPrefix+strconv.Itoa(i)+".sock")
+		logFile := path.Join(stateDir, virtiofsdLogPrefix+strconv.Itoa(i)+".log")
+		if err := startVirtiofsd(virtiofsd, d, socket, logFile); err != nil {
+			return nil, "", nil, err
+		}
+		cu.Add(func() {
+			stopVirtiofsd(d)
+		})
+		fsConfigs = append(fsConfigs, chvapi.FsConfig{Tag: tag, Socket: socket, NumQueues: 1, QueueSize: virtiofsQueueSize, Id: String(tag)})
+	}
+	listener, err := serve9P(vsockPath, exports)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cu.Add(func() {
+		listener.Close()
+	})
+	return fsConfigs, guesttuning.SharedDirsCmdlineKey + "=\"" + guesttuning.EncodeSharedDirs(guestDirs) + "\"", listener, nil
+}
+
+// serve9P serves `exports` over 9P to the guest of the VM with the vsock socket `vsockPath`, until
+// the returned listener is closed. The hypervisor forwards the guest's connections to the port to
+// "<vsock socket>_<port>".
+func serve9P(vsockPath string, exports map[string]ninep.Export) (net.Listener, error) {
+	socket := vsockPath + "_" + strconv.Itoa(guesttuning.SharedDirsVsockPort)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for 9P on %s: %w", socket, err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := ninep.Serve(conn, exports); err != nil {
+					log.WithError(err).WithField("socket", socket).Warn("9P connection failed")
+				}
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+// recordSharedDirTransports records the transports a guest reported it mounted `dirs` with, by tag.
+// Must be called with the server lock held.
+func recordSharedDirTransports(dirs []*sharedDir, transports map[string]string) {
+	for i, d := range dirs {
+		switch transport := transports[sharedDirTagPrefix+strconv.Itoa(i)]; transport {
+		case guesttuning.SharedDirTransportVirtiofs, guesttuning.SharedDirTransport9P:
+			d.transport = transport
+		}
+	}
+}
+
+// startVirtiofsd starts the virtiofsd at `virtiofsd` serving `d` on `socket` and waits for it to
+// listen.
+func startVirtiofsd(virtiofsd string, d *sharedDir, socket string, logFile string) error {
+	logger := log.WithFields(log.Fields{"hostPath": d.hostPath, "socket": socket})
+	f, err := os.Create(logFile)
+	if err != nil {
+		return fmt.Errorf("failed to create virtiofsd log file: %w", err)
+	}
+	defer f.Close()
+
+	args := []string{"--socket-path", socket, "--shared-dir", d.hostPath, "--cache", "auto"}
+	if d.readOnly {
+		args = append(args, "--readonly")
+	}
+	cmd := exec.Command(virtiofsd, args...)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	// Like the hypervisor, out of reach of our Ctrl-C.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start virtiofsd for %s: %w", d.hostPath, err)
+	}
+	d.process = cmd.Process
+
+	deadline := time.Now().Add(virtiofsdStartTimeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			stopVirtiofsd(d)
+			return fmt.Errorf("virtiofsd for %s didn't listen within %s, see %s", d.hostPath, virtiofsdStartTimeout, logFile)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	logger.WithField("pid", d.process.Pid).Info("started virtiofsd")
+	return nil
+}
+
+// stopVirtiofsd stops the virtiofsd of `d`, if it has one.
+func stopVirtiofsd(d *sharedDir) {
+	if d.process == nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{"hostPath": d.hostPath, "pid": d.process.Pid})
+	// Those of VMs taken over from another server aren't our children and can't be waited for.
+	d.process.Signal(syscall.SIGTERM)
+	if err := reapProcess(d.process, logger, virtiofsdStopTimeout); err != nil {
+		logger.WithError(err).Debug("failed to reap virtiofsd")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// OpenShell starts an interactive shell on a new pseudo-terminal in the guest of `vmName`. The
+// returned connection carries `guestcall` frames until the shell exits, and closing it hangs the
+// shell up. Errors are NotFound for unknown VMs, InvalidArgument for bad terminal types,
+// FailedPrecondition if the VM isn't running and Unavailable if its agent can't open shells.
+func (s *Server) OpenShell(ctx context.Context, vmName string, req guestcall.PTYRequest) (net.Conn, error) {
+	if err := guestcall.ValidateTerm(req.Term); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	conn, reader, err := s.dialAgent(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := guestcall.OpenPTY(conn, reader, req); err != nil {
+		conn.Close()
+		var respErr *guestcall.ResponseError
+		if !errors.As(err, &respErr) {
+			// Agents that predate shells run the command and answer with its output instead.
+			return nil, status.Errorf(codes.Unavailable, "failed to open shell, the agent of vm %s may be too old: %v", vmName, err)
+		}
+		switch respErr.Code {
+		case guestcall.ErrorInvalidPTY:
+			return nil, status.Error(codes.InvalidArgument, respErr.Message)
+		case guestcall.ErrorPTYFailed:
+			return nil, status.Errorf(codes.Internal, "failed to open shell: %s", respErr.Message)
+		default:
+			return nil, status.Errorf(codes.Unavailable, "failed to open shell: %s", respErr.Message)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
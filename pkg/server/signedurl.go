@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/auth"
+)
+
+const (
+	// Under the state dir.
+	urlSigningKeyFileName = "url-signing.key"
+
+	defaultSignedURLTTL = 15 * time.Minute
+	maxSignedURLTTL     = 24 * time.Hour
+)
+
+// SignURL returns a URL for the GET request `rawURL`, e.g. "/v1/vms/foo/files?paths=/out.log",
+// that works without an API key until it expires. It acts as the caller with read-only access,
+// and stops working if the caller's key is revoked, even if a new key takes its name.
+func (s *Server) SignURL(ctx context.Context, req *serverapi.SignUrlRequest) (*serverapi.SignUrlResponse, error) {
+	u, err := url.Parse(req.GetUrl())
+	if err != nil || u.IsAbs() || !strings.HasPrefix(u.Path, "/v1/") {
+		return nil, status.Error(codes.InvalidArgument, "url must be an API path, e.g. /v1/vms/foo/files?paths=/out.log")
+	}
+	if strings.HasPrefix(u.Path, "/v1/admin/") {
+		return nil, status.Error(codes.InvalidArgument, "admin endpoints can't be signed")
+	}
+	if u.Query().Has(auth.SignatureParam) {
+		return nil, status.Error(codes.InvalidArgument, "url is already signed")
+	}
+
+	ttl := defaultSignedURLTTL
+	if req.HasExpiresIn() {
+		ttl, err = time.ParseDuration(req.GetExpiresIn())
+		if err != nil || ttl <= 0 || ttl > maxSignedURLTTL {
+			return nil, status.Errorf(codes.InvalidArgument, "expiresIn must be a duration between 0 and %s", maxSignedURLTTL)
+		}
+	}
+
+	id := auth.FromContext(ctx)
+	if id != nil && id.ReadOnly() == nil {
+		return nil, status.Error(codes.PermissionDenied, "api key lacks the read permission")
+	}
+	if id != nil && strings.HasPrefix(id.Name, auth.OIDCNamePrefix) {
+		// The signer's permissions are looked up on every use, which we can't do for a token.
+		return nil, status.Error(codes.FailedPrecondition, "signing urls requires an api key")
+	}
+	// Signed by the key rather than its name, so that a new key with the same name doesn't revive
+	// the URLs of a revoked one.
+	var keyID string
+	if id != nil {
+		keyID = id.KeyID
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	signed := s.urlSigner.Sign(http.MethodGet, u, keyID, expires)
+
+	log.WithFields(log.Fields{
+		"path":    u.Path,
+		"signer":  ownerFromContext(ctx),
+		"expires": expires,
+	}).Info("signed url")
+	return &serverapi.SignUrlResponse{
+		Url:       serverapi.PtrString(signed.String()),
+		ExpiresAt: serverapi.PtrTime(expires.UTC()),
+	}, nil
+}
+
+// AuthenticateSignedURL returns the identity the signed request `r` acts with: the signer's,
+// limited to reading. Signed URLs can't open WebSockets, which could steer the VM.
+func (s *Server) AuthenticateSignedURL(r *http.Request) (*auth.Identity, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || websocket.IsWebSocketUpgrade(r) {
+		return nil, auth.ErrSignatureInvalid
+	}
+	// HEAD requests use the URL signed for GET.
+	keyID, err := s.urlSigner.Verify(http.MethodGet, r.URL, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := auth.IdentityByKeyID(s.Config().Auth.APIKeys, keyID)
+	if !ok {
+		id, ok = s.apiKeys.IdentityByKeyID(keyID)
+	}
+	if !ok || id.ReadOnly() == nil {
+		return nil, auth.ErrSignatureInvalid
+	}
+	return id.ReadOnly(), nil
+}
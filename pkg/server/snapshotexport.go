@@ -0,0 +1,210 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/objectstore"
+)
+
+const (
+	operationSnapshotExport = "snapshot.export"
+
+	// First entry of every exported snapshot archive.
+	snapshotManifestName    = "arrakis-snapshot.json"
+	snapshotManifestVersion = 1
+)
+
+// snapshotManifest describes an exported snapshot archive.
+type snapshotManifest struct {
+	Version    int       `json:"version"`
+	SnapshotID string    `json:"snapshotId"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// Names of the snapshot's files, which follow the manifest in the archive.
+	Files []string `json:"files"`
+}
+
+// validSnapshotID returns an InvalidArgument error unless `id` names a directory directly under
+// the snapshots directory. Hidden names are kept for imports in progress.
+func validSnapshotID(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || filepath.Base(id) != id {
+		return status.Errorf(codes.InvalidArgument, "invalid snapshot id %q", id)
+	}
+	return nil
+}
+
+// ExportSnapshot starts uploading the snapshot `snapshotId` to the snapshot store and returns the
+// operation that tracks the upload.
+func (s *Server) ExportSnapshot(ctx context.Context, snapshotId string) (*serverapi.Operation, error) {
+	if err := validSnapshotID(snapshotId); err != nil {
+		return nil, err
+	}
+	cfg := s.Config().SnapshotStore
+	if cfg.Endpoint == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no snapshot store is configured")
+	}
+	store, err := objectstore.New(cfg)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "invalid snapshot store: %v", err)
+	}
+
+	dir := path.Join(s.config.StateDir, "snapshots", snapshotId)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotId)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read snapshot %s: %v", snapshotId, err)
+	}
+	var files []string
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read snapshot %s: %v", snapshotId, err)
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, entry.Name())
+		size += info.Size()
+	}
+
+	// Drains wait for exports like for snapshots.
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	op, err := s.operations.start(ctx, operationSnapshotExport, snapshotId, size)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s%s-%s.tar.gz", cfg.Prefix, snapshotId, now.Format("20060102T150405Z"))
+	manifest := snapshotManifest{
+		Version:    snapshotManifestVersion,
+		SnapshotID: snapshotId,
+		ExportedAt: now,
+		Files:      files,
+	}
+
+	logger := log.WithFields(log.Fields{
+		"snapshotId":  snapshotId,
+		"operationId": op.id,
+		"uri":         store.URI(key),
+	})
+	logger.Info("exporting snapshot")
+	go func() {
+		defer done()
+		err := s.exportSnapshot(store, key, dir, manifest, op)
+		if err != nil {
+			logger.WithError(err).Error("failed to export snapshot")
+			s.operations.finish(op, nil, err)
+			return
+		}
+		logger.Info("exported snapshot")
+		s.operations.finish(op, map[string]string{"uri": store.URI(key)}, nil)
+	}()
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return convertOperation(op), nil
+}
+
+// exportSnapshot uploads the archive of the snapshot in `dir` as `key`, counting the snapshot's
+// bytes towards `op` as they're archived.
+func (s *Server) exportSnapshot(store *objectstore.Client, key string, dir string, manifest snapshotManifest, op *operation) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.writeSnapshotArchive(pw, dir, manifest, op))
+	}()
+	err := store.Upload(context.Background(), key, pr)
+	// Stops the archive writer if the upload failed.
+	pr.CloseWithError(err)
+	return err
+}
+
+// writeSnapshotArchive writes `manifest` and the files of the snapshot in `dir` to `w` as a
+// gzipped tar archive.
+func (s *Server) writeSnapshotArchive(w io.Writer, dir string, manifest snapshotManifest, op *operation) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    snapshotManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.ExportedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	for _, name := range manifest.Files {
+		if err := s.addArchiveFile(tw, path.Join(dir, name), name, op); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (s *Server) addArchiveFile(tw *tar.Writer, filePath string, name string, op *operation) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, &progressReader{r: f, report: func(n int64) { s.operations.progress(op, n) }})
+	return err
+}
+
+// progressReader reports the bytes read through it.
+type progressReader struct {
+	r      io.Reader
+	report func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.report(int64(n))
+	}
+	return n, err
+}
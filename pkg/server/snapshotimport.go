@@ -0,0 +1,332 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/objectstore"
+)
+
+const (
+	operationSnapshotImport = "snapshot.import"
+
+	// Target of imports of uploaded archives, which have no URI.
+	uploadedArchiveTarget = "upload"
+	// Largest manifest read from an archive.
+	maxSnapshotManifestSize = 1 << 20
+)
+
+// ImportSnapshot starts downloading the snapshot archive at the "s3://" `uri`, as written by
+// `ExportSnapshot`, and returns the operation that tracks the download. The snapshot is registered
+// as `snapshotId`, or under the ID it was exported with if that's empty.
+func (s *Server) ImportSnapshot(ctx context.Context, uri string, snapshotId string) (*serverapi.Operation, error) {
+	if snapshotId != "" {
+		if err := s.checkImportedSnapshotID(snapshotId); err != nil {
+			return nil, err
+		}
+	}
+	bucket, key, err := objectstore.ParseURI(uri)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot URI: %v", err)
+	}
+	cfg := s.Config().SnapshotStore
+	if cfg.Endpoint == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no snapshot store is configured")
+	}
+	// The configured credentials may well reach the buckets of other hosts.
+	cfg.Bucket = bucket
+	store, err := objectstore.New(cfg)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "invalid snapshot store: %v", err)
+	}
+
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	op, err := s.operations.start(ctx, operationSnapshotImport, uri, 0)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{
+		"uri":         uri,
+		"operationId": op.id,
+	})
+	logger.Info("importing snapshot")
+	go func() {
+		defer done()
+		id, err := s.importSnapshotObject(store, key, snapshotId, op)
+		if err != nil {
+			logger.WithError(err).Error("failed to import snapshot")
+			s.operations.finish(op, nil, err)
+			return
+		}
+		logger.WithField("snapshotId", id).Info("imported snapshot")
+		s.operations.finish(op, map[string]string{"snapshotId": id}, nil)
+	}()
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return convertOperation(op), nil
+}
+
+func (s *Server) importSnapshotObject(store *objectstore.Client, key string, snapshotId string, op *operation) (string, error) {
+	body, size, err := store.Open(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	s.operations.lock.Lock()
+	op.bytesTotal = size
+	s.operations.lock.Unlock()
+	return s.importSnapshotArchive(body, snapshotId, op)
+}
+
+// ImportSnapshotArchive imports the snapshot archive read from `r`, which is `size` bytes long or
+// -1 if unknown, and returns the finished operation. The snapshot is registered as `snapshotId`,
+// or under the ID it was exported with if that's empty.
+func (s *Server) ImportSnapshotArchive(ctx context.Context, r io.Reader, size int64, snapshotId string) (*serverapi.Operation, error) {
+	if snapshotId != "" {
+		if err := s.checkImportedSnapshotID(snapshotId); err != nil {
+			return nil, err
+		}
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	op, err := s.operations.start(ctx, operationSnapshotImport, uploadedArchiveTarget, max(size, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.importSnapshotArchive(r, snapshotId, op)
+	if err != nil {
+		log.WithField("operationId", op.id).WithError(err).Error("failed to import snapshot")
+		s.operations.finish(op, nil, err)
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"operationId": op.id,
+		"snapshotId":  id,
+	}).Info("imported snapshot")
+	s.operations.finish(op, map[string]string{"snapshotId": id}, nil)
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return convertOperation(op), nil
+}
+
+// checkImportedSnapshotID returns an error unless a snapshot can be imported as `id`.
+func (s *Server) checkImportedSnapshotID(id string) error {
+	if err := validSnapshotID(id); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(s.config.StateDir, "snapshots", id)); err == nil {
+		return status.Errorf(codes.AlreadyExists, "snapshot %s already exists", id)
+	}
+	return nil
+}
+
+// importSnapshotArchive unpacks the archive read from `r` into a new snapshot, counting the bytes
+// read towards `op`, and returns the snapshot's ID. Nothing is left behind if it fails.
+func (s *Server) importSnapshotArchive(r io.Reader, snapshotId string, op *operation) (string, error) {
+	gz, err := gzip.NewReader(&progressReader{r: r, report: func(n int64) { s.operations.progress(op, n) }})
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "not a snapshot archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	manifest, err := readSnapshotManifest(tr)
+	if err != nil {
+		return "", err
+	}
+	if snapshotId == "" {
+		snapshotId = manifest.SnapshotID
+	}
+	if err := s.checkImportedSnapshotID(snapshotId); err != nil {
+		return "", err
+	}
+
+	// Unpacked next to the snapshots, and only moved in with its final name once complete.
+	snapshotsDir := path.Join(s.config.StateDir, "snapshots")
+	tmpDir := path.Join(snapshotsDir, ".import-"+op.id)
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to create snapshot directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	expected := make(map[string]bool, len(manifest.Files))
+	for _, name := range manifest.Files {
+		if err := validSnapshotID(name); err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid file name %q in snapshot manifest", name)
+		}
+		expected[name] = true
+	}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid snapshot archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg || !expected[header.Name] {
+			return "", status.Errorf(codes.InvalidArgument, "unexpected entry %q in snapshot archive", header.Name)
+		}
+		// Each file only once.
+		delete(expected, header.Name)
+		// Files keep their permissions, e.g. the vsock secret's, but are never made executable.
+		perm := header.FileInfo().Mode().Perm() & 0644
+		if err := extractArchiveFile(tr, path.Join(tmpDir, header.Name), perm); err != nil {
+			return "", status.Errorf(codes.Internal, "failed to unpack %s: %v", header.Name, err)
+		}
+	}
+	if len(expected) > 0 {
+		missing := slices.Sorted(maps.Keys(expected))
+		return "", status.Errorf(codes.InvalidArgument, "snapshot archive lacks %s", strings.Join(missing, ", "))
+	}
+	if err := s.checkImportedConfig(path.Join(tmpDir, "config.json")); err != nil {
+		return "", err
+	}
+
+	// Someone may have taken the ID while we were unpacking.
+	if err := s.checkImportedSnapshotID(snapshotId); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDir, path.Join(snapshotsDir, snapshotId)); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to register snapshot: %v", err)
+	}
+	return snapshotId, nil
+}
+
+// checkImportedConfig returns an error unless every path in the imported VM config at `configPath`
+// is the snapshotted VM's own, which restores move into the new VM's state directory, or an image
+// the server's config names. Anything else, e.g. a host's block device as a disk, would be opened
+// by the hypervisor of the VMs restored from it.
+func (s *Server) checkImportedConfig(configPath string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "snapshot archive lacks its VM config: %v", err)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid VM config in snapshot archive: %v", err)
+	}
+	oldStateDir := snapshotStateDir(config)
+	images := s.importableImages()
+	var bad string
+	walkConfigStrings(config, func(v string) {
+		if bad != "" || !strings.HasPrefix(v, "/") {
+			return
+		}
+		// As relocated by replaceStatePaths.
+		if rest, ok := strings.CutPrefix(v, oldStateDir+"/"); oldStateDir != "" && ok && filepath.IsLocal(rest) {
+			return
+		}
+		if !images(v) {
+			bad = v
+		}
+	})
+	if bad != "" {
+		return status.Errorf(codes.InvalidArgument, "snapshot VM config refers to %s, which is neither in the snapshot nor a configured image", bad)
+	}
+	return nil
+}
+
+// importableImages returns whether a path is an image that imported snapshots may refer to: the
+// kernel, initramfs and rootfs of the config and its templates, base images, volumes, and the image
+// cache, which holds downloaded and converted images.
+func (s *Server) importableImages() func(string) bool {
+	cfg := s.Config()
+	paths := map[string]bool{}
+	for _, p := range []string{cfg.KernelPath, cfg.InitramfsPath, cfg.RootfsPath} {
+		paths[p] = true
+	}
+	for _, tmpl := range cfg.Templates {
+		paths[tmpl.Kernel] = true
+		paths[tmpl.Initramfs] = true
+		paths[tmpl.Rootfs] = true
+	}
+	for _, p := range cfg.BaseImages {
+		paths[p] = true
+	}
+	for _, p := range cfg.Volumes {
+		paths[p] = true
+	}
+	cacheDir := path.Join(cfg.StateDir, imageCacheDirName)
+	return func(p string) bool {
+		if rest, ok := strings.CutPrefix(p, cacheDir+"/"); ok && filepath.IsLocal(rest) {
+			return true
+		}
+		return p != "" && paths[p]
+	}
+}
+
+// walkConfigStrings calls `fn` with every string in the decoded JSON `value`.
+func walkConfigStrings(value any, fn func(string)) {
+	switch v := value.(type) {
+	case string:
+		fn(v)
+	case map[string]any:
+		for _, elem := range v {
+			walkConfigStrings(elem, fn)
+		}
+	case []any:
+		for _, elem := range v {
+			walkConfigStrings(elem, fn)
+		}
+	}
+}
+
+// readSnapshotManifest reads the manifest, which leads every snapshot archive.
+func readSnapshotManifest(tr *tar.Reader) (*snapshotManifest, error) {
+	header, err := tr.Next()
+	if err != nil || header.Name != snapshotManifestName {
+		return nil, status.Errorf(codes.InvalidArgument, "not a snapshot archive: it doesn't start with %s", snapshotManifestName)
+	}
+	var manifest snapshotManifest
+	if err := json.NewDecoder(io.LimitReader(tr, maxSnapshotManifestSize)).Decode(&manifest); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot manifest: %v", err)
+	}
+	if manifest.Version < 1 || manifest.Version > snapshotManifestVersion {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported snapshot archive version %d", manifest.Version)
+	}
+	if err := validSnapshotID(manifest.SnapshotID); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot id %q in snapshot manifest", manifest.SnapshotID)
+	}
+	return &manifest, nil
+}
+
+func extractArchiveFile(r io.Reader, filePath string, perm os.FileMode) error {
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+func TestCheckImportedConfig(t *testing.T) {
+	s := &Server{config: config.ServerConfig{
+		StateDir:      "/var/lib/arrakis",
+		KernelPath:    "/opt/arrakis/vmlinux.bin",
+		InitramfsPath: "/opt/arrakis/initramfs.cpio.gz",
+		RootfsPath:    "/opt/arrakis/rootfs.img",
+		Templates:     map[string]config.TemplateConfig{"python": {Rootfs: "/opt/arrakis/python.img"}},
+		Volumes:       map[string]string{"data": "/srv/volumes/data.img"},
+	}}
+	const stateDir = "/var/lib/arrakis/vms/foo"
+
+	// A config as snapshotted, with `disk` as its data disk.
+	snapshotConfig := func(disk string) map[string]any {
+		return map[string]any{
+			"payload": map[string]any{
+				"kernel":    "/opt/arrakis/vmlinux.bin",
+				"initramfs": "/opt/arrakis/initramfs.cpio.gz",
+				"cmdline":   "console=ttyS0 init=/sbin/init",
+			},
+			"disks": []any{
+				map[string]any{"path": "/var/lib/arrakis/images/rootfs-raw.img", "readonly": true},
+				map[string]any{"path": disk},
+			},
+			"serial": map[string]any{"file": stateDir + "/serial.log"},
+			"vsock":  map[string]any{"socket": stateDir + "/vsock.sock", "cid": 3},
+		}
+	}
+	tests := []struct {
+		name    string
+		disk    string
+		wantErr bool
+	}{
+		{name: "stateful disk", disk: stateDir + "/" + statefulDiskFilename},
+		{name: "rootfs", disk: "/opt/arrakis/rootfs.img"},
+		{name: "template rootfs", disk: "/opt/arrakis/python.img"},
+		{name: "volume", disk: "/srv/volumes/data.img"},
+		{name: "image cache", disk: "/var/lib/arrakis/images/data-raw.img"},
+		{name: "host device", disk: "/dev/sda", wantErr: true},
+		{name: "other VM's disk", disk: "/var/lib/arrakis/vms/bar/" + statefulDiskFilename, wantErr: true},
+		{name: "out of the state dir", disk: stateDir + "/../bar/" + statefulDiskFilename, wantErr: true},
+		{name: "out of the image cache", disk: "/var/lib/arrakis/images/../vms/bar/" + statefulDiskFilename, wantErr: true},
+		{name: "state dir itself", disk: stateDir, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(snapshotConfig(tt.disk))
+			if err != nil {
+				t.Fatal(err)
+			}
+			configPath := path.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(configPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err = s.checkImportedConfig(configPath)
+			if tt.wantErr {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Fatalf("checkImportedConfig(%s) error = %v, want InvalidArgument", tt.disk, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkImportedConfig(%s) error = %v", tt.disk, err)
+			}
+		})
+	}
+}
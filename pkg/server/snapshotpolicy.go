@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const (
+	maxSnapshotPolicies  = 8
+	maxSnapshotRetention = 100
+)
+
+// snapshotPolicy snapshots a VM on a schedule, keeping the newest `retention` of the snapshots it
+// took. Guarded by the server lock.
+type snapshotPolicy struct {
+	id        string
+	spec      string
+	schedule  *cronSchedule
+	retention int
+	nextRun   time.Time
+	lastRun   time.Time
+	lastError string
+	// IDs of the snapshots taken for the policy, oldest first.
+	snapshots []string
+	// Set while a snapshot for the policy is being taken.
+	running bool
+}
+
+// CreateSnapshotPolicy adds a policy that snapshots the VM `vmName` on a schedule.
+func (s *Server) CreateSnapshotPolicy(ctx context.Context, vmName string, req *serverapi.SnapshotPolicyRequest) (*serverapi.SnapshotPolicy, error) {
+	schedule, err := parseCronSchedule(req.Schedule)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid schedule %q: %v", req.Schedule, err)
+	}
+	if req.Retention < 1 || req.Retention > maxSnapshotRetention {
+		return nil, status.Errorf(codes.InvalidArgument, "retention must be between 1 and %d", maxSnapshotRetention)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create policy id: %v", err)
+	}
+	now := time.Now()
+	nextRun, _ := schedule.next(now)
+	p := &snapshotPolicy{
+		id:        hex.EncodeToString(b),
+		spec:      req.Schedule,
+		schedule:  schedule,
+		retention: int(req.Retention),
+		nextRun:   nextRun,
+	}
+
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	if len(vm.snapshotPolicies) >= maxSnapshotPolicies {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s already has %d snapshot policies", vmName, maxSnapshotPolicies)
+	}
+	vm.snapshotPolicies = append(vm.snapshotPolicies, p)
+	resp := convertSnapshotPolicy(p)
+	s.lock.Unlock()
+
+	log.WithFields(log.Fields{
+		"vmName":    vmName,
+		"policyId":  p.id,
+		"schedule":  p.spec,
+		"retention": p.retention,
+		"nextRun":   p.nextRun,
+	}).Info("created snapshot policy")
+	return resp, nil
+}
+
+// ListSnapshotPolicies returns the snapshot policies of the VM `vmName`.
+func (s *Server) ListSnapshotPolicies(ctx context.Context, vmName string) (*serverapi.ListSnapshotPoliciesResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	resp := &serverapi.ListSnapshotPoliciesResponse{
+		Policies: []serverapi.SnapshotPolicy{},
+	}
+	for _, p := range vm.snapshotPolicies {
+		resp.Policies = append(resp.Policies, *convertSnapshotPolicy(p))
+	}
+	return resp, nil
+}
+
+// DeleteSnapshotPolicy removes the snapshot policy `id` of the VM `vmName`. The snapshots it took
+// are kept.
+func (s *Server) DeleteSnapshotPolicy(ctx context.Context, vmName string, id string) (*serverapi.VMResponse, error) {
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	i := slices.IndexFunc(vm.snapshotPolicies, func(p *snapshotPolicy) bool { return p.id == id })
+	if i == -1 {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "snapshot policy %s not found", id)
+	}
+	vm.snapshotPolicies = slices.Delete(vm.snapshotPolicies, i, i+1)
+	s.lock.Unlock()
+
+	log.WithFields(log.Fields{
+		"vmName":   vmName,
+		"policyId": id,
+	}).Info("deleted snapshot policy")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
+
+// runSnapshotScheduler takes the snapshots that policies are due for, checking at the start of
+// every minute. It never returns.
+func (s *Server) runSnapshotScheduler() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		s.takeDueSnapshots(time.Now())
+	}
+}
+
+// takeDueSnapshots starts a snapshot for every policy that is due at `now`. Runs of policies whose
+// VM isn't running, or whose previous snapshot is still being taken, are skipped.
+func (s *Server) takeDueSnapshots(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for vmName, vm := range s.vms {
+		for _, p := range vm.snapshotPolicies {
+			if now.Before(p.nextRun) {
+				continue
+			}
+			p.nextRun, _ = p.schedule.next(now)
+			if p.running || vm.status != vmStatusRunning {
+				log.WithFields(log.Fields{
+					"vmName":   vmName,
+					"policyId": p.id,
+					"status":   vm.status.String(),
+				}).Debug("skipped scheduled snapshot")
+				continue
+			}
+			p.running = true
+			go s.takeScheduledSnapshot(vmName, p, now)
+		}
+	}
+}
+
+// takeScheduledSnapshot snapshots the VM `vmName` for `p` and deletes the policy's snapshots
+// beyond its retention, then compacts the new snapshot if image_compaction says so.
+func (s *Server) takeScheduledSnapshot(vmName string, p *snapshotPolicy, now time.Time) {
+	logger := log.WithFields(log.Fields{
+		"vmName":   vmName,
+		"policyId": p.id,
+	})
+	snapshotId := fmt.Sprintf("scheduled-%s-%s-%s", vmName, p.id, now.UTC().Format("20060102T150405Z"))
+	_, err := s.SnapshotVM(context.Background(), vmName, snapshotId)
+
+	s.lock.Lock()
+	p.running = false
+	p.lastRun = now
+	if err != nil {
+		p.lastError = err.Error()
+		s.lock.Unlock()
+		logger.WithError(err).Error("scheduled snapshot failed")
+		return
+	}
+	p.lastError = ""
+	p.snapshots = append(p.snapshots, snapshotId)
+	var expired []string
+	// Snapshots of deleted policies are kept.
+	vm, ok := s.vms[vmName]
+	if ok && slices.Contains(vm.snapshotPolicies, p) && len(p.snapshots) > p.retention {
+		n := len(p.snapshots) - p.retention
+		expired = slices.Clone(p.snapshots[:n])
+		p.snapshots = slices.Delete(p.snapshots, 0, n)
+	}
+	s.lock.Unlock()
+	logger.WithField("snapshotId", snapshotId).Info("took scheduled snapshot")
+
+	for _, id := range expired {
+		if err := os.RemoveAll(path.Join(s.config.StateDir, "snapshots", id)); err != nil {
+			logger.WithField("snapshotId", id).WithError(err).Warn("failed to delete expired snapshot")
+			continue
+		}
+		logger.WithField("snapshotId", id).Info("deleted expired snapshot")
+	}
+	s.compactSnapshotScheduled(snapshotId)
+}
+
+func convertSnapshotPolicy(p *snapshotPolicy) *serverapi.SnapshotPolicy {
+	policy := &serverapi.SnapshotPolicy{
+		Id:        serverapi.PtrString(p.id),
+		Schedule:  serverapi.PtrString(p.spec),
+		Retention: serverapi.PtrInt32(int32(p.retention)),
+		NextRun:   serverapi.PtrTime(p.nextRun),
+		Snapshots: slices.Clone(p.snapshots),
+	}
+	if !p.lastRun.IsZero() {
+		policy.SetLastRun(p.lastRun)
+		policy.SetLastError(p.lastError)
+	}
+	return policy
+}
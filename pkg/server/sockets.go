@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+const (
+	maxSocketForwards = 16
+	// Host sockets of a VM's forwards live here, in its state directory.
+	socketForwardsDirname = "sockets"
+	// Longest path a Unix socket can be bound to, sun_path less its terminating NUL.
+	maxUnixSocketPath = 107
+)
+
+// socketForward exposes a Unix socket of the guest as a Unix socket on the host. Guarded by the
+// server lock, except for `connections`.
+type socketForward struct {
+	id        string
+	guestPath string
+	hostPath  string
+	createdAt time.Time
+	listener  net.Listener
+	// Connections currently bridged.
+	connections atomic.Int32
+}
+
+// bufferedConn is a connection whose first bytes were read into `reader` already.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// dialAgent connects to the vsockserver of `vm` and authenticates if the VM has a secret. Reads
+// must go through the returned reader.
+func (s *Server) dialAgent(ctx context.Context, vm *vm) (net.Conn, *bufio.Reader, error) {
+	if vm.vsockPath == "" {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "vm %s has no vsock device", vm.name)
+	}
+	conn, err := DialVsock(ctx, vm.vsockPath, guestcall.VsockPort, s.Config().Timeouts.AgentDial)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "failed to connect to the vsockserver: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	secret, err := os.ReadFile(path.Join(vm.stateDirPath, guestcall.VsockSecretFilename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to read vsock secret: %w", err)
+	}
+	if err == nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if err := guestcall.Authenticate(conn, reader, strings.TrimSpace(string(secret))); err != nil {
+			conn.Close()
+			return nil, nil, status.Errorf(codes.Unavailable, "failed to authenticate to the vsockserver: %v", err)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, reader, nil
+}
+
+// dialGuestSocket connects to the Unix socket at `socketPath` in the guest of `vm`, bridged by the
+// vsockserver.
+func (s *Server) dialGuestSocket(ctx context.Context, vm *vm, socketPath string) (net.Conn, error) {
+	conn, reader, err := s.dialAgent(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := guestcall.OpenSocket(conn, reader, socketPath); err != nil {
+		conn.Close()
+		var respErr *guestcall.ResponseError
+		if !errors.As(err, &respErr) {
+			return nil, status.Errorf(codes.Unavailable, "failed to open socket %s: %v", socketPath, err)
+		}
+		switch respErr.Code {
+		case guestcall.ErrorInvalidSocket:
+			return nil, status.Error(codes.InvalidArgument, respErr.Message)
+		case guestcall.ErrorSocketUnreachable:
+			return nil, status.Error(codes.FailedPrecondition, respErr.Message)
+		default:
+			return nil, status.Errorf(codes.Unavailable, "failed to open socket %s: %s", socketPath, respErr.Message)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// runningVM returns the VM `vmName` if it's running.
+func (s *Server) runningVM(vmName string) (*vm, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Errorf(codes.NotFound, "vm not found: %s", vmName)
+	}
+	if vm.status != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, not running", vmName, vm.status)
+	}
+	return vm, nil
+}
+
+// DialGuestSocket connects to the Unix socket at `socketPath` in the guest of `vmName`. Errors are
+// NotFound for unknown VMs, InvalidArgument for bad paths and FailedPrecondition if the VM isn't
+// running or nothing listens on the socket.
+func (s *Server) DialGuestSocket(ctx context.Context, vmName string, socketPath string) (net.Conn, error) {
+	if err := guestcall.ValidateSocketPath(socketPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	return s.dialGuestSocket(ctx, vm, socketPath)
+}
+
+// CreateSocketForward exposes the Unix socket at `req.GuestPath` in the guest of `vmName` as a Unix
+// socket on the host, in the VM's state directory.
+func (s *Server) CreateSocketForward(ctx context.Context, vmName string, req *serverapi.SocketForwardRequest) (*serverapi.SocketForward, error) {
+	if err := guestcall.ValidateSocketPath(req.GuestPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create socket id: %v", err)
+	}
+	id := hex.EncodeToString(b)
+	dir := path.Join(vm.stateDirPath, socketForwardsDirname)
+	hostPath := path.Join(dir, id+".sock")
+	if len(hostPath) > maxUnixSocketPath {
+		return nil, status.Errorf(codes.FailedPrecondition, "host socket path %s is longer than %d bytes, use a shorter state_dir", hostPath, maxUnixSocketPath)
+	}
+
+	s.lock.Lock()
+	if len(vm.socketForwards) >= maxSocketForwards {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s already exposes %d sockets", vmName, maxSocketForwards)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.Internal, "failed to create socket directory: %v", err)
+	}
+	listener, err := net.Listen("unix", hostPath)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.Internal, "failed to create host socket: %v", err)
+	}
+	if err := os.Chmod(hostPath, 0600); err != nil {
+		listener.Close()
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.Internal, "failed to restrict host socket: %v", err)
+	}
+	f := &socketForward{
+		id:        id,
+		guestPath: req.GuestPath,
+		hostPath:  hostPath,
+		createdAt: time.Now(),
+		listener:  listener,
+	}
+	vm.socketForwards = append(vm.socketForwards, f)
+	resp := convertSocketForward(f)
+	s.lock.Unlock()
+
+	log.WithFields(log.Fields{
+		"vmName":    vmName,
+		"socketId":  id,
+		"guestPath": f.guestPath,
+		"hostPath":  hostPath,
+	}).Info("exposed guest socket")
+	go s.serveSocketForward(vm, f)
+	return resp, nil
+}
+
+// serveSocketForward bridges every connection to the host socket of `f` to the guest socket, until
+// the host socket is closed.
+func (s *Server) serveSocketForward(vm *vm, f *socketForward) {
+	logger := log.WithFields(log.Fields{
+		"vmName":   vm.name,
+		"socketId": f.id,
+	})
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.WithError(err).Error("failed to accept connection to host socket")
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			guestConn, err := s.dialGuestSocket(context.Background(), vm, f.guestPath)
+			if err != nil {
+				logger.WithError(err).Warn("failed to connect to guest socket")
+				return
+			}
+			defer guestConn.Close()
+			f.connections.Add(1)
+			defer f.connections.Add(-1)
+			bridgeConns(conn, guestConn)
+		}()
+	}
+}
+
+// bridgeConns copies bytes between `a` and `b` until both directions are done, passing on
+// half-closes.
+func bridgeConns(a net.Conn, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(b, a)
+		closeWrite(b)
+	}()
+	io.Copy(a, b)
+	closeWrite(a)
+	<-done
+}
+
+// closeWrite shuts down the writing side of `conn` if it supports that.
+func closeWrite(conn net.Conn) {
+	if buffered, ok := conn.(*bufferedConn); ok {
+		conn = buffered.Conn
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// ListSocketForwards returns the guest sockets `vmName` exposes on the host.
+func (s *Server) ListSocketForwards(ctx context.Context, vmName string) (*serverapi.ListSocketForwardsResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	sockets := []serverapi.SocketForward{}
+	for _, f := range vm.socketForwards {
+		sockets = append(sockets, *convertSocketForward(f))
+	}
+	return &serverapi.ListSocketForwardsResponse{Sockets: sockets}, nil
+}
+
+// DeleteSocketForward removes the host socket `id` of `vmName`. Bridged connections stay open.
+func (s *Server) DeleteSocketForward(ctx context.Context, vmName string, id string) (*serverapi.VMResponse, error) {
+	s.lock.Lock()
+	vm, ok := s.vms[vmName]
+	if !ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	i := slices.IndexFunc(vm.socketForwards, func(f *socketForward) bool { return f.id == id })
+	if i == -1 {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s has no socket %s", vmName, id)
+	}
+	f := vm.socketForwards[i]
+	vm.socketForwards = slices.Delete(vm.socketForwards, i, i+1)
+	s.lock.Unlock()
+
+	// Also removes the socket file.
+	f.listener.Close()
+	log.WithFields(log.Fields{
+		"vmName":   vmName,
+		"socketId": id,
+	}).Info("removed exposed guest socket")
+	return &serverapi.VMResponse{Success: serverapi.PtrBool(true)}, nil
+}
+
+// closeSocketForwards removes every host socket of `vm`.
+func (s *Server) closeSocketForwards(vm *vm) {
+	s.lock.Lock()
+	forwards := vm.socketForwards
+	vm.socketForwards = nil
+	s.lock.Unlock()
+	for _, f := range forwards {
+		f.listener.Close()
+	}
+}
+
+func convertSocketForward(f *socketForward) *serverapi.SocketForward {
+	return &serverapi.SocketForward{
+		Id:          serverapi.PtrString(f.id),
+		GuestPath:   serverapi.PtrString(f.guestPath),
+		HostPath:    serverapi.PtrString(f.hostPath),
+		Connections: serverapi.PtrInt32(f.connections.Load()),
+		CreatedAt:   serverapi.PtrTime(f.createdAt),
+	}
+}
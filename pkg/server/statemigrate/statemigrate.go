@@ -0,0 +1,403 @@
+// Package statemigrate upgrades the on-disk format of a directory, such as the server's state dir,
+// through a list of numbered migrations. The directory's format version is kept in a file in it.
+// Before a migration runs, the paths it touches are backed up; if it fails, or the process dies
+// while it runs, they are restored and the directory stays at its previous version.
+package statemigrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Holds the format version of the directory.
+	VersionFileName = "format-version.json"
+	// Backups of migrations live in this directory, one directory each.
+	BackupsDirName = "migration-backups"
+	// Backups of this many of the most recent migrations are kept.
+	keptBackups = 3
+
+	backupManifestName = "manifest.json"
+	backupFilesDirName = "files"
+)
+
+// Migration upgrades a directory from version To-1 to To.
+type Migration struct {
+	To          int
+	Description string
+	// Affected returns the paths, relative to `dir`, that Up may change, create or remove. Only
+	// these are backed up and restored.
+	Affected func(dir string) ([]string, error)
+	// Up performs the migration. Backups hard link files where they can, so Up must replace files
+	// by writing new ones and renaming them over the old, never modify them in place.
+	Up func(dir string) error
+}
+
+// versionFile is the content of the version file.
+type versionFile struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// backupManifest describes a backup. Backups that aren't `Done` belong to a migration that never
+// finished and are rolled back on the next run.
+type backupManifest struct {
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	Paths     []string  `json:"paths"`
+	CreatedAt time.Time `json:"createdAt"`
+	Done      bool      `json:"done"`
+}
+
+// Latest returns the version a directory is at once all of `migrations` ran.
+func Latest(migrations []Migration) int {
+	return len(migrations)
+}
+
+// Version returns the format version of `dir`. Directories without a version file are at 0 unless
+// they are empty, i.e. new, in which case they're at `latest`.
+func Version(dir string, latest int) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, VersionFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && len(entries) == 0) {
+			return latest, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var version versionFile
+	if err := json.Unmarshal(data, &version); err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", VersionFileName, err)
+	}
+	return version.Version, nil
+}
+
+// Run brings `dir`, which must exist, to the latest version of `migrations`, whose `To` must count
+// up from 1. It refuses directories at a newer version than it knows.
+func Run(dir string, migrations []Migration) error {
+	for i, m := range migrations {
+		if m.To != i+1 {
+			return fmt.Errorf("migration %q is numbered %d, expected %d", m.Description, m.To, i+1)
+		}
+	}
+	if err := recoverInterrupted(dir); err != nil {
+		return err
+	}
+
+	latest := Latest(migrations)
+	version, err := Version(dir, latest)
+	if err != nil {
+		return fmt.Errorf("failed to read format version of %s: %w", dir, err)
+	}
+	if version > latest {
+		return fmt.Errorf(
+			"%s is at format version %d, newer than the %d this server supports: upgrade the server, or restore a backup from %s",
+			dir, version, latest, filepath.Join(dir, BackupsDirName))
+	}
+	if _, err := os.Stat(filepath.Join(dir, VersionFileName)); errors.Is(err, os.ErrNotExist) && version == latest {
+		// A new directory, nothing to migrate.
+		return writeVersion(dir, latest)
+	}
+
+	for _, m := range migrations[version:] {
+		if err := apply(dir, m); err != nil {
+			return fmt.Errorf("failed to migrate %s to format version %d (%s): %w", dir, m.To, m.Description, err)
+		}
+	}
+	return pruneBackups(dir)
+}
+
+// apply runs `m` on `dir`, which is at version m.To-1, and rolls it back if it fails.
+func apply(dir string, m Migration) error {
+	logger := log.WithFields(log.Fields{
+		"dir":       dir,
+		"migration": m.To,
+	})
+	logger.Infof("Migrating to format version %d: %s", m.To, m.Description)
+
+	var paths []string
+	if m.Affected != nil {
+		var err error
+		if paths, err = m.Affected(dir); err != nil {
+			return err
+		}
+	}
+	for _, p := range paths {
+		if !filepath.IsLocal(p) || isReserved(p) {
+			return fmt.Errorf("migration affects %q, which is outside the directory or reserved", p)
+		}
+	}
+
+	backupDir := filepath.Join(dir, BackupsDirName, fmt.Sprintf("v%d-to-v%d-%d", m.To-1, m.To, time.Now().Unix()))
+	manifest := backupManifest{
+		From:      m.To - 1,
+		To:        m.To,
+		Paths:     paths,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := os.MkdirAll(filepath.Join(backupDir, backupFilesDirName), 0700); err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+	// Written first, so that a backup interrupted halfway is still found and rolled back.
+	if err := writeJSON(filepath.Join(backupDir, backupManifestName), manifest); err != nil {
+		os.RemoveAll(backupDir)
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+	for _, p := range paths {
+		if err := backup(filepath.Join(dir, p), filepath.Join(backupDir, backupFilesDirName, p)); err != nil {
+			os.RemoveAll(backupDir)
+			return fmt.Errorf("failed to back up %s: %w", p, err)
+		}
+	}
+
+	if err := m.Up(dir); err != nil {
+		logger.WithError(err).Error("Migration failed, rolling back")
+		if rollbackErr := rollback(dir, backupDir, manifest); rollbackErr != nil {
+			return fmt.Errorf("%w, and rolling back failed: %v, restore %s by hand", err, rollbackErr, backupDir)
+		}
+		return err
+	}
+	if err := writeVersion(dir, m.To); err != nil {
+		if rollbackErr := rollback(dir, backupDir, manifest); rollbackErr != nil {
+			return fmt.Errorf("%w, and rolling back failed: %v, restore %s by hand", err, rollbackErr, backupDir)
+		}
+		return err
+	}
+	manifest.Done = true
+	if err := writeJSON(filepath.Join(backupDir, backupManifestName), manifest); err != nil {
+		// The version is written, so rolling back on the next run would undo a finished migration.
+		return fmt.Errorf("failed to mark backup %s done: %w", backupDir, err)
+	}
+	logger.WithField("backup", backupDir).Infof("Migrated to format version %d", m.To)
+	return nil
+}
+
+// isReserved returns whether `p` is one of the files this package keeps in the directory.
+func isReserved(p string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(filepath.Clean(p)), "/")
+	return first == VersionFileName || first == BackupsDirName
+}
+
+// recoverInterrupted rolls back the migrations of `dir` whose backups were never marked done,
+// unless the version was written before the process died.
+func recoverInterrupted(dir string) error {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if b.manifest.Done {
+			continue
+		}
+		// Not empty, it holds the backup.
+		version, err := Version(dir, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read format version of %s: %w", dir, err)
+		}
+		if version >= b.manifest.To {
+			b.manifest.Done = true
+			if err := writeJSON(filepath.Join(b.dir, backupManifestName), b.manifest); err != nil {
+				return err
+			}
+			continue
+		}
+		log.WithField("backup", b.dir).Warnf("Rolling back interrupted migration to format version %d", b.manifest.To)
+		if err := rollback(dir, b.dir, b.manifest); err != nil {
+			return fmt.Errorf("failed to roll back interrupted migration to format version %d, restore %s by hand: %w", b.manifest.To, b.dir, err)
+		}
+	}
+	return nil
+}
+
+// rollback puts the paths backed up in `backupDir` back into `dir` and removes the backup. Paths
+// that didn't exist before the migration are removed.
+func rollback(dir string, backupDir string, manifest backupManifest) error {
+	for _, p := range manifest.Paths {
+		target := filepath.Join(dir, p)
+		saved := filepath.Join(backupDir, backupFilesDirName, p)
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(saved); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(saved, target); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(backupDir)
+}
+
+type backupEntry struct {
+	dir      string
+	manifest backupManifest
+}
+
+// listBackups returns the backups of `dir`, oldest first.
+func listBackups(dir string) ([]backupEntry, error) {
+	backupsDir := filepath.Join(dir, BackupsDirName)
+	entries, err := os.ReadDir(backupsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []backupEntry
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		b := backupEntry{dir: filepath.Join(backupsDir, entry.Name())}
+		data, err := os.ReadFile(filepath.Join(b.dir, backupManifestName))
+		if errors.Is(err, os.ErrNotExist) {
+			// Interrupted before anything was backed up, let alone migrated.
+			if err := os.RemoveAll(b.dir); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &b.manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest of backup %s: %w", b.dir, err)
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].manifest.CreatedAt.Before(backups[j].manifest.CreatedAt)
+	})
+	return backups, nil
+}
+
+// pruneBackups removes all but the most recent `keptBackups` backups.
+func pruneBackups(dir string) error {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	backups = slices.DeleteFunc(backups, func(b backupEntry) bool { return !b.manifest.Done })
+	for len(backups) > keptBackups {
+		log.WithField("backup", backups[0].dir).Info("Removing old migration backup")
+		if err := os.RemoveAll(backups[0].dir); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backup mirrors `src` at `dst`, hard linking regular files where it can and copying them where it
+// can't. Missing sources are skipped.
+func backup(src string, dst string) error {
+	if _, err := os.Lstat(src); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			err := os.Link(p, target)
+			if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) {
+				return copyFile(p, target, info.Mode().Perm())
+			}
+			return err
+		default:
+			// Sockets and the like don't outlive the processes that made them.
+			return nil
+		}
+	})
+}
+
+func copyFile(src string, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeVersion(dir string, version int) error {
+	return writeJSON(filepath.Join(dir, VersionFileName), versionFile{Version: version, UpdatedAt: time.Now().UTC()})
+}
+
+// writeJSON writes `v` to `p`, replacing the file atomically.
+func writeJSON(p string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
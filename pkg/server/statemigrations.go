@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/server/statemigrate"
+)
+
+// stateMigrations upgrade the layout of the state dir, in order. New ones go at the end; released
+// ones are never changed, since state dirs out there are already past them.
+var stateMigrations = []statemigrate.Migration{
+	{
+		To:          1,
+		Description: "remove VM state directories left at the top level by servers before vms/",
+		Affected:    legacyVMStateDirs,
+		Up:          removeLegacyVMStateDirs,
+	},
+}
+
+// MigrateStateDir upgrades the layout of `stateDir` to the one this server uses, creating it if it
+// doesn't exist. It must run before anything else reads the state dir.
+func MigrateStateDir(stateDir string) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create state dir %s: %w", stateDir, err)
+	}
+	return statemigrate.Run(stateDir, stateMigrations)
+}
+
+// StateDirVersion returns the format version of `stateDir` and the one this server migrates it to.
+func StateDirVersion(stateDir string) (int, int, error) {
+	latest := statemigrate.Latest(stateMigrations)
+	version, err := statemigrate.Version(stateDir, latest)
+	return version, latest, err
+}
+
+// legacyVMStateDirs returns the top-level directories of `stateDir` that hold the files of a VM.
+// Servers named VM state directories after the VM, directly under the state dir, before they moved
+// to "vms/<id>". VMs don't outlive the server, so these are leftovers of VMs that died with one.
+func legacyVMStateDirs(stateDir string) ([]string, error) {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// cloud-hypervisor always logs to "log", and every VM had its API socket.
+		dir := path.Join(stateDir, entry.Name())
+		if !exists(path.Join(dir, "log")) {
+			continue
+		}
+		for _, name := range []string{apiSocketFilename, vsockSocketFilename, statefulDiskFilename, guestcall.VsockSecretFilename} {
+			if exists(path.Join(dir, name)) {
+				dirs = append(dirs, entry.Name())
+				break
+			}
+		}
+	}
+	return dirs, nil
+}
+
+func removeLegacyVMStateDirs(stateDir string) error {
+	dirs, err := legacyVMStateDirs(stateDir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(path.Join(stateDir, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return !errors.Is(err, os.ErrNotExist)
+}
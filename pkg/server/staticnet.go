@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net"
+	"slices"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/server/ipallocator"
+)
+
+// parseStaticNetwork validates the IP and MAC a start asks for, nil for those it doesn't. MACs must
+// be unicast Ethernet addresses.
+func parseStaticNetwork(ipStr string, macStr string) (net.IP, net.HardwareAddr, error) {
+	var ip net.IP
+	if ipStr != "" {
+		if ip = net.ParseIP(ipStr).To4(); ip == nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid IPv4 address %q", ipStr)
+		}
+	}
+	var mac net.HardwareAddr
+	if macStr != "" {
+		var err error
+		mac, err = net.ParseMAC(macStr)
+		if err != nil || len(mac) != 6 {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid MAC address %q", macStr)
+		}
+		if mac[0]&1 != 0 {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "MAC address %s is multicast", macStr)
+		}
+	}
+	return ip, mac, nil
+}
+
+// parseIPPool validates the IP pool a start asks for, returning the default pool if it asks for
+// none.
+func (s *Server) parseIPPool(name string) (string, error) {
+	if name == "" {
+		return ipallocator.DefaultPool, nil
+	}
+	if !slices.Contains(s.ipAllocator.Pools(), name) {
+		return "", status.Errorf(codes.InvalidArgument, "unknown IP pool %q", name)
+	}
+	return name, nil
+}
+
+// checkStaticMAC returns an error if a VM other than `vmName`, or a hibernated one, has `mac`.
+func (s *Server) checkStaticMAC(vmName string, mac net.HardwareAddr) error {
+	if mac == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for name, vm := range s.vms {
+		if name != vmName && vm.mac == mac.String() {
+			return status.Errorf(codes.AlreadyExists, "MAC address %s is in use by vm %s", mac, name)
+		}
+	}
+	for name, h := range s.hibernated {
+		if name != vmName && h.mac == mac.String() {
+			return status.Errorf(codes.AlreadyExists, "MAC address %s is in use by vm %s", mac, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+	"github.com/abilashraghuram/arrakis/pkg/tracing"
+)
+
+// ForwardGuestTelemetry exports `body`, OTLP/HTTP JSON logs or metrics as `signal` says, that the
+// guest `guestName` collected, to the collector of the `guest_telemetry` config. Each resource is
+// tagged with the VM's name, namespace, owner and labels, replacing any "arrakis." attributes the
+// guest set. Like reports, it's only accepted from the VM's own IP.
+func (s *Server) ForwardGuestTelemetry(ctx context.Context, guestName string, sourceIP net.IP, signal string, body []byte) error {
+	if s.telemetry == nil {
+		return status.Errorf(codes.FailedPrecondition, "guest telemetry is disabled")
+	}
+	if signal != guestcall.TelemetryLogs && signal != guestcall.TelemetryMetrics {
+		return status.Errorf(codes.NotFound, "unknown telemetry signal %q", signal)
+	}
+	if len(body) > guestcall.MaxTelemetryBody {
+		return status.Errorf(codes.InvalidArgument, "telemetry exceeds %d bytes", guestcall.MaxTelemetryBody)
+	}
+	vmName, vm, err := s.guestVM(guestName, sourceIP, "telemetry")
+	if err != nil {
+		return err
+	}
+
+	namespace, name := SplitQualifiedName(vmName)
+	attrs := []tracing.Attribute{
+		tracing.String("arrakis.vm.name", name),
+		tracing.String("arrakis.namespace", namespace),
+	}
+	s.lock.RLock()
+	if vm.owner != "" {
+		attrs = append(attrs, tracing.String("arrakis.owner", vm.owner))
+	}
+	keys := make([]string, 0, len(vm.labels))
+	for key := range vm.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attrs = append(attrs, tracing.String("arrakis.label."+key, vm.labels[key]))
+	}
+	s.lock.RUnlock()
+
+	err = s.telemetry.Forward(ctx, signal, body, attrs)
+	if errors.Is(err, tracing.ErrInvalidExport) {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"vmName": vmName,
+			"signal": signal,
+		}).WithError(err).Warn("failed to forward guest telemetry")
+		return status.Errorf(codes.Unavailable, "failed to forward %s: %v", signal, err)
+	}
+	return nil
+}
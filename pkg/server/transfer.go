@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errTransferIdle = errors.New("transfer idle")
+
+// idleTimer cancels a transfer once no data has moved through its readers for `idle`, so that
+// large files aren't cut off by a fixed deadline while stalled guests are still given up on.
+type idleTimer struct {
+	idle  time.Duration
+	timer *time.Timer
+}
+
+// withIdleTimeout returns a context that is canceled once `idle` passes without a read through the
+// readers of the returned timer. The cancel func must be called once the transfer is over.
+func withIdleTimeout(ctx context.Context, idle time.Duration) (context.Context, *idleTimer, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	t := &idleTimer{idle: idle}
+	t.timer = time.AfterFunc(idle, func() { cancel(errTransferIdle) })
+	return ctx, t, func() {
+		t.timer.Stop()
+		cancel(nil)
+	}
+}
+
+// reader returns `r` with every read that moves data pushing the timer back.
+func (t *idleTimer) reader(r io.Reader) io.Reader {
+	return &idleReader{r: r, timer: t}
+}
+
+type idleReader struct {
+	r     io.Reader
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.timer.Reset(r.timer.idle)
+	}
+	return n, err
+}
+
+// error returns the error for a transfer under `ctx` that failed to `action` with `err`, telling a
+// transfer that went idle apart from other failures.
+func (t *idleTimer) error(ctx context.Context, action string, err error) error {
+	if errors.Is(context.Cause(ctx), errTransferIdle) {
+		return status.Errorf(codes.DeadlineExceeded, "failed to %s: no data moved for %s", action, t.idle)
+	}
+	return status.Errorf(codes.Internal, "failed to %s: %v", action, err)
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+	"github.com/abilashraghuram/arrakis/pkg/guestcall"
+)
+
+// How long the vsockserver may take to say why it stopped taking the chunks of a write.
+const fileErrorTimeout = 5 * time.Second
+
+// fileCallError converts an error of the FILE command `req`.
+func fileCallError(req guestcall.FileRequest, err error) error {
+	var respErr *guestcall.ResponseError
+	if !errors.As(err, &respErr) {
+		return status.Errorf(codes.Unavailable, "failed to %s %s, the vsockserver may be too old for chunked transfers: %v", req.Op, req.Path, err)
+	}
+	switch respErr.Code {
+	case guestcall.ErrorInvalidFile:
+		return status.Error(codes.InvalidArgument, respErr.Message)
+	case guestcall.ErrorFileNotFound:
+		return status.Error(codes.NotFound, respErr.Message)
+	case guestcall.ErrorFileOffset:
+		if req.Op == guestcall.FileOpRead {
+			return status.Error(codes.OutOfRange, respErr.Message)
+		}
+		return status.Error(codes.FailedPrecondition, respErr.Message)
+	case guestcall.ErrorFileBusy:
+		return status.Error(codes.FailedPrecondition, respErr.Message)
+	case guestcall.ErrorFileFailed:
+		return status.Error(codes.Internal, respErr.Message)
+	default:
+		// E.g. an unknown command, from a vsockserver that predates chunked transfers.
+		return status.Errorf(codes.Unavailable, "vsockserver failed, it may be too old for chunked transfers: %s", respErr.Message)
+	}
+}
+
+func fileUploadToAPI(s *guestcall.FileStatus) *serverapi.FileUpload {
+	upload := &serverapi.FileUpload{
+		Path:   serverapi.PtrString(s.Path),
+		Offset: serverapi.PtrInt64(s.Offset),
+		Exists: serverapi.PtrBool(s.Exists),
+	}
+	if s.Exists {
+		upload.Size = serverapi.PtrInt64(s.Size)
+	}
+	if s.Committed {
+		upload.Committed = serverapi.PtrBool(true)
+	}
+	return upload
+}
+
+// openFileCall checks `req.Path`, connects to the vsockserver of the running VM `vmName` and sends
+// `req`. The connection is closed once `ctx` is done.
+func (s *Server) openFileCall(ctx context.Context, vmName string, req guestcall.FileRequest) (net.Conn, *bufio.Reader, *guestcall.FileStatus, error) {
+	if err := guestcall.ValidateFilePath(req.Path); err != nil {
+		return nil, nil, nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	vm, err := s.runningVM(vmName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn, reader, err := s.dialAgent(ctx, vm)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	fileStatus, err := guestcall.SendFileRequest(conn, reader, req)
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, nil, nil, status.Errorf(codes.DeadlineExceeded, "vsockserver didn't answer in time: %v", err)
+		}
+		return nil, nil, nil, fileCallError(req, err)
+	}
+	return conn, reader, fileStatus, nil
+}
+
+// fileCall runs a FILE command that carries no chunks, giving it `timeout`.
+func (s *Server) fileCall(ctx context.Context, vmName string, req guestcall.FileRequest, timeout time.Duration) (*serverapi.FileUpload, error) {
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, _, fileStatus, err := s.openFileCall(ctx, vmName, req)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return fileUploadToAPI(fileStatus), nil
+}
+
+// UploadStatus returns how much of the upload to `path` in the VM `vmName` was written so far.
+func (s *Server) UploadStatus(ctx context.Context, vmName string, path string) (*serverapi.FileUpload, error) {
+	return s.fileCall(ctx, vmName, guestcall.FileRequest{Op: guestcall.FileOpStat, Path: path}, s.Config().Timeouts.ExecDefault)
+}
+
+// AbortUpload deletes what was written of the upload to `path` in the VM `vmName`.
+func (s *Server) AbortUpload(ctx context.Context, vmName string, path string) (*serverapi.VMResponse, error) {
+	if _, err := s.fileCall(ctx, vmName, guestcall.FileRequest{Op: guestcall.FileOpAbort, Path: path}, s.Config().Timeouts.ExecDefault); err != nil {
+		return nil, err
+	}
+	return &serverapi.VMResponse{}, nil
+}
+
+// CommitUpload moves the complete upload of `req` into place. Checksumming large files takes a
+// while, so it's given as long as commands may run.
+func (s *Server) CommitUpload(ctx context.Context, vmName string, req *serverapi.FileUploadCommitRequest) (*serverapi.FileUpload, error) {
+	fileReq := guestcall.FileRequest{
+		Op:     guestcall.FileOpCommit,
+		Path:   req.GetPath(),
+		Size:   req.GetSize(),
+		SHA256: req.GetSha256(),
+		Mode:   req.GetMode(),
+	}
+	if req.HasUid() {
+		uid := int(req.GetUid())
+		fileReq.UID = &uid
+	}
+	if req.HasGid() {
+		gid := int(req.GetGid())
+		fileReq.GID = &gid
+	}
+	upload, err := s.fileCall(ctx, vmName, fileReq, s.Config().Timeouts.ExecMax)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"vmName": vmName,
+		"path":   req.GetPath(),
+		"size":   req.GetSize(),
+	}).Info("committed upload")
+	return upload, nil
+}
+
+// WriteUpload streams `body` into the upload to `path` in the VM `vmName` from `offset`, a chunk at
+// a time. If `body` is cut short, what arrived is kept for the upload to be resumed. Errors are
+// FailedPrecondition if `offset` isn't where the upload is at.
+func (s *Server) WriteUpload(ctx context.Context, vmName string, path string, offset int64, mkdirs bool, body io.Reader) (*serverapi.FileUpload, error) {
+	if offset < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "offset can't be negative")
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	ctx, idle, cancel := withIdleTimeout(ctx, s.Config().Timeouts.FileTransferIdle)
+	defer cancel()
+	req := guestcall.FileRequest{
+		Op:     guestcall.FileOpWrite,
+		Path:   path,
+		Offset: offset,
+		Mkdirs: mkdirs,
+	}
+	conn, reader, _, err := s.openFileCall(ctx, vmName, req)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	chunks := guestcall.NewChunkWriter(conn)
+	body = idle.reader(body)
+	buf := make([]byte, guestcall.MaxFileChunk)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := chunks.Write(buf[:n]); err != nil {
+				if ctx.Err() != nil {
+					return nil, idle.error(ctx, "write the upload", err)
+				}
+				// The vsockserver stops reading when it fails, and says why first.
+				conn.SetReadDeadline(time.Now().Add(fileErrorTimeout))
+				if _, statusErr := guestcall.ReadFileStatus(reader); statusErr != nil {
+					var respErr *guestcall.ResponseError
+					if errors.As(statusErr, &respErr) {
+						return nil, fileCallError(req, statusErr)
+					}
+				}
+				return nil, status.Errorf(codes.Unavailable, "failed to write the upload: %v", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// Closing the connection without the last chunk tells the vsockserver to keep what
+			// it has.
+			return nil, idle.error(ctx, "read the upload", readErr)
+		}
+	}
+	if err := chunks.Close(); err != nil {
+		return nil, idle.error(ctx, "write the upload", err)
+	}
+	fileStatus, err := guestcall.ReadFileStatus(reader)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, idle.error(ctx, "write the upload", err)
+		}
+		return nil, fileCallError(req, err)
+	}
+	return fileUploadToAPI(fileStatus), nil
+}
+
+// GuestFile is a part of a file being streamed from a guest. It must be closed.
+type GuestFile struct {
+	io.Reader
+	// Size of the whole file, and where and how long the part is.
+	Size   int64
+	Offset int64
+	Length int64
+	close  func()
+}
+
+func (f *GuestFile) Close() error {
+	f.close()
+	return nil
+}
+
+// OpenGuestFile streams at most `length` bytes of the file at `path` in the VM `vmName` from
+// `offset`, all of the rest if `length` is zero. Errors are OutOfRange if `offset` is beyond the
+// end of the file. The stream fails if the file shrinks meanwhile or no data moves for the file
+// transfer idle timeout.
+func (s *Server) OpenGuestFile(ctx context.Context, vmName string, path string, offset int64, length int64) (*GuestFile, error) {
+	if offset < 0 || length < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "offset and length can't be negative")
+	}
+	done, err := s.beginOp(false)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, idle, cancel := withIdleTimeout(ctx, s.Config().Timeouts.FileTransferIdle)
+	conn, reader, fileStatus, err := s.openFileCall(ctx, vmName, guestcall.FileRequest{
+		Op:     guestcall.FileOpRead,
+		Path:   path,
+		Offset: offset,
+		Length: length,
+	})
+	if err != nil {
+		cancel()
+		done()
+		return nil, err
+	}
+	return &GuestFile{
+		Reader: io.LimitReader(idle.reader(guestcall.NewChunkReader(reader)), fileStatus.Length),
+		Size:   fileStatus.Size,
+		Offset: fileStatus.Offset,
+		Length: fileStatus.Length,
+		close: func() {
+			conn.Close()
+			cancel()
+			done()
+		},
+	}, nil
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+const (
+	// Under the state dir.
+	usageFileName = "usage.json"
+
+	// CPU time used by a VM in its last interval before it stops is missed, so this is short.
+	usageSampleInterval = 15 * time.Second
+	// Unit of the CPU times in /proc, which Linux fixes at 100 per second for userspace.
+	userHZ = 100
+
+	// Package domains of RAPL are "intel-rapl:<n>" here, also on AMD CPUs.
+	raplDir          = "/sys/class/powercap"
+	energySourceRAPL = "rapl"
+)
+
+// vmUsage is what a VM used since it was first seen.
+type vmUsage struct {
+	CPUSeconds   float64   `json:"cpuSeconds"`
+	EnergyJoules float64   `json:"energyJoules"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+	// The hypervisor process at the last sample and its CPU ticks then, so that only ticks since
+	// are counted, also across restarts of the server. The start time tells reused PIDs apart.
+	PID       int    `json:"pid,omitempty"`
+	StartTime uint64 `json:"startTime,omitempty"`
+	Ticks     uint64 `json:"ticks,omitempty"`
+	// Whether the VM's process was running at the last sample.
+	running bool
+}
+
+type usageState struct {
+	Since time.Time `json:"since"`
+	// Energy of the host's CPU packages while it was measured.
+	HostEnergyJoules float64 `json:"hostEnergyJoules"`
+	// Keyed by qualified VM name.
+	VMs map[string]*vmUsage `json:"vms"`
+}
+
+// raplCounter is a reading of a RAPL energy counter, which wraps around at maxRange.
+type raplCounter struct {
+	energy   uint64
+	maxRange uint64
+}
+
+// usageTracker accounts the CPU time and energy VMs use, kept in a file so that it outlives
+// restarts.
+type usageTracker struct {
+	path  string
+	lock  sync.Mutex
+	state usageState
+	// Counters of the previous sample, to turn into the usage since.
+	lastCPUBusy uint64
+	lastEnergy  map[string]raplCounter
+}
+
+func newUsageTracker(stateDir string) (*usageTracker, error) {
+	u := &usageTracker{path: filepath.Join(stateDir, usageFileName)}
+	data, err := os.ReadFile(u.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read VM usage: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &u.state); err != nil {
+			log.WithError(err).Warnf("Ignoring invalid VM usage %s", u.path)
+			u.state = usageState{}
+		}
+	}
+	if u.state.Since.IsZero() {
+		u.state.Since = time.Now().UTC()
+	}
+	if u.state.VMs == nil {
+		u.state.VMs = make(map[string]*vmUsage)
+	}
+	return u, nil
+}
+
+// readProcessCPU returns the user and system CPU ticks of the process `pid`, all of its threads,
+// and its start time, from /proc/<pid>/stat.
+func readProcessCPU(pid int) (uint64, uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name before the fields can contain spaces and parentheses.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	// Starting with the third field, the state.
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return 0, 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	var values [3]uint64
+	for i, index := range []int{11, 12, 19} {
+		if values[i], err = strconv.ParseUint(fields[index], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid /proc/%d/stat: %w", pid, err)
+		}
+	}
+	return values[0] + values[1], values[2], nil
+}
+
+// readRAPLEnergy returns the energy counters of the host's CPU packages, or none if the host has no
+// RAPL interface.
+func readRAPLEnergy() (map[string]raplCounter, error) {
+	dirs, err := filepath.Glob(filepath.Join(raplDir, "intel-rapl:*"))
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]raplCounter)
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		// Subdomains, e.g. the cores or DRAM, are "intel-rapl:<n>:<m>", and the cores are part
+		// of the package.
+		if strings.Count(name, ":") != 1 {
+			continue
+		}
+		var counter raplCounter
+		for _, value := range []struct {
+			file string
+			dest *uint64
+		}{{"energy_uj", &counter.energy}, {"max_energy_range_uj", &counter.maxRange}} {
+			data, err := os.ReadFile(filepath.Join(dir, value.file))
+			if err != nil {
+				return nil, err
+			}
+			if *value.dest, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s/%s: %w", dir, value.file, err)
+			}
+		}
+		counters[name] = counter
+	}
+	return counters, nil
+}
+
+// energySince returns the energy in joules used since `last`, across the counters of both.
+func energySince(last map[string]raplCounter, counters map[string]raplCounter) float64 {
+	var microjoules uint64
+	for name, counter := range counters {
+		previous, ok := last[name]
+		if !ok {
+			continue
+		}
+		if counter.energy >= previous.energy {
+			microjoules += counter.energy - previous.energy
+		} else {
+			microjoules += counter.maxRange - previous.energy + counter.energy
+		}
+	}
+	return float64(microjoules) / 1e6
+}
+
+// sample adds the usage since the previous sample of the VMs whose hypervisors run as `pids`,
+// keyed by qualified VM name, and forgets VMs that weren't seen for `retention`.
+func (u *usageTracker) sample(now time.Time, pids map[string]int, retention time.Duration) error {
+	busy, _, err := readCPUCounters()
+	if err != nil {
+		return err
+	}
+	energy, err := readRAPLEnergy()
+	if err != nil {
+		// Typically because the counters are only readable by root.
+		log.WithError(err).Debug("Failed to read RAPL energy counters")
+		energy = nil
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	var busyTicks uint64
+	if u.lastCPUBusy != 0 && busy > u.lastCPUBusy {
+		busyTicks = busy - u.lastCPUBusy
+	}
+	u.lastCPUBusy = busy
+	joules := energySince(u.lastEnergy, energy)
+	u.lastEnergy = energy
+
+	for _, usage := range u.state.VMs {
+		usage.running = false
+	}
+	ticks := make(map[string]uint64, len(pids))
+	var vmTicks uint64
+	for name, pid := range pids {
+		cpu, startTime, err := readProcessCPU(pid)
+		if err != nil {
+			// The VM stopped since it was listed.
+			continue
+		}
+		usage, ok := u.state.VMs[name]
+		if !ok {
+			usage = &vmUsage{FirstSeen: now.UTC()}
+			u.state.VMs[name] = usage
+		}
+		delta := cpu
+		if usage.PID == pid && usage.StartTime == startTime && cpu >= usage.Ticks {
+			delta = cpu - usage.Ticks
+		}
+		usage.PID, usage.StartTime, usage.Ticks = pid, startTime, cpu
+		usage.CPUSeconds += float64(delta) / userHZ
+		usage.LastSeen = now.UTC()
+		usage.running = true
+		ticks[name] = delta
+		vmTicks += delta
+	}
+
+	if joules > 0 {
+		u.state.HostEnergyJoules += joules
+		// Each VM gets the share of the energy that its CPU time is of the host's busy CPU time,
+		// leaving the host's idle power and other processes' share unattributed. The ticks of
+		// processes new since the previous sample may predate it, so never attribute more than all.
+		if total := max(busyTicks, vmTicks); total > 0 {
+			for name, delta := range ticks {
+				u.state.VMs[name].EnergyJoules += joules * float64(delta) / float64(total)
+			}
+		}
+	}
+
+	cutoff := now.Add(-retention)
+	for name, usage := range u.state.VMs {
+		if !usage.running && usage.LastSeen.Before(cutoff) {
+			delete(u.state.VMs, name)
+		}
+	}
+	return u.saveLocked()
+}
+
+// saveLocked writes the usage out, replacing the file atomically.
+func (u *usageTracker) saveLocked() error {
+	data, err := json.Marshal(u.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), filepath.Base(u.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save VM usage: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save VM usage: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save VM usage: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), u.path); err != nil {
+		return fmt.Errorf("failed to save VM usage: %w", err)
+	}
+	return nil
+}
+
+// report returns the usage of every VM seen, sorted by qualified name.
+func (u *usageTracker) report(now time.Time) *serverapi.UsageReport {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	measured := len(u.lastEnergy) > 0 || u.state.HostEnergyJoules > 0
+	resp := &serverapi.UsageReport{
+		GeneratedAt:  serverapi.PtrTime(now.UTC()),
+		Since:        serverapi.PtrTime(u.state.Since),
+		EnergySource: serverapi.PtrString(""),
+		Vms:          []serverapi.VmUsage{},
+	}
+	if measured {
+		resp.EnergySource = serverapi.PtrString(energySourceRAPL)
+		resp.HostEnergyJoules = serverapi.PtrFloat64(u.state.HostEnergyJoules)
+	}
+	for _, name := range slices.Sorted(maps.Keys(u.state.VMs)) {
+		usage := u.state.VMs[name]
+		namespace, vmName := SplitQualifiedName(name)
+		vm := serverapi.VmUsage{
+			Namespace:   serverapi.PtrString(namespace),
+			VmName:      serverapi.PtrString(vmName),
+			Running:     serverapi.PtrBool(usage.running),
+			CpuSeconds:  serverapi.PtrFloat64(usage.CPUSeconds),
+			FirstSeenAt: serverapi.PtrTime(usage.FirstSeen),
+			LastSeenAt:  serverapi.PtrTime(usage.LastSeen),
+		}
+		if measured {
+			vm.EnergyJoules = serverapi.PtrFloat64(usage.EnergyJoules)
+		}
+		resp.Vms = append(resp.Vms, vm)
+	}
+	return resp
+}
+
+// runUsageSampler samples the usage of the VMs every usage sample interval, forever.
+func (s *Server) runUsageSampler() {
+	for {
+		pids := make(map[string]int)
+		s.lock.RLock()
+		for name, vm := range s.vms {
+			if vm.process != nil {
+				pids[name] = vm.process.Pid
+			}
+		}
+		s.lock.RUnlock()
+		_, retention := s.capacityIntervals()
+		if err := s.usage.sample(time.Now(), pids, retention); err != nil {
+			log.WithError(err).Warn("Failed to sample VM usage")
+		}
+		time.Sleep(usageSampleInterval)
+	}
+}
+
+// UsageReport returns the CPU time and energy used by every VM seen within the capacity retention.
+func (s *Server) UsageReport() *serverapi.UsageReport {
+	return s.usage.report(time.Now())
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names end up in mux routes, paths under the state dir and, qualified with their namespace,
+// guest hostnames.
+const maxVMNameLength = 63
+
+// Letters, digits, '-' and '_', starting and ending with a letter or digit. No '.', which
+// separates names from namespaces.
+var (
+	vmNameRegexp        = regexp.MustCompile(`^[a-zA-Z0-9]([-_a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+	vmNameInvalidRegexp = regexp.MustCompile(`[^-_a-zA-Z0-9]+`)
+)
+
+// ValidateVMName returns an InvalidArgument error if `name` can't be used for a new VM.
+func ValidateVMName(name string) error {
+	if name == "" {
+		return status.Error(codes.InvalidArgument, "vm name is required")
+	}
+	if len(name) > maxVMNameLength {
+		return status.Errorf(codes.InvalidArgument, "invalid vm name %q: longer than %d characters", name, maxVMNameLength)
+	}
+	if !vmNameRegexp.MatchString(name) {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"invalid vm name %q: must be letters, digits, '-' and '_', starting and ending with a letter or digit",
+			name,
+		)
+	}
+	return nil
+}
+
+// ValidateVMNamePrefix returns an InvalidArgument error if names generated from `prefix` with a
+// suffix of `suffixLength` characters wouldn't be valid.
+func ValidateVMNamePrefix(prefix string, suffixLength int) error {
+	if err := ValidateVMName(prefix + strings.Repeat("x", suffixLength)); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid vm name prefix %q: %s", prefix, status.Convert(err).Message())
+	}
+	return nil
+}
+
+// NormalizeVMName maps `name` onto the VM name grammar: runs of invalid characters, e.g. spaces,
+// slashes and dots, become '-', leading and trailing separators are dropped and the result is cut
+// to length. "my app/v1.2" becomes "my-app-v1-2". Names that are already valid are unchanged.
+func NormalizeVMName(name string) string {
+	name = vmNameInvalidRegexp.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-_")
+	if len(name) > maxVMNameLength {
+		name = strings.TrimRight(name[:maxVMNameLength], "-_")
+	}
+	return name
+}
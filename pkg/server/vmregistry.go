@@ -0,0 +1,496 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/out/gen/serverapi"
+)
+
+// Under the state dir. Only kept with high availability enabled, see leader.go.
+const vmRegistryFileName = "vms.json"
+
+// vmRecord is what a server that takes over the VMs of another needs to manage one of them.
+type vmRecord struct {
+	Name               string              `json:"name"`
+	GuestName          string              `json:"guestName"`
+	StateDir           string              `json:"stateDir"`
+	APISocket          string              `json:"apiSocket"`
+	PID                int                 `json:"pid"`
+	IP                 string              `json:"ip"`
+	MAC                string              `json:"mac,omitempty"`
+	NetworkMode        string              `json:"networkMode,omitempty"`
+	TapDevice          string              `json:"tapDevice"`
+	PortForwards       []vmRecordPort      `json:"portForwards,omitempty"`
+	VsockPath          string              `json:"vsockPath"`
+	CID                uint32              `json:"cid"`
+	StatefulDisk       string              `json:"statefulDisk"`
+	Status             vmStatus            `json:"status"`
+	Owner              string              `json:"owner,omitempty"`
+	SessionToken       string              `json:"sessionToken,omitempty"`
+	Protected          bool                `json:"protected,omitempty"`
+	Labels             map[string]string   `json:"labels,omitempty"`
+	Services           map[string]uint32   `json:"services,omitempty"`
+	CredentialProfiles []string            `json:"credentialProfiles,omitempty"`
+	StartedAt          time.Time           `json:"startedAt"`
+	Restart            *vmRecordRestart    `json:"restart,omitempty"`
+	Restarts           int32               `json:"restarts,omitempty"`
+	Disconnect         *vmRecordDisconnect `json:"disconnect,omitempty"`
+	Hooks              []vmRecordHook      `json:"hooks,omitempty"`
+	// Kept in the form of the API, which the policy is validated from again.
+	Egress       *serverapi.EgressPolicy `json:"egress,omitempty"`
+	NetworkLimit *vmRecordNetworkLimit   `json:"networkLimit,omitempty"`
+	SharedDirs   []vmRecordSharedDir     `json:"sharedDirs,omitempty"`
+	BaseImage    string                  `json:"baseImage,omitempty"`
+	DiskOverlay  bool                    `json:"diskOverlay,omitempty"`
+	DataDisks    []vmRecordDataDisk      `json:"dataDisks,omitempty"`
+	OOMPolicy    *serverapi.OomPolicy    `json:"oomPolicy,omitempty"`
+	OOMKills     int32                   `json:"oomKills,omitempty"`
+	Jail         *vmRecordJail           `json:"jail,omitempty"`
+	Cgroup       string                  `json:"cgroup,omitempty"`
+	DiskLimit    *vmRecordDiskLimit      `json:"diskLimit,omitempty"`
+}
+
+// vmRecordDiskLimit is a `diskLimit`.
+type vmRecordDiskLimit struct {
+	BytesPerSecond int64 `json:"bytesPerSecond,omitempty"`
+	IOPS           int32 `json:"iops,omitempty"`
+}
+
+func recordDiskLimit(l *diskLimit) *vmRecordDiskLimit {
+	if l == nil {
+		return nil
+	}
+	return &vmRecordDiskLimit{BytesPerSecond: l.bytesPerSecond, IOPS: l.iops}
+}
+
+func restoreDiskLimit(r *vmRecordDiskLimit) *diskLimit {
+	if r == nil {
+		return nil
+	}
+	return &diskLimit{bytesPerSecond: r.BytesPerSecond, iops: r.IOPS}
+}
+
+// vmRecordJail is a `jail`.
+type vmRecordJail struct {
+	Root   string   `json:"root"`
+	UID    int      `json:"uid"`
+	Cgroup string   `json:"cgroup"`
+	Bound  []string `json:"bound,omitempty"`
+}
+
+// vmRecordSharedDir is a `sharedDir`, with the PID of its virtiofsd.
+type vmRecordSharedDir struct {
+	HostPath  string `json:"hostPath"`
+	GuestPath string `json:"guestPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	Transport string `json:"transport,omitempty"`
+}
+
+// vmRecordDataDisk is a `dataDisk`.
+type vmRecordDataDisk struct {
+	Id        string             `json:"id"`
+	SizeBytes int64              `json:"sizeBytes,omitempty"`
+	Volume    string             `json:"volume,omitempty"`
+	Path      string             `json:"path"`
+	GuestPath string             `json:"guestPath,omitempty"`
+	ReadOnly  bool               `json:"readOnly,omitempty"`
+	Limit     *vmRecordDiskLimit `json:"limit,omitempty"`
+}
+
+// vmRecordNetworkLimit is a `networkLimit`.
+type vmRecordNetworkLimit struct {
+	IngressMbps int32 `json:"ingressMbps,omitempty"`
+	EgressMbps  int32 `json:"egressMbps,omitempty"`
+	IngressPPS  int32 `json:"ingressPps,omitempty"`
+	EgressPPS   int32 `json:"egressPps,omitempty"`
+}
+
+// vmRecordHook is a `hook`.
+type vmRecordHook struct {
+	Event   string        `json:"event"`
+	Command string        `json:"command"`
+	Guest   bool          `json:"guest,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// vmRecordDisconnect is a `disconnectPolicy`.
+type vmRecordDisconnect struct {
+	Action string        `json:"action"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+}
+
+type vmRecordPort struct {
+	HostPort    int32  `json:"hostPort"`
+	GuestPort   int32  `json:"guestPort"`
+	Description string `json:"description"`
+}
+
+// vmRecordRestart is a `restartSpec`.
+type vmRecordRestart struct {
+	Policy         string                   `json:"policy"`
+	MaxRestarts    int32                    `json:"maxRestarts,omitempty"`
+	Backoff        time.Duration            `json:"backoff"`
+	Request        serverapi.StartVMRequest `json:"request"`
+	ForkSnapshotID string                   `json:"forkSnapshotId,omitempty"`
+}
+
+// vmRegistry writes the VMs of the server to the state dir as they change, for a standby.
+type vmRegistry struct {
+	lock sync.Mutex
+	path string
+}
+
+// recordVMLocked returns the record of `vm`, nil if it isn't up and running. Must be called with
+// `s.lock` held.
+func recordVMLocked(vm *vm) *vmRecord {
+	switch vm.status {
+	case vmStatusRunning, vmStatusPaused, vmStatusStopped:
+	default:
+		return nil
+	}
+	if vm.process == nil || vm.ip == nil || vm.tapDevice == nil || vm.migrating {
+		return nil
+	}
+	record := &vmRecord{
+		Name:               vm.name,
+		GuestName:          vm.guestName,
+		StateDir:           vm.stateDirPath,
+		APISocket:          vm.apiSocketPath,
+		PID:                vm.process.Pid,
+		IP:                 vm.ip.String(),
+		MAC:                vm.mac,
+		NetworkMode:        vm.networkMode,
+		TapDevice:          vm.tapDevice.Name,
+		VsockPath:          vm.vsockPath,
+		CID:                vm.cid,
+		StatefulDisk:       vm.statefulDiskPath,
+		BaseImage:          vm.baseImage,
+		DiskOverlay:        vm.diskOverlay,
+		Status:             vm.status,
+		Owner:              vm.owner,
+		SessionToken:       vm.sessionToken,
+		Protected:          vm.protected,
+		Labels:             vm.labels,
+		Services:           vm.services,
+		CredentialProfiles: vm.credentialProfiles,
+		StartedAt:          vm.startedAt,
+		Restarts:           vm.restarts,
+		Egress:             convertEgressPolicy(vm.egress),
+	}
+	if l := vm.networkLimit; l != nil {
+		record.NetworkLimit = &vmRecordNetworkLimit{
+			IngressMbps: l.ingressMbps,
+			EgressMbps:  l.egressMbps,
+			IngressPPS:  l.ingressPPS,
+			EgressPPS:   l.egressPPS,
+		}
+	}
+	for _, d := range vm.sharedDirs {
+		r := vmRecordSharedDir{HostPath: d.hostPath, GuestPath: d.guestPath, ReadOnly: d.readOnly, Transport: d.transport}
+		if d.process != nil {
+			r.PID = d.process.Pid
+		}
+		record.SharedDirs = append(record.SharedDirs, r)
+	}
+	for _, d := range vm.dataDisks {
+		record.DataDisks = append(record.DataDisks, vmRecordDataDisk{
+			Id:        d.id,
+			SizeBytes: d.sizeBytes,
+			Volume:    d.volume,
+			Path:      d.path,
+			GuestPath: d.guestPath,
+			ReadOnly:  d.readOnly,
+			Limit:     recordDiskLimit(d.limit),
+		})
+	}
+	for _, pf := range vm.portForwards {
+		record.PortForwards = append(record.PortForwards, vmRecordPort{
+			HostPort:    pf.hostPort,
+			GuestPort:   pf.guestPort,
+			Description: pf.description,
+		})
+	}
+	if vm.disconnect != nil {
+		record.Disconnect = &vmRecordDisconnect{Action: vm.disconnect.action, TTL: vm.disconnect.ttl}
+	}
+	record.OOMPolicy = convertOOMPolicy(vm.oomPolicy)
+	record.OOMKills = vm.oomKills
+	record.Jail = recordJail(vm.jail)
+	record.Cgroup = vm.cgroup
+	record.DiskLimit = recordDiskLimit(vm.diskLimit)
+	for _, h := range vm.hooks {
+		record.Hooks = append(record.Hooks, vmRecordHook{
+			Event:   h.event,
+			Command: h.command,
+			Guest:   h.guest,
+			Timeout: h.timeout,
+		})
+	}
+	if vm.restart != nil {
+		record.Restart = &vmRecordRestart{
+			Policy:         vm.restart.policy.policy,
+			MaxRestarts:    vm.restart.policy.maxRestarts,
+			Backoff:        vm.restart.policy.backoff,
+			Request:        vm.restart.req,
+			ForkSnapshotID: vm.restart.forkSnapshotID,
+		}
+	}
+	return record
+}
+
+// saveVMRegistry writes out the VMs, if high availability is enabled. Failures are only logged, a
+// standby then takes over the VMs as they were at the last successful save.
+func (s *Server) saveVMRegistry() {
+	if s.registry == nil {
+		return
+	}
+	s.registry.lock.Lock()
+	defer s.registry.lock.Unlock()
+
+	s.lock.RLock()
+	records := make([]*vmRecord, 0, len(s.vms))
+	for _, vm := range s.vms {
+		if record := recordVMLocked(vm); record != nil {
+			records = append(records, record)
+		}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	s.lock.RUnlock()
+	if err != nil {
+		log.WithError(err).Error("failed to save VM registry")
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.registry.path), filepath.Base(s.registry.path)+".tmp*")
+	if err != nil {
+		log.WithError(err).Error("failed to save VM registry")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.registry.path)
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to save VM registry")
+	}
+}
+
+// loadLiveVMRecords returns the VMs in the registry of `stateDir` whose hypervisor still runs, e.g.
+// after the server that started them died.
+func loadLiveVMRecords(stateDir string) ([]*vmRecord, error) {
+	data, err := os.ReadFile(path.Join(stateDir, vmRegistryFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM registry: %w", err)
+	}
+	var records []*vmRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid VM registry: %w", err)
+	}
+
+	var live []*vmRecord
+	for _, record := range records {
+		if exited, _, _ := hypervisorExit(record.PID); exited {
+			log.WithField("vmName", record.Name).Warn("hypervisor of VM in registry is gone, not taking it over")
+			continue
+		}
+		// The PID may have been reused by now.
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", record.PID))
+		if err != nil || !strings.Contains(string(cmdline), record.APISocket) {
+			log.WithField("vmName", record.Name).Warn("hypervisor of VM in registry is gone, not taking it over")
+			continue
+		}
+		live = append(live, record)
+	}
+	return live, nil
+}
+
+// adoptVMs takes over the VMs of `records`, claiming their IPs, CIDs, host ports and tap devices,
+// as if this server had started them. VMs that can't be taken over are left alone. Returns how
+// many were taken over.
+func (s *Server) adoptVMs(records []*vmRecord) int {
+	adopted := 0
+	for _, record := range records {
+		logger := log.WithFields(log.Fields{"vmName": record.Name, "pid": record.PID})
+		vm, err := s.adoptVM(record)
+		if err != nil {
+			logger.WithError(err).Error("failed to take over VM")
+			continue
+		}
+		s.lock.Lock()
+		s.vms[record.Name] = vm
+		// Taken over even if the config has dropped the volume, which stays attached to the guest.
+		if err := s.claimVolumesLocked(record.Name, vm.dataDisks); err != nil {
+			logger.WithError(err).Warn("failed to claim volumes of VM")
+		}
+		s.lock.Unlock()
+		adopted++
+		logger.Info("took over VM")
+	}
+	return adopted
+}
+
+func (s *Server) adoptVM(record *vmRecord) (*vm, error) {
+	ip, ipNet, err := net.ParseCIDR(record.IP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP %s: %w", record.IP, err)
+	}
+	process, err := os.FindProcess(record.PID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ipAllocator.ClaimIP(ip, record.StateDir); err != nil {
+		return nil, err
+	}
+	if err := s.cidAllocator.ClaimCID(record.CID); err != nil {
+		s.ipAllocator.FreeIP(ip)
+		return nil, err
+	}
+	tapDevice, err := s.fountain.AdoptTapDevice(record.TapDevice)
+	if err != nil {
+		s.ipAllocator.FreeIP(ip)
+		s.cidAllocator.FreeCID(record.CID)
+		return nil, err
+	}
+	vm := &vm{
+		name:             record.Name,
+		guestName:        record.GuestName,
+		stateDirPath:     record.StateDir,
+		apiSocketPath:    record.APISocket,
+		apiClient:        createApiClient(record.APISocket),
+		process:          process,
+		ip:               &net.IPNet{IP: ip, Mask: ipNet.Mask},
+		mac:              record.MAC,
+		networkMode:      record.NetworkMode,
+		tapDevice:        tapDevice,
+		status:           record.Status,
+		vsockPath:        record.VsockPath,
+		cid:              record.CID,
+		statefulDiskPath: record.StatefulDisk,
+		baseImage:        record.BaseImage,
+		diskOverlay:      record.DiskOverlay,
+		owner:            record.Owner,
+		sessionToken:     record.SessionToken,
+		protected:        record.Protected,
+		labels:           record.Labels,
+		services:         record.Services,
+		startedAt:        record.StartedAt,
+		restarts:         record.Restarts,
+
+		credentialProfiles: record.CredentialProfiles,
+	}
+	// Records of older servers only have NAT VMs.
+	if vm.networkMode == "" {
+		vm.networkMode = networkModeNAT
+	}
+	for _, pf := range record.PortForwards {
+		// The forwarding rules outlive the server that added them.
+		if err := s.portAllocator.ClaimPort(pf.HostPort); err != nil {
+			log.WithField("vmName", record.Name).WithError(err).Warn("failed to claim forwarded port")
+			continue
+		}
+		vm.portForwards = append(vm.portForwards, portForward{
+			hostPort:    pf.HostPort,
+			guestPort:   pf.GuestPort,
+			description: pf.Description,
+		})
+	}
+	if d := record.Disconnect; d != nil {
+		vm.disconnect = &disconnectPolicy{action: d.Action, ttl: d.TTL}
+	}
+	vm.oomPolicy, err = newOOMPolicy(record.OOMPolicy)
+	if err != nil {
+		log.WithField("vmName", record.Name).WithError(err).Warn("failed to restore OOM policy")
+	}
+	vm.oomKills = record.OOMKills
+	// Kills of the hypervisor's cgroup while no server watched it are taken for the hypervisor's.
+	vm.hypervisorCgroup = hypervisorCgroup(record.PID)
+	vm.hypervisorOOMKills = cgroupOOMKills(vm.hypervisorCgroup)
+	vm.cgroup = record.Cgroup
+	vm.diskLimit = restoreDiskLimit(record.DiskLimit)
+	// The hypervisor keeps running in its jail, its user mustn't be handed to another.
+	if r := record.Jail; r != nil {
+		vm.jail = &jail{root: r.Root, uid: r.UID, cgroup: r.Cgroup, bound: make(map[string]bool)}
+		for _, p := range r.Bound {
+			vm.jail.bound[p] = true
+		}
+		s.lock.Lock()
+		s.jailUIDs[r.UID] = true
+		s.lock.Unlock()
+	}
+	for _, h := range record.Hooks {
+		vm.hooks = append(vm.hooks, hook{
+			event:   h.Event,
+			command: h.Command,
+			guest:   h.Guest,
+			timeout: h.Timeout,
+		})
+	}
+	if r := record.Restart; r != nil {
+		vm.restart = &restartSpec{
+			policy: restartPolicy{
+				policy:      r.Policy,
+				maxRestarts: r.MaxRestarts,
+				backoff:     r.Backoff,
+			},
+			req:            r.Request,
+			forkSnapshotID: r.ForkSnapshotID,
+		}
+	}
+	// Like the egress rules, the limits outlive the server that applied them.
+	if l := record.NetworkLimit; l != nil {
+		vm.networkLimit = &networkLimit{
+			ingressMbps: l.IngressMbps,
+			egressMbps:  l.EgressMbps,
+			ingressPPS:  l.IngressPPS,
+			egressPPS:   l.EgressPPS,
+		}
+	}
+	// The virtiofsds keep serving the guest, they're stopped along with it. Mounts over 9P were
+	// served by the previous server and went with it.
+	for _, r := range record.SharedDirs {
+		d := &sharedDir{hostPath: r.HostPath, guestPath: r.GuestPath, readOnly: r.ReadOnly, transport: r.Transport}
+		if r.PID != 0 {
+			d.process, _ = os.FindProcess(r.PID)
+		}
+		vm.sharedDirs = append(vm.sharedDirs, d)
+	}
+	for _, r := range record.DataDisks {
+		vm.dataDisks = append(vm.dataDisks, &dataDisk{
+			id:        r.Id,
+			sizeBytes: r.SizeBytes,
+			volume:    r.Volume,
+			path:      r.Path,
+			guestPath: r.GuestPath,
+			readOnly:  r.ReadOnly,
+			limit:     restoreDiskLimit(r.Limit),
+		})
+	}
+	// Its rules outlive the server that added them, the DNS proxy only needs the policy back.
+	if egress, err := newEgressPolicy(record.Egress, vm.networkMode); err != nil {
+		log.WithField("vmName", record.Name).WithError(err).Warn("failed to restore egress policy")
+	} else {
+		vm.egress = egress
+	}
+	return vm, nil
+}
@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Resource attributes starting with this are ours. Forwarded ones are dropped, so that the sender
+// can't pose as another VM.
+const forwardedAttributePrefix = "arrakis."
+
+// ErrInvalidExport is wrapped by the errors Forward returns for malformed export requests.
+var ErrInvalidExport = errors.New("invalid OTLP export request")
+
+// Top level keys of OTLP/HTTP JSON export requests, by the signal they carry.
+var resourceKeys = map[string]string{
+	"logs":    "resourceLogs",
+	"metrics": "resourceMetrics",
+}
+
+// Forwarder exports logs and metrics that were collected elsewhere, e.g. inside guests, as OTLP/HTTP
+// JSON, adding resource attributes to them. Unlike spans, they're sent right away, so that the
+// sender learns when the collector refused them.
+type Forwarder struct {
+	// Keyed by signal, "logs" or "metrics".
+	endpoints map[string]string
+	headers   map[string]string
+	client    *http.Client
+}
+
+// NewForwarder returns a forwarder exporting to the full OTLP/HTTP URLs `logsEndpoint` and
+// `metricsEndpoint`, sending `headers` with every export.
+func NewForwarder(logsEndpoint string, metricsEndpoint string, headers map[string]string) *Forwarder {
+	return &Forwarder{
+		endpoints: map[string]string{"logs": logsEndpoint, "metrics": metricsEndpoint},
+		headers:   headers,
+		client:    &http.Client{Timeout: exportTimeout},
+	}
+}
+
+// Forward exports `body`, an OTLP/HTTP JSON export request of `signal`, with `attrs` added to each
+// of its resources.
+func (f *Forwarder) Forward(ctx context.Context, signal string, body []byte, attrs []Attribute) error {
+	resourceKey, ok := resourceKeys[signal]
+	if !ok {
+		return fmt.Errorf("unknown signal %q", signal)
+	}
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return fmt.Errorf("%w of %s: %v", ErrInvalidExport, signal, err)
+	}
+	var resources []map[string]json.RawMessage
+	if data, ok := request[resourceKey]; ok {
+		if err := json.Unmarshal(data, &resources); err != nil {
+			return fmt.Errorf("%w of %s: %v", ErrInvalidExport, signal, err)
+		}
+	}
+	if len(resources) == 0 {
+		return nil
+	}
+
+	added := toOTLPAttributes(attrs)
+	for _, resource := range resources {
+		var fields map[string]json.RawMessage
+		if data, ok := resource["resource"]; ok {
+			if err := json.Unmarshal(data, &fields); err != nil {
+				return fmt.Errorf("%w, bad resource: %v", ErrInvalidExport, err)
+			}
+		}
+		if fields == nil {
+			fields = map[string]json.RawMessage{}
+		}
+		var attributes []json.RawMessage
+		if data, ok := fields["attributes"]; ok {
+			if err := json.Unmarshal(data, &attributes); err != nil {
+				return fmt.Errorf("%w, bad resource attributes: %v", ErrInvalidExport, err)
+			}
+		}
+		kept := make([]any, 0, len(attributes)+len(added))
+		for _, attribute := range attributes {
+			var kv struct {
+				Key string `json:"key"`
+			}
+			if err := json.Unmarshal(attribute, &kv); err != nil {
+				return fmt.Errorf("%w, bad resource attribute: %v", ErrInvalidExport, err)
+			}
+			if !strings.HasPrefix(kv.Key, forwardedAttributePrefix) {
+				kept = append(kept, attribute)
+			}
+		}
+		for _, kv := range added {
+			kept = append(kept, kv)
+		}
+		var err error
+		if fields["attributes"], err = json.Marshal(kept); err != nil {
+			return err
+		}
+		if resource["resource"], err = json.Marshal(fields); err != nil {
+			return err
+		}
+	}
+	var err error
+	if request[resourceKey], err = json.Marshal(resources); err != nil {
+		return err
+	}
+	if body, err = json.Marshal(request); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.endpoints[signal], bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range f.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %w", signal, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("collector returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/arrakis/pkg/config"
+)
+
+const (
+	// Spans are flushed to the collector when this many are buffered or when the flush interval
+	// elapses, whichever comes first.
+	maxBatchSize  = 512
+	maxQueueSize  = 4096
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+
+	defaultServiceName  = "arrakis-restserver"
+	instrumentationName = "github.com/abilashraghuram/arrakis"
+
+	traceparentHeader = "traceparent"
+)
+
+// SpanKind mirrors the OTLP span kind enum.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// statusCodeError is the OTLP status code for a failed span.
+const statusCodeError = 2
+
+// Attribute is a key/value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string valued attribute.
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer valued attribute.
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a boolean valued attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is a single timed operation. A nil *Span is valid and does nothing, which is what callers
+// get when tracing is disabled.
+type Span struct {
+	lock          sync.Mutex
+	traceID       [16]byte
+	spanID        [8]byte
+	parentSpanID  [8]byte
+	name          string
+	kind          SpanKind
+	start         time.Time
+	end           time.Time
+	attributes    []Attribute
+	statusCode    int
+	statusMessage string
+	ended         bool
+}
+
+type spanContextKey struct{}
+
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type remoteParentKey struct{}
+
+type exporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+var (
+	globalLock     sync.RWMutex
+	globalExporter *exporter
+)
+
+// Init configures the process wide exporter from `cfg`. When tracing is disabled this is a no-op
+// and all spans are dropped. The returned function flushes pending spans and stops the exporter.
+func Init(cfg config.TracingConfig) (func(context.Context) error, error) {
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("tracing enabled but no endpoint configured")
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	e := &exporter{
+		endpoint:    cfg.Endpoint,
+		headers:     cfg.Headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, maxQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go e.run()
+
+	globalLock.Lock()
+	globalExporter = e
+	globalLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"endpoint":    cfg.Endpoint,
+		"serviceName": serviceName,
+	}).Info("OTLP trace exporter started")
+
+	return func(ctx context.Context) error {
+		globalLock.Lock()
+		globalExporter = nil
+		globalLock.Unlock()
+
+		close(e.done)
+		select {
+		case <-e.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, nil
+}
+
+func getExporter() *exporter {
+	globalLock.RLock()
+	defer globalLock.RUnlock()
+	return globalExporter
+}
+
+// Start starts a new span named `name` as a child of the span in `ctx`, if any. The returned
+// context carries the new span.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return StartWithKind(ctx, name, SpanKindInternal, attrs...)
+}
+
+// StartWithKind is like Start but sets the span kind.
+func StartWithKind(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if getExporter() == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attrs,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentSpanID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+		span.traceID = remote.traceID
+		span.parentSpanID = remote.spanID
+	} else if err := newID(span.traceID[:]); err != nil {
+		log.WithError(err).WithField("span", name).Warn("Failed to generate trace ID, dropping span")
+		return ctx, nil
+	}
+	if err := newID(span.spanID[:]); err != nil {
+		log.WithError(err).WithField("span", name).Warn("Failed to generate span ID, dropping span")
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// newID fills `id` with a random trace or span ID. All-zero IDs are invalid, and collectors reject
+// spans carrying them.
+func newID(id []byte) error {
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	for _, b := range id {
+		if b != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("generated an all-zero ID")
+}
+
+// FromContext returns the active span in `ctx` or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes = append(s.attributes, attrs...)
+}
+
+// RecordError marks the span as failed with the given error. A nil error is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusCode = statusCodeError
+	s.statusMessage = err.Error()
+}
+
+// End finishes the span and queues it for export. Calling End more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.lock.Unlock()
+
+	e := getExporter()
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		log.WithField("span", s.name).Debug("trace export queue full, dropping span")
+	}
+}
+
+// TraceID returns the hex encoded trace ID of the span or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Inject writes the W3C trace context of the active span in `ctx` into `header`.
+func Inject(ctx context.Context, header http.Header) {
+	span := FromContext(ctx)
+	if span == nil {
+		return
+	}
+	header.Set(
+		traceparentHeader,
+		fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(span.traceID[:]), hex.EncodeToString(span.spanID[:])),
+	)
+}
+
+// Extract returns a context whose next span continues the W3C trace context found in `header`.
+// Malformed or missing headers leave `ctx` unchanged.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	parts := strings.Split(header.Get(traceparentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+
+	var parent remoteParent
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	// W3C trace context has all-zero IDs invalid; start a new trace instead.
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParentKey{}, parent)
+}
+
+func (e *exporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			log.WithError(err).Warnf("failed to export %d spans", len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			// Drain whatever is left in the queue before exiting.
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// The types below are the subset of the OTLP/HTTP JSON encoding that we emit.
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPAttributes(attrs []Attribute) []otlpKeyValue {
+	result := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kv := otlpKeyValue{Key: attr.Key}
+		switch v := attr.Value.(type) {
+		case string:
+			kv.Value.StringValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			kv.Value.IntValue = &s
+		case bool:
+			kv.Value.BoolValue = &v
+		default:
+			s := fmt.Sprintf("%v", v)
+			kv.Value.StringValue = &s
+		}
+		result = append(result, kv)
+	}
+	return result
+}
+
+func (e *exporter) export(spans []*Span) error {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = instrumentationName
+	for _, s := range spans {
+		s.lock.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              int(s.kind),
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        toOTLPAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+		}
+		if s.parentSpanID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+		}
+		s.lock.Unlock()
+		scope.Spans = append(scope.Spans, out)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = toOTLPAttributes([]Attribute{String("service.name", e.serviceName)})
+
+	body, err := json.Marshal(otlpExportRequest{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
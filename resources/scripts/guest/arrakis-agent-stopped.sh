@@ -0,0 +1,26 @@
+#!/bin/sh
+#
+# Run by systemd after an Arrakis agent, e.g. arrakis-cmdserver, stops (ExecStopPost=). If the agent
+# failed, this records why, and the vsockserver's watchdog reports the crash to the host. systemd
+# then restarts the agent.
+#
+# Usage: arrakis-agent-stopped <unit>
+
+CRASH_DIR=/run/arrakis/agent-crashes
+
+# Clean stops, e.g. at shutdown, aren't crashes.
+if [ -z "$SERVICE_RESULT" ] || [ "$SERVICE_RESULT" = "success" ]; then
+    exit 0
+fi
+
+mkdir -p "$CRASH_DIR"
+FILE="$CRASH_DIR/$1.$(date +%s%N)"
+# Renamed into place so that the watchdog never reads half a record.
+cat > "$FILE.tmp" <<RECORD
+agent=${1%.service}
+result=$SERVICE_RESULT
+exitCode=$EXIT_CODE
+exitStatus=$EXIT_STATUS
+crashedAt=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+RECORD
+mv "$FILE.tmp" "$FILE"
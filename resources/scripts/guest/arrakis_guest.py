@@ -0,0 +1,296 @@
+#!/usr/bin/env python3
+"""
+Arrakis Guest SDK
+
+This module lets code running inside an Arrakis VM invoke callbacks on the host
+client, report its progress and publish the files it produced. It talks to the
+vsockserver in the guest with the same CALL and REPORT commands as
+arrakis-call and the Go guestcall package, and needs nothing beyond the
+standard library.
+
+Usage:
+    import arrakis_guest
+
+    # Invoke a callback; the result is whatever the client handler returns
+    result = arrakis_guest.call("process_data", {"input": "hello", "count": 5})
+
+    # Report progress, published on the host's events stream as vm.progress and
+    # pushed to the client answering the VM's callbacks
+    arrakis_guest.progress("indexing files", percent=40)
+
+    # Let the client know a long task is alive while it has nothing new to say
+    with arrakis_guest.Heartbeat(interval=10, task="build"):
+        run_build()
+
+    # Publish a file, announced as vm.artifact; the host downloads it with
+    # GET /v1/vms/<name>/files?paths=<path>
+    arrakis_guest.publish_artifact("/tmp/report.html", content_type="text/html")
+"""
+
+import hashlib
+import json
+import os
+import random
+import socket
+import threading
+import time
+from typing import Any, Dict, Optional
+
+
+# vsock server port (must match the vsockserver's port)
+VSOCK_PORT = 4032
+
+# The vsockserver runs in this guest, which vsock calls the local CID
+VSOCK_LOCAL_CID = 1
+
+DEFAULT_TIMEOUT = 30.0
+DEFAULT_RETRIES = 3
+INITIAL_BACKOFF = 0.2
+MAX_BACKOFF = 5.0
+
+
+class CallbackError(Exception):
+    """
+    Raised when a callback or report fails.
+
+    Attributes:
+        method: The callback method, or "report <type>" for reports.
+        message: Why it failed.
+        retryable: True if it never reached the host, so that sending it again
+            may succeed. Such failures are already retried before this is
+            raised.
+        code: Set if the vsockserver refused it, e.g. "rate_limited" or
+            "too_many_connections".
+    """
+
+    def __init__(self, method: str, message: str, retryable: bool = False, code: str = ""):
+        super().__init__(f"callback {method} failed: {message}")
+        self.method = method
+        self.message = message
+        self.retryable = retryable
+        self.code = code
+
+
+def _send_once(what: str, command: str, payload: dict, timeout: float) -> Any:
+    try:
+        sock = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+        sock.settimeout(timeout)
+        sock.connect((VSOCK_LOCAL_CID, VSOCK_PORT))
+    except OSError as e:
+        # Nothing was sent, so trying again is safe
+        raise CallbackError(what, f"failed to connect to vsockserver: {e}", retryable=True)
+
+    try:
+        line = f"{command} {json.dumps(payload, separators=(',', ':'))}\n"
+        sock.sendall(line.encode("utf-8"))
+
+        response = b""
+        while not response.endswith(b"\n"):
+            chunk = sock.recv(65536)
+            if not chunk:
+                break
+            response += chunk
+    except socket.timeout:
+        raise CallbackError(what, f"timed out after {timeout}s")
+    except OSError as e:
+        raise CallbackError(what, str(e))
+    finally:
+        sock.close()
+
+    try:
+        resp = json.loads(response.decode("utf-8"))
+    except ValueError:
+        raise CallbackError(what, f"invalid response from vsockserver: {response!r}")
+    error = resp.get("error")
+    if error:
+        raise CallbackError(
+            what,
+            error.get("message", ""),
+            bool(error.get("retryable")),
+            error.get("code", ""),
+        )
+    return resp.get("result")
+
+
+def _send(what: str, command: str, make_payload, timeout: float, retries: int) -> Any:
+    retry = 0
+    while True:
+        try:
+            return _send_once(what, command, make_payload(timeout), timeout)
+        except CallbackError as e:
+            if not e.retryable or retry >= retries:
+                raise
+        retry += 1
+        # Exponential backoff with jitter, like the Go client
+        backoff = min(INITIAL_BACKOFF * 2 ** (retry - 1), MAX_BACKOFF)
+        time.sleep(backoff / 2 + random.uniform(0, backoff / 2))
+
+
+def call(
+    method: str,
+    params: Optional[Any] = None,
+    timeout: float = DEFAULT_TIMEOUT,
+    retries: int = DEFAULT_RETRIES,
+) -> Any:
+    """
+    Invoke a callback on the host client.
+
+    Callbacks are only sent again if they never reached the host, e.g. because
+    the vsockserver is still starting, since the tools they invoke may not be
+    safe to run twice.
+
+    Args:
+        method: The callback method name to invoke on the client.
+        params: Optional JSON-serializable parameters to pass to the callback.
+        timeout: How long each attempt may take, in seconds.
+        retries: How often to retry callbacks that didn't reach the host.
+
+    Returns:
+        The result from the client's callback handler, decoded from JSON.
+
+    Raises:
+        CallbackError: If the callback fails.
+    """
+    if not method or " " in method or "\n" in method:
+        raise ValueError(f"invalid callback method {method!r}")
+
+    def payload(attempt_timeout: float) -> dict:
+        request = {"method": method, "timeoutMs": int(attempt_timeout * 1000)}
+        if params is not None:
+            request["params"] = params
+        return request
+
+    return _send(method, "CALL", payload, timeout, retries)
+
+
+def report(
+    report_type: str,
+    data: Optional[Dict[str, Any]] = None,
+    timeout: float = DEFAULT_TIMEOUT,
+    retries: int = DEFAULT_RETRIES,
+) -> None:
+    """
+    Send a report about this VM's work to the host, which publishes it on its
+    events stream as "vm.<report_type>". Progress and heartbeats are also pushed
+    to the client answering the VM's callbacks, which doesn't answer them.
+
+    Args:
+        report_type: "progress", "artifact" or "heartbeat". Heartbeats aren't
+            published on the events stream.
+        data: Event data. Values are converted to strings.
+
+    Raises:
+        CallbackError: If the report fails.
+    """
+    payload = {"type": report_type}
+    if data:
+        payload["data"] = {str(k): str(v) for k, v in data.items() if v is not None}
+    _send(f"report {report_type}", "REPORT", lambda _: payload, timeout, retries)
+
+
+def progress(message: str, percent: Optional[float] = None, **fields: Any) -> None:
+    """
+    Report progress, e.g. progress("indexing files", percent=40, files=1200).
+
+    Args:
+        message: What the VM is doing.
+        percent: Optional completion between 0 and 100.
+        **fields: Any other details to include in the event.
+    """
+    data = dict(fields)
+    data["message"] = message
+    if percent is not None:
+        data["percent"] = f"{max(0.0, min(100.0, float(percent))):g}"
+    report("progress", data)
+
+
+def heartbeat(**fields: Any) -> None:
+    """
+    Tell the client that a long-running task is still alive, e.g.
+    heartbeat(task="build").
+
+    Args:
+        **fields: Any details to include in the message.
+    """
+    report("heartbeat", fields)
+
+
+class Heartbeat:
+    """
+    Sends a heartbeat every `interval` seconds while the block runs:
+
+        with Heartbeat(interval=10, task="build"):
+            run_build()
+
+    Heartbeats that fail are dropped, the next one is sent on time anyway.
+    """
+
+    def __init__(self, interval: float = 10.0, **fields: Any):
+        self.interval = interval
+        self.fields = fields
+        self._stop = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    def _run(self) -> None:
+        while not self._stop.wait(self.interval):
+            try:
+                report("heartbeat", self.fields, timeout=self.interval, retries=0)
+            except CallbackError:
+                pass
+
+    def start(self) -> "Heartbeat":
+        self._thread = threading.Thread(target=self._run, name="arrakis-heartbeat", daemon=True)
+        self._thread.start()
+        return self
+
+    def stop(self) -> None:
+        self._stop.set()
+        if self._thread is not None:
+            self._thread.join()
+            self._thread = None
+
+    def __enter__(self) -> "Heartbeat":
+        return self.start()
+
+    def __exit__(self, *exc: Any) -> None:
+        self.stop()
+
+
+def publish_artifact(
+    path: str,
+    name: Optional[str] = None,
+    content_type: Optional[str] = None,
+) -> Dict[str, str]:
+    """
+    Announce a file this VM produced, so that the host can download it with
+    GET /v1/vms/<name>/files?paths=<path>. The file must stay in place until
+    then.
+
+    Args:
+        path: Path of the file in the guest.
+        name: Name to show for the artifact, defaults to the file name.
+        content_type: Optional MIME type of the file.
+
+    Returns:
+        The data of the vm.artifact event: path, name, size and sha256.
+
+    Raises:
+        FileNotFoundError: If the file doesn't exist.
+        CallbackError: If the report fails.
+    """
+    path = os.path.abspath(path)
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(1 << 20), b""):
+            digest.update(chunk)
+
+    data = {
+        "path": path,
+        "name": name or os.path.basename(path),
+        "size": str(os.path.getsize(path)),
+        "sha256": digest.hexdigest(),
+    }
+    if content_type:
+        data["contentType"] = content_type
+    report("artifact", data)
+    return data